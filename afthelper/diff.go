@@ -0,0 +1,437 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package afthelper
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+)
+
+// ChangeType describes how an entry, or a member of a next-hop-group, differs
+// between two snapshots.
+type ChangeType int64
+
+const (
+	_ ChangeType = iota
+	// EntryAdded indicates that the entry is only present in the later snapshot.
+	EntryAdded
+	// EntryRemoved indicates that the entry is only present in the earlier
+	// snapshot.
+	EntryRemoved
+	// EntryModified indicates that the entry is present in both snapshots, with
+	// different contents.
+	EntryModified
+)
+
+func (c ChangeType) String() string {
+	return map[ChangeType]string{
+		EntryAdded:    "added",
+		EntryRemoved:  "removed",
+		EntryModified: "modified",
+	}[c]
+}
+
+// SnapshotDiff describes the differences between two snapshots of the AFTs of
+// a device.
+type SnapshotDiff struct {
+	// Entries are the entries that differ between the snapshots, ordered by
+	// network instance, AFT and key.
+	Entries []*EntryDiff
+}
+
+// EntryDiff describes an entry that differs between two snapshots.
+type EntryDiff struct {
+	// Type is the way in which the entry differs.
+	Type ChangeType
+	// NetworkInstance is the network instance that the entry is within.
+	NetworkInstance string
+	// AFT is the AFT that the entry is within.
+	AFT constants.AFT
+	// Key is the key of the entry within the AFT. Prefixes are specified in
+	// their canonical form, as returned by CanonicalPrefix.
+	Key string
+	// Fields are the fields of a modified entry whose value differs, ordered by
+	// path. The membership of next-hop-groups is described by Members.
+	Fields []*FieldDiff
+	// Members are the next-hops of a modified next-hop-group that were added,
+	// removed, or whose weight differs, ordered by index.
+	Members []*MemberDiff
+}
+
+// FieldDiff describes a field of an entry whose value differs between two
+// snapshots.
+type FieldDiff struct {
+	// Path is the path of the field, relative to the entry.
+	Path string
+	// Before and After are the values of the field in each snapshot. They
+	// are empty if the field is not set.
+	Before, After string
+}
+
+// MemberDiff describes a next-hop within a next-hop-group that differs between
+// two snapshots.
+type MemberDiff struct {
+	// Type is the way in which the member differs.
+	Type ChangeType
+	// Index is the index of the next-hop.
+	Index uint64
+	// BeforeWeight and AfterWeight are the weight of the next-hop in each
+	// snapshot. The weight is zero in a snapshot that the member is not
+	// present in.
+	BeforeWeight, AfterWeight uint64
+}
+
+// Empty returns true if the snapshots that were compared contain the same
+// entries.
+func (d *SnapshotDiff) Empty() bool {
+	return d == nil || len(d.Entries) == 0
+}
+
+// String returns a human-readable description of the differences between the
+// snapshots, with one line per entry followed by any field and member changes.
+func (d *SnapshotDiff) String() string {
+	if d.Empty() {
+		return "no differences"
+	}
+	b := &bytes.Buffer{}
+	for _, e := range d.Entries {
+		b.WriteString(e.String())
+	}
+	return b.String()
+}
+
+// String returns a human-readable description of the changes to the entry.
+func (e *EntryDiff) String() string {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "%s %s %s in NI %s\n", e.AFT, e.Key, e.Type, e.NetworkInstance)
+	for _, f := range e.Fields {
+		fmt.Fprintf(b, "\t%s: %q -> %q\n", f.Path, f.Before, f.After)
+	}
+	for _, m := range e.Members {
+		switch m.Type {
+		case EntryAdded:
+			fmt.Fprintf(b, "\tnext-hop %d added with weight %d\n", m.Index, m.AfterWeight)
+		case EntryRemoved:
+			fmt.Fprintf(b, "\tnext-hop %d removed, had weight %d\n", m.Index, m.BeforeWeight)
+		default:
+			fmt.Fprintf(b, "\tnext-hop %d weight: %d -> %d\n", m.Index, m.BeforeWeight, m.AfterWeight)
+		}
+	}
+	return b.String()
+}
+
+// diffKey uniquely identifies an entry within a snapshot.
+type diffKey struct {
+	ni  string
+	aft constants.AFT
+	key string
+}
+
+// DiffSnapshots compares the AFTs within the before and after snapshots, keyed
+// by network instance name, and returns the entries that were added, removed
+// or modified between them. Prefixes are compared in their canonical form,
+// such that 1.1.1.0/24 and 01.1.1.0/24 are the same entry, and the ordering of
+// entries within the snapshots is not significant.
+//
+// The snapshots can be created from the results of the Get RPC using
+// rib.FromGetResponses. An error is returned if a snapshot contains two
+// entries whose keys are the same once normalised.
+func DiffSnapshots(before, after map[string]*aft.RIB) (*SnapshotDiff, error) {
+	b, err := snapshotEntries(before)
+	if err != nil {
+		return nil, fmt.Errorf("invalid before snapshot, %v", err)
+	}
+	a, err := snapshotEntries(after)
+	if err != nil {
+		return nil, fmt.Errorf("invalid after snapshot, %v", err)
+	}
+
+	keys := []diffKey{}
+	for k := range b {
+		keys = append(keys, k)
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		switch {
+		case keys[i].ni != keys[j].ni:
+			return keys[i].ni < keys[j].ni
+		case keys[i].aft != keys[j].aft:
+			return keys[i].aft < keys[j].aft
+		default:
+			return keys[i].key < keys[j].key
+		}
+	})
+
+	d := &SnapshotDiff{}
+	for _, k := range keys {
+		e := &EntryDiff{NetworkInstance: k.ni, AFT: k.aft, Key: k.key}
+		be, inBefore := b[k]
+		ae, inAfter := a[k]
+		switch {
+		case !inBefore:
+			e.Type = EntryAdded
+		case !inAfter:
+			e.Type = EntryRemoved
+		default:
+			e.Type = EntryModified
+			if e.Fields, err = fieldDiffs(k.aft, be, ae); err != nil {
+				return nil, fmt.Errorf("cannot compare %s %s in NI %s, %v", k.aft, k.key, k.ni, err)
+			}
+			if k.aft == constants.NextHopGroup {
+				e.Members = memberDiffs(be.(*aft.Afts_NextHopGroup), ae.(*aft.Afts_NextHopGroup))
+			}
+			if len(e.Fields) == 0 && len(e.Members) == 0 {
+				continue
+			}
+		}
+		d.Entries = append(d.Entries, e)
+	}
+	return d, nil
+}
+
+// snapshotEntries returns the entries within the snapshot s keyed by their
+// normalised key.
+func snapshotEntries(s map[string]*aft.RIB) (map[diffKey]ygot.GoStruct, error) {
+	ents := map[diffKey]ygot.GoStruct{}
+	add := func(k diffKey, e ygot.GoStruct) error {
+		if _, ok := ents[k]; ok {
+			return fmt.Errorf("duplicate %s entry %s in NI %s", k.aft, k.key, k.ni)
+		}
+		ents[k] = e
+		return nil
+	}
+
+	for ni, r := range s {
+		a := r.GetAfts()
+		for p, e := range a.Ipv4Entry {
+			if err := add(diffKey{ni: ni, aft: constants.IPv4, key: CanonicalPrefix(p)}, e); err != nil {
+				return nil, err
+			}
+		}
+		for p, e := range a.Ipv6Entry {
+			if err := add(diffKey{ni: ni, aft: constants.IPv6, key: CanonicalPrefix(p)}, e); err != nil {
+				return nil, err
+			}
+		}
+		for l, e := range a.LabelEntry {
+			if err := add(diffKey{ni: ni, aft: constants.MPLS, key: fmt.Sprintf("%v", l)}, e); err != nil {
+				return nil, err
+			}
+		}
+		for id, e := range a.NextHopGroup {
+			if err := add(diffKey{ni: ni, aft: constants.NextHopGroup, key: strconv.FormatUint(id, 10)}, e); err != nil {
+				return nil, err
+			}
+		}
+		for idx, e := range a.NextHop {
+			if err := add(diffKey{ni: ni, aft: constants.NextHop, key: strconv.FormatUint(idx, 10)}, e); err != nil {
+				return nil, err
+			}
+		}
+		for idx, e := range a.PolicyForwardingEntry {
+			if err := add(diffKey{ni: ni, aft: constants.PolicyForwarding, key: strconv.FormatUint(idx, 10)}, e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ents, nil
+}
+
+// keyLeaves are the paths of the leaves that form the key of the entries
+// within each AFT. They are excluded from the field comparison, since entries
+// are matched using their normalised key.
+var keyLeaves = map[constants.AFT]string{
+	constants.IPv4:             "/prefix",
+	constants.IPv6:             "/prefix",
+	constants.MPLS:             "/label",
+	constants.NextHopGroup:     "/id",
+	constants.NextHop:          "/index",
+	constants.PolicyForwarding: "/index",
+}
+
+// fieldDiffs returns the fields of the entries before and after, which are
+// within the AFT a, whose values differ. The members of next-hop-groups are
+// not included.
+func fieldDiffs(a constants.AFT, before, after ygot.GoStruct) ([]*FieldDiff, error) {
+	opt := &ygot.DiffPathOpt{MapToSinglePath: true}
+	fwd, err := ygot.Diff(before, after, opt)
+	if err != nil {
+		return nil, err
+	}
+	rev, err := ygot.Diff(after, before, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]*FieldDiff{}
+	field := func(p *gpb.Path) (*FieldDiff, error) {
+		s, err := ygot.PathToString(p)
+		if err != nil {
+			return nil, err
+		}
+		if s == keyLeaves[a] || strings.HasPrefix(s, "/next-hops/") {
+			return nil, nil
+		}
+		if _, ok := fields[s]; !ok {
+			fields[s] = &FieldDiff{Path: s}
+		}
+		return fields[s], nil
+	}
+	// The updates in the forward diff carry the values after the change, and
+	// those in the reverse diff carry the values before it. Deleted fields are
+	// left empty.
+	for _, u := range fwd.GetUpdate() {
+		f, err := field(u.GetPath())
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			f.After = typedValueString(u.GetVal())
+		}
+	}
+	for _, u := range rev.GetUpdate() {
+		f, err := field(u.GetPath())
+		if err != nil {
+			return nil, err
+		}
+		if f != nil {
+			f.Before = typedValueString(u.GetVal())
+		}
+	}
+
+	ret := []*FieldDiff{}
+	for _, f := range fields {
+		ret = append(ret, f)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Path < ret[j].Path })
+	return ret, nil
+}
+
+// typedValueString returns the value v as a string.
+func typedValueString(v *gpb.TypedValue) string {
+	switch t := v.GetValue().(type) {
+	case *gpb.TypedValue_StringVal:
+		return t.StringVal
+	case *gpb.TypedValue_UintVal:
+		return strconv.FormatUint(t.UintVal, 10)
+	case *gpb.TypedValue_IntVal:
+		return strconv.FormatInt(t.IntVal, 10)
+	case *gpb.TypedValue_BoolVal:
+		return strconv.FormatBool(t.BoolVal)
+	case *gpb.TypedValue_BytesVal:
+		return fmt.Sprintf("%x", t.BytesVal)
+	case *gpb.TypedValue_LeaflistVal:
+		vals := []string{}
+		for _, e := range t.LeaflistVal.GetElement() {
+			vals = append(vals, typedValueString(e))
+		}
+		return fmt.Sprintf("[%s]", strings.Join(vals, ", "))
+	}
+	return fmt.Sprintf("%v", v.GetValue())
+}
+
+// memberDiffs returns the next-hops of the next-hop-groups before and after
+// that were added, removed, or whose weight differs.
+func memberDiffs(before, after *aft.Afts_NextHopGroup) []*MemberDiff {
+	idx := map[uint64]bool{}
+	for i := range before.NextHop {
+		idx[i] = true
+	}
+	for i := range after.NextHop {
+		idx[i] = true
+	}
+
+	ret := []*MemberDiff{}
+	for i := range idx {
+		b, inBefore := before.NextHop[i]
+		a, inAfter := after.NextHop[i]
+		m := &MemberDiff{Index: i, BeforeWeight: b.GetWeight(), AfterWeight: a.GetWeight()}
+		switch {
+		case !inBefore:
+			m.Type = EntryAdded
+		case !inAfter:
+			m.Type = EntryRemoved
+		case m.BeforeWeight != m.AfterWeight:
+			m.Type = EntryModified
+		default:
+			continue
+		}
+		ret = append(ret, m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Index < ret[j].Index })
+	return ret
+}
+
+// CanonicalPrefix returns the canonical form of the IPv4 or IPv6 prefix p, with
+// the host bits of the address masked, such that prefixes that are written
+// differently but are semantically equal - for example, 1.1.1.0/24 and
+// 01.1.1.0/24 - have the same canonical form. If p is not a valid prefix, it is
+// returned unmodified.
+func CanonicalPrefix(p string) string {
+	addr, bits, ok := strings.Cut(p, "/")
+	if !ok {
+		return p
+	}
+	l, err := strconv.Atoi(bits)
+	if err != nil {
+		return p
+	}
+	a, err := netip.ParseAddr(addr)
+	if err != nil {
+		// IPv4 addresses with leading zeros in their octets are rejected by
+		// netip, since they are ambiguous in some contexts, but they are
+		// decimal within an AFT.
+		if a, ok = parseDecimalIPv4(addr); !ok {
+			return p
+		}
+	}
+	pfx := netip.PrefixFrom(a, l).Masked()
+	if !pfx.IsValid() {
+		return p
+	}
+	return pfx.String()
+}
+
+// parseDecimalIPv4 parses the dotted-decimal IPv4 address s, allowing leading
+// zeros within each octet.
+func parseDecimalIPv4(s string) (netip.Addr, bool) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return netip.Addr{}, false
+	}
+	var b [4]byte
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 8)
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		b[i] = byte(v)
+	}
+	return netip.AddrFrom4(b), true
+}
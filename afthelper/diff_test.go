@@ -0,0 +1,266 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package afthelper
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+)
+
+// diffRIB returns a RIB in which the prefix p uses next-hop-group 1, which
+// contains next-hops 1 and 2 with weights 1 and 2 respectively.
+func diffRIB(p string) *aft.RIB {
+	r := &aft.RIB{}
+	r.GetOrCreateAfts().GetOrCreateIpv4Entry(p).NextHopGroup = ygot.Uint64(1)
+	nhg := r.GetOrCreateAfts().GetOrCreateNextHopGroup(1)
+	for idx, w := range map[uint64]uint64{1: 1, 2: 2} {
+		nhg.GetOrCreateNextHop(idx).Weight = ygot.Uint64(w)
+		r.GetOrCreateAfts().GetOrCreateNextHop(idx).IpAddress = ygot.String(addrFor(idx))
+	}
+	return r
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	tests := []struct {
+		desc     string
+		inBefore map[string]*aft.RIB
+		inAfter  map[string]*aft.RIB
+		want     *SnapshotDiff
+		wantErr  bool
+	}{{
+		desc:     "identical snapshots",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter:  map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		want:     &SnapshotDiff{},
+	}, {
+		desc:     "semantically equal prefixes",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter:  map[string]*aft.RIB{defName: diffRIB("01.1.1.0/24")},
+		want:     &SnapshotDiff{},
+	}, {
+		desc:     "added and removed prefixes",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter:  map[string]*aft.RIB{defName: diffRIB("2.2.2.0/24")},
+		want: &SnapshotDiff{
+			Entries: []*EntryDiff{{
+				Type:            EntryRemoved,
+				NetworkInstance: defName,
+				AFT:             constants.IPv4,
+				Key:             "1.1.1.0/24",
+			}, {
+				Type:            EntryAdded,
+				NetworkInstance: defName,
+				AFT:             constants.IPv4,
+				Key:             "2.2.2.0/24",
+			}},
+		},
+	}, {
+		desc:     "modified prefix",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter: map[string]*aft.RIB{defName: func() *aft.RIB {
+			r := diffRIB("1.1.1.0/24")
+			r.GetAfts().GetIpv4Entry("1.1.1.0/24").NextHopGroup = ygot.Uint64(2)
+			r.GetAfts().GetIpv4Entry("1.1.1.0/24").NextHopGroupNetworkInstance = ygot.String("VRF-A")
+			return r
+		}()},
+		want: &SnapshotDiff{
+			Entries: []*EntryDiff{{
+				Type:            EntryModified,
+				NetworkInstance: defName,
+				AFT:             constants.IPv4,
+				Key:             "1.1.1.0/24",
+				Fields: []*FieldDiff{{
+					Path:   "/state/next-hop-group",
+					Before: "1",
+					After:  "2",
+				}, {
+					Path:  "/state/next-hop-group-network-instance",
+					After: "VRF-A",
+				}},
+			}},
+		},
+	}, {
+		desc:     "next-hop-group membership and weights",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter: map[string]*aft.RIB{defName: func() *aft.RIB {
+			r := diffRIB("1.1.1.0/24")
+			nhg := r.GetAfts().GetNextHopGroup(1)
+			delete(nhg.NextHop, 1)
+			nhg.GetNextHop(2).Weight = ygot.Uint64(4)
+			nhg.GetOrCreateNextHop(3).Weight = ygot.Uint64(1)
+			nhg.BackupNextHopGroup = ygot.Uint64(10)
+			r.GetAfts().GetOrCreateNextHop(3).IpAddress = ygot.String(addrFor(3))
+			return r
+		}()},
+		want: &SnapshotDiff{
+			Entries: []*EntryDiff{{
+				Type:            EntryAdded,
+				NetworkInstance: defName,
+				AFT:             constants.NextHop,
+				Key:             "3",
+			}, {
+				Type:            EntryModified,
+				NetworkInstance: defName,
+				AFT:             constants.NextHopGroup,
+				Key:             "1",
+				Fields: []*FieldDiff{{
+					Path:  "/state/backup-next-hop-group",
+					After: "10",
+				}},
+				Members: []*MemberDiff{{
+					Type:         EntryRemoved,
+					Index:        1,
+					BeforeWeight: 1,
+				}, {
+					Type:         EntryModified,
+					Index:        2,
+					BeforeWeight: 2,
+					AfterWeight:  4,
+				}, {
+					Type:        EntryAdded,
+					Index:       3,
+					AfterWeight: 1,
+				}},
+			}},
+		},
+	}, {
+		desc:     "next-hop attributes",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter: map[string]*aft.RIB{defName: func() *aft.RIB {
+			r := diffRIB("1.1.1.0/24")
+			nh := r.GetAfts().GetNextHop(2)
+			nh.IpAddress = nil
+			nh.GetOrCreateInterfaceRef().Interface = ygot.String("eth0")
+			return r
+		}()},
+		want: &SnapshotDiff{
+			Entries: []*EntryDiff{{
+				Type:            EntryModified,
+				NetworkInstance: defName,
+				AFT:             constants.NextHop,
+				Key:             "2",
+				Fields: []*FieldDiff{{
+					Path:  "/interface-ref/state/interface",
+					After: "eth0",
+				}, {
+					Path:   "/state/ip-address",
+					Before: "192.0.2.2",
+				}},
+			}},
+		},
+	}, {
+		desc:     "entries in other network instance",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter: map[string]*aft.RIB{
+			defName: diffRIB("1.1.1.0/24"),
+			"VRF-A": func() *aft.RIB {
+				r := &aft.RIB{}
+				r.GetOrCreateAfts().GetOrCreateNextHop(1).IpAddress = ygot.String("192.0.2.1")
+				return r
+			}(),
+		},
+		want: &SnapshotDiff{
+			Entries: []*EntryDiff{{
+				Type:            EntryAdded,
+				NetworkInstance: "VRF-A",
+				AFT:             constants.NextHop,
+				Key:             "1",
+			}},
+		},
+	}, {
+		desc:     "duplicate prefix after normalisation",
+		inBefore: map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")},
+		inAfter: map[string]*aft.RIB{defName: func() *aft.RIB {
+			r := diffRIB("1.1.1.0/24")
+			r.GetAfts().GetOrCreateIpv4Entry("001.1.1.0/24").NextHopGroup = ygot.Uint64(1)
+			return r
+		}()},
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := DiffSnapshots(tt.inBefore, tt.inAfter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DiffSnapshots(): did not get expected error, got: %v, wantErr? %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("DiffSnapshots(): did not get expected diff, diff(-got,+want):\n%s", diff)
+			}
+			if got.Empty() != (len(tt.want.Entries) == 0) {
+				t.Errorf("Empty(): did not get expected result, got: %v, want: %v", got.Empty(), len(tt.want.Entries) == 0)
+			}
+		})
+	}
+}
+
+func TestSnapshotDiffString(t *testing.T) {
+	before := map[string]*aft.RIB{defName: diffRIB("1.1.1.0/24")}
+	after := map[string]*aft.RIB{defName: func() *aft.RIB {
+		r := diffRIB("1.1.1.0/24")
+		r.GetAfts().GetIpv4Entry("1.1.1.0/24").NextHopGroup = ygot.Uint64(2)
+		r.GetAfts().GetNextHopGroup(1).GetNextHop(2).Weight = ygot.Uint64(4)
+		return r
+	}()}
+
+	got, err := DiffSnapshots(before, after)
+	if err != nil {
+		t.Fatalf("DiffSnapshots(): got unexpected error, %v", err)
+	}
+	want := strings.Join([]string{
+		"IPv4 1.1.1.0/24 modified in NI DEFAULT",
+		"\t/state/next-hop-group: \"1\" -> \"2\"",
+		"NextHopGroup 1 modified in NI DEFAULT",
+		"\tnext-hop 2 weight: 2 -> 4",
+		"",
+	}, "\n")
+	if diff := cmp.Diff(got.String(), want); diff != "" {
+		t.Errorf("String(): did not get expected output, diff(-got,+want):\n%s", diff)
+	}
+
+	if got, want := (&SnapshotDiff{}).String(), "no differences"; got != want {
+		t.Errorf("String(): did not get expected output for empty diff, got: %q, want: %q", got, want)
+	}
+}
+
+func TestCanonicalPrefix(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "1.1.1.0/24", want: "1.1.1.0/24"},
+		{in: "01.1.1.0/24", want: "1.1.1.0/24"},
+		{in: "10.0.0.0/08", want: "10.0.0.0/8"},
+		{in: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{in: "2001:0DB8::/32", want: "2001:db8::/32"},
+		{in: "10.0.0.0/33", want: "10.0.0.0/33"},
+		{in: "256.0.0.0/8", want: "256.0.0.0/8"},
+		{in: "fish", want: "fish"},
+	}
+
+	for _, tt := range tests {
+		if got := CanonicalPrefix(tt.in); got != tt.want {
+			t.Errorf("CanonicalPrefix(%s): did not get expected result, got: %s, want: %s", tt.in, got, tt.want)
+		}
+	}
+}
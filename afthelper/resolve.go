@@ -0,0 +1,282 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package afthelper
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+
+	"github.com/openconfig/gribigo/aft"
+)
+
+// DefaultMaxResolutionDepth is the maximum number of prefixes that are traversed
+// when recursively resolving a next-hop if no other depth is specified.
+const DefaultMaxResolutionDepth = 8
+
+var (
+	// ErrResolutionLoop is returned when the recursive resolution of a next-hop
+	// results in the same next-hop being resolved again.
+	ErrResolutionLoop = errors.New("next-hop resolution loop")
+	// ErrMaxDepthExceeded is returned when the recursive resolution of a next-hop
+	// traverses more prefixes than the maximum depth.
+	ErrMaxDepthExceeded = errors.New("maximum next-hop resolution depth exceeded")
+)
+
+// ResolutionStep is a single step within the recursive resolution of a next-hop,
+// describing a next-hop whose address was resolved via a prefix within the RIB.
+type ResolutionStep struct {
+	// NetworkInstance is the network instance that the next-hop is within.
+	NetworkInstance string
+	// NextHop is the index of the next-hop.
+	NextHop uint64
+	// Address is the IP address of the next-hop.
+	Address string
+	// PrefixNetworkInstance is the network instance within which the address
+	// of the next-hop was looked up.
+	PrefixNetworkInstance string
+	// Prefix is the longest prefix within PrefixNetworkInstance that matched
+	// the address of the next-hop.
+	Prefix string
+}
+
+// ResolvedNextHop is a next-hop at the end of a recursive resolution, that is to
+// say, a next-hop that is not itself resolved via another prefix within the RIB.
+type ResolvedNextHop struct {
+	// NetworkInstance is the network instance that the next-hop is within.
+	NetworkInstance string
+	// Index is the index of the next-hop.
+	Index uint64
+	// Address is the IP address of the next-hop, it is empty if the next-hop
+	// does not specify an address.
+	Address string
+	// Interface and Subinterface are the egress interface specified by the
+	// next-hop, if any.
+	Interface    string
+	Subinterface uint32
+	// Chain is the set of steps that were taken to reach the next-hop, in the
+	// order that they were taken. It is empty if the next-hop that was resolved
+	// is not resolved via another prefix.
+	Chain []*ResolutionStep
+}
+
+// ResolvePrefix recursively resolves the IPv4 or IPv6 prefix within the network
+// instance netinst using the specified ribs. It returns the set of next-hops that
+// the prefix is ultimately resolved to. Next-hops whose address is covered by
+// another prefix within the RIB are resolved via that prefix, following the
+// longest match. At most maxDepth prefixes are traversed for each next-hop of
+// the prefix, if maxDepth is zero, DefaultMaxResolutionDepth is used.
+//
+// An error wrapping ErrResolutionLoop or ErrMaxDepthExceeded is returned if
+// the prefix cannot be resolved due to a loop, or the maximum depth being
+// exceeded.
+func ResolvePrefix(ribs map[string]*aft.RIB, netinst, prefix string, maxDepth int) ([]*ResolvedNextHop, error) {
+	nhgNI, nhgID, err := prefixNHG(ribs, netinst, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return resolveNHG(ribs, nhgNI, nhgID, depth(maxDepth), map[nhKey]bool{}, nil)
+}
+
+// prefixNHG returns the network instance and ID of the next-hop-group that is
+// referenced by the IPv4 or IPv6 prefix within the network instance netinst.
+func prefixNHG(ribs map[string]*aft.RIB, netinst, prefix string) (string, uint64, error) {
+	afts := ribs[netinst].GetAfts()
+	if afts == nil {
+		return "", 0, fmt.Errorf("network instance %s does not exist", netinst)
+	}
+
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid prefix %s, %v", prefix, err)
+	}
+
+	var (
+		nhgNI string
+		nhgID uint64
+	)
+	switch {
+	case p.Addr().Is4():
+		e := afts.GetIpv4Entry(prefix)
+		if e == nil {
+			return "", 0, fmt.Errorf("cannot find IPv4 prefix %s in NI %s", prefix, netinst)
+		}
+		nhgNI, nhgID = e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup()
+	default:
+		e := afts.GetIpv6Entry(prefix)
+		if e == nil {
+			return "", 0, fmt.Errorf("cannot find IPv6 prefix %s in NI %s", prefix, netinst)
+		}
+		nhgNI, nhgID = e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup()
+	}
+	if nhgNI == "" {
+		nhgNI = netinst
+	}
+	return nhgNI, nhgID, nil
+}
+
+// ResolveNextHop recursively resolves the next-hop with the specified index within
+// the network instance netinst using the specified ribs. The semantics of the
+// resolution are as described for ResolvePrefix.
+func ResolveNextHop(ribs map[string]*aft.RIB, netinst string, index uint64, maxDepth int) ([]*ResolvedNextHop, error) {
+	nh := ribs[netinst].GetAfts().GetNextHop(index)
+	if nh == nil {
+		return nil, fmt.Errorf("cannot find next-hop %d in NI %s", index, netinst)
+	}
+	return ResolveNextHopEntry(ribs, netinst, nh, maxDepth)
+}
+
+// ResolveNextHopEntry recursively resolves the next-hop nh within the network
+// instance netinst using the specified ribs. The next-hop need not be within the
+// ribs, such that it can be used to determine how a candidate next-hop would be
+// resolved - if a next-hop with the same index exists, then nh is considered to
+// replace it. The semantics of the resolution are as described for ResolvePrefix.
+func ResolveNextHopEntry(ribs map[string]*aft.RIB, netinst string, nh *aft.Afts_NextHop, maxDepth int) ([]*ResolvedNextHop, error) {
+	return resolveNH(ribs, netinst, nh, depth(maxDepth), map[nhKey]bool{}, nil)
+}
+
+// depth returns the maximum resolution depth that should be used when the user
+// specified maxDepth.
+func depth(maxDepth int) int {
+	if maxDepth <= 0 {
+		return DefaultMaxResolutionDepth
+	}
+	return maxDepth
+}
+
+// nhKey uniquely identifies a next-hop across network instances.
+type nhKey struct {
+	ni    string
+	index uint64
+}
+
+// resolveNHG resolves each next-hop within the next-hop-group with the specified
+// id in network instance ni. The path and chain arguments are as described for
+// resolveNH.
+func resolveNHG(ribs map[string]*aft.RIB, ni string, id uint64, maxDepth int, path map[nhKey]bool, chain []*ResolutionStep) ([]*ResolvedNextHop, error) {
+	nhg := ribs[ni].GetAfts().GetNextHopGroup(id)
+	if nhg == nil {
+		return nil, fmt.Errorf("cannot find next-hop-group %d in NI %s", id, ni)
+	}
+
+	idx := []uint64{}
+	for i := range nhg.NextHop {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(i, j int) bool { return idx[i] < idx[j] })
+
+	ret := []*ResolvedNextHop{}
+	for _, i := range idx {
+		nh := ribs[ni].GetAfts().GetNextHop(i)
+		if nh == nil {
+			return nil, fmt.Errorf("cannot find next-hop %d in NI %s, referenced by next-hop-group %d", i, ni, id)
+		}
+		res, err := resolveNH(ribs, ni, nh, maxDepth, path, chain)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, res...)
+	}
+	return ret, nil
+}
+
+// resolveNH resolves the next-hop nh within the network instance ni. The path
+// argument stores the next-hops that are currently being resolved, and is used
+// to detect loops. The chain argument stores the steps that have been taken to
+// reach nh.
+func resolveNH(ribs map[string]*aft.RIB, ni string, nh *aft.Afts_NextHop, maxDepth int, path map[nhKey]bool, chain []*ResolutionStep) ([]*ResolvedNextHop, error) {
+	k := nhKey{ni: ni, index: nh.GetIndex()}
+	if path[k] {
+		return nil, fmt.Errorf("next-hop %d in NI %s, %w", k.index, ni, ErrResolutionLoop)
+	}
+
+	terminal := []*ResolvedNextHop{{
+		NetworkInstance: ni,
+		Index:           nh.GetIndex(),
+		Address:         nh.GetIpAddress(),
+		Interface:       nh.GetInterfaceRef().GetInterface(),
+		Subinterface:    nh.GetInterfaceRef().GetSubinterface(),
+		Chain:           chain,
+	}}
+
+	// A next-hop that specifies an egress interface is resolved directly on that
+	// interface, and next-hops without a valid address cannot be resolved via a
+	// prefix.
+	if nh.GetInterfaceRef().GetInterface() != "" || nh.GetIpAddress() == "" {
+		return terminal, nil
+	}
+	addr, err := netip.ParseAddr(nh.GetIpAddress())
+	if err != nil {
+		return terminal, nil
+	}
+
+	lookupNI := ni
+	if nhNI := nh.GetNetworkInstance(); nhNI != "" {
+		lookupNI = nhNI
+	}
+	lookupAFT := ribs[lookupNI].GetAfts()
+	if lookupAFT == nil {
+		return nil, fmt.Errorf("invalid unknown network instance %s for next-hop %d in NI %s", lookupNI, k.index, ni)
+	}
+
+	prefix, nhgNI, nhgID, ok := longestMatch(lookupAFT, addr)
+	if !ok {
+		// The next-hop is resolved outside of the RIB.
+		return terminal, nil
+	}
+	if len(chain) >= maxDepth {
+		return nil, fmt.Errorf("next-hop %d in NI %s, %w (%d)", k.index, ni, ErrMaxDepthExceeded, maxDepth)
+	}
+	if nhgNI == "" {
+		nhgNI = lookupNI
+	}
+
+	next := append(append([]*ResolutionStep{}, chain...), &ResolutionStep{
+		NetworkInstance:       ni,
+		NextHop:               k.index,
+		Address:               nh.GetIpAddress(),
+		PrefixNetworkInstance: lookupNI,
+		Prefix:                prefix,
+	})
+
+	path[k] = true
+	defer delete(path, k)
+	return resolveNHG(ribs, nhgNI, nhgID, maxDepth, path, next)
+}
+
+// longestMatch returns the longest prefix within afts that contains addr, along
+// with the network instance and ID of the next-hop-group that it references. It
+// returns false if no prefix contains addr. Prefixes are expected to be stored
+// in their canonical form.
+func longestMatch(afts *aft.Afts, addr netip.Addr) (string, string, uint64, bool) {
+	for l := addr.BitLen(); l >= 0; l-- {
+		p, err := addr.Prefix(l)
+		if err != nil {
+			return "", "", 0, false
+		}
+		s := p.String()
+		if addr.Is4() {
+			if e := afts.GetIpv4Entry(s); e != nil {
+				return s, e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup(), true
+			}
+			continue
+		}
+		if e := afts.GetIpv6Entry(s); e != nil {
+			return s, e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup(), true
+		}
+	}
+	return "", "", 0, false
+}
@@ -0,0 +1,258 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package afthelper
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/ygot/ygot"
+)
+
+// addRoute adds a prefix to r which is resolved via a next-hop-group with the
+// specified id, containing a single next-hop with the same index and the
+// address addr.
+func addRoute(r *aft.RIB, prefix string, id uint64, addr string) {
+	r.GetOrCreateAfts().GetOrCreateIpv4Entry(prefix).NextHopGroup = ygot.Uint64(id)
+	r.GetOrCreateAfts().GetOrCreateNextHopGroup(id).GetOrCreateNextHop(id).Weight = ygot.Uint64(1)
+	r.GetOrCreateAfts().GetOrCreateNextHop(id).IpAddress = ygot.String(addr)
+}
+
+// threeLevelRIB returns a RIB in which 203.0.113.0/24 is resolved via two other
+// prefixes before reaching a next-hop with an egress interface.
+func threeLevelRIB() *aft.RIB {
+	r := &aft.RIB{}
+	addRoute(r, "203.0.113.0/24", 1, "10.2.0.1")
+	addRoute(r, "10.2.0.0/16", 2, "10.3.0.1")
+	addRoute(r, "10.3.0.0/16", 3, "192.0.2.1")
+	r.GetOrCreateAfts().GetOrCreateNextHop(3).GetOrCreateInterfaceRef().Interface = ygot.String("eth0")
+	return r
+}
+
+func TestResolvePrefix(t *testing.T) {
+	tests := []struct {
+		desc       string
+		inRIB      map[string]*aft.RIB
+		inNetInst  string
+		inPrefix   string
+		inMaxDepth int
+		want       []*ResolvedNextHop
+		wantErr    error
+	}{{
+		desc: "next-hop resolved outside of the RIB",
+		inRIB: map[string]*aft.RIB{
+			defName: func() *aft.RIB {
+				r := &aft.RIB{}
+				addRoute(r, "8.8.8.8/32", 1, "192.0.2.1")
+				return r
+			}(),
+		},
+		inNetInst: defName,
+		inPrefix:  "8.8.8.8/32",
+		want: []*ResolvedNextHop{{
+			NetworkInstance: defName,
+			Index:           1,
+			Address:         "192.0.2.1",
+		}},
+	}, {
+		desc:      "three level recursion",
+		inRIB:     map[string]*aft.RIB{defName: threeLevelRIB()},
+		inNetInst: defName,
+		inPrefix:  "203.0.113.0/24",
+		want: []*ResolvedNextHop{{
+			NetworkInstance: defName,
+			Index:           3,
+			Address:         "192.0.2.1",
+			Interface:       "eth0",
+			Chain: []*ResolutionStep{{
+				NetworkInstance:       defName,
+				NextHop:               1,
+				Address:               "10.2.0.1",
+				PrefixNetworkInstance: defName,
+				Prefix:                "10.2.0.0/16",
+			}, {
+				NetworkInstance:       defName,
+				NextHop:               2,
+				Address:               "10.3.0.1",
+				PrefixNetworkInstance: defName,
+				Prefix:                "10.3.0.0/16",
+			}},
+		}},
+	}, {
+		desc:       "three level recursion exceeds maximum depth",
+		inRIB:      map[string]*aft.RIB{defName: threeLevelRIB()},
+		inNetInst:  defName,
+		inPrefix:   "203.0.113.0/24",
+		inMaxDepth: 1,
+		wantErr:    ErrMaxDepthExceeded,
+	}, {
+		desc: "longest match is used",
+		inRIB: map[string]*aft.RIB{
+			defName: func() *aft.RIB {
+				r := &aft.RIB{}
+				addRoute(r, "8.8.8.8/32", 1, "10.0.0.1")
+				addRoute(r, "10.0.0.0/8", 2, "192.0.2.2")
+				addRoute(r, "10.0.0.0/24", 3, "192.0.2.3")
+				return r
+			}(),
+		},
+		inNetInst: defName,
+		inPrefix:  "8.8.8.8/32",
+		want: []*ResolvedNextHop{{
+			NetworkInstance: defName,
+			Index:           3,
+			Address:         "192.0.2.3",
+			Chain: []*ResolutionStep{{
+				NetworkInstance:       defName,
+				NextHop:               1,
+				Address:               "10.0.0.1",
+				PrefixNetworkInstance: defName,
+				Prefix:                "10.0.0.0/24",
+			}},
+		}},
+	}, {
+		desc: "next-hop resolved in another network instance",
+		inRIB: map[string]*aft.RIB{
+			defName: func() *aft.RIB {
+				r := &aft.RIB{}
+				addRoute(r, "10.0.0.0/8", 2, "192.0.2.2")
+				return r
+			}(),
+			"VRF-A": func() *aft.RIB {
+				r := &aft.RIB{}
+				addRoute(r, "8.8.8.8/32", 1, "10.0.0.1")
+				r.GetOrCreateAfts().GetOrCreateNextHop(1).NetworkInstance = ygot.String(defName)
+				return r
+			}(),
+		},
+		inNetInst: "VRF-A",
+		inPrefix:  "8.8.8.8/32",
+		want: []*ResolvedNextHop{{
+			NetworkInstance: defName,
+			Index:           2,
+			Address:         "192.0.2.2",
+			Chain: []*ResolutionStep{{
+				NetworkInstance:       "VRF-A",
+				NextHop:               1,
+				Address:               "10.0.0.1",
+				PrefixNetworkInstance: defName,
+				Prefix:                "10.0.0.0/8",
+			}},
+		}},
+	}, {
+		desc: "loop",
+		inRIB: map[string]*aft.RIB{
+			defName: func() *aft.RIB {
+				r := &aft.RIB{}
+				addRoute(r, "8.8.8.8/32", 1, "10.1.0.1")
+				addRoute(r, "10.1.0.0/16", 2, "10.2.0.1")
+				addRoute(r, "10.2.0.0/16", 3, "10.1.0.2")
+				return r
+			}(),
+		},
+		inNetInst: defName,
+		inPrefix:  "8.8.8.8/32",
+		wantErr:   ErrResolutionLoop,
+	}, {
+		desc: "ipv6",
+		inRIB: map[string]*aft.RIB{
+			defName: func() *aft.RIB {
+				r := &aft.RIB{}
+				r.GetOrCreateAfts().GetOrCreateIpv6Entry("2001:db8:1::/48").NextHopGroup = ygot.Uint64(1)
+				r.GetOrCreateAfts().GetOrCreateNextHopGroup(1).GetOrCreateNextHop(1).Weight = ygot.Uint64(1)
+				r.GetOrCreateAfts().GetOrCreateNextHop(1).IpAddress = ygot.String("2001:db8:2::1")
+				r.GetOrCreateAfts().GetOrCreateIpv6Entry("2001:db8:2::/48").NextHopGroup = ygot.Uint64(2)
+				r.GetOrCreateAfts().GetOrCreateNextHopGroup(2).GetOrCreateNextHop(2).Weight = ygot.Uint64(1)
+				r.GetOrCreateAfts().GetOrCreateNextHop(2).IpAddress = ygot.String("fe80::1")
+				return r
+			}(),
+		},
+		inNetInst: defName,
+		inPrefix:  "2001:db8:1::/48",
+		want: []*ResolvedNextHop{{
+			NetworkInstance: defName,
+			Index:           2,
+			Address:         "fe80::1",
+			Chain: []*ResolutionStep{{
+				NetworkInstance:       defName,
+				NextHop:               1,
+				Address:               "2001:db8:2::1",
+				PrefixNetworkInstance: defName,
+				Prefix:                "2001:db8:2::/48",
+			}},
+		}},
+	}, {
+		desc:      "unknown prefix",
+		inRIB:     map[string]*aft.RIB{defName: threeLevelRIB()},
+		inNetInst: defName,
+		inPrefix:  "198.51.100.0/24",
+		wantErr:   errAny,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := ResolvePrefix(tt.inRIB, tt.inNetInst, tt.inPrefix, tt.inMaxDepth)
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("ResolvePrefix(...): did not get expected error, got: %v, want: nil", err)
+			case tt.wantErr == errAny && err == nil, tt.wantErr != nil && tt.wantErr != errAny && !errors.Is(err, tt.wantErr):
+				t.Fatalf("ResolvePrefix(...): did not get expected error, got: %v, want: %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Fatalf("ResolvePrefix(...): did not get expected result, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+// errAny is used in tests to indicate that any error is expected.
+var errAny = errors.New("any error")
+
+func TestResolveNextHop(t *testing.T) {
+	r := map[string]*aft.RIB{defName: threeLevelRIB()}
+
+	got, err := ResolveNextHop(r, defName, 2, 0)
+	if err != nil {
+		t.Fatalf("ResolveNextHop(...): did not get expected error, got: %v, want: nil", err)
+	}
+	want := []*ResolvedNextHop{{
+		NetworkInstance: defName,
+		Index:           3,
+		Address:         "192.0.2.1",
+		Interface:       "eth0",
+		Chain: []*ResolutionStep{{
+			NetworkInstance:       defName,
+			NextHop:               2,
+			Address:               "10.3.0.1",
+			PrefixNetworkInstance: defName,
+			Prefix:                "10.3.0.0/16",
+		}},
+	}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Fatalf("ResolveNextHop(...): did not get expected result, diff(-got,+want):\n%s", diff)
+	}
+
+	// Replacing next-hop 3 such that it is resolved via 10.2.0.0/16 causes a loop.
+	candidate := &aft.Afts_NextHop{Index: ygot.Uint64(3), IpAddress: ygot.String("10.2.0.2")}
+	if _, err := ResolveNextHopEntry(r, defName, candidate, 0); !errors.Is(err, ErrResolutionLoop) {
+		t.Fatalf("ResolveNextHopEntry(...): did not get expected error, got: %v, want: %v", err, ErrResolutionLoop)
+	}
+
+	if _, err := ResolveNextHop(r, defName, 42, 0); err == nil {
+		t.Fatalf("ResolveNextHop(...): did not get expected error for unknown next-hop")
+	}
+}
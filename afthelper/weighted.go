@@ -0,0 +1,268 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package afthelper
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/openconfig/gribigo/aft"
+)
+
+// DefaultWeightBuckets is the number of buckets that the traffic for a prefix is
+// distributed across by WeightedNextHops if no other number is specified.
+const DefaultWeightBuckets = 64
+
+// Encap describes the encapsulation and decapsulation that is performed by a
+// next-hop.
+type Encap struct {
+	// EncapsulateHeader and DecapsulateHeader are the headers that are
+	// added to, or removed from, packets that are forwarded via the next-hop.
+	EncapsulateHeader aft.E_AftTypes_EncapsulationHeaderType
+	DecapsulateHeader aft.E_AftTypes_EncapsulationHeaderType
+	// IPinIPSource and IPinIPDestination are the source and destination
+	// addresses of the IP-in-IP header added by the next-hop, if any.
+	IPinIPSource      string
+	IPinIPDestination string
+	// PushedMPLSLabelStack is the stack of MPLS labels that is pushed by the
+	// next-hop, and PopTopLabel indicates whether the top label is popped.
+	PushedMPLSLabelStack []aft.Afts_NextHop_PushedMplsLabelStack_Union
+	PopTopLabel          bool
+}
+
+// WeightedHop is a next-hop at the end of the recursive resolution of a prefix,
+// along with the share of the prefix's traffic that it is allocated.
+type WeightedHop struct {
+	// NetworkInstance is the network instance that the next-hop is within.
+	NetworkInstance string
+	// Index is the index of the next-hop.
+	Index uint64
+	// Address is the IP address of the next-hop, it is empty if the next-hop
+	// does not specify an address.
+	Address string
+	// Interface and Subinterface are the egress interface specified by the
+	// next-hop, if any.
+	Interface    string
+	Subinterface uint32
+	// Encap describes the encapsulation performed by the next-hop.
+	Encap *Encap
+	// Buckets is the number of buckets allocated to the next-hop, out of
+	// TotalBuckets, such that its normalized weight is Buckets/TotalBuckets.
+	Buckets      uint64
+	TotalBuckets uint64
+	// Unresolved indicates that the next-hop cannot be resolved, and hence
+	// is allocated no buckets.
+	Unresolved bool
+}
+
+// Fraction returns the normalized weight of the next-hop, as a fraction of the
+// traffic for the prefix.
+func (w *WeightedHop) Fraction() float64 {
+	if w.TotalBuckets == 0 {
+		return 0
+	}
+	return float64(w.Buckets) / float64(w.TotalBuckets)
+}
+
+// WeightedNextHops expands the IPv4 or IPv6 prefix within the network instance
+// netinst into the set of next-hops that it is ultimately resolved to, as
+// described for ResolvePrefix, along with the share of the prefix's traffic
+// that is allocated to each. The weights of the next-hops within each
+// next-hop-group that is traversed are normalized, and the traffic is divided
+// into the specified number of buckets - or DefaultWeightBuckets if buckets is
+// zero.
+//
+// Next-hops within a next-hop-group that have a weight of zero are excluded, and
+// a next-hop-group member that does not specify a weight has a weight of 1.
+// Members that cannot be resolved are excluded from the distribution, and
+// are returned with Unresolved set. Buckets are allocated using the largest
+// remainder method, with ties broken by network instance and index, such that
+// the same contents of ribs always produce the same allocation. Next-hops are
+// returned in the same order.
+func WeightedNextHops(ribs map[string]*aft.RIB, netinst, prefix string, buckets uint64) ([]*WeightedHop, error) {
+	if buckets == 0 {
+		buckets = DefaultWeightBuckets
+	}
+	nhgNI, nhgID, err := prefixNHG(ribs, netinst, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &weighter{
+		ribs:   ribs,
+		shares: map[nhKey]*big.Rat{},
+		hops:   map[nhKey]*WeightedHop{},
+	}
+	if err := w.nhg(nhgNI, nhgID, big.NewRat(1, 1)); err != nil {
+		return nil, err
+	}
+	if len(w.shares) == 0 {
+		return nil, fmt.Errorf("prefix %s in NI %s has no resolvable next-hops", prefix, netinst)
+	}
+
+	keys := []nhKey{}
+	for k := range w.hops {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ni != keys[j].ni {
+			return keys[i].ni < keys[j].ni
+		}
+		return keys[i].index < keys[j].index
+	})
+
+	// Each next-hop is allocated the whole number of buckets within its exact
+	// share, and the remaining buckets are allocated to the next-hops with the
+	// largest remainders.
+	type remainder struct {
+		hop *WeightedHop
+		rem *big.Rat
+	}
+	rems := []remainder{}
+	allocated := uint64(0)
+	ret := []*WeightedHop{}
+	for _, k := range keys {
+		h := w.hops[k]
+		h.TotalBuckets = buckets
+		ret = append(ret, h)
+		s, ok := w.shares[k]
+		if !ok {
+			continue
+		}
+		exact := new(big.Rat).Mul(s, new(big.Rat).SetInt(new(big.Int).SetUint64(buckets)))
+		whole := new(big.Int).Quo(exact.Num(), exact.Denom())
+		h.Buckets = whole.Uint64()
+		allocated += h.Buckets
+		rems = append(rems, remainder{
+			hop: h,
+			rem: new(big.Rat).Sub(exact, new(big.Rat).SetInt(whole)),
+		})
+	}
+	sort.SliceStable(rems, func(i, j int) bool { return rems[i].rem.Cmp(rems[j].rem) > 0 })
+	for i := 0; allocated < buckets; i++ {
+		rems[i%len(rems)].hop.Buckets++
+		allocated++
+	}
+	return ret, nil
+}
+
+// weighter accumulates the share of traffic allocated to each next-hop whilst
+// expanding a prefix.
+type weighter struct {
+	// ribs are the RIBs within which the prefix is expanded.
+	ribs map[string]*aft.RIB
+	// shares is the exact share of traffic allocated to each resolved next-hop.
+	shares map[nhKey]*big.Rat
+	// hops stores each next-hop that was reached, including those that are
+	// unresolved.
+	hops map[nhKey]*WeightedHop
+}
+
+// nhg distributes share across the members of the next-hop-group with the
+// specified id within network instance ni, in proportion to their weights.
+// Members that are resolved via another prefix have their share distributed
+// across the next-hop-group of that prefix.
+func (w *weighter) nhg(ni string, id uint64, share *big.Rat) error {
+	nhg := w.ribs[ni].GetAfts().GetNextHopGroup(id)
+	if nhg == nil {
+		return fmt.Errorf("cannot find next-hop-group %d in NI %s", id, ni)
+	}
+
+	idx := []uint64{}
+	for i := range nhg.NextHop {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(i, j int) bool { return idx[i] < idx[j] })
+
+	type member struct {
+		nh     *aft.Afts_NextHop
+		weight uint64
+		res    []*ResolvedNextHop
+	}
+	members := []*member{}
+	total := uint64(0)
+	for _, i := range idx {
+		weight := uint64(1)
+		if v := nhg.NextHop[i].Weight; v != nil {
+			weight = *v
+		}
+		if weight == 0 {
+			continue
+		}
+		k := nhKey{ni: ni, index: i}
+		nh := w.ribs[ni].GetAfts().GetNextHop(i)
+		if nh == nil {
+			w.hops[k] = &WeightedHop{NetworkInstance: ni, Index: i, Unresolved: true}
+			continue
+		}
+		res, err := ResolveNextHopEntry(w.ribs, ni, nh, 0)
+		if err != nil {
+			h := weightedHop(ni, nh)
+			h.Unresolved = true
+			w.hops[k] = h
+			continue
+		}
+		members = append(members, &member{nh: nh, weight: weight, res: res})
+		total += weight
+	}
+
+	for _, m := range members {
+		s := new(big.Rat).Mul(share, new(big.Rat).SetFrac(
+			new(big.Int).SetUint64(m.weight),
+			new(big.Int).SetUint64(total),
+		))
+		if len(m.res) == 1 && len(m.res[0].Chain) == 0 {
+			k := nhKey{ni: ni, index: m.nh.GetIndex()}
+			if _, ok := w.shares[k]; !ok {
+				w.shares[k] = new(big.Rat)
+			}
+			w.shares[k].Add(w.shares[k], s)
+			w.hops[k] = weightedHop(ni, m.nh)
+			continue
+		}
+		// The member is resolved via a prefix, whose next-hop-group receives
+		// the member's share.
+		step := m.res[0].Chain[0]
+		nhgNI, nhgID, err := prefixNHG(w.ribs, step.PrefixNetworkInstance, step.Prefix)
+		if err != nil {
+			return err
+		}
+		if err := w.nhg(nhgNI, nhgID, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weightedHop returns a WeightedHop describing the next-hop nh within network
+// instance ni.
+func weightedHop(ni string, nh *aft.Afts_NextHop) *WeightedHop {
+	return &WeightedHop{
+		NetworkInstance: ni,
+		Index:           nh.GetIndex(),
+		Address:         nh.GetIpAddress(),
+		Interface:       nh.GetInterfaceRef().GetInterface(),
+		Subinterface:    nh.GetInterfaceRef().GetSubinterface(),
+		Encap: &Encap{
+			EncapsulateHeader:    nh.GetEncapsulateHeader(),
+			DecapsulateHeader:    nh.GetDecapsulateHeader(),
+			IPinIPSource:         nh.GetIpInIp().GetSrcIp(),
+			IPinIPDestination:    nh.GetIpInIp().GetDstIp(),
+			PushedMPLSLabelStack: nh.PushedMplsLabelStack,
+			PopTopLabel:          nh.GetPopTopLabel(),
+		},
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package afthelper
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/ygot/ygot"
+)
+
+// weightedRIB returns a RIB in which 203.0.113.0/24 uses next-hop-group 1, which
+// contains the next-hops with the specified weights, keyed by index. Each
+// next-hop has the address 192.0.2.<index>.
+func weightedRIB(weights map[uint64]uint64) *aft.RIB {
+	r := &aft.RIB{}
+	r.GetOrCreateAfts().GetOrCreateIpv4Entry("203.0.113.0/24").NextHopGroup = ygot.Uint64(1)
+	nhg := r.GetOrCreateAfts().GetOrCreateNextHopGroup(1)
+	for idx, w := range weights {
+		nhg.GetOrCreateNextHop(idx).Weight = ygot.Uint64(w)
+		r.GetOrCreateAfts().GetOrCreateNextHop(idx).IpAddress = ygot.String(addrFor(idx))
+	}
+	return r
+}
+
+// addrFor returns the address used for the next-hop with index idx.
+func addrFor(idx uint64) string {
+	return fmt.Sprintf("192.0.2.%d", idx)
+}
+
+func TestWeightedNextHops(t *testing.T) {
+	tests := []struct {
+		desc      string
+		inRIB     *aft.RIB
+		inPrefix  string
+		inBuckets uint64
+		// wantBuckets maps the index of each next-hop to the number of buckets
+		// that it is expected to be allocated, or -1 if it is unresolved.
+		wantBuckets map[uint64]int
+		wantTotal   uint64
+		wantErr     bool
+	}{{
+		desc:        "single next-hop",
+		inRIB:       weightedRIB(map[uint64]uint64{1: 5}),
+		wantBuckets: map[uint64]int{1: 64},
+		wantTotal:   DefaultWeightBuckets,
+	}, {
+		desc:        "unequal weights",
+		inRIB:       weightedRIB(map[uint64]uint64{1: 1, 2: 3}),
+		wantBuckets: map[uint64]int{1: 16, 2: 48},
+		wantTotal:   DefaultWeightBuckets,
+	}, {
+		desc:        "equal remainders allocated by index",
+		inRIB:       weightedRIB(map[uint64]uint64{1: 1, 2: 1, 3: 1}),
+		wantBuckets: map[uint64]int{1: 22, 2: 21, 3: 21},
+		wantTotal:   DefaultWeightBuckets,
+	}, {
+		desc:        "largest remainder",
+		inRIB:       weightedRIB(map[uint64]uint64{1: 1, 2: 2, 3: 4}),
+		inBuckets:   10,
+		wantBuckets: map[uint64]int{1: 1, 2: 3, 3: 6},
+		wantTotal:   10,
+	}, {
+		desc:        "zero weight excluded",
+		inRIB:       weightedRIB(map[uint64]uint64{1: 0, 2: 1}),
+		wantBuckets: map[uint64]int{2: 64},
+		wantTotal:   DefaultWeightBuckets,
+	}, {
+		desc: "unset weight is one",
+		inRIB: func() *aft.RIB {
+			r := weightedRIB(map[uint64]uint64{1: 1, 2: 1})
+			r.GetAfts().GetNextHopGroup(1).GetNextHop(2).Weight = nil
+			return r
+		}(),
+		wantBuckets: map[uint64]int{1: 32, 2: 32},
+		wantTotal:   DefaultWeightBuckets,
+	}, {
+		desc: "unresolvable member excluded",
+		inRIB: func() *aft.RIB {
+			// NH 2 is resolved via 192.0.2.0/24, which uses NH 2.
+			r := weightedRIB(map[uint64]uint64{1: 1, 2: 1})
+			r.GetOrCreateAfts().GetOrCreateIpv4Entry("192.0.2.0/24").NextHopGroup = ygot.Uint64(2)
+			r.GetOrCreateAfts().GetOrCreateNextHopGroup(2).GetOrCreateNextHop(2).Weight = ygot.Uint64(1)
+			r.GetAfts().GetNextHop(1).GetOrCreateInterfaceRef().Interface = ygot.String("eth0")
+			return r
+		}(),
+		wantBuckets: map[uint64]int{1: 64, 2: -1},
+		wantTotal:   DefaultWeightBuckets,
+	}, {
+		desc: "recursive member",
+		inRIB: func() *aft.RIB {
+			// NH 1 is resolved via 10.0.0.0/8, which is split across NHs 3 and 4.
+			r := weightedRIB(map[uint64]uint64{1: 1, 2: 1})
+			r.GetAfts().GetNextHop(1).IpAddress = ygot.String("10.0.0.1")
+			r.GetOrCreateAfts().GetOrCreateIpv4Entry("10.0.0.0/8").NextHopGroup = ygot.Uint64(2)
+			for _, idx := range []uint64{3, 4} {
+				r.GetOrCreateAfts().GetOrCreateNextHopGroup(2).GetOrCreateNextHop(idx).Weight = ygot.Uint64(1)
+				r.GetOrCreateAfts().GetOrCreateNextHop(idx).GetOrCreateInterfaceRef().Interface = ygot.String("eth0")
+			}
+			return r
+		}(),
+		wantBuckets: map[uint64]int{2: 32, 3: 16, 4: 16},
+		wantTotal:   DefaultWeightBuckets,
+	}, {
+		desc: "no resolvable next-hops",
+		inRIB: func() *aft.RIB {
+			r := weightedRIB(map[uint64]uint64{1: 1})
+			r.GetAfts().NextHop = nil
+			return r
+		}(),
+		wantErr: true,
+	}, {
+		desc:     "missing prefix",
+		inRIB:    weightedRIB(map[uint64]uint64{1: 1}),
+		inPrefix: "198.51.100.0/24",
+		wantErr:  true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			prefix := tt.inPrefix
+			if prefix == "" {
+				prefix = "203.0.113.0/24"
+			}
+			got, err := WeightedNextHops(map[string]*aft.RIB{defName: tt.inRIB}, defName, prefix, tt.inBuckets)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WeightedNextHops(): did not get expected error, got: %v, wantErr? %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			gotBuckets := map[uint64]int{}
+			sum := uint64(0)
+			for _, h := range got {
+				if h.TotalBuckets != tt.wantTotal {
+					t.Errorf("WeightedNextHops(): next-hop %d: did not get expected total buckets, got: %d, want: %d", h.Index, h.TotalBuckets, tt.wantTotal)
+				}
+				if h.Unresolved {
+					gotBuckets[h.Index] = -1
+					continue
+				}
+				gotBuckets[h.Index] = int(h.Buckets)
+				sum += h.Buckets
+			}
+			if diff := cmp.Diff(gotBuckets, tt.wantBuckets); diff != "" {
+				t.Errorf("WeightedNextHops(): did not get expected buckets, diff(-got,+want):\n%s", diff)
+			}
+			if sum != tt.wantTotal {
+				t.Errorf("WeightedNextHops(): did not allocate all buckets, got: %d, want: %d", sum, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func TestWeightedNextHopsDetails(t *testing.T) {
+	r := weightedRIB(map[uint64]uint64{1: 1})
+	nh := r.GetAfts().GetNextHop(1)
+	nh.GetOrCreateInterfaceRef().Interface = ygot.String("eth0")
+	nh.GetOrCreateInterfaceRef().Subinterface = ygot.Uint32(10)
+	nh.EncapsulateHeader = aft.AftTypes_EncapsulationHeaderType_IPV4
+	nh.GetOrCreateIpInIp().SrcIp = ygot.String("198.51.100.1")
+	nh.GetOrCreateIpInIp().DstIp = ygot.String("198.51.100.2")
+
+	got, err := WeightedNextHops(map[string]*aft.RIB{defName: r}, defName, "203.0.113.0/24", 0)
+	if err != nil {
+		t.Fatalf("WeightedNextHops(): got unexpected error, %v", err)
+	}
+	want := []*WeightedHop{{
+		NetworkInstance: defName,
+		Index:           1,
+		Address:         "192.0.2.1",
+		Interface:       "eth0",
+		Subinterface:    10,
+		Encap: &Encap{
+			EncapsulateHeader: aft.AftTypes_EncapsulationHeaderType_IPV4,
+			IPinIPSource:      "198.51.100.1",
+			IPinIPDestination: "198.51.100.2",
+		},
+		Buckets:      DefaultWeightBuckets,
+		TotalBuckets: DefaultWeightBuckets,
+	}}
+	if diff := cmp.Diff(got, want, cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("WeightedNextHops(): did not get expected next-hops, diff(-got,+want):\n%s", diff)
+	}
+	if got[0].Fraction() != 1.0 {
+		t.Errorf("Fraction(): did not get expected fraction for single next-hop, got: %v, want: 1.0", got[0].Fraction())
+	}
+}
+
+func TestWeightedNextHopsDeterministic(t *testing.T) {
+	weights := map[uint64]uint64{1: 3, 2: 5, 3: 7, 4: 11, 5: 13}
+	first, err := WeightedNextHops(map[string]*aft.RIB{defName: weightedRIB(weights)}, defName, "203.0.113.0/24", 0)
+	if err != nil {
+		t.Fatalf("WeightedNextHops(): got unexpected error, %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		got, err := WeightedNextHops(map[string]*aft.RIB{defName: weightedRIB(weights)}, defName, "203.0.113.0/24", 0)
+		if err != nil {
+			t.Fatalf("WeightedNextHops(): got unexpected error, %v", err)
+		}
+		if diff := cmp.Diff(got, first); diff != "" {
+			t.Fatalf("WeightedNextHops(): did not get the same allocation for the same RIB, diff(-got,+want):\n%s", diff)
+		}
+	}
+}
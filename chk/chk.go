@@ -23,17 +23,22 @@ package chk
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/afthelper"
 	"github.com/openconfig/gribigo/client"
+	"github.com/openconfig/gribigo/constants"
 	"github.com/openconfig/gribigo/fluent"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
 	spb "github.com/openconfig/gribi/v1/proto/service"
 	gspb "google.golang.org/genproto/googleapis/rpc/status"
 )
@@ -72,7 +77,8 @@ func hasIgnoreOperationID(opt []resultOpt) bool {
 }
 
 // HasResult checks whether the specified res slice contains a result containing
-// with the value of want.
+// with the value of want. Results that match want are recorded as checked, such
+// that they are not reported by a client created with WithFailOnUncheckedErrors.
 func HasResult(t testing.TB, res []*client.OpResult, want *client.OpResult, opt ...resultOpt) {
 	t.Helper()
 	var found bool
@@ -83,6 +89,10 @@ func HasResult(t testing.TB, res []*client.OpResult, want *client.OpResult, opt
 	if want.Details == nil {
 		ignoreFields = append(ignoreFields, "Details")
 	}
+	// Likewise, error details are only compared if they were asked for.
+	if want.ErrorDetails == nil {
+		ignoreFields = append(ignoreFields, "ErrorDetails")
+	}
 	if hasIgnoreOperationID(opt) {
 		ignoreFields = append(ignoreFields, "OperationID")
 	}
@@ -91,10 +101,15 @@ func HasResult(t testing.TB, res []*client.OpResult, want *client.OpResult, opt
 		cmpopts.IgnoreFields(client.OpResult{}, ignoreFields...),
 		protocmp.Transform(),
 	}
+	// Similarly, the network instance is only compared if it was asked for.
+	if want.Details != nil && want.Details.NetworkInstance == "" {
+		opts = append(opts, cmpopts.IgnoreFields(client.OpDetailsResults{}, "NetworkInstance"))
+	}
 
 	for _, r := range res {
 		if cmp.Equal(r, want, opts...) {
 			found = true
+			fluent.MarkChecked(r)
 		}
 	}
 	if !found {
@@ -157,6 +172,42 @@ func HasResultsCache(t testing.TB, res, wants []*client.OpResult, opt ...resultO
 	}
 }
 
+// HasSummary checks whether the summary got contains the counts specified in
+// want. Keys that are absent from either summary are treated as having a count of
+// zero. The test fails with a description of each count that differs if the summaries
+// are not equal.
+func HasSummary(t testing.TB, got, want fluent.ResultSummary) {
+	t.Helper()
+
+	keys := map[fluent.SummaryKey]bool{}
+	for k := range got {
+		keys[k] = true
+	}
+	for k := range want {
+		keys[k] = true
+	}
+
+	diffs := []string{}
+	for k := range keys {
+		if g, w := got[k], want[k]; g != w {
+			diffs = append(diffs, fmt.Sprintf("\t%s: got: %d, want: %d\n", k, g, w))
+		}
+	}
+	if len(diffs) == 0 {
+		return
+	}
+	sort.Strings(diffs)
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("result summary did not match expected summary\n")
+	for _, d := range diffs {
+		buf.WriteString(d)
+	}
+	buf.WriteString("got:\n")
+	buf.WriteString(got.String())
+	t.Fatalf(buf.String())
+}
+
 // clientError converts the given error into a client ClientErr.
 func clientError(t testing.TB, err error) *client.ClientErr {
 	t.Helper()
@@ -359,3 +410,356 @@ func GetResponseHasEntries(t testing.TB, getres *spb.GetResponse, wants ...fluen
 		}
 	}
 }
+
+// GetResponseHasIPv4Prefixes checks whether the set of IPv4 prefixes within
+// network instance ni in the supplied GetResponse is exactly the set specified
+// by wants. It calls t.Fatalf with a report of the prefixes that are missing
+// from, and unexpectedly present in, the GetResponse if the sets differ.
+func GetResponseHasIPv4Prefixes(t testing.TB, getres *spb.GetResponse, ni string, wants []string) {
+	got := map[string]bool{}
+	for _, r := range getres.GetEntry() {
+		if v, ok := r.Entry.(*spb.AFTEntry_Ipv4); ok && r.GetNetworkInstance() == ni {
+			got[v.Ipv4.GetPrefix()] = true
+		}
+	}
+	want := map[string]bool{}
+	for _, p := range wants {
+		want[p] = true
+	}
+
+	var missing, unexpected []string
+	for p := range want {
+		if !got[p] {
+			missing = append(missing, p)
+		}
+	}
+	for p := range got {
+		if !want[p] {
+			unexpected = append(unexpected, p)
+		}
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return
+	}
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "IPv4 prefixes in network instance %s did not match, got: %d prefixes, want: %d prefixes\n", ni, len(got), len(want))
+	fmt.Fprintf(b, "missing (%d):\n", len(missing))
+	for _, p := range missing {
+		fmt.Fprintf(b, "\t%s\n", p)
+	}
+	fmt.Fprintf(b, "unexpected (%d):\n", len(unexpected))
+	for _, p := range unexpected {
+		fmt.Fprintf(b, "\t%s\n", p)
+	}
+	t.Fatalf("%s", b.String())
+}
+
+// AFTEntryDiff returns a human-readable diff between the received AFTEntry got,
+// and the expected AFTEntry want, such as one built by fluent.ExpectedIPv4. It
+// returns an empty string if the entries are equal. The IPv4 and IPv6 prefixes
+// of the entries are compared in their canonical form, as returned by
+// afthelper.CanonicalPrefix, such that 10.0.0.0/8 and 10.0.0.0/08 are
+// considered equal. The FIB status of the entries, and the order of the
+// next-hops within a next-hop-group, are ignored.
+func AFTEntryDiff(got, want *spb.AFTEntry) string {
+	return aftEntryDiff(got, want)
+}
+
+// aftEntryDiff returns the diff between the AFTEntry messages got and want, as
+// described for AFTEntryDiff, using the additional cmp options opts.
+func aftEntryDiff(got, want *spb.AFTEntry, opts ...cmp.Option) string {
+	opts = append([]cmp.Option{
+		protocmp.Transform(),
+		protocmp.IgnoreFields(&spb.AFTEntry{}, "fib_status"),
+		protocmp.SortRepeated(func(a, b *aftpb.Afts_NextHopGroup_NextHopKey) bool {
+			return a.GetIndex() < b.GetIndex()
+		}),
+	}, opts...)
+	return cmp.Diff(normalizeAFTEntry(got), normalizeAFTEntry(want), opts...)
+}
+
+// normalizeAFTEntry returns a copy of the AFTEntry e in which the IPv4 or IPv6
+// prefix is in its canonical form. Prefixes that cannot be parsed are returned
+// unmodified, such that they are compared as strings.
+func normalizeAFTEntry(e *spb.AFTEntry) *spb.AFTEntry {
+	if e == nil {
+		return nil
+	}
+	n := proto.Clone(e).(*spb.AFTEntry)
+	switch v := n.Entry.(type) {
+	case *spb.AFTEntry_Ipv4:
+		if v.Ipv4 != nil {
+			v.Ipv4.Prefix = afthelper.CanonicalPrefix(v.Ipv4.GetPrefix())
+		}
+	case *spb.AFTEntry_Ipv6:
+		if v.Ipv6 != nil {
+			v.Ipv6.Prefix = afthelper.CanonicalPrefix(v.Ipv6.GetPrefix())
+		}
+	}
+	return n
+}
+
+// aftEntryKey returns a string that uniquely identifies the AFTEntry e within
+// a GetResponse, using the canonical form of its prefix, if any.
+func aftEntryKey(e *spb.AFTEntry) string {
+	switch v := e.Entry.(type) {
+	case *spb.AFTEntry_Ipv4:
+		return fmt.Sprintf("%s/IPv4/%s", e.GetNetworkInstance(), afthelper.CanonicalPrefix(v.Ipv4.GetPrefix()))
+	case *spb.AFTEntry_Ipv6:
+		return fmt.Sprintf("%s/IPv6/%s", e.GetNetworkInstance(), afthelper.CanonicalPrefix(v.Ipv6.GetPrefix()))
+	case *spb.AFTEntry_NextHopGroup:
+		return fmt.Sprintf("%s/NextHopGroup/%d", e.GetNetworkInstance(), v.NextHopGroup.GetId())
+	case *spb.AFTEntry_NextHop:
+		return fmt.Sprintf("%s/NextHop/%d", e.GetNetworkInstance(), v.NextHop.GetIndex())
+	case *spb.AFTEntry_Mpls:
+		return fmt.Sprintf("%s/MPLS/%d", e.GetNetworkInstance(), v.Mpls.GetLabelUint64())
+	case *spb.AFTEntry_PolicyForwardingEntry:
+		return fmt.Sprintf("%s/PolicyForwarding/%d", e.GetNetworkInstance(), v.PolicyForwardingEntry.GetIndex())
+	}
+	return ""
+}
+
+// GetResponseHasAFTEntries checks whether the supplied GetResponse contains
+// each of the AFTEntry messages specified by wants, which are typically built
+// using the fluent.Expected helpers. Entries are matched by network instance
+// and key, and compared using AFTEntryDiff. It calls t.Fatalf with the diff if
+// an entry differs from the one that is expected, or if it is not found.
+func GetResponseHasAFTEntries(t testing.TB, getres *spb.GetResponse, wants ...*spb.AFTEntry) {
+	t.Helper()
+	got := map[string]*spb.AFTEntry{}
+	for _, e := range getres.GetEntry() {
+		got[aftEntryKey(e)] = e
+	}
+
+	for _, want := range wants {
+		k := aftEntryKey(want)
+		g, ok := got[k]
+		if !ok {
+			t.Fatalf("did not find entry %s, want: %s, got:\n%s", k, want, getres)
+		}
+		if diff := AFTEntryDiff(g, want); diff != "" {
+			t.Fatalf("did not get expected entry %s, diff(-got,+want):\n%s", k, diff)
+		}
+	}
+}
+
+// DiffOpt is an interface implemented by the options that can be handed to
+// HasNoUnexpectedChanges.
+type DiffOpt interface {
+	isDiffOpt()
+}
+
+// allowChange is the internal representation of an option that specifies an
+// entry that is expected to change.
+type allowChange struct {
+	ni  string
+	aft constants.AFT
+	key string
+}
+
+// isDiffOpt marks allowChange as a DiffOpt.
+func (*allowChange) isDiffOpt() {}
+
+// AllowChange specifies that the entry with the specified key, within the AFT a
+// of network instance ni, may be added, removed or modified between the
+// snapshots handed to HasNoUnexpectedChanges. The key is a prefix for the IPv4
+// and IPv6 AFTs, and the decimal label, ID or index for other AFTs.
+func AllowChange(ni string, a constants.AFT, key string) *allowChange {
+	if a == constants.IPv4 || a == constants.IPv6 {
+		key = afthelper.CanonicalPrefix(key)
+	}
+	return &allowChange{ni: ni, aft: a, key: key}
+}
+
+// HasNoUnexpectedChanges checks that the entries that differ between the before
+// and after snapshots, keyed by network instance name, are within the set of
+// entries specified by AllowChange options. Entries that are allowed to change
+// but do not are not reported. It calls t.Fatalf with a description of the
+// unexpected changes if there are any, or if the snapshots cannot be compared.
+//
+// Snapshots can be created from the results of the Get RPC using
+// rib.FromGetResponses.
+func HasNoUnexpectedChanges(t testing.TB, before, after map[string]*aft.RIB, opts ...DiffOpt) {
+	t.Helper()
+	d, err := afthelper.DiffSnapshots(before, after)
+	if err != nil {
+		t.Fatalf("cannot compare snapshots, %v", err)
+	}
+
+	allowed := map[allowChange]bool{}
+	for _, o := range opts {
+		if v, ok := o.(*allowChange); ok {
+			allowed[*v] = true
+		}
+	}
+
+	unexpected := &afthelper.SnapshotDiff{}
+	for _, e := range d.Entries {
+		if !allowed[allowChange{ni: e.NetworkInstance, aft: e.AFT, key: e.Key}] {
+			unexpected.Entries = append(unexpected.Entries, e)
+		}
+	}
+	if !unexpected.Empty() {
+		t.Fatalf("got unexpected changes between snapshots:\n%s", unexpected)
+	}
+}
+
+// GetOpt is an interface implemented by the options that can be handed to
+// HasEntry.
+type GetOpt interface {
+	isGetOpt()
+}
+
+// ignoreMetadata is the internal representation of the IgnoreMetadata option.
+type ignoreMetadata struct{}
+
+// isGetOpt marks ignoreMetadata as a GetOpt.
+func (*ignoreMetadata) isGetOpt() {}
+
+// IgnoreMetadata specifies that the opaque metadata of IPv4, IPv6 and MPLS
+// entries should be ignored when comparing entries, since some devices do not
+// return it.
+func IgnoreMetadata() *ignoreMetadata {
+	return &ignoreMetadata{}
+}
+
+// ignoreNHGWeights is the internal representation of the IgnoreNHGWeights
+// option.
+type ignoreNHGWeights struct{}
+
+// isGetOpt marks ignoreNHGWeights as a GetOpt.
+func (*ignoreNHGWeights) isGetOpt() {}
+
+// IgnoreNHGWeights specifies that the weights of the next-hops within
+// next-hop-groups should be ignored when comparing entries, since some devices
+// normalise the weights that they are programmed with.
+func IgnoreNHGWeights() *ignoreNHGWeights {
+	return &ignoreNHGWeights{}
+}
+
+// getCmpOpts returns the cmp options that implement the supplied GetOpts.
+func getCmpOpts(opts []GetOpt) []cmp.Option {
+	ret := []cmp.Option{}
+	for _, o := range opts {
+		switch o.(type) {
+		case *ignoreMetadata:
+			ret = append(ret,
+				protocmp.IgnoreFields(&aftpb.Afts_Ipv4Entry{}, "entry_metadata"),
+				protocmp.IgnoreFields(&aftpb.Afts_Ipv6Entry{}, "entry_metadata"),
+				protocmp.IgnoreFields(&aftpb.Afts_LabelEntry{}, "entry_metadata"),
+			)
+		case *ignoreNHGWeights:
+			ret = append(ret, protocmp.IgnoreFields(&aftpb.Afts_NextHopGroup_NextHop{}, "weight"))
+		}
+	}
+	return ret
+}
+
+// HasEntry checks whether the supplied GetResponse contains the gRIBI entry
+// described by want. The entry is matched by its network instance and key,
+// irrespective of its position within the GetResponse, and its contents are
+// compared as described for AFTEntryDiff, modified by the specified options.
+//
+// It calls t.Fatalf if the entry differs from want, or if more than one entry
+// with the same key is present. If no entry with the same key is found, the
+// failure includes a diff against the closest entry of the same type.
+func HasEntry(t testing.TB, getres *spb.GetResponse, want fluent.GRIBIEntry, opts ...GetOpt) {
+	t.Helper()
+	wantProto, err := want.EntryProto()
+	if err != nil {
+		t.Fatalf("cannot convert want to an AFTEntry protobuf, %v", err)
+	}
+	k := aftEntryKey(wantProto)
+	if k == "" {
+		t.Fatalf("unsupported entry type %T in want", wantProto.GetEntry())
+	}
+	cmpOpts := getCmpOpts(opts)
+
+	var matches []*spb.AFTEntry
+	for _, e := range getres.GetEntry() {
+		if aftEntryKey(e) == k {
+			matches = append(matches, e)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		// Report the entry of the same type that has the smallest diff, such
+		// that a test failure shows the most likely mismatch.
+		var closest string
+		for _, e := range getres.GetEntry() {
+			if aftTypeOf(e) != aftTypeOf(wantProto) {
+				continue
+			}
+			if d := aftEntryDiff(e, wantProto, cmpOpts...); closest == "" || len(d) < len(closest) {
+				closest = d
+			}
+		}
+		if closest == "" {
+			t.Fatalf("did not find entry %s, got no entries of type %s", k, aftTypeOf(wantProto))
+		}
+		t.Fatalf("did not find entry %s, closest entry diff(-got,+want):\n%s", k, closest)
+	case 1:
+		if diff := aftEntryDiff(matches[0], wantProto, cmpOpts...); diff != "" {
+			t.Fatalf("did not get expected entry %s, diff(-got,+want):\n%s", k, diff)
+		}
+	default:
+		t.Fatalf("got duplicate entries for %s, got: %d entries, want: 1:\n%v", k, len(matches), matches)
+	}
+}
+
+// HasNEntries checks whether the supplied GetResponse contains exactly n entries
+// of the AFT type a, across all network instances. AFTType_ALL counts entries
+// of all types. It calls t.Fatalf if the number of entries differs, or if the
+// GetResponse contains more than one entry with the same key, since such
+// entries would otherwise be counted more than once.
+func HasNEntries(t testing.TB, getres *spb.GetResponse, a spb.AFTType, n int) {
+	t.Helper()
+	seen := map[string]int{}
+	got := 0
+	for _, e := range getres.GetEntry() {
+		if a != spb.AFTType_ALL && aftTypeOf(e) != a {
+			continue
+		}
+		got++
+		seen[aftEntryKey(e)]++
+	}
+
+	dups := []string{}
+	for k, c := range seen {
+		if c > 1 {
+			dups = append(dups, fmt.Sprintf("%s (%d entries)", k, c))
+		}
+	}
+	if len(dups) != 0 {
+		sort.Strings(dups)
+		t.Fatalf("got duplicate entries of type %s: %v", a, dups)
+	}
+	if got != n {
+		t.Fatalf("did not get expected number of entries of type %s, got: %d, want: %d", a, got, n)
+	}
+}
+
+// aftTypeOf returns the AFT type of the entry e.
+func aftTypeOf(e *spb.AFTEntry) spb.AFTType {
+	switch e.GetEntry().(type) {
+	case *spb.AFTEntry_Ipv4:
+		return spb.AFTType_IPV4
+	case *spb.AFTEntry_Ipv6:
+		return spb.AFTType_IPV6
+	case *spb.AFTEntry_Mpls:
+		return spb.AFTType_MPLS
+	case *spb.AFTEntry_NextHopGroup:
+		return spb.AFTType_NEXTHOP_GROUP
+	case *spb.AFTEntry_NextHop:
+		return spb.AFTType_NEXTHOP
+	case *spb.AFTEntry_MacEntry:
+		return spb.AFTType_MAC
+	case *spb.AFTEntry_PolicyForwardingEntry:
+		return spb.AFTType_POLICY_FORWARDING
+	}
+	return spb.AFTType_INVALID
+}
@@ -21,15 +21,19 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/openconfig/gribigo/aft"
 	"github.com/openconfig/gribigo/client"
 	"github.com/openconfig/gribigo/constants"
 	"github.com/openconfig/gribigo/fluent"
 	"github.com/openconfig/testt"
+	"github.com/openconfig/ygot/ygot"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
 	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
 	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
 )
 
 func TestHasMessage(t *testing.T) {
@@ -115,6 +119,38 @@ func TestHasMessage(t *testing.T) {
 			WithMPLSOperation(42).
 			WithOperationType(constants.Add).
 			AsResult(),
+	}, {
+		desc: "network instance ignored when not specified",
+		inResults: []*client.OpResult{{
+			OperationID: 42,
+			Details: &client.OpDetailsResults{
+				Type:            constants.Add,
+				IPv4Prefix:      "1.1.1.1/32",
+				NetworkInstance: "VRF-A",
+			},
+		}},
+		inMsg: fluent.OperationResult().
+			WithOperationID(42).
+			WithIPv4Operation("1.1.1.1/32").
+			WithOperationType(constants.Add).
+			AsResult(),
+	}, {
+		desc: "network instance does not match",
+		inResults: []*client.OpResult{{
+			OperationID: 42,
+			Details: &client.OpDetailsResults{
+				Type:            constants.Add,
+				IPv4Prefix:      "1.1.1.1/32",
+				NetworkInstance: "VRF-A",
+			},
+		}},
+		inMsg: fluent.OperationResult().
+			WithOperationID(42).
+			WithIPv4Operation("1.1.1.1/32").
+			WithNetworkInstance("VRF-B").
+			WithOperationType(constants.Add).
+			AsResult(),
+		expectFatalMsg: "results did not contain a result of value",
 	}}
 
 	for _, tt := range tests {
@@ -133,6 +169,51 @@ func TestHasMessage(t *testing.T) {
 	}
 }
 
+func TestHasSummary(t *testing.T) {
+	ipv4Add := fluent.SummaryKey{AFT: constants.IPv4, Op: constants.Add, Result: fluent.InstalledInRIB}
+	nhAdd := fluent.SummaryKey{AFT: constants.NextHop, Op: constants.Add, Result: fluent.InstalledInRIB}
+
+	tests := []struct {
+		desc           string
+		inGot          fluent.ResultSummary
+		inWant         fluent.ResultSummary
+		expectFatalMsg string
+	}{{
+		desc:   "equal summaries",
+		inGot:  fluent.ResultSummary{ipv4Add: 300, nhAdd: 60},
+		inWant: fluent.ResultSummary{ipv4Add: 300, nhAdd: 60},
+	}, {
+		desc:   "zero count in want matches absent key",
+		inGot:  fluent.ResultSummary{ipv4Add: 300},
+		inWant: fluent.ResultSummary{ipv4Add: 300, nhAdd: 0},
+	}, {
+		desc:           "differing count",
+		inGot:          fluent.ResultSummary{ipv4Add: 299},
+		inWant:         fluent.ResultSummary{ipv4Add: 300},
+		expectFatalMsg: "IPv4/Add/InstalledInRIB: got: 299, want: 300",
+	}, {
+		desc:           "unexpected key",
+		inGot:          fluent.ResultSummary{ipv4Add: 300, nhAdd: 1},
+		inWant:         fluent.ResultSummary{ipv4Add: 300},
+		expectFatalMsg: "NextHop/Add/InstalledInRIB: got: 1, want: 0",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.expectFatalMsg != "" {
+				got := testt.ExpectFatal(t, func(t testing.TB) {
+					HasSummary(t, tt.inGot, tt.inWant)
+				})
+				if !strings.Contains(got, tt.expectFatalMsg) {
+					t.Fatalf("did not get expected fatal message, but test called Fatal, got: %s, want: %s", got, tt.expectFatalMsg)
+				}
+				return
+			}
+			HasSummary(t, tt.inGot, tt.inWant)
+		})
+	}
+}
+
 func TestHasResultsCache(t *testing.T) {
 
 	generatePrefixes := func(numPrefixes uint32) []*client.OpResult {
@@ -520,6 +601,230 @@ func TestGetResponseHasEntries(t *testing.T) {
 	}
 }
 
+func TestGetResponseHasIPv4Prefixes(t *testing.T) {
+	ipv4 := func(ni, p string) *spb.AFTEntry {
+		return &spb.AFTEntry{
+			NetworkInstance: ni,
+			Entry: &spb.AFTEntry_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: p,
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		desc           string
+		inGetRes       *spb.GetResponse
+		inNI           string
+		inWants        []string
+		expectFatalMsg []string
+	}{{
+		desc: "equal sets",
+		inGetRes: &spb.GetResponse{
+			Entry: []*spb.AFTEntry{
+				ipv4("default", "1.1.1.1/32"),
+				ipv4("default", "2.2.2.2/32"),
+				ipv4("vrf", "3.3.3.3/32"),
+			},
+		},
+		inNI:    "default",
+		inWants: []string{"2.2.2.2/32", "1.1.1.1/32"},
+	}, {
+		desc:     "empty sets",
+		inGetRes: &spb.GetResponse{},
+		inNI:     "default",
+	}, {
+		desc: "missing and unexpected prefixes",
+		inGetRes: &spb.GetResponse{
+			Entry: []*spb.AFTEntry{
+				ipv4("default", "1.1.1.1/32"),
+				ipv4("default", "3.3.3.3/32"),
+			},
+		},
+		inNI:           "default",
+		inWants:        []string{"1.1.1.1/32", "2.2.2.2/32"},
+		expectFatalMsg: []string{"missing (1):\n\t2.2.2.2/32", "unexpected (1):\n\t3.3.3.3/32"},
+	}, {
+		desc: "prefix in another network instance",
+		inGetRes: &spb.GetResponse{
+			Entry: []*spb.AFTEntry{
+				ipv4("vrf", "1.1.1.1/32"),
+			},
+		},
+		inNI:           "default",
+		inWants:        []string{"1.1.1.1/32"},
+		expectFatalMsg: []string{"missing (1):\n\t1.1.1.1/32", "unexpected (0)"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.expectFatalMsg != nil {
+				got := testt.ExpectFatal(t, func(t testing.TB) {
+					GetResponseHasIPv4Prefixes(t, tt.inGetRes, tt.inNI, tt.inWants)
+				})
+				for _, m := range tt.expectFatalMsg {
+					if !strings.Contains(got, m) {
+						t.Fatalf("did not get expected fatal message, got: %s, want: %s", got, m)
+					}
+				}
+				return
+			}
+			GetResponseHasIPv4Prefixes(t, tt.inGetRes, tt.inNI, tt.inWants)
+		})
+	}
+}
+
+func TestAFTEntryDiff(t *testing.T) {
+	// withPrefix returns a copy of the IPv4 or IPv6 entry e with its prefix set
+	// to p, as it would be received from a server that formats it differently.
+	withPrefix := func(e *spb.AFTEntry, p string) *spb.AFTEntry {
+		n := proto.Clone(e).(*spb.AFTEntry)
+		switch v := n.Entry.(type) {
+		case *spb.AFTEntry_Ipv4:
+			v.Ipv4.Prefix = p
+		case *spb.AFTEntry_Ipv6:
+			v.Ipv6.Prefix = p
+		}
+		return n
+	}
+
+	tests := []struct {
+		desc         string
+		inGot        *spb.AFTEntry
+		inWant       *spb.AFTEntry
+		wantDiff     bool
+		wantContains []string
+	}{{
+		desc:   "identical IPv4 entries",
+		inGot:  fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+		inWant: fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+	}, {
+		desc:   "IPv4 prefix length with leading zero",
+		inGot:  withPrefix(fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"), "10.0.0.0/08"),
+		inWant: fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+	}, {
+		desc:   "IPv4 prefix with host bits set",
+		inGot:  withPrefix(fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"), "10.1.2.3/8"),
+		inWant: fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+	}, {
+		desc:   "IPv6 prefix in non-canonical form",
+		inGot:  withPrefix(fluent.ExpectedIPv6("2001:db8::/32", 1, "default"), "2001:0DB8:0:0::/32"),
+		inWant: fluent.ExpectedIPv6("2001:db8::/32", 1, "default"),
+	}, {
+		desc: "FIB status is ignored",
+		inGot: func() *spb.AFTEntry {
+			e := fluent.ExpectedIPv4("10.0.0.0/8", 1, "default")
+			e.FibStatus = spb.AFTEntry_PROGRAMMED
+			return e
+		}(),
+		inWant: fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+	}, {
+		desc:   "next-hop-groups with same members",
+		inGot:  fluent.ExpectedNextHopGroup(1, map[uint64]uint64{1: 1, 2: 3}, "default"),
+		inWant: fluent.ExpectedNextHopGroup(1, map[uint64]uint64{2: 3, 1: 1}, "default"),
+	}, {
+		desc: "next-hop-group members in different order",
+		inGot: func() *spb.AFTEntry {
+			e := fluent.ExpectedNextHopGroup(1, map[uint64]uint64{1: 1, 2: 3}, "default")
+			nhs := e.GetNextHopGroup().GetNextHopGroup().NextHop
+			nhs[0], nhs[1] = nhs[1], nhs[0]
+			return e
+		}(),
+		inWant: fluent.ExpectedNextHopGroup(1, map[uint64]uint64{1: 1, 2: 3}, "default"),
+	}, {
+		desc:         "different next-hop-group",
+		inGot:        fluent.ExpectedIPv4("10.0.0.0/8", 2, "default"),
+		inWant:       fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+		wantDiff:     true,
+		wantContains: []string{"next_hop_group", "-", "2", "+", "1"},
+	}, {
+		desc:         "different prefix",
+		inGot:        fluent.ExpectedIPv4("10.0.0.0/16", 1, "default"),
+		inWant:       fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+		wantDiff:     true,
+		wantContains: []string{"10.0.0.0/16", "10.0.0.0/8"},
+	}, {
+		desc:         "different network instance",
+		inGot:        fluent.ExpectedNextHop(1, "192.0.2.1", "vrf"),
+		inWant:       fluent.ExpectedNextHop(1, "192.0.2.1", "default"),
+		wantDiff:     true,
+		wantContains: []string{"network_instance", "vrf", "default"},
+	}, {
+		desc:         "invalid prefix compared as string",
+		inGot:        withPrefix(fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"), "10.0.0.0/33"),
+		inWant:       fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+		wantDiff:     true,
+		wantContains: []string{"10.0.0.0/33"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			diff := AFTEntryDiff(tt.inGot, tt.inWant)
+			if (diff != "") != tt.wantDiff {
+				t.Fatalf("AFTEntryDiff(): did not get expected result, got diff:\n%s\nwantDiff? %v", diff, tt.wantDiff)
+			}
+			for _, m := range tt.wantContains {
+				if !strings.Contains(diff, m) {
+					t.Errorf("AFTEntryDiff(): did not get expected content in diff, got:\n%s\nwant: %s", diff, m)
+				}
+			}
+		})
+	}
+}
+
+func TestGetResponseHasAFTEntries(t *testing.T) {
+	getres := &spb.GetResponse{
+		Entry: []*spb.AFTEntry{
+			fluent.ExpectedNextHop(1, "192.0.2.1", "default"),
+			fluent.ExpectedNextHopGroup(1, map[uint64]uint64{1: 1}, "default"),
+			func() *spb.AFTEntry {
+				e := fluent.ExpectedIPv4("10.0.0.0/8", 1, "default")
+				e.GetIpv4().Prefix = "10.0.0.0/08"
+				return e
+			}(),
+			fluent.ExpectedIPv4("10.0.0.0/8", 1, "vrf"),
+		},
+	}
+
+	tests := []struct {
+		desc           string
+		inWants        []*spb.AFTEntry
+		expectFatalMsg string
+	}{{
+		desc: "all entries present",
+		inWants: []*spb.AFTEntry{
+			fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+			fluent.ExpectedIPv4("10.0.0.0/8", 1, "vrf"),
+			fluent.ExpectedNextHopGroup(1, map[uint64]uint64{1: 1}, "default"),
+			fluent.ExpectedNextHop(1, "192.0.2.1", "default"),
+		},
+	}, {
+		desc:           "missing entry",
+		inWants:        []*spb.AFTEntry{fluent.ExpectedIPv4("192.0.2.0/24", 1, "default")},
+		expectFatalMsg: "did not find entry default/IPv4/192.0.2.0/24",
+	}, {
+		desc:           "mismatched entry",
+		inWants:        []*spb.AFTEntry{fluent.ExpectedNextHopGroup(1, map[uint64]uint64{1: 2}, "default")},
+		expectFatalMsg: "did not get expected entry default/NextHopGroup/1",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.expectFatalMsg != "" {
+				got := testt.ExpectFatal(t, func(t testing.TB) {
+					GetResponseHasAFTEntries(t, getres, tt.inWants...)
+				})
+				if !strings.Contains(got, tt.expectFatalMsg) {
+					t.Fatalf("did not get expected fatal message, got: %s, want: %s", got, tt.expectFatalMsg)
+				}
+				return
+			}
+			GetResponseHasAFTEntries(t, getres, tt.inWants...)
+		})
+	}
+}
+
 func TestHasRecvClientErrorWithStatus(t *testing.T) {
 	tests := []struct {
 		desc           string
@@ -672,3 +977,229 @@ func TestHasRecvClientErrorWithStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestHasNoUnexpectedChanges(t *testing.T) {
+	// snapshot returns a snapshot in which each of the IPv4 prefixes uses
+	// next-hop-group 1, which contains next-hop 1 with the specified weight.
+	snapshot := func(weight uint64, prefixes ...string) map[string]*aft.RIB {
+		r := &aft.RIB{}
+		for _, p := range prefixes {
+			r.GetOrCreateAfts().GetOrCreateIpv4Entry(p).NextHopGroup = ygot.Uint64(1)
+		}
+		r.GetOrCreateAfts().GetOrCreateNextHopGroup(1).GetOrCreateNextHop(1).Weight = ygot.Uint64(weight)
+		r.GetOrCreateAfts().GetOrCreateNextHop(1).IpAddress = ygot.String("192.0.2.1")
+		return map[string]*aft.RIB{"DEFAULT": r}
+	}
+
+	tests := []struct {
+		desc           string
+		inBefore       map[string]*aft.RIB
+		inAfter        map[string]*aft.RIB
+		inOpts         []DiffOpt
+		expectFatalMsg []string
+		// notExpectFatalMsg are strings that must not be within the fatal
+		// message, since they describe changes that are allowed.
+		notExpectFatalMsg []string
+	}{{
+		desc:     "no changes",
+		inBefore: snapshot(1, "1.1.1.0/24"),
+		inAfter:  snapshot(1, "01.1.1.0/24"),
+	}, {
+		desc:     "allowed changes",
+		inBefore: snapshot(1, "1.1.1.0/24"),
+		inAfter:  snapshot(2, "1.1.1.0/24", "2.2.2.0/24"),
+		inOpts: []DiffOpt{
+			AllowChange("DEFAULT", constants.IPv4, "02.2.2.0/24"),
+			AllowChange("DEFAULT", constants.NextHopGroup, "1"),
+			AllowChange("DEFAULT", constants.IPv4, "3.3.3.0/24"),
+		},
+	}, {
+		desc:     "unexpected changes",
+		inBefore: snapshot(1, "1.1.1.0/24"),
+		inAfter:  snapshot(2, "2.2.2.0/24"),
+		inOpts: []DiffOpt{
+			AllowChange("DEFAULT", constants.IPv4, "2.2.2.0/24"),
+		},
+		expectFatalMsg: []string{
+			"IPv4 1.1.1.0/24 removed in NI DEFAULT",
+			"NextHopGroup 1 modified in NI DEFAULT\n\tnext-hop 1 weight: 1 -> 2",
+		},
+		notExpectFatalMsg: []string{"2.2.2.0/24"},
+	}, {
+		desc:     "change allowed in other network instance",
+		inBefore: snapshot(1, "1.1.1.0/24"),
+		inAfter:  snapshot(1, "1.1.1.0/24", "2.2.2.0/24"),
+		inOpts: []DiffOpt{
+			AllowChange("VRF-A", constants.IPv4, "2.2.2.0/24"),
+		},
+		expectFatalMsg: []string{"IPv4 2.2.2.0/24 added in NI DEFAULT"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.expectFatalMsg != nil {
+				got := testt.ExpectFatal(t, func(t testing.TB) {
+					HasNoUnexpectedChanges(t, tt.inBefore, tt.inAfter, tt.inOpts...)
+				})
+				for _, m := range tt.expectFatalMsg {
+					if !strings.Contains(got, m) {
+						t.Fatalf("did not get expected fatal message, got: %s, want: %s", got, m)
+					}
+				}
+				for _, m := range tt.notExpectFatalMsg {
+					if strings.Contains(got, m) {
+						t.Fatalf("got allowed change in fatal message, got: %s, did not want: %s", got, m)
+					}
+				}
+				return
+			}
+			HasNoUnexpectedChanges(t, tt.inBefore, tt.inAfter, tt.inOpts...)
+		})
+	}
+}
+
+func TestHasEntry(t *testing.T) {
+	// withMetadata returns the IPv4 entry e with the metadata m.
+	withMetadata := func(e *spb.AFTEntry, m string) *spb.AFTEntry {
+		e.GetIpv4().GetIpv4Entry().EntryMetadata = &wpb.BytesValue{Value: []byte(m)}
+		return e
+	}
+
+	getres := &spb.GetResponse{
+		Entry: []*spb.AFTEntry{
+			fluent.ExpectedNextHopGroup(1, map[uint64]uint64{1: 10, 2: 20}, "default"),
+			fluent.ExpectedNextHop(1, "192.0.2.1", "default"),
+			withMetadata(fluent.ExpectedIPv4("10.0.0.0/08", 1, "default"), "device"),
+			fluent.ExpectedIPv4("192.0.2.0/24", 1, "default"),
+			fluent.ExpectedIPv4("192.0.2.0/24", 2, "default"),
+		},
+	}
+
+	tests := []struct {
+		desc           string
+		inWant         fluent.GRIBIEntry
+		inOpts         []GetOpt
+		expectFatalMsg []string
+	}{{
+		desc:   "matching next-hop",
+		inWant: fluent.NextHopEntry().WithIndex(1).WithIPAddress("192.0.2.1").WithNetworkInstance("default"),
+	}, {
+		desc: "next-hop-group with members in different order",
+		inWant: fluent.NextHopGroupEntry().WithID(1).WithNetworkInstance("default").
+			AddNextHop(2, 20).AddNextHop(1, 10),
+	}, {
+		desc: "next-hop-group weights differ",
+		inWant: fluent.NextHopGroupEntry().WithID(1).WithNetworkInstance("default").
+			AddNextHop(1, 1).AddNextHop(2, 2),
+		expectFatalMsg: []string{"did not get expected entry default/NextHopGroup/1", "uint64(10)", "uint64(1)"},
+	}, {
+		desc: "next-hop-group weights ignored",
+		inWant: fluent.NextHopGroupEntry().WithID(1).WithNetworkInstance("default").
+			AddNextHop(1, 1).AddNextHop(2, 2),
+		inOpts: []GetOpt{IgnoreNHGWeights()},
+	}, {
+		desc:           "metadata differs",
+		inWant:         fluent.IPv4Entry().WithPrefix("10.0.0.0/8").WithNextHopGroup(1).WithNetworkInstance("default"),
+		expectFatalMsg: []string{"did not get expected entry default/IPv4/10.0.0.0/8", "entry_metadata"},
+	}, {
+		desc:   "metadata ignored",
+		inWant: fluent.IPv4Entry().WithPrefix("10.0.0.0/8").WithNextHopGroup(1).WithNetworkInstance("default"),
+		inOpts: []GetOpt{IgnoreMetadata()},
+	}, {
+		desc:           "missing entry reports closest candidate",
+		inWant:         fluent.NextHopEntry().WithIndex(2).WithIPAddress("192.0.2.1").WithNetworkInstance("default"),
+		expectFatalMsg: []string{"did not find entry default/NextHop/2, closest entry diff(-got,+want)", "uint64(1)", "uint64(2)"},
+	}, {
+		desc:           "missing entry with no candidates",
+		inWant:         fluent.IPv6Entry().WithPrefix("2001:db8::/32").WithNextHopGroup(1).WithNetworkInstance("default"),
+		expectFatalMsg: []string{"did not find entry default/IPv6/2001:db8::/32, got no entries of type IPV6"},
+	}, {
+		desc:           "duplicate entries",
+		inWant:         fluent.IPv4Entry().WithPrefix("192.0.2.0/24").WithNextHopGroup(1).WithNetworkInstance("default"),
+		expectFatalMsg: []string{"got duplicate entries for default/IPv4/192.0.2.0/24, got: 2 entries"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.expectFatalMsg != nil {
+				got := testt.ExpectFatal(t, func(t testing.TB) {
+					HasEntry(t, getres, tt.inWant, tt.inOpts...)
+				})
+				for _, m := range tt.expectFatalMsg {
+					if !strings.Contains(got, m) {
+						t.Fatalf("did not get expected fatal message, got: %s, want: %s", got, m)
+					}
+				}
+				return
+			}
+			HasEntry(t, getres, tt.inWant, tt.inOpts...)
+		})
+	}
+}
+
+func TestHasNEntries(t *testing.T) {
+	tests := []struct {
+		desc           string
+		inGetRes       *spb.GetResponse
+		inAFT          spb.AFTType
+		inN            int
+		expectFatalMsg string
+	}{{
+		desc: "expected number of entries",
+		inGetRes: &spb.GetResponse{
+			Entry: []*spb.AFTEntry{
+				fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+				fluent.ExpectedIPv4("10.0.0.0/8", 1, "vrf"),
+				fluent.ExpectedNextHop(1, "192.0.2.1", "default"),
+			},
+		},
+		inAFT: spb.AFTType_IPV4,
+		inN:   2,
+	}, {
+		desc: "all AFTs",
+		inGetRes: &spb.GetResponse{
+			Entry: []*spb.AFTEntry{
+				fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+				fluent.ExpectedNextHop(1, "192.0.2.1", "default"),
+			},
+		},
+		inAFT: spb.AFTType_ALL,
+		inN:   2,
+	}, {
+		desc: "unexpected number of entries",
+		inGetRes: &spb.GetResponse{
+			Entry: []*spb.AFTEntry{
+				fluent.ExpectedNextHop(1, "192.0.2.1", "default"),
+			},
+		},
+		inAFT:          spb.AFTType_NEXTHOP,
+		inN:            2,
+		expectFatalMsg: "did not get expected number of entries of type NEXTHOP, got: 1, want: 2",
+	}, {
+		desc: "duplicate entries",
+		inGetRes: &spb.GetResponse{
+			Entry: []*spb.AFTEntry{
+				fluent.ExpectedIPv4("10.0.0.0/8", 1, "default"),
+				fluent.ExpectedIPv4("10.0.0.0/08", 2, "default"),
+			},
+		},
+		inAFT:          spb.AFTType_IPV4,
+		inN:            2,
+		expectFatalMsg: "got duplicate entries of type IPV4: [default/IPv4/10.0.0.0/8 (2 entries)]",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.expectFatalMsg != "" {
+				got := testt.ExpectFatal(t, func(t testing.TB) {
+					HasNEntries(t, tt.inGetRes, tt.inAFT, tt.inN)
+				})
+				if !strings.Contains(got, tt.expectFatalMsg) {
+					t.Fatalf("did not get expected fatal message, got: %s, want: %s", got, tt.expectFatalMsg)
+				}
+				return
+			}
+			HasNEntries(t, tt.inGetRes, tt.inAFT, tt.inN)
+		})
+	}
+}
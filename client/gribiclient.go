@@ -114,6 +114,38 @@ type Client struct {
 	// sendExitCh is a channel that is used to indicate that the sender for the
 	// client is exited, such that other goroutines can clean up.
 	sendExitCh chan struct{}
+
+	// respMirror is a channel to which each ModifyResponse that is received
+	// from the server is written, if it is non-nil.
+	respMirror chan<- *spb.ModifyResponse
+	// mirrorDropped is the number of ModifyResponses that could not be written
+	// to respMirror because it was full.
+	mirrorDropped atomic.Uint64
+
+	// sentFn and recvFn are called with each ModifyRequest that is sent, and
+	// each ModifyResponse that is received, if they are non-nil.
+	sentFn func(*spb.ModifyRequest)
+	recvFn func(*spb.ModifyResponse)
+
+	// sentOps, ribACKs, fibACKs and failedOps count the number of AFT operations
+	// that have been sent, and the results that have been received for them.
+	sentOps, ribACKs, fibACKs, failedOps atomic.Uint64
+}
+
+// Stats is a snapshot of the counters of AFT operations that have been sent by
+// a client, and the results that have been received for them.
+type Stats struct {
+	// Sent is the number of AFT operations that have been sent to the server.
+	Sent uint64
+	// RIBACKs is the number of RIB_PROGRAMMED results that have been received.
+	RIBACKs uint64
+	// FIBACKs is the number of FIB_PROGRAMMED results that have been received.
+	FIBACKs uint64
+	// Failed is the number of FAILED or FIB_FAILED results that have been received.
+	Failed uint64
+	// Pending is the number of AFT operations for which the client is awaiting
+	// a result.
+	Pending uint64
 }
 
 // clientState is used to store the configured (immutable) state of the client.
@@ -174,6 +206,47 @@ func (c *Client) Done() <-chan struct{} {
 	return c.doneCh
 }
 
+// MirrorResponses specifies that each ModifyResponse that is received from the
+// server should be written to ch, in the order in which the responses are received.
+// Writes to ch do not block the client, if ch is full then the response is not
+// written to it, and is counted in MirrorDropped. MirrorResponses must be called
+// prior to Connect.
+func (c *Client) MirrorResponses(ch chan<- *spb.ModifyResponse) {
+	c.respMirror = ch
+}
+
+// ObserveMessages specifies that sent should be called with each ModifyRequest that
+// is sent to the server, and received with each ModifyResponse that is received
+// from it. Requests are observed before they are sent, such that a request is
+// always observed before the responses to it. The functions are called from the
+// goroutines that send and receive messages without holding locks within the
+// client, and hence should return promptly. Either function may be nil.
+// ObserveMessages must be called prior to Connect.
+func (c *Client) ObserveMessages(sent func(*spb.ModifyRequest), received func(*spb.ModifyResponse)) {
+	c.sentFn, c.recvFn = sent, received
+}
+
+// Stats returns a snapshot of the counters of AFT operations that have been sent
+// by the client, and the results that have been received for them.
+func (c *Client) Stats() *Stats {
+	c.qs.pendMu.RLock()
+	pending := len(c.qs.pendq.Ops)
+	c.qs.pendMu.RUnlock()
+	return &Stats{
+		Sent:    c.sentOps.Load(),
+		RIBACKs: c.ribACKs.Load(),
+		FIBACKs: c.fibACKs.Load(),
+		Failed:  c.failedOps.Load(),
+		Pending: uint64(pending),
+	}
+}
+
+// MirrorDropped returns the number of ModifyResponses that were not written to
+// the channel supplied to MirrorResponses because it was full.
+func (c *Client) MirrorDropped() uint64 {
+	return c.mirrorDropped.Load()
+}
+
 // handleParams takes the set of gRIBI client options that are provided and uses them
 // to populate the session parameters that they are translated into. It returns a
 // populate SessionParameters protobuf along with any errors when parsing the supplied
@@ -212,18 +285,56 @@ type DialOpt interface {
 	isDialOpt()
 }
 
+// WithTransportCredentials specifies the transport credentials that are used
+// when dialing the server. By default, TLS is used without verifying the
+// certificate presented by the server.
+func WithTransportCredentials(creds credentials.TransportCredentials) *transportCreds {
+	return &transportCreds{creds: creds}
+}
+
+// transportCreds is the internal implementation of WithTransportCredentials.
+type transportCreds struct {
+	creds credentials.TransportCredentials
+}
+
+// isDialOpt implements the DialOpt interface.
+func (*transportCreds) isDialOpt() {}
+
+// WithDialOptions specifies gRPC dial options that are used when dialing the
+// server, in addition to those used by default - for example, interceptors that
+// add authentication tokens to each RPC, or a custom dialer. Options that are
+// specified are applied after the defaults, and hence take precedence over them.
+func WithDialOptions(opts ...grpc.DialOption) *dialOptions {
+	return &dialOptions{opts: opts}
+}
+
+// dialOptions is the internal implementation of WithDialOptions.
+type dialOptions struct {
+	opts []grpc.DialOption
+}
+
+// isDialOpt implements the DialOpt interface.
+func (*dialOptions) isDialOpt() {}
+
 // Dial dials the server specified in the addr string, using the specified
 // set of dial options.
 func (c *Client) Dial(ctx context.Context, addr string, opts ...DialOpt) error {
-	// TODO(robjs): translate any options within the dial options here, we may
-	// want to consider just accepting some gRPC dialoptions directly.
-
 	dialOpts := []grpc.DialOption{grpc.WithBlock()}
 
-	tlsc := credentials.NewTLS(&tls.Config{
+	var tlsc credentials.TransportCredentials = credentials.NewTLS(&tls.Config{
 		InsecureSkipVerify: true,
 	})
+	var extra []grpc.DialOption
+	for _, o := range opts {
+		switch v := o.(type) {
+		case *transportCreds:
+			tlsc = v.creds
+		case *dialOptions:
+			extra = append(extra, v.opts...)
+		}
+	}
 	dialOpts = append(dialOpts, grpc.WithTransportCredentials(tlsc))
+	dialOpts = append(dialOpts, extra...)
 
 	conn, err := grpc.DialContext(ctx, addr, dialOpts...)
 	if err != nil {
@@ -244,6 +355,18 @@ func (c *Client) UseStub(stub spb.GRIBIClient) error {
 	return nil
 }
 
+// OpenModifyStream opens an additional Modify RPC to the server using the
+// connection or stub of the client. The returned stream is not managed by the
+// client, such that no messages are sent on it, and responses received on it are
+// not processed. It is intended for testing the behaviour of a server when more
+// than one Modify RPC is opened on the same connection.
+func (c *Client) OpenModifyStream(ctx context.Context) (spb.GRIBI_ModifyClient, error) {
+	if c.c == nil {
+		return nil, errors.New("client is not connected to a server")
+	}
+	return c.c.Modify(ctx)
+}
+
 // Reset clears the client's transient state - is is recommended to call this method between
 // reconnections at a server to clear pending queues and results which are no longer valid.
 func (c *Client) Reset() {
@@ -272,6 +395,10 @@ func (c *Client) Reset() {
 	defer c.qs.resultMu.Unlock()
 	c.qs.resultq = nil
 
+	for _, v := range []*atomic.Uint64{&c.sentOps, &c.ribACKs, &c.fibACKs, &c.failedOps} {
+		v.Store(0)
+	}
+
 	c.qs.modifyCh = make(chan *spb.ModifyRequest, 5)
 
 	// Empty the done channel if a reader did not take the message from it.
@@ -429,6 +556,14 @@ func (c *Client) Connect(ctx context.Context) error {
 			c.addReadErr(err)
 			return true
 		}
+		if c.respMirror != nil {
+			select {
+			case c.respMirror <- in:
+			default:
+				c.mirrorDropped.Inc()
+				log.Warningf("dropped message mirroring ModifyResponse, channel is full: %s", in)
+			}
+		}
 		if err := c.handleModifyResponse(in); err != nil {
 			log.Errorf("got error processing message received from server, %v", err)
 			c.addReadErr(err)
@@ -453,7 +588,11 @@ func (c *Client) Connect(ctx context.Context) error {
 				log.V(2).Infof("shutting down recv goroutine, id: %s, cause: SHUTDOWN", id)
 				return
 			}
-			if done := respHandler(stream.Recv()); done {
+			in, err := stream.Recv()
+			if err == nil && c.recvFn != nil {
+				c.recvFn(in)
+			}
+			if done := respHandler(in, err); done {
 				log.V(2).Infof("shuttting down recv goroutine, id: %s, cause: HANDLER", id)
 				return
 			}
@@ -505,6 +644,9 @@ func (c *Client) Connect(ctx context.Context) error {
 			}
 
 			v, ok := <-c.qs.modifyCh
+			if ok && c.sentFn != nil {
+				c.sentFn(v)
+			}
 			if done := reqHandler(v, ok); done {
 				log.V(2).Infof("shutting down send goroutine, id: %s, cause: HANDLER", id)
 				return
@@ -672,6 +814,10 @@ type OpResult struct {
 	// Details stores detailed information about the operation over the ID
 	// and the result.
 	Details *OpDetailsResults
+
+	// ErrorDetails stores the details of the error that the server returned
+	// for a failed AFT operation.
+	ErrorDetails *spb.AFTErrorDetails
 }
 
 // String returns a string for an OpResult for debugging purposes.
@@ -697,6 +843,10 @@ func (o *OpResult) String() string {
 		buf.WriteString(fmt.Sprintf(" SessionParameterResult: OK (%s)", v.String()))
 	}
 
+	if v := o.ErrorDetails.GetErrorMessage(); v != "" {
+		buf.WriteString(fmt.Sprintf(" Error Details: %s", v))
+	}
+
 	if v := o.ClientError; v != "" {
 		buf.WriteString(fmt.Sprintf(" With Error: %s", v))
 	}
@@ -705,6 +855,43 @@ func (o *OpResult) String() string {
 	return buf.String()
 }
 
+// IPv4Prefix returns the IPv4 prefix of the entry that the result refers to,
+// and whether the result refers to an IPv4 entry.
+func (o *OpResult) IPv4Prefix() (string, bool) {
+	if o == nil || o.Details == nil || o.Details.IPv4Prefix == "" {
+		return "", false
+	}
+	return o.Details.IPv4Prefix, true
+}
+
+// NextHopGroupID returns the ID of the next-hop-group that the result refers
+// to, and whether the result refers to a next-hop-group entry.
+func (o *OpResult) NextHopGroupID() (uint64, bool) {
+	if o == nil || o.Details == nil || o.Details.NextHopGroupID == 0 {
+		return 0, false
+	}
+	return o.Details.NextHopGroupID, true
+}
+
+// NextHopID returns the index of the next-hop that the result refers to, and
+// whether the result refers to a next-hop entry.
+func (o *OpResult) NextHopID() (uint64, bool) {
+	if o == nil || o.Details == nil || o.Details.NextHopIndex == 0 {
+		return 0, false
+	}
+	return o.Details.NextHopIndex, true
+}
+
+// NetworkInstance returns the network instance of the operation that the result
+// refers to. It returns an empty string if the result does not refer to an
+// AFT operation.
+func (o *OpResult) NetworkInstance() string {
+	if o == nil || o.Details == nil {
+		return ""
+	}
+	return o.Details.NetworkInstance
+}
+
 // OpDetailsResults provides details of an operation for use in the results.
 type OpDetailsResults struct {
 	// Type is the type of the operation (i.e., ADD, MODIFY, DELETE)
@@ -721,6 +908,11 @@ type OpDetailsResults struct {
 	IPv6Prefix string
 	// MPLSLabel is the MPLS label that was modified by the operation.
 	MPLSLabel uint64
+	// PolicyForwardingIndex is the index of the policy-forwarding entry that
+	// was modified by the operation.
+	PolicyForwardingIndex uint64
+	// NetworkInstance is the network instance that the operation was sent for.
+	NetworkInstance string
 }
 
 // String returns a human-readable form of the OpDetailsResults
@@ -741,6 +933,11 @@ func (o *OpDetailsResults) String() string {
 		buf.WriteString(fmt.Sprintf("IPv6: %s", o.IPv6Prefix))
 	case o.MPLSLabel != 0:
 		buf.WriteString(fmt.Sprintf("MPLS: %d", o.MPLSLabel))
+	case o.PolicyForwardingIndex != 0:
+		buf.WriteString(fmt.Sprintf("PBR Index: %d", o.PolicyForwardingIndex))
+	}
+	if o.NetworkInstance != "" {
+		buf.WriteString(fmt.Sprintf(" NI: %s", o.NetworkInstance))
 	}
 	buf.WriteString(">")
 
@@ -836,6 +1033,7 @@ func (c *Client) handleModifyRequest(m *spb.ModifyRequest) error {
 		if err := c.addPendingOp(o); err != nil {
 			return err
 		}
+		c.sentOps.Inc()
 	}
 
 	if m.ElectionId != nil {
@@ -890,6 +1088,14 @@ func (c *Client) handleModifyResponse(m *spb.ModifyResponse) error {
 	}
 
 	for _, r := range m.Result {
+		switch r.GetStatus() {
+		case spb.AFTResult_RIB_PROGRAMMED:
+			c.ribACKs.Inc()
+		case spb.AFTResult_FIB_PROGRAMMED:
+			c.fibACKs.Inc()
+		case spb.AFTResult_FAILED, spb.AFTResult_FIB_FAILED:
+			c.failedOps.Inc()
+		}
 		res, err := c.clearPendingOp(r)
 		c.qs.resultq = append(c.qs.resultq, res)
 		if err != nil {
@@ -992,7 +1198,8 @@ func (c *Client) clearPendingOp(op *spb.AFTResult) (*OpResult, error) {
 	}
 
 	det := &OpDetailsResults{
-		Type: constants.OpFromAFTOp(v.Op.Op),
+		Type:            constants.OpFromAFTOp(v.Op.Op),
+		NetworkInstance: v.Op.GetNetworkInstance(),
 	}
 	switch opEntry := v.Op.Entry.(type) {
 	case *spb.AFTOperation_Ipv4:
@@ -1005,6 +1212,8 @@ func (c *Client) clearPendingOp(op *spb.AFTResult) (*OpResult, error) {
 		det.NextHopGroupID = opEntry.NextHopGroup.GetId()
 	case *spb.AFTOperation_NextHop:
 		det.NextHopIndex = opEntry.NextHop.GetIndex()
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		det.PolicyForwardingIndex = opEntry.PolicyForwardingEntry.GetIndex()
 	}
 
 	n := unixTS()
@@ -1014,6 +1223,7 @@ func (c *Client) clearPendingOp(op *spb.AFTResult) (*OpResult, error) {
 		OperationID:       op.GetId(),
 		ProgrammingResult: op.GetStatus(),
 		Details:           det,
+		ErrorDetails:      op.GetErrorDetails(),
 	}, nil
 }
 
@@ -1314,7 +1524,7 @@ func (c *Client) Get(ctx context.Context, sreq *spb.GetRequest) (*spb.GetRespons
 
 	stream, err := c.c.Get(ctx, sreq)
 	if err != nil {
-		return nil, fmt.Errorf("cannot send Get RPC, %v", err)
+		return nil, fmt.Errorf("cannot send Get RPC, %w", err)
 	}
 
 	for {
@@ -1323,7 +1533,7 @@ func (c *Client) Get(ctx context.Context, sreq *spb.GetRequest) (*spb.GetRespons
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("error in Get RPC, %v", err)
+			return nil, fmt.Errorf("error in Get RPC, %w", err)
 		}
 		result.Entry = append(result.Entry, getres.Entry...)
 
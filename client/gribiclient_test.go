@@ -1408,6 +1408,18 @@ func TestOpResultString(t *testing.T) {
 			OperationID: 42,
 		},
 		want: "<0 (0 nsec): AFTOperation { ID: 42, Details: <nil>, Status: UNSET }>",
+	}, {
+		desc: "details with network instance",
+		inResult: &OpResult{
+			OperationID:       42,
+			ProgrammingResult: spb.AFTResult_RIB_PROGRAMMED,
+			Details: &OpDetailsResults{
+				Type:            constants.Add,
+				IPv4Prefix:      "192.0.2.1/32",
+				NetworkInstance: "VRF-A",
+			},
+		},
+		want: "<0 (0 nsec): AFTOperation { ID: 42, Details: <Type: Add IPv4: 192.0.2.1/32 NI: VRF-A>, Status: RIB_PROGRAMMED }>",
 	}}
 
 	for _, tt := range tests {
@@ -1419,6 +1431,73 @@ func TestOpResultString(t *testing.T) {
 	}
 }
 
+func TestOpResultKeys(t *testing.T) {
+	type key struct {
+		IPv4Prefix      string
+		IsIPv4          bool
+		NextHopGroupID  uint64
+		IsNextHopGroup  bool
+		NextHopID       uint64
+		IsNextHop       bool
+		NetworkInstance string
+	}
+
+	tests := []struct {
+		desc     string
+		inResult *OpResult
+		want     key
+	}{{
+		desc:     "nil result",
+		inResult: nil,
+	}, {
+		desc: "result without details",
+		inResult: &OpResult{
+			CurrentServerElectionID: &spb.Uint128{Low: 1},
+		},
+	}, {
+		desc: "IPv4 entry",
+		inResult: &OpResult{
+			OperationID: 1,
+			Details: &OpDetailsResults{
+				IPv4Prefix:      "192.0.2.1/32",
+				NetworkInstance: "DEFAULT",
+			},
+		},
+		want: key{IPv4Prefix: "192.0.2.1/32", IsIPv4: true, NetworkInstance: "DEFAULT"},
+	}, {
+		desc: "next-hop-group entry",
+		inResult: &OpResult{
+			OperationID: 2,
+			Details: &OpDetailsResults{
+				NextHopGroupID:  42,
+				NetworkInstance: "VRF-A",
+			},
+		},
+		want: key{NextHopGroupID: 42, IsNextHopGroup: true, NetworkInstance: "VRF-A"},
+	}, {
+		desc: "next-hop entry",
+		inResult: &OpResult{
+			OperationID: 3,
+			Details: &OpDetailsResults{
+				NextHopIndex: 84,
+			},
+		},
+		want: key{NextHopID: 84, IsNextHop: true},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := key{NetworkInstance: tt.inResult.NetworkInstance()}
+			got.IPv4Prefix, got.IsIPv4 = tt.inResult.IPv4Prefix()
+			got.NextHopGroupID, got.IsNextHopGroup = tt.inResult.NextHopGroupID()
+			got.NextHopID, got.IsNextHop = tt.inResult.NextHopID()
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Fatalf("did not get expected keys, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestFlush(t *testing.T) {
 	tests := []struct {
 		desc         string
@@ -16,5 +16,7 @@
 // server for compliance testing.
 //
 // It takes a command-line argument of -addr which specifies the host:port that
-// the gRIBI server under test is at.
+// the gRIBI server under test is at. The -tls_cert, -tls_key and -ca arguments
+// can be used to present a client certificate to, and verify the certificate
+// of, a server that requires mutual TLS.
 package ccli
@@ -17,7 +17,9 @@ package ccli
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -39,6 +41,9 @@ var (
 	addr              = flag.String("addr", "", "address of the gRIBI server in the format hostname:port")
 	insecureFlag      = flag.Bool("insecure", false, "dial insecure gRPC (no TLS)")
 	skipVerify        = flag.Bool("skip_verify", true, "allow self-signed TLS certificate; not needed for -insecure")
+	tlsCert           = flag.String("tls_cert", "", "path to the TLS certificate presented by the client to the server, requires -tls_key")
+	tlsKey            = flag.String("tls_key", "", "path to the key for the TLS certificate specified by -tls_cert")
+	caFile            = flag.String("ca", "", "path to the certificate authorities used to verify the server's certificate, when specified -skip_verify is ignored")
 	username          = flag.String("username", os.Getenv("USER"), "username to be sent as gRPC metadata")
 	password          = flag.String("password", "", "password to be sent as gRPC metadata")
 	initialElectionID = flag.Uint("initial_electionid", 0, "initial election ID to be used")
@@ -47,8 +52,22 @@ var (
 	skipSrvReorder      = flag.Bool("skip_reordering", false, "skip tests that rely on server side transaction reordering")
 	skipImplicitReplace = flag.Bool("skip_implicit_replace", false, "skip tests for ADD operations that perform implicit replacement of existing entries")
 	skipNonDefaultNINHG = flag.Bool("skip_non_default_ni_nhg", false, "skip tests that configure NH/NHG entries in a non-default network-instance")
+	skipRecursive       = flag.Bool("skip_recursive_resolution", false, "skip tests that rely on next-hops being resolved via prefixes programmed using gRIBI")
+	skipRefIntegrity    = flag.Bool("skip_reference_integrity", false, "skip tests that rely on the server immediately NACKing operations that reference entries that are not installed")
+	skipNIType          = flag.Bool("skip_network_instance_type_check", false, "skip tests that rely on the server rejecting operations for AFTs that cannot be programmed within the type of the network instance")
+	skipPBR             = flag.Bool("skip_policy_forwarding", false, "skip tests that rely on policy-forwarding entries being supported by the server")
+	skipIncreasingOpIDs = flag.Bool("skip_increasing_operation_ids", false, "skip tests that rely on the server rejecting operations whose ID is not greater than that of the last operation accepted from the client")
+
+	secondModifyRejected = flag.Bool("second_modify_rejected", false, "the server rejects a second Modify RPC on the same connection with FAILED_PRECONDITION rather than treating it as an independent session")
+
+	recursiveCoveringPrefix = flag.String("recursive_covering_prefix", "203.0.113.0/24", "covering prefix used by the recursive next-hop resolution test, which must not otherwise be routed by the server")
+	recursiveResolvedNH     = flag.String("recursive_resolved_nh", "192.0.2.1", "address of the next-hop of the covering prefix, which must be resolvable by the server without gRIBI")
+	recursiveNH             = flag.String("recursive_nh", "203.0.113.1", "address of the next-hop that is resolved via the covering prefix, which must be within -recursive_covering_prefix")
 
 	defaultNIName = flag.String("default_ni_name", server.DefaultNetworkInstanceName, "default network instance name to be used for the server")
+
+	consistencyOps  = flag.Int("consistency_ops", 500, "number of IPv4 operations sent by the get-after-modify consistency test")
+	consistencySeed = flag.Int64("consistency_seed", 1, "seed used to generate the operations sent by the get-after-modify consistency test")
 )
 
 // flagCred implements credentials.PerRPCCredentials by populating the
@@ -78,10 +97,69 @@ func shouldSkip(tt *compliance.TestSpec) string {
 		return "This RequiresImplicitReplace test is skipped by --skip_implicit_replace"
 	case *skipNonDefaultNINHG && tt.In.RequiresNonDefaultNINHG:
 		return "This RequiresNonDefaultNINHG test is skipped by --skip_non_default_ni_nhg"
+	case *skipRecursive && tt.In.RequiresRecursiveResolution:
+		return "This RequiresRecursiveResolution test is skipped by --skip_recursive_resolution"
+	case *skipRefIntegrity && tt.In.RequiresReferenceIntegrityCheck:
+		return "This RequiresReferenceIntegrityCheck test is skipped by --skip_reference_integrity"
+	case *skipNIType && tt.In.RequiresNetworkInstanceTypeCheck:
+		return "This RequiresNetworkInstanceTypeCheck test is skipped by --skip_network_instance_type_check"
+	case *skipIncreasingOpIDs && tt.In.RequiresIncreasingOperationIDs:
+		return "This RequiresIncreasingOperationIDs test is skipped by --skip_increasing_operation_ids"
+	case *skipPBR && tt.In.RequiresPolicyForwarding:
+		return "This RequiresPolicyForwarding test is skipped by --skip_policy_forwarding"
 	}
 	return ""
 }
 
+// flagTLSConfig returns the TLS configuration specified by the -tls_cert,
+// -tls_key, -ca and -skip_verify flags.
+func flagTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: *skipVerify,
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate, %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read certificate authorities, %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("cannot parse certificate authorities from %s", *caFile)
+		}
+		cfg.RootCAs = pool
+		cfg.InsecureSkipVerify = false
+	}
+	return cfg, nil
+}
+
+// flagDialOpts returns the gRPC dial options specified by the command-line
+// flags.
+func flagDialOpts(t *testing.T) []grpc.DialOption {
+	dialOpts := []grpc.DialOption{grpc.WithBlock()}
+	switch {
+	case *insecureFlag:
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	case *skipVerify, *tlsCert != "", *caFile != "":
+		cfg, err := flagTLSConfig()
+		if err != nil {
+			t.Fatalf("invalid TLS flags, %v", err)
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	}
+
+	if *password != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(flagCred{}))
+	}
+	return dialOpts
+}
+
 func TestCompliance(t *testing.T) {
 	if *addr == "" {
 		log.Errorf("Must specify gRIBI server address, got: %v", *addr)
@@ -94,19 +172,7 @@ func TestCompliance(t *testing.T) {
 
 	compliance.SetDefaultNetworkInstanceName(*defaultNIName)
 
-	dialOpts := []grpc.DialOption{grpc.WithBlock()}
-	if *insecureFlag {
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	} else if *skipVerify {
-		tlsc := credentials.NewTLS(&tls.Config{
-			InsecureSkipVerify: *skipVerify,
-		})
-		dialOpts = append(dialOpts, grpc.WithTransportCredentials(tlsc))
-	}
-
-	if *password != "" {
-		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(flagCred{}))
-	}
+	dialOpts := flagDialOpts(t)
 
 	for _, tt := range compliance.TestSuite {
 		t.Run(tt.In.ShortName, func(t *testing.T) {
@@ -137,6 +203,10 @@ func TestCompliance(t *testing.T) {
 
 			opts := []compliance.TestOpt{
 				compliance.SecondClient(sc),
+				compliance.RecursiveResolution(*recursiveCoveringPrefix, *recursiveResolvedNH, *recursiveNH),
+			}
+			if *secondModifyRejected {
+				opts = append(opts, compliance.SecondModifyStreamRejected())
 			}
 
 			if tt.FatalMsg != "" {
@@ -161,3 +231,26 @@ func TestCompliance(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAfterModifyConsistency(t *testing.T) {
+	if *addr == "" {
+		t.Skip("no gRIBI server address specified")
+	}
+
+	if *initialElectionID != 0 {
+		compliance.SetElectionID(uint64(*initialElectionID))
+	}
+	compliance.SetDefaultNetworkInstanceName(*defaultNIName)
+
+	conn, err := grpc.DialContext(context.Background(), *addr, flagDialOpts(t)...)
+	if err != nil {
+		t.Fatalf("Could not dial gRPC: %v", err)
+	}
+	defer conn.Close()
+
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(conn))
+	compliance.GetAfterModifyConsistency(c, t,
+		compliance.ConsistencyOperations(*consistencyOps),
+		compliance.ConsistencySeed(*consistencySeed))
+}
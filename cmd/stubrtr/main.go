@@ -19,14 +19,17 @@ package main
 
 import (
 	"context"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	log "github.com/golang/glog"
 	"github.com/openconfig/gribigo/server"
-	"github.com/openconfig/gribigo/testcommon"
 	"google.golang.org/grpc"
 
 	"net/http"
@@ -38,8 +41,11 @@ import (
 var (
 	certFile = flag.String("cert", "", "cert is the path to the server TLS certificate file")
 	keyFile  = flag.String("key", "", "key is the path to the server TLS key file")
+	caFile   = flag.String("ca", "", "ca is the path to a file containing the certificate authorities used to verify client certificates")
+	reqCert  = flag.Bool("require_client_cert", false, "require_client_cert specifies that clients must present a certificate signed by the authorities in ca")
 	addr     = flag.String("addr", ":9340", "gribi listen address")
 	vrfs     = flag.String("vrfs", "NON-DEFAULT-VRF", "additional VRFs to initialise on the server")
+	defNI    = flag.String("default_ni", server.DefaultNetworkInstanceName, "name of the default network instance on the server")
 )
 
 func main() {
@@ -51,43 +57,65 @@ func main() {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	creds, err := testcommon.TLSCredsFromFile(*certFile, *keyFile)
-	if err != nil {
-		log.Exitf("cannot initialise TLS, got: %v", err)
-	}
 
-	opts := []server.ServerOpt{}
+	opts := []server.ServerOpt{server.WithTLSFromFiles(*certFile, *keyFile)}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Exitf("cannot read certificate authorities, %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Exitf("cannot parse certificate authorities from %s", *caFile)
+		}
+		opts = append(opts, server.WithClientCAs(pool, *reqCert))
+	}
+	opts = append(opts, server.WithDefaultNetworkInstanceName(*defNI))
 	vrfList := strings.Split(*vrfs, ",")
 	if len(vrfList) != 0 {
 		opts = append(opts, server.WithVRFs(vrfList))
 	}
 
-	stop, err := startgRIBI(ctx, *addr, creds, opts...)
+	ts, stop, err := startgRIBI(ctx, *addr, opts...)
 	if err != nil {
 		log.Exitf("cannot start gRIBI server, %v", err)
 	}
 	defer stop()
 
+	// Reload the TLS certificate when SIGHUP is received, such that it can
+	// be rotated without restarting the server.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := ts.Reload(); err != nil {
+				log.Errorf("cannot reload TLS certificate, %v", err)
+				continue
+			}
+			log.Infof("reloaded TLS certificate from %s", *certFile)
+		}
+	}()
+
 	go func() {
 		log.Infof("%v", http.ListenAndServe("localhost:6060", nil))
 	}()
 	<-ctx.Done()
 }
 
-func startgRIBI(ctx context.Context, addr string, creds *testcommon.TLSCred, opt ...server.ServerOpt) (func(), error) {
+func startgRIBI(ctx context.Context, addr string, opt ...server.ServerOpt) (*server.Server, func(), error) {
 	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create gRPC server for gRIBI, %v", err)
+		return nil, nil, fmt.Errorf("cannot create gRPC server for gRIBI, %v", err)
 	}
 
-	s := grpc.NewServer(grpc.Creds(creds.C))
 	ts, err := server.New(opt...)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create gRIBI server, %v", err)
+		return nil, nil, fmt.Errorf("cannot create gRIBI server, %v", err)
 	}
+	s := grpc.NewServer(grpc.Creds(ts.TransportCredentials()))
 	spb.RegisterGRIBIServer(s, ts)
 
 	go s.Serve(l)
 	log.Infof("listening on %s", l.Addr().String())
-	return s.GracefulStop, nil
+	return ts, s.GracefulStop, nil
 }
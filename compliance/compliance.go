@@ -20,6 +20,7 @@ package compliance
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
@@ -63,6 +64,19 @@ var (
 	// overriden by tests that have pushed a configuration to the server where they
 	// have created a name that is not the specified string.
 	vrfName = "NON-DEFAULT-VRF"
+
+	// l2NetworkInstanceName is the name of a network instance of type L2VSI that
+	// exists on the server. It can be overridden by tests that have pushed a
+	// configuration to the server where they have created a name that is not the
+	// specified string.
+	l2NetworkInstanceName = "L2VSI-NI"
+
+	// flushVRFNames are the names of two non-default VRFs that exist on the
+	// server, which are used to validate that a Flush of one network instance
+	// does not remove entries from another. They can be overridden by tests that
+	// have pushed a configuration to the server where they have created names
+	// that are not the specified strings.
+	flushVRFNames = [2]string{"VRF-A", "VRF-B"}
 )
 
 // SetDefaultNetworkInstanceName allows an external caller to specify a network
@@ -77,6 +91,19 @@ func SetNonDefaultVRFName(n string) {
 	vrfName = n
 }
 
+// SetL2NetworkInstanceName allows an external caller to specify a network-instance
+// name to be used as a network instance of type L2VSI.
+func SetL2NetworkInstanceName(n string) {
+	l2NetworkInstanceName = n
+}
+
+// SetFlushVRFNames allows an external caller to specify the names of the two
+// non-default VRFs that are used by FlushOfSpecificNIIsIsolated. If either name
+// is empty, the test is skipped.
+func SetFlushVRFNames(a, b string) {
+	flushVRFNames = [2]string{a, b}
+}
+
 // Test describes a test within the compliance library.
 type Test struct {
 	// Fn is the function to be run for a test. Tests must not error if additional
@@ -113,6 +140,35 @@ type Test struct {
 	RequiresMPLS bool
 	// RequiresIPv6 marks a test that requires IPv6 support in the gRIBI server.
 	RequiresIPv6 bool
+	// RequiresPolicyForwarding marks a test that requires policy-forwarding
+	// (PBR) entry support in the gRIBI server.
+	RequiresPolicyForwarding bool
+	// RequiresReferenceIntegrityCheck marks a test that requires the server to
+	// immediately NACK operations that reference entries that are not installed,
+	// rather than reordering them. The reference implementation does this only when
+	// configured using server.WithReferenceIntegrityCheck.
+	RequiresReferenceIntegrityCheck bool
+	// RequiresNetworkInstanceTypeCheck marks a test that requires the server to
+	// reject operations for AFTs that cannot be programmed within the type of the
+	// network instance that they specify. It also requires that a network
+	// instance of type L2VSI is configured on the server, whose name can be
+	// specified using SetL2NetworkInstanceName. The reference implementation
+	// knows the type of a network instance only when it is created using
+	// server.WithNetworkInstanceTypes.
+	RequiresNetworkInstanceTypeCheck bool
+	// RequiresRecursiveResolution marks a test that requires the server to
+	// program entries in the FIB only once the next-hops that they use can be
+	// resolved, including via prefixes that are programmed using gRIBI. The
+	// reference implementation treats a next-hop whose address is not covered by
+	// a prefix within the RIB as being resolved outside of gRIBI, and hence
+	// acknowledges it as programmed in the FIB immediately, unless a RIB event
+	// hook that simulates the FIB is specified.
+	RequiresRecursiveResolution bool
+	// RequiresIncreasingOperationIDs marks a test that requires the server to
+	// reject operations whose ID is not greater than the ID of the last operation
+	// that was accepted from the client. The reference implementation does this
+	// only when configured using server.WithIncreasingOperationIDs.
+	RequiresIncreasingOperationIDs bool
 }
 
 // TestSpec is a description of a test.
@@ -150,6 +206,11 @@ var (
 			Fn:        ModifyConnectionSinglePrimaryPreserve,
 			ShortName: "Modify RPC Connection with invalid persist/redundancy parameters",
 		},
+	}, {
+		In: Test{
+			Fn:        SessionParameterCompliance,
+			ShortName: "Session parameter negotiation - absent, mid-stream and SINGLE_PRIMARY parameters",
+		},
 	}, {
 		In: Test{
 			Fn:        InvalidElectionIDAndAFTOperation,
@@ -165,6 +226,11 @@ var (
 			Fn:        InvalidParamsAndAFTOperation,
 			ShortName: "Invalid session params and AFT operation in same ModifyRequest",
 		},
+	}, {
+		In: Test{
+			Fn:        SecondModifyStream,
+			ShortName: "Second concurrent Modify RPC on the same connection",
+		},
 	}, {
 		In: Test{
 			Fn:        makeTestWithACK(AddIPv4Entry, fluent.InstalledInRIB),
@@ -268,11 +334,21 @@ var (
 			Fn:        makeTestWithACK(AddIPv4EntryDifferentNINHG, fluent.InstalledInRIB),
 			ShortName: "Add IPv4 Entry that references a NHG in a different network instance",
 		},
+	}, {
+		In: Test{
+			Fn:        makeTestWithACK(AddIPv4EntryDefaultAndNamedNI, fluent.InstalledInRIB),
+			ShortName: "Add the same IPv4 prefix to the default and a named network instance",
+		},
 	}, {
 		In: Test{
 			Fn:        makeTestWithACK(AddDeleteAdd, fluent.InstalledInRIB),
 			ShortName: "Add-Delete-Add for IPv4Entry - RIB ACK",
 		},
+	}, {
+		In: Test{
+			Fn:        makeTestWithACK(AddDeleteAddSingleRequest, fluent.InstalledInRIB),
+			ShortName: "Add, delete and re-add the same prefix within a single ModifyRequest",
+		},
 	}, {
 		In: Test{
 			Fn:                      makeTestWithACK(ImplicitReplaceNH, fluent.InstalledInRIB),
@@ -312,6 +388,18 @@ var (
 			RequiresImplicitReplace: true,
 			RequiresFIBACK:          true,
 		},
+	}, {
+		In: Test{
+			Fn:                      makeTestWithACK(ImplicitReplaceIPv4EntryContents, fluent.InstalledInRIB),
+			ShortName:               "Implicit replace IPv4 entry with ADD references the new next-hop-group - RIB ACK",
+			RequiresImplicitReplace: true,
+		},
+	}, {
+		In: Test{
+			Fn:                      makeTestWithACK(IdenticalAddIPv4Entry, fluent.InstalledInRIB),
+			ShortName:               "ADD of an identical IPv4 entry succeeds - RIB ACK",
+			RequiresImplicitReplace: true,
+		},
 	}, {
 		In: Test{
 			Fn:                       makeTestWithACK(IdempotentDelete, fluent.InstalledInRIB),
@@ -439,6 +527,11 @@ var (
 			Fn:        TestDecElectionID,
 			ShortName: "Election - Decrementing election ID is ignored",
 		},
+	}, {
+		In: Test{
+			Fn:        ElectionIDRollbackCompliance,
+			ShortName: "Election - Operations with a rolled back election ID are rejected",
+		},
 	}, {
 		In: Test{
 			Fn:        TestSameElectionIDFromTwoClients,
@@ -449,6 +542,11 @@ var (
 			Fn:        TestElectionIDAsZero,
 			ShortName: "Election - Sending election ID as zero",
 		},
+	}, {
+		In: Test{
+			Fn:        TestElectionIDRace,
+			ShortName: "Election - Racing election ID updates from two clients",
+		},
 	}, {
 		In: Test{
 			Fn:        makeTestWithACK(FlushFromMasterDefaultNI, fluent.InstalledInRIB),
@@ -487,6 +585,12 @@ var (
 			ShortName:               "Flush non-default network instances preserves the default",
 			RequiresNonDefaultNINHG: false, // No entries in the non-default VRF.
 		},
+	}, {
+		In: Test{
+			Fn:                      makeTestWithACK(FlushOfSpecificNIIsIsolated, fluent.InstalledInRIB),
+			ShortName:               "Flush of one non-default network instance preserves other network instances",
+			RequiresNonDefaultNINHG: true,
+		},
 	}, {
 		In: Test{
 			Fn:           makeTestWithACK(AddMPLSEntry, fluent.InstalledInRIB),
@@ -505,6 +609,12 @@ var (
 			ShortName:    "MPLS add entry with NH label stack",
 			RequiresMPLS: true,
 		},
+	}, {
+		In: Test{
+			Fn:                       makeTestWithACK(AddPolicyForwardingEntry, fluent.InstalledInRIB),
+			ShortName:                "Add policy-forwarding entry and retrieve it using Get",
+			RequiresPolicyForwarding: true,
+		},
 	}, {
 		In: Test{
 			Fn:           makeTestWithACK(AddIPv6Entry, fluent.InstalledInRIB),
@@ -524,6 +634,53 @@ var (
 			ShortName:    "Add IPv6 entry with metadata",
 			RequiresIPv6: true,
 		},
+	}, {
+		In: Test{
+			Fn:           AFTTypeMutualExclusionCompliance,
+			ShortName:    "Entries of one AFT cannot be installed or replaced using the key of another",
+			RequiresIPv6: true,
+		},
+	}, {
+		In: Test{
+			Fn:                             OperationIDMonotonicity,
+			ShortName:                      "Operation IDs that do not increase are rejected",
+			RequiresIncreasingOperationIDs: true,
+		},
+	}, {
+		In: Test{
+			Fn:                              ForwardReferenceFailure,
+			ShortName:                       "Reference integrity - entries referencing missing entries are rejected",
+			RequiresReferenceIntegrityCheck: true,
+		},
+	}, {
+		In: Test{
+			Fn:        makeTestWithACK(BackwardReferenceSuccess, fluent.InstalledInRIB),
+			ShortName: "Reference integrity - entries referencing installed entries are accepted",
+		},
+	}, {
+		In: Test{
+			Fn:                               IncompatibleNetworkInstanceType,
+			ShortName:                        "IPv4 entry in L2VSI network-instance is rejected",
+			RequiresNetworkInstanceTypeCheck: true,
+		},
+	}, {
+		In: Test{
+			Fn:                          RecursiveNextHopResolution,
+			ShortName:                   "Next-hop resolved via a covering route is installed in the FIB only once the route exists",
+			RequiresFIBACK:              true,
+			RequiresRecursiveResolution: true,
+		},
+	}, {
+		In: Test{
+			Fn:        makeTestWithACK(RecursiveNextHopCompliance, fluent.InstalledInRIB),
+			ShortName: "Entries using a recursively resolved next-hop are installed - with RIB ACK",
+		},
+	}, {
+		In: Test{
+			Fn:             makeTestWithACK(RecursiveNextHopCompliance, fluent.InstalledInFIB),
+			ShortName:      "Entries using a recursively resolved next-hop are installed - with FIB ACK",
+			RequiresFIBACK: true,
+		},
 	}}
 )
 
@@ -601,6 +758,119 @@ func ModifyConnectionSinglePrimaryPreserve(c *fluent.GRIBIClient, t testing.TB,
 	chk.HasRecvClientErrorWithStatus(t, err, want, chk.AllowUnimplemented())
 }
 
+// SessionParameterCompliance validates the negotiation of session parameters on the
+// Modify RPC. It checks that:
+//   - when no SessionParameters message is sent, the first ModifyRequest containing an
+//     operation is handled using the default parameters (ALL_PRIMARY, DELETE persistence,
+//     RIB ACK) - either by returning a result for the operation, or if the server does
+//     not support the defaults, by returning an error with the UNSUPPORTED_PARAMS reason.
+//   - in SINGLE_PRIMARY mode, the responses to the parameters and election ID reflect the
+//     redundancy mode, and subsequent operations carrying the election ID are ACKed.
+//   - sending SessionParameters after another message on the stream results in an error
+//     with the MODIFY_NOT_ALLOWED reason.
+//
+// opts must contain a SecondClient option such that there is a second stub to be used to
+// the device.
+func SessionParameterCompliance(c *fluent.GRIBIClient, t testing.TB, opts ...TestOpt) {
+	defer electionID.Inc()
+
+	clientA, clientB := clientAB(c, t, opts...)
+	// clientB is used to flush the server since it is an elected primary client.
+	defer flushServer(clientB, t)
+
+	// Open a stream without sending SessionParameters.
+	clientA.Start(context.Background(), t)
+	clientA.StartSending(context.Background(), t)
+	clientA.Modify().AddEntry(t,
+		fluent.NextHopEntry().
+			WithNetworkInstance(defaultNetworkInstanceName).
+			WithIndex(1).
+			WithIPAddress("192.0.2.1"))
+
+	switch err := awaitTimeout(context.Background(), clientA, t, time.Minute); err {
+	case nil:
+		chk.HasResult(t, clientA.Results(t),
+			fluent.OperationResult().
+				WithNextHopOperation(1).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(fluent.InstalledInRIB).
+				AsResult(),
+			chk.IgnoreOperationID(),
+		)
+	default:
+		chk.HasNRecvErrors(t, err, 1)
+		chk.HasRecvClientErrorWithStatus(
+			t,
+			err,
+			fluent.ModifyError().
+				WithCode(codes.FailedPrecondition).
+				WithReason(fluent.UnsupportedParameters).
+				AsStatus(t),
+			chk.AllowUnimplemented(),
+		)
+	}
+	clientA.Stop(t)
+
+	// Check that SINGLE_PRIMARY mode is reflected in the responses from the server.
+	clientB.Connection().WithInitialElectionID(electionID.Load(), 0).
+		WithRedundancyMode(fluent.ElectedPrimaryClient).
+		WithPersistence()
+	clientB.Start(context.Background(), t)
+	defer clientB.Stop(t)
+	clientB.StartSending(context.Background(), t)
+	clientB.Modify().AddEntry(t,
+		fluent.NextHopEntry().
+			WithNetworkInstance(defaultNetworkInstanceName).
+			WithIndex(2).
+			WithIPAddress("192.0.2.2"))
+	if err := awaitTimeout(context.Background(), clientB, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server, %v", err)
+	}
+
+	chk.HasResult(t, clientB.Results(t),
+		fluent.OperationResult().
+			WithSuccessfulSessionParams().
+			AsResult(),
+	)
+	chk.HasResult(t, clientB.Results(t),
+		fluent.OperationResult().
+			WithCurrentServerElectionID(electionID.Load(), 0).
+			AsResult(),
+	)
+	chk.HasResult(t, clientB.Results(t),
+		fluent.OperationResult().
+			WithNextHopOperation(2).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+
+	// Send conflicting parameters mid-stream.
+	clientB.Modify().InjectRequest(t, &spb.ModifyRequest{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+			AckType:     spb.SessionParameters_RIB_AND_FIB_ACK,
+		},
+	})
+
+	err := awaitTimeout(context.Background(), clientB, t, time.Minute)
+	if err == nil {
+		t.Fatalf("did not get expected error from server for parameters sent mid-stream, got: nil")
+	}
+
+	chk.HasNRecvErrors(t, err, 1)
+	chk.HasRecvClientErrorWithStatus(
+		t,
+		err,
+		fluent.ModifyError().
+			WithCode(codes.FailedPrecondition).
+			WithReason(fluent.ModifyParamsNotAllowed).
+			AsStatus(t),
+	)
+}
+
 // InvalidElectionIDAndAFTOperation ensures that the server returns an error when the client
 // attempts to update the election ID whilst simultaenously specifying an operation.
 func InvalidElectionIDAndAFTOperation(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
@@ -912,6 +1182,103 @@ func AddIPv4EntryDifferentNINHG(c *fluent.GRIBIClient, wantACK fluent.Programmin
 		chk.IgnoreOperationID())
 }
 
+// AddIPv4EntryDefaultAndNamedNI adds the same IPv4 prefix to the default network
+// instance and a named network instance, each referencing a different next-hop-group.
+// It validates, using the Get RPC, that each network instance contains only its own
+// entry, and that deleting the entry from the named network instance does not affect
+// the entry in the default network instance.
+func AddIPv4EntryDefaultAndNamedNI(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	const prefix = "1.1.1.1/32"
+	// entry returns the IPv4 entry for prefix within network instance ni, which
+	// references the next-hop-group nhg in the default network instance.
+	entry := func(ni string, nhg uint64) fluent.GRIBIEntry {
+		e := fluent.IPv4Entry().
+			WithPrefix(prefix).
+			WithNetworkInstance(ni).
+			WithNextHopGroup(nhg)
+		if ni != defaultNetworkInstanceName {
+			e.WithNextHopGroupNetworkInstance(defaultNetworkInstanceName)
+		}
+		return e
+	}
+
+	ops := []func(){
+		func() {
+			for _, i := range []uint64{1, 2} {
+				c.Modify().AddEntry(t,
+					fluent.NextHopEntry().
+						WithNetworkInstance(defaultNetworkInstanceName).
+						WithIndex(i).
+						WithIPAddress(fmt.Sprintf("192.0.2.%d", i)))
+				c.Modify().AddEntry(t,
+					fluent.NextHopGroupEntry().
+						WithNetworkInstance(defaultNetworkInstanceName).
+						WithID(i).
+						AddNextHop(i, 1))
+			}
+		},
+		func() { c.Modify().AddEntry(t, entry(defaultNetworkInstanceName, 1)) },
+		func() { c.Modify().AddEntry(t, entry(vrfName, 2)) },
+	}
+
+	res := DoModifyOps(c, t, ops, wantACK, false)
+	// The IPv4 entries are the fifth and sixth operations, following the next-hop
+	// and next-hop-group entries.
+	for _, id := range []uint64{5, 6} {
+		chk.HasResult(t, res,
+			fluent.OperationResult().
+				WithOperationID(id).
+				WithIPv4Operation(prefix).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(wantACK).
+				AsResult())
+	}
+
+	// checkNI validates that the network instance ni contains only the IPv4 entry
+	// want, or no IPv4 entries if want is nil.
+	checkNI := func(ni string, want fluent.GRIBIEntry) {
+		t.Helper()
+		ctx := context.Background()
+		c.Start(ctx, t)
+		defer c.Stop(t)
+		gr, err := c.Get().
+			WithNetworkInstance(ni).
+			WithAFT(fluent.IPv4).
+			Send()
+		if err != nil {
+			t.Fatalf("got unexpected error from get for network instance %s, got: %v", ni, err)
+		}
+		wantN := 0
+		if want != nil {
+			wantN = 1
+			getResponseHasEntries(t, gr, want)
+		}
+		if got := len(gr.GetEntry()); got != wantN {
+			t.Fatalf("network instance %s did not contain the expected number of IPv4 entries, got: %d (%v), want: %d", ni, got, gr.GetEntry(), wantN)
+		}
+	}
+
+	checkNI(defaultNetworkInstanceName, entry(defaultNetworkInstanceName, 1))
+	checkNI(vrfName, entry(vrfName, 2))
+
+	res = DoModifyOps(c, t, []func(){
+		func() { c.Modify().DeleteEntry(t, entry(vrfName, 2)) },
+	}, wantACK, false)
+	// Operation IDs continue from the operations used to add the entries.
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(7).
+			WithIPv4Operation(prefix).
+			WithOperationType(constants.Delete).
+			WithProgrammingResult(wantACK).
+			AsResult())
+
+	checkNI(defaultNetworkInstanceName, entry(defaultNetworkInstanceName, 1))
+	checkNI(vrfName, nil)
+}
+
 // DoModifyOps performs the series of operations in ops using the context
 // client c. wantACK specifies the ACK type to request from the
 // server, and randomise specifies whether the operations should be
@@ -1192,6 +1559,111 @@ func ImplicitReplaceIPv4Entry(c *fluent.GRIBIClient, wantACK fluent.ProgrammingR
 			AsResult())
 }
 
+// ImplicitReplaceIPv4EntryContents adds an IPv4 entry referencing one next-hop-group,
+// and subsequently adds the same prefix referencing a second next-hop-group using an
+// ADD rather than a REPLACE operation. It validates that both operations are
+// acknowledged, and that the entry returned by Get references the second
+// next-hop-group - i.e., that the server handled the second ADD as an implicit
+// replace, rather than rejecting it or ignoring it as a duplicate.
+func ImplicitReplaceIPv4EntryContents(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	const prefix = "198.51.100.0/24"
+	ipv4 := func(nhg uint64) fluent.GRIBIEntry {
+		return fluent.IPv4Entry().WithPrefix(prefix).WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(nhg)
+	}
+
+	ops := []func(){
+		func() {
+			for _, i := range []uint64{1, 2} {
+				c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(i).WithIPAddress(fmt.Sprintf("192.0.2.%d", i)))
+				c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(i).AddNextHop(i, 1))
+			}
+			c.Modify().AddEntry(t, ipv4(1))
+		},
+		func() {
+			c.Modify().AddEntry(t, ipv4(2))
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, wantACK, false)
+
+	for _, id := range []uint64{5, 6} {
+		chk.HasResult(t, res,
+			fluent.OperationResult().
+				WithOperationID(id).
+				WithIPv4Operation(prefix).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(wantACK).
+				AsResult())
+	}
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	c.Stop(t)
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasEntries(t, gr, ipv4(2))
+	if got := len(gr.GetEntry()); got != 1 {
+		t.Fatalf("did not get expected number of IPv4 entries, got: %d (%v), want: 1", got, gr.GetEntry())
+	}
+}
+
+// IdenticalAddIPv4Entry adds the same IPv4 entry twice, validating that the second
+// ADD of an entry that is identical to the installed entry is acknowledged as
+// successful, and that the entry is unchanged.
+func IdenticalAddIPv4Entry(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	const prefix = "198.51.100.0/24"
+	ipv4 := fluent.IPv4Entry().WithPrefix(prefix).WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(1)
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t,
+				fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"),
+				fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+				ipv4,
+			)
+		},
+		func() {
+			c.Modify().AddEntry(t, ipv4)
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, wantACK, false)
+
+	for _, id := range []uint64{3, 4} {
+		chk.HasResult(t, res,
+			fluent.OperationResult().
+				WithOperationID(id).
+				WithIPv4Operation(prefix).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(wantACK).
+				AsResult())
+	}
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	c.Stop(t)
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasEntries(t, gr, ipv4)
+	if got := len(gr.GetEntry()); got != 1 {
+		t.Fatalf("did not get expected number of IPv4 entries, got: %d (%v), want: 1", got, gr.GetEntry())
+	}
+}
+
 // IdempotentDelete performs two delete operations for the same NextHop,
 // NextHopGroup, and IPv4Entry, validating that the server handles duplicate
 // operations successfully.
@@ -1806,6 +2278,109 @@ func AddDeleteAdd(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t tes
 		chk.IgnoreOperationID())
 }
 
+// AddDeleteAddSingleRequest tests that when a single ModifyRequest contains an ADD of a
+// prefix, a DELETE of the same prefix, and a further ADD of the prefix referencing a
+// different next-hop-group, each operation is acknowledged separately and the final
+// state of the server reflects the last ADD. It validates that the next-hop-group
+// referenced by the first ADD is no longer referenced, and hence can be deleted,
+// whilst the next-hop-group referenced by the last ADD cannot.
+func AddDeleteAddSingleRequest(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	const prefix = "2.0.0.0/8"
+	// op returns an operation of type o with ID id for the entry e.
+	op := func(t testing.TB, o spb.AFTOperation_Operation, id uint64, e fluent.GRIBIEntry) *spb.AFTOperation {
+		ep, err := e.OpProto()
+		if err != nil {
+			t.Fatalf("cannot build operation, %v", err)
+		}
+		ep.Id = id
+		ep.Op = o
+		ep.ElectionId = &spb.Uint128{Low: electionID.Load()}
+		return ep
+	}
+	ipv4 := func(nhg uint64) fluent.GRIBIEntry {
+		return fluent.IPv4Entry().WithPrefix(prefix).WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(nhg)
+	}
+
+	ops := []func(){
+		func() {
+			for _, i := range []uint64{1, 2} {
+				c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(i).WithIPAddress(fmt.Sprintf("192.0.2.%d", i)))
+			}
+			for _, i := range []uint64{1, 2} {
+				c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(i).AddNextHop(i, 1))
+			}
+		},
+		func() {
+			c.Modify().Enqueue(t, &spb.ModifyRequest{
+				Operation: []*spb.AFTOperation{
+					op(t, spb.AFTOperation_ADD, 5, ipv4(1)),
+					op(t, spb.AFTOperation_DELETE, 6, ipv4(1)),
+					op(t, spb.AFTOperation_ADD, 7, ipv4(2)),
+				},
+			})
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, wantACK, false)
+
+	for _, want := range []struct {
+		id     uint64
+		opType constants.OpType
+	}{
+		{id: 5, opType: constants.Add},
+		{id: 6, opType: constants.Delete},
+		{id: 7, opType: constants.Add},
+	} {
+		chk.HasResult(t, res,
+			fluent.OperationResult().
+				WithOperationID(want.id).
+				WithIPv4Operation(prefix).
+				WithOperationType(want.opType).
+				WithProgrammingResult(wantACK).
+				AsResult())
+	}
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	c.Stop(t)
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasEntries(t, gr, ipv4(2))
+	if got := len(gr.GetEntry()); got != 1 {
+		t.Fatalf("did not get expected number of IPv4 entries, got: %d (%v), want: 1", got, gr.GetEntry())
+	}
+
+	res = DoModifyOps(c, t, []func(){
+		func() {
+			c.Modify().DeleteEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(2))
+			c.Modify().DeleteEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1))
+		},
+	}, wantACK, false)
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithNextHopGroupOperation(2).
+			WithOperationType(constants.Delete).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult(),
+		chk.IgnoreOperationID())
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithNextHopGroupOperation(1).
+			WithOperationType(constants.Delete).
+			WithProgrammingResult(wantACK).
+			AsResult(),
+		chk.IgnoreOperationID())
+}
+
 // AddIPv6Entry adds a fully referenced IPv4Entry and checks whether the specified ACK
 // type (wantACK) is returned.
 func AddIPv6Entry(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
@@ -1891,3 +2466,288 @@ func AddIPv6Metadata(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
 			AsResult(),
 		chk.IgnoreOperationID())
 }
+
+// AFTTypeMutualExclusionCompliance validates that the server keys entries by
+// their AFT as well as their prefix, such that an entry of one AFT cannot be
+// installed using the key of another. It checks that:
+//   - an IPv6 entry whose prefix is an IPv4 prefix is rejected.
+//   - an IPv4 entry that is installed cannot be replaced by an IPv6 entry using
+//     the same prefix, and remains installed after the replace is rejected.
+//
+// A server that stores all entries within a single map keyed by the prefix
+// string fails this test.
+func AFTTypeMutualExclusionCompliance(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	const (
+		v4Prefix       = "198.51.100.0/24"
+		mismatchPrefix = "192.0.2.0/24"
+	)
+	// ipv6 returns an operation of type o with ID id for an IPv6 entry with the
+	// prefix p. The fluent library does not allow an IPv6 entry to be created
+	// with an IPv4 prefix, hence the prefix is set on the built operation.
+	ipv6 := func(t testing.TB, o spb.AFTOperation_Operation, id uint64, p string) *spb.AFTOperation {
+		ep, err := fluent.IPv6Entry().WithPrefix("2001:db8::/32").WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(1).OpProto()
+		if err != nil {
+			t.Fatalf("cannot build operation, %v", err)
+		}
+		ep.GetIpv6().Prefix = p
+		ep.Id = id
+		ep.Op = o
+		ep.ElectionId = &spb.Uint128{Low: electionID.Load()}
+		return ep
+	}
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t,
+				fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"),
+				fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+				fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(v4Prefix).WithNextHopGroup(1),
+			)
+		},
+		func() {
+			c.Modify().InjectRequest(t, &spb.ModifyRequest{
+				Operation: []*spb.AFTOperation{ipv6(t, spb.AFTOperation_ADD, 100, mismatchPrefix)},
+			})
+		},
+		func() {
+			c.Modify().InjectRequest(t, &spb.ModifyRequest{
+				Operation: []*spb.AFTOperation{ipv6(t, spb.AFTOperation_REPLACE, 101, v4Prefix)},
+			})
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, fluent.InstalledInRIB, false)
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithIPv4Operation(v4Prefix).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult(),
+		chk.IgnoreOperationID())
+
+	for _, id := range []uint64{100, 101} {
+		chk.HasResult(t, res,
+			fluent.OperationResult().
+				WithOperationID(id).
+				WithProgrammingResult(fluent.ProgrammingFailed).
+				AsResult())
+	}
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasIPv4Prefixes(t, gr, defaultNetworkInstanceName, []string{v4Prefix})
+
+	gr, err = c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv6).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	if got := len(gr.GetEntry()); got != 0 {
+		t.Fatalf("did not get expected number of IPv6 entries, got: %d (%v), want: 0", got, gr.GetEntry())
+	}
+}
+
+// OperationIDMonotonicity validates that the server enforces that the IDs of
+// operations within a Modify stream are increasing. Operations that use an ID that
+// is lower than, or reuses, a previously received ID must fail, whilst operations
+// with an increasing ID must succeed.
+func OperationIDMonotonicity(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	ctx := context.Background()
+	// addNH adds a next-hop with the specified index using the operation ID id,
+	// and waits for the server to respond such that reused IDs are not
+	// pending at the client simultaneously.
+	addNH := func(index, id uint64) {
+		c.Modify().AddEntry(t,
+			fluent.NextHopEntry().
+				WithNetworkInstance(defaultNetworkInstanceName).
+				WithIndex(index).
+				WithIPAddress("192.0.2.1").
+				WithOperationID(id))
+		if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+			t.Fatalf("got unexpected error from server - entries, got: %v, want: nil", err)
+		}
+	}
+
+	ops := []func(){
+		func() { addNH(1, 2) },
+		// Decreasing operation ID.
+		func() { addNH(2, 1) },
+		// Reused operation ID.
+		func() { addNH(3, 2) },
+		func() { addNH(4, 3) },
+	}
+
+	res := DoModifyOps(c, t, ops, fluent.InstalledInRIB, false)
+
+	for _, want := range []struct {
+		id, index uint64
+		result    fluent.ProgrammingResult
+	}{
+		{id: 2, index: 1, result: fluent.InstalledInRIB},
+		{id: 1, index: 2, result: fluent.ProgrammingFailed},
+		{id: 2, index: 3, result: fluent.ProgrammingFailed},
+		{id: 3, index: 4, result: fluent.InstalledInRIB},
+	} {
+		chk.HasResult(t, res,
+			fluent.OperationResult().
+				WithOperationID(want.id).
+				WithNextHopOperation(want.index).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(want.result).
+				AsResult())
+	}
+}
+
+// ForwardReferenceFailure validates that the server rejects operations that reference
+// entries that have not been installed. An IPv4 entry that references a next-hop-group
+// that does not exist, and a next-hop-group that references a next-hop that does not
+// exist must fail, such that they are not installed when the referenced entries are
+// later added.
+func ForwardReferenceFailure(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t, fluent.IPv4Entry().WithPrefix("1.1.1.1/32").WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(42))
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(42).AddNextHop(1, 1))
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, fluent.InstalledInRIB, false)
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(1).
+			WithIPv4Operation("1.1.1.1/32").
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult())
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(2).
+			WithNextHopGroupOperation(42).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult())
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(3).
+			WithNextHopOperation(1).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult())
+}
+
+// BackwardReferenceSuccess validates that the server accepts operations that reference
+// entries that have already been installed, where the next-hop, next-hop-group and
+// IPv4 entry are sent in separate ModifyRequests in dependency order.
+func BackwardReferenceSuccess(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	ctx := context.Background()
+	// await waits for the server to respond to the outstanding operations such that
+	// each operation references entries that have already been acknowledged.
+	await := func() {
+		if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+			t.Fatalf("got unexpected error from server - entries, got: %v, want: nil", err)
+		}
+	}
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+			await()
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(42).AddNextHop(1, 1))
+			await()
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.IPv4Entry().WithPrefix("1.1.1.1/32").WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(42))
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, wantACK, false)
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(1).
+			WithNextHopOperation(1).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(wantACK).
+			AsResult())
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(2).
+			WithNextHopGroupOperation(42).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(wantACK).
+			AsResult())
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(3).
+			WithIPv4Operation("1.1.1.1/32").
+			WithOperationType(constants.Add).
+			WithProgrammingResult(wantACK).
+			AsResult())
+}
+
+// IncompatibleNetworkInstanceType validates that the server rejects an IPv4
+// entry that is programmed within a network instance of type L2VSI, since an
+// L2VSI does not perform layer 3 forwarding. The entry's references are
+// installed in the default network instance, such that the only reason for the
+// failure is the type of the network instance.
+func IncompatibleNetworkInstanceType(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1))
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.IPv4Entry().
+				WithPrefix("203.0.113.0/24").
+				WithNetworkInstance(l2NetworkInstanceName).
+				WithNextHopGroup(1).
+				WithNextHopGroupNetworkInstance(defaultNetworkInstanceName))
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, fluent.InstalledInRIB, false)
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(3).
+			WithIPv4Operation("203.0.113.0/24").
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult())
+}
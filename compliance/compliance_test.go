@@ -15,8 +15,13 @@
 package compliance
 
 import (
+	"flag"
+	"fmt"
+	"net"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/openconfig/gribigo/fluent"
 	"github.com/openconfig/gribigo/server"
@@ -25,14 +30,47 @@ import (
 	"github.com/openconfig/lemming/gnmi/oc"
 	"github.com/openconfig/testt"
 	"github.com/openconfig/ygot/ygot"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+var (
+	// refreshRealTime specifies that TestElectionIDRefreshCompliance should
+	// wait between re-advertisements of the election ID in real time, rather
+	// than advancing the clock of the server.
+	refreshRealTime = flag.Bool("election_refresh_real_time", false, "wait in real time between election ID re-advertisements in TestElectionIDRefreshCompliance")
+	// checkRIBConsistency specifies that the consistency of the RIB of each
+	// gribigo server that is started by a compliance test is checked once the
+	// test completes.
+	checkRIBConsistency = flag.Bool("check_rib_consistency", false, "check the consistency of the server's RIB after each compliance test that uses a gribigo server")
 )
 
 func TestCompliance(t *testing.T) {
 	for _, tt := range TestSuite {
 		t.Run(tt.In.ShortName, func(t *testing.T) {
+			if tt.In.RequiresReferenceIntegrityCheck {
+				t.Skip("lemming does not check reference integrity, see TestReferenceIntegrityCompliance")
+			}
+			if tt.In.RequiresNetworkInstanceTypeCheck {
+				t.Skip("lemming does not check network instance types, see TestNetworkInstanceTypeCompliance")
+			}
+			if tt.In.RequiresIncreasingOperationIDs {
+				t.Skip("lemming does not require increasing operation IDs, see TestIncreasingOperationIDsCompliance")
+			}
+			if tt.In.RequiresRecursiveResolution {
+				t.Skip("lemming acknowledges unresolved next-hops as programmed in the FIB, see TestRecursiveNextHopResolutionCompliance")
+			}
+			if tt.In.RequiresPolicyForwarding {
+				t.Skip("policy-forwarding entries are validated against the gribigo server, see TestPolicyForwardingCompliance")
+			}
 			cfg := &oc.Root{}
 			cfg.GetOrCreateNetworkInstance(server.DefaultNetworkInstanceName).Type = oc.NetworkInstanceTypes_NETWORK_INSTANCE_TYPE_DEFAULT_INSTANCE
 			cfg.GetOrCreateNetworkInstance(vrfName).Type = oc.NetworkInstanceTypes_NETWORK_INSTANCE_TYPE_L3VRF
+			for _, n := range flushVRFNames {
+				cfg.GetOrCreateNetworkInstance(n).Type = oc.NetworkInstanceTypes_NETWORK_INSTANCE_TYPE_L3VRF
+			}
 			jsonConfig, err := ygot.Marshal7951(cfg)
 			if err != nil {
 				t.Fatalf("cannot create configuration for device, error: %v", err)
@@ -55,6 +93,9 @@ func TestCompliance(t *testing.T) {
 			sc.Connection().WithTarget(d.GRIBIAddr())
 			opts := []TestOpt{
 				SecondClient(sc),
+				// lemming uses the gribigo server, which rejects a second Modify
+				// RPC on a connection by default.
+				SecondModifyStreamRejected(),
 			}
 
 			if tt.FatalMsg != "" {
@@ -85,3 +126,190 @@ func TestCompliance(t *testing.T) {
 		})
 	}
 }
+
+func TestReferenceIntegrityCompliance(t *testing.T) {
+	tests := []Test{{
+		Fn:        ForwardReferenceFailure,
+		ShortName: "forward references are rejected",
+	}, {
+		Fn:        makeTestWithACK(BackwardReferenceSuccess, fluent.InstalledInRIB),
+		ShortName: "backward references are accepted",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.ShortName, func(t *testing.T) {
+			addr := startServer(t, server.WithReferenceIntegrityCheck(true))
+
+			c := fluent.NewClient()
+			c.Connection().WithTarget(addr)
+			tt.Fn(c, t)
+			c.Stop(t)
+		})
+	}
+}
+
+// startServer starts a gribigo server with the specified options, listening on
+// a random port on localhost. It returns the address that the server is
+// listening on, the server is stopped when the test completes.
+func startServer(t *testing.T, opts ...server.ServerOpt) string {
+	t.Helper()
+	_, addr := startServerWithHandle(t, opts...)
+	return addr
+}
+
+// startServerWithHandle starts a gribigo server in the same manner as startServer,
+// additionally returning the server such that a test can interact with it
+// directly.
+func startServerWithHandle(t *testing.T, opts ...server.ServerOpt) (*server.Server, string) {
+	t.Helper()
+	creds, err := credentials.NewServerTLSFromFile(testcommon.TLSCreds())
+	if err != nil {
+		t.Fatalf("cannot load TLS credentials, got err: %v", err)
+	}
+	srv := grpc.NewServer(grpc.Creds(creds))
+	s, err := server.New(opts...)
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	spb.RegisterGRIBIServer(srv, s)
+	t.Cleanup(func() { checkConsistency(t, s) })
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("cannot listen, %v", err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return s, l.Addr().String()
+}
+
+// checkConsistency reports an error to t for each inconsistency within the RIB of
+// the server s, when the check_rib_consistency flag is set.
+func checkConsistency(t *testing.T, s *server.Server) {
+	t.Helper()
+	if !*checkRIBConsistency {
+		return
+	}
+	for _, v := range s.CheckConsistency().Violations {
+		t.Errorf("RIB is inconsistent following test, %s", v)
+	}
+}
+
+func TestIPv4TableFullCompliance(t *testing.T) {
+	const limit = 10
+	c := fluent.NewClient()
+	c.Connection().WithTarget(startServer(t, server.WithMaxIPv4Entries(limit)))
+	IPv4TableFull(c, t, IPv4EntryLimit(limit))
+}
+
+func TestSecondModifyStreamCompliance(t *testing.T) {
+	tests := []struct {
+		desc    string
+		srvOpts []server.ServerOpt
+		opts    []TestOpt
+	}{{
+		desc: "rejected by default",
+		opts: []TestOpt{SecondModifyStreamRejected()},
+	}, {
+		desc:    "independent session",
+		srvOpts: []server.ServerOpt{server.WithMultipleModifyPerConnection()},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			c := fluent.NewClient()
+			c.Connection().WithTarget(startServer(t, tt.srvOpts...))
+			SecondModifyStream(c, t, tt.opts...)
+		})
+	}
+}
+
+func TestPolicyForwardingCompliance(t *testing.T) {
+	c := fluent.NewClient()
+	c.Connection().WithTarget(startServer(t))
+	AddPolicyForwardingEntry(c, fluent.InstalledInRIB, t)
+}
+
+func TestNetworkInstanceTypeCompliance(t *testing.T) {
+	addr := startServer(t, server.WithNetworkInstanceTypes(map[string]server.NetworkInstanceType{
+		l2NetworkInstanceName: server.L2VSI,
+	}))
+	c := fluent.NewClient()
+	c.Connection().WithTarget(addr)
+	IncompatibleNetworkInstanceType(c, t)
+}
+
+func TestIncreasingOperationIDsCompliance(t *testing.T) {
+	c := fluent.NewClient()
+	c.Connection().WithTarget(startServer(t, server.WithIncreasingOperationIDs()))
+	OperationIDMonotonicity(c, t)
+}
+
+func TestFlushOfSpecificNIIsIsolatedCompliance(t *testing.T) {
+	c := fluent.NewClient()
+	c.Connection().WithTarget(startServer(t, server.WithVRFs(flushVRFNames[:])))
+	FlushOfSpecificNIIsIsolated(c, fluent.InstalledInRIB, t)
+}
+
+func TestFlushOfSpecificNIIsIsolatedSkipped(t *testing.T) {
+	orig := flushVRFNames
+	defer SetFlushVRFNames(orig[0], orig[1])
+	SetFlushVRFNames("", "")
+
+	var skipped bool
+	t.Run("unspecified VRFs", func(t *testing.T) {
+		// The client is never connected, since the test is skipped before any
+		// RPC is made.
+		defer func() { skipped = t.Skipped() }()
+		FlushOfSpecificNIIsIsolated(fluent.NewClient(), fluent.InstalledInRIB, t)
+	})
+	if !skipped {
+		t.Errorf("FlushOfSpecificNIIsIsolated was not skipped when VRF names are unspecified")
+	}
+}
+
+func TestGetAfterModifyConsistencyCompliance(t *testing.T) {
+	for _, seed := range []int64{1, 42} {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			c := fluent.NewClient()
+			c.Connection().WithTarget(startServer(t))
+			GetAfterModifyConsistency(c, t, ConsistencyOperations(200), ConsistencySeed(seed))
+		})
+	}
+}
+
+func TestElectionIDRaceIterationsCompliance(t *testing.T) {
+	addr := startServer(t)
+	c, sc := fluent.NewClient(), fluent.NewClient()
+	c.Connection().WithTarget(addr)
+	sc.Connection().WithTarget(addr)
+	TestElectionIDRace(c, t, SecondClient(sc), ElectionRaceIterations(3))
+}
+
+func TestElectionIDRefreshCompliance(t *testing.T) {
+	if *refreshRealTime {
+		c := fluent.NewClient()
+		c.Connection().WithTarget(startServer(t))
+		ElectionIDRefresh(c, t)
+		return
+	}
+
+	// The server's clock is advanced by each wait between re-advertisements,
+	// such that the test does not wait in real time.
+	var (
+		mu  sync.Mutex
+		now = time.Unix(0, 0)
+	)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	c := fluent.NewClient()
+	c.Connection().WithTarget(startServer(t, server.WithClock(clock)))
+	ElectionIDRefresh(c, t, RefreshSleep(advance))
+}
@@ -0,0 +1,141 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/openconfig/gribigo/fluent"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+const (
+	// defaultConsistencyOperations is the number of IPv4 operations that are
+	// sent by GetAfterModifyConsistency if the ConsistencyOperations option
+	// is not specified.
+	defaultConsistencyOperations = 500
+	// consistencyPrefixes is the number of distinct prefixes that are added
+	// and deleted by GetAfterModifyConsistency. It is smaller than the number
+	// of operations such that each prefix is added and deleted multiple times.
+	consistencyPrefixes = 64
+)
+
+// consistencyOperations is an option that specifies the number of IPv4
+// operations that are sent by GetAfterModifyConsistency.
+type consistencyOperations struct {
+	// n is the number of operations.
+	n int
+}
+
+// IsTestOpt marks consistencyOperations as implementing the TestOpt interface.
+func (*consistencyOperations) IsTestOpt() {}
+
+// ConsistencyOperations specifies the number of IPv4 add and delete operations
+// that are sent to the server by GetAfterModifyConsistency.
+func ConsistencyOperations(n int) *consistencyOperations {
+	return &consistencyOperations{n: n}
+}
+
+// consistencySeed is an option that specifies the seed used to generate the
+// operations sent by GetAfterModifyConsistency.
+type consistencySeed struct {
+	// seed is the seed for the random number generator.
+	seed int64
+}
+
+// IsTestOpt marks consistencySeed as implementing the TestOpt interface.
+func (*consistencySeed) IsTestOpt() {}
+
+// ConsistencySeed specifies the seed of the random number generator that is
+// used to generate the sequence of operations sent by GetAfterModifyConsistency,
+// such that a failing sequence can be reproduced.
+func ConsistencySeed(seed int64) *consistencySeed {
+	return &consistencySeed{seed: seed}
+}
+
+// GetAfterModifyConsistency sends a stream of randomly generated adds and
+// deletes of IPv4 entries to the server, and validates that the set of IPv4
+// entries returned by a subsequent Get is exactly the set that is expected
+// based on a model of the operations maintained by the client. Each operation
+// adds a prefix that is not installed, or deletes a prefix that is installed,
+// such that the test does not rely on implicit replace or idempotent delete.
+//
+// The number of operations and the seed used to generate them can be
+// specified using the ConsistencyOperations and ConsistencySeed options.
+func GetAfterModifyConsistency(c *fluent.GRIBIClient, t testing.TB, opts ...TestOpt) {
+	defer flushServer(c, t)
+
+	n, seed := defaultConsistencyOperations, int64(1)
+	for _, o := range opts {
+		switch v := o.(type) {
+		case *consistencyOperations:
+			n = v.n
+		case *consistencySeed:
+			seed = v.seed
+		}
+	}
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1))
+		},
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	installed := map[string]bool{}
+	for i := 0; i < n; i++ {
+		j := r.Intn(consistencyPrefixes)
+		p := fmt.Sprintf("198.18.%d.0/24", j)
+		e := fluent.IPv4Entry().WithPrefix(p).WithNetworkInstance(defaultNetworkInstanceName)
+		if installed[p] {
+			delete(installed, p)
+			ops = append(ops, func() { c.Modify().DeleteEntry(t, e) })
+			continue
+		}
+		installed[p] = true
+		ops = append(ops, func() { c.Modify().AddEntry(t, e.WithNextHopGroup(1)) })
+	}
+
+	res := DoModifyOps(c, t, ops, fluent.InstalledInRIB, false)
+	for _, r := range res {
+		if r.OperationID != 0 && r.ProgrammingResult == spb.AFTResult_FAILED {
+			t.Fatalf("operation %d failed with seed %d, got: %s", r.OperationID, seed, r)
+		}
+	}
+
+	want := []string{}
+	for p := range installed {
+		want = append(want, p)
+	}
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasIPv4Prefixes(t, gr, defaultNetworkInstanceName, want)
+}
@@ -16,6 +16,8 @@ package compliance
 
 import (
 	"context"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -23,9 +25,34 @@ import (
 	"github.com/openconfig/gribigo/chk"
 	"github.com/openconfig/gribigo/constants"
 	"github.com/openconfig/gribigo/fluent"
+	"github.com/openconfig/gribigo/server"
 	"google.golang.org/grpc/codes"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
 )
 
+// defaultElectionRaceIterations is the number of times that TestElectionIDRace
+// repeats the race between the two clients if the ElectionRaceIterations option
+// is not specified.
+const defaultElectionRaceIterations = 1
+
+// electionRaceIterations is an option that specifies the number of times that
+// TestElectionIDRace repeats the race between the two clients.
+type electionRaceIterations struct {
+	// n is the number of iterations.
+	n int
+}
+
+// IsTestOpt marks electionRaceIterations as implementing the TestOpt interface.
+func (*electionRaceIterations) IsTestOpt() {}
+
+// ElectionRaceIterations specifies the number of times that TestElectionIDRace
+// repeats the race between the two clients, such that different interleavings
+// of their messages at the server are exercised.
+func ElectionRaceIterations(n int) *electionRaceIterations {
+	return &electionRaceIterations{n: n}
+}
+
 // secondClient is an option that provides for a second gRIBI client to
 // be supplied to a test.
 type secondClient struct {
@@ -364,7 +391,7 @@ func TestActiveAfterMasterChange(c *fluent.GRIBIClient, t testing.TB, opts ...Te
 			t.Fatalf("could not execute Get via client (%s), %v", errDetails, err)
 		}
 
-		chk.GetResponseHasEntries(t, gr,
+		getResponseHasEntries(t, gr,
 			fluent.IPv4Entry().
 				WithNetworkInstance(defaultNetworkInstanceName).
 				WithNextHopGroup(42).
@@ -539,6 +566,84 @@ func TestIncElectionID(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
 	)
 }
 
+// ElectionIDRollbackCompliance validates that once a client has been elected as
+// primary, operations that it sends with a lower election ID are rejected by the
+// server. Entries are installed using the client's election ID, and a DELETE of an
+// installed entry, and an ADD of a new entry, are then sent with the previous
+// election ID. Both operations must fail, and the installed entries must be
+// unchanged when retrieved using Get.
+func ElectionIDRollbackCompliance(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+	defer electionID.Add(2)
+
+	// Use the next ID such that the previous ID is valid and is not lower than
+	// an ID that has already been used.
+	id := electionID.Load() + 1
+	c.Connection().WithInitialElectionID(id, 0).
+		WithRedundancyMode(fluent.ElectedPrimaryClient).
+		WithPersistence()
+	c.Start(context.Background(), t)
+	c.StartSending(context.Background(), t)
+	defer c.Stop(t)
+
+	const (
+		installed = "198.51.100.0/24"
+		rejected  = "203.0.113.0/24"
+	)
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"),
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(installed).WithNextHopGroup(1),
+	)
+	if err := awaitTimeout(context.Background(), c, t, time.Minute); err != nil {
+		t.Fatalf("could not program entries via client, got err: %v", err)
+	}
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithIPv4Operation(installed).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+
+	c.Modify().DeleteEntry(t,
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(installed).
+			WithElectionID(id-1, 0))
+	c.Modify().AddEntry(t,
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(rejected).WithNextHopGroup(1).
+			WithElectionID(id-1, 0))
+	if err := awaitTimeout(context.Background(), c, t, time.Minute); err != nil {
+		t.Fatalf("could not send operations with previous election ID via client, got err: %v", err)
+	}
+
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithIPv4Operation(installed).
+			WithOperationType(constants.Delete).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithIPv4Operation(rejected).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasIPv4Prefixes(t, gr, defaultNetworkInstanceName, []string{installed})
+}
+
 // TestDecElectionID validates that when a client decreases the election ID
 // it is not honoured by the server, and the server reports back the highest
 // ID it has seen.
@@ -681,3 +786,143 @@ func TestElectionIDAsZero(c *fluent.GRIBIClient, t testing.TB, _ ...TestOpt) {
 		chk.IgnoreDetails(),
 	)
 }
+
+// race runs each of the supplied functions in its own goroutine, releasing them
+// at the same time using a shared barrier, and returns when all of them have
+// completed.
+func race(fns ...func()) {
+	var wg sync.WaitGroup
+	barrier := make(chan struct{})
+	for _, fn := range fns {
+		wg.Add(1)
+		go func(fn func()) {
+			defer wg.Done()
+			<-barrier
+			fn()
+		}(fn)
+	}
+	close(barrier)
+	wg.Wait()
+}
+
+// TestElectionIDRace validates the behaviour of the server when two clients race to
+// update their election IDs. Client A is initially master with election ID N, and
+// client B is connected with election ID N-1. Client A then updates its election ID
+// to N+1 at the same time as client B updates its election ID to N+2, after which
+// both clients simultaneously send an ADD for a different prefix. Regardless of the
+// order in which the updates are processed, client B is master, so its ADD must
+// succeed, and client A's ADD must fail since it is not primary. A subsequent Get
+// must return only client B's prefix. The number of times that the sequence is
+// repeated can be specified using the ElectionRaceIterations option.
+//
+// opts must contain a SecondClient option such that there is a second stub to be used to
+// the device.
+func TestElectionIDRace(c *fluent.GRIBIClient, t testing.TB, opts ...TestOpt) {
+	clientA, clientB := clientAB(c, t, opts...)
+	n := defaultElectionRaceIterations
+	for _, o := range opts {
+		if v, ok := o.(*electionRaceIterations); ok {
+			n = v.n
+		}
+	}
+	for i := 0; i < n; i++ {
+		electionIDRaceOnce(clientA, clientB, t, i)
+	}
+}
+
+// electionIDRaceOnce runs a single iteration of TestElectionIDRace with the clients
+// clientA and clientB.
+func electionIDRaceOnce(clientA, clientB *fluent.GRIBIClient, t testing.TB, iteration int) {
+	defer flushServer(clientA, t)
+	defer electionID.Add(3)
+
+	// base is N-1, such that client B's initial election ID is valid.
+	base := electionID.Load()
+	const (
+		prefixA = "198.51.100.0/24"
+		prefixB = "203.0.113.0/24"
+	)
+
+	clientA.Connection().WithInitialElectionID(base+1, 0).
+		WithRedundancyMode(fluent.ElectedPrimaryClient).WithPersistence()
+	clientA.Start(context.Background(), t)
+	clientA.StartSending(context.Background(), t)
+	defer clientA.Stop(t)
+
+	clientA.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"),
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+	)
+	if err := awaitTimeout(context.Background(), clientA, t, time.Minute); err != nil {
+		t.Fatalf("iteration %d: did not expect error from server in client A, got: %v", iteration, err)
+	}
+
+	clientB.Connection().WithInitialElectionID(base, 0).
+		WithRedundancyMode(fluent.ElectedPrimaryClient).WithPersistence()
+	clientB.Start(context.Background(), t)
+	clientB.StartSending(context.Background(), t)
+	defer clientB.Stop(t)
+
+	if err := awaitTimeout(context.Background(), clientB, t, time.Minute); err != nil {
+		t.Fatalf("iteration %d: did not expect error from server in client B, got: %v", iteration, err)
+	}
+
+	race(
+		func() { clientA.Modify().UpdateElectionID(t, base+2, 0) },
+		func() { clientB.Modify().UpdateElectionID(t, base+3, 0) },
+	)
+	for _, cl := range []*fluent.GRIBIClient{clientA, clientB} {
+		if err := awaitTimeout(context.Background(), cl, t, time.Minute); err != nil {
+			t.Fatalf("iteration %d: did not expect error from server after election ID update, got: %v", iteration, err)
+		}
+	}
+
+	race(
+		func() {
+			clientA.Modify().AddEntry(t, fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(prefixA).WithNextHopGroup(1))
+		},
+		func() {
+			clientB.Modify().AddEntry(t, fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(prefixB).WithNextHopGroup(1))
+		},
+	)
+	for _, cl := range []*fluent.GRIBIClient{clientA, clientB} {
+		if err := awaitTimeout(context.Background(), cl, t, time.Minute); err != nil {
+			t.Fatalf("iteration %d: did not expect error from server after ADD, got: %v", iteration, err)
+		}
+	}
+
+	chk.HasResult(t, clientB.Results(t),
+		fluent.OperationResult().
+			WithIPv4Operation(prefixB).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+
+	var failed bool
+	for _, r := range clientA.Results(t) {
+		if p, ok := r.IPv4Prefix(); !ok || p != prefixA {
+			continue
+		}
+		if r.ProgrammingResult != spb.AFTResult_FAILED {
+			t.Fatalf("iteration %d: did not get expected failure for ADD from client A, got: %s", iteration, r)
+		}
+		if msg := r.ErrorDetails.GetErrorMessage(); !strings.Contains(msg, server.NotPrimary) {
+			t.Fatalf("iteration %d: did not get not primary error for client A, got: %q, want substring: %s", iteration, msg, server.NotPrimary)
+		}
+		failed = true
+	}
+	if !failed {
+		t.Fatalf("iteration %d: did not get result for ADD from client A, got: %v", iteration, clientA.Results(t))
+	}
+
+	gr, err := clientB.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	if err != nil {
+		t.Fatalf("iteration %d: got unexpected error from get, got: %v", iteration, err)
+	}
+	getResponseHasIPv4Prefixes(t, gr, defaultNetworkInstanceName, []string{prefixB})
+}
@@ -0,0 +1,200 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/chk"
+	"github.com/openconfig/gribigo/fluent"
+	"github.com/openconfig/gribigo/rib"
+	"github.com/openconfig/ygot/ygot"
+	"github.com/openconfig/ygot/ytypes"
+	"google.golang.org/protobuf/encoding/prototext"
+
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// ErrorFormatter is a function that renders a gNMI Notification into a
+// human-readable form such that it can be included in the output of a failed
+// compliance test.
+type ErrorFormatter func(*gpb.Notification) string
+
+var (
+	// errFormatterMu protects errFormatter.
+	errFormatterMu sync.RWMutex
+	// errFormatter is the ErrorFormatter that is used by the compliance tests
+	// to render notifications in error messages.
+	errFormatter ErrorFormatter = JSONErrorFormatter
+)
+
+// SetErrorFormatter sets the ErrorFormatter that is used by the compliance tests
+// when rendering notifications within error messages. If f is nil, the default
+// JSONErrorFormatter is restored.
+func SetErrorFormatter(f ErrorFormatter) {
+	errFormatterMu.Lock()
+	defer errFormatterMu.Unlock()
+	if f == nil {
+		f = JSONErrorFormatter
+	}
+	errFormatter = f
+}
+
+// FormatNotification renders the notification n using the currently configured
+// ErrorFormatter. It is used by the compliance tests to render the contents of
+// Get responses when they do not contain the expected entries, and may be used
+// by test suites that check gNMI telemetry alongside the compliance tests such
+// that failures are rendered consistently.
+func FormatNotification(n *gpb.Notification) string {
+	errFormatterMu.RLock()
+	defer errFormatterMu.RUnlock()
+	return errFormatter(n)
+}
+
+// JSONErrorFormatter is the default ErrorFormatter. It maps the updates within n
+// onto the AFT schema and renders them as pretty-printed RFC7951 (JSON_IETF) JSON,
+// followed by the paths of any deletes within the notification. If the updates
+// cannot be mapped onto the schema, the notification is rendered in prototext.
+func JSONErrorFormatter(n *gpb.Notification) string {
+	if n == nil {
+		return "<nil notification>"
+	}
+
+	js, err := notificationToJSON(n)
+	if err != nil {
+		return fmt.Sprintf("%s (cannot render as JSON: %v)", prototext.Format(n), err)
+	}
+
+	var b strings.Builder
+	b.WriteString(js)
+	for _, d := range n.GetDelete() {
+		ps, err := ygot.PathToString(joinPath(n.GetPrefix(), d))
+		if err != nil {
+			ps = prototext.Format(d)
+		}
+		fmt.Fprintf(&b, "\ndelete: %s", ps)
+	}
+	return b.String()
+}
+
+// notificationToJSON unmarshals the updates within n into an AFT RIB and
+// returns the RIB as indented RFC7951 JSON.
+func notificationToJSON(n *gpb.Notification) (string, error) {
+	schema, err := aft.Schema()
+	if err != nil {
+		return "", fmt.Errorf("cannot load schema, %v", err)
+	}
+
+	root := schema.Root
+	for _, u := range n.GetUpdate() {
+		p := joinPath(n.GetPrefix(), u.GetPath())
+		if err := ytypes.SetNode(schema.RootSchema(), root, p, u.GetVal(), &ytypes.InitMissingElements{}); err != nil {
+			return "", fmt.Errorf("cannot set path %s, %v", p, err)
+		}
+	}
+
+	js, err := ygot.Marshal7951(root, ygot.JSONIndent("  "), &ygot.RFC7951JSONConfig{AppendModuleName: true})
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal JSON, %v", err)
+	}
+	return string(js), nil
+}
+
+// joinPath returns a path which consists of the elements of the prefix followed
+// by those of p.
+func joinPath(prefix, p *gpb.Path) *gpb.Path {
+	elems := append([]*gpb.PathElem{}, prefix.GetElem()...)
+	return &gpb.Path{
+		Origin: prefix.GetOrigin(),
+		Elem:   append(elems, p.GetElem()...),
+	}
+}
+
+// formatGetResponse renders the entries within getres as AFT notifications, one
+// per network instance, using FormatNotification.
+func formatGetResponse(getres *spb.GetResponse) string {
+	r, err := rib.FromGetResponses(defaultNetworkInstanceName, []*spb.GetResponse{getres})
+	if err != nil {
+		return fmt.Sprintf("cannot build RIB from GetResponse, %v", err)
+	}
+	contents, err := r.RIBContents()
+	if err != nil {
+		return fmt.Sprintf("cannot retrieve RIB contents, %v", err)
+	}
+
+	nis := []string{}
+	for ni := range contents {
+		nis = append(nis, ni)
+	}
+	sort.Strings(nis)
+
+	var b strings.Builder
+	for _, ni := range nis {
+		ns, err := ygot.TogNMINotifications(contents[ni], 0, ygot.GNMINotificationsConfig{UsePathElem: true})
+		if err != nil {
+			fmt.Fprintf(&b, "network instance %s: cannot render contents, %v\n", ni, err)
+			continue
+		}
+		for _, n := range ns {
+			fmt.Fprintf(&b, "network instance %s:\n%s\n", ni, FormatNotification(n))
+		}
+	}
+	return b.String()
+}
+
+// getResponseTB is a testing.TB which appends the contents of a GetResponse,
+// rendered using FormatNotification, to the failures that are reported to it.
+type getResponseTB struct {
+	testing.TB
+	// getres is the GetResponse whose contents are appended to failures.
+	getres *spb.GetResponse
+}
+
+// Errorf reports a failure to the underlying testing.TB along with the contents
+// of the GetResponse.
+func (g *getResponseTB) Errorf(format string, args ...any) {
+	g.TB.Helper()
+	g.TB.Errorf("%s\nGetResponse contents:\n%s", fmt.Sprintf(format, args...), formatGetResponse(g.getres))
+}
+
+// Fatalf reports a fatal failure to the underlying testing.TB along with the
+// contents of the GetResponse.
+func (g *getResponseTB) Fatalf(format string, args ...any) {
+	g.TB.Helper()
+	g.TB.Fatalf("%s\nGetResponse contents:\n%s", fmt.Sprintf(format, args...), formatGetResponse(g.getres))
+}
+
+// getResponseHasEntries checks that getres contains the entries in wants using
+// chk.GetResponseHasEntries, rendering the contents of getres using the
+// configured ErrorFormatter on failure.
+func getResponseHasEntries(t testing.TB, getres *spb.GetResponse, wants ...fluent.GRIBIEntry) {
+	t.Helper()
+	chk.GetResponseHasEntries(&getResponseTB{TB: t, getres: getres}, getres, wants...)
+}
+
+// getResponseHasIPv4Prefixes checks that the IPv4 prefixes within network
+// instance ni in getres are exactly wants using chk.GetResponseHasIPv4Prefixes,
+// rendering the contents of getres using the configured ErrorFormatter on
+// failure.
+func getResponseHasIPv4Prefixes(t testing.TB, getres *spb.GetResponse, ni string, wants []string) {
+	t.Helper()
+	chk.GetResponseHasIPv4Prefixes(&getResponseTB{TB: t, getres: getres}, getres, ni, wants)
+}
@@ -0,0 +1,185 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/openconfig/gribigo/fluent"
+	"github.com/openconfig/ygot/ygot"
+
+	gpb "github.com/openconfig/gnmi/proto/gnmi"
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+func mustPath(t *testing.T, s string) *gpb.Path {
+	t.Helper()
+	p, err := ygot.StringToStructuredPath(s)
+	if err != nil {
+		t.Fatalf("cannot parse path %s, %v", s, err)
+	}
+	return p
+}
+
+func TestJSONErrorFormatter(t *testing.T) {
+	tests := []struct {
+		desc         string
+		in           *gpb.Notification
+		wantContains []string
+	}{{
+		desc:         "nil notification",
+		wantContains: []string{"<nil notification>"},
+	}, {
+		desc: "next-hop in schema",
+		in: &gpb.Notification{
+			Prefix: mustPath(t, "/afts/next-hops/next-hop[index=1]"),
+			Update: []*gpb.Update{{
+				Path: mustPath(t, "state/ip-address"),
+				Val:  &gpb.TypedValue{Value: &gpb.TypedValue_StringVal{StringVal: "192.0.2.1"}},
+			}, {
+				Path: mustPath(t, "state/index"),
+				Val:  &gpb.TypedValue{Value: &gpb.TypedValue_UintVal{UintVal: 1}},
+			}},
+			Delete: []*gpb.Path{
+				mustPath(t, "state/mac-address"),
+			},
+		},
+		wantContains: []string{
+			`"gribi-aft:afts"`,
+			`"ip-address": "192.0.2.1"`,
+			`"index": "1"`,
+			"delete: /afts/next-hops/next-hop[index=1]/state/mac-address",
+		},
+	}, {
+		desc: "path not in schema",
+		in: &gpb.Notification{
+			Update: []*gpb.Update{{
+				Path: mustPath(t, "/not-in-schema[name=eth0]/leaf"),
+				Val:  &gpb.TypedValue{Value: &gpb.TypedValue_UintVal{UintVal: 1500}},
+			}},
+		},
+		wantContains: []string{"cannot render as JSON", "eth0"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := JSONErrorFormatter(tt.in)
+			for _, want := range tt.wantContains {
+				if !strings.Contains(got, want) {
+					t.Errorf("JSONErrorFormatter(%v): did not get expected output, got:\n%s\nwant substring: %s", tt.in, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSetErrorFormatter(t *testing.T) {
+	defer SetErrorFormatter(nil)
+
+	SetErrorFormatter(func(*gpb.Notification) string { return "custom-output" })
+	if got, want := FormatNotification(&gpb.Notification{}), "custom-output"; got != want {
+		t.Fatalf("did not get expected output, got: %s, want: %s", got, want)
+	}
+
+	SetErrorFormatter(nil)
+	if got := FormatNotification(nil); got != "<nil notification>" {
+		t.Fatalf("did not restore default formatter, got: %s", got)
+	}
+}
+
+// recordingTB is a testing.TB which records the failures that are reported to
+// it rather than failing the test.
+type recordingTB struct {
+	testing.TB
+	msgs []string
+}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.msgs = append(r.msgs, fmt.Sprintf(format, args...))
+}
+
+func (r *recordingTB) Fatalf(format string, args ...any) {
+	r.Errorf(format, args...)
+	runtime.Goexit()
+}
+
+func TestGetResponseFailureFormat(t *testing.T) {
+	getres := &spb.GetResponse{
+		Entry: []*spb.AFTEntry{{
+			NetworkInstance: defaultNetworkInstanceName,
+			Entry: &spb.AFTEntry_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 1,
+					NextHop: &aftpb.Afts_NextHop{
+						IpAddress: &wpb.StringValue{Value: "192.0.2.1"},
+					},
+				},
+			},
+		}},
+	}
+
+	tests := []struct {
+		desc            string
+		inFormatter     ErrorFormatter
+		wantContains    []string
+		wantNotContains []string
+	}{{
+		desc:         "default formatter",
+		wantContains: []string{"did not find nexthop", `"ip-address": "192.0.2.1"`},
+	}, {
+		desc:            "custom formatter",
+		inFormatter:     func(*gpb.Notification) string { return "custom-output" },
+		wantContains:    []string{"did not find nexthop", "custom-output"},
+		wantNotContains: []string{`"ip-address": "192.0.2.1"`},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			SetErrorFormatter(tt.inFormatter)
+			defer SetErrorFormatter(nil)
+
+			rt := &recordingTB{TB: t}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				getResponseHasEntries(rt, getres,
+					fluent.NextHopEntry().
+						WithNetworkInstance(defaultNetworkInstanceName).
+						WithIndex(2))
+			}()
+			<-done
+
+			if len(rt.msgs) != 1 {
+				t.Fatalf("did not get expected number of failures, got: %v, want: 1", rt.msgs)
+			}
+			got := rt.msgs[0]
+			for _, want := range tt.wantContains {
+				if !strings.Contains(got, want) {
+					t.Errorf("did not get expected failure, got:\n%s\nwant substring: %s", got, want)
+				}
+			}
+			for _, notWant := range tt.wantNotContains {
+				if strings.Contains(got, notWant) {
+					t.Errorf("got unexpected content in failure, got:\n%s\ndid not want substring: %s", got, notWant)
+				}
+			}
+		})
+	}
+}
@@ -262,6 +262,60 @@ func FlushPreservesDefaultNI(c *fluent.GRIBIClient, wantACK fluent.ProgrammingRe
 	checkNIHasNEntries(ctx, c, defaultNetworkInstanceName, 3, t)
 }
 
+// FlushOfSpecificNIIsIsolated programs entries into two non-default VRFs, whose
+// names can be specified using SetFlushVRFNames. It subsequently issues a Flush
+// RPC using the current master's election ID that targets only the first VRF, and
+// ensures using the Get RPC that the first VRF is empty, whilst the entries within
+// the second are preserved. Finally, it issues a Flush RPC that overrides the
+// election ID and targets all network instances, and ensures that both VRFs are
+// empty.
+func FlushOfSpecificNIIsIsolated(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
+	vrfA, vrfB := flushVRFNames[0], flushVRFNames[1]
+	if vrfA == "" || vrfB == "" {
+		t.Skip("names of the VRFs used to validate Flush isolation are not specified, see SetFlushVRFNames")
+	}
+	defer flushServer(c, t)
+
+	addFlushEntriesToNI(c, vrfA, wantACK, t)
+	addFlushEntriesToNI(c, vrfB, wantACK, t)
+
+	// addFlushEntriesToNI increments the election ID so to check with the current value,
+	// we need to subtract one from the current election ID.
+	curID := electionID.Load() - 1
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+
+	fr, err := c.Flush().
+		WithElectionID(curID, 0).
+		WithNetworkInstance(vrfA).
+		Send()
+	switch {
+	case err != nil:
+		t.Fatalf("got unexpected error from flush of %s, got: %v", vrfA, err)
+	case fr.GetResult() != spb.FlushResponse_OK:
+		t.Fatalf("unexpected response from flush of %s, got: %v, want: %v", vrfA, fr.GetResult().String(), spb.FlushResponse_OK.String())
+	}
+
+	checkNIHasNEntries(ctx, c, vrfA, 0, t)
+	checkNIHasNEntries(ctx, c, vrfB, 3, t)
+
+	fr, err = c.Flush().
+		WithElectionOverride().
+		WithAllNetworkInstances().
+		Send()
+	switch {
+	case err != nil:
+		t.Fatalf("got unexpected error from flush of all network instances, got: %v", err)
+	case fr.GetResult() != spb.FlushResponse_OK:
+		t.Fatalf("unexpected response from flush of all network instances, got: %v, want: %v", fr.GetResult().String(), spb.FlushResponse_OK.String())
+	}
+
+	checkNIHasNEntries(ctx, c, vrfA, 0, t)
+	checkNIHasNEntries(ctx, c, vrfB, 0, t)
+}
+
 // FlushServer flushes all the state on the server, but does not validate it
 // specifically. It can be called from tests that need to clean up
 // a server between test cases.
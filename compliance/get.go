@@ -65,7 +65,7 @@ func GetNH(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB
 		t.Fatalf("got unexpected error from get, got: %v", err)
 	}
 
-	chk.GetResponseHasEntries(t, gr,
+	getResponseHasEntries(t, gr,
 		fluent.NextHopEntry().
 			WithNetworkInstance(defaultNetworkInstanceName).
 			WithIndex(1).
@@ -125,7 +125,7 @@ func GetNHG(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.T
 		t.Fatalf("got unexpected error from get, got: %v", err)
 	}
 
-	chk.GetResponseHasEntries(t, gr,
+	getResponseHasEntries(t, gr,
 		fluent.NextHopGroupEntry().
 			WithNetworkInstance(defaultNetworkInstanceName).
 			WithID(1).
@@ -202,7 +202,7 @@ func GetIPv4(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.
 		t.Fatalf("got unexpected error from get, got: %v", err)
 	}
 
-	chk.GetResponseHasEntries(t, gr,
+	getResponseHasEntries(t, gr,
 		fluent.IPv4Entry().
 			WithNetworkInstance(defaultNetworkInstanceName).
 			WithNextHopGroup(1).
@@ -280,7 +280,7 @@ func GetIPv4Chain(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t tes
 		t.Fatalf("got unexpected error from get, got: %v", err)
 	}
 
-	chk.GetResponseHasEntries(t, gr,
+	getResponseHasEntries(t, gr,
 		fluent.IPv4Entry().
 			WithNetworkInstance(defaultNetworkInstanceName).
 			WithNextHopGroup(1).
@@ -0,0 +1,126 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/openconfig/gribigo/chk"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+)
+
+// ipv4EntryLimit is an option that specifies the number of IPv4 entries that a
+// server can install within a network instance.
+type ipv4EntryLimit struct {
+	// n is the maximum number of IPv4 entries.
+	n int
+}
+
+// IsTestOpt marks ipv4EntryLimit as implementing the TestOpt interface.
+func (*ipv4EntryLimit) IsTestOpt() {}
+
+// IPv4EntryLimit specifies the maximum number of IPv4 entries that the server
+// under test can install within the default network instance.
+func IPv4EntryLimit(n int) *ipv4EntryLimit {
+	return &ipv4EntryLimit{n: n}
+}
+
+// IPv4TableFull fills the IPv4 table of the default network instance up to the
+// limit specified using the IPv4EntryLimit option, and validates that the first
+// IPv4 entry that is added beyond the limit is NACKed, whilst a replace of an
+// existing entry is accepted. It checks that the number of IPv4 entries that
+// are installed is equal to the limit using the Get RPC.
+func IPv4TableFull(c *fluent.GRIBIClient, t testing.TB, opts ...TestOpt) {
+	defer flushServer(c, t)
+
+	var limit int
+	for _, o := range opts {
+		if v, ok := o.(*ipv4EntryLimit); ok {
+			limit = v.n
+		}
+	}
+	if limit == 0 {
+		t.Fatalf("IPv4TableFull requires an IPv4EntryLimit option to be specified")
+	}
+
+	prefix := func(i int) string {
+		return fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+	}
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(42).AddNextHop(1, 1))
+		},
+	}
+	// Add one more entry than the limit.
+	for i := 0; i <= limit; i++ {
+		p := prefix(i)
+		ops = append(ops, func() {
+			c.Modify().AddEntry(t, fluent.IPv4Entry().WithPrefix(p).WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(42))
+		})
+	}
+	// Replacing an existing entry does not increase the size of the table.
+	ops = append(ops, func() {
+		c.Modify().ReplaceEntry(t, fluent.IPv4Entry().WithPrefix(prefix(0)).WithNetworkInstance(defaultNetworkInstanceName).WithNextHopGroup(42))
+	})
+
+	res := DoModifyOps(c, t, ops, fluent.InstalledInRIB, false)
+
+	for i := 0; i < limit; i++ {
+		chk.HasResult(t, res,
+			fluent.OperationResult().
+				WithOperationID(uint64(i+3)).
+				WithIPv4Operation(prefix(i)).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(fluent.InstalledInRIB).
+				AsResult())
+	}
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(uint64(limit+3)).
+			WithIPv4Operation(prefix(limit)).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult())
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithOperationID(uint64(limit+4)).
+			WithIPv4Operation(prefix(0)).
+			WithOperationType(constants.Replace).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult())
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	if got := len(gr.GetEntry()); got != limit {
+		t.Fatalf("did not get expected number of IPv4 entries, got: %d, want: %d", got, limit)
+	}
+}
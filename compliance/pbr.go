@@ -0,0 +1,85 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"context"
+	"testing"
+
+	"github.com/openconfig/gribigo/chk"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+	"google.golang.org/protobuf/proto"
+)
+
+// AddPolicyForwardingEntry validates that the gRIBI server supports adding a
+// policy-forwarding entry that matches on each of the supported header fields,
+// and that the entry that is returned by the Get RPC has the same contents as
+// the entry that was programmed. It expects the wantACK acknowledgement type.
+func AddPolicyForwardingEntry(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, _ ...TestOpt) {
+	defer flushServer(c, t)
+
+	pbr := fluent.PolicyForwardingEntry().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithIndex(1).
+		WithIPv4Dst("203.0.113.0/24").
+		WithDSCP(46).
+		WithProtocol(17).
+		WithL4SrcPort(1024).
+		WithL4DstPort(4789).
+		WithNextHopGroup(1)
+
+	ops := []func(){
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+		},
+		func() {
+			c.Modify().AddEntry(t, fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1))
+		},
+		func() {
+			c.Modify().AddEntry(t, pbr)
+		},
+	}
+
+	res := DoModifyOps(c, t, ops, wantACK, false)
+
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithPolicyForwardingOperation(1).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(wantACK).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+
+	ctx := context.Background()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.PolicyForwarding).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+
+	want, err := pbr.EntryProto()
+	if err != nil {
+		t.Fatalf("cannot build expected entry, %v", err)
+	}
+	if len(gr.GetEntry()) != 1 || !proto.Equal(gr.GetEntry()[0], want) {
+		t.Fatalf("did not get expected policy-forwarding entry, got: %s, want: %s", gr, want)
+	}
+}
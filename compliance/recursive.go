@@ -0,0 +1,345 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/chk"
+	"github.com/openconfig/gribigo/client"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+const (
+	// recursiveDependentPrefix is the prefix of the IPv4 entry that uses the
+	// next-hop that is recursively resolved via the covering route.
+	recursiveDependentPrefix = "198.51.100.0/24"
+
+	// unresolvedWait is the time for which RecursiveNextHopResolution waits for
+	// FIB_PROGRAMMED results that are not expected to be received since the
+	// entries cannot be resolved.
+	unresolvedWait = 5 * time.Second
+)
+
+// recursiveResolution is an option that specifies the addresses that are used by
+// RecursiveNextHopResolution.
+type recursiveResolution struct {
+	// coveringPrefix is the prefix of the covering route.
+	coveringPrefix string
+	// resolvedAddr is the address of the next-hop of the covering route.
+	resolvedAddr string
+	// recursiveAddr is the address of the next-hop that is resolved via the
+	// covering route.
+	recursiveAddr string
+}
+
+// IsTestOpt marks recursiveResolution as implementing the TestOpt interface.
+func (*recursiveResolution) IsTestOpt() {}
+
+// RecursiveResolution specifies the addresses that are used by
+// RecursiveNextHopResolution. The coveringPrefix is the prefix of the covering
+// route, which the server under test must not otherwise have a route for. The
+// resolvedAddr is the address of the next-hop of the covering route, which must be
+// resolvable by the server without gRIBI - for example, since it is directly
+// connected. The recursiveAddr is the address of the next-hop that is resolved via
+// the covering route, which must be within coveringPrefix.
+//
+// By default, the covering route 203.0.113.0/24 is used with a next-hop of
+// 192.0.2.1, and the recursively resolved next-hop has the address 203.0.113.1.
+func RecursiveResolution(coveringPrefix, resolvedAddr, recursiveAddr string) *recursiveResolution {
+	return &recursiveResolution{
+		coveringPrefix: coveringPrefix,
+		resolvedAddr:   resolvedAddr,
+		recursiveAddr:  recursiveAddr,
+	}
+}
+
+// RecursiveNextHopResolution validates that the server under test resolves a
+// next-hop whose address is within a prefix that is programmed using gRIBI via
+// that prefix. Before the covering route is installed, it adds a next-hop whose
+// address is within the covering prefix, along with a next-hop-group and an IPv4
+// entry that use it, and validates that the IPv4 entry is installed in the RIB,
+// but not in the FIB. It subsequently adds the covering route, and validates that
+// the dependent entries are then installed in the FIB.
+//
+// Finally, it deletes the covering route. The dependent IPv4 entry is expected to
+// remain in the RIB, and - if the server reports the FIB status of entries using
+// the Get RPC - to be reported as not being programmed in the FIB.
+//
+// The addresses that are used can be specified using the RecursiveResolution
+// option.
+func RecursiveNextHopResolution(c *fluent.GRIBIClient, t testing.TB, opts ...TestOpt) {
+	defer flushServer(c, t)
+	defer electionID.Inc()
+
+	addrs := RecursiveResolution("203.0.113.0/24", "192.0.2.1", "203.0.113.1")
+	for _, o := range opts {
+		if v, ok := o.(*recursiveResolution); ok {
+			addrs = v
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	c.Connection().WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(electionID.Load(), 0).WithPersistence().WithFIBACK()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - session negotiation, got: %v, want: nil", err)
+	}
+
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress(addrs.recursiveAddr),
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(recursiveDependentPrefix).WithNextHopGroup(1),
+	)
+
+	// The dependent entries cannot be programmed in the FIB until the covering
+	// route exists, and hence the client is not expected to converge.
+	if err := awaitTimeout(ctx, c, t, unresolvedWait); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("did not get expected error awaiting entries that cannot be resolved, got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	res := c.Results(t)
+	chk.HasResult(t, res,
+		fluent.OperationResult().
+			WithIPv4Operation(recursiveDependentPrefix).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+	for _, r := range res {
+		if r.Details != nil && r.Details.IPv4Prefix == recursiveDependentPrefix && r.ProgrammingResult == spb.AFTResult_FIB_PROGRAMMED {
+			t.Fatalf("IPv4 entry %s was programmed in the FIB before the covering route %s was installed", recursiveDependentPrefix, addrs.coveringPrefix)
+		}
+	}
+
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(2).WithIPAddress(addrs.resolvedAddr),
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(2).AddNextHop(2, 1),
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(addrs.coveringPrefix).WithNextHopGroup(2),
+	)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - covering route, got: %v, want: nil", err)
+	}
+
+	res = c.Results(t)
+	for _, want := range []*client.OpResult{
+		fluent.OperationResult().
+			WithNextHopOperation(1).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInFIB).
+			AsResult(),
+		fluent.OperationResult().
+			WithNextHopGroupOperation(1).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInFIB).
+			AsResult(),
+		fluent.OperationResult().
+			WithIPv4Operation(recursiveDependentPrefix).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInFIB).
+			AsResult(),
+		fluent.OperationResult().
+			WithIPv4Operation(addrs.coveringPrefix).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInFIB).
+			AsResult(),
+	} {
+		chk.HasResult(t, res, want, chk.IgnoreOperationID())
+	}
+
+	c.Modify().DeleteEntry(t,
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(addrs.coveringPrefix).WithNextHopGroup(2),
+	)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - delete covering route, got: %v, want: nil", err)
+	}
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithIPv4Operation(addrs.coveringPrefix).
+			WithOperationType(constants.Delete).
+			WithProgrammingResult(fluent.InstalledInFIB).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasIPv4Prefixes(t, gr, defaultNetworkInstanceName, []string{recursiveDependentPrefix})
+	for _, e := range gr.GetEntry() {
+		if e.GetIpv4().GetPrefix() != recursiveDependentPrefix {
+			continue
+		}
+		switch e.GetFibStatus() {
+		case spb.AFTEntry_UNAVAILABLE:
+			t.Logf("server does not report FIB status, cannot validate that IPv4 entry %s was removed from the FIB", recursiveDependentPrefix)
+		case spb.AFTEntry_PROGRAMMED:
+			t.Errorf("IPv4 entry %s is programmed in the FIB after the covering route %s was deleted", recursiveDependentPrefix, addrs.coveringPrefix)
+		}
+	}
+}
+
+const (
+	// recursiveCoveringPrefix is the prefix of the IPv4 entry used by
+	// RecursiveNextHopCompliance that resolves the recursive next-hop.
+	recursiveCoveringPrefix = "192.0.2.0/24"
+	// recursiveNextHopAddr is the address of the next-hop used by
+	// RecursiveNextHopCompliance that is resolved via recursiveCoveringPrefix.
+	recursiveNextHopAddr = "192.0.2.1"
+	// recursiveResolvedPrefix is the prefix of the IPv4 entry used by
+	// RecursiveNextHopCompliance that uses the recursive next-hop.
+	recursiveResolvedPrefix = "10.0.0.0/8"
+)
+
+// directNextHopInterface is an option that specifies the interface that is used
+// by the directly connected next-hop in RecursiveNextHopCompliance.
+type directNextHopInterface struct {
+	name string
+}
+
+// IsTestOpt marks directNextHopInterface as implementing the TestOpt interface.
+func (*directNextHopInterface) IsTestOpt() {}
+
+// DirectNextHopInterface specifies the name of the interface that is used by the
+// directly connected next-hop in RecursiveNextHopCompliance, which must exist on
+// the server under test. By default, the interface eth0 is used.
+func DirectNextHopInterface(name string) *directNextHopInterface {
+	return &directNextHopInterface{name: name}
+}
+
+// RecursiveNextHopCompliance validates that the server under test installs
+// entries that use a next-hop that is recursively resolved via an IPv4 entry
+// programmed using gRIBI. It installs a next-hop pointing to an interface, a
+// next-hop-group that references it, and the IPv4 entry 192.0.2.0/24 that uses
+// the next-hop-group. It subsequently installs the IPv4 entry 10.0.0.0/8, using a
+// next-hop whose address is within 192.0.2.0/24, and validates that each entry is
+// acknowledged with the programming result wantACK.
+//
+// Finally, it deletes 192.0.2.0/24, and validates that the next-hop-group that it
+// used is no longer referenced - such that it, and its next-hop, can be deleted -
+// whilst 10.0.0.0/8 remains installed.
+//
+// The interface used by the next-hop can be specified using the
+// DirectNextHopInterface option.
+func RecursiveNextHopCompliance(c *fluent.GRIBIClient, wantACK fluent.ProgrammingResult, t testing.TB, opts ...TestOpt) {
+	defer flushServer(c, t)
+	defer electionID.Inc()
+
+	intf := "eth0"
+	for _, o := range opts {
+		if v, ok := o.(*directNextHopInterface); ok {
+			intf = v.name
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	conn := c.Connection().WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(electionID.Load(), 0).WithPersistence()
+	if wantACK == fluent.InstalledInFIB {
+		conn.WithFIBACK()
+	}
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - session negotiation, got: %v, want: nil", err)
+	}
+
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithInterfaceRef(intf),
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(recursiveCoveringPrefix).WithNextHopGroup(1),
+	)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - covering route, got: %v, want: nil", err)
+	}
+
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(2).WithIPAddress(recursiveNextHopAddr),
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(2).AddNextHop(2, 1),
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(recursiveResolvedPrefix).WithNextHopGroup(2),
+	)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - recursive route, got: %v, want: nil", err)
+	}
+
+	res := c.Results(t)
+	for _, want := range []*client.OpResult{
+		fluent.OperationResult().WithNextHopOperation(1).WithOperationType(constants.Add).WithProgrammingResult(wantACK).AsResult(),
+		fluent.OperationResult().WithNextHopGroupOperation(1).WithOperationType(constants.Add).WithProgrammingResult(wantACK).AsResult(),
+		fluent.OperationResult().WithIPv4Operation(recursiveCoveringPrefix).WithOperationType(constants.Add).WithProgrammingResult(wantACK).AsResult(),
+		fluent.OperationResult().WithNextHopOperation(2).WithOperationType(constants.Add).WithProgrammingResult(wantACK).AsResult(),
+		fluent.OperationResult().WithNextHopGroupOperation(2).WithOperationType(constants.Add).WithProgrammingResult(wantACK).AsResult(),
+		fluent.OperationResult().WithIPv4Operation(recursiveResolvedPrefix).WithOperationType(constants.Add).WithProgrammingResult(wantACK).AsResult(),
+	} {
+		chk.HasResult(t, res, want, chk.IgnoreOperationID())
+	}
+
+	c.Modify().DeleteEntry(t,
+		fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(recursiveCoveringPrefix).WithNextHopGroup(1),
+	)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - delete covering route, got: %v, want: nil", err)
+	}
+
+	// Once the covering route is deleted, the next-hop-group that it used is no
+	// longer referenced by any entry, and hence can itself be deleted, followed by
+	// its next-hop.
+	c.Modify().DeleteEntry(t,
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1),
+	)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - delete next-hop-group, got: %v, want: nil", err)
+	}
+	c.Modify().DeleteEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1),
+	)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error from server - delete next-hop, got: %v, want: nil", err)
+	}
+
+	res = c.Results(t)
+	for _, want := range []*client.OpResult{
+		fluent.OperationResult().WithIPv4Operation(recursiveCoveringPrefix).WithOperationType(constants.Delete).WithProgrammingResult(wantACK).AsResult(),
+		fluent.OperationResult().WithNextHopGroupOperation(1).WithOperationType(constants.Delete).WithProgrammingResult(wantACK).AsResult(),
+		fluent.OperationResult().WithNextHopOperation(1).WithOperationType(constants.Delete).WithProgrammingResult(wantACK).AsResult(),
+	} {
+		chk.HasResult(t, res, want, chk.IgnoreOperationID())
+	}
+
+	gr, err := c.Get().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithAFT(fluent.IPv4).
+		Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from get, got: %v", err)
+	}
+	getResponseHasIPv4Prefixes(t, gr, defaultNetworkInstanceName, []string{recursiveResolvedPrefix})
+}
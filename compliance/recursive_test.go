@@ -0,0 +1,243 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+	"github.com/openconfig/gribigo/rib"
+	"github.com/openconfig/gribigo/server"
+)
+
+// maxFIBResolutionDepth is the maximum number of prefixes that are traversed
+// when the simulated FIB resolves a next-hop.
+const maxFIBResolutionDepth = 8
+
+// simulatedFIB is a RIB event hook that simulates a FIB within which a next-hop
+// is programmed only once its address can be resolved - either since it is within
+// a connected prefix, or since it is within an IPv4 prefix that is programmed in
+// the FIB. Events for entries that cannot be programmed are completed once they
+// can be.
+type simulatedFIB struct {
+	// connected is the prefix that is directly connected to the simulated device.
+	connected netip.Prefix
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// held are the events that have not been completed since the entry that they
+	// refer to cannot yet be programmed.
+	held []rib.RIBEvent
+	// nhs maps the index of each next-hop to its address.
+	nhs map[uint64]string
+	// nhgs maps the ID of each next-hop-group to the indices of its next-hops.
+	nhgs map[uint64][]uint64
+	// ipv4 maps each IPv4 prefix to the ID of the next-hop-group that it uses.
+	ipv4 map[string]uint64
+	// withdrawn are the IPv4 prefixes that were removed from the FIB since an
+	// entry that they were resolved via was deleted.
+	withdrawn []string
+	// setStatus, if set, is used to report prefixes that are withdrawn from the
+	// FIB to the server.
+	setStatus func(ni string, a constants.AFT, key string, programmed bool) error
+}
+
+// newSimulatedFIB returns a simulated FIB in which the prefix connected is
+// directly connected.
+func newSimulatedFIB(connected string) *simulatedFIB {
+	return &simulatedFIB{
+		connected: netip.MustParsePrefix(connected),
+		nhs:       map[uint64]string{},
+		nhgs:      map[uint64][]uint64{},
+		ipv4:      map[string]uint64{},
+	}
+}
+
+// event implements rib.RIBEventFn for the simulated FIB.
+func (f *simulatedFIB) event(e rib.RIBEvent) error {
+	f.mu.Lock()
+	before := f.programmedPrefixes()
+	switch v := e.Entry.(type) {
+	case *aft.Afts_NextHop:
+		if e.Op == constants.Delete {
+			delete(f.nhs, v.GetIndex())
+			break
+		}
+		f.nhs[v.GetIndex()] = v.GetIpAddress()
+	case *aft.Afts_NextHopGroup:
+		if e.Op == constants.Delete {
+			delete(f.nhgs, v.GetId())
+			break
+		}
+		f.nhgs[v.GetId()] = nil
+		for idx := range v.NextHop {
+			f.nhgs[v.GetId()] = append(f.nhgs[v.GetId()], idx)
+		}
+	case *aft.Afts_Ipv4Entry:
+		if e.Op == constants.Delete {
+			delete(f.ipv4, v.GetPrefix())
+			break
+		}
+		f.ipv4[v.GetPrefix()] = v.GetNextHopGroup()
+	}
+	if e.Op != constants.Delete {
+		f.held = append(f.held, e)
+	}
+
+	after := f.programmedPrefixes()
+	withdrawn := []string{}
+	for p := range before {
+		if _, ok := f.ipv4[p]; ok && !after[p] {
+			withdrawn = append(withdrawn, p)
+		}
+	}
+	f.withdrawn = append(f.withdrawn, withdrawn...)
+
+	// Events are completed once the mutex is released, since completing an event
+	// may block until its result has been sent to the client.
+	done := []func(error){}
+	if e.Op == constants.Delete {
+		done = append(done, e.Done)
+	}
+	held := []rib.RIBEvent{}
+	for _, h := range f.held {
+		if f.programmed(h.Entry) {
+			done = append(done, h.Done)
+			continue
+		}
+		held = append(held, h)
+	}
+	f.held = held
+	f.mu.Unlock()
+
+	// Withdrawals are reported before the event that caused them is completed,
+	// such that they are visible to a client that has received its result.
+	for _, p := range withdrawn {
+		if f.setStatus == nil {
+			break
+		}
+		if err := f.setStatus(server.DefaultNetworkInstanceName, constants.IPv4, p, false); err != nil {
+			return err
+		}
+	}
+	for _, fn := range done {
+		fn(nil)
+	}
+	return nil
+}
+
+// programmed returns true if the entry e can be programmed in the FIB.
+func (f *simulatedFIB) programmed(e any) bool {
+	switch v := e.(type) {
+	case *aft.Afts_NextHop:
+		return f.nhProgrammed(v.GetIndex(), 0)
+	case *aft.Afts_NextHopGroup:
+		return f.nhgProgrammed(v.GetId(), 0)
+	case *aft.Afts_Ipv4Entry:
+		return f.nhgProgrammed(v.GetNextHopGroup(), 0)
+	}
+	return true
+}
+
+// programmedPrefixes returns the set of IPv4 prefixes that are programmed in the
+// FIB.
+func (f *simulatedFIB) programmedPrefixes() map[string]bool {
+	ps := map[string]bool{}
+	for p, nhg := range f.ipv4 {
+		if f.nhgProgrammed(nhg, 0) {
+			ps[p] = true
+		}
+	}
+	return ps
+}
+
+// nhgProgrammed returns true if each next-hop within the next-hop-group with
+// the specified ID is programmed, having traversed depth prefixes.
+func (f *simulatedFIB) nhgProgrammed(id uint64, depth int) bool {
+	nhs, ok := f.nhgs[id]
+	if !ok || len(nhs) == 0 {
+		return false
+	}
+	for _, idx := range nhs {
+		if !f.nhProgrammed(idx, depth) {
+			return false
+		}
+	}
+	return true
+}
+
+// nhProgrammed returns true if the next-hop with the specified index can be
+// resolved, having traversed depth prefixes. Its address is resolved using the
+// longest IPv4 prefix that covers it.
+func (f *simulatedFIB) nhProgrammed(idx uint64, depth int) bool {
+	a, ok := f.nhs[idx]
+	if !ok || depth > maxFIBResolutionDepth {
+		return false
+	}
+	addr, err := netip.ParseAddr(a)
+	if err != nil {
+		return false
+	}
+	if f.connected.Contains(addr) {
+		return true
+	}
+
+	var (
+		longest netip.Prefix
+		nhg     uint64
+	)
+	for s, id := range f.ipv4 {
+		p, err := netip.ParsePrefix(s)
+		if err != nil || !p.Contains(addr) || (longest.IsValid() && p.Bits() <= longest.Bits()) {
+			continue
+		}
+		longest, nhg = p, id
+	}
+	return longest.IsValid() && f.nhgProgrammed(nhg, depth+1)
+}
+
+func TestRecursiveNextHopResolutionCompliance(t *testing.T) {
+	fib := newSimulatedFIB("192.0.2.0/24")
+	// Events for entries that cannot be programmed are held by the simulated FIB,
+	// and hence sufficient events must be able to be outstanding for the events
+	// for the covering route to be handed to it.
+	s, addr := startServerWithHandle(t, server.WithRIBEventHook(fib.event), server.WithMaxOutstandingRIBEvents(16))
+	fib.setStatus = s.SetFIBStatus
+	c := fluent.NewClient()
+	c.Connection().WithTarget(addr)
+	RecursiveNextHopResolution(c, t)
+
+	fib.mu.Lock()
+	defer fib.mu.Unlock()
+	if len(fib.withdrawn) != 1 || fib.withdrawn[0] != recursiveDependentPrefix {
+		t.Errorf("did not get expected prefixes withdrawn from the FIB, got: %v, want: [%s]", fib.withdrawn, recursiveDependentPrefix)
+	}
+}
+
+func TestRecursiveNextHopCompliance(t *testing.T) {
+	for _, wantACK := range []fluent.ProgrammingResult{fluent.InstalledInRIB, fluent.InstalledInFIB} {
+		t.Run(fmt.Sprintf("%v", wantACK), func(t *testing.T) {
+			addr := startServer(t)
+			c := fluent.NewClient()
+			c.Connection().WithTarget(addr)
+			RecursiveNextHopCompliance(c, wantACK, t)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/chk"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+	"lukechampine.com/uint128"
+)
+
+const (
+	// defaultRefreshInterval is the interval at which ElectionIDRefresh
+	// re-advertises the election ID if the ElectionRefresh option is not
+	// specified.
+	defaultRefreshInterval = 5 * time.Second
+	// defaultRefreshDuration is the duration for which ElectionIDRefresh
+	// re-advertises the election ID if the ElectionRefresh option is not
+	// specified.
+	defaultRefreshDuration = 2 * time.Minute
+)
+
+// electionRefresh is an option that specifies how ElectionIDRefresh
+// re-advertises the election ID.
+type electionRefresh struct {
+	// interval is the time between each re-advertisement.
+	interval time.Duration
+	// duration is the total time for which the election ID is re-advertised.
+	duration time.Duration
+}
+
+// IsTestOpt marks electionRefresh as implementing the TestOpt interface.
+func (*electionRefresh) IsTestOpt() {}
+
+// ElectionRefresh specifies that ElectionIDRefresh should re-advertise the
+// election ID every interval, for the specified duration.
+func ElectionRefresh(interval, duration time.Duration) *electionRefresh {
+	return &electionRefresh{interval: interval, duration: duration}
+}
+
+// refreshSleep is an option that specifies the function used by
+// ElectionIDRefresh to wait between re-advertisements.
+type refreshSleep struct {
+	// fn is called with the time to wait.
+	fn func(time.Duration)
+}
+
+// IsTestOpt marks refreshSleep as implementing the TestOpt interface.
+func (*refreshSleep) IsTestOpt() {}
+
+// RefreshSleep specifies the function that ElectionIDRefresh uses to wait
+// between re-advertisements of the election ID, by default time.Sleep is used.
+// When the test is run against a server whose clock is controlled by the test,
+// a function that advances the server's clock allows the test to be run without
+// waiting in real time.
+func RefreshSleep(fn func(time.Duration)) *refreshSleep {
+	return &refreshSleep{fn: fn}
+}
+
+// ElectionIDRefresh validates that a client that periodically re-advertises the
+// same election ID - as some controllers do as a liveness signal - remains the
+// master, and that the entries that it programmed are not disturbed. Entries are
+// programmed at the start of the test, after which the election ID is
+// re-advertised periodically. Each re-advertisement must be acknowledged with
+// the unchanged election ID, and a Get after each must return the programmed
+// entries.
+//
+// The interval and duration of the re-advertisements, and the function used to
+// wait between them, can be specified using the ElectionRefresh and
+// RefreshSleep options.
+func ElectionIDRefresh(c *fluent.GRIBIClient, t testing.TB, opts ...TestOpt) {
+	defer flushServer(c, t)
+	defer electionID.Inc()
+
+	interval, duration, sleep := defaultRefreshInterval, defaultRefreshDuration, time.Sleep
+	for _, o := range opts {
+		switch v := o.(type) {
+		case *electionRefresh:
+			interval, duration = v.interval, v.duration
+		case *refreshSleep:
+			sleep = v.fn
+		}
+	}
+
+	id := electionID.Load()
+	c.Connection().WithInitialElectionID(id, 0).
+		WithRedundancyMode(fluent.ElectedPrimaryClient).
+		WithPersistence()
+	ctx := context.Background()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+
+	prefixes := []string{"198.51.100.0/24", "203.0.113.0/24"}
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"),
+		fluent.NextHopGroupEntry().WithNetworkInstance(defaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+	)
+	for _, p := range prefixes {
+		c.Modify().AddEntry(t, fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(p).WithNextHopGroup(1))
+	}
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("could not program entries via client, got err: %v", err)
+	}
+	for _, p := range prefixes {
+		chk.HasResult(t, c.Results(t),
+			fluent.OperationResult().
+				WithIPv4Operation(p).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(fluent.InstalledInRIB).
+				AsResult(),
+			chk.IgnoreOperationID(),
+		)
+	}
+
+	want := uint128.From64(id)
+	// The initial election ID is acknowledged when the client is started.
+	wantAcks := 1
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += interval {
+		sleep(interval)
+		c.Modify().UpdateElectionID(t, id, 0)
+		wantAcks++
+		if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+			t.Fatalf("after %s: did not expect error from server after re-advertising election ID, got: %v", elapsed+interval, err)
+		}
+
+		var acks int
+		for _, r := range c.Results(t) {
+			if r.CurrentServerElectionID == nil {
+				continue
+			}
+			if got := uint128.New(r.CurrentServerElectionID.Low, r.CurrentServerElectionID.High); got != want {
+				t.Fatalf("after %s: re-advertisement of election ID was not acknowledged with the unchanged ID, got: %s, want: %s", elapsed+interval, got, want)
+			}
+			acks++
+		}
+		if acks != wantAcks {
+			t.Fatalf("after %s: did not get expected number of election ID acknowledgements, got: %d, want: %d", elapsed+interval, acks, wantAcks)
+		}
+
+		gr, err := c.Get().
+			WithNetworkInstance(defaultNetworkInstanceName).
+			WithAFT(fluent.IPv4).
+			Send()
+		if err != nil {
+			t.Fatalf("after %s: got unexpected error from get, got: %v", elapsed+interval, err)
+		}
+		getResponseHasIPv4Prefixes(t, gr, defaultNetworkInstanceName, prefixes)
+	}
+
+	// The client must still be the master, such that it can program entries.
+	const added = "192.0.2.0/24"
+	c.Modify().AddEntry(t, fluent.IPv4Entry().WithNetworkInstance(defaultNetworkInstanceName).WithPrefix(added).WithNextHopGroup(1))
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("could not program entry after re-advertisements, got err: %v", err)
+	}
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithIPv4Operation(added).
+			WithOperationType(constants.Add).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult(),
+		chk.IgnoreOperationID(),
+	)
+}
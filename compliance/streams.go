@@ -0,0 +1,172 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compliance
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/chk"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// secondModifyStreamRejected is an option that specifies that the server under
+// test rejects a second Modify stream that is opened on the same connection as
+// an active Modify stream.
+type secondModifyStreamRejected struct{}
+
+// IsTestOpt marks secondModifyStreamRejected as implementing the TestOpt interface.
+func (*secondModifyStreamRejected) IsTestOpt() {}
+
+// SecondModifyStreamRejected specifies that the server under test rejects a
+// second Modify stream opened on the same connection as an active Modify stream
+// with the FAILED_PRECONDITION code. When it is not specified, the server is
+// expected to treat the second stream as an independent session.
+func SecondModifyStreamRejected() *secondModifyStreamRejected {
+	return &secondModifyStreamRejected{}
+}
+
+// SecondModifyStream opens a Modify stream using the client c, and subsequently
+// opens a second Modify stream on the same connection, on which it negotiates the
+// session parameters and election ID, and sends an ADD for a next-hop.
+//
+// If the SecondModifyStreamRejected option is specified, it validates that the
+// second stream is rejected with the FAILED_PRECONDITION code, and that the first
+// stream can still be used to program entries. Otherwise, it validates that the
+// second stream is treated as an independent session - such that it becomes the
+// primary client, since it uses a higher election ID, and the next-hop is
+// programmed.
+func SecondModifyStream(c *fluent.GRIBIClient, t testing.TB, opts ...TestOpt) {
+	defer flushServer(c, t)
+	defer electionID.Add(2)
+
+	var reject bool
+	for _, o := range opts {
+		if _, ok := o.(*secondModifyStreamRejected); ok {
+			reject = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	c.Connection().WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(electionID.Load(), 0).WithPersistence()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+	if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+		t.Fatalf("got unexpected error on client, %v", err)
+	}
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithSuccessfulSessionParams().
+			AsResult(),
+	)
+
+	ms := c.RawModifyStream(ctx, t)
+	defer ms.CloseSend()
+
+	// exchange sends req on the second stream, and returns the next response that
+	// is received.
+	exchange := func(req *spb.ModifyRequest) (*spb.ModifyResponse, error) {
+		if err := ms.Send(req); err != nil {
+			// An error sending is reported by the subsequent Recv.
+			t.Logf("cannot send %s on second Modify stream, %v", req, err)
+		}
+		return ms.Recv()
+	}
+
+	params := &spb.ModifyRequest{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+			AckType:     spb.SessionParameters_RIB_ACK,
+		},
+	}
+
+	if reject {
+		_, err := exchange(params)
+		if got := status.Code(err); got != codes.FailedPrecondition {
+			t.Fatalf("did not get expected error on second Modify stream, got: %v, want code: %s", err, codes.FailedPrecondition)
+		}
+
+		// The first stream is unaffected by the rejected stream.
+		c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(defaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+		if err := awaitTimeout(ctx, c, t, time.Minute); err != nil {
+			t.Fatalf("got unexpected error on client, %v", err)
+		}
+		chk.HasResult(t, c.Results(t),
+			fluent.OperationResult().
+				WithNextHopOperation(1).
+				WithOperationType(constants.Add).
+				WithProgrammingResult(fluent.InstalledInRIB).
+				AsResult(),
+			chk.IgnoreOperationID(),
+		)
+		return
+	}
+
+	res, err := exchange(params)
+	switch {
+	case err != nil:
+		t.Fatalf("cannot negotiate session parameters on second Modify stream, %v", err)
+	case res.GetSessionParamsResult().GetStatus() != spb.SessionParametersResult_OK:
+		t.Fatalf("did not get successful session parameters on second Modify stream, got: %s", res)
+	}
+
+	elecID := &spb.Uint128{Low: electionID.Load() + 1}
+	if res, err = exchange(&spb.ModifyRequest{ElectionId: elecID}); err != nil {
+		t.Fatalf("cannot send election ID on second Modify stream, %v", err)
+	}
+	if got := res.GetElectionId(); got.GetLow() != elecID.GetLow() || got.GetHigh() != elecID.GetHigh() {
+		t.Fatalf("did not get expected election ID on second Modify stream, got: %s, want: %s", got, elecID)
+	}
+
+	op, err := fluent.NextHopEntry().
+		WithNetworkInstance(defaultNetworkInstanceName).
+		WithIndex(1).
+		WithIPAddress("192.0.2.1").
+		WithOperationID(1).
+		WithElectionID(elecID.GetLow(), elecID.GetHigh()).
+		OpProto()
+	if err != nil {
+		t.Fatalf("cannot build operation, %v", err)
+	}
+	op.Op = spb.AFTOperation_ADD
+	if err := ms.Send(&spb.ModifyRequest{Operation: []*spb.AFTOperation{op}}); err != nil {
+		t.Fatalf("cannot send operation on second Modify stream, %v", err)
+	}
+	for {
+		res, err := ms.Recv()
+		if err != nil {
+			t.Fatalf("did not get result for operation on second Modify stream, %v", err)
+		}
+		for _, r := range res.GetResult() {
+			if r.GetId() != op.GetId() {
+				continue
+			}
+			if r.GetStatus() != spb.AFTResult_RIB_PROGRAMMED {
+				t.Fatalf("did not get expected result for operation on second Modify stream, got: %s, want: %s", r.GetStatus(), spb.AFTResult_RIB_PROGRAMMED)
+			}
+			return
+		}
+	}
+}
@@ -73,27 +73,31 @@ const (
 	MPLS
 	// IPv6 speciifes the IPv6 AFT.
 	IPv6
+	// PolicyForwarding specifies the policy-forwarding AFT.
+	PolicyForwarding
 )
 
 func (a AFT) String() string {
 	return map[AFT]string{
-		All:          "ALL",
-		IPv4:         "IPv4",
-		NextHop:      "NextHop",
-		NextHopGroup: "NextHopGroup",
-		MPLS:         "MPLS",
-		IPv6:         "IPv6",
+		All:              "ALL",
+		IPv4:             "IPv4",
+		NextHop:          "NextHop",
+		NextHopGroup:     "NextHopGroup",
+		MPLS:             "MPLS",
+		IPv6:             "IPv6",
+		PolicyForwarding: "PolicyForwarding",
 	}[a]
 }
 
 // aftMap maps between an AFT enumerated type and the specified type in the
 // gRIBI protobuf.
 var aftMap = map[AFT]spb.AFTType{
-	All:          spb.AFTType_ALL,
-	IPv4:         spb.AFTType_IPV4,
-	IPv6:         spb.AFTType_IPV6,
-	NextHop:      spb.AFTType_NEXTHOP,
-	NextHopGroup: spb.AFTType_NEXTHOP_GROUP,
+	All:              spb.AFTType_ALL,
+	IPv4:             spb.AFTType_IPV4,
+	IPv6:             spb.AFTType_IPV6,
+	NextHop:          spb.AFTType_NEXTHOP,
+	NextHopGroup:     spb.AFTType_NEXTHOP_GROUP,
+	PolicyForwarding: spb.AFTType_POLICY_FORWARDING,
 }
 
 // AFTTypeFromAFT returns the gRIBI AFTType from the enumerated AFT type.
@@ -0,0 +1,147 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// expectTimeout is the maximum time for which ExpectRIBProgrammed and
+// ExpectFIBProgrammed wait for the results of operations.
+const expectTimeout = time.Minute
+
+// ExpectRIBProgrammed blocks until each operation within the ModifyRequest that
+// was most recently created using the receiver has received a result, and reports
+// an error to t for each operation that was not programmed in the RIB. The test is
+// failed immediately if the results cannot be awaited - for example, since the
+// client is not connected, or a minute elapses before all results are received.
+//
+// It can be chained with the method that created the ModifyRequest, for example:
+//
+//	c.Modify().AddEntry(t, entries...).ExpectRIBProgrammed(t)
+func (g *gRIBIModify) ExpectRIBProgrammed(t testing.TB) *gRIBIModify {
+	t.Helper()
+	g.expect(t, false)
+	return g
+}
+
+// ExpectFIBProgrammed blocks until each operation within the ModifyRequest that
+// was most recently created using the receiver has received a result indicating
+// whether it was programmed in the FIB, or that it failed, and reports an error to
+// t for each operation that was not programmed in the FIB. Since FIB results are
+// only sent when they are negotiated for the session, the test is failed
+// immediately if the client did not request the RIBFIBAck acknowledgement mode,
+// or if the results cannot be awaited as per ExpectRIBProgrammed.
+func (g *gRIBIModify) ExpectFIBProgrammed(t testing.TB) *gRIBIModify {
+	t.Helper()
+	g.expect(t, true)
+	return g
+}
+
+// expect waits for the results of the operations within the last ModifyRequest
+// that was created using the receiver, and reports an error to t for each
+// operation whose final result is not successful. If fib is true, an operation is
+// only successful if it was programmed in the FIB.
+func (g *gRIBIModify) expect(t testing.TB, fib bool) {
+	t.Helper()
+	if g.parent.c == nil {
+		t.Fatalf("cannot check results of operations, client is not connected")
+	}
+	if len(g.reqs) == 0 {
+		t.Fatalf("cannot check results of operations, no ModifyRequest has been created")
+	}
+
+	b := &gRIBIBatch{parent: g.parent}
+	for _, o := range g.reqs[len(g.reqs)-1].GetOperation() {
+		b.ops = append(b.ops, batchOp{id: o.GetId(), details: opDetails(o)})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), expectTimeout)
+	defer cancel()
+	var err error
+	switch {
+	case fib:
+		err = b.WaitForFIBACKs(ctx)
+	default:
+		err = b.WaitForAllACKs(ctx)
+	}
+	if err != nil {
+		t.Fatalf("cannot wait for results of operations, %v", err)
+	}
+
+	for _, o := range b.BatchResult(t).Operations {
+		got := o.Result.ProgrammingResult
+		switch {
+		case fib && got != spb.AFTResult_FIB_PROGRAMMED:
+			t.Errorf("operation %d was not programmed in the FIB, got: %s, want: %s", o.ID, got, spb.AFTResult_FIB_PROGRAMMED)
+		case !fib && got == spb.AFTResult_FAILED:
+			t.Errorf("operation %d was not programmed in the RIB, got: %s, want: %s", o.ID, got, spb.AFTResult_RIB_PROGRAMMED)
+		}
+	}
+}
+
+// ExpectedIPv4 returns the AFTEntry that the Get RPC is expected to return for an
+// IPv4 entry for prefix within network instance ni, which references the
+// next-hop-group with ID nhg within the same network instance. It can be
+// compared with a received entry using chk.AFTEntryDiff.
+func ExpectedIPv4(prefix string, nhg uint64, ni string) *spb.AFTEntry {
+	return mustEntryProto(IPv4Entry().WithPrefix(prefix).WithNextHopGroup(nhg).WithNetworkInstance(ni))
+}
+
+// ExpectedIPv6 returns the AFTEntry that the Get RPC is expected to return for an
+// IPv6 entry, as described for ExpectedIPv4.
+func ExpectedIPv6(prefix string, nhg uint64, ni string) *spb.AFTEntry {
+	return mustEntryProto(IPv6Entry().WithPrefix(prefix).WithNextHopGroup(nhg).WithNetworkInstance(ni))
+}
+
+// ExpectedNextHopGroup returns the AFTEntry that the Get RPC is expected to return
+// for the next-hop-group with the specified id within network instance ni. The
+// nhs map is keyed by the index of each next-hop within the group, with the value
+// being its weight, and the next-hops are included in ascending index order.
+func ExpectedNextHopGroup(id uint64, nhs map[uint64]uint64, ni string) *spb.AFTEntry {
+	idx := []uint64{}
+	for i := range nhs {
+		idx = append(idx, i)
+	}
+	sort.Slice(idx, func(i, j int) bool { return idx[i] < idx[j] })
+	e := NextHopGroupEntry().WithID(id).WithNetworkInstance(ni)
+	for _, i := range idx {
+		e.AddNextHop(i, nhs[i])
+	}
+	return mustEntryProto(e)
+}
+
+// ExpectedNextHop returns the AFTEntry that the Get RPC is expected to return for
+// the next-hop with the specified index and IP address within network instance
+// ni.
+func ExpectedNextHop(index uint64, addr, ni string) *spb.AFTEntry {
+	return mustEntryProto(NextHopEntry().WithIndex(index).WithIPAddress(addr).WithNetworkInstance(ni))
+}
+
+// mustEntryProto returns the AFTEntry built from e. The entries built by the
+// Expected helpers cannot fail to be converted, and hence it panics on error.
+func mustEntryProto(e GRIBIEntry) *spb.AFTEntry {
+	p, err := e.EntryProto()
+	if err != nil {
+		panic(fmt.Sprintf("cannot build AFTEntry, %v", err))
+	}
+	return p
+}
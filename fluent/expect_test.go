@@ -0,0 +1,105 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/openconfig/gribigo/rib"
+	"github.com/openconfig/gribigo/server"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestExpectProgrammed(t *testing.T) {
+	// failFIB is a RIB event hook that fails to program each entry in the FIB.
+	failFIB := func(e rib.RIBEvent) error {
+		e.Done(errors.New("injected FIB failure"))
+		return nil
+	}
+
+	tests := []struct {
+		desc string
+		// inServerOpts are the options used to create the server.
+		inServerOpts []server.ServerOpt
+		inAckType    AckType
+		// inNetworkInstance is the network instance of the entry that is added.
+		inNetworkInstance string
+		// inFIB specifies that ExpectFIBProgrammed is used, rather than
+		// ExpectRIBProgrammed.
+		inFIB bool
+		// wantErrSub is a substring of the error that is expected to be
+		// reported to the test, no error is expected if it is empty.
+		wantErrSub string
+	}{{
+		desc:              "RIB programmed",
+		inAckType:         RIBAck,
+		inNetworkInstance: server.DefaultNetworkInstanceName,
+	}, {
+		desc:              "RIB failure",
+		inAckType:         RIBAck,
+		inNetworkInstance: "unknown",
+		wantErrSub:        "operation 1 was not programmed in the RIB",
+	}, {
+		desc:              "FIB programmed",
+		inAckType:         RIBFIBAck,
+		inNetworkInstance: server.DefaultNetworkInstanceName,
+		inFIB:             true,
+	}, {
+		desc:              "FIB failure",
+		inServerOpts:      []server.ServerOpt{server.WithRIBEventHook(failFIB)},
+		inAckType:         RIBFIBAck,
+		inNetworkInstance: server.DefaultNetworkInstanceName,
+		inFIB:             true,
+		wantErrSub:        "operation 1 was not programmed in the FIB",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := server.NewInProcess(tt.inServerOpts...)
+			if err != nil {
+				t.Fatalf("cannot start in-process server, %v", err)
+			}
+			defer s.Stop()
+
+			c := NewClient()
+			c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence().WithAckType(tt.inAckType)
+			c.Start(context.Background(), t)
+			defer c.Stop(t)
+			c.StartSending(context.Background(), t)
+
+			// The assertion reports errors to rt, such that failures can be
+			// validated without failing this test.
+			rt := &recordingTB{TB: t}
+			m := c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(tt.inNetworkInstance).WithIndex(1).WithIPAddress("192.0.2.1"))
+			switch {
+			case tt.inFIB:
+				m.ExpectFIBProgrammed(rt)
+			default:
+				m.ExpectRIBProgrammed(rt)
+			}
+
+			switch {
+			case tt.wantErrSub == "" && len(rt.errs) != 0:
+				t.Fatalf("got unexpected errors, %v", rt.errs)
+			case tt.wantErrSub != "" && (len(rt.errs) != 1 || !strings.Contains(rt.errs[0], tt.wantErrSub)):
+				t.Fatalf("did not get expected error, got: %v, want substring: %s", rt.errs, tt.wantErrSub)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// probeNetworkInstance is the name of the network instance that is used by the
+// requests that probe the features of the server. It is not expected to exist
+// on the server, such that the requests do not return or remove any entries.
+const probeNetworkInstance = "__gribigo_feature_probe__"
+
+// ServerFeatures describes the features of the gRIBI protocol that are supported
+// by the server that the client is connected to.
+type ServerFeatures struct {
+	// SupportsFlush indicates that the server implements the Flush RPC.
+	SupportsFlush bool
+	// SupportsIPv6 indicates that the server supports the IPv6 AFT.
+	SupportsIPv6 bool
+	// SupportsForwardReferences indicates that the server accepts entries that
+	// reference entries that have not yet been installed, holding them until
+	// the references are resolved. When it is not set, a set of entries that
+	// are modified together is not sent if an entry references a next-hop or
+	// next-hop-group that is added by a subsequent entry within the set.
+	SupportsForwardReferences bool
+}
+
+// allFeatures is the set of features that is assumed to be supported by a server
+// when the features have not been declared or probed.
+var allFeatures = ServerFeatures{
+	SupportsFlush:             true,
+	SupportsIPv6:              true,
+	SupportsForwardReferences: true,
+}
+
+// ErrUnsupportedByServer is the error that is returned when a request is not sent
+// to the server since it uses a feature that the server does not support.
+type ErrUnsupportedByServer struct {
+	// Feature is the name of the feature that is not supported.
+	Feature string
+}
+
+// Error implements the error interface.
+func (e *ErrUnsupportedByServer) Error() string {
+	return fmt.Sprintf("%s is not supported by the server", e.Feature)
+}
+
+// WithServerFeatures declares the features that are supported by the server, such
+// that requests that use unsupported features return an ErrUnsupportedByServer
+// error rather than being sent. Features that are determined by WithFeatureProbe
+// take precedence over those that are declared.
+func (g *gRIBIConnection) WithServerFeatures(f ServerFeatures) *gRIBIConnection {
+	g.features = &f
+	return g
+}
+
+// WithFeatureProbe specifies that the features supported by the server should be
+// determined when the client is started. Since gRIBI does not define a service
+// through which a server advertises its capabilities, the features are inferred
+// from the server's response to requests that reference a network instance that
+// does not exist - a server that responds with an Unimplemented status does not
+// support the feature. Support for forward references cannot be inferred in this
+// way, and is taken from WithServerFeatures if specified.
+func (g *gRIBIConnection) WithFeatureProbe() *gRIBIConnection {
+	g.probeFeatures = true
+	return g
+}
+
+// ServerFeatures returns the features that are supported by the server. Where the
+// features were not declared using WithServerFeatures, or probed when the client
+// was started using WithFeatureProbe, all features are assumed to be supported.
+func (g *GRIBIClient) ServerFeatures() ServerFeatures {
+	switch {
+	case g.features != nil:
+		return *g.features
+	case g.connection != nil && g.connection.features != nil:
+		return *g.connection.features
+	default:
+		return allFeatures
+	}
+}
+
+// probe determines the features of the server by sending requests to it using
+// the client's context, starting from the features that were declared.
+func (g *GRIBIClient) probe() ServerFeatures {
+	f := allFeatures
+	if g.connection.features != nil {
+		f = *g.connection.features
+	}
+
+	flush := &spb.FlushRequest{
+		NetworkInstance: &spb.FlushRequest_Name{Name: probeNetworkInstance},
+	}
+	if g.connection.redundMode == ElectedPrimaryClient {
+		flush.Election = &spb.FlushRequest_Override{Override: &spb.Empty{}}
+	}
+	_, err := g.c.Flush(g.ctx, flush)
+	f.SupportsFlush = !isUnimplemented(err)
+
+	_, err = g.c.Get(g.ctx, &spb.GetRequest{
+		NetworkInstance: &spb.GetRequest_Name{Name: probeNetworkInstance},
+		Aft:             spb.AFTType_IPV6,
+	})
+	f.SupportsIPv6 = !isUnimplemented(err)
+
+	log.V(2).Infof("probed server features, %+v", f)
+	return f
+}
+
+// isUnimplemented returns true if err indicates that the server does not
+// implement the request that was made.
+func isUnimplemented(err error) bool {
+	return status.Code(err) == codes.Unimplemented
+}
+
+// checkEntryFeatures returns an ErrUnsupportedByServer error if the operation op
+// uses a feature that is not supported by the server.
+func (g *GRIBIClient) checkEntryFeatures(op *spb.AFTOperation) error {
+	if _, ok := op.GetEntry().(*spb.AFTOperation_Ipv6); ok && !g.ServerFeatures().SupportsIPv6 {
+		return &ErrUnsupportedByServer{Feature: "IPv6 AFT"}
+	}
+	return nil
+}
+
+// refKey is the key of a next-hop or next-hop-group that may be referenced by
+// an entry.
+type refKey struct {
+	// ni is the network instance of the entry.
+	ni string
+	// nhg indicates that the entry is a next-hop-group, rather than a
+	// next-hop.
+	nhg bool
+	// id is the index of the next-hop, or the ID of the next-hop-group.
+	id uint64
+}
+
+// checkForwardReferences returns an ErrUnsupportedByServer error if the server
+// does not support forward references, and an operation within ops - which are to
+// be sent in order - references a next-hop or next-hop-group that is added or
+// replaced by a subsequent operation within ops.
+func (g *GRIBIClient) checkForwardReferences(ops []*spb.AFTOperation) error {
+	if g.ServerFeatures().SupportsForwardReferences {
+		return nil
+	}
+	// The operations are checked in reverse order, such that later stores the
+	// entries that are programmed by the operations after the one being checked.
+	later := map[refKey]bool{}
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		if op.GetOp() == spb.AFTOperation_DELETE {
+			continue
+		}
+		for _, r := range opReferences(op) {
+			if later[r] {
+				return &ErrUnsupportedByServer{Feature: fmt.Sprintf("forward reference from operation %d", op.GetId())}
+			}
+		}
+		switch e := op.GetEntry().(type) {
+		case *spb.AFTOperation_NextHop:
+			later[refKey{ni: op.GetNetworkInstance(), id: e.NextHop.GetIndex()}] = true
+		case *spb.AFTOperation_NextHopGroup:
+			later[refKey{ni: op.GetNetworkInstance(), nhg: true, id: e.NextHopGroup.GetId()}] = true
+		}
+	}
+	return nil
+}
+
+// opReferences returns the keys of the next-hops and next-hop-groups that are
+// referenced by the entry within the operation op.
+func opReferences(op *spb.AFTOperation) []refKey {
+	ni := op.GetNetworkInstance()
+	nhg := func(refNI string, id uint64) []refKey {
+		if id == 0 {
+			return nil
+		}
+		if refNI == "" {
+			refNI = ni
+		}
+		return []refKey{{ni: refNI, nhg: true, id: id}}
+	}
+
+	switch e := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		v := e.Ipv4.GetIpv4Entry()
+		return nhg(v.GetNextHopGroupNetworkInstance().GetValue(), v.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_Ipv6:
+		v := e.Ipv6.GetIpv6Entry()
+		return nhg(v.GetNextHopGroupNetworkInstance().GetValue(), v.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_Mpls:
+		v := e.Mpls.GetLabelEntry()
+		return nhg(v.GetNextHopGroupNetworkInstance().GetValue(), v.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		v := e.PolicyForwardingEntry.GetPolicyForwardingEntry()
+		return nhg(v.GetNextHopGroupNetworkInstance().GetValue(), v.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_NextHopGroup:
+		v := e.NextHopGroup.GetNextHopGroup()
+		refs := nhg("", v.GetBackupNextHopGroup().GetValue())
+		for _, nh := range v.GetNextHop() {
+			refs = append(refs, refKey{ni: ni, id: nh.GetIndex()})
+		}
+		return refs
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/server"
+	"github.com/openconfig/testt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// limitedServer is a gRIBI server that does not implement the Flush RPC, or the
+// IPv6 AFT within the Get RPC.
+type limitedServer struct {
+	*server.Server
+}
+
+// Flush implements the gRIBI Flush RPC, returning an Unimplemented error.
+func (*limitedServer) Flush(context.Context, *spb.FlushRequest) (*spb.FlushResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "Flush is not implemented")
+}
+
+// Get implements the gRIBI Get RPC, returning an Unimplemented error for the
+// IPv6 AFT.
+func (s *limitedServer) Get(req *spb.GetRequest, stream spb.GRIBI_GetServer) error {
+	if req.GetAft() == spb.AFTType_IPV6 {
+		return status.Errorf(codes.Unimplemented, "IPv6 is not implemented")
+	}
+	return s.Server.Get(req, stream)
+}
+
+// startServer serves srv on an in-memory listener, returning a stub that is
+// connected to it.
+func startServer(t *testing.T, srv spb.GRIBIServer) spb.GRIBIClient {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	gs := grpc.NewServer()
+	spb.RegisterGRIBIServer(gs, srv)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("cannot connect to server, %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return spb.NewGRIBIClient(conn)
+}
+
+func TestServerFeatures(t *testing.T) {
+	s, err := server.New()
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+
+	tests := []struct {
+		desc         string
+		inServer     spb.GRIBIServer
+		inProbe      bool
+		inDeclared   *ServerFeatures
+		wantFeatures ServerFeatures
+	}{{
+		desc:         "fully-featured server, probed",
+		inServer:     s,
+		inProbe:      true,
+		wantFeatures: allFeatures,
+	}, {
+		desc:     "limited server, probed",
+		inServer: &limitedServer{s},
+		inProbe:  true,
+		wantFeatures: ServerFeatures{
+			SupportsForwardReferences: true,
+		},
+	}, {
+		desc:         "limited server, not probed",
+		inServer:     &limitedServer{s},
+		wantFeatures: allFeatures,
+	}, {
+		desc:       "declared features",
+		inServer:   s,
+		inDeclared: &ServerFeatures{SupportsFlush: true},
+		wantFeatures: ServerFeatures{
+			SupportsFlush: true,
+		},
+	}, {
+		desc:       "probed features take precedence over declared features",
+		inServer:   s,
+		inProbe:    true,
+		inDeclared: &ServerFeatures{},
+		wantFeatures: ServerFeatures{
+			SupportsFlush: true,
+			SupportsIPv6:  true,
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			c := NewClient()
+			c.Connection().WithStub(startServer(t, tt.inServer)).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0)
+			if tt.inProbe {
+				c.Connection().WithFeatureProbe()
+			}
+			if tt.inDeclared != nil {
+				c.Connection().WithServerFeatures(*tt.inDeclared)
+			}
+			c.Start(context.Background(), t)
+			defer c.Stop(t)
+
+			if diff := cmp.Diff(c.ServerFeatures(), tt.wantFeatures); diff != "" {
+				t.Fatalf("did not get expected features, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestUnsupportedByServer(t *testing.T) {
+	s, err := server.New()
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	c := NewClient()
+	c.Connection().WithStub(startServer(t, &limitedServer{s})).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0).WithFeatureProbe()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+
+	var unsupported *ErrUnsupportedByServer
+	if _, err := c.Flush().WithElectionOverride().WithAllNetworkInstances().Send(); !errors.As(err, &unsupported) {
+		t.Errorf("did not get expected error for Flush, got: %v", err)
+	}
+	if _, err := c.Get().WithNetworkInstance(server.DefaultNetworkInstanceName).WithAFT(IPv6).Send(); !errors.As(err, &unsupported) {
+		t.Errorf("did not get expected error for IPv6 Get, got: %v", err)
+	}
+	if _, err := c.Get().WithNetworkInstance(server.DefaultNetworkInstanceName).WithAFT(IPv4).Send(); err != nil {
+		t.Errorf("got unexpected error for IPv4 Get, %v", err)
+	}
+
+	got := testt.ExpectFatal(t, func(t testing.TB) {
+		c.Modify().AddEntry(t, IPv6Entry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithPrefix("2001:db8::/32").WithNextHopGroup(1))
+	})
+	if want := "IPv6 AFT is not supported by the server"; !strings.Contains(got, want) {
+		t.Errorf("did not get expected fatal error for IPv6 entry, got: %s, want: %s", got, want)
+	}
+}
+
+func TestForwardReferencesUnsupportedByServer(t *testing.T) {
+	s, err := server.New(server.WithReferenceIntegrityCheck(true))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	c := NewClient()
+	c.Connection().WithStub(startServer(t, s)).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence().
+		WithServerFeatures(ServerFeatures{SupportsFlush: true, SupportsIPv6: true})
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+
+	nh := NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1")
+	nhg := NextHopGroupEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithID(1).AddNextHop(1, 1)
+
+	got := testt.ExpectFatal(t, func(t testing.TB) {
+		c.Modify().AddEntry(t, nhg, nh)
+	})
+	if want := "forward reference from operation 1 is not supported by the server"; !strings.Contains(got, want) {
+		t.Errorf("did not get expected fatal error for forward reference, got: %s, want: %s", got, want)
+	}
+
+	// Entries that only reference entries earlier within the set are sent.
+	c.Modify().AddEntry(t, nh, nhg)
+	c.StartSending(context.Background(), t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("cannot await client, %v", err)
+	}
+	for _, r := range c.Results(t) {
+		if r.ProgrammingResult == spb.AFTResult_FAILED {
+			t.Errorf("got unexpected failed result, %s", r)
+		}
+	}
+}
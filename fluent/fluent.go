@@ -20,12 +20,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	log "github.com/golang/glog"
 	"github.com/openconfig/gribigo/client"
 	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 
@@ -50,7 +56,24 @@ type GRIBIClient struct {
 	opCount uint64
 	// currentElectionID is the current electionID that the client should use.
 	currentElectionID *spb.Uint128
-}
+	// features are the features of the server that were probed when the
+	// client was started, nil if they were not probed.
+	features *ServerFeatures
+	// rawResponses is the channel to which ModifyResponses received from the
+	// server are written when raw response capture is enabled.
+	rawResponses chan *spb.ModifyResponse
+	// rawResponsesClosed indicates that rawResponses has been closed since
+	// the client was stopped.
+	rawResponsesClosed bool
+	// tracker records the results that have been checked by the test, it is
+	// nil unless WithFailOnUncheckedErrors is specified.
+	tracker *resultTracker
+}
+
+// rawResponseBufferSize is the number of ModifyResponse messages that are buffered
+// when raw response capture is enabled. Responses that are received when the
+// buffer is full are not captured, and are counted by RawResponsesDropped.
+const rawResponseBufferSize = 1000
 
 type gRIBIConnection struct {
 	// targetAddr stores the address that is to be dialed by the client.
@@ -70,6 +93,20 @@ type gRIBIConnection struct {
 	// fibACK indicates whether the client requests that the server sends
 	// a FIB ACK rather than a RIB ACK.
 	fibACK bool
+	// creds are the transport credentials used when dialing targetAddr, if
+	// nil, the client's default credentials are used.
+	creds credentials.TransportCredentials
+	// dialOpts are additional gRPC dial options used when dialing targetAddr.
+	dialOpts []grpc.DialOption
+	// features are the features that are declared to be supported by the
+	// server, nil if they were not declared.
+	features *ServerFeatures
+	// probeFeatures indicates whether the features of the server should be
+	// probed when the client is started.
+	probeFeatures bool
+	// msgLogger is called with each message that is sent or received on the
+	// Modify stream, if it is non-nil.
+	msgLogger func(Direction, proto.Message)
 
 	// parent is a pointer to the parent of the gRIBIConnection.
 	parent *GRIBIClient
@@ -109,6 +146,27 @@ func (g *gRIBIConnection) WithStub(stub spb.GRIBIClient) *gRIBIConnection {
 	return g
 }
 
+// WithTransportCredentials specifies the transport credentials that are used
+// when dialing the gRIBI target specified using WithTarget - for example, TLS
+// credentials that verify the server's certificate and present a client
+// certificate. It has no effect when a stub is specified using WithStub.
+func (g *gRIBIConnection) WithTransportCredentials(creds credentials.TransportCredentials) *gRIBIConnection {
+	g.creds = creds
+	return g
+}
+
+// WithDialOptions specifies additional gRPC dial options that are used when
+// dialing the gRIBI target specified using WithTarget - for example, interceptors
+// that add authentication tokens or tracing to each RPC. The options are
+// applied after the defaults and any transport credentials specified using
+// WithTransportCredentials, and hence take precedence over them. The connection
+// is owned by the client, and is closed when Stop is called. It has no effect
+// when a stub is specified using WithStub.
+func (g *gRIBIConnection) WithDialOptions(opts ...grpc.DialOption) *gRIBIConnection {
+	g.dialOpts = append(g.dialOpts, opts...)
+	return g
+}
+
 // WithPersistence specifies that the gRIBI server should maintain the RIB
 // state after the client disconnects.
 func (g *gRIBIConnection) WithPersistence() *gRIBIConnection {
@@ -117,12 +175,81 @@ func (g *gRIBIConnection) WithPersistence() *gRIBIConnection {
 }
 
 // WithFIBACK indicates that the gRIBI server should send an ACK after the
-// entry has been programmed into the FIB.
+// entry has been programmed into the FIB. It is equivalent to
+// WithAckType(RIBFIBAck).
 func (g *gRIBIConnection) WithFIBACK() *gRIBIConnection {
 	g.fibACK = true
 	return g
 }
 
+// AckType is a type used to indicate the acknowledgement modes supported in gRIBI.
+type AckType int64
+
+const (
+	_ AckType = iota
+	// RIBAck indicates that the server should acknowledge each operation once
+	// it has been programmed into the RIB.
+	RIBAck
+	// RIBFIBAck indicates that the server should acknowledge each operation once
+	// it has been programmed into the RIB, and subsequently once it has been
+	// programmed into the FIB.
+	RIBFIBAck
+)
+
+// WithAckType specifies the acknowledgement mode that is requested from the
+// server in the session parameters sent by the client. The acknowledgement mode
+// is negotiated once for the session, and cannot be changed for individual
+// operations.
+func (g *gRIBIConnection) WithAckType(a AckType) *gRIBIConnection {
+	g.fibACK = a == RIBFIBAck
+	return g
+}
+
+// WithRawResponseCapture specifies that each ModifyResponse that is received from
+// the server should be made available via the RawResponses channel of the client,
+// in addition to being processed into results as usual.
+func (g *gRIBIConnection) WithRawResponseCapture() *gRIBIConnection {
+	if g.parent.rawResponses == nil {
+		g.parent.rawResponses = make(chan *spb.ModifyResponse, rawResponseBufferSize)
+	}
+	return g
+}
+
+// Direction is a type used to indicate whether a message was sent to, or received
+// from, the server.
+type Direction int64
+
+const (
+	_ Direction = iota
+	// ToServer indicates that the message was sent to the server.
+	ToServer
+	// FromServer indicates that the message was received from the server.
+	FromServer
+)
+
+// String returns a human-readable name for the direction.
+func (d Direction) String() string {
+	switch d {
+	case ToServer:
+		return "SENT"
+	case FromServer:
+		return "RECEIVED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// WithMessageLogger specifies a function that is called with each ModifyRequest
+// that is sent to the server, and each ModifyResponse that is received from it,
+// along with the direction of the message. Requests are logged before they are
+// sent, such that a request is always logged before the responses to it. The
+// function is called from the goroutines that send and receive messages, and
+// hence should return promptly - for example, by writing the message to t.Log.
+func (g *gRIBIConnection) WithMessageLogger(fn func(dir Direction, msg proto.Message)) *gRIBIConnection {
+	g.msgLogger = fn
+	return g
+}
+
 // RedundancyMode is a type used to indicate the redundancy modes supported in gRIBI.
 type RedundancyMode int64
 
@@ -166,8 +293,15 @@ func (g *gRIBIConnection) WithInitialElectionID(low, high uint64) *gRIBIConnecti
 // testing.TB.
 func (g *GRIBIClient) Start(ctx context.Context, t testing.TB) {
 	t.Helper()
+	if err := g.start(ctx); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// start implements Start, returning an error if the client cannot be started.
+func (g *GRIBIClient) start(ctx context.Context) error {
 	if c := g.connection; c.targetAddr == "" && c.stub == nil {
-		t.Fatalf("cannot dial without specifying target address or stub")
+		return errors.New("cannot dial without specifying target address or stub")
 	}
 
 	opts := []client.Opt{}
@@ -176,7 +310,7 @@ func (g *GRIBIClient) Start(ctx context.Context, t testing.TB) {
 		opts = append(opts, client.AllPrimaryClients())
 	case ElectedPrimaryClient:
 		if g.connection.electionID == nil {
-			t.Fatalf("client must specify Election ID in elected primary mode")
+			return errors.New("client must specify Election ID in elected primary mode")
 		}
 		opts = append(opts, client.ElectedPrimaryClient(g.connection.electionID))
 	}
@@ -192,32 +326,132 @@ func (g *GRIBIClient) Start(ctx context.Context, t testing.TB) {
 	log.V(2).Infof("setting client parameters to %+v", opts)
 	c, err := client.New(opts...)
 	if err != nil {
-		t.Fatalf("cannot create new client, %v", err)
+		return fmt.Errorf("cannot create new client, %v", err)
 	}
 	g.c = c
 
+	if g.rawResponses != nil {
+		if g.rawResponsesClosed {
+			g.rawResponses = make(chan *spb.ModifyResponse, rawResponseBufferSize)
+			g.rawResponsesClosed = false
+		}
+		c.MirrorResponses(g.rawResponses)
+	}
+
+	if fn := g.connection.msgLogger; fn != nil {
+		c.ObserveMessages(
+			func(m *spb.ModifyRequest) { fn(ToServer, m) },
+			func(m *spb.ModifyResponse) { fn(FromServer, m) },
+		)
+	}
+
 	if g.connection.stub != nil {
 		log.V(2).Infof("using stub %#v", g.connection.stub)
 		c.UseStub(g.connection.stub)
 	} else {
 		log.V(2).Infof("dialing %s", g.connection.targetAddr)
-		if err := c.Dial(ctx, g.connection.targetAddr); err != nil {
-			t.Fatalf("cannot dial target, %v", err)
+		dialOpts := []client.DialOpt{}
+		if g.connection.creds != nil {
+			dialOpts = append(dialOpts, client.WithTransportCredentials(g.connection.creds))
+		}
+		if len(g.connection.dialOpts) != 0 {
+			dialOpts = append(dialOpts, client.WithDialOptions(g.connection.dialOpts...))
+		}
+		if err := c.Dial(ctx, g.connection.targetAddr, dialOpts...); err != nil {
+			return fmt.Errorf("cannot dial target, %v", err)
 		}
 	}
 
 	g.ctx = ctx
+
+	g.features = nil
+	if g.connection.probeFeatures {
+		f := g.probe()
+		g.features = &f
+	}
+	return nil
+}
+
+// RawResponses returns a channel to which each ModifyResponse that is received
+// from the server is written, in the order in which it is received. The channel
+// is closed when the client is stopped. It returns nil if raw response capture
+// was not enabled using WithRawResponseCapture.
+//
+// If the channel is not read from, responses beyond the size of its buffer are
+// not written to it - RawResponsesDropped should be checked to ensure that
+// every response was captured.
+func (g *GRIBIClient) RawResponses() <-chan *spb.ModifyResponse {
+	return g.rawResponses
+}
+
+// RawResponsesDropped returns the number of ModifyResponses that were not written
+// to the RawResponses channel because its buffer was full.
+func (g *GRIBIClient) RawResponsesDropped() uint64 {
+	if g.c == nil {
+		return 0
+	}
+	return g.c.MirrorDropped()
+}
+
+// ClientStats is a snapshot of the counters of operations that have been sent by
+// the client, and the results that have been received for them.
+type ClientStats struct {
+	// Sent is the number of AFT operations that have been sent to the server.
+	Sent uint64
+	// RIBACKs is the number of RIB_PROGRAMMED results that have been received.
+	RIBACKs uint64
+	// FIBACKs is the number of FIB_PROGRAMMED results that have been received.
+	FIBACKs uint64
+	// Failed is the number of failed results that have been received.
+	Failed uint64
+	// Pending is the number of AFT operations for which no final result has
+	// been received.
+	Pending uint64
+}
+
+// Stats returns a snapshot of the counters of operations that have been sent by
+// the client since it was started, and the results that have been received for
+// them. It returns zero values if the client has not been started.
+func (g *GRIBIClient) Stats() ClientStats {
+	if g.c == nil {
+		return ClientStats{}
+	}
+	st := g.c.Stats()
+	return ClientStats{
+		Sent:    st.Sent,
+		RIBACKs: st.RIBACKs,
+		FIBACKs: st.FIBACKs,
+		Failed:  st.Failed,
+		Pending: st.Pending,
+	}
 }
 
 // Stop specifies that the gRIBI client should stop sending operations,
-// and subsequently disconnect from the server.
+// and subsequently disconnect from the server. If the client was created with
+// WithFailOnUncheckedErrors, the test t is failed if failed results have been
+// received that were not checked.
 func (g *GRIBIClient) Stop(t testing.TB) {
+	t.Helper()
+	g.stop()
+	if err := g.uncheckedFailures(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// stop implements Stop.
+func (g *GRIBIClient) stop() {
 	if g.c != nil {
 		g.c.StopSending()
 		if err := g.c.Close(); err != nil {
 			log.Infof("cannot disconnect from server, %v", err)
 		}
 	}
+	// The client no longer receives responses once it is closed, such that
+	// the raw response channel can be closed.
+	if g.rawResponses != nil && !g.rawResponsesClosed {
+		close(g.rawResponses)
+		g.rawResponsesClosed = true
+	}
 }
 
 // StartSending specifies that the Modify stream to the target should be made, and
@@ -225,10 +459,99 @@ func (g *GRIBIClient) Stop(t testing.TB) {
 // encountered is reported using the supplied testing.TB.
 func (g *GRIBIClient) StartSending(ctx context.Context, t testing.TB) {
 	t.Helper()
+	if err := g.startSending(ctx); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+// startSending implements StartSending, returning an error if the Modify stream
+// cannot be opened.
+func (g *GRIBIClient) startSending(ctx context.Context) error {
 	if err := g.c.Connect(ctx); err != nil {
-		t.Fatalf("cannot connect Modify request, %v", err)
+		return fmt.Errorf("cannot connect Modify request, %v", err)
 	}
 	g.c.StartSending()
+	return nil
+}
+
+// RawModifyStream opens a second Modify stream to the server on the same
+// connection as the client, such that tests can validate how the server handles
+// more than one Modify stream from a single client connection. The stream is not
+// managed by the client - messages must be sent and received on it directly, and
+// it is closed by cancelling ctx. The client must have been started. Any error
+// opening the stream is reported using the supplied testing.TB.
+func (g *GRIBIClient) RawModifyStream(ctx context.Context, t testing.TB) spb.GRIBI_ModifyClient {
+	t.Helper()
+	if g.c == nil {
+		t.Fatalf("cannot open a Modify stream on a client that has not been started")
+	}
+	s, err := g.c.OpenModifyStream(ctx)
+	if err != nil {
+		t.Fatalf("cannot open Modify stream, %v", err)
+	}
+	return s
+}
+
+// Reset returns the client to the state that it was in when it started sending,
+// such that it can be re-used between test cases without creating a new client.
+// The entries on the server are removed using a Flush of all network instances,
+// the queued and pending operations and the results received are cleared, the
+// operation ID counter and the election ID are reset to their initial values, and
+// a new Modify stream is opened, re-sending the session parameters.
+//
+// Since the server retains the highest election ID that it has received, a client
+// whose election ID was increased using UpdateElectionID is no longer the primary
+// after it is reset, and should update its election ID again.
+//
+// The Flush is only sent if the server supports it. If the client cannot be reset,
+// the underlying connection is closed and re-dialed, and an error is returned only
+// if the client cannot be reset on the new connection.
+func (g *GRIBIClient) Reset(ctx context.Context) error {
+	if g.c == nil {
+		return errors.New("cannot reset a client that has not been started")
+	}
+	err := g.reset(ctx)
+	if err == nil {
+		return nil
+	}
+	log.Infof("cannot reset client, re-dialing connection, %v", err)
+	if err := g.c.Close(); err != nil {
+		log.Infof("cannot disconnect from server, %v", err)
+	}
+	if err := g.start(ctx); err != nil {
+		return fmt.Errorf("cannot re-dial connection to reset client, %v", err)
+	}
+	if err := g.reset(ctx); err != nil {
+		return fmt.Errorf("cannot reset client, %v", err)
+	}
+	return nil
+}
+
+// reset implements Reset using the client's current connection.
+func (g *GRIBIClient) reset(ctx context.Context) error {
+	if g.ServerFeatures().SupportsFlush {
+		req := &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+		}
+		if g.connection.redundMode == ElectedPrimaryClient {
+			req.Election = &spb.FlushRequest_Override{Override: &spb.Empty{}}
+		}
+		if _, err := g.c.Flush(ctx, req); err != nil {
+			return fmt.Errorf("cannot flush server, %v", err)
+		}
+	}
+	return g.resetSession(ctx)
+}
+
+// resetSession clears the queued and pending operations and the results received
+// by the client, resets the operation ID counter and the election ID to their
+// initial values, and opens a new Modify stream. Unlike Reset, the entries on the
+// server are not removed.
+func (g *GRIBIClient) resetSession(ctx context.Context) error {
+	g.c.Reset()
+	g.opCount = 0
+	g.currentElectionID = g.connection.electionID
+	return g.startSending(ctx)
 }
 
 // Await waits until the underlying gRIBI client has completed its work to return -
@@ -253,6 +576,14 @@ func (g *GRIBIClient) Results(t testing.TB) []*client.OpResult {
 	return r
 }
 
+// ResultSummary returns a summary of the results of the AFT operations that
+// the client has received from the server. The summary is computed from the
+// current set of results each time it is called, such that it reflects results
+// (e.g., FIB ACKs) that are received after a call to Await.
+func (g *GRIBIClient) ResultSummary(t testing.TB) ResultSummary {
+	return SummariseResults(g.Results(t))
+}
+
 // Status returns the status of the client. It can be used to check whether there pending
 // operations or whether errors have occurred in the client.
 func (g *GRIBIClient) Status(t testing.TB) *client.ClientStatus {
@@ -313,16 +644,19 @@ const (
 	NextHop
 	// IPv6 references the IPv6Entry AFT.
 	IPv6
+	// PolicyForwarding references the PolicyForwardingEntry AFT.
+	PolicyForwarding
 )
 
 // aftMap provides mapping between the AFT enumerated type within the fluent
 // package and that within the gRIBI protobuf.
 var aftMap = map[AFT]spb.AFTType{
-	AllAFTs:      spb.AFTType_ALL,
-	IPv4:         spb.AFTType_IPV4,
-	NextHopGroup: spb.AFTType_NEXTHOP_GROUP,
-	NextHop:      spb.AFTType_NEXTHOP,
-	IPv6:         spb.AFTType_IPV6,
+	AllAFTs:          spb.AFTType_ALL,
+	IPv4:             spb.AFTType_IPV4,
+	NextHopGroup:     spb.AFTType_NEXTHOP_GROUP,
+	NextHop:          spb.AFTType_NEXTHOP,
+	IPv6:             spb.AFTType_IPV6,
+	PolicyForwarding: spb.AFTType_POLICY_FORWARDING,
 }
 
 // WithAFT specifies the AFT for which the Get request is made. The AllAFTs
@@ -332,8 +666,13 @@ func (g *gRIBIGet) WithAFT(a AFT) *gRIBIGet {
 	return g
 }
 
-// Send issues Get RPC to the target and returns the results.
+// Send issues Get RPC to the target and returns the results. It returns an
+// ErrUnsupportedByServer error if the requested AFT is not supported by the
+// server.
 func (g *gRIBIGet) Send() (*spb.GetResponse, error) {
+	if g.pb.GetAft() == spb.AFTType_IPV6 && !g.parent.ServerFeatures().SupportsIPv6 {
+		return nil, &ErrUnsupportedByServer{Feature: "IPv6 AFT"}
+	}
 	return g.parent.c.Get(g.parent.ctx, g.pb)
 }
 
@@ -397,12 +736,20 @@ func (g *gRIBIFlush) WithAllNetworkInstances() *gRIBIFlush {
 	return g
 }
 
-// Send sends the flush operation to the device.
+// Send sends the flush operation to the device. It returns an ErrUnsupportedByServer
+// error if the server does not support the Flush RPC.
 func (g *gRIBIFlush) Send() (*spb.FlushResponse, error) {
+	if !g.parent.ServerFeatures().SupportsFlush {
+		return nil, &ErrUnsupportedByServer{Feature: "Flush RPC"}
+	}
 	return g.parent.c.Flush(g.parent.ctx, g.pb)
 }
 
 // Modify wraps methods that trigger operations within the gRIBI Modify RPC.
+//
+// If the client has not been started, the ModifyRequests that are created are
+// not sent, and can instead be retrieved using Build - allowing requests to be
+// constructed and validated without a connection to a server.
 func (g *GRIBIClient) Modify() *gRIBIModify {
 	return &gRIBIModify{parent: g}
 }
@@ -411,6 +758,43 @@ func (g *GRIBIClient) Modify() *gRIBIModify {
 type gRIBIModify struct {
 	// parent is a pointer to the parent of the gRIBI modify.
 	parent *GRIBIClient
+	// reqs is the set of ModifyRequests that have been created, in the order
+	// in which they were created.
+	reqs []*spb.ModifyRequest
+	// errs is the set of errors encountered creating ModifyRequests whilst
+	// the client is not connected.
+	errs []error
+}
+
+// Build returns the ModifyRequests that have been created using the receiver,
+// in the order in which they were created, with operation IDs and election IDs
+// populated as they would be when sent to the server. When the client has not
+// been started, entries that fail validation do not cause the test to fail, and
+// instead Build returns an error describing them.
+func (g *gRIBIModify) Build() ([]*spb.ModifyRequest, error) {
+	if err := errors.Join(g.errs...); err != nil {
+		return nil, fmt.Errorf("cannot build modify requests, %w", err)
+	}
+	return g.reqs, nil
+}
+
+// queue records the ModifyRequest m, and sends it to the server if the client is
+// connected. err is the error encountered creating m - if the client is connected,
+// the test is failed, otherwise the error is returned by Build.
+func (g *gRIBIModify) queue(t testing.TB, m *spb.ModifyRequest, err error) {
+	if g.parent.c == nil {
+		if err != nil {
+			g.errs = append(g.errs, err)
+			return
+		}
+		g.reqs = append(g.reqs, m)
+		return
+	}
+	if err != nil {
+		t.Fatalf("cannot build modify request: %v", err)
+	}
+	g.reqs = append(g.reqs, m)
+	g.parent.c.Q(m)
 }
 
 // InjectRequest injects a gRIBI ModifyRequest that is created by an external
@@ -418,45 +802,216 @@ type gRIBIModify struct {
 // It is intended to allow for invalid messages that the fluent library does not
 // allow the creation of to be sent to a server.
 func (g *gRIBIModify) InjectRequest(t testing.TB, m *spb.ModifyRequest) *gRIBIModify {
-	g.parent.c.Q(m)
+	g.queue(t, m, nil)
 	return g
 }
 
 // AddEntry creates an operation adding the set of entries specified to the server.
 func (g *gRIBIModify) AddEntry(t testing.TB, entries ...GRIBIEntry) *gRIBIModify {
 	m, err := g.entriesToModifyRequest(spb.AFTOperation_ADD, entries)
-	if err != nil {
-		t.Fatalf("cannot build modify request: %v", err)
-	}
-	g.parent.c.Q(m)
+	g.queue(t, m, err)
 	return g
 }
 
 // DeleteEntry creates an operation deleting the set of entries specified from the server.
 func (g *gRIBIModify) DeleteEntry(t testing.TB, entries ...GRIBIEntry) *gRIBIModify {
 	m, err := g.entriesToModifyRequest(spb.AFTOperation_DELETE, entries)
-	if err != nil {
-		t.Fatalf("cannot build modify request, %v", err)
-	}
-	g.parent.c.Q(m)
+	g.queue(t, m, err)
 	return g
 }
 
 // ReplaceEntry creates an operation replacing the set of entries specified on the server.
 func (g *gRIBIModify) ReplaceEntry(t testing.TB, entries ...GRIBIEntry) *gRIBIModify {
 	m, err := g.entriesToModifyRequest(spb.AFTOperation_REPLACE, entries)
+	g.queue(t, m, err)
+	return g
+}
+
+// AddBatch creates an operation adding the set of entries specified to the server
+// within a single ModifyRequest, using sequentially assigned operation IDs. It
+// returns a handle to the batch that can be used to wait for, and determine, the
+// outcome of the operations within it.
+func (g *gRIBIModify) AddBatch(t testing.TB, entries []GRIBIEntry) *gRIBIBatch {
+	m, err := g.entriesToModifyRequest(spb.AFTOperation_ADD, entries)
+	g.queue(t, m, err)
+	b := &gRIBIBatch{parent: g.parent}
+	for _, o := range m.GetOperation() {
+		b.ops = append(b.ops, batchOp{id: o.GetId(), details: opDetails(o)})
+	}
+	return b
+}
+
+// gRIBIBatch is a handle to a set of operations that were sent to the server
+// using AddBatch.
+type gRIBIBatch struct {
+	// parent is a pointer to the client that sent the batch.
+	parent *GRIBIClient
+	// ops is the set of operations within the batch, in the order in which
+	// they were sent.
+	ops []batchOp
+}
+
+// batchOp identifies an operation within a batch. Since operation IDs can be
+// reused, the details of the operation are used alongside the ID to identify
+// the results that correspond to it.
+type batchOp struct {
+	// id is the operation ID that was used for the operation.
+	id uint64
+	// details describes the entry that the operation referred to.
+	details client.OpDetailsResults
+}
+
+// opDetails returns the details of the AFT operation op in the form that they
+// are reported within the results received by the client.
+func opDetails(op *spb.AFTOperation) client.OpDetailsResults {
+	d := client.OpDetailsResults{
+		Type:            constants.OpFromAFTOp(op.GetOp()),
+		NetworkInstance: op.GetNetworkInstance(),
+	}
+	switch e := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		d.IPv4Prefix = e.Ipv4.GetPrefix()
+	case *spb.AFTOperation_Ipv6:
+		d.IPv6Prefix = e.Ipv6.GetPrefix()
+	case *spb.AFTOperation_Mpls:
+		d.MPLSLabel = e.Mpls.GetLabelUint64()
+	case *spb.AFTOperation_NextHopGroup:
+		d.NextHopGroupID = e.NextHopGroup.GetId()
+	case *spb.AFTOperation_NextHop:
+		d.NextHopIndex = e.NextHop.GetIndex()
+	}
+	return d
+}
+
+// matches returns true if the result r corresponds to the operation o.
+func (o batchOp) matches(r *client.OpResult) bool {
+	return r.OperationID == o.id && r.Details != nil && *r.Details == o.details
+}
+
+// WaitForAllACKs blocks until each operation within the batch has completed -
+// i.e., it has received a response from the server and is no longer pending.
+// It returns an error if the context expires before all operations are complete,
+// or if the client encounters an error.
+func (b *gRIBIBatch) WaitForAllACKs(ctx context.Context) error {
+	return b.wait(ctx, false)
+}
+
+// WaitForFIBACKs blocks until each operation within the batch has received a
+// result indicating whether it was programmed into the FIB, or a result
+// indicating that it failed. Since FIB ACKs are only sent by the server when
+// they are negotiated for the session, it returns an error if the client did
+// not request the RIBFIBAck acknowledgement mode. It also returns an error if
+// the context expires before all operations are complete, or if the client
+// encounters an error.
+func (b *gRIBIBatch) WaitForFIBACKs(ctx context.Context) error {
+	if c := b.parent.connection; c == nil || !c.fibACK {
+		return errors.New("cannot wait for FIB ACKs, RIB_AND_FIB_ACK was not negotiated for the session, specify WithAckType(RIBFIBAck)")
+	}
+	return b.wait(ctx, true)
+}
+
+// wait blocks until each operation within the batch has completed, as per
+// complete.
+func (b *gRIBIBatch) wait(ctx context.Context, fib bool) error {
+	for {
+		done, err := b.complete(fib)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(client.BusyLoopDelay):
+		}
+	}
+}
+
+// complete returns true if all operations within the batch have completed. If
+// fib is true, an operation is only complete once it has received a FIB result,
+// or has failed. It returns an error if the client has encountered errors.
+func (b *gRIBIBatch) complete(fib bool) (bool, error) {
+	st, err := b.parent.c.Status()
 	if err != nil {
-		t.Fatalf("cannot build modify request, %v", err)
+		return false, err
 	}
-	g.parent.c.Q(m)
-	return g
+	if len(st.SendErrs) != 0 || len(st.ReadErrs) != 0 {
+		return false, &client.ClientErr{Send: st.SendErrs, Recv: st.ReadErrs}
+	}
+
+	pending := map[uint64]bool{}
+	for _, p := range st.PendingTransactions {
+		if o, ok := p.(*client.PendingOp); ok {
+			pending[o.Op.GetId()] = true
+		}
+	}
+
+	for _, o := range b.ops {
+		// An operation that has not yet been sent is not pending, hence we
+		// also check that a result has been received.
+		if pending[o.id] || !b.hasResult(o, st.Results, fib) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// hasResult returns true if res contains a result for the operation o. If fib
+// is true, only results that indicate the outcome of FIB programming, or that
+// the operation failed, are considered.
+func (b *gRIBIBatch) hasResult(o batchOp, res []*client.OpResult, fib bool) bool {
+	for _, r := range res {
+		if !o.matches(r) {
+			continue
+		}
+		switch {
+		case !fib:
+			return true
+		case r.ProgrammingResult == spb.AFTResult_FIB_PROGRAMMED, r.ProgrammingResult == spb.AFTResult_FIB_FAILED, r.ProgrammingResult == spb.AFTResult_FAILED:
+			return true
+		}
+	}
+	return false
+}
+
+// BatchResult returns the outcome of each operation within the batch, based on
+// the results that the client has received at the time of the call.
+func (b *gRIBIBatch) BatchResult(t testing.TB) *BatchResult {
+	return b.batchResult(b.parent.Results(t))
+}
+
+// batchResult returns the outcome of each operation within the batch, based on
+// the results res received by the client.
+func (b *gRIBIBatch) batchResult(res []*client.OpResult) *BatchResult {
+	br := &BatchResult{}
+	for _, o := range b.ops {
+		var final *client.OpResult
+		for _, r := range res {
+			if !o.matches(r) {
+				continue
+			}
+			if b.parent.tracker != nil {
+				b.parent.tracker.mark(r)
+			}
+			if final == nil || resultRank[r.ProgrammingResult] > resultRank[final.ProgrammingResult] {
+				final = r
+			}
+		}
+		br.Operations = append(br.Operations, &BatchOperationResult{
+			ID:     o.id,
+			Result: final,
+		})
+	}
+	return br
 }
 
 // Enqueue adds the pre-formed set of ModifyRequests to the queue that are to be
 // sent by the client. The entries are not validated or modified.
 func (g *gRIBIModify) Enqueue(t testing.TB, entries ...*spb.ModifyRequest) *gRIBIModify {
 	for _, m := range entries {
-		g.parent.c.Q(m)
+		g.queue(t, m, nil)
 	}
 	return g
 }
@@ -469,7 +1024,7 @@ func (g *gRIBIModify) UpdateElectionID(t testing.TB, low, high uint64) *gRIBIMod
 		High: high,
 	}
 	g.parent.currentElectionID = eid
-	g.parent.c.Q(&spb.ModifyRequest{ElectionId: eid})
+	g.queue(t, &spb.ModifyRequest{ElectionId: eid}, nil)
 	return g
 }
 
@@ -483,20 +1038,24 @@ func (g *gRIBIModify) entriesToModifyRequest(op spb.AFTOperation_Operation, entr
 		}
 		ep.Op = op
 
-		// ID was unset, so use the library maintained count. Note, that clients
-		// should not use both explictly and manually specified IDs. To this end
-		// initially we do not allow this API to be used for anything other than
-		// automatically set values.
-		if ep.Id != 0 {
-			return nil, fmt.Errorf("cannot use explicitly set operation IDs for a message, got: %d, want: 0", ep.Id)
-		}
-
 		if g.parent == nil {
 			return nil, errors.New("invalid nil parent")
 		}
-		// increment before first use of the opCount so that we start at 1.
-		g.parent.opCount++
-		ep.Id = g.parent.opCount
+		if err := g.parent.checkEntryFeatures(ep); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case ep.Id == 0:
+			// ID was unset, so use the library maintained count, incrementing before
+			// first use of the opCount so that we start at 1.
+			g.parent.opCount++
+			ep.Id = g.parent.opCount
+		case ep.Id > g.parent.opCount:
+			// An explicit ID was specified, ensure that automatically allocated IDs
+			// continue from it such that they remain increasing.
+			g.parent.opCount = ep.Id
+		}
 
 		// If the election ID wasn't explicitly set then write the current one
 		// to the message if this is a client that requires it.
@@ -506,6 +1065,9 @@ func (g *gRIBIModify) entriesToModifyRequest(op spb.AFTOperation_Operation, entr
 
 		m.Operation = append(m.Operation, ep)
 	}
+	if err := g.parent.checkForwardReferences(m.Operation); err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
@@ -527,6 +1089,9 @@ type ipv4Entry struct {
 	// electionID is an explicit election ID to be used for an
 	// operation using the entry.
 	electionID *spb.Uint128
+	// opID is an explicit operation ID to be used for an operation
+	// using the entry.
+	opID uint64
 }
 
 // IPv4Entry returns a new gRIBI IPv4Entry builder.
@@ -583,11 +1148,23 @@ func (i *ipv4Entry) WithElectionID(low, high uint64) *ipv4Entry {
 	return i
 }
 
-// OpProto implements the gRIBIEntry interface, returning a gRIBI AFTOperation. ID
-// is explicitly not populated such that they can be populated by
-// the function (e.g., AddEntry) to which they are an argument.
+// WithOperationID specifies an explicit operation ID to be used for the
+// AFTOperation that uses the entry. If it is not specified, the ID is
+// allocated by the client.
+func (i *ipv4Entry) WithOperationID(id uint64) *ipv4Entry {
+	i.opID = id
+	return i
+}
+
+// OpProto implements the gRIBIEntry interface, returning a gRIBI AFTOperation. Unless
+// explicitly specified using WithOperationID, the ID is not populated such that it can
+// be populated by the function (e.g., AddEntry) to which the entry is an argument.
 func (i *ipv4Entry) OpProto() (*spb.AFTOperation, error) {
+	if err := checkPrefix(i.pb.GetPrefix(), true); err != nil {
+		return nil, err
+	}
 	return &spb.AFTOperation{
+		Id:              i.opID,
 		NetworkInstance: i.ni,
 		Entry: &spb.AFTOperation_Ipv4{
 			Ipv4: proto.Clone(i.pb).(*aftpb.Afts_Ipv4EntryKey),
@@ -596,6 +1173,23 @@ func (i *ipv4Entry) OpProto() (*spb.AFTOperation, error) {
 	}, nil
 }
 
+// checkPrefix returns an error if the prefix p, which is an IPv4 prefix if ipv4
+// is true and an IPv6 prefix otherwise, is not valid. An unset prefix is not
+// checked.
+func checkPrefix(p string, ipv4 bool) error {
+	if p == "" {
+		return nil
+	}
+	pfx, err := netip.ParsePrefix(p)
+	switch {
+	case err != nil:
+		return fmt.Errorf("invalid prefix %s, %v", p, err)
+	case pfx.Addr().Is4() != ipv4:
+		return fmt.Errorf("invalid prefix %s, incorrect address family", p)
+	}
+	return nil
+}
+
 // EntryProto implements the GRIBIEntry interface, building a gRIBI AFTEntry.
 func (i *ipv4Entry) EntryProto() (*spb.AFTEntry, error) {
 	return &spb.AFTEntry{
@@ -615,6 +1209,9 @@ type ipv6Entry struct {
 	// electionID is an explicit election ID to be used for an
 	// operation using the entry.
 	electionID *spb.Uint128
+	// opID is an explicit operation ID to be used for an operation
+	// using the entry.
+	opID uint64
 }
 
 // IPv6Entry returns a new gRIBI IPv6Entry builder.
@@ -671,11 +1268,23 @@ func (i *ipv6Entry) WithElectionID(low, high uint64) *ipv6Entry {
 	return i
 }
 
-// OpProto implements the gRIBIEntry interface, returning a gRIBI AFTOperation. ID
-// is explicitly not populated such that they can be populated by
-// the function (e.g., AddEntry) to which they are an argument.
+// WithOperationID specifies an explicit operation ID to be used for the
+// AFTOperation that uses the entry. If it is not specified, the ID is
+// allocated by the client.
+func (i *ipv6Entry) WithOperationID(id uint64) *ipv6Entry {
+	i.opID = id
+	return i
+}
+
+// OpProto implements the gRIBIEntry interface, returning a gRIBI AFTOperation. Unless
+// explicitly specified using WithOperationID, the ID is not populated such that it can
+// be populated by the function (e.g., AddEntry) to which the entry is an argument.
 func (i *ipv6Entry) OpProto() (*spb.AFTOperation, error) {
+	if err := checkPrefix(i.pb.GetPrefix(), false); err != nil {
+		return nil, err
+	}
 	return &spb.AFTOperation{
+		Id:              i.opID,
 		NetworkInstance: i.ni,
 		Entry: &spb.AFTOperation_Ipv6{
 			Ipv6: proto.Clone(i.pb).(*aftpb.Afts_Ipv6EntryKey),
@@ -704,6 +1313,9 @@ type labelEntry struct {
 	// electionID is the explicit electionID to be used when the MPLS
 	// entry is programmed.
 	electionID *spb.Uint128
+	// opID is an explicit operation ID to be used for an operation
+	// using the entry.
+	opID uint64
 }
 
 // LabelEntry returns a builder that can be used to define a MPLS label entry in
@@ -727,10 +1339,12 @@ func (l *labelEntry) EntryProto() (*spb.AFTEntry, error) {
 	}, nil
 }
 
-// OpProto implements the GRIBIEntry interface, returning a gRIBI AFTOperation. The
-// ID is explicitly not populated so it can be set by the caller.
+// OpProto implements the GRIBIEntry interface, returning a gRIBI AFTOperation. Unless
+// explicitly specified using WithOperationID, the ID is not populated so it can be set
+// by the caller.
 func (l *labelEntry) OpProto() (*spb.AFTOperation, error) {
 	return &spb.AFTOperation{
+		Id:              l.opID,
 		NetworkInstance: l.ni,
 		Entry: &spb.AFTOperation_Mpls{
 			Mpls: proto.Clone(l.pb).(*aftpb.Afts_LabelEntryKey),
@@ -780,6 +1394,14 @@ func (l *labelEntry) WithPoppedLabelStack(labels ...uint32) *labelEntry {
 	return l
 }
 
+// WithOperationID specifies an explicit operation ID to be used for the
+// AFTOperation that uses the entry. If it is not specified, the ID is
+// allocated by the client.
+func (l *labelEntry) WithOperationID(id uint64) *labelEntry {
+	l.opID = id
+	return l
+}
+
 // nextHopEntry is the internal representation of a next-hop Entry in gRIBI.
 type nextHopEntry struct {
 	// ni is the network instance that the next-hop entry is within.
@@ -790,6 +1412,9 @@ type nextHopEntry struct {
 	// electionID is an explicit electionID to be used when the next-hop entry
 	// is programmed.
 	electionID *spb.Uint128
+	// opID is an explicit operation ID to be used for an operation
+	// using the entry.
+	opID uint64
 }
 
 // NextHopEntry returns a builder that can be used to build up a NextHop within
@@ -935,13 +1560,22 @@ func (n *nextHopEntry) WithElectionID(low, high uint64) *nextHopEntry {
 	return n
 }
 
+// WithOperationID specifies an explicit operation ID to be used for the
+// AFTOperation that uses the entry. If it is not specified, the ID is
+// allocated by the client.
+func (n *nextHopEntry) WithOperationID(id uint64) *nextHopEntry {
+	n.opID = id
+	return n
+}
+
 // TODO(robjs): add additional NextHopEntry fields.
 
-// OpProto implements the GRIBIEntry interface, building a gRIBI AFTOperation. ID
-// and ElectionID are explicitly not populated such that they can be populated by
-// the function (e.g., AddEntry) to which they are an argument.
+// OpProto implements the GRIBIEntry interface, building a gRIBI AFTOperation. Unless
+// explicitly specified, ID and ElectionID are not populated such that they can be
+// populated by the function (e.g., AddEntry) to which they are an argument.
 func (n *nextHopEntry) OpProto() (*spb.AFTOperation, error) {
 	return &spb.AFTOperation{
+		Id:              n.opID,
 		NetworkInstance: n.ni,
 		Entry: &spb.AFTOperation_NextHop{
 			NextHop: proto.Clone(n.pb).(*aftpb.Afts_NextHopKey),
@@ -970,6 +1604,9 @@ type nextHopGroupEntry struct {
 	// electionID is the explicit election ID to be used when this entry is used
 	// in an AFTOperation.
 	electionID *spb.Uint128
+	// opID is an explicit operation ID to be used for an operation
+	// using the entry.
+	opID uint64
 }
 
 // NextHopGroupEntry returns a builder that can be used to build up a NextHopGroup within
@@ -1024,11 +1661,20 @@ func (n *nextHopGroupEntry) WithElectionID(low, high uint64) *nextHopGroupEntry
 	return n
 }
 
-// OpProto implements the GRIBIEntry interface, building a gRIBI AFTOperation. ID
-// and ElectionID are explicitly not populated such that they can be populated by
-// the function (e.g., AddEntry) to which they are an argument.
+// WithOperationID specifies an explicit operation ID to be used for the
+// AFTOperation that uses the entry. If it is not specified, the ID is
+// allocated by the client.
+func (n *nextHopGroupEntry) WithOperationID(id uint64) *nextHopGroupEntry {
+	n.opID = id
+	return n
+}
+
+// OpProto implements the GRIBIEntry interface, building a gRIBI AFTOperation. Unless
+// explicitly specified, ID and ElectionID are not populated such that they can be
+// populated by the function (e.g., AddEntry) to which they are an argument.
 func (n *nextHopGroupEntry) OpProto() (*spb.AFTOperation, error) {
 	return &spb.AFTOperation{
+		Id:              n.opID,
 		NetworkInstance: n.ni,
 		Entry: &spb.AFTOperation_NextHopGroup{
 			NextHopGroup: proto.Clone(n.pb).(*aftpb.Afts_NextHopGroupKey),
@@ -1047,6 +1693,138 @@ func (n *nextHopGroupEntry) EntryProto() (*spb.AFTEntry, error) {
 	}, nil
 }
 
+// policyForwardingEntry is the internal representation of a policy-forwarding
+// entry in gRIBI.
+type policyForwardingEntry struct {
+	// ni is the network instance that the policy-forwarding entry is within.
+	ni string
+	// pb is the AFT protobuf representing the policy-forwarding entry.
+	pb *aftpb.Afts_PolicyForwardingEntryKey
+
+	// electionID is an explicit electionID to be used when the
+	// policy-forwarding entry is programmed.
+	electionID *spb.Uint128
+	// opID is an explicit operation ID to be used for an operation
+	// using the entry.
+	opID uint64
+}
+
+// PolicyForwardingEntry returns a builder that can be used to define a
+// policy-forwarding (PBR) entry, which maps packets matching a set of header
+// fields to a next-hop-group.
+func PolicyForwardingEntry() *policyForwardingEntry {
+	return &policyForwardingEntry{
+		pb: &aftpb.Afts_PolicyForwardingEntryKey{
+			PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntry{},
+		},
+	}
+}
+
+// WithIndex specifies the index of the policy-forwarding entry, which is its
+// key within the AFT.
+func (p *policyForwardingEntry) WithIndex(i uint64) *policyForwardingEntry {
+	p.pb.Index = i
+	return p
+}
+
+// WithNetworkInstance specifies the network instance within which the
+// policy-forwarding entry is to be installed.
+func (p *policyForwardingEntry) WithNetworkInstance(ni string) *policyForwardingEntry {
+	p.ni = ni
+	return p
+}
+
+// WithIPv4Dst specifies the IPv4 prefix, in the form prefix/mask, that the
+// destination address of packets must be within to match the entry.
+func (p *policyForwardingEntry) WithIPv4Dst(pfx string) *policyForwardingEntry {
+	p.pb.PolicyForwardingEntry.IpPrefix = &wpb.StringValue{Value: pfx}
+	return p
+}
+
+// WithDSCP specifies the DSCP value that packets must have to match the entry.
+func (p *policyForwardingEntry) WithDSCP(v uint8) *policyForwardingEntry {
+	p.pb.PolicyForwardingEntry.IpDscp = &wpb.UintValue{Value: uint64(v)}
+	return p
+}
+
+// WithProtocol specifies the IP protocol number that packets must have to
+// match the entry.
+func (p *policyForwardingEntry) WithProtocol(v uint8) *policyForwardingEntry {
+	p.pb.PolicyForwardingEntry.IpProtocol = &aftpb.Afts_PolicyForwardingEntry_IpProtocolUint64{IpProtocolUint64: uint64(v)}
+	return p
+}
+
+// WithL4SrcPort specifies the layer 4 source port that packets must have to
+// match the entry.
+func (p *policyForwardingEntry) WithL4SrcPort(v uint16) *policyForwardingEntry {
+	p.pb.PolicyForwardingEntry.L4SrcPort = &wpb.UintValue{Value: uint64(v)}
+	return p
+}
+
+// WithL4DstPort specifies the layer 4 destination port that packets must have
+// to match the entry.
+func (p *policyForwardingEntry) WithL4DstPort(v uint16) *policyForwardingEntry {
+	p.pb.PolicyForwardingEntry.L4DstPort = &wpb.UintValue{Value: uint64(v)}
+	return p
+}
+
+// WithNextHopGroup specifies the next-hop-group that packets matching the entry
+// are forwarded to.
+func (p *policyForwardingEntry) WithNextHopGroup(id uint64) *policyForwardingEntry {
+	p.pb.PolicyForwardingEntry.NextHopGroup = &wpb.UintValue{Value: id}
+	return p
+}
+
+// WithNextHopGroupNetworkInstance specifies the network instance within which
+// the policy-forwarding entry's next-hop-group should be resolved.
+func (p *policyForwardingEntry) WithNextHopGroupNetworkInstance(ni string) *policyForwardingEntry {
+	p.pb.PolicyForwardingEntry.NextHopGroupNetworkInstance = &wpb.StringValue{Value: ni}
+	return p
+}
+
+// WithElectionID specifies an explicit election ID to be used for the Entry.
+// The election ID is made up of the concatenation of the low and high uint64
+// values provided.
+func (p *policyForwardingEntry) WithElectionID(low, high uint64) *policyForwardingEntry {
+	p.electionID = &spb.Uint128{
+		Low:  low,
+		High: high,
+	}
+	return p
+}
+
+// WithOperationID specifies an explicit operation ID to be used for the
+// AFTOperation that uses the entry. If it is not specified, the ID is
+// allocated by the client.
+func (p *policyForwardingEntry) WithOperationID(id uint64) *policyForwardingEntry {
+	p.opID = id
+	return p
+}
+
+// OpProto implements the GRIBIEntry interface, returning a gRIBI AFTOperation. Unless
+// explicitly specified using WithOperationID, the ID is not populated so it can be set
+// by the caller.
+func (p *policyForwardingEntry) OpProto() (*spb.AFTOperation, error) {
+	return &spb.AFTOperation{
+		Id:              p.opID,
+		NetworkInstance: p.ni,
+		Entry: &spb.AFTOperation_PolicyForwardingEntry{
+			PolicyForwardingEntry: proto.Clone(p.pb).(*aftpb.Afts_PolicyForwardingEntryKey),
+		},
+		ElectionId: p.electionID,
+	}, nil
+}
+
+// EntryProto implements the GRIBIEntry interface, returning a gRIBI AFTEntry.
+func (p *policyForwardingEntry) EntryProto() (*spb.AFTEntry, error) {
+	return &spb.AFTEntry{
+		NetworkInstance: p.ni,
+		Entry: &spb.AFTEntry_PolicyForwardingEntry{
+			PolicyForwardingEntry: proto.Clone(p.pb).(*aftpb.Afts_PolicyForwardingEntryKey),
+		},
+	}, nil
+}
+
 // modifyError is a type that can be used to build a gRIBI Modify error.
 type modifyError struct {
 	Reason spb.ModifyRPCErrorDetails_Reason
@@ -1199,6 +1977,26 @@ func (o *opResult) WithMPLSOperation(i uint64) *opResult {
 	return o
 }
 
+// WithPolicyForwardingOperation indicates that the result corresponds to an
+// operation impacting the policy-forwarding entry with index i.
+func (o *opResult) WithPolicyForwardingOperation(i uint64) *opResult {
+	if o.r.Details == nil {
+		o.r.Details = &client.OpDetailsResults{}
+	}
+	o.r.Details.PolicyForwardingIndex = i
+	return o
+}
+
+// WithNetworkInstance indicates that the result corresponds to an
+// operation within the network instance ni.
+func (o *opResult) WithNetworkInstance(ni string) *opResult {
+	if o.r.Details == nil {
+		o.r.Details = &client.OpDetailsResults{}
+	}
+	o.r.Details.NetworkInstance = ni
+	return o
+}
+
 // WithOperationType indicates that the result corresponds to
 // an operation with a specific type.
 func (o *opResult) WithOperationType(c constants.OpType) *opResult {
@@ -1246,3 +2044,168 @@ func (o *opResult) WithProgrammingResult(r ProgrammingResult) *opResult {
 func (o *opResult) AsResult() *client.OpResult {
 	return o.r
 }
+
+// String returns a human-readable name for the ProgrammingResult.
+func (p ProgrammingResult) String() string {
+	return map[ProgrammingResult]string{
+		ProgrammingFailed: "ProgrammingFailed",
+		InstalledInRIB:    "InstalledInRIB",
+		InstalledInFIB:    "InstalledInFIB",
+	}[p]
+}
+
+// SummaryKey is the key used for counts within a ResultSummary. It
+// describes the AFT that an operation was for, the type of the operation, and
+// its final programming result.
+type SummaryKey struct {
+	// AFT is the AFT that the operation was performed on.
+	AFT constants.AFT
+	// Op is the type of the operation.
+	Op constants.OpType
+	// Result is the final programming result of the operation.
+	Result ProgrammingResult
+}
+
+// String returns a human-readable form of the SummaryKey.
+func (k SummaryKey) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.AFT, k.Op, k.Result)
+}
+
+// ResultSummary is a count of AFT operations keyed by the AFT, operation type
+// and final programming result of the operation.
+type ResultSummary map[SummaryKey]int
+
+// String returns a human-readable form of the ResultSummary, with one line
+// per key, sorted by key.
+func (r ResultSummary) String() string {
+	keys := make([]string, 0, len(r))
+	for k, v := range r {
+		keys = append(keys, fmt.Sprintf("%s: %d", k, v))
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, "\n")
+}
+
+// resultRank ranks the AFTResult status values such that the final state of an
+// operation can be determined regardless of the order in which results are
+// received. A failure is always final, and an entry that has been installed in
+// the FIB has also been installed in the RIB.
+var resultRank = map[spb.AFTResult_Status]int{
+	spb.AFTResult_RIB_PROGRAMMED: 1,
+	spb.AFTResult_FIB_PROGRAMMED: 2,
+	spb.AFTResult_FIB_FAILED:     3,
+	spb.AFTResult_FAILED:         3,
+}
+
+// fluentResult maps an AFTResult status to the fluent-style programming result.
+var fluentResult = map[spb.AFTResult_Status]ProgrammingResult{
+	spb.AFTResult_RIB_PROGRAMMED: InstalledInRIB,
+	spb.AFTResult_FIB_PROGRAMMED: InstalledInFIB,
+	spb.AFTResult_FIB_FAILED:     ProgrammingFailed,
+	spb.AFTResult_FAILED:         ProgrammingFailed,
+}
+
+// SummariseResults returns a ResultSummary for the supplied results. Results
+// that do not correspond to an AFT operation (e.g., election ID updates), or
+// whose AFT cannot be determined from their details, are ignored. Multiple
+// results for the same operation are counted once, using the final programming
+// result of the operation.
+func SummariseResults(res []*client.OpResult) ResultSummary {
+	// opKey identifies an individual operation, the details are included to
+	// distinguish operations that reuse an operation ID.
+	type opKey struct {
+		id      uint64
+		details client.OpDetailsResults
+	}
+
+	final := map[opKey]spb.AFTResult_Status{}
+	for _, r := range res {
+		if r.OperationID == 0 || r.Details == nil {
+			continue
+		}
+		if _, ok := resultRank[r.ProgrammingResult]; !ok {
+			continue
+		}
+		k := opKey{id: r.OperationID, details: *r.Details}
+		if resultRank[r.ProgrammingResult] > resultRank[final[k]] {
+			final[k] = r.ProgrammingResult
+		}
+	}
+
+	sum := ResultSummary{}
+	for k, v := range final {
+		aft, ok := detailsAFT(k.details)
+		if !ok {
+			continue
+		}
+		sum[SummaryKey{
+			AFT:    aft,
+			Op:     k.details.Type,
+			Result: fluentResult[v],
+		}]++
+	}
+	return sum
+}
+
+// detailsAFT returns the AFT that the operation described by d corresponds to,
+// and whether the AFT could be determined.
+func detailsAFT(d client.OpDetailsResults) (constants.AFT, bool) {
+	switch {
+	case d.IPv4Prefix != "":
+		return constants.IPv4, true
+	case d.IPv6Prefix != "":
+		return constants.IPv6, true
+	case d.NextHopGroupID != 0:
+		return constants.NextHopGroup, true
+	case d.NextHopIndex != 0:
+		return constants.NextHop, true
+	case d.MPLSLabel != 0:
+		return constants.MPLS, true
+	case d.PolicyForwardingIndex != 0:
+		return constants.PolicyForwarding, true
+	default:
+		return 0, false
+	}
+}
+
+// BatchResult describes the outcome of the operations that were sent to the
+// server using AddBatch.
+type BatchResult struct {
+	// Operations is the outcome of each operation in the batch, in the order
+	// in which the operations were sent.
+	Operations []*BatchOperationResult
+}
+
+// BatchOperationResult describes the outcome of a single operation within a
+// batch.
+type BatchOperationResult struct {
+	// ID is the operation ID that was used for the operation.
+	ID uint64
+	// Result is the final result that was received for the operation, if no
+	// result has been received it is nil.
+	Result *client.OpResult
+}
+
+// Succeeded returns true if the operation was installed in the RIB or FIB.
+func (b *BatchOperationResult) Succeeded() bool {
+	if b.Result == nil {
+		return false
+	}
+	switch b.Result.ProgrammingResult {
+	case spb.AFTResult_RIB_PROGRAMMED, spb.AFTResult_FIB_PROGRAMMED:
+		return true
+	}
+	return false
+}
+
+// Failed returns the operations within the batch that did not succeed, including
+// those for which no result has been received.
+func (b *BatchResult) Failed() []*BatchOperationResult {
+	var f []*BatchOperationResult
+	for _, o := range b.Operations {
+		if !o.Succeeded() {
+			f = append(f, o)
+		}
+	}
+	return f
+}
@@ -16,18 +16,27 @@ package fluent
 
 import (
 	"context"
+	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/client"
+	"github.com/openconfig/gribigo/constants"
 	"github.com/openconfig/gribigo/server"
 	"github.com/openconfig/gribigo/testcommon"
 	"github.com/openconfig/lemming"
 	"github.com/openconfig/testt"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 
 	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
@@ -113,6 +122,180 @@ func TestGRIBIClient(t *testing.T) {
 			}
 			c.Stop(t)
 		},
+	}, {
+		desc: "raw response capture",
+		inFn: func(addr string, t testing.TB) {
+			c := NewClient()
+			c.Connection().WithTarget(addr).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(0, 1).WithPersistence().WithRawResponseCapture()
+			c.Start(context.Background(), t)
+			defer c.Stop(t)
+			c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1))
+			c.StartSending(context.Background(), t)
+			if err := c.Await(context.Background(), t); err != nil {
+				t.Fatalf("got unexpected error from server, %v", err)
+			}
+
+			want := []*spb.ModifyResponse{{
+				SessionParamsResult: &spb.SessionParametersResult{},
+			}, {
+				ElectionId: &spb.Uint128{High: 1},
+			}, {
+				Result: []*spb.AFTResult{{
+					Id:     1,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			}}
+			got := []*spb.ModifyResponse{}
+			for range want {
+				select {
+				case r := <-c.RawResponses():
+					got = append(got, r)
+				case <-time.After(10 * time.Second):
+					t.Fatalf("did not receive expected raw responses, got: %v", got)
+				}
+			}
+			if diff := cmp.Diff(got, want, protocmp.Transform(), protocmp.IgnoreFields(&spb.AFTResult{}, "timestamp")); diff != "" {
+				t.Fatalf("did not get expected raw responses, diff(-got,+want):\n%s", diff)
+			}
+
+			// Capturing raw responses does not change the results that are processed.
+			if got, want := len(c.Results(t)), 3; got != want {
+				t.Fatalf("did not get expected number of results, got: %d, want: %d", got, want)
+			}
+			if got := c.RawResponsesDropped(); got != 0 {
+				t.Fatalf("did not get expected number of dropped responses, got: %d, want: 0", got)
+			}
+
+			// The channel is closed when the client is stopped.
+			c.Stop(t)
+			select {
+			case r, ok := <-c.RawResponses():
+				if ok {
+					t.Fatalf("got unexpected raw response after stop, %s", r)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("raw response channel was not closed after stop")
+			}
+		},
+	}, {
+		desc: "operation statistics",
+		inFn: func(addr string, t testing.TB) {
+			c := NewClient()
+			c.Connection().WithTarget(addr).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(0, 1).WithPersistence()
+			if got := c.Stats(); got != (ClientStats{}) {
+				t.Fatalf("did not get empty statistics before start, got: %+v", got)
+			}
+			c.Start(context.Background(), t)
+			defer c.Stop(t)
+			c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1))
+			c.Modify().AddEntry(t, NextHopGroupEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithID(1).AddNextHop(1, 1))
+			c.Modify().AddEntry(t, IPv4Entry().WithPrefix("1.1.1.1/32").WithNetworkInstance(server.DefaultNetworkInstanceName).WithNextHopGroup(1))
+			// A next-hop referencing an unknown network instance cannot be installed.
+			c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(2).WithNextHopNetworkInstance("FISH"))
+			c.StartSending(context.Background(), t)
+			if err := c.Await(context.Background(), t); err != nil {
+				t.Fatalf("got unexpected error from server, %v", err)
+			}
+
+			want := ClientStats{
+				Sent:    4,
+				RIBACKs: 3,
+				Failed:  1,
+			}
+			if diff := cmp.Diff(c.Stats(), want); diff != "" {
+				t.Fatalf("did not get expected statistics, diff(-got,+want):\n%s", diff)
+			}
+		},
+	}, {
+		desc: "result entry keys",
+		inFn: func(addr string, t testing.TB) {
+			c := NewClient()
+			c.Connection().WithTarget(addr).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(0, 1).WithPersistence()
+			c.Start(context.Background(), t)
+			defer c.Stop(t)
+			c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1))
+			c.Modify().AddEntry(t, NextHopGroupEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithID(2).AddNextHop(1, 1))
+			c.Modify().AddEntry(t, IPv4Entry().WithPrefix("1.1.1.1/32").WithNetworkInstance(server.DefaultNetworkInstanceName).WithNextHopGroup(2))
+			c.StartSending(context.Background(), t)
+			if err := c.Await(context.Background(), t); err != nil {
+				t.Fatalf("got unexpected error from server, %v", err)
+			}
+
+			var gotNH, gotNHG uint64
+			var gotPfx string
+			for _, r := range c.Results(t) {
+				if r.OperationID == 0 {
+					continue
+				}
+				if got := r.NetworkInstance(); got != server.DefaultNetworkInstanceName {
+					t.Errorf("did not get expected network instance for operation %d, got: %s, want: %s", r.OperationID, got, server.DefaultNetworkInstanceName)
+				}
+				if v, ok := r.NextHopID(); ok {
+					gotNH = v
+				}
+				if v, ok := r.NextHopGroupID(); ok {
+					gotNHG = v
+				}
+				if v, ok := r.IPv4Prefix(); ok {
+					gotPfx = v
+				}
+			}
+			if gotNH != 1 || gotNHG != 2 || gotPfx != "1.1.1.1/32" {
+				t.Fatalf("did not get expected entry keys, got: NH: %d, NHG: %d, IPv4: %s, want: NH: 1, NHG: 2, IPv4: 1.1.1.1/32", gotNH, gotNHG, gotPfx)
+			}
+		},
+	}, {
+		desc: "batch of entries",
+		inFn: func(addr string, t testing.TB) {
+			c := NewClient()
+			c.Connection().WithTarget(addr).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(0, 1).WithPersistence()
+			c.Start(context.Background(), t)
+			c.StartSending(context.Background(), t)
+			defer c.Stop(t)
+
+			m := c.Modify().AddBatch(t, []GRIBIEntry{
+				NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1),
+				NextHopGroupEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithID(1).AddNextHop(1, 1),
+				IPv4Entry().WithPrefix("1.1.1.1/32").WithNetworkInstance(server.DefaultNetworkInstanceName).WithNextHopGroup(1),
+				// A next-hop referencing an unknown network instance cannot be installed.
+				NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(2).WithNextHopNetworkInstance("FISH"),
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := m.WaitForAllACKs(ctx); err != nil {
+				t.Fatalf("did not get all ACKs for batch, %v", err)
+			}
+
+			res := m.BatchResult(t)
+			if got, want := len(res.Operations), 4; got != want {
+				t.Fatalf("did not get expected number of operations in batch, got: %d, want: %d", got, want)
+			}
+			for i, o := range res.Operations {
+				if got, want := o.ID, uint64(i+1); got != want {
+					t.Errorf("did not get expected ID for operation %d, got: %d, want: %d", i, got, want)
+				}
+			}
+			failed := res.Failed()
+			if len(failed) != 1 || failed[0].ID != 4 {
+				t.Fatalf("did not get expected failed operations, got: %v, want: [4]", failed)
+			}
+
+			// The result of a second batch that reuses an operation ID must be
+			// attributed only to the operation in the second batch.
+			reused := c.Modify().AddBatch(t, []GRIBIEntry{
+				NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(10).WithOperationID(1),
+			})
+			if err := reused.WaitForAllACKs(ctx); err != nil {
+				t.Fatalf("did not get all ACKs for second batch, %v", err)
+			}
+			if ops := reused.BatchResult(t).Operations; len(ops) != 1 || ops[0].ID != 1 || !ops[0].Succeeded() {
+				t.Fatalf("did not get expected operations for second batch, got: %v, want: [1]", ops)
+			}
+			if failed := m.BatchResult(t).Failed(); len(failed) != 1 || failed[0].ID != 4 {
+				t.Fatalf("did not get expected failed operations for first batch after reuse, got: %v, want: [4]", failed)
+			}
+		},
 	}}
 
 	for _, tt := range tests {
@@ -153,6 +336,113 @@ func TestGRIBIClient(t *testing.T) {
 	}
 }
 
+func TestGracefulStop(t *testing.T) {
+	const numOps = 1000
+
+	s, err := server.NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(0, 1).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+
+	for i := uint64(1); i <= numOps; i++ {
+		c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(i).WithIPAddress("192.0.2.1"))
+	}
+	c.StartSending(context.Background(), t)
+
+	// Stop the server once it has started to respond to operations, such that
+	// operations are in flight when the stop begins.
+	for c.Stats().RIBACKs == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.Server.GracefulStop(ctx); err != nil {
+		t.Fatalf("cannot gracefully stop server, %v", err)
+	}
+
+	// The stream is closed by the server after all results are sent, and
+	// hence Await may return an error.
+	awaitCtx, awaitCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer awaitCancel()
+	c.Await(awaitCtx, t)
+
+	got := map[uint64]bool{}
+	for _, r := range c.Results(t) {
+		if r.OperationID == 0 {
+			continue
+		}
+		switch {
+		case r.ProgrammingResult == spb.AFTResult_RIB_PROGRAMMED:
+		case r.ProgrammingResult == spb.AFTResult_FAILED && r.ClientError == "":
+		default:
+			t.Errorf("got unexpected result for operation %d, %s", r.OperationID, r)
+		}
+		got[r.OperationID] = true
+	}
+	if len(got) != numOps {
+		t.Fatalf("did not get a result for every operation, got: %d, want: %d", len(got), numOps)
+	}
+	if st := c.Stats(); st.Pending != 0 {
+		t.Fatalf("did not get expected pending operations after graceful stop, got: %d, want: 0", st.Pending)
+	}
+}
+
+func TestDialOptions(t *testing.T) {
+	lis := bufconn.Listen(1024 * 1024)
+	s, err := server.New()
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	gs := grpc.NewServer()
+	spb.RegisterGRIBIServer(gs, s)
+	go gs.Serve(lis)
+	defer gs.Stop()
+
+	var streams atomic.Int32
+	c := NewClient()
+	c.Connection().WithTarget("bufconn").
+		WithDialOptions(
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+				streams.Add(1)
+				return streamer(ctx, desc, cc, method, opts...)
+			}),
+		).
+		WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+	c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("got unexpected error awaiting results, %v", err)
+	}
+
+	var programmed bool
+	for _, r := range c.Results(t) {
+		if r.OperationID == 1 && r.ProgrammingResult == spb.AFTResult_RIB_PROGRAMMED {
+			programmed = true
+		}
+	}
+	if !programmed {
+		t.Errorf("did not get expected result for entry, got: %v", c.Results(t))
+	}
+	if streams.Load() == 0 {
+		t.Errorf("did not get expected call to stream interceptor")
+	}
+}
+
 func TestEntry(t *testing.T) {
 	tests := []struct {
 		desc           string
@@ -447,6 +737,49 @@ func TestEntry(t *testing.T) {
 				},
 			},
 		},
+	}, {
+		desc: "policy-forwarding entry",
+		in: PolicyForwardingEntry().WithNetworkInstance("DEFAULT").WithIndex(1).
+			WithIPv4Dst("192.0.2.0/24").WithDSCP(46).WithProtocol(17).
+			WithL4SrcPort(1024).WithL4DstPort(4789).
+			WithNextHopGroup(1).WithNextHopGroupNetworkInstance("DEFAULT").
+			WithElectionID(1, 0).WithOperationID(42),
+		wantOpProto: &spb.AFTOperation{
+			Id:              42,
+			NetworkInstance: "DEFAULT",
+			ElectionId:      &spb.Uint128{Low: 1},
+			Entry: &spb.AFTOperation_PolicyForwardingEntry{
+				PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntryKey{
+					Index: 1,
+					PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntry{
+						IpPrefix:                    &wpb.StringValue{Value: "192.0.2.0/24"},
+						IpDscp:                      &wpb.UintValue{Value: 46},
+						IpProtocol:                  &aftpb.Afts_PolicyForwardingEntry_IpProtocolUint64{IpProtocolUint64: 17},
+						L4SrcPort:                   &wpb.UintValue{Value: 1024},
+						L4DstPort:                   &wpb.UintValue{Value: 4789},
+						NextHopGroup:                &wpb.UintValue{Value: 1},
+						NextHopGroupNetworkInstance: &wpb.StringValue{Value: "DEFAULT"},
+					},
+				},
+			},
+		},
+		wantEntryProto: &spb.AFTEntry{
+			NetworkInstance: "DEFAULT",
+			Entry: &spb.AFTEntry_PolicyForwardingEntry{
+				PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntryKey{
+					Index: 1,
+					PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntry{
+						IpPrefix:                    &wpb.StringValue{Value: "192.0.2.0/24"},
+						IpDscp:                      &wpb.UintValue{Value: 46},
+						IpProtocol:                  &aftpb.Afts_PolicyForwardingEntry_IpProtocolUint64{IpProtocolUint64: 17},
+						L4SrcPort:                   &wpb.UintValue{Value: 1024},
+						L4DstPort:                   &wpb.UintValue{Value: 4789},
+						NextHopGroup:                &wpb.UintValue{Value: 1},
+						NextHopGroupNetworkInstance: &wpb.StringValue{Value: "DEFAULT"},
+					},
+				},
+			},
+		},
 	}}
 
 	for _, tt := range tests {
@@ -572,6 +905,54 @@ func TestEntriesToModifyRequest(t *testing.T) {
 				},
 			}},
 		},
+	}, {
+		desc: "explicit operation IDs",
+		inOp: spb.AFTOperation_ADD,
+		inEntries: []GRIBIEntry{
+			NextHopEntry().WithIndex(1).WithOperationID(42),
+			NextHopEntry().WithIndex(2),
+			NextHopEntry().WithIndex(3).WithOperationID(10),
+			NextHopEntry().WithIndex(4),
+		},
+		wantModifyRequest: &spb.ModifyRequest{
+			Operation: []*spb.AFTOperation{{
+				Id: 42,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   1,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}, {
+				Id: 43,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   2,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}, {
+				Id: 10,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   3,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}, {
+				Id: 44,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   4,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}},
+		},
 	}}
 
 	for _, tt := range tests {
@@ -591,6 +972,190 @@ func TestEntriesToModifyRequest(t *testing.T) {
 	}
 }
 
+func TestBuild(t *testing.T) {
+	t.Run("mixed batch", func(t *testing.T) {
+		c := NewClient()
+		c.Connection().WithRedundancyMode(ElectedPrimaryClient)
+		m := c.Modify()
+		m.UpdateElectionID(t, 42, 0).
+			AddEntry(t, NextHopEntry().WithIndex(1), IPv4Entry().WithPrefix("192.0.2.0/24").WithNextHopGroup(1)).
+			ReplaceEntry(t, IPv6Entry().WithPrefix("2001:db8::/32").WithNextHopGroup(1).WithElectionID(43, 0)).
+			DeleteEntry(t, IPv4Entry().WithPrefix("192.0.2.0/24"))
+
+		got, err := m.Build()
+		if err != nil {
+			t.Fatalf("Build(): got unexpected error, %v", err)
+		}
+
+		eid := &spb.Uint128{Low: 42}
+		want := []*spb.ModifyRequest{{
+			ElectionId: eid,
+		}, {
+			Operation: []*spb.AFTOperation{{
+				Id:         1,
+				Op:         spb.AFTOperation_ADD,
+				ElectionId: eid,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   1,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}, {
+				Id:         2,
+				Op:         spb.AFTOperation_ADD,
+				ElectionId: eid,
+				Entry: &spb.AFTOperation_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix: "192.0.2.0/24",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+							NextHopGroup: &wpb.UintValue{Value: 1},
+						},
+					},
+				},
+			}},
+		}, {
+			Operation: []*spb.AFTOperation{{
+				Id:         3,
+				Op:         spb.AFTOperation_REPLACE,
+				ElectionId: &spb.Uint128{Low: 43},
+				Entry: &spb.AFTOperation_Ipv6{
+					Ipv6: &aftpb.Afts_Ipv6EntryKey{
+						Prefix: "2001:db8::/32",
+						Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+							NextHopGroup: &wpb.UintValue{Value: 1},
+						},
+					},
+				},
+			}},
+		}, {
+			Operation: []*spb.AFTOperation{{
+				Id:         4,
+				Op:         spb.AFTOperation_DELETE,
+				ElectionId: eid,
+				Entry: &spb.AFTOperation_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix:    "192.0.2.0/24",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+					},
+				},
+			}},
+		}}
+		if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+			t.Fatalf("Build(): did not get expected requests, diff(-got,+want):\n%s", diff)
+		}
+	})
+
+	t.Run("invalid entries", func(t *testing.T) {
+		m := NewClient().Modify()
+		m.AddEntry(t, IPv4Entry().WithPrefix("192.0.2.0/24").WithNextHopGroup(1)).
+			AddEntry(t, IPv4Entry().WithPrefix("192.0.2.0/33").WithNextHopGroup(1)).
+			AddEntry(t, IPv6Entry().WithPrefix("192.0.2.0/24").WithNextHopGroup(1))
+
+		got, err := m.Build()
+		if err == nil {
+			t.Fatalf("Build(): did not get expected error, got requests: %v", got)
+		}
+		for _, want := range []string{"invalid prefix 192.0.2.0/33", "invalid prefix 192.0.2.0/24, incorrect address family"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Build(): did not get expected error, got: %v, want: %s", err, want)
+			}
+		}
+	})
+}
+
+func TestSummariseResults(t *testing.T) {
+	result := func(id uint64, status spb.AFTResult_Status, d *client.OpDetailsResults) *client.OpResult {
+		return &client.OpResult{
+			OperationID:       id,
+			ProgrammingResult: status,
+			Details:           d,
+		}
+	}
+	ipv4 := &client.OpDetailsResults{Type: constants.Add, IPv4Prefix: "192.0.2.1/32"}
+	nh := &client.OpDetailsResults{Type: constants.Add, NextHopIndex: 1}
+	nhg := &client.OpDetailsResults{Type: constants.Delete, NextHopGroupID: 1}
+	mpls := &client.OpDetailsResults{Type: constants.Add, MPLSLabel: 42}
+
+	tests := []struct {
+		desc      string
+		inResults []*client.OpResult
+		want      ResultSummary
+	}{{
+		desc: "no results",
+		want: ResultSummary{},
+	}, {
+		desc: "ignored non-operation results",
+		inResults: []*client.OpResult{{
+			CurrentServerElectionID: &spb.Uint128{Low: 1},
+		}, {
+			SessionParameters: &spb.SessionParametersResult{},
+		}},
+		want: ResultSummary{},
+	}, {
+		desc: "ignored results with unrecognised details",
+		inResults: []*client.OpResult{
+			result(1, spb.AFTResult_RIB_PROGRAMMED, &client.OpDetailsResults{Type: constants.Add}),
+			result(2, spb.AFTResult_RIB_PROGRAMMED, nh),
+		},
+		want: ResultSummary{
+			{AFT: constants.NextHop, Op: constants.Add, Result: InstalledInRIB}: 1,
+		},
+	}, {
+		desc: "one result per AFT",
+		inResults: []*client.OpResult{
+			result(1, spb.AFTResult_RIB_PROGRAMMED, nh),
+			result(2, spb.AFTResult_FAILED, nhg),
+			result(3, spb.AFTResult_RIB_PROGRAMMED, ipv4),
+			result(4, spb.AFTResult_RIB_PROGRAMMED, mpls),
+		},
+		want: ResultSummary{
+			{AFT: constants.NextHop, Op: constants.Add, Result: InstalledInRIB}:            1,
+			{AFT: constants.NextHopGroup, Op: constants.Delete, Result: ProgrammingFailed}: 1,
+			{AFT: constants.IPv4, Op: constants.Add, Result: InstalledInRIB}:               1,
+			{AFT: constants.MPLS, Op: constants.Add, Result: InstalledInRIB}:               1,
+		},
+	}, {
+		desc: "late FIB ACK supersedes RIB ACK",
+		inResults: []*client.OpResult{
+			result(1, spb.AFTResult_RIB_PROGRAMMED, nh),
+			result(2, spb.AFTResult_RIB_PROGRAMMED, ipv4),
+			result(1, spb.AFTResult_FIB_PROGRAMMED, nh),
+		},
+		want: ResultSummary{
+			{AFT: constants.NextHop, Op: constants.Add, Result: InstalledInFIB}: 1,
+			{AFT: constants.IPv4, Op: constants.Add, Result: InstalledInRIB}:    1,
+		},
+	}, {
+		desc: "FIB failure after RIB ACK",
+		inResults: []*client.OpResult{
+			result(1, spb.AFTResult_RIB_PROGRAMMED, ipv4),
+			result(1, spb.AFTResult_FIB_FAILED, ipv4),
+		},
+		want: ResultSummary{
+			{AFT: constants.IPv4, Op: constants.Add, Result: ProgrammingFailed}: 1,
+		},
+	}, {
+		desc: "reused operation ID for different entry",
+		inResults: []*client.OpResult{
+			result(1, spb.AFTResult_RIB_PROGRAMMED, nh),
+			result(1, spb.AFTResult_FAILED, &client.OpDetailsResults{Type: constants.Add, NextHopIndex: 2}),
+		},
+		want: ResultSummary{
+			{AFT: constants.NextHop, Op: constants.Add, Result: InstalledInRIB}:    1,
+			{AFT: constants.NextHop, Op: constants.Add, Result: ProgrammingFailed}: 1,
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if diff := cmp.Diff(SummariseResults(tt.inResults), tt.want); diff != "" {
+				t.Fatalf("SummariseResults(%v): did not get expected summary, diff(-got,+want):\n%s", tt.inResults, diff)
+			}
+		})
+	}
+}
+
 func TestModifyError(t *testing.T) {
 	tests := []struct {
 		desc       string
@@ -623,3 +1188,307 @@ func TestModifyError(t *testing.T) {
 		})
 	}
 }
+
+// captureStub is a GRIBIClient stub that records the ModifyRequests that are
+// sent on the Modify stream, without responding to them.
+type captureStub struct {
+	spb.GRIBIClient
+	sent chan *spb.ModifyRequest
+}
+
+// Modify implements the GRIBIClient interface, returning a stream that writes
+// each message sent to the sent channel of the stub.
+func (s *captureStub) Modify(ctx context.Context, _ ...grpc.CallOption) (spb.GRIBI_ModifyClient, error) {
+	return &captureStream{ctx: ctx, sent: s.sent}, nil
+}
+
+// captureStream is a Modify stream used by captureStub.
+type captureStream struct {
+	grpc.ClientStream
+	ctx  context.Context
+	sent chan *spb.ModifyRequest
+}
+
+func (c *captureStream) Send(m *spb.ModifyRequest) error {
+	c.sent <- m
+	return nil
+}
+
+func (c *captureStream) Recv() (*spb.ModifyResponse, error) {
+	<-c.ctx.Done()
+	return nil, c.ctx.Err()
+}
+
+func (c *captureStream) CloseSend() error { return nil }
+
+func TestAckType(t *testing.T) {
+	tests := []struct {
+		desc       string
+		inFn       func(*gRIBIConnection)
+		wantParams *spb.SessionParameters
+	}{{
+		desc: "RIB ACK",
+		inFn: func(c *gRIBIConnection) { c.WithAckType(RIBAck) },
+		wantParams: &spb.SessionParameters{
+			Redundancy: spb.SessionParameters_SINGLE_PRIMARY,
+			AckType:    spb.SessionParameters_RIB_ACK,
+		},
+	}, {
+		desc: "RIB and FIB ACK",
+		inFn: func(c *gRIBIConnection) { c.WithAckType(RIBFIBAck) },
+		wantParams: &spb.SessionParameters{
+			Redundancy: spb.SessionParameters_SINGLE_PRIMARY,
+			AckType:    spb.SessionParameters_RIB_AND_FIB_ACK,
+		},
+	}, {
+		desc: "RIB ACK overrides FIB ACK",
+		inFn: func(c *gRIBIConnection) { c.WithFIBACK().WithAckType(RIBAck) },
+		wantParams: &spb.SessionParameters{
+			Redundancy: spb.SessionParameters_SINGLE_PRIMARY,
+			AckType:    spb.SessionParameters_RIB_ACK,
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			stub := &captureStub{sent: make(chan *spb.ModifyRequest, 10)}
+			c := NewClient()
+			c.Connection().WithStub(stub).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0)
+			tt.inFn(c.Connection())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c.Start(ctx, t)
+			c.StartSending(ctx, t)
+			defer c.Stop(t)
+
+			select {
+			case m := <-stub.sent:
+				if diff := cmp.Diff(m.GetParams(), tt.wantParams, protocmp.Transform()); diff != "" {
+					t.Fatalf("did not get expected session parameters, diff(-got,+want):\n%s", diff)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("did not receive session parameters")
+			}
+			cancel()
+		})
+	}
+}
+
+func TestWaitForFIBACKs(t *testing.T) {
+	tests := []struct {
+		desc       string
+		inAckType  AckType
+		wantErrSub string
+	}{{
+		desc:       "RIB-only negotiated",
+		inAckType:  RIBAck,
+		wantErrSub: "RIB_AND_FIB_ACK was not negotiated",
+	}, {
+		desc:      "RIB and FIB negotiated",
+		inAckType: RIBFIBAck,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := server.NewInProcess()
+			if err != nil {
+				t.Fatalf("cannot start in-process server, %v", err)
+			}
+			defer s.Stop()
+
+			c := NewClient()
+			c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence().WithAckType(tt.inAckType)
+			c.Start(context.Background(), t)
+			defer c.Stop(t)
+			c.StartSending(context.Background(), t)
+
+			b := c.Modify().AddBatch(t, []GRIBIEntry{NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1")})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err = b.WaitForFIBACKs(ctx)
+			if tt.wantErrSub != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrSub) {
+					t.Fatalf("did not get expected error, got: %v, want substring: %s", err, tt.wantErrSub)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cannot wait for FIB ACKs, %v", err)
+			}
+			res := b.BatchResult(t)
+			if len(res.Operations) != 1 || res.Operations[0].Result.ProgrammingResult != spb.AFTResult_FIB_PROGRAMMED {
+				t.Fatalf("did not get expected FIB result, got: %+v", res.Operations)
+			}
+		})
+	}
+}
+
+func TestReset(t *testing.T) {
+	s, err := server.NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+
+	nh := func(i uint64) GRIBIEntry {
+		return NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(i).WithIPAddress("192.0.2.1")
+	}
+	c.Modify().AddEntry(t, nh(1), nh(2))
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("cannot program entries, %v", err)
+	}
+
+	if err := c.Reset(ctx); err != nil {
+		t.Fatalf("Reset(): got unexpected error, %v", err)
+	}
+	if st := c.Stats(); st != (ClientStats{}) {
+		t.Errorf("Reset(): did not get expected stats, got: %+v, want: zero", st)
+	}
+	if got, err := c.Get().AllNetworkInstances().WithAFT(AllAFTs).Send(); err != nil || len(got.GetEntry()) != 0 {
+		t.Errorf("Reset(): server was not flushed, got entries: %v, err: %v", got.GetEntry(), err)
+	}
+
+	// Operation IDs restart from the initial value.
+	c.Modify().AddEntry(t, nh(3))
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("cannot program entry after reset, %v", err)
+	}
+	var got []*client.OpResult
+	for _, r := range c.Results(t) {
+		if r.OperationID != 0 {
+			got = append(got, r)
+		}
+	}
+	if len(got) != 1 || got[0].OperationID != 1 || got[0].ProgrammingResult != spb.AFTResult_RIB_PROGRAMMED {
+		t.Fatalf("did not get expected result after reset, got: %v", got)
+	}
+
+	c.Modify().UpdateElectionID(t, 2, 0)
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("cannot update election ID, %v", err)
+	}
+	if err := c.Reset(ctx); err != nil {
+		t.Fatalf("Reset(): got unexpected error, %v", err)
+	}
+	if diff := cmp.Diff(c.currentElectionID, &spb.Uint128{Low: 1}, protocmp.Transform()); diff != "" {
+		t.Errorf("Reset(): did not get expected election ID, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestResetNotStarted(t *testing.T) {
+	if err := NewClient().Reset(context.Background()); err == nil {
+		t.Errorf("Reset(): did not get expected error for client that was not started")
+	}
+}
+
+func TestMessageLogger(t *testing.T) {
+	s, err := server.NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	type logged struct {
+		dir Direction
+		msg proto.Message
+	}
+	var (
+		mu  sync.Mutex
+		got []logged
+	)
+	c := NewClient()
+	c.Connection().
+		WithStub(spb.NewGRIBIClient(s.Conn())).
+		WithRedundancyMode(ElectedPrimaryClient).
+		WithInitialElectionID(1, 0).
+		WithPersistence().
+		WithMessageLogger(func(dir Direction, msg proto.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, logged{dir: dir, msg: msg})
+		})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+
+	c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"))
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("cannot program entry, %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Find the request that carried the operation, and the response that
+	// acknowledged it.
+	reqIdx, respIdx := -1, -1
+	for i, l := range got {
+		switch m := l.msg.(type) {
+		case *spb.ModifyRequest:
+			if l.dir != ToServer {
+				t.Errorf("ModifyRequest logged with direction %s, want: %s", l.dir, ToServer)
+			}
+			if len(m.GetOperation()) == 1 && m.GetOperation()[0].GetId() == 1 {
+				reqIdx = i
+			}
+		case *spb.ModifyResponse:
+			if l.dir != FromServer {
+				t.Errorf("ModifyResponse logged with direction %s, want: %s", l.dir, FromServer)
+			}
+			if len(m.GetResult()) == 1 && m.GetResult()[0].GetId() == 1 && m.GetResult()[0].GetStatus() == spb.AFTResult_RIB_PROGRAMMED {
+				respIdx = i
+			}
+		default:
+			t.Errorf("got unexpected logged message type %T", m)
+		}
+	}
+	switch {
+	case reqIdx == -1 || respIdx == -1:
+		t.Fatalf("did not log request and ACK for operation, got request index: %d, ACK index: %d, messages: %v", reqIdx, respIdx, got)
+	case reqIdx > respIdx:
+		t.Fatalf("ACK was logged before request, got request index: %d, ACK index: %d", reqIdx, respIdx)
+	}
+}
+
+func TestRawModifyStream(t *testing.T) {
+	s, err := server.NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	if got := testt.ExpectFatal(t, func(t testing.TB) {
+		NewClient().RawModifyStream(context.Background(), t)
+	}); !strings.Contains(got, "not been started") {
+		t.Errorf("RawModifyStream: did not get expected fatal error for client that was not started, got: %s", got)
+	}
+
+	c := NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c.Start(ctx, t)
+	defer c.Stop(t)
+	c.StartSending(ctx, t)
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("cannot negotiate session, %v", err)
+	}
+
+	ms := c.RawModifyStream(ctx, t)
+	if err := ms.Send(&spb.ModifyRequest{ElectionId: &spb.Uint128{Low: 2}}); err != nil {
+		t.Fatalf("cannot send on raw Modify stream, %v", err)
+	}
+	if _, err := ms.Recv(); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("did not get expected error on raw Modify stream, got: %v, want code: %s", err, codes.FailedPrecondition)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// DefaultPoolIdleTimeout is the duration for which a connection within a
+// ConnectionPool may be unused before it is closed, if no other timeout is
+// specified using WithIdleTimeout.
+const DefaultPoolIdleTimeout = 30 * time.Second
+
+// ConnectionPool is a pool of gRIBI clients that share a single gRPC stub, such
+// that many test cases running in parallel can program a server without each
+// opening its own connection. Each client in the pool has an open Modify stream
+// to the server, and at most maxConns clients exist at any time.
+type ConnectionPool struct {
+	// stub is the gRPC stub used by all clients in the pool.
+	stub spb.GRIBIClient
+	// maxConns is the maximum number of clients that can be open at any time.
+	maxConns int
+
+	// doneCh is closed when the pool is closed.
+	doneCh chan struct{}
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// idleTimeout is the duration after which an unused client is closed.
+	idleTimeout time.Duration
+	// configFn is called to configure the connection of each new client.
+	configFn func(*gRIBIConnection)
+	// open is the number of clients that are currently open, including those
+	// that are idle.
+	open int
+	// idle stores the clients that have been released, most recently released
+	// last.
+	idle []*pooledClient
+	// inUse stores the clients that have been acquired and not released.
+	inUse map[*GRIBIClient]*pooledClient
+	// nextNamespace is the election ID namespace of the next client created.
+	nextNamespace uint64
+	// released is closed and replaced when a client is released or closed such
+	// that callers waiting for a client can retry.
+	released chan struct{}
+	// closed indicates that the pool has been closed.
+	closed bool
+}
+
+// pooledClient is a client within a ConnectionPool.
+type pooledClient struct {
+	// c is the client.
+	c *GRIBIClient
+	// namespace is the election ID namespace of the client.
+	namespace uint64
+	// lastUsed is the time at which the client was last released.
+	lastUsed time.Time
+}
+
+// NewConnectionPool returns a new pool of gRIBI clients which use the stub
+// specified, with at most maxConns clients open at any time. Clients are created
+// as they are required, and closed once they have been idle for longer than
+// the pool's idle timeout. The pool must be closed using Close once it is no
+// longer required. Since the clients share the connection of the stub, the server
+// must accept multiple Modify RPCs on a single connection - a gribigo server must
+// be created using server.WithMultipleModifyPerConnection. A maxConns of less than
+// one is treated as one, such that clients can always be acquired.
+func NewConnectionPool(stub spb.GRIBIClient, maxConns int) *ConnectionPool {
+	if maxConns < 1 {
+		log.Warningf("invalid maximum number of connections %d for pool, using 1", maxConns)
+		maxConns = 1
+	}
+	p := &ConnectionPool{
+		stub:          stub,
+		maxConns:      maxConns,
+		doneCh:        make(chan struct{}),
+		idleTimeout:   DefaultPoolIdleTimeout,
+		inUse:         map[*GRIBIClient]*pooledClient{},
+		nextNamespace: 1,
+		released:      make(chan struct{}),
+	}
+	go p.reapIdle()
+	return p
+}
+
+// WithIdleTimeout specifies the duration for which a client within the pool may
+// be unused before it is closed. If d is zero or negative, idle clients are never
+// closed, and remain open until the pool is closed.
+func (p *ConnectionPool) WithIdleTimeout(d time.Duration) *ConnectionPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idleTimeout = d
+	return p
+}
+
+// WithConnectionConfig specifies a function that is called to configure the
+// connection of each client that is created by the pool - for example, to set
+// the redundancy mode or persistence. The stub and the initial election ID of
+// each client are set by the pool before fn is called.
+func (p *ConnectionPool) WithConnectionConfig(fn func(*gRIBIConnection)) *ConnectionPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configFn = fn
+	return p
+}
+
+// AcquireClient returns a client from the pool which has an open Modify stream
+// to the server. An idle client is returned if one exists, otherwise a new client
+// is created. If maxConns clients are already in use, AcquireClient blocks until
+// a client is released, or ctx is done. The client must be returned to the pool
+// using ReleaseClient, rather than being stopped.
+//
+// Each client is allocated its own election ID namespace, such that the high
+// 64 bits of its initial election ID are unique within the pool.
+func (p *ConnectionPool) AcquireClient(ctx context.Context) (*GRIBIClient, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, errors.New("connection pool is closed")
+		}
+		if n := len(p.idle); n != 0 {
+			pc := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.inUse[pc.c] = pc
+			p.mu.Unlock()
+			return pc.c, nil
+		}
+		if p.open < p.maxConns {
+			p.open++
+			ns := p.nextNamespace
+			p.nextNamespace++
+			configFn := p.configFn
+			p.mu.Unlock()
+			return p.newClient(ns, configFn)
+		}
+		released := p.released
+		p.mu.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("cannot acquire client, %v", ctx.Err())
+		}
+	}
+}
+
+// newClient creates and starts a new client in the election ID namespace ns,
+// configuring its connection using configFn if it is non-nil. The caller must
+// have already counted the client as being open.
+func (p *ConnectionPool) newClient(ns uint64, configFn func(*gRIBIConnection)) (*GRIBIClient, error) {
+	c := NewClient()
+	c.Connection().WithStub(p.stub).WithInitialElectionID(1, ns)
+	if configFn != nil {
+		configFn(c.Connection())
+	}
+
+	// The Modify stream of the client outlives the context of the caller that
+	// acquired it, since the client may subsequently be reused.
+	ctx := context.Background()
+	err := c.start(ctx)
+	if err == nil {
+		err = c.startSending(ctx)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		c.stop()
+		p.open--
+		p.notify()
+		return nil, fmt.Errorf("cannot start client, %v", err)
+	}
+	p.inUse[c] = &pooledClient{c: c, namespace: ns}
+	return c, nil
+}
+
+// ReleaseClient returns the client c, which was acquired using AcquireClient, to
+// the pool such that it can be reused. The client is reset before it is reused -
+// its queued operations and results are cleared, its operation IDs and election ID
+// restart from their initial values, and a new Modify stream is opened. Since the
+// server is shared by the clients of the pool, the entries that the client
+// installed are not removed, and must be deleted by the caller if required. A
+// client that cannot be reset is closed rather than being reused.
+func (p *ConnectionPool) ReleaseClient(c *GRIBIClient) {
+	p.mu.Lock()
+	pc, ok := p.inUse[c]
+	if !ok {
+		p.mu.Unlock()
+		log.Errorf("cannot release client %p that was not acquired from the pool", c)
+		return
+	}
+	delete(p.inUse, c)
+	closed := p.closed
+	p.mu.Unlock()
+
+	var err error
+	if !closed {
+		if err = c.resetSession(context.Background()); err != nil {
+			log.Errorf("cannot reset client in election ID namespace %d, closing it, %v", pc.namespace, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// The pool may have been closed whilst the client was being reset.
+	if closed || err != nil || p.closed {
+		c.stop()
+		p.open--
+		p.notify()
+		return
+	}
+	pc.lastUsed = time.Now()
+	p.idle = append(p.idle, pc)
+	p.notify()
+}
+
+// notify wakes callers that are waiting for a client. It must be called with
+// p.mu held.
+func (p *ConnectionPool) notify() {
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+// OpenConnections returns the number of clients within the pool that are open,
+// including those that are idle.
+func (p *ConnectionPool) OpenConnections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.open
+}
+
+// reapIdle periodically closes clients that have been idle for longer than the
+// idle timeout, until the pool is closed. Clients are not closed whilst the idle
+// timeout is not positive, however, the timeout continues to be checked since it
+// may subsequently be changed.
+func (p *ConnectionPool) reapIdle() {
+	for {
+		p.mu.Lock()
+		timeout := p.idleTimeout
+		p.mu.Unlock()
+		interval := timeout / 2
+		if timeout <= 0 {
+			interval = DefaultPoolIdleTimeout / 2
+		}
+
+		select {
+		case <-p.doneCh:
+			return
+		case <-time.After(interval):
+		}
+
+		p.mu.Lock()
+		if p.idleTimeout <= 0 {
+			p.mu.Unlock()
+			continue
+		}
+		var expired []*pooledClient
+		keep := []*pooledClient{}
+		for _, pc := range p.idle {
+			if time.Since(pc.lastUsed) > p.idleTimeout {
+				expired = append(expired, pc)
+				continue
+			}
+			keep = append(keep, pc)
+		}
+		p.idle = keep
+		p.mu.Unlock()
+
+		if len(expired) == 0 {
+			continue
+		}
+		// Clients are only counted as closed once they have been stopped, such
+		// that the number of open connections never exceeds maxConns.
+		for _, pc := range expired {
+			log.V(2).Infof("closing client in election ID namespace %d, idle since %s", pc.namespace, pc.lastUsed)
+			pc.c.stop()
+		}
+		p.mu.Lock()
+		p.open -= len(expired)
+		p.notify()
+		p.mu.Unlock()
+	}
+}
+
+// Close closes the idle clients within the pool, and causes subsequent calls to
+// AcquireClient to fail. Clients that are in use are closed when they are
+// released.
+func (p *ConnectionPool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	close(p.doneCh)
+	p.notify()
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		pc.c.stop()
+	}
+	p.mu.Lock()
+	p.open -= len(idle)
+	p.mu.Unlock()
+}
@@ -0,0 +1,240 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/server"
+	"go.uber.org/atomic"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestConnectionPool(t *testing.T) {
+	const (
+		maxConns = 3
+		numUsers = 20
+	)
+
+	s, err := server.NewInProcess(server.WithMultipleModifyPerConnection())
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	p := NewConnectionPool(spb.NewGRIBIClient(s.Conn()), maxConns).
+		WithIdleTimeout(200 * time.Millisecond).
+		WithConnectionConfig(func(c *gRIBIConnection) {
+			c.WithRedundancyMode(ElectedPrimaryClient).WithPersistence()
+		})
+	defer p.Close()
+
+	// Sample the number of clients connected to the server while the pool is
+	// in use.
+	var maxSeen atomic.Int64
+	sampleDone := make(chan struct{})
+	sampleStopped := make(chan struct{})
+	go func() {
+		defer close(sampleStopped)
+		for {
+			if n := int64(len(s.Stats().Client)); n > maxSeen.Load() {
+				maxSeen.Store(n)
+			}
+			select {
+			case <-sampleDone:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		namespaces = map[*GRIBIClient]uint64{}
+	)
+	errs := make(chan error, numUsers)
+	for i := 0; i < numUsers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c, err := p.AcquireClient(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			namespaces[c] = c.connection.electionID.GetHigh()
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			p.ReleaseClient(c)
+		}()
+	}
+	wg.Wait()
+	close(sampleDone)
+	<-sampleStopped
+	close(errs)
+	for err := range errs {
+		t.Errorf("cannot acquire client, %v", err)
+	}
+
+	if got := p.OpenConnections(); got > maxConns {
+		t.Errorf("did not get expected number of open connections, got: %d, want: <= %d", got, maxConns)
+	}
+	if got := maxSeen.Load(); got > maxConns {
+		t.Errorf("server saw too many concurrent clients, got: %d, want: <= %d", got, maxConns)
+	}
+	if got := len(namespaces); got > maxConns {
+		t.Errorf("pool created too many clients, got: %d, want: <= %d", got, maxConns)
+	}
+	seenNS := map[uint64]bool{}
+	for _, ns := range namespaces {
+		if seenNS[ns] {
+			t.Errorf("election ID namespace %d was allocated to more than one client", ns)
+		}
+		seenNS[ns] = true
+	}
+
+	// Idle connections are closed once the idle timeout has expired.
+	deadline := time.Now().Add(10 * time.Second)
+	for p.OpenConnections() != 0 || len(s.Stats().Client) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle connections were not closed, pool: %d, server: %d", p.OpenConnections(), len(s.Stats().Client))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectionPoolAcquireTimeout(t *testing.T) {
+	s, err := server.NewInProcess(server.WithMultipleModifyPerConnection())
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	p := NewConnectionPool(spb.NewGRIBIClient(s.Conn()), 1)
+	defer p.Close()
+
+	c, err := p.AcquireClient(context.Background())
+	if err != nil {
+		t.Fatalf("cannot acquire client, %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.AcquireClient(ctx); err == nil {
+		t.Fatalf("did not get expected error acquiring client from exhausted pool")
+	}
+
+	p.ReleaseClient(c)
+	got, err := p.AcquireClient(context.Background())
+	if err != nil {
+		t.Fatalf("cannot acquire client after release, %v", err)
+	}
+	if got != c {
+		t.Errorf("did not reuse idle client, got: %p, want: %p", got, c)
+	}
+	p.ReleaseClient(got)
+
+	p.Close()
+	if _, err := p.AcquireClient(context.Background()); err == nil {
+		t.Fatalf("did not get expected error acquiring client from closed pool")
+	}
+	if got := p.OpenConnections(); got != 0 {
+		t.Errorf("did not get expected open connections after close, got: %d, want: 0", got)
+	}
+}
+
+func TestConnectionPoolInvalidConfig(t *testing.T) {
+	s, err := server.NewInProcess(server.WithMultipleModifyPerConnection())
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	// A pool with no connections is treated as having one, and a zero idle
+	// timeout means that idle clients are never closed.
+	p := NewConnectionPool(spb.NewGRIBIClient(s.Conn()), 0).WithIdleTimeout(0)
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := p.AcquireClient(ctx)
+	if err != nil {
+		t.Fatalf("cannot acquire client from pool with zero connections, %v", err)
+	}
+	p.ReleaseClient(c)
+
+	time.Sleep(100 * time.Millisecond)
+	if got := p.OpenConnections(); got != 1 {
+		t.Errorf("did not get expected number of open connections with zero idle timeout, got: %d, want: 1", got)
+	}
+}
+
+func TestConnectionPoolReleaseResetsClient(t *testing.T) {
+	s, err := server.NewInProcess(server.WithMultipleModifyPerConnection())
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	p := NewConnectionPool(spb.NewGRIBIClient(s.Conn()), 1).
+		WithConnectionConfig(func(c *gRIBIConnection) {
+			c.WithRedundancyMode(ElectedPrimaryClient).WithPersistence()
+		})
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := p.AcquireClient(ctx)
+	if err != nil {
+		t.Fatalf("cannot acquire client, %v", err)
+	}
+	c.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1))
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("cannot await client, %v", err)
+	}
+	if len(c.Results(t)) == 0 {
+		t.Fatalf("did not get results for operation before release")
+	}
+	p.ReleaseClient(c)
+
+	got, err := p.AcquireClient(ctx)
+	if err != nil {
+		t.Fatalf("cannot acquire client after release, %v", err)
+	}
+	defer p.ReleaseClient(got)
+	if got != c {
+		t.Fatalf("did not reuse idle client, got: %p, want: %p", got, c)
+	}
+	if r := got.Results(t); len(r) != 0 {
+		t.Errorf("did not get expected results for reused client, got: %v, want: none", r)
+	}
+
+	// The reused client can program the server using a new session.
+	got.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(2))
+	if err := got.Await(ctx, t); err != nil {
+		t.Fatalf("cannot await reused client, %v", err)
+	}
+	if r := got.Results(t); len(r) == 0 {
+		t.Errorf("did not get results for operation sent by reused client")
+	}
+}
@@ -0,0 +1,405 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/openconfig/gribigo/client"
+	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/protobuf/proto"
+	"lukechampine.com/uint128"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// Snapshot is a copy of the gRIBI entries that were installed on a device at a
+// point in time, such that the device can subsequently be restored to the same
+// state.
+type Snapshot struct {
+	// entries stores the entries within the snapshot, with their RIB and FIB
+	// status removed.
+	entries map[snapshotKey]*spb.AFTEntry
+}
+
+// snapshotKey uniquely identifies an entry within a Snapshot.
+type snapshotKey struct {
+	// ni is the network instance that the entry is installed in.
+	ni string
+	// aft is the AFT that the entry belongs to.
+	aft constants.AFT
+	// key is the key of the entry within the AFT.
+	key string
+}
+
+// SnapshotDevice captures the entries that are installed in all network
+// instances and AFTs of the device that the client c is connected to, using the
+// Get RPC. The client must have been started.
+func SnapshotDevice(ctx context.Context, c *GRIBIClient) (*Snapshot, error) {
+	if c.c == nil {
+		return nil, errors.New("cannot snapshot device, client has not been started")
+	}
+	res, err := c.c.Get(ctx, &spb.GetRequest{
+		NetworkInstance: &spb.GetRequest_All{All: &spb.Empty{}},
+		Aft:             spb.AFTType_ALL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot snapshot device, %v", err)
+	}
+	return newSnapshot(res.GetEntry())
+}
+
+// newSnapshot returns a Snapshot containing the entries specified.
+func newSnapshot(entries []*spb.AFTEntry) (*Snapshot, error) {
+	s := &Snapshot{entries: map[snapshotKey]*spb.AFTEntry{}}
+	for _, e := range entries {
+		k, err := entryKey(e)
+		if err != nil {
+			return nil, err
+		}
+		e = proto.Clone(e).(*spb.AFTEntry)
+		// The status of the entry is not part of the state that is restored.
+		e.RibStatus, e.FibStatus = spb.AFTEntry_UNAVAILABLE, spb.AFTEntry_UNAVAILABLE
+		s.entries[k] = e
+	}
+	return s, nil
+}
+
+// entryKey returns the key of the entry e within a Snapshot.
+func entryKey(e *spb.AFTEntry) (snapshotKey, error) {
+	k := snapshotKey{ni: e.GetNetworkInstance()}
+	switch v := e.GetEntry().(type) {
+	case *spb.AFTEntry_Ipv4:
+		k.aft, k.key = constants.IPv4, v.Ipv4.GetPrefix()
+	case *spb.AFTEntry_Ipv6:
+		k.aft, k.key = constants.IPv6, v.Ipv6.GetPrefix()
+	case *spb.AFTEntry_Mpls:
+		k.aft, k.key = constants.MPLS, strconv.FormatUint(v.Mpls.GetLabelUint64(), 10)
+	case *spb.AFTEntry_NextHopGroup:
+		k.aft, k.key = constants.NextHopGroup, strconv.FormatUint(v.NextHopGroup.GetId(), 10)
+	case *spb.AFTEntry_NextHop:
+		k.aft, k.key = constants.NextHop, strconv.FormatUint(v.NextHop.GetIndex(), 10)
+	case *spb.AFTEntry_PolicyForwardingEntry:
+		k.aft, k.key = constants.PolicyForwarding, strconv.FormatUint(v.PolicyForwardingEntry.GetIndex(), 10)
+	default:
+		return snapshotKey{}, fmt.Errorf("unsupported entry type %T in network instance %s", v, e.GetNetworkInstance())
+	}
+	return k, nil
+}
+
+// Entries returns the entries within the snapshot, ordered such that each entry
+// is preceded by the entries that it references.
+func (s *Snapshot) Entries() []GRIBIEntry {
+	ents := []GRIBIEntry{}
+	for _, e := range orderEntries(s.entries, s.entries, false) {
+		ents = append(ents, &snapshotEntry{pb: e})
+	}
+	return ents
+}
+
+// snapshotEntry is a GRIBIEntry that is created from an AFTEntry returned by the
+// Get RPC.
+type snapshotEntry struct {
+	// pb is the entry.
+	pb *spb.AFTEntry
+}
+
+// OpProto implements the GRIBIEntry interface, building the entry as an
+// AFTOperation.
+func (s *snapshotEntry) OpProto() (*spb.AFTOperation, error) {
+	e := proto.Clone(s.pb).(*spb.AFTEntry)
+	op := &spb.AFTOperation{NetworkInstance: e.GetNetworkInstance()}
+	switch v := e.GetEntry().(type) {
+	case *spb.AFTEntry_Ipv4:
+		op.Entry = &spb.AFTOperation_Ipv4{Ipv4: v.Ipv4}
+	case *spb.AFTEntry_Ipv6:
+		op.Entry = &spb.AFTOperation_Ipv6{Ipv6: v.Ipv6}
+	case *spb.AFTEntry_Mpls:
+		op.Entry = &spb.AFTOperation_Mpls{Mpls: v.Mpls}
+	case *spb.AFTEntry_NextHopGroup:
+		op.Entry = &spb.AFTOperation_NextHopGroup{NextHopGroup: v.NextHopGroup}
+	case *spb.AFTEntry_NextHop:
+		op.Entry = &spb.AFTOperation_NextHop{NextHop: v.NextHop}
+	case *spb.AFTEntry_PolicyForwardingEntry:
+		op.Entry = &spb.AFTOperation_PolicyForwardingEntry{PolicyForwardingEntry: v.PolicyForwardingEntry}
+	default:
+		return nil, fmt.Errorf("unsupported entry type %T", v)
+	}
+	return op, nil
+}
+
+// EntryProto implements the GRIBIEntry interface, returning a copy of the entry.
+func (s *snapshotEntry) EntryProto() (*spb.AFTEntry, error) {
+	return proto.Clone(s.pb).(*spb.AFTEntry), nil
+}
+
+// orderEntries returns the entries specified in an order that satisfies their
+// dependencies. When reverse is false, each entry is preceded by the entries
+// that it references - next-hops are ordered before next-hop-groups, which are
+// ordered before prefix and label entries. Since next-hop-groups and prefixes
+// may reference entries in other network instances, all entries of each type
+// across all network instances are ordered together. When reverse is true, the
+// order is reversed such that entries are ordered before those they reference,
+// as is required for deletion.
+//
+// Backup next-hop-groups within all, which contains all the entries that are
+// installed once the entries are programmed, are ordered before the next-hop-
+// groups that reference them.
+func orderEntries(entries, all map[snapshotKey]*spb.AFTEntry, reverse bool) []*spb.AFTEntry {
+	depth := nhgDepths(all)
+	rank := func(k snapshotKey) int {
+		switch k.aft {
+		case constants.NextHop:
+			return 0
+		case constants.NextHopGroup:
+			return 1 + depth[k]
+		default:
+			return len(all) + 2
+		}
+	}
+
+	keys := []snapshotKey{}
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if ra, rb := rank(a), rank(b); ra != rb {
+			if reverse {
+				return ra > rb
+			}
+			return ra < rb
+		}
+		switch {
+		case a.aft != b.aft:
+			return a.aft < b.aft
+		case a.ni != b.ni:
+			return a.ni < b.ni
+		default:
+			return a.key < b.key
+		}
+	})
+
+	ordered := []*spb.AFTEntry{}
+	for _, k := range keys {
+		ordered = append(ordered, entries[k])
+	}
+	return ordered
+}
+
+// nhgDepths returns, for each next-hop-group within entries, the length of the
+// chain of backup next-hop-groups within entries that it references.
+func nhgDepths(entries map[snapshotKey]*spb.AFTEntry) map[snapshotKey]int {
+	depths := map[snapshotKey]int{}
+	var depth func(k snapshotKey, seen int) int
+	depth = func(k snapshotKey, seen int) int {
+		if d, ok := depths[k]; ok {
+			return d
+		}
+		e, ok := entries[k]
+		// Bound the recursion in the case that there is a loop of backups.
+		if !ok || seen > len(entries) {
+			return 0
+		}
+		d := 0
+		if b := e.GetNextHopGroup().GetNextHopGroup().GetBackupNextHopGroup(); b != nil {
+			bk := snapshotKey{ni: k.ni, aft: constants.NextHopGroup, key: strconv.FormatUint(b.GetValue(), 10)}
+			if _, ok := entries[bk]; ok {
+				d = 1 + depth(bk, seen+1)
+			}
+		}
+		depths[k] = d
+		return d
+	}
+	for k := range entries {
+		if k.aft == constants.NextHopGroup {
+			depth(k, 0)
+		}
+	}
+	return depths
+}
+
+// RestoreResult describes the changes that were made to a device to restore it
+// to the state within a Snapshot.
+type RestoreResult struct {
+	// Added contains the entries that were added to the device.
+	Added []*spb.AFTEntry
+	// Replaced contains the entries whose contents were replaced on the device.
+	Replaced []*spb.AFTEntry
+	// Deleted contains the entries that were deleted from the device.
+	Deleted []*spb.AFTEntry
+	// Failed contains the operations that were not successfully programmed.
+	Failed []*RestoreFailure
+}
+
+// RestoreFailure describes an operation that failed when restoring a device to
+// the state within a Snapshot.
+type RestoreFailure struct {
+	// Op is the type of the operation.
+	Op constants.OpType
+	// Entry is the entry that the operation was sent for.
+	Entry *spb.AFTEntry
+	// Result is the final result that was received for the operation, or nil
+	// if no result was received.
+	Result *client.OpResult
+}
+
+// restoreOp is an operation that is sent to restore a device to a Snapshot.
+type restoreOp struct {
+	// op is the type of operation.
+	op spb.AFTOperation_Operation
+	// entry is the entry that the operation is sent for.
+	entry *spb.AFTEntry
+}
+
+// RestoreTo restores the device that the client c is connected to such that the
+// entries installed on it are the same as those within the snapshot. The
+// device's current entries are retrieved using Get, and compared to the snapshot
+// such that entries that are missing are added, entries whose contents differ
+// are replaced, and entries that are not within the snapshot are deleted.
+// Operations are sent such that entries are programmed after, and deleted
+// before, the entries that they reference, including those in other network
+// instances.
+//
+// The client must have been started and be sending to the device. If the client
+// uses an elected primary redundancy mode and the device has reported that the
+// client is not the primary, no operations are sent and an error is returned,
+// since the client cannot modify the device. If any operation is not
+// successfully programmed - for example, because the device rejects the
+// deletion of an entry owned by another client - it is reported within the
+// Failed field of the result, and an error is returned.
+func (s *Snapshot) RestoreTo(ctx context.Context, c *GRIBIClient) (*RestoreResult, error) {
+	cur, err := SnapshotDevice(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPrimary(c); err != nil {
+		return nil, fmt.Errorf("cannot restore snapshot, %v", err)
+	}
+
+	programmed := map[snapshotKey]*spb.AFTEntry{}
+	deleted := map[snapshotKey]*spb.AFTEntry{}
+	replace := map[snapshotKey]bool{}
+	for k, e := range s.entries {
+		ce, ok := cur.entries[k]
+		switch {
+		case !ok:
+			programmed[k] = e
+		case !proto.Equal(ce, e):
+			programmed[k] = e
+			replace[k] = true
+		}
+	}
+	for k, e := range cur.entries {
+		if _, ok := s.entries[k]; !ok {
+			deleted[k] = e
+		}
+	}
+
+	ops := []restoreOp{}
+	for _, e := range orderEntries(programmed, s.entries, false) {
+		op := spb.AFTOperation_ADD
+		if k, _ := entryKey(e); replace[k] {
+			op = spb.AFTOperation_REPLACE
+		}
+		ops = append(ops, restoreOp{op: op, entry: e})
+	}
+	for _, e := range orderEntries(deleted, cur.entries, true) {
+		ops = append(ops, restoreOp{op: spb.AFTOperation_DELETE, entry: e})
+	}
+
+	res := &RestoreResult{}
+	if len(ops) == 0 {
+		return res, nil
+	}
+
+	m := &spb.ModifyRequest{}
+	mod := c.Modify()
+	for _, o := range ops {
+		om, err := mod.entriesToModifyRequest(o.op, []GRIBIEntry{&snapshotEntry{pb: o.entry}})
+		if err != nil {
+			return nil, fmt.Errorf("cannot build operation for %s, %v", o.entry, err)
+		}
+		m.Operation = append(m.Operation, om.GetOperation()...)
+	}
+	b := &gRIBIBatch{parent: c}
+	for _, o := range m.GetOperation() {
+		b.ops = append(b.ops, batchOp{id: o.GetId(), details: opDetails(o)})
+	}
+	c.c.Q(m)
+
+	if err := b.WaitForAllACKs(ctx); err != nil {
+		return nil, fmt.Errorf("cannot restore snapshot, %v", err)
+	}
+	results, err := c.c.Results()
+	if err != nil {
+		return nil, fmt.Errorf("cannot retrieve results, %v", err)
+	}
+
+	for i, r := range b.batchResult(results).Operations {
+		o := ops[i]
+		if r.Result == nil || (r.Result.ProgrammingResult != spb.AFTResult_RIB_PROGRAMMED && r.Result.ProgrammingResult != spb.AFTResult_FIB_PROGRAMMED) {
+			res.Failed = append(res.Failed, &RestoreFailure{
+				Op:     constants.OpFromAFTOp(o.op),
+				Entry:  o.entry,
+				Result: r.Result,
+			})
+			continue
+		}
+		switch o.op {
+		case spb.AFTOperation_ADD:
+			res.Added = append(res.Added, o.entry)
+		case spb.AFTOperation_REPLACE:
+			res.Replaced = append(res.Replaced, o.entry)
+		case spb.AFTOperation_DELETE:
+			res.Deleted = append(res.Deleted, o.entry)
+		}
+	}
+	if len(res.Failed) != 0 {
+		return res, fmt.Errorf("%d of %d operations failed restoring snapshot", len(res.Failed), len(ops))
+	}
+	return res, nil
+}
+
+// checkPrimary returns an error if the client c uses an elected primary
+// redundancy mode, and the device has reported an election ID that is higher
+// than the client's, such that the client is not the primary client.
+func checkPrimary(c *GRIBIClient) error {
+	if c.connection == nil || c.connection.redundMode != ElectedPrimaryClient || c.currentElectionID == nil {
+		return nil
+	}
+	results, err := c.c.Results()
+	if err != nil {
+		return err
+	}
+	var server *spb.Uint128
+	for _, r := range results {
+		if r.CurrentServerElectionID != nil {
+			server = r.CurrentServerElectionID
+		}
+	}
+	if server == nil {
+		return nil
+	}
+	own := uint128.New(c.currentElectionID.GetLow(), c.currentElectionID.GetHigh())
+	if srv := uint128.New(server.GetLow(), server.GetHigh()); srv.Cmp(own) > 0 {
+		return fmt.Errorf("client is not primary, its election ID %s is lower than the device's election ID %s", own, srv)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/server"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// startSnapshotClient starts a client that is connected to the server s with
+// the election ID specified, and waits for it to converge.
+func startSnapshotClient(t *testing.T, s *server.InProcessServer, electionID uint64) *GRIBIClient {
+	t.Helper()
+	c := NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(ElectedPrimaryClient).WithInitialElectionID(electionID, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	t.Cleanup(func() { c.Stop(t) })
+	c.StartSending(context.Background(), t)
+	awaitClient(t, c)
+	return c
+}
+
+// awaitClient waits for the client c to converge.
+func awaitClient(t *testing.T, c *GRIBIClient) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("got unexpected error from client, %v", err)
+	}
+}
+
+// entryProtos returns the AFTEntry protobufs for the entries specified.
+func entryProtos(t *testing.T, entries []GRIBIEntry) []*spb.AFTEntry {
+	t.Helper()
+	pbs := []*spb.AFTEntry{}
+	for _, e := range entries {
+		pb, err := e.EntryProto()
+		if err != nil {
+			t.Fatalf("cannot build entry, %v", err)
+		}
+		pbs = append(pbs, pb)
+	}
+	return pbs
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	const vrf = "VRF-A"
+	def := server.DefaultNetworkInstanceName
+
+	s, err := server.NewInProcess(server.WithVRFs([]string{vrf}))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := startSnapshotClient(t, s, 1)
+
+	nh1 := NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("192.0.2.1")
+	nh2 := NextHopEntry().WithNetworkInstance(def).WithIndex(2).WithIPAddress("192.0.2.2")
+	nhg1 := NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(1, 1)
+	nhg2 := NextHopGroupEntry().WithNetworkInstance(def).WithID(2).AddNextHop(2, 1).WithBackupNHG(1)
+	v4 := IPv4Entry().WithNetworkInstance(def).WithPrefix("1.1.1.1/32").WithNextHopGroup(1)
+	// vrfV4 references a next-hop-group in another network instance.
+	vrfV4 := IPv4Entry().WithNetworkInstance(vrf).WithPrefix("10.0.0.0/8").WithNextHopGroup(2).WithNextHopGroupNetworkInstance(def)
+
+	c.Modify().AddEntry(t, nh1, nh2, nhg1, nhg2, v4, vrfV4)
+	awaitClient(t, c)
+
+	ctx := context.Background()
+	snap, err := SnapshotDevice(ctx, c)
+	if err != nil {
+		t.Fatalf("cannot snapshot device, %v", err)
+	}
+
+	// Entries are ordered such that references are satisfied.
+	wantEntries := entryProtos(t, []GRIBIEntry{nh1, nh2, nhg1, nhg2, v4, vrfV4})
+	if diff := cmp.Diff(entryProtos(t, snap.Entries()), wantEntries, protocmp.Transform()); diff != "" {
+		t.Fatalf("did not get expected snapshot entries, diff(-got,+want):\n%s", diff)
+	}
+
+	nh3 := NextHopEntry().WithNetworkInstance(def).WithIndex(3).WithIPAddress("192.0.2.3")
+	extraV4 := IPv4Entry().WithNetworkInstance(def).WithPrefix("3.3.3.3/32").WithNextHopGroup(1)
+	c.Modify().DeleteEntry(t, vrfV4, nhg2, nh2)
+	c.Modify().AddEntry(t, nh3)
+	c.Modify().ReplaceEntry(t, NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(3, 1))
+	c.Modify().AddEntry(t, extraV4)
+	awaitClient(t, c)
+
+	got, err := snap.RestoreTo(ctx, c)
+	if err != nil {
+		t.Fatalf("cannot restore snapshot, %v", err)
+	}
+	want := &RestoreResult{
+		Added:    entryProtos(t, []GRIBIEntry{nh2, nhg2, vrfV4}),
+		Replaced: entryProtos(t, []GRIBIEntry{nhg1}),
+		Deleted:  entryProtos(t, []GRIBIEntry{extraV4, nh3}),
+	}
+	if diff := cmp.Diff(got, want, protocmp.Transform(), cmpopts.EquateEmpty()); diff != "" {
+		t.Fatalf("did not get expected restore result, diff(-got,+want):\n%s", diff)
+	}
+
+	after, err := SnapshotDevice(ctx, c)
+	if err != nil {
+		t.Fatalf("cannot snapshot device after restore, %v", err)
+	}
+	if diff := cmp.Diff(entryProtos(t, after.Entries()), wantEntries, protocmp.Transform()); diff != "" {
+		t.Fatalf("device was not restored to snapshot, diff(-got,+want):\n%s", diff)
+	}
+
+	// Restoring a device that matches the snapshot is a no-op.
+	got, err = snap.RestoreTo(ctx, c)
+	if err != nil {
+		t.Fatalf("cannot restore snapshot, %v", err)
+	}
+	if diff := cmp.Diff(got, &RestoreResult{}, protocmp.Transform(), cmpopts.EquateEmpty()); diff != "" {
+		t.Fatalf("did not get expected result for no-op restore, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestSnapshotRestoreNotPrimary(t *testing.T) {
+	def := server.DefaultNetworkInstanceName
+
+	s, err := server.NewInProcess(server.WithMultipleModifyPerConnection())
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	primary := startSnapshotClient(t, s, 2)
+	ctx := context.Background()
+	empty, err := SnapshotDevice(ctx, primary)
+	if err != nil {
+		t.Fatalf("cannot snapshot device, %v", err)
+	}
+
+	primary.Modify().AddEntry(t, NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("192.0.2.1"))
+	awaitClient(t, primary)
+
+	backup := startSnapshotClient(t, s, 1)
+	if _, err := empty.RestoreTo(ctx, backup); err == nil || !strings.Contains(err.Error(), "not primary") {
+		t.Fatalf("did not get expected error restoring from non-primary client, got: %v", err)
+	}
+
+	after, err := SnapshotDevice(ctx, primary)
+	if err != nil {
+		t.Fatalf("cannot snapshot device, %v", err)
+	}
+	if got := len(after.Entries()); got != 1 {
+		t.Fatalf("device was modified by non-primary client, got: %d entries, want: 1", got)
+	}
+}
+
+func TestSnapshotRestoreOwnedEntries(t *testing.T) {
+	def := server.DefaultNetworkInstanceName
+
+	s, err := server.NewInProcess(server.WithStrictDeleteOwnership(), server.WithMultipleModifyPerConnection())
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	first := startSnapshotClient(t, s, 1)
+	ctx := context.Background()
+	empty, err := SnapshotDevice(ctx, first)
+	if err != nil {
+		t.Fatalf("cannot snapshot device, %v", err)
+	}
+
+	owned := NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("192.0.2.1")
+	first.Modify().AddEntry(t, owned)
+	awaitClient(t, first)
+
+	// The second client becomes primary, but cannot delete the entry that is
+	// owned by the first.
+	second := startSnapshotClient(t, s, 2)
+	got, err := empty.RestoreTo(ctx, second)
+	if err == nil {
+		t.Fatalf("did not get expected error restoring entries owned by another client")
+	}
+	if got == nil || len(got.Failed) != 1 {
+		t.Fatalf("did not get expected failed operations, got: %+v", got)
+	}
+	f := got.Failed[0]
+	if diff := cmp.Diff(f.Entry, entryProtos(t, []GRIBIEntry{owned})[0], protocmp.Transform()); diff != "" {
+		t.Errorf("did not get expected failed entry, diff(-got,+want):\n%s", diff)
+	}
+	if f.Op != constants.Delete || f.Result == nil || f.Result.ProgrammingResult != spb.AFTResult_FAILED {
+		t.Errorf("did not get expected failure, got op: %s, result: %s", f.Op, f.Result)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/openconfig/gribigo/client"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+var (
+	// trackersMu protects the trackers map.
+	trackersMu sync.Mutex
+	// trackers stores the result trackers of the clients that were created with
+	// WithFailOnUncheckedErrors, such that results that are checked by a test can
+	// be recorded without the check having a reference to the client.
+	trackers = map[*resultTracker]bool{}
+)
+
+// resultTracker records the results received by a client that have been checked
+// by a test.
+type resultTracker struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// checked stores the results that have been checked.
+	checked map[*client.OpResult]bool
+	// allowed stores the IDs of operations whose failures are expected.
+	allowed map[uint64]bool
+}
+
+// mark records that the results res have been checked.
+func (r *resultTracker) mark(res ...*client.OpResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, o := range res {
+		r.checked[o] = true
+	}
+}
+
+// unchecked returns the results within res that failed and have not been
+// checked, or allowed.
+func (r *resultTracker) unchecked(res []*client.OpResult) []*client.OpResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var u []*client.OpResult
+	for _, o := range res {
+		if o.ProgrammingResult != spb.AFTResult_FAILED || r.checked[o] || r.allowed[o.OperationID] {
+			continue
+		}
+		u = append(u, o)
+	}
+	return u
+}
+
+// WithFailOnUncheckedErrors specifies that the test should fail if the client
+// receives a failed result for an operation that the test does not check. Results
+// are checked when they are matched by an assertion within the chk package, when
+// they are returned by the BatchResult of a batch, or when they are explicitly
+// marked using MarkChecked. Failures that are expected, but not otherwise checked,
+// can be allowed using AllowFailures.
+//
+// Results are verified when Stop is called, or when VerifyNoUnexpectedFailures is
+// called, and unchecked failures are reported to the test that is supplied to
+// them, such that a client that is reused across subtests reports them to the
+// subtest that stops it. Since Stop verifies the results that have been received,
+// checks must be made before the client is stopped.
+func (g *gRIBIConnection) WithFailOnUncheckedErrors(t testing.TB) *gRIBIConnection {
+	if g.parent.tracker != nil {
+		return g
+	}
+	tr := &resultTracker{
+		checked: map[*client.OpResult]bool{},
+		allowed: map[uint64]bool{},
+	}
+	g.parent.tracker = tr
+	trackersMu.Lock()
+	trackers[tr] = true
+	trackersMu.Unlock()
+	t.Cleanup(func() {
+		trackersMu.Lock()
+		defer trackersMu.Unlock()
+		delete(trackers, tr)
+	})
+	return g
+}
+
+// MarkChecked records that the results res have been checked by a test, such that
+// they are not reported by clients created with WithFailOnUncheckedErrors. It is
+// called by the assertions within the chk package, and can be called by tests that
+// check results directly.
+func MarkChecked(res ...*client.OpResult) {
+	trackersMu.Lock()
+	defer trackersMu.Unlock()
+	for tr := range trackers {
+		tr.mark(res...)
+	}
+}
+
+// AllowFailures specifies that failed results for the operations with the IDs ids
+// are expected, such that they are not reported by a client created with
+// WithFailOnUncheckedErrors. It has no effect on other clients.
+func (g *GRIBIClient) AllowFailures(ids ...uint64) {
+	if g.tracker == nil {
+		return
+	}
+	g.tracker.mu.Lock()
+	defer g.tracker.mu.Unlock()
+	for _, id := range ids {
+		g.tracker.allowed[id] = true
+	}
+}
+
+// VerifyNoUnexpectedFailures fails the test t if the client has received a failed
+// result that has not been checked or allowed, listing each such result. It has no
+// effect unless the client was created with WithFailOnUncheckedErrors.
+func (g *GRIBIClient) VerifyNoUnexpectedFailures(t testing.TB) {
+	t.Helper()
+	if err := g.uncheckedFailures(); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+// uncheckedFailures returns an error listing the failed results received by the
+// client that have not been checked or allowed.
+func (g *GRIBIClient) uncheckedFailures() error {
+	if g.tracker == nil || g.c == nil {
+		return nil
+	}
+	res, err := g.c.Results()
+	if err != nil {
+		return fmt.Errorf("cannot retrieve results, %v", err)
+	}
+	u := g.tracker.unchecked(res)
+	if len(u) == 0 {
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("client received %d failed results that were not checked:\n", len(u)))
+	for _, r := range u {
+		buf.WriteString(fmt.Sprintf("\t%s\n", r))
+	}
+	return fmt.Errorf("%s", buf.String())
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/client"
+	"github.com/openconfig/gribigo/server"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// recordingTB is a testing.TB that records the errors that are reported to it,
+// rather than failing the test.
+type recordingTB struct {
+	testing.TB
+	errs []string
+}
+
+// Errorf records the error that is reported.
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+// Helper implements testing.TB.
+func (*recordingTB) Helper() {}
+
+func TestFailOnUncheckedErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		// inBatch specifies that the operations are sent as a batch.
+		inBatch bool
+		// inCheckFn is called with the client and its results before it is
+		// stopped.
+		inCheckFn func(c *GRIBIClient, res []*client.OpResult)
+		wantErr   bool
+	}{{
+		desc:      "unchecked failure",
+		inCheckFn: func(*GRIBIClient, []*client.OpResult) {},
+		wantErr:   true,
+	}, {
+		desc: "failure marked as checked",
+		inCheckFn: func(_ *GRIBIClient, res []*client.OpResult) {
+			for _, r := range res {
+				if r.ProgrammingResult == spb.AFTResult_FAILED {
+					MarkChecked(r)
+				}
+			}
+		},
+	}, {
+		desc: "only successful result checked",
+		inCheckFn: func(_ *GRIBIClient, res []*client.OpResult) {
+			for _, r := range res {
+				if r.ProgrammingResult == spb.AFTResult_RIB_PROGRAMMED {
+					MarkChecked(r)
+				}
+			}
+		},
+		wantErr: true,
+	}, {
+		desc:      "failure allowed",
+		inCheckFn: func(c *GRIBIClient, _ []*client.OpResult) { c.AllowFailures(2) },
+	}, {
+		desc:      "failure returned by batch result",
+		inBatch:   true,
+		inCheckFn: func(*GRIBIClient, []*client.OpResult) {},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := server.NewInProcess()
+			if err != nil {
+				t.Fatalf("cannot start in-process server, %v", err)
+			}
+			defer s.Stop()
+
+			rt := &recordingTB{TB: t}
+			c := NewClient()
+			c.Connection().
+				WithStub(spb.NewGRIBIClient(s.Conn())).
+				WithRedundancyMode(ElectedPrimaryClient).
+				WithInitialElectionID(1, 0).
+				WithPersistence().
+				WithFailOnUncheckedErrors(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			c.Start(ctx, t)
+			c.StartSending(ctx, t)
+
+			// The second entry is within a network instance that does not
+			// exist, and hence fails.
+			entries := []GRIBIEntry{
+				NextHopEntry().WithNetworkInstance(server.DefaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"),
+				NextHopEntry().WithNetworkInstance("VRF-UNKNOWN").WithIndex(2).WithIPAddress("192.0.2.2"),
+			}
+			var b *gRIBIBatch
+			if tt.inBatch {
+				b = c.Modify().AddBatch(t, entries)
+			} else {
+				c.Modify().AddEntry(t, entries...)
+			}
+			if err := c.Await(ctx, t); err != nil {
+				t.Fatalf("cannot program entries, %v", err)
+			}
+			if b != nil {
+				b.BatchResult(t)
+			}
+			tt.inCheckFn(c, c.Results(t))
+
+			// Unchecked failures are reported to the test that stops the
+			// client.
+			c.Stop(rt)
+			if gotErr := len(rt.errs) != 0; gotErr != tt.wantErr {
+				t.Fatalf("Stop(): did not get expected error, got: %v, wantErr? %v", rt.errs, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(rt.errs[0], "1 failed results") {
+				t.Fatalf("Stop(): did not get error listing the failed result, got: %s", rt.errs[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,569 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"runtime"
+	"sort"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// Entry is an entry that is added to the RIB by BulkAdd.
+type Entry struct {
+	// NetworkInstance is the name of the network instance that the entry is
+	// added to, where an empty name refers to the default network instance.
+	NetworkInstance string
+	// Op is the operation that adds the entry, which must be an ADD or a
+	// REPLACE. Its ID and election ID are recorded in the metadata of the
+	// entry.
+	Op *spb.AFTOperation
+}
+
+// BulkOpt is an interface implemented by options that modify the behaviour of
+// BulkAdd.
+type BulkOpt interface {
+	isBulkOpt()
+}
+
+// WithAtomicBatch specifies that BulkAdd should not add any of the entries within
+// the batch if one or more of them cannot be added.
+func WithAtomicBatch() *atomicBatch { return &atomicBatch{} }
+
+// atomicBatch is the internal implementation of the WithAtomicBatch option.
+type atomicBatch struct{}
+
+// isBulkOpt implements the BulkOpt interface.
+func (*atomicBatch) isBulkOpt() {}
+
+// hasAtomicBatch returns true if the BulkOpt slice supplied contains the
+// atomicBatch option.
+func hasAtomicBatch(opt []BulkOpt) bool {
+	for _, o := range opt {
+		if _, ok := o.(*atomicBatch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bulkEntry is an entry that is being added by BulkAdd.
+type bulkEntry struct {
+	// i is the index of the entry within the batch.
+	i int
+	// ni is the name of the network instance that the entry is added to.
+	ni string
+	// op is the operation that adds the entry.
+	op *spb.AFTOperation
+	// aft and key identify the entry within the network instance.
+	aft constants.AFT
+	key any
+	// entry is the entry that is added, as an AFT GoStruct.
+	entry ygot.GoStruct
+	// orig is the entry that was replaced, it is nil if there was no entry.
+	orig ygot.GoStruct
+}
+
+// BulkAdd adds entries to the RIB as a single batch, and is intended for
+// populating the RIB with a large number of entries, for example, when setting up
+// a test. The references of each entry are validated against the contents of the
+// RIB along with the other entries within the batch, such that an entry may
+// reference an entry that appears later in entries. The write lock of each network
+// instance is acquired once, and the entries are installed in dependency order -
+// next-hops, followed by next-hop-groups, followed by all other entries - with the
+// reference counts and prefix index of each network instance being updated.
+//
+// It returns the error for each entry, in the same order as entries, which is nil
+// for each entry that was added. An entry that cannot be added does not prevent the
+// remaining entries from being added, unless the WithAtomicBatch option is
+// specified, in which case no entries are added and an error is also returned. An
+// error is returned, and no entries are added, if ctx is done before the entries
+// are installed.
+//
+// The entries that are added are recorded in the journal and the entry metadata of
+// the RIB, and the ResolvabilityFn is called as for other mutations. The
+// post-change and resolved entry hooks are not called, DerivationFns are not run,
+// and pending operations are not retried. Whether next-hops that are recursively
+// resolved via a prefix within the batch loop is not checked.
+func (r *RIB) BulkAdd(ctx context.Context, entries []Entry, opt ...BulkOpt) ([]error, error) {
+	errs := make([]error, len(entries))
+	converted, err := r.bulkEntries(ctx, entries, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	// Entries are installed in dependency order, next-hop-groups reference
+	// next-hops, and all other entries reference next-hop-groups.
+	rank := func(a constants.AFT) int {
+		switch a {
+		case constants.NextHop:
+			return 0
+		case constants.NextHopGroup:
+			return 1
+		}
+		return 2
+	}
+	ordered := make([]*bulkEntry, 0, len(converted))
+	for _, b := range converted {
+		if b != nil {
+			ordered = append(ordered, b)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return rank(ordered[i].aft) < rank(ordered[j].aft) })
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.nrMu.RLock()
+	// Locks are acquired in a consistent order to avoid deadlocking with other
+	// callers.
+	names := []string{}
+	for n := range r.niRIB {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		r.niRIB[n].mu.Lock()
+	}
+	unlock := func() {
+		for _, n := range names {
+			r.niRIB[n].mu.Unlock()
+		}
+		r.nrMu.RUnlock()
+	}
+
+	valid := r.bulkValidate(ordered, errs)
+	if hasAtomicBatch(opt) {
+		invalid := 0
+		for _, err := range errs {
+			if err != nil {
+				invalid++
+			}
+		}
+		if invalid != 0 {
+			unlock()
+			return errs, fmt.Errorf("cannot add batch, %d of %d entries cannot be added", invalid, len(entries))
+		}
+	}
+	for _, b := range valid {
+		r.bulkInstall(b)
+	}
+	unlock()
+
+	var seq uint64
+	ids := make([]entryID, 0, len(valid))
+	for _, b := range valid {
+		r.setEntryMetadata(b.ni, "", b.aft, b.key, b.op)
+		niR, _ := r.NetworkInstanceRIB(b.ni)
+		seq = r.recordAdded(niR, b.ni, "", b.aft, b.key, b.orig, b.op)
+		ids = append(ids, newEntryID(b.ni, b.aft, b.key))
+	}
+
+	// The stored resolution of next-hops is updated such that subsequent changes
+	// are evaluated correctly. The next-hops that are considered are those that
+	// were added, and those whose resolution may be changed by the prefixes and
+	// next-hop-groups within the batch.
+	if r.ribCheck && len(valid) != 0 {
+		scope := resolutionScope{}
+		for _, b := range valid {
+			switch e := b.entry.(type) {
+			case *aft.Afts_NextHop:
+				scope.nextHops = append(scope.nextHops, nhKey{ni: b.ni, index: b.key.(uint64)})
+			case *aft.Afts_NextHopGroup:
+				for i := range e.NextHop {
+					scope.nextHops = append(scope.nextHops, nhKey{ni: b.ni, index: i})
+				}
+				if orig, ok := b.orig.(*aft.Afts_NextHopGroup); ok && orig != nil {
+					for i := range orig.NextHop {
+						scope.nextHops = append(scope.nextHops, nhKey{ni: b.ni, index: i})
+					}
+				}
+			case *aft.Afts_Ipv4Entry, *aft.Afts_Ipv6Entry:
+				ps := prefixScope(b.ni, b.key.(string))
+				scope.prefixes = append(scope.prefixes, ps.prefixes...)
+			}
+		}
+		if _, err := r.resolutionChanges(scope); err != nil {
+			log.Errorf("cannot update resolution of next-hops following bulk add, %v", err)
+		}
+	}
+	r.updateResolvability(seq, ids...)
+
+	return errs, nil
+}
+
+// bulkEntries converts each of the entries to a bulkEntry, concurrently. The
+// returned slice is in the same order as entries, and contains nil for each entry
+// that cannot be converted, for which the error is stored in errs. It returns an
+// error if ctx is done before all entries are converted.
+func (r *RIB) bulkEntries(ctx context.Context, entries []Entry, errs []error) ([]*bulkEntry, error) {
+	converted := make([]*bulkEntry, len(entries))
+	workers := runtime.GOMAXPROCS(0)
+	chunk := (len(entries) + workers - 1) / workers
+
+	var wg sync.WaitGroup
+	for start := 0; start < len(entries); start += chunk {
+		end := start + chunk
+		if end > len(entries) {
+			end = len(entries)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				// Check periodically whether the caller has given up.
+				if i%1024 == 0 && ctx.Err() != nil {
+					return
+				}
+				converted[i], errs[i] = r.bulkEntry(i, entries[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return converted, nil
+}
+
+// bulkEntry converts the entry e, at index i within the batch, to a bulkEntry.
+// It returns an error if the entry is not valid.
+func (r *RIB) bulkEntry(i int, e Entry) (*bulkEntry, error) {
+	op := e.Op
+	switch op.GetOp() {
+	case spb.AFTOperation_ADD, spb.AFTOperation_REPLACE:
+	default:
+		return nil, fmt.Errorf("unsupported operation %s, only ADD and REPLACE are supported", op.GetOp())
+	}
+
+	ni := e.NetworkInstance
+	if ni == "" {
+		ni = r.defaultName
+	}
+	b := &bulkEntry{i: i, ni: ni, op: op}
+	b.aft, b.key = operationKey(op)
+
+	// Prefixes that use only the common fields are converted directly, since
+	// this is significantly faster than populating and validating the
+	// candidate RIB.
+	switch t := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		if v := fastIPv4(t.Ipv4); v != nil {
+			b.entry = v
+			return b, nil
+		}
+	case *spb.AFTOperation_Ipv6:
+		if v := fastIPv6(t.Ipv6); v != nil {
+			b.entry = v
+			return b, nil
+		}
+	}
+
+	a := &aftpb.Afts{}
+	switch t := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		a.Ipv4Entry = []*aftpb.Afts_Ipv4EntryKey{t.Ipv4}
+	case *spb.AFTOperation_Ipv6:
+		a.Ipv6Entry = []*aftpb.Afts_Ipv6EntryKey{t.Ipv6}
+	case *spb.AFTOperation_Mpls:
+		a.LabelEntry = []*aftpb.Afts_LabelEntryKey{t.Mpls}
+	case *spb.AFTOperation_NextHopGroup:
+		a.NextHopGroup = []*aftpb.Afts_NextHopGroupKey{t.NextHopGroup}
+	case *spb.AFTOperation_NextHop:
+		a.NextHop = []*aftpb.Afts_NextHopKey{t.NextHop}
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		a.PolicyForwardingEntry = []*aftpb.Afts_PolicyForwardingEntryKey{t.PolicyForwardingEntry}
+	default:
+		return nil, fmt.Errorf("unsupported entry type in operation, %T", t)
+	}
+
+	nr, err := candidateRIB(a)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry in operation, %v", err)
+	}
+	caft := nr.GetAfts()
+	if err := checkCandidate(caft); err != nil {
+		return nil, err
+	}
+	for _, v := range caft.Ipv4Entry {
+		b.entry = v
+	}
+	for _, v := range caft.Ipv6Entry {
+		b.entry = v
+	}
+	for _, v := range caft.LabelEntry {
+		b.entry = v
+	}
+	for _, v := range caft.NextHopGroup {
+		b.entry = v
+	}
+	for _, v := range caft.NextHop {
+		b.entry = v
+	}
+	for _, v := range caft.PolicyForwardingEntry {
+		b.entry = v
+	}
+	return b, nil
+}
+
+// fastIPv4 returns the IPv4 entry e as an AFT GoStruct if it specifies only its
+// prefix, in canonical form, and its next-hop-group. It returns nil otherwise.
+func fastIPv4(e *aftpb.Afts_Ipv4EntryKey) *aft.Afts_Ipv4Entry {
+	p := e.GetIpv4Entry()
+	if p.GetDecapsulateHeader() != 0 || p.GetEntryMetadata() != nil || !canonicalPrefix(e.GetPrefix(), true) {
+		return nil
+	}
+	v := &aft.Afts_Ipv4Entry{Prefix: ygot.String(e.GetPrefix())}
+	if nhg := p.GetNextHopGroup(); nhg != nil {
+		v.NextHopGroup = ygot.Uint64(nhg.GetValue())
+	}
+	if ni := p.GetNextHopGroupNetworkInstance(); ni != nil {
+		v.NextHopGroupNetworkInstance = ygot.String(ni.GetValue())
+	}
+	return v
+}
+
+// fastIPv6 returns the IPv6 entry e as an AFT GoStruct if it specifies only its
+// prefix, in canonical form, and its next-hop-group. It returns nil otherwise.
+func fastIPv6(e *aftpb.Afts_Ipv6EntryKey) *aft.Afts_Ipv6Entry {
+	p := e.GetIpv6Entry()
+	if p.GetDecapsulateHeader() != 0 || p.GetEntryMetadata() != nil || !canonicalPrefix(e.GetPrefix(), false) {
+		return nil
+	}
+	v := &aft.Afts_Ipv6Entry{Prefix: ygot.String(e.GetPrefix())}
+	if nhg := p.GetNextHopGroup(); nhg != nil {
+		v.NextHopGroup = ygot.Uint64(nhg.GetValue())
+	}
+	if ni := p.GetNextHopGroupNetworkInstance(); ni != nil {
+		v.NextHopGroupNetworkInstance = ygot.String(ni.GetValue())
+	}
+	return v
+}
+
+// canonicalPrefix returns true if s is an IPv4 prefix, if v4 is true, or an IPv6
+// prefix otherwise, written in its canonical form.
+func canonicalPrefix(s string, v4 bool) bool {
+	p, err := netip.ParsePrefix(s)
+	if err != nil || p.String() != s {
+		return false
+	}
+	if v4 {
+		return p.Addr().Is4()
+	}
+	return p.Addr().Is6() && !p.Addr().Is4In6()
+}
+
+// bulkValidate determines which of the entries, which are in dependency order,
+// can be added to the RIB, storing an error in errs for each entry that cannot.
+// The references of each entry are resolved against the RIB, and the entries
+// that precede it. It returns the entries that can be added. The caller MUST hold
+// nrMu, and the write lock of each network instance RIB.
+func (r *RIB) bulkValidate(entries []*bulkEntry, errs []error) []*bulkEntry {
+	added := map[entryID]bool{}
+	exists := func(ni string, a constants.AFT, key any) bool {
+		if added[newEntryID(ni, a, key)] {
+			return true
+		}
+		niR, ok := r.niRIB[ni]
+		return ok && locklessEntryExists(niR, a, key)
+	}
+
+	valid := make([]*bulkEntry, 0, len(entries))
+	for _, b := range entries {
+		if err := r.bulkCheck(b, exists); err != nil {
+			errs[b.i] = err
+			continue
+		}
+		added[newEntryID(b.ni, b.aft, b.key)] = true
+		valid = append(valid, b)
+	}
+	return valid
+}
+
+// bulkCheck returns an error if the entry b cannot be added to the RIB, using
+// exists to determine whether an entry that it references exists. The caller
+// MUST hold nrMu.
+func (r *RIB) bulkCheck(b *bulkEntry, exists func(string, constants.AFT, any) bool) error {
+	niR, ok := r.niRIB[b.ni]
+	// IsValid cannot be used, since the write lock is already held.
+	if !ok || niR.name == "" || niR.r.GetAfts() == nil {
+		return fmt.Errorf("invalid network instance, %s", b.ni)
+	}
+	if b.op.GetOp() == spb.AFTOperation_REPLACE && !exists(b.ni, b.aft, b.key) {
+		return fmt.Errorf("cannot replace %s entry %v, does not exist", b.aft, b.key)
+	}
+	if !r.ribCheck {
+		return nil
+	}
+
+	switch e := b.entry.(type) {
+	case *aft.Afts_NextHop:
+		if e.GetIndex() == 0 {
+			return fmt.Errorf("invalid index zero for next-hop in NI %s", b.ni)
+		}
+		if nhNI := e.GetNetworkInstance(); nhNI != "" {
+			if _, ok := r.niRIB[nhNI]; !ok {
+				return fmt.Errorf("invalid unknown network-instance %s for next-hop %d in NI %s", nhNI, e.GetIndex(), b.ni)
+			}
+		}
+	case *aft.Afts_NextHopGroup:
+		if e.GetId() == 0 {
+			return fmt.Errorf("invalid zero-index NHG")
+		}
+		for idx := range e.NextHop {
+			if idx == 0 {
+				return fmt.Errorf("invalid zero index NH in NHG %d, NI %s", e.GetId(), b.ni)
+			}
+			if !exists(b.ni, constants.NextHop, idx) {
+				return fmt.Errorf("unresolved reference to next-hop %d in NHG %d, NI %s", idx, e.GetId(), b.ni)
+			}
+		}
+	case topLevelEntryStruct:
+		if e.GetNextHopGroup() == 0 {
+			return fmt.Errorf("invalid zero-index NHG in %s entry %v, NI %s", b.aft, b.key, b.ni)
+		}
+		nhgNI := b.ni
+		if n := e.GetNextHopGroupNetworkInstance(); n != "" {
+			if _, ok := r.niRIB[n]; !ok {
+				return fmt.Errorf("invalid unknown network-instance for entry, %s", n)
+			}
+			nhgNI = n
+		}
+		if !exists(nhgNI, constants.NextHopGroup, e.GetNextHopGroup()) {
+			return fmt.Errorf("unresolved reference to NHG %d in %s entry %v, NI %s", e.GetNextHopGroup(), b.aft, b.key, b.ni)
+		}
+	}
+	return nil
+}
+
+// locklessEntryExists returns true if the entry with key key exists within the
+// AFT a of the network instance RIB niR. The caller MUST hold the relevant lock.
+func locklessEntryExists(niR *RIBHolder, a constants.AFT, key any) bool {
+	afts := niR.r.GetAfts()
+	var ok bool
+	switch a {
+	case constants.IPv4:
+		_, ok = afts.Ipv4Entry[key.(string)]
+	case constants.IPv6:
+		_, ok = afts.Ipv6Entry[key.(string)]
+	case constants.MPLS:
+		_, ok = afts.LabelEntry[aft.UnionUint32(key.(uint64))]
+	case constants.NextHopGroup:
+		_, ok = afts.NextHopGroup[key.(uint64)]
+	case constants.NextHop:
+		_, ok = afts.NextHop[key.(uint64)]
+	case constants.PolicyForwarding:
+		_, ok = afts.PolicyForwardingEntry[key.(uint64)]
+	}
+	return ok
+}
+
+// bulkInstall installs the entry b, which has been validated, within its network
+// instance RIB, and updates the reference counts of the entries that it references,
+// recording the entry that it replaced. The caller MUST hold nrMu, and the write
+// lock of each network instance RIB.
+func (r *RIB) bulkInstall(b *bulkEntry) {
+	niR := r.niRIB[b.ni]
+	niR.unshare(b.aft)
+	afts := niR.r.GetOrCreateAfts()
+
+	switch e := b.entry.(type) {
+	case *aft.Afts_Ipv4Entry:
+		if orig, ok := swapEntry(&afts.Ipv4Entry, e.GetPrefix(), e); ok {
+			b.orig = orig
+		}
+		niR.indexPrefix(e.GetPrefix())
+	case *aft.Afts_Ipv6Entry:
+		if orig, ok := swapEntry(&afts.Ipv6Entry, e.GetPrefix(), e); ok {
+			b.orig = orig
+		}
+		niR.indexPrefix(e.GetPrefix())
+	case *aft.Afts_LabelEntry:
+		if orig, ok := swapEntry(&afts.LabelEntry, e.Label, e); ok {
+			b.orig = orig
+		}
+	case *aft.Afts_PolicyForwardingEntry:
+		if orig, ok := swapEntry(&afts.PolicyForwardingEntry, e.GetIndex(), e); ok {
+			b.orig = orig
+		}
+	case *aft.Afts_NextHopGroup:
+		orig, ok := swapEntry(&afts.NextHopGroup, e.GetId(), e)
+		for idx := range e.NextHop {
+			niR.incNHRefCount(idx)
+		}
+		if ok {
+			b.orig = orig
+			for idx := range orig.NextHop {
+				niR.decNHRefCount(idx)
+			}
+		}
+	case *aft.Afts_NextHop:
+		if orig, ok := swapEntry(&afts.NextHop, e.GetIndex(), e); ok {
+			b.orig = orig
+		}
+	}
+
+	// Entries other than next-hops and next-hop-groups reference a
+	// next-hop-group, which may be within another network instance.
+	if e, ok := b.entry.(topLevelEntryStruct); ok {
+		if rr := r.bulkNHGRef(b.ni, e); rr != nil {
+			rr.incNHGRefCount(e.GetNextHopGroup())
+		}
+		if orig, ok := b.orig.(topLevelEntryStruct); ok {
+			if rr := r.bulkNHGRef(b.ni, orig); rr != nil {
+				rr.decNHGRefCount(orig.GetNextHopGroup())
+			}
+		}
+	}
+}
+
+// bulkNHGRef returns the network instance RIB that contains the next-hop-group
+// referenced by the entry e within network instance ni. It returns nil if the
+// network instance does not exist. The caller MUST hold nrMu.
+func (r *RIB) bulkNHGRef(ni string, e topLevelEntryStruct) *RIBHolder {
+	if n := e.GetNextHopGroupNetworkInstance(); n != "" {
+		ni = n
+	}
+	niR, ok := r.niRIB[ni]
+	if !ok {
+		log.Errorf("cannot find network instance %s", ni)
+		return nil
+	}
+	return niR
+}
+
+// swapEntry stores the value v with key k within the map m, which is created if it
+// is nil. It returns the value that was previously stored, and whether there was
+// one.
+func swapEntry[K comparable, V any](m *map[K]V, k K, v V) (V, bool) {
+	if *m == nil {
+		*m = map[K]V{}
+	}
+	orig, ok := (*m)[k]
+	(*m)[k] = v
+	return orig, ok
+}
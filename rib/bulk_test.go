@@ -0,0 +1,254 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/openconfig/gribigo/constants"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+// bulkEntries returns Entry values adding each of the operations ops to the
+// network instance ni.
+func bulkEntries(ni string, ops ...*spb.AFTOperation) []Entry {
+	entries := make([]Entry, 0, len(ops))
+	for _, op := range ops {
+		entries = append(entries, Entry{NetworkInstance: ni, Op: op})
+	}
+	return entries
+}
+
+func TestBulkAdd(t *testing.T) {
+	const vrf = "VRF-A"
+
+	// crossNI is an IPv4 entry that references a next-hop-group within the
+	// default network instance.
+	crossNI := ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 2)
+	crossNI.GetIpv4().GetIpv4Entry().NextHopGroupNetworkInstance = &wpb.StringValue{Value: defName}
+
+	tests := []struct {
+		desc string
+		// inEntries are the entries that are added to the RIB, which is
+		// pre-populated with next-hop 1 and next-hop-group 1 in the default
+		// network instance.
+		inEntries []Entry
+		inOpts    []BulkOpt
+		// wantErrSubs is the substring of the error expected for each entry,
+		// an empty string indicates that the entry is expected to be added.
+		wantErrSubs []string
+		// wantErr indicates whether an error is expected for the batch.
+		wantErr bool
+		// wantCounts is the number of entries in each AFT of the default
+		// network instance following the add.
+		wantCounts map[constants.AFT]uint64
+	}{{
+		desc: "forward references within batch",
+		inEntries: bulkEntries(defName,
+			ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 2),
+			ipv4Op(spb.AFTOperation_ADD, "198.51.101.0/24", 1),
+			nhgOp(2, 2),
+			nhOp(2, "192.0.2.2", ""),
+		),
+		wantErrSubs: []string{"", "", "", ""},
+		wantCounts: map[constants.AFT]uint64{
+			constants.IPv4:         2,
+			constants.NextHopGroup: 2,
+			constants.NextHop:      2,
+		},
+	}, {
+		desc: "reference to next-hop-group in another network instance",
+		inEntries: append(
+			bulkEntries(vrf, crossNI),
+			bulkEntries(defName, nhgOp(2, 1))...,
+		),
+		wantErrSubs: []string{"", ""},
+		wantCounts: map[constants.AFT]uint64{
+			constants.NextHopGroup: 2,
+			constants.NextHop:      1,
+		},
+	}, {
+		desc: "invalid entries do not prevent others being added",
+		inEntries: bulkEntries(defName,
+			ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 42),
+			ipv4Op(spb.AFTOperation_ADD, "198.51.101.0/24", 1),
+			ipv4Op(spb.AFTOperation_DELETE, "198.51.102.0/24", 1),
+			ipv4Op(spb.AFTOperation_REPLACE, "198.51.103.0/24", 1),
+			nhgOp(3, 3),
+			ipv4Op(spb.AFTOperation_ADD, "198.51.104.0/24", 3),
+		),
+		wantErrSubs: []string{
+			"unresolved reference to NHG 42",
+			"",
+			"unsupported operation DELETE",
+			"does not exist",
+			"unresolved reference to next-hop 3",
+			"unresolved reference to NHG 3",
+		},
+		wantCounts: map[constants.AFT]uint64{
+			constants.IPv4:         1,
+			constants.NextHopGroup: 1,
+			constants.NextHop:      1,
+		},
+	}, {
+		desc: "atomic batch with invalid entry",
+		inEntries: bulkEntries(defName,
+			nhOp(2, "192.0.2.2", ""),
+			ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 42),
+		),
+		inOpts:      []BulkOpt{WithAtomicBatch()},
+		wantErrSubs: []string{"", "unresolved reference to NHG 42"},
+		wantErr:     true,
+		wantCounts: map[constants.AFT]uint64{
+			constants.NextHopGroup: 1,
+			constants.NextHop:      1,
+		},
+	}, {
+		desc: "atomic batch with valid entries",
+		inEntries: bulkEntries(defName,
+			ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 2),
+			nhgOp(2, 2),
+			nhOp(2, "192.0.2.2", ""),
+		),
+		inOpts:      []BulkOpt{WithAtomicBatch()},
+		wantErrSubs: []string{"", "", ""},
+		wantCounts: map[constants.AFT]uint64{
+			constants.IPv4:         1,
+			constants.NextHopGroup: 2,
+			constants.NextHop:      2,
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := New(defName)
+			if err := r.AddNetworkInstance(vrf); err != nil {
+				t.Fatalf("cannot add network instance, %v", err)
+			}
+			applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""), nhgOp(1, 1))
+
+			errs, err := r.BulkAdd(context.Background(), tt.inEntries, tt.inOpts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BulkAdd(): did not get expected error, got: %v, wantErr? %v", err, tt.wantErr)
+			}
+			if len(errs) != len(tt.wantErrSubs) {
+				t.Fatalf("BulkAdd(): did not get expected number of errors, got: %d (%v), want: %d", len(errs), errs, len(tt.wantErrSubs))
+			}
+			for i, want := range tt.wantErrSubs {
+				switch got := errs[i]; {
+				case want == "" && got != nil:
+					t.Errorf("BulkAdd(): entry %d: got unexpected error, %v", i, got)
+				case want != "" && (got == nil || !strings.Contains(got.Error(), want)):
+					t.Errorf("BulkAdd(): entry %d: did not get expected error, got: %v, want substring: %s", i, got, want)
+				}
+			}
+
+			niR, _ := r.NetworkInstanceRIB(defName)
+			got := niR.EntryCounts()
+			for a, want := range tt.wantCounts {
+				if got[a] != want {
+					t.Errorf("BulkAdd(): did not get expected number of %s entries, got: %d, want: %d", a, got[a], want)
+				}
+			}
+		})
+	}
+}
+
+func TestBulkAddState(t *testing.T) {
+	r := New(defName, WithJournal(10))
+	errs, err := r.BulkAdd(context.Background(), bulkEntries(defName,
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/25", 1),
+		nhgOp(1, 1),
+		nhOp(1, "192.0.2.1", "eth0"),
+	))
+	if err != nil {
+		t.Fatalf("BulkAdd(): got unexpected error, %v", err)
+	}
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("BulkAdd(): entry %d: got unexpected error, %v", i, err)
+		}
+	}
+
+	// The reference counts prevent referenced entries from being removed.
+	if got, err := r.NHGReferences(defName, 1); err != nil || got != 2 {
+		t.Errorf("NHGReferences(%s, 1): did not get expected references, got: %d, err: %v, want: 2", defName, got, err)
+	}
+	if got, err := r.NHReferences(defName, 1); err != nil || got != 1 {
+		t.Errorf("NHReferences(%s, 1): did not get expected references, got: %d, err: %v, want: 1", defName, got, err)
+	}
+	if _, fails, err := r.DeleteEntry(defName, nhgOp(1, 1)); err != nil || len(fails) != 1 {
+		t.Errorf("DeleteEntry(): did not get expected failure deleting referenced NHG, fails: %v, err: %v", fails, err)
+	}
+
+	// The prefixes are indexed for longest-prefix-match lookups.
+	res, err := r.Lookup(defName, netip.MustParseAddr("198.51.100.1"))
+	if err != nil {
+		t.Fatalf("Lookup(): got unexpected error, %v", err)
+	}
+	if want := "198.51.100.0/25"; res.Prefix != want {
+		t.Errorf("Lookup(): did not get expected prefix, got: %s, want: %s", res.Prefix, want)
+	}
+
+	// Each entry is recorded in the journal, in the order in which it was
+	// installed.
+	got := []string{}
+	for _, e := range r.Journal(0) {
+		got = append(got, fmt.Sprintf("%s %s", e.AFT, e.Key))
+	}
+	want := []string{"NextHop 1", "NextHopGroup 1", "IPv4 198.51.100.0/24", "IPv4 198.51.100.0/25"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("Journal(0): did not get expected entries, got: %v, want: %v", got, want)
+	}
+}
+
+func TestBulkAddCancelled(t *testing.T) {
+	r := New(defName)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.BulkAdd(ctx, bulkEntries(defName, nhOp(1, "192.0.2.1", ""))); err == nil {
+		t.Fatalf("BulkAdd(): did not get expected error for cancelled context")
+	}
+	niR, _ := r.NetworkInstanceRIB(defName)
+	if got := niR.EntryCounts()[constants.NextHop]; got != 0 {
+		t.Errorf("BulkAdd(): did not get expected number of next-hops, got: %d, want: 0", got)
+	}
+}
+
+// BenchmarkBulkAdd measures the time taken to add one million prefixes to the
+// RIB using BulkAdd.
+func BenchmarkBulkAdd(b *testing.B) {
+	const n = 1000000
+	entries := bulkEntries(defName, nhOp(1, "192.0.2.1", "eth0"), nhgOp(1, 1))
+	for i := 0; i < n; i++ {
+		p := fmt.Sprintf("%d.%d.%d.0/24", 10+i>>16, (i>>8)&255, i&255)
+		entries = append(entries, Entry{NetworkInstance: defName, Op: ipv4Op(spb.AFTOperation_ADD, p, 1)})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := New(defName)
+		if _, err := r.BulkAdd(context.Background(), entries); err != nil {
+			b.Fatalf("cannot add entries, %v", err)
+		}
+	}
+}
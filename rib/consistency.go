@@ -0,0 +1,325 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/openconfig/gribigo/constants"
+)
+
+// ViolationType is the type of inconsistency that is described by a Violation.
+type ViolationType string
+
+const (
+	// ViolationMissingNextHopGroup indicates that an IPv4, IPv6, MPLS or
+	// policy-forwarding entry references a next-hop-group that does not exist.
+	ViolationMissingNextHopGroup ViolationType = "MISSING_NEXT_HOP_GROUP"
+	// ViolationMissingNextHop indicates that a next-hop-group contains a
+	// next-hop that does not exist.
+	ViolationMissingNextHop ViolationType = "MISSING_NEXT_HOP"
+	// ViolationReferenceCount indicates that the reference count of a
+	// next-hop-group or next-hop does not match the number of entries that
+	// reference it.
+	ViolationReferenceCount ViolationType = "REFERENCE_COUNT"
+	// ViolationOrphanedReferenceCount indicates that a reference count is
+	// stored for a next-hop-group or next-hop that neither exists, nor is
+	// referenced by any entry - for example, since it was not removed when the
+	// entries that referenced it were deleted.
+	ViolationOrphanedReferenceCount ViolationType = "ORPHANED_REFERENCE_COUNT"
+	// ViolationPrefixIndex indicates that the index used for longest-prefix-match
+	// lookups does not match the IPv4 and IPv6 entries within the RIB.
+	ViolationPrefixIndex ViolationType = "PREFIX_INDEX"
+)
+
+// Violation describes an inconsistency within the RIB.
+type Violation struct {
+	// Type is the type of the inconsistency.
+	Type ViolationType
+	// NetworkInstance, AFT and Key identify the entry that is inconsistent -
+	// the entry with the missing reference, the next-hop-group or next-hop
+	// whose reference count is incorrect, or the prefix that is incorrectly
+	// indexed.
+	NetworkInstance string
+	AFT             constants.AFT
+	Key             string
+	// Expected and Actual describe the expected and actual state of the
+	// entry.
+	Expected, Actual string
+}
+
+// String returns a human-readable description of the violation.
+func (v *Violation) String() string {
+	return fmt.Sprintf("%s: %s %s in NI %s, expected: %s, actual: %s", v.Type, v.AFT, v.Key, v.NetworkInstance, v.Expected, v.Actual)
+}
+
+// ConsistencyReport is the result of checking the consistency of the RIB.
+type ConsistencyReport struct {
+	// Violations are the inconsistencies that were found, sorted by network
+	// instance, type, AFT and key.
+	Violations []*Violation
+}
+
+// Consistent returns true if no inconsistencies were found.
+func (c *ConsistencyReport) Consistent() bool {
+	return len(c.Violations) == 0
+}
+
+// String returns a human-readable description of the violations within the
+// report, one per line.
+func (c *ConsistencyReport) String() string {
+	s := []string{}
+	for _, v := range c.Violations {
+		s = append(s, v.String())
+	}
+	return strings.Join(s, "\n")
+}
+
+// nhgReference is a reference from an entry to a next-hop-group.
+type nhgReference struct {
+	// aft and key identify the referencing entry.
+	aft constants.AFT
+	key string
+	// ni and id identify the referenced next-hop-group.
+	ni string
+	id uint64
+}
+
+// consistencyState is the state of a single network instance that is used to
+// check the consistency of the RIB.
+type consistencyState struct {
+	// refs are the references to next-hop-groups from entries within the
+	// network instance.
+	refs []nhgReference
+	// nhgs maps the ID of each next-hop-group to the indices of its next-hops.
+	nhgs map[uint64][]uint64
+	// nhs is the set of next-hop indices.
+	nhs map[uint64]bool
+	// prefixes is the set of IPv4 and IPv6 prefixes, and indexed is the set of
+	// prefixes within the prefix index.
+	prefixes, indexed map[string]bool
+	// nhgCounts and nhCounts are the non-zero reference counts of
+	// next-hop-groups and next-hops.
+	nhgCounts, nhCounts map[uint64]uint64
+}
+
+// CheckConsistency checks that the contents of the RIB are internally consistent,
+// and returns a report describing each inconsistency that is found. It checks
+// that:
+//   - the next-hop-group referenced by each IPv4, IPv6, MPLS and
+//     policy-forwarding entry exists,
+//   - the next-hops within each next-hop-group exist,
+//   - the reference count of each next-hop-group and next-hop matches the
+//     number of entries that reference it, and no reference counts are stored
+//     for entries that neither exist nor are referenced,
+//   - the index used for longest-prefix-match lookups contains exactly the
+//     IPv4 and IPv6 entries of each network instance.
+//
+// Each network instance is read-locked in turn whilst its state is collected,
+// such that the RIB is not frozen whilst it is checked. Since network instances
+// are not read at a single point in time, the RIB should not be modified whilst
+// CheckConsistency runs for the report to be accurate.
+func (r *RIB) CheckConsistency() *ConsistencyReport {
+	r.nrMu.RLock()
+	holders := make(map[string]*RIBHolder, len(r.niRIB))
+	for n, h := range r.niRIB {
+		holders[n] = h
+	}
+	r.nrMu.RUnlock()
+
+	states := make(map[string]*consistencyState, len(holders))
+	for n, h := range holders {
+		states[n] = h.consistencyState()
+	}
+
+	report := &ConsistencyReport{}
+	add := func(t ViolationType, ni string, a constants.AFT, key any, expected, actual string) {
+		report.Violations = append(report.Violations, &Violation{
+			Type:            t,
+			NetworkInstance: ni,
+			AFT:             a,
+			Key:             fmt.Sprintf("%v", key),
+			Expected:        expected,
+			Actual:          actual,
+		})
+	}
+
+	// Determine the number of references to each next-hop-group and next-hop,
+	// keyed by network instance.
+	nhgRefs, nhRefs := map[string]map[uint64]uint64{}, map[string]map[uint64]uint64{}
+	count := func(m map[string]map[uint64]uint64, ni string, id uint64) {
+		if m[ni] == nil {
+			m[ni] = map[uint64]uint64{}
+		}
+		m[ni][id]++
+	}
+	for ni, s := range states {
+		for _, ref := range s.refs {
+			count(nhgRefs, ref.ni, ref.id)
+			if rs, ok := states[ref.ni]; !ok || rs.nhgs[ref.id] == nil {
+				add(ViolationMissingNextHopGroup, ni, ref.aft, ref.key, fmt.Sprintf("NHG %d exists in NI %s", ref.id, ref.ni), "does not exist")
+			}
+		}
+		for id, nhs := range s.nhgs {
+			for _, idx := range nhs {
+				count(nhRefs, ni, idx)
+				if !s.nhs[idx] {
+					add(ViolationMissingNextHop, ni, constants.NextHopGroup, id, fmt.Sprintf("NH %d exists", idx), "does not exist")
+				}
+			}
+		}
+	}
+
+	// checkCounts compares the reference counts of the entries within the AFT a
+	// of network instance ni, where exists determines whether an entry exists.
+	checkCounts := func(ni string, a constants.AFT, want, got map[uint64]uint64, exists func(uint64) bool) {
+		ids := map[uint64]bool{}
+		for id := range want {
+			ids[id] = true
+		}
+		for id := range got {
+			ids[id] = true
+		}
+		for id := range ids {
+			switch {
+			case want[id] == got[id]:
+			case want[id] == 0 && !exists(id):
+				add(ViolationOrphanedReferenceCount, ni, a, id, "no reference count", fmt.Sprintf("%d references", got[id]))
+			default:
+				add(ViolationReferenceCount, ni, a, id, fmt.Sprintf("%d references", want[id]), fmt.Sprintf("%d references", got[id]))
+			}
+		}
+	}
+	for ni, s := range states {
+		checkCounts(ni, constants.NextHopGroup, nhgRefs[ni], s.nhgCounts, func(id uint64) bool { return s.nhgs[id] != nil })
+		checkCounts(ni, constants.NextHop, nhRefs[ni], s.nhCounts, func(idx uint64) bool { return s.nhs[idx] })
+
+		for p := range s.prefixes {
+			if !s.indexed[p] {
+				add(ViolationPrefixIndex, ni, prefixAFT(p), p, "indexed", "not indexed")
+			}
+		}
+		for p := range s.indexed {
+			if !s.prefixes[p] {
+				add(ViolationPrefixIndex, ni, prefixAFT(p), p, "not indexed", "indexed")
+			}
+		}
+	}
+
+	sort.Slice(report.Violations, func(i, j int) bool {
+		a, b := report.Violations[i], report.Violations[j]
+		switch {
+		case a.NetworkInstance != b.NetworkInstance:
+			return a.NetworkInstance < b.NetworkInstance
+		case a.Type != b.Type:
+			return a.Type < b.Type
+		case a.AFT != b.AFT:
+			return a.AFT < b.AFT
+		}
+		return a.Key < b.Key
+	})
+	return report
+}
+
+// prefixAFT returns the AFT that contains the prefix p.
+func prefixAFT(p string) constants.AFT {
+	if strings.Contains(p, ":") {
+		return constants.IPv6
+	}
+	return constants.IPv4
+}
+
+// consistencyState collects the state of the network instance RIB that is used to
+// check the consistency of the RIB, holding its read lock whilst doing so.
+func (r *RIBHolder) consistencyState() *consistencyState {
+	s := &consistencyState{
+		nhgs:      map[uint64][]uint64{},
+		nhs:       map[uint64]bool{},
+		prefixes:  map[string]bool{},
+		indexed:   map[string]bool{},
+		nhgCounts: map[uint64]uint64{},
+		nhCounts:  map[uint64]uint64{},
+	}
+
+	r.mu.RLock()
+	afts := r.r.GetAfts()
+	ref := func(a constants.AFT, key any, e topLevelEntryStruct) {
+		ni := e.GetNextHopGroupNetworkInstance()
+		if ni == "" {
+			ni = r.name
+		}
+		s.refs = append(s.refs, nhgReference{aft: a, key: fmt.Sprintf("%v", key), ni: ni, id: e.GetNextHopGroup()})
+	}
+	for p, e := range afts.Ipv4Entry {
+		ref(constants.IPv4, p, e)
+		s.prefixes[p] = true
+	}
+	for p, e := range afts.Ipv6Entry {
+		ref(constants.IPv6, p, e)
+		s.prefixes[p] = true
+	}
+	for l, e := range afts.LabelEntry {
+		ref(constants.MPLS, l, e)
+	}
+	for i, e := range afts.PolicyForwardingEntry {
+		ref(constants.PolicyForwarding, i, e)
+	}
+	for id, e := range afts.NextHopGroup {
+		s.nhgs[id] = []uint64{}
+		for idx := range e.NextHop {
+			s.nhgs[id] = append(s.nhgs[id], idx)
+		}
+	}
+	for idx := range afts.NextHop {
+		s.nhs[idx] = true
+	}
+	if r.prefixes != nil {
+		for _, root := range []*trieNode{r.prefixes.v4, r.prefixes.v6} {
+			root.walk(func(p string) { s.indexed[p] = true })
+		}
+	}
+	r.mu.RUnlock()
+
+	r.refCounts.mu.RLock()
+	defer r.refCounts.mu.RUnlock()
+	for id, n := range r.refCounts.NextHopGroup {
+		if n != 0 {
+			s.nhgCounts[id] = n
+		}
+	}
+	for idx, n := range r.refCounts.NextHop {
+		if n != 0 {
+			s.nhCounts[idx] = n
+		}
+	}
+	return s
+}
+
+// walk calls fn for each prefix that is stored within the trie rooted at n.
+func (n *trieNode) walk(fn func(string)) {
+	if n == nil {
+		return
+	}
+	for i := 1; i < len(n.routes); i++ {
+		if n.stored(i) {
+			fn(*n.routes[i])
+		}
+	}
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
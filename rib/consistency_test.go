@@ -0,0 +1,150 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/constants"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestCheckConsistency(t *testing.T) {
+	tests := []struct {
+		desc string
+		// inCorrupt corrupts the network instance RIB of the default network
+		// instance, which contains NH 1, NHG 1 and 198.51.100.0/24.
+		inCorrupt func(*RIBHolder)
+		want      []*Violation
+	}{{
+		desc:      "consistent",
+		inCorrupt: func(*RIBHolder) {},
+	}, {
+		desc: "missing next-hop-group",
+		inCorrupt: func(h *RIBHolder) {
+			delete(h.r.GetAfts().NextHopGroup, 1)
+		},
+		want: []*Violation{{
+			Type:            ViolationMissingNextHopGroup,
+			NetworkInstance: defName,
+			AFT:             constants.IPv4,
+			Key:             "198.51.100.0/24",
+		}, {
+			// NH 1 is no longer referenced by any next-hop-group.
+			Type:            ViolationReferenceCount,
+			NetworkInstance: defName,
+			AFT:             constants.NextHop,
+			Key:             "1",
+		}},
+	}, {
+		desc: "missing next-hop",
+		inCorrupt: func(h *RIBHolder) {
+			delete(h.r.GetAfts().NextHop, 1)
+		},
+		want: []*Violation{{
+			Type:            ViolationMissingNextHop,
+			NetworkInstance: defName,
+			AFT:             constants.NextHopGroup,
+			Key:             "1",
+		}},
+	}, {
+		desc: "incorrect reference count",
+		inCorrupt: func(h *RIBHolder) {
+			h.refCounts.NextHopGroup[1] = 5
+		},
+		want: []*Violation{{
+			Type:            ViolationReferenceCount,
+			NetworkInstance: defName,
+			AFT:             constants.NextHopGroup,
+			Key:             "1",
+		}},
+	}, {
+		desc: "orphaned reference count",
+		inCorrupt: func(h *RIBHolder) {
+			h.refCounts.NextHop[42] = 1
+		},
+		want: []*Violation{{
+			Type:            ViolationOrphanedReferenceCount,
+			NetworkInstance: defName,
+			AFT:             constants.NextHop,
+			Key:             "42",
+		}},
+	}, {
+		desc: "prefix missing from index",
+		inCorrupt: func(h *RIBHolder) {
+			h.unindexPrefix("198.51.100.0/24")
+		},
+		want: []*Violation{{
+			Type:            ViolationPrefixIndex,
+			NetworkInstance: defName,
+			AFT:             constants.IPv4,
+			Key:             "198.51.100.0/24",
+		}},
+	}, {
+		desc: "stale prefix within index",
+		inCorrupt: func(h *RIBHolder) {
+			h.indexPrefix("2001:db8::/32")
+		},
+		want: []*Violation{{
+			Type:            ViolationPrefixIndex,
+			NetworkInstance: defName,
+			AFT:             constants.IPv6,
+			Key:             "2001:db8::/32",
+		}},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := New(defName)
+			applyOps(t, r, defName,
+				nhOp(1, "192.0.2.1", ""),
+				nhgOp(1, 1),
+				ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+			)
+			if got := r.CheckConsistency(); !got.Consistent() {
+				t.Fatalf("CheckConsistency(): got unexpected violations before corruption:\n%s", got)
+			}
+
+			tt.inCorrupt(r.niRIB[defName])
+			got := r.CheckConsistency()
+			if diff := cmp.Diff(got.Violations, tt.want, cmpopts.EquateEmpty(), cmpopts.IgnoreFields(Violation{}, "Expected", "Actual")); diff != "" {
+				t.Errorf("CheckConsistency(): did not get expected violations, diff(-got,+want):\n%s", diff)
+			}
+			if got.Consistent() != (len(tt.want) == 0) {
+				t.Errorf("Consistent(): did not get expected result, got: %v, want: %v", got.Consistent(), len(tt.want) == 0)
+			}
+		})
+	}
+}
+
+func TestCheckConsistencyAfterDelete(t *testing.T) {
+	r := New(defName)
+	applyOps(t, r, defName,
+		nhOp(1, "192.0.2.1", ""),
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/25", 1),
+		ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1),
+		ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/25", 1),
+		&spb.AFTOperation{Op: spb.AFTOperation_DELETE, Entry: nhgOp(1, 1).Entry},
+		&spb.AFTOperation{Op: spb.AFTOperation_DELETE, Entry: nhOp(1, "192.0.2.1", "").Entry},
+	)
+	if got := r.CheckConsistency(); !got.Consistent() {
+		t.Errorf("CheckConsistency(): got unexpected violations after deleting all entries:\n%s", got)
+	}
+}
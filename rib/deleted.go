@@ -0,0 +1,227 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+	"lukechampine.com/uint128"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// MaxDeletedPayload is the maximum size in bytes of the serialised contents of
+// an entry that is stored in a DeletedEntry. Contents that are larger are
+// truncated, such that the history of deleted entries does not retain large
+// entries.
+const MaxDeletedPayload = 1024
+
+// DeletedEntry is a record of an entry that was deleted from the RIB.
+type DeletedEntry struct {
+	// NetworkInstance is the network instance that the entry was deleted from.
+	NetworkInstance string
+	// AFT is the AFT that the entry was deleted from.
+	AFT constants.AFT
+	// Key is the key of the entry within the AFT - the prefix of an IPv4 or
+	// IPv6 entry, the ID of a next-hop-group, the index of a next-hop, or the
+	// label of an MPLS entry.
+	Key string
+	// Deleted is the time at which the entry was deleted.
+	Deleted time.Time
+	// Client is the identity of the client that deleted the entry, expressed
+	// as the election ID specified in the operation that deleted it. It is
+	// empty if the operation did not specify an election ID.
+	Client string
+	// Payload is the RFC7951 JSON serialisation of the contents of the entry
+	// at the time that it was deleted, truncated to MaxDeletedPayload bytes.
+	Payload []byte
+	// Truncated indicates whether Payload was truncated.
+	Truncated bool
+}
+
+// WithDeletedHistory specifies that the RIB should keep a record of recently
+// deleted entries, which can be retrieved using RecentlyDeleted. At most count
+// records are kept for each AFT within each network instance, and records that
+// are older than age are discarded. An age of zero indicates that records are
+// discarded only when the count is exceeded. The history is not kept if count
+// is zero.
+func WithDeletedHistory(count int, age time.Duration) *deletedHistoryOpt {
+	return &deletedHistoryOpt{count: count, age: age}
+}
+
+// deletedHistoryOpt is the internal implementation of WithDeletedHistory.
+type deletedHistoryOpt struct {
+	count int
+	age   time.Duration
+}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*deletedHistoryOpt) isRIBOpt() {}
+
+// hasDeletedHistory returns the deletedHistoryOpt within the supplied RIBOpt
+// slice, or nil if it is not present.
+func hasDeletedHistory(opt []RIBOpt) *deletedHistoryOpt {
+	for _, o := range opt {
+		if v, ok := o.(*deletedHistoryOpt); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// deletedKey is the key of the history of deleted entries for an AFT within a
+// network instance.
+type deletedKey struct {
+	ni  string
+	aft constants.AFT
+}
+
+// deletedHistory is a bounded history of deleted entries.
+type deletedHistory struct {
+	// mu protects entries.
+	mu sync.Mutex
+	// count is the maximum number of entries for each key.
+	count int
+	// age is the maximum age of an entry, or zero if entries do not expire.
+	age time.Duration
+	// entries is the set of deleted entries for each key, in the order in
+	// which they were deleted.
+	entries map[deletedKey][]*DeletedEntry
+}
+
+// newDeletedHistory returns a new deletedHistory based on the option o, or nil
+// if no history is to be kept.
+func newDeletedHistory(o *deletedHistoryOpt) *deletedHistory {
+	if o == nil || o.count <= 0 {
+		return nil
+	}
+	return &deletedHistory{
+		count:   o.count,
+		age:     o.age,
+		entries: map[deletedKey][]*DeletedEntry{},
+	}
+}
+
+// expire removes the entries for key k that were deleted before now minus the
+// maximum age. It must be called with mu held.
+func (d *deletedHistory) expire(k deletedKey, now time.Time) {
+	if d.age == 0 {
+		return
+	}
+	es := d.entries[k]
+	i := 0
+	for i < len(es) && now.Sub(es[i].Deleted) > d.age {
+		i++
+	}
+	switch {
+	case i == len(es):
+		delete(d.entries, k)
+	case i > 0:
+		d.entries[k] = es[i:]
+	}
+}
+
+// record adds the deleted entry e to the history, evicting the oldest entries
+// if the count for its network instance and AFT is exceeded.
+func (d *deletedHistory) record(e *DeletedEntry) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	k := deletedKey{ni: e.NetworkInstance, aft: e.AFT}
+	d.expire(k, e.Deleted)
+	es := append(d.entries[k], e)
+	if n := len(es) - d.count; n > 0 {
+		// Copy such that the evicted entries are not retained by the
+		// underlying array.
+		es = append([]*DeletedEntry{}, es[n:]...)
+	}
+	d.entries[k] = es
+}
+
+// query returns the entries for key k that have not expired at now and whose
+// key matches filter.
+func (d *deletedHistory) query(k deletedKey, now time.Time, filter func(string) bool) []*DeletedEntry {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(k, now)
+	var ret []*DeletedEntry
+	for _, e := range d.entries[k] {
+		if filter != nil && !filter(e.Key) {
+			continue
+		}
+		c := *e
+		ret = append(ret, &c)
+	}
+	return ret
+}
+
+// now returns the current time using the RIB's clock.
+func (r *RIB) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// recordDeleted records that the entry e, with the key key, was deleted from
+// the AFT a of network instance ni by the operation op, received from the client
+// session with ID session, within the journal and the history of deleted entries.
+// It returns the sequence number that was assigned to the deletion.
+func (r *RIB) recordDeleted(ni, session string, a constants.AFT, key any, e ygot.GoStruct, op *spb.AFTOperation) uint64 {
+	seq := r.recordJournal(JournalDelete, ni, session, a, key, op, e, nil)
+	if r.deleted == nil {
+		return seq
+	}
+	d := &DeletedEntry{
+		NetworkInstance: ni,
+		AFT:             a,
+		Key:             fmt.Sprintf("%v", key),
+		Deleted:         r.now(),
+	}
+	if id := op.GetElectionId(); id != nil {
+		d.Client = uint128.New(id.GetLow(), id.GetHigh()).String()
+	}
+	js, err := ygot.Marshal7951(e)
+	if err != nil {
+		log.Errorf("cannot serialise deleted entry %s %s, %v", a, d.Key, err)
+	}
+	if len(js) > MaxDeletedPayload {
+		js, d.Truncated = js[:MaxDeletedPayload], true
+	}
+	// Copy the payload such that the full serialisation is not retained.
+	d.Payload = append([]byte{}, js...)
+	r.deleted.record(d)
+	return seq
+}
+
+// RecentlyDeleted returns the records of the entries that were recently deleted
+// from the AFT a within network instance ni, in the order in which they were
+// deleted. If filter is not nil, only the entries whose key it returns true
+// for are returned. No entries are returned unless the RIB was created with the
+// WithDeletedHistory option. Entries that are removed by Flush are not
+// recorded.
+func (r *RIB) RecentlyDeleted(ni string, a constants.AFT, filter func(key string) bool) []*DeletedEntry {
+	return r.deleted.query(deletedKey{ni: ni, aft: a}, r.now(), filter)
+}
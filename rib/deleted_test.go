@@ -0,0 +1,201 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/constants"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+// deletingRIB returns a RIB with a deleted entry history of count entries and
+// the specified age, and a function that advances its clock by d.
+func deletingRIB(t *testing.T, count int, age time.Duration) (*RIB, func(d time.Duration)) {
+	t.Helper()
+	now := time.Unix(0, 0)
+	r := New(defName, WithClock(func() time.Time { return now }), WithDeletedHistory(count, age))
+	for _, op := range []*spb.AFTOperation{nhOp(1, "192.0.2.1", ""), nhgOp(1, 1)} {
+		if _, fails, err := r.AddEntry(defName, op); err != nil || len(fails) != 0 {
+			t.Fatalf("cannot add %s, fails: %v, err: %v", op, fails, err)
+		}
+	}
+	return r, func(d time.Duration) { now = now.Add(d) }
+}
+
+// addAndDelete adds the IPv4 prefix p to r, and then deletes it using an
+// operation with election ID elecID.
+func addAndDelete(t *testing.T, r *RIB, p string, elecID uint64) {
+	t.Helper()
+	if _, fails, err := r.AddEntry(defName, ipv4Op(spb.AFTOperation_ADD, p, 1)); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot add prefix %s, fails: %v, err: %v", p, fails, err)
+	}
+	del := ipv4Op(spb.AFTOperation_DELETE, p, 1)
+	del.ElectionId = &spb.Uint128{Low: elecID}
+	if _, fails, err := r.DeleteEntry(defName, del); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot delete prefix %s, fails: %v, err: %v", p, fails, err)
+	}
+}
+
+// deletedKeys returns the keys of the entries in es.
+func deletedKeys(es []*DeletedEntry) []string {
+	ks := []string{}
+	for _, e := range es {
+		ks = append(ks, e.Key)
+	}
+	return ks
+}
+
+func TestRecentlyDeleted(t *testing.T) {
+	r, advance := deletingRIB(t, 2, 0)
+	addAndDelete(t, r, "192.0.2.0/24", 42)
+	advance(time.Second)
+
+	got := r.RecentlyDeleted(defName, constants.IPv4, nil)
+	want := []*DeletedEntry{{
+		NetworkInstance: defName,
+		AFT:             constants.IPv4,
+		Key:             "192.0.2.0/24",
+		Deleted:         time.Unix(0, 0),
+		Client:          "42",
+	}}
+	if diff := cmp.Diff(got, want, cmpopts.IgnoreFields(DeletedEntry{}, "Payload")); diff != "" {
+		t.Fatalf("RecentlyDeleted(...): did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+	if p := string(got[0].Payload); !strings.Contains(p, `"next-hop-group":"1"`) {
+		t.Errorf("RecentlyDeleted(...): did not get expected payload, got: %s", p)
+	}
+
+	// Removing the next-hop-group and next-hop records them in their own AFTs.
+	for _, op := range []*spb.AFTOperation{{
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_NextHopGroup{NextHopGroup: &aftpb.Afts_NextHopGroupKey{Id: 1}},
+	}, {
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: 1}},
+	}} {
+		if _, fails, err := r.DeleteEntry(defName, op); err != nil || len(fails) != 0 {
+			t.Fatalf("cannot delete %s, fails: %v, err: %v", op, fails, err)
+		}
+	}
+	for a, want := range map[constants.AFT]string{constants.NextHopGroup: "1", constants.NextHop: "1"} {
+		got := r.RecentlyDeleted(defName, a, nil)
+		if len(got) != 1 || got[0].Key != want || got[0].Client != "" {
+			t.Errorf("RecentlyDeleted(%s): did not get expected entry, got: %v, want key: %s", a, got, want)
+		}
+	}
+
+	if got := r.RecentlyDeleted("VRF-A", constants.IPv4, nil); got != nil {
+		t.Errorf("RecentlyDeleted(...): did not get expected entries for unknown network instance, got: %v", got)
+	}
+}
+
+func TestRecentlyDeletedEviction(t *testing.T) {
+	t.Run("count", func(t *testing.T) {
+		r, _ := deletingRIB(t, 2, 0)
+		for i := 1; i <= 3; i++ {
+			addAndDelete(t, r, fmt.Sprintf("192.0.%d.0/24", i), 1)
+		}
+		if diff := cmp.Diff(deletedKeys(r.RecentlyDeleted(defName, constants.IPv4, nil)), []string{"192.0.2.0/24", "192.0.3.0/24"}); diff != "" {
+			t.Fatalf("did not get expected entries, diff(-got,+want):\n%s", diff)
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		r, advance := deletingRIB(t, 10, time.Minute)
+		addAndDelete(t, r, "192.0.1.0/24", 1)
+		advance(45 * time.Second)
+		addAndDelete(t, r, "192.0.2.0/24", 1)
+		advance(30 * time.Second)
+
+		if diff := cmp.Diff(deletedKeys(r.RecentlyDeleted(defName, constants.IPv4, nil)), []string{"192.0.2.0/24"}); diff != "" {
+			t.Fatalf("did not get expected entries after first expiry, diff(-got,+want):\n%s", diff)
+		}
+		advance(time.Minute)
+		if got := r.RecentlyDeleted(defName, constants.IPv4, nil); got != nil {
+			t.Fatalf("did not get expected entries after second expiry, got: %v, want: nil", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r, _ := deletingRIB(t, 0, 0)
+		addAndDelete(t, r, "192.0.1.0/24", 1)
+		if got := r.RecentlyDeleted(defName, constants.IPv4, nil); got != nil {
+			t.Fatalf("did not get expected entries, got: %v, want: nil", got)
+		}
+	})
+}
+
+func TestRecentlyDeletedFilter(t *testing.T) {
+	r, _ := deletingRIB(t, 10, 0)
+	for _, p := range []string{"192.0.2.0/24", "198.51.100.0/24", "192.0.2.128/25"} {
+		addAndDelete(t, r, p, 1)
+	}
+	got := r.RecentlyDeleted(defName, constants.IPv4, func(k string) bool { return strings.HasPrefix(k, "192.0.2.") })
+	if diff := cmp.Diff(deletedKeys(got), []string{"192.0.2.0/24", "192.0.2.128/25"}); diff != "" {
+		t.Fatalf("did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+
+	// Modifying a returned entry does not modify the history.
+	got[0].Key = "modified"
+	if k := r.RecentlyDeleted(defName, constants.IPv4, nil)[0].Key; k != "192.0.2.0/24" {
+		t.Errorf("history was modified by caller, got key: %s", k)
+	}
+}
+
+func TestRecentlyDeletedTruncation(t *testing.T) {
+	r, _ := deletingRIB(t, 1, 0)
+	// A next-hop-group with many next-hops is larger than the maximum payload.
+	nhg := &aftpb.Afts_NextHopGroup{}
+	for i := uint64(1); i <= 64; i++ {
+		if _, fails, err := r.AddEntry(defName, nhOp(i, "192.0.2.1", "")); err != nil || len(fails) != 0 {
+			t.Fatalf("cannot add next-hop %d, fails: %v, err: %v", i, fails, err)
+		}
+		nhg.NextHop = append(nhg.NextHop, &aftpb.Afts_NextHopGroup_NextHopKey{
+			Index:   i,
+			NextHop: &aftpb.Afts_NextHopGroup_NextHop{Weight: &wpb.UintValue{Value: 1}},
+		})
+	}
+	add := &spb.AFTOperation{
+		Op:    spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_NextHopGroup{NextHopGroup: &aftpb.Afts_NextHopGroupKey{Id: 2, NextHopGroup: nhg}},
+	}
+	del := &spb.AFTOperation{
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_NextHopGroup{NextHopGroup: &aftpb.Afts_NextHopGroupKey{Id: 2}},
+	}
+	if _, fails, err := r.AddEntry(defName, add); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot add next-hop-group, fails: %v, err: %v", fails, err)
+	}
+	if _, fails, err := r.DeleteEntry(defName, del); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot delete next-hop-group, fails: %v, err: %v", fails, err)
+	}
+
+	got := r.RecentlyDeleted(defName, constants.NextHopGroup, nil)
+	if len(got) != 1 {
+		t.Fatalf("did not get expected number of entries, got: %d, want: 1", len(got))
+	}
+	if !got[0].Truncated || len(got[0].Payload) != MaxDeletedPayload {
+		t.Errorf("did not get truncated payload, got truncated: %v, length: %d", got[0].Truncated, len(got[0].Payload))
+	}
+}
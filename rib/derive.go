@@ -0,0 +1,500 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+	"google.golang.org/protobuf/proto"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// defaultMaxDerivationDepth is the derivation depth that is used when none is
+// specified, such that only changes that are made by clients are derived from.
+const defaultMaxDerivationDepth = 1
+
+// DerivedChange describes a change to an entry within the RIB that is handed to a
+// DerivationFn.
+type DerivedChange struct {
+	// Op is the type of the change - an Add, Replace or Delete.
+	Op constants.OpType
+	// NetworkInstance is the name of the network instance that the entry is
+	// within.
+	NetworkInstance string
+	// AFT is the AFT that the entry is within.
+	AFT constants.AFT
+	// Key is the key of the entry within the AFT - a string for IPv4 and IPv6
+	// prefixes, and a uint64 for the label, ID or index of other entries.
+	Key any
+	// Entry is the entry after the change, or the entry that was removed in
+	// the case of a Delete.
+	Entry ygot.GoStruct
+	// Depth is the derivation depth of the change, which is zero for changes
+	// that were made by a client, and one greater than the depth of the change
+	// that an entry was derived from otherwise.
+	Depth int
+}
+
+// DerivedOperation is an operation that is returned by a DerivationFn to be
+// applied to the RIB.
+type DerivedOperation struct {
+	// NetworkInstance is the name of the network instance that the operation
+	// applies to, where an empty name refers to the default network instance.
+	NetworkInstance string
+	// Op is the operation to be applied. Its ID and election ID are ignored.
+	Op *spb.AFTOperation
+}
+
+// DerivationFn is a function that is called with each change that is made to the
+// RIB, and returns the operations that should be applied to the RIB to create, or
+// update, the entries that are derived from the change. Derived entries are removed
+// automatically when the entry that they were derived from is removed, such that
+// a DerivationFn need not return operations for a Delete.
+type DerivationFn func(DerivedChange) []*DerivedOperation
+
+// WithMaxDerivationDepth specifies the maximum depth of derivation within the RIB,
+// such that changes to derived entries are only handed to the registered
+// DerivationFns when their depth is less than n. The default depth of 1 means that
+// only changes made by clients are derived from, preventing derived entries from
+// triggering further derivation.
+func WithMaxDerivationDepth(n int) *maxDerivationDepth {
+	return &maxDerivationDepth{n: n}
+}
+
+// maxDerivationDepth is the internal implementation of WithMaxDerivationDepth.
+type maxDerivationDepth struct {
+	n int
+}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*maxDerivationDepth) isRIBOpt() {}
+
+// hasMaxDerivationDepth returns the depth specified by the maxDerivationDepth
+// option in the supplied RIBOpt slice, or zero if it is not specified.
+func hasMaxDerivationDepth(opt []RIBOpt) int {
+	for _, o := range opt {
+		if v, ok := o.(*maxDerivationDepth); ok {
+			return v.n
+		}
+	}
+	return 0
+}
+
+// WithDerivedEntriesInGet specifies that derived entries should be returned by
+// Snapshot.GetRIB, and hence by the gRIBI Get RPC, alongside the entries that were
+// programmed by clients.
+func WithDerivedEntriesInGet() *derivedInGet {
+	return &derivedInGet{}
+}
+
+// derivedInGet is the internal implementation of WithDerivedEntriesInGet.
+type derivedInGet struct{}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*derivedInGet) isRIBOpt() {}
+
+// hasDerivedInGet returns true if the supplied RIBOpt slice contains the
+// WithDerivedEntriesInGet option.
+func hasDerivedInGet(opt []RIBOpt) bool {
+	for _, o := range opt {
+		if _, ok := o.(*derivedInGet); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// entryID uniquely identifies an entry within the RIB.
+type entryID struct {
+	ni  string
+	aft constants.AFT
+	// key is the key of the entry, which is normalised by newEntryID such that
+	// the same entry always has the same key.
+	key any
+}
+
+// newEntryID returns the entryID of the entry with key key within the AFT a of
+// network instance ni.
+func newEntryID(ni string, a constants.AFT, key any) entryID {
+	switch k := key.(type) {
+	case aft.UnionUint32:
+		key = uint64(k)
+	case uint32:
+		key = uint64(k)
+	}
+	return entryID{ni: ni, aft: a, key: key}
+}
+
+// derivations stores the registered DerivationFns, and the relationship between
+// derived entries and the entries that they were derived from.
+type derivations struct {
+	// fns are the registered derivation functions.
+	fns []DerivationFn
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// source maps each derived entry to the entry that it was derived from.
+	source map[entryID]entryID
+	// derived maps each entry to the entries that were derived from it, in
+	// the order in which they were derived.
+	derived map[entryID][]entryID
+}
+
+// AddDerivation registers fn to be called with each change that is made to the RIB
+// at a depth less than the maximum derivation depth. The operations that fn returns
+// are applied to the RIB before the operation that triggered the change returns,
+// and the entries that they install are marked as derived from the changed entry.
+//
+// Derived entries are not owned by a client. They cannot be deleted by a client,
+// and are not returned by the gRIBI Get RPC unless the RIB was created with
+// WithDerivedEntriesInGet, but are otherwise handled as any other entry - such
+// that they are reported to the hooks of the RIB. A derived operation is not
+// applied if it would replace an entry that was programmed by a client, or if it
+// cannot be resolved at the time that it is applied.
+//
+// AddDerivation must be called before the RIB is modified.
+func (r *RIB) AddDerivation(fn DerivationFn) {
+	if r.derivations == nil {
+		r.derivations = &derivations{
+			source:  map[entryID]entryID{},
+			derived: map[entryID][]entryID{},
+		}
+	}
+	r.derivations.fns = append(r.derivations.fns, fn)
+}
+
+// IsDerived returns true if the entry with key key within the AFT a of network
+// instance ni was derived from another entry by a registered DerivationFn.
+func (r *RIB) IsDerived(ni string, a constants.AFT, key any) bool {
+	return r.derivations.isDerived(newEntryID(ni, a, key))
+}
+
+// isDerived returns true if the entry id is a derived entry.
+func (d *derivations) isDerived(id entryID) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.source[id]
+	return ok
+}
+
+// isDerivedOp returns true if the operation op within network instance ni refers
+// to a derived entry.
+func (d *derivations) isDerivedOp(ni string, op *spb.AFTOperation) bool {
+	if d == nil {
+		return false
+	}
+	a, key := operationKey(op)
+	return d.isDerived(newEntryID(ni, a, key))
+}
+
+// add records that the entry id was derived from the entry src.
+func (d *derivations) add(src, id entryID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, ok := d.source[id]; ok {
+		if s == src {
+			return
+		}
+		d.unlink(s, id)
+	}
+	d.source[id] = src
+	d.derived[src] = append(d.derived[src], id)
+}
+
+// unlink removes id from the entries derived from src. It must be called with mu
+// held.
+func (d *derivations) unlink(src, id entryID) {
+	ids := d.derived[src]
+	for i, c := range ids {
+		if c == id {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(d.derived, src)
+		return
+	}
+	d.derived[src] = ids
+}
+
+// disown records that the entry id is no longer derived from another entry, for
+// example, because it was replaced by a client.
+func (d *derivations) disown(id entryID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if src, ok := d.source[id]; ok {
+		d.unlink(src, id)
+		delete(d.source, id)
+	}
+}
+
+// remove records that the entry id was removed from the RIB, returning the entries
+// that were derived from it.
+func (d *derivations) remove(id entryID) []entryID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if src, ok := d.source[id]; ok {
+		d.unlink(src, id)
+		delete(d.source, id)
+	}
+	children := d.derived[id]
+	delete(d.derived, id)
+	return children
+}
+
+// removeNetworkInstances records that all entries within the network instances nis
+// were removed from the RIB, returning the entries, outside of those network
+// instances, that were derived from them.
+func (d *derivations) removeNetworkInstances(nis map[string]bool) []entryID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, src := range d.source {
+		if nis[id.ni] {
+			d.unlink(src, id)
+			delete(d.source, id)
+		}
+	}
+	var orphans []entryID
+	for src, ids := range d.derived {
+		if !nis[src.ni] {
+			continue
+		}
+		for _, id := range ids {
+			delete(d.source, id)
+			orphans = append(orphans, id)
+		}
+		delete(d.derived, src)
+	}
+	return orphans
+}
+
+// derivedEntries returns the set of derived entries.
+func (d *derivations) derivedEntries() map[entryID]bool {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := make(map[entryID]bool, len(d.source))
+	for id := range d.source {
+		m[id] = true
+	}
+	return m
+}
+
+// deriveAdded handles the installation of the entry with key key within the AFT a
+// of the network instance RIB niR, named ni, by an operation at the derivation
+// depth depth. The change, of type op, is handed to the registered DerivationFns,
+// and the operations that they return are applied. The results of any pending
+// operations that are installed as a result are appended to oks and fails.
+func (r *RIB) deriveAdded(niR *RIBHolder, ni string, op constants.OpType, a constants.AFT, key any, depth int, oks, fails *[]*OpResult) error {
+	if r.derivations == nil {
+		return nil
+	}
+	id := newEntryID(ni, a, key)
+	if depth == 0 {
+		// A client has programmed the entry, and hence owns it.
+		r.derivations.disown(id)
+	}
+	return r.derive(id, DerivedChange{
+		Op:              op,
+		NetworkInstance: ni,
+		AFT:             a,
+		Key:             id.key,
+		Entry:           niR.retrieveEntry(a, key),
+		Depth:           depth,
+	}, oks, fails)
+}
+
+// deriveDeleted handles the removal of the entry e, with key key, from the AFT a
+// of network instance ni by an operation at the derivation depth depth. The
+// entries that were derived from e are removed, and the change is handed to the
+// registered DerivationFns.
+func (r *RIB) deriveDeleted(ni string, a constants.AFT, key any, e ygot.GoStruct, depth int, oks, fails *[]*OpResult) error {
+	if r.derivations == nil {
+		return nil
+	}
+	id := newEntryID(ni, a, key)
+	children := r.derivations.remove(id)
+	// Remove the most recently derived entries first, such that entries are
+	// removed before the entries that they may reference.
+	for i := len(children) - 1; i >= 0; i-- {
+		if err := r.removeDerived(children[i], depth+1); err != nil {
+			return err
+		}
+	}
+	return r.derive(id, DerivedChange{
+		Op:              constants.Delete,
+		NetworkInstance: ni,
+		AFT:             a,
+		Key:             id.key,
+		Entry:           e,
+		Depth:           depth,
+	}, oks, fails)
+}
+
+// derive hands the change ch to the entry src to each registered DerivationFn,
+// if its depth is less than the maximum derivation depth, and applies the
+// operations that are returned.
+func (r *RIB) derive(src entryID, ch DerivedChange, oks, fails *[]*OpResult) error {
+	limit := r.maxDerivationDepth
+	if limit <= 0 {
+		limit = defaultMaxDerivationDepth
+	}
+	if ch.Depth >= limit {
+		return nil
+	}
+	for _, fn := range r.derivations.fns {
+		for _, d := range fn(ch) {
+			if err := r.applyDerived(src, d, ch.Depth+1, oks, fails); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyDerived applies the operation d, which was derived from the entry src, at
+// the derivation depth depth. Failures to apply the operation are logged rather
+// than returned, since they do not cause the change that d was derived from to
+// fail. The results of any pending operations that are installed as a result are
+// appended to oks and fails.
+func (r *RIB) applyDerived(src entryID, d *DerivedOperation, depth int, oks, fails *[]*OpResult) error {
+	ni, err := r.operationNetworkInstance(d.NetworkInstance)
+	if err != nil {
+		log.Errorf("cannot apply derived operation %s, %v", d.Op, err)
+		return nil
+	}
+	niR, ok := r.NetworkInstanceRIB(ni)
+	if !ok || !niR.IsValid() {
+		log.Errorf("cannot apply derived operation %s, invalid network instance %s", d.Op, ni)
+		return nil
+	}
+	// The operation is copied such that the IDs of operations sent by clients
+	// cannot collide with it.
+	op := proto.Clone(d.Op).(*spb.AFTOperation)
+	op.Id, op.ElectionId = 0, nil
+	a, key := operationKey(op)
+	id := newEntryID(ni, a, key)
+
+	if op.GetOp() == spb.AFTOperation_DELETE {
+		if !r.derivations.isDerived(id) {
+			log.Errorf("cannot apply derived operation %s, entry is not derived", op)
+			return nil
+		}
+		_, dfails, err := r.deleteEntry(ni, "", op, depth)
+		if len(dfails) != 0 {
+			log.Errorf("cannot apply derived operation %s, %s", op, dfails[0].Error)
+		}
+		return err
+	}
+
+	if e := niR.retrieveEntry(a, key); e != nil && !r.derivations.isDerived(id) {
+		log.Errorf("cannot apply derived operation %s, entry was programmed by a client", op)
+		return nil
+	}
+	if u := r.UnresolvedReferences(ni, op); len(u) != 0 {
+		log.Errorf("cannot apply derived operation %s, unresolved references: %v", op, u)
+		return nil
+	}
+
+	// The entry is marked as derived before it is installed, such that changes
+	// to it are handled at the correct depth.
+	r.derivations.add(src, id)
+	nOK, nFail := len(*oks), len(*fails)
+	if err := r.addEntryInternal(ni, "", op, oks, fails, map[pendingID]bool{}, depth); err != nil {
+		return err
+	}
+	// Remove the result of the derived operation, such that only results for
+	// operations sent by clients are returned.
+	installed := false
+	*oks, installed = removeResult(*oks, nOK, op)
+	var failed bool
+	if *fails, failed = removeResult(*fails, nFail, op); failed || !installed {
+		log.Errorf("cannot apply derived operation %s", op)
+		r.derivations.remove(id)
+		r.rmPending(pendingID{id: op.GetId()})
+	}
+	return nil
+}
+
+// removeResult removes the result for the operation op from the results res that
+// were appended after index from, returning the updated results and whether such a
+// result was found.
+func removeResult(res []*OpResult, from int, op *spb.AFTOperation) ([]*OpResult, bool) {
+	for i := from; i < len(res); i++ {
+		if res[i].Op == op {
+			return append(res[:i:i], res[i+1:]...), true
+		}
+	}
+	return res, false
+}
+
+// removeDerived removes the derived entry id from the RIB, as a change at the
+// derivation depth depth.
+func (r *RIB) removeDerived(id entryID, depth int) error {
+	op := &spb.AFTOperation{Op: spb.AFTOperation_DELETE}
+	switch id.aft {
+	case constants.IPv4:
+		op.Entry = &spb.AFTOperation_Ipv4{Ipv4: &aftpb.Afts_Ipv4EntryKey{Prefix: id.key.(string)}}
+	case constants.IPv6:
+		op.Entry = &spb.AFTOperation_Ipv6{Ipv6: &aftpb.Afts_Ipv6EntryKey{Prefix: id.key.(string)}}
+	case constants.MPLS:
+		op.Entry = &spb.AFTOperation_Mpls{Mpls: &aftpb.Afts_LabelEntryKey{
+			Label: &aftpb.Afts_LabelEntryKey_LabelUint64{LabelUint64: id.key.(uint64)},
+		}}
+	case constants.NextHopGroup:
+		op.Entry = &spb.AFTOperation_NextHopGroup{NextHopGroup: &aftpb.Afts_NextHopGroupKey{Id: id.key.(uint64)}}
+	case constants.NextHop:
+		op.Entry = &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: id.key.(uint64)}}
+	case constants.PolicyForwarding:
+		op.Entry = &spb.AFTOperation_PolicyForwardingEntry{PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntryKey{Index: id.key.(uint64)}}
+	}
+	_, fails, err := r.deleteEntry(id.ni, "", op, depth)
+	if len(fails) != 0 {
+		log.Errorf("cannot remove derived entry %s, %s", op, fails[0].Error)
+	}
+	return err
+}
+
+// flushDerived handles the removal of all entries within the network instances
+// nis by Flush, removing the entries outside of those network instances that were
+// derived from them.
+func (r *RIB) flushDerived(nis []string) error {
+	if r.derivations == nil {
+		return nil
+	}
+	flushed := map[string]bool{}
+	for _, ni := range nis {
+		flushed[ni] = true
+	}
+	orphans := r.derivations.removeNetworkInstances(flushed)
+	for i := len(orphans) - 1; i >= 0; i-- {
+		if err := r.removeDerived(orphans[i], 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+// leakFn returns a DerivationFn that leaks each IPv4 entry that is added to the
+// network instance from into the network instance to, resolving it via the
+// same next-hop-group as the original entry.
+func leakFn(from, to string) DerivationFn {
+	return func(ch DerivedChange) []*DerivedOperation {
+		if ch.NetworkInstance != from || ch.AFT != constants.IPv4 || ch.Op == constants.Delete {
+			return nil
+		}
+		e := ch.Entry.(*aft.Afts_Ipv4Entry)
+		nhgNI := e.GetNextHopGroupNetworkInstance()
+		if nhgNI == "" {
+			nhgNI = from
+		}
+		return []*DerivedOperation{{
+			NetworkInstance: to,
+			Op: &spb.AFTOperation{
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix: e.GetPrefix(),
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+							NextHopGroup:                &wpb.UintValue{Value: e.GetNextHopGroup()},
+							NextHopGroupNetworkInstance: &wpb.StringValue{Value: nhgNI},
+						},
+					},
+				},
+			},
+		}}
+	}
+}
+
+// newDerivedRIB returns a RIB with the options opt, and the network instances
+// VRF-A and VRF-B, that leaks IPv4 entries from the default network instance to
+// VRF-A, and from VRF-A to VRF-B.
+func newDerivedRIB(t *testing.T, opt ...RIBOpt) *RIB {
+	t.Helper()
+	r := New(defName, opt...)
+	for _, ni := range []string{"VRF-A", "VRF-B"} {
+		if err := r.AddNetworkInstance(ni); err != nil {
+			t.Fatalf("cannot add network instance %s, %v", ni, err)
+		}
+	}
+	r.AddDerivation(leakFn(defName, "VRF-A"))
+	r.AddDerivation(leakFn("VRF-A", "VRF-B"))
+	applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""), nhgOp(1, 1))
+	return r
+}
+
+// hasIPv4 returns true if the network instance ni of r contains the IPv4 prefix.
+func hasIPv4(t *testing.T, r *RIB, ni, prefix string) bool {
+	t.Helper()
+	niR, ok := r.NetworkInstanceRIB(ni)
+	if !ok {
+		t.Fatalf("cannot find network instance %s", ni)
+	}
+	return niR.retrieveIPv4(prefix) != nil
+}
+
+func TestDerivation(t *testing.T) {
+	r := newDerivedRIB(t)
+
+	add := ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1)
+	add.Id = 1
+	oks, fails, err := r.AddEntry(defName, add)
+	if err != nil || len(fails) != 0 {
+		t.Fatalf("cannot add prefix, fails: %v, err: %v", fails, err)
+	}
+	if len(oks) != 1 || oks[0].ID != 1 {
+		t.Errorf("AddEntry: did not get only the result of the client operation, got: %v", oks)
+	}
+
+	if !hasIPv4(t, r, "VRF-A", "198.51.100.0/24") {
+		t.Fatalf("derived entry was not installed in VRF-A")
+	}
+	if !r.IsDerived("VRF-A", constants.IPv4, "198.51.100.0/24") {
+		t.Errorf("IsDerived: entry in VRF-A was not reported as derived")
+	}
+	if r.IsDerived(defName, constants.IPv4, "198.51.100.0/24") {
+		t.Errorf("IsDerived: client entry was reported as derived")
+	}
+	// The derived entry is not derived from, since the default depth is 1.
+	if hasIPv4(t, r, "VRF-B", "198.51.100.0/24") {
+		t.Errorf("entry was derived from a derived entry with the default depth")
+	}
+
+	del := ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1)
+	del.Id = 2
+	_, fails, err = r.DeleteEntry("VRF-A", del)
+	if err != nil {
+		t.Fatalf("DeleteEntry: got unexpected error, %v", err)
+	}
+	if len(fails) != 1 || fails[0].ID != 2 {
+		t.Errorf("DeleteEntry: client delete of a derived entry did not fail, got: %v", fails)
+	}
+
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1))
+	if hasIPv4(t, r, "VRF-A", "198.51.100.0/24") {
+		t.Errorf("derived entry was not removed with the entry it was derived from")
+	}
+	if r.IsDerived("VRF-A", constants.IPv4, "198.51.100.0/24") {
+		t.Errorf("IsDerived: removed entry was reported as derived")
+	}
+}
+
+func TestDerivationDepth(t *testing.T) {
+	r := newDerivedRIB(t, WithMaxDerivationDepth(2))
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1))
+	for _, ni := range []string{"VRF-A", "VRF-B"} {
+		if !hasIPv4(t, r, ni, "198.51.100.0/24") {
+			t.Errorf("derived entry was not installed in %s", ni)
+		}
+	}
+
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1))
+	for _, ni := range []string{"VRF-A", "VRF-B"} {
+		if hasIPv4(t, r, ni, "198.51.100.0/24") {
+			t.Errorf("derived entry in %s was not removed", ni)
+		}
+	}
+}
+
+func TestDerivationClientEntry(t *testing.T) {
+	r := newDerivedRIB(t)
+	// An entry programmed by a client is not replaced by a derived entry.
+	applyOps(t, r, "VRF-A", nhOp(1, "192.0.2.2", ""), nhgOp(2, 1), ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 2))
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1))
+	if r.IsDerived("VRF-A", constants.IPv4, "198.51.100.0/24") {
+		t.Fatalf("client entry was replaced by a derived entry")
+	}
+
+	// A client takes ownership of a derived entry that it replaces.
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 1))
+	applyOps(t, r, "VRF-A", ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 2))
+	if r.IsDerived("VRF-A", constants.IPv4, "203.0.113.0/24") {
+		t.Errorf("entry replaced by a client was reported as derived")
+	}
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_DELETE, "203.0.113.0/24", 1))
+	if !hasIPv4(t, r, "VRF-A", "203.0.113.0/24") {
+		t.Errorf("entry replaced by a client was removed with the entry it was derived from")
+	}
+}
+
+func TestDerivationFlush(t *testing.T) {
+	r := newDerivedRIB(t)
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1))
+	if err := r.Flush([]string{defName}); err != nil {
+		t.Fatalf("cannot flush RIB, %v", err)
+	}
+	if hasIPv4(t, r, "VRF-A", "198.51.100.0/24") {
+		t.Errorf("derived entry was not removed by Flush of the network instance it was derived from")
+	}
+}
+
+func TestDerivationGet(t *testing.T) {
+	tests := []struct {
+		desc string
+		opt  []RIBOpt
+		want []string
+	}{{
+		desc: "derived entries excluded",
+		want: []string{},
+	}, {
+		desc: "derived entries included",
+		opt:  []RIBOpt{WithDerivedEntriesInGet()},
+		want: []string{"VRF-A/IPv4/198.51.100.0/24"},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := newDerivedRIB(t, tt.opt...)
+			applyOps(t, r, defName, ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1))
+			snap := r.Snapshot()
+			defer snap.Release()
+			if diff := cmp.Diff(snapshotKeys(t, snap, "VRF-A"), tt.want); diff != "" {
+				t.Errorf("did not get expected entries, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
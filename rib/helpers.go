@@ -47,6 +47,8 @@ func FromGetResponses(defaultName string, responses []*spb.GetResponse, opt ...R
 				niAFTs[ni].NextHopGroup = append(niAFTs[ni].NextHopGroup, t.NextHopGroup)
 			case *spb.AFTEntry_NextHop:
 				niAFTs[ni].NextHop = append(niAFTs[ni].NextHop, t.NextHop)
+			case *spb.AFTEntry_PolicyForwardingEntry:
+				niAFTs[ni].PolicyForwardingEntry = append(niAFTs[ni].PolicyForwardingEntry, t.PolicyForwardingEntry)
 			default:
 				return nil, fmt.Errorf("unknown/unhandled type %T in received GetResponses", t)
 			}
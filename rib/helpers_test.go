@@ -287,9 +287,9 @@ func TestFromGetResponses(t *testing.T) {
 
 			if diff := cmp.Diff(got, tt.wantRIB,
 				cmpopts.EquateEmpty(), cmp.AllowUnexported(RIB{}),
-				cmpopts.IgnoreFields(RIB{}, "nrMu", "pendMu", "ribCheck"),
+				cmpopts.IgnoreFields(RIB{}, "nrMu", "pendMu", "resMu", "intfMu", "elecMu", "metaMu", "seq", "ribCheck"),
 				cmp.AllowUnexported(RIBHolder{}),
-				cmpopts.IgnoreFields(RIBHolder{}, "mu", "refCounts", "checkFn"),
+				cmpopts.IgnoreFields(RIBHolder{}, "mu", "refCounts", "checkFn", "prefixes"),
 			); diff != "" {
 				t.Fatalf("FromGetResponses(...): did not get expected RIB, diff(-got,+want):\n%s", diff)
 			}
@@ -469,9 +469,9 @@ func TestFakeRIB(t *testing.T) {
 			got := tt.inBuild().RIB()
 			if diff := cmp.Diff(got, tt.wantRIB,
 				cmpopts.EquateEmpty(), cmp.AllowUnexported(RIB{}),
-				cmpopts.IgnoreFields(RIB{}, "nrMu", "pendMu", "ribCheck"),
+				cmpopts.IgnoreFields(RIB{}, "nrMu", "pendMu", "resMu", "intfMu", "elecMu", "metaMu", "seq", "ribCheck"),
 				cmp.AllowUnexported(RIBHolder{}),
-				cmpopts.IgnoreFields(RIBHolder{}, "mu", "refCounts", "checkFn"),
+				cmpopts.IgnoreFields(RIBHolder{}, "mu", "refCounts", "checkFn", "prefixes"),
 			); diff != "" {
 				t.Fatalf("FakeRIB.RIB(...): did not get expected RIB, diff(-got,+want):\n%s", diff)
 			}
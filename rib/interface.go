@@ -0,0 +1,138 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/afthelper"
+	"github.com/openconfig/gribigo/constants"
+)
+
+// InterfaceResolverFn is a function that determines whether the interface name,
+// and the subinterface sub within it, exist and are operationally up, such that
+// a next-hop that specifies them as its egress interface can be resolved.
+type InterfaceResolverFn func(name string, sub uint32) bool
+
+// WithInterfaceResolver specifies a function that is used to determine whether
+// the egress interface of a next-hop that specifies an interface can be used.
+// A next-hop whose interface cannot be used is unresolvable, as are the entries
+// that depend upon it. By default, all interfaces are considered usable.
+//
+// When the state of an interface changes, the embedder must call
+// SetInterfaceState such that the resolution of the entries that use it is
+// re-evaluated.
+func WithInterfaceResolver(fn InterfaceResolverFn) *interfaceResolver {
+	return &interfaceResolver{fn: fn}
+}
+
+// interfaceResolver is the internal implementation of WithInterfaceResolver.
+type interfaceResolver struct {
+	fn InterfaceResolverFn
+}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*interfaceResolver) isRIBOpt() {}
+
+// hasInterfaceResolver returns the function specified by the interfaceResolver
+// option within the supplied RIBOpt slice, or nil if it is not present.
+func hasInterfaceResolver(opt []RIBOpt) InterfaceResolverFn {
+	for _, o := range opt {
+		if v, ok := o.(*interfaceResolver); ok {
+			return v.fn
+		}
+	}
+	return nil
+}
+
+// SetInterfaceState records that the interface name is operationally up or
+// down, and re-evaluates the resolution of each next-hop that uses it, along
+// with the entries that depend upon them. Next-hops whose resolution changes
+// are reported to the post-change, resolved entry and resolvability hooks in
+// the same way as when a change to the RIB changes their resolution.
+//
+// An interface that is down cannot be used regardless of the result of the
+// function specified by WithInterfaceResolver. SetInterfaceState should also
+// be called when the result of that function changes for an interface, such
+// that the RIB reflects it.
+func (r *RIB) SetInterfaceState(name string, up bool) error {
+	r.intfMu.Lock()
+	switch {
+	case up:
+		delete(r.intfDown, name)
+	default:
+		if r.intfDown == nil {
+			r.intfDown = map[string]bool{}
+		}
+		r.intfDown[name] = true
+	}
+	r.intfMu.Unlock()
+
+	usesIntf := func(_ nhKey, nh *aft.Afts_NextHop) bool {
+		return nh.GetInterfaceRef().GetInterface() == name
+	}
+
+	ids := []entryID{}
+	ribs, done := r.ribs()
+	for ni, rib := range ribs {
+		for idx, nh := range rib.GetAfts().NextHop {
+			if usesIntf(nhKey{ni: ni, index: idx}, nh) {
+				ids = append(ids, newEntryID(ni, constants.NextHop, idx))
+			}
+		}
+	}
+	done()
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].ni != ids[j].ni {
+			return ids[i].ni < ids[j].ni
+		}
+		return ids[i].key.(uint64) < ids[j].key.(uint64)
+	})
+
+	if err := r.reevaluateResolution(resolutionScope{affected: usesIntf, unresolved: true}); err != nil {
+		return err
+	}
+	r.updateResolvability(r.seq.Load(), ids...)
+	return nil
+}
+
+// interfaceUsable returns true if the interface name, and its subinterface sub,
+// can be used as the egress interface of a next-hop. Next-hops that do not
+// specify an interface, and hence have an empty name, are not constrained.
+func (r *RIB) interfaceUsable(name string, sub uint32) bool {
+	if name == "" {
+		return true
+	}
+	r.intfMu.RLock()
+	down := r.intfDown[name]
+	r.intfMu.RUnlock()
+	if down {
+		return false
+	}
+	return r.interfaceResolver == nil || r.interfaceResolver(name, sub)
+}
+
+// checkInterfaces returns an error if any of the next-hops nhs, which are the
+// result of resolving an entry, use an egress interface that cannot be used.
+func (r *RIB) checkInterfaces(nhs []*afthelper.ResolvedNextHop) error {
+	for _, nh := range nhs {
+		if !r.interfaceUsable(nh.Interface, nh.Subinterface) {
+			return fmt.Errorf("interface %s, subinterface %d of next-hop %d in NI %s is not usable", nh.Interface, nh.Subinterface, nh.Index, nh.NetworkInstance)
+		}
+	}
+	return nil
+}
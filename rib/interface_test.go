@@ -0,0 +1,198 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/constants"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+func TestSetInterfaceState(t *testing.T) {
+	intfOnly := nhOp(3, "", "eth1")
+	intfOnly.GetNextHop().GetNextHop().IpAddress = nil
+
+	r := New(defName)
+	// NH 1 specifies both an address and an interface, and NH 2 is recursively
+	// resolved via 198.51.100.0/24, such that both IPv4 entries ultimately use
+	// eth0. NH 3 specifies only an interface, which is unaffected by eth0.
+	applyOps(t, r, defName,
+		nhOp(1, "192.0.2.1", "eth0"),
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+		nhOp(2, "198.51.100.1", ""),
+		nhgOp(2, 2),
+		ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 2),
+		intfOnly,
+		nhgOp(3, 3),
+		ipv4Op(spb.AFTOperation_ADD, "198.18.0.0/15", 3),
+	)
+
+	rec := &resolutionRecorder{entries: make(chan string, 100)}
+	r.SetPostChangeHook(rec.postChange)
+	r.SetResolvedEntryHook(rec.resolvedEntry)
+	var batches []*ResolvabilityBatch
+	r.SetResolvabilityHook(func(b *ResolvabilityBatch) {
+		batches = append(batches, b)
+	})
+
+	tests := []struct {
+		desc string
+		inUp bool
+		// wantEntries are the calls to the resolved entry hook.
+		wantEntries []string
+		// wantResolvable are the IPv4 entries reported to the resolvability
+		// hook, each of which is expected to have the resolvability inUp.
+		wantResolvable []string
+	}{{
+		desc:           "interface down",
+		inUp:           false,
+		wantEntries:    []string{"Delete IPv4:198.51.100.0/24", "Delete IPv4:203.0.113.0/24"},
+		wantResolvable: []string{"198.51.100.0/24", "203.0.113.0/24"},
+	}, {
+		desc:           "interface up",
+		inUp:           true,
+		wantEntries:    []string{"Add IPv4:198.51.100.0/24", "Add IPv4:203.0.113.0/24"},
+		wantResolvable: []string{"198.51.100.0/24", "203.0.113.0/24"},
+	}}
+
+	for _, tt := range tests {
+		batches = nil
+		if err := r.SetInterfaceState("eth0", tt.inUp); err != nil {
+			t.Fatalf("%s: SetInterfaceState(): got unexpected error, %v", tt.desc, err)
+		}
+
+		if diff := cmp.Diff(rec.replaced(), []uint64{1, 2}); diff != "" {
+			t.Errorf("%s: did not get expected next-hop status changes, diff(-got,+want):\n%s", tt.desc, diff)
+		}
+		if diff := cmp.Diff(rec.awaitEntries(t, len(tt.wantEntries)), tt.wantEntries); diff != "" {
+			t.Errorf("%s: did not get expected resolved entries, diff(-got,+want):\n%s", tt.desc, diff)
+		}
+
+		if len(batches) != 1 {
+			t.Fatalf("%s: did not get expected number of resolvability batches, got: %d, want: 1", tt.desc, len(batches))
+		}
+		got := []string{}
+		for _, c := range batches[0].Changes {
+			if c.Resolvable != tt.inUp {
+				t.Errorf("%s: did not get expected resolvability for %s %v, got: %v, want: %v", tt.desc, c.AFT, c.Key, c.Resolvable, tt.inUp)
+			}
+			if c.AFT == constants.IPv4 {
+				got = append(got, fmt.Sprintf("%v", c.Key))
+			}
+		}
+		if diff := cmp.Diff(got, tt.wantResolvable); diff != "" {
+			t.Errorf("%s: did not get expected resolvability changes, diff(-got,+want):\n%s", tt.desc, diff)
+		}
+	}
+}
+
+func TestInterfaceResolver(t *testing.T) {
+	var (
+		mu sync.Mutex
+		// usable is the set of usable interfaces, keyed by the interface and
+		// subinterface.
+		usable = map[string]bool{"eth0/0": true}
+	)
+	resolver := func(name string, sub uint32) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return usable[fmt.Sprintf("%s/%d", name, sub)]
+	}
+
+	subintf := nhOp(3, "192.0.2.3", "eth0")
+	subintf.GetNextHop().GetNextHop().GetInterfaceRef().Subinterface = &wpb.UintValue{Value: 1}
+
+	r := New(defName, WithInterfaceResolver(resolver))
+	applyOps(t, r, defName,
+		nhOp(1, "192.0.2.1", "eth0"),
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+		nhOp(2, "192.0.2.2", "eth1"),
+		nhgOp(2, 2),
+		ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 2),
+		subintf,
+		nhgOp(3, 3),
+		ipv4Op(spb.AFTOperation_ADD, "198.18.0.0/15", 3),
+	)
+
+	var batches []*ResolvabilityBatch
+	r.SetResolvabilityHook(func(b *ResolvabilityBatch) {
+		batches = append(batches, b)
+	})
+
+	// resolvable returns the keys of the entries that were reported to the
+	// resolvability hook with the resolvability want.
+	resolvable := func(want bool) []string {
+		got := []string{}
+		for _, b := range batches {
+			for _, c := range b.Changes {
+				if c.Resolvable == want {
+					got = append(got, fmt.Sprintf("%s %v", c.AFT, c.Key))
+				}
+			}
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	// An interface that the resolver reports as unusable does not change the
+	// resolvability of entries until it is reported by SetInterfaceState.
+	mu.Lock()
+	usable["eth1/0"] = true
+	mu.Unlock()
+	if err := r.SetInterfaceState("eth1", true); err != nil {
+		t.Fatalf("SetInterfaceState(eth1, true): got unexpected error, %v", err)
+	}
+	want := []string{"IPv4 203.0.113.0/24", "NextHop 2", "NextHopGroup 2"}
+	if diff := cmp.Diff(resolvable(true), want); diff != "" {
+		t.Errorf("SetInterfaceState(eth1, true): did not get expected resolvable entries, diff(-got,+want):\n%s", diff)
+	}
+
+	// An interface that is down cannot be used regardless of the resolver.
+	batches = nil
+	if err := r.SetInterfaceState("eth0", false); err != nil {
+		t.Fatalf("SetInterfaceState(eth0, false): got unexpected error, %v", err)
+	}
+	want = []string{"IPv4 198.51.100.0/24", "NextHop 1", "NextHopGroup 1"}
+	if diff := cmp.Diff(resolvable(false), want); diff != "" {
+		t.Errorf("SetInterfaceState(eth0, false): did not get expected unresolvable entries, diff(-got,+want):\n%s", diff)
+	}
+
+	// A next-hop that specifies a subinterface is resolved using it, such that
+	// NH 3 is resolvable only once subinterface 1 of eth0 is usable.
+	batches = nil
+	mu.Lock()
+	usable["eth0/1"] = true
+	mu.Unlock()
+	if err := r.SetInterfaceState("eth0", true); err != nil {
+		t.Fatalf("SetInterfaceState(eth0, true): got unexpected error, %v", err)
+	}
+	want = []string{
+		"IPv4 198.18.0.0/15", "IPv4 198.51.100.0/24",
+		"NextHop 1", "NextHop 3",
+		"NextHopGroup 1", "NextHopGroup 3",
+	}
+	if diff := cmp.Diff(resolvable(true), want); diff != "" {
+		t.Errorf("SetInterfaceState(eth0, true): did not get expected resolvable entries, diff(-got,+want):\n%s", diff)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/util"
+	"github.com/openconfig/ygot/ygot"
+	"lukechampine.com/uint128"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// JournalOp is the type of mutation that is described by a JournalEntry.
+type JournalOp string
+
+const (
+	// JournalAdd indicates that an entry that did not previously exist was
+	// added to the RIB.
+	JournalAdd JournalOp = "ADD"
+	// JournalReplace indicates that an existing entry within the RIB was
+	// replaced, either explicitly or implicitly by an ADD operation.
+	JournalReplace JournalOp = "REPLACE"
+	// JournalDelete indicates that an entry was deleted from the RIB by a
+	// DELETE operation.
+	JournalDelete JournalOp = "DELETE"
+	// JournalFlush indicates that an entry was removed from the RIB by Flush.
+	JournalFlush JournalOp = "FLUSH"
+	// JournalRemovePending indicates that an operation that was pending
+	// resolution was removed from the RIB without being installed.
+	JournalRemovePending JournalOp = "REMOVE_PENDING"
+)
+
+// JournalEntry is a record of a single mutation of the RIB.
+type JournalEntry struct {
+	// Seq is the sequence number of the mutation. Sequence numbers increase
+	// monotonically, starting at 1, for the lifetime of the RIB, and are
+	// assigned to each mutation regardless of whether a journal is kept.
+	Seq uint64 `json:"seq"`
+	// Time is the time at which the mutation was made.
+	Time time.Time `json:"time"`
+	// Op is the type of the mutation.
+	Op JournalOp `json:"op"`
+	// OperationID is the ID of the gRIBI operation that caused the mutation,
+	// it is zero for mutations that were not caused by an operation.
+	OperationID uint64 `json:"operation-id,omitempty"`
+	// Client is the identity of the client that caused the mutation,
+	// expressed as the election ID specified in its operation. It is empty if
+	// no election ID was specified, or the mutation was not caused by an
+	// operation.
+	Client string `json:"client,omitempty"`
+	// Session is the ID of the client session from which the operation that
+	// caused the mutation was received. It is empty if the session is not
+	// known, or the mutation was not caused by an operation.
+	Session string `json:"session,omitempty"`
+	// NetworkInstance is the network instance that was mutated.
+	NetworkInstance string `json:"network-instance"`
+	// AFT is the AFT that was mutated.
+	AFT constants.AFT `json:"-"`
+	// Key is the key of the entry within the AFT - the prefix of an IPv4 or
+	// IPv6 entry, the ID of a next-hop-group, the index of a next-hop or
+	// policy-forwarding entry, or the label of an MPLS entry.
+	Key string `json:"key"`
+	// Before is the RFC7951 JSON serialisation of the entry before the
+	// mutation, it is empty if the entry did not exist. For an operation that
+	// was removed whilst pending, it contains the entry that the operation
+	// would have installed.
+	Before json.RawMessage `json:"before,omitempty"`
+	// After is the RFC7951 JSON serialisation of the entry after the
+	// mutation, it is empty if the entry was removed.
+	After json.RawMessage `json:"after,omitempty"`
+}
+
+// MarshalJSON implements the json.Marshaler interface, rendering the AFT of the
+// entry as its name.
+func (e *JournalEntry) MarshalJSON() ([]byte, error) {
+	type entry JournalEntry
+	return json.Marshal(struct {
+		*entry
+		AFT string `json:"aft"`
+	}{
+		entry: (*entry)(e),
+		AFT:   e.AFT.String(),
+	})
+}
+
+// WithJournal specifies that the RIB should keep a journal of the mutations that
+// are made to it, which can be retrieved using Journal. At most size entries are
+// kept, such that the oldest entries are discarded when the journal is full. The
+// journal is not kept if size is zero.
+func WithJournal(size int) *journalOpt {
+	return &journalOpt{size: size}
+}
+
+// journalOpt is the internal implementation of WithJournal.
+type journalOpt struct {
+	size int
+}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*journalOpt) isRIBOpt() {}
+
+// hasJournal returns the journalOpt within the supplied RIBOpt slice, or nil if
+// it is not present.
+func hasJournal(opt []RIBOpt) *journalOpt {
+	for _, o := range opt {
+		if v, ok := o.(*journalOpt); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// journal is a bounded record of the mutations made to the RIB, stored as a
+// ring buffer.
+type journal struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+	// entries is the ring buffer of entries.
+	entries []*JournalEntry
+	// next is the index within entries at which the next entry is written.
+	next int
+	// full indicates whether the ring buffer has wrapped.
+	full bool
+}
+
+// newJournal returns a new journal based on the option o, or nil if no journal
+// is to be kept.
+func newJournal(o *journalOpt) *journal {
+	if o == nil || o.size <= 0 {
+		return nil
+	}
+	return &journal{entries: make([]*JournalEntry, o.size)}
+}
+
+// record adds e to the journal, assigning it the next sequence number from seq
+// and overwriting the oldest entry if the journal is full. The sequence number is
+// assigned whilst the journal is locked, such that entries are stored in sequence
+// order.
+func (j *journal) record(e *JournalEntry, seq *atomic.Uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e.Seq = seq.Add(1)
+	j.entries[j.next] = e
+	j.next = (j.next + 1) % len(j.entries)
+	if j.next == 0 {
+		j.full = true
+	}
+}
+
+// since returns copies of the entries in the journal whose sequence number is
+// greater than seq, in sequence order.
+func (j *journal) since(seq uint64) []*JournalEntry {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	start, n := 0, j.next
+	if j.full {
+		start, n = j.next, len(j.entries)
+	}
+	var ret []*JournalEntry
+	for i := 0; i < n; i++ {
+		e := j.entries[(start+i)%len(j.entries)]
+		if e.Seq <= seq {
+			continue
+		}
+		c := *e
+		ret = append(ret, &c)
+	}
+	return ret
+}
+
+// journalValue returns the RFC7951 JSON serialisation of the entry e, or nil if
+// e is nil.
+func journalValue(e ygot.GoStruct) json.RawMessage {
+	if e == nil || util.IsValueNil(e) {
+		return nil
+	}
+	js, err := ygot.Marshal7951(e)
+	if err != nil {
+		log.Errorf("cannot serialise journal entry, %v", err)
+		return nil
+	}
+	return js
+}
+
+// recordJournal records the mutation op of the entry with key key, within the
+// AFT a of network instance ni, in the journal of the RIB. The operation that
+// caused the mutation is aftOp, which may be nil, received from the client session
+// with ID session, and before and after are the contents of the entry before and
+// after the mutation. It returns the sequence number that was assigned to the
+// mutation.
+func (r *RIB) recordJournal(op JournalOp, ni, session string, a constants.AFT, key any, aftOp *spb.AFTOperation, before, after ygot.GoStruct) uint64 {
+	if r.journal == nil {
+		return r.seq.Add(1)
+	}
+	e := &JournalEntry{
+		Time:            r.now(),
+		Op:              op,
+		OperationID:     aftOp.GetId(),
+		Session:         session,
+		NetworkInstance: ni,
+		AFT:             a,
+		Key:             fmt.Sprintf("%v", key),
+		Before:          journalValue(before),
+		After:           journalValue(after),
+	}
+	if id := aftOp.GetElectionId(); id != nil {
+		e.Client = uint128.New(id.GetLow(), id.GetHigh()).String()
+	}
+	r.journal.record(e, &r.seq)
+	return e.Seq
+}
+
+// recordAdded records that the operation op, received from the client session
+// with ID session, installed the entry with key key within the AFT a of the
+// network instance RIB niR, named ni, replacing the entry orig. The installed
+// entry is retrieved from niR. It returns the sequence number that was assigned to
+// the mutation.
+func (r *RIB) recordAdded(niR *RIBHolder, ni, session string, a constants.AFT, key any, orig ygot.GoStruct, op *spb.AFTOperation) uint64 {
+	jop := JournalReplace
+	if orig == nil || util.IsValueNil(orig) {
+		jop = JournalAdd
+	}
+	var after ygot.GoStruct
+	if r.journal != nil {
+		// The installed entry is only retrieved if it is to be recorded.
+		after = niR.retrieveEntry(a, key)
+	}
+	return r.recordJournal(jop, ni, session, a, key, op, orig, after)
+}
+
+// recordRemovedPending records that the pending entry p, whose operation was
+// pending resolution, was removed from the RIB.
+func (r *RIB) recordRemovedPending(p *pendingEntry) {
+	if r.journal == nil {
+		r.seq.Add(1)
+		return
+	}
+	op := p.op
+	a, e, err := OperationEntry(op)
+	if err != nil {
+		log.Errorf("cannot record removal of pending operation %d, %v", op.GetId(), err)
+		return
+	}
+	_, key := operationKey(op)
+	r.recordJournal(JournalRemovePending, p.ni, p.session, a, key, op, e, nil)
+}
+
+// Journal returns the entries within the journal of the RIB whose sequence number
+// is greater than sinceSeq, in the order in which the mutations were made. Since
+// the journal is bounded, entries may have been discarded, which can be detected
+// by a gap between sinceSeq and the sequence number of the first entry returned.
+// No entries are returned unless the RIB was created with the WithJournal option.
+func (r *RIB) Journal(sinceSeq uint64) []*JournalEntry {
+	return r.journal.since(sinceSeq)
+}
+
+// JournalJSON returns the entries that are returned by Journal for sinceSeq,
+// serialised as a JSON array.
+func (r *RIB) JournalJSON(sinceSeq uint64) ([]byte, error) {
+	entries := r.Journal(sinceSeq)
+	if entries == nil {
+		entries = []*JournalEntry{}
+	}
+	js, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("cannot serialise journal, %v", err)
+	}
+	return js, nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/constants"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// journalSummary is the subset of the fields of a JournalEntry that are
+// compared by tests.
+type journalSummary struct {
+	Seq         uint64
+	Op          JournalOp
+	OperationID uint64
+	Client      string
+	AFT         constants.AFT
+	Key         string
+	HasBefore   bool
+	HasAfter    bool
+}
+
+// summarise returns the journalSummary for each entry in es.
+func summarise(es []*JournalEntry) []journalSummary {
+	s := []journalSummary{}
+	for _, e := range es {
+		s = append(s, journalSummary{
+			Seq:         e.Seq,
+			Op:          e.Op,
+			OperationID: e.OperationID,
+			Client:      e.Client,
+			AFT:         e.AFT,
+			Key:         e.Key,
+			HasBefore:   len(e.Before) != 0,
+			HasAfter:    len(e.After) != 0,
+		})
+	}
+	return s
+}
+
+func TestJournal(t *testing.T) {
+	now := time.Unix(42, 0)
+	r := New(defName, WithClock(func() time.Time { return now }), WithJournal(100))
+
+	nh := nhOp(1, "192.0.2.1", "")
+	nh.ElectionId = &spb.Uint128{Low: 10}
+	ops := []*spb.AFTOperation{
+		nh,
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+		ipv4Op(spb.AFTOperation_REPLACE, "198.51.100.0/24", 1),
+	}
+	for i, op := range ops {
+		op.Id = uint64(i + 1)
+	}
+	applyOps(t, r, defName, ops...)
+
+	del := ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1)
+	del.Id = 5
+	if _, fails, err := r.DeleteEntry(defName, del); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot delete prefix, fails: %v, err: %v", fails, err)
+	}
+
+	pending := ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 42)
+	pending.Id = 6
+	if _, _, err := r.AddEntry(defName, pending); err != nil {
+		t.Fatalf("cannot add pending entry, %v", err)
+	}
+	if !r.RemovePending(pending.Id) {
+		t.Fatalf("operation %d was not pending", pending.Id)
+	}
+
+	if err := r.Flush([]string{defName}); err != nil {
+		t.Fatalf("cannot flush RIB, %v", err)
+	}
+
+	want := []journalSummary{
+		{Seq: 1, Op: JournalAdd, OperationID: 1, Client: "10", AFT: constants.NextHop, Key: "1", HasAfter: true},
+		{Seq: 2, Op: JournalAdd, OperationID: 2, AFT: constants.NextHopGroup, Key: "1", HasAfter: true},
+		{Seq: 3, Op: JournalAdd, OperationID: 3, AFT: constants.IPv4, Key: "198.51.100.0/24", HasAfter: true},
+		{Seq: 4, Op: JournalReplace, OperationID: 4, AFT: constants.IPv4, Key: "198.51.100.0/24", HasBefore: true, HasAfter: true},
+		{Seq: 5, Op: JournalDelete, OperationID: 5, AFT: constants.IPv4, Key: "198.51.100.0/24", HasBefore: true},
+		{Seq: 6, Op: JournalRemovePending, OperationID: 6, AFT: constants.IPv4, Key: "203.0.113.0/24", HasBefore: true},
+		{Seq: 7, Op: JournalFlush, AFT: constants.NextHopGroup, Key: "1", HasBefore: true},
+		{Seq: 8, Op: JournalFlush, AFT: constants.NextHop, Key: "1", HasBefore: true},
+	}
+	got := r.Journal(0)
+	if diff := cmp.Diff(summarise(got), want); diff != "" {
+		t.Fatalf("Journal(0): did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+	for _, e := range got {
+		if !e.Time.Equal(now) || e.NetworkInstance != defName {
+			t.Errorf("Journal(0): entry %d did not have expected time and network instance, got: %s %s", e.Seq, e.Time, e.NetworkInstance)
+		}
+	}
+
+	if diff := cmp.Diff(summarise(r.Journal(6)), want[6:]); diff != "" {
+		t.Errorf("Journal(6): did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+
+	js, err := r.JournalJSON(7)
+	if err != nil {
+		t.Fatalf("JournalJSON(7): got unexpected error, %v", err)
+	}
+	var gotJSON []map[string]any
+	if err := json.Unmarshal(js, &gotJSON); err != nil {
+		t.Fatalf("JournalJSON(7): cannot unmarshal output, %v", err)
+	}
+	if len(gotJSON) != 1 {
+		t.Fatalf("JournalJSON(7): did not get expected number of entries, got: %s", js)
+	}
+	for k, want := range map[string]any{"seq": float64(8), "op": "FLUSH", "aft": "NextHop", "key": "1"} {
+		if gotJSON[0][k] != want {
+			t.Errorf("JournalJSON(7): did not get expected value for %s, got: %v, want: %v", k, gotJSON[0][k], want)
+		}
+	}
+	if _, ok := gotJSON[0]["before"].(map[string]any); !ok {
+		t.Errorf("JournalJSON(7): did not get entry contents before flush, got: %s", js)
+	}
+}
+
+func TestJournalBounded(t *testing.T) {
+	r := New(defName, WithJournal(3))
+	var ops []*spb.AFTOperation
+	for i := uint64(1); i <= 5; i++ {
+		op := nhOp(i, "192.0.2.1", "")
+		op.Id = i
+		ops = append(ops, op)
+	}
+	applyOps(t, r, defName, ops...)
+
+	seqs := func(es []*JournalEntry) []uint64 {
+		s := []uint64{}
+		for _, e := range es {
+			s = append(s, e.Seq)
+		}
+		return s
+	}
+	if diff := cmp.Diff(seqs(r.Journal(0)), []uint64{3, 4, 5}); diff != "" {
+		t.Errorf("Journal(0): did not get expected sequence numbers, diff(-got,+want):\n%s", diff)
+	}
+	if diff := cmp.Diff(seqs(r.Journal(4)), []uint64{5}); diff != "" {
+		t.Errorf("Journal(4): did not get expected sequence numbers, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestJournalDisabled(t *testing.T) {
+	r := New(defName)
+	applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""))
+	if got := r.Journal(0); got != nil {
+		t.Errorf("Journal(0): got entries for RIB without a journal, %v", got)
+	}
+	js, err := r.JournalJSON(0)
+	if err != nil {
+		t.Fatalf("JournalJSON(0): got unexpected error, %v", err)
+	}
+	if string(js) != "[]" {
+		t.Errorf("JournalJSON(0): did not get empty array, got: %s", js)
+	}
+}
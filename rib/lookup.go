@@ -0,0 +1,315 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/afthelper"
+)
+
+// ErrNoMatch is returned by Lookup when no prefix within the network instance
+// contains the address that was looked up.
+var ErrNoMatch = errors.New("no matching prefix")
+
+// LookupResult is the result of a longest-prefix-match lookup of an address
+// within the RIB.
+type LookupResult struct {
+	// NetworkInstance is the network instance within which the address was
+	// looked up.
+	NetworkInstance string
+	// Prefix is the longest prefix within NetworkInstance that contains the
+	// address.
+	Prefix string
+	// NextHopGroupNetworkInstance and NextHopGroup identify the next-hop-group
+	// that is referenced by the entry for Prefix.
+	NextHopGroupNetworkInstance string
+	NextHopGroup                uint64
+	// NextHops is the set of next-hops that the address is resolved to,
+	// following any recursive resolution via other prefixes within the RIB.
+	NextHops []*LookupNextHop
+}
+
+// LookupNextHop is a next-hop that an address looked up within the RIB is
+// resolved to.
+type LookupNextHop struct {
+	// NextHop is the resolved next-hop. Its Chain describes the prefixes via
+	// which it was recursively resolved, if any.
+	NextHop *afthelper.ResolvedNextHop
+	// Weight is the weight, within the next-hop-group of the matched prefix, of
+	// the next-hop via which NextHop was reached. It is the weight of NextHop
+	// itself when it was not recursively resolved.
+	Weight uint64
+}
+
+// Lookup returns the result of a longest-prefix-match lookup of the address addr
+// within the network instance ni, where an empty name refers to the default
+// network instance. The matching entry is recursively resolved to the set of
+// next-hops that traffic to addr is forwarded to. An error wrapping ErrNoMatch is
+// returned if no prefix within ni contains addr.
+func (r *RIB) Lookup(ni string, addr netip.Addr) (*LookupResult, error) {
+	ni, err := r.operationNetworkInstance(ni)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IsValid() {
+		return nil, fmt.Errorf("invalid address %v", addr)
+	}
+	addr = addr.Unmap()
+
+	ribs, done := r.ribs()
+	defer done()
+
+	niR, ok := r.niRIB[ni]
+	if !ok {
+		return nil, fmt.Errorf("unknown network instance %s", ni)
+	}
+	prefix, ok := niR.prefixes.longestMatch(addr)
+	if !ok {
+		return nil, fmt.Errorf("cannot look up %s in NI %s, %w", addr, ni, ErrNoMatch)
+	}
+
+	res := &LookupResult{NetworkInstance: ni, Prefix: prefix}
+	afts := ribs[ni].GetAfts()
+	switch {
+	case addr.Is4():
+		e := afts.GetIpv4Entry(prefix)
+		res.NextHopGroupNetworkInstance, res.NextHopGroup = e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup()
+	default:
+		e := afts.GetIpv6Entry(prefix)
+		res.NextHopGroupNetworkInstance, res.NextHopGroup = e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup()
+	}
+	if res.NextHopGroupNetworkInstance == "" {
+		res.NextHopGroupNetworkInstance = ni
+	}
+
+	nhs, err := afthelper.ResolvePrefix(ribs, ni, prefix, r.maxResolutionDepth)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve prefix %s in NI %s, %v", prefix, ni, err)
+	}
+	nhg := ribs[res.NextHopGroupNetworkInstance].GetAfts().GetNextHopGroup(res.NextHopGroup)
+	for _, nh := range nhs {
+		idx := nh.Index
+		if len(nh.Chain) != 0 {
+			idx = nh.Chain[0].NextHop
+		}
+		res.NextHops = append(res.NextHops, &LookupNextHop{
+			NextHop: nh,
+			Weight:  nhg.GetNextHop(idx).GetWeight(),
+		})
+	}
+	return res, nil
+}
+
+// prefixIndex is an index of the IPv4 and IPv6 prefixes within a network
+// instance RIB, which is used to perform longest-prefix-match lookups. It is
+// protected by the lock of the RIBHolder that it belongs to.
+type prefixIndex struct {
+	v4, v6 *trieNode
+}
+
+// indexPrefix adds the prefix pfx, which is the key of an IPv4 or IPv6 entry,
+// to the prefix index of the RIBHolder. The caller MUST hold the write lock.
+func (r *RIBHolder) indexPrefix(pfx string) {
+	p, err := netip.ParsePrefix(pfx)
+	if err != nil {
+		log.Errorf("cannot index invalid prefix %s, %v", pfx, err)
+		return
+	}
+	if r.prefixes == nil {
+		r.prefixes = &prefixIndex{}
+	}
+	root := &r.prefixes.v6
+	if p.Addr().Is4() {
+		root = &r.prefixes.v4
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+	(*root).insert(newTrieKey(p.Addr()), p.Bits(), pfx)
+}
+
+// unindexPrefix removes the prefix pfx from the prefix index of the RIBHolder.
+// The caller MUST hold the write lock.
+func (r *RIBHolder) unindexPrefix(pfx string) {
+	p, err := netip.ParsePrefix(pfx)
+	if err != nil || r.prefixes == nil {
+		return
+	}
+	root := r.prefixes.v6
+	if p.Addr().Is4() {
+		root = r.prefixes.v4
+	}
+	if root != nil {
+		root.delete(newTrieKey(p.Addr()), p.Bits())
+	}
+}
+
+// longestMatch returns the longest prefix within the index that contains addr,
+// or false if there is no such prefix.
+func (p *prefixIndex) longestMatch(addr netip.Addr) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	n := p.v6
+	if addr.Is4() {
+		n = p.v4
+	}
+	k := newTrieKey(addr)
+	var best *string
+	for d := 0; n != nil; d += trieStride {
+		v := k.bits(d, trieStride)
+		if r := n.routes[trieFringe|v]; r != nil {
+			best = r
+		}
+		n = n.children[v]
+	}
+	if best == nil {
+		return "", false
+	}
+	return *best, true
+}
+
+// trieKey is an IPv4 or IPv6 address, stored as a 128-bit value whose most
+// significant bit is the first bit of the address.
+type trieKey struct {
+	hi, lo uint64
+}
+
+// newTrieKey returns the trieKey for the address a.
+func newTrieKey(a netip.Addr) trieKey {
+	if a.Is4() {
+		b := a.As4()
+		return trieKey{hi: uint64(binary.BigEndian.Uint32(b[:])) << 32}
+	}
+	b := a.As16()
+	return trieKey{hi: binary.BigEndian.Uint64(b[:8]), lo: binary.BigEndian.Uint64(b[8:])}
+}
+
+// bits returns the n bits of k that start at bit d, where n is at most 64.
+func (k trieKey) bits(d, n int) int {
+	if n == 0 {
+		return 0
+	}
+	hi := k.hi
+	switch {
+	case d >= 64:
+		hi = k.lo << (d - 64)
+	case d > 0:
+		hi = k.hi<<d | k.lo>>(64-d)
+	}
+	return int(hi >> (64 - n))
+}
+
+const (
+	// trieStride is the number of bits of an address that are consumed by
+	// each level of the trie.
+	trieStride = 4
+	// trieFringe is the index within the routes of a trieNode of the first
+	// prefix whose length is the full stride of the node.
+	trieFringe = 1 << trieStride
+)
+
+// trieNode is a node of a multibit trie of prefixes, which consumes trieStride
+// bits of an address. A node at depth d stores the prefixes whose length is
+// greater than d, and no more than d+trieStride - along with the prefix of length
+// zero at the root. Longer prefixes are stored within its children, indexed by
+// the value of the bits that the node consumes.
+//
+// The routes of a node are indexed such that the prefix of length l, whose value
+// within the node is v, is at the index 1<<l | v. The route at each index is the
+// longest prefix stored within the node that covers that index, such that the
+// route at the index trieFringe|v is the longest prefix within the node that
+// matches an address whose bits are v. This allows a lookup to consider a single
+// route at each level of the trie.
+type trieNode struct {
+	routes   [2 * trieFringe]*string
+	children [trieFringe]*trieNode
+	// count is the number of prefixes and children stored within the node.
+	count int
+}
+
+// insert adds the prefix of length l with the address k to the trie rooted at
+// n, where pfx is the key of its entry.
+func (n *trieNode) insert(k trieKey, l int, pfx string) {
+	d := 0
+	for ; l > d+trieStride; d += trieStride {
+		v := k.bits(d, trieStride)
+		if n.children[v] == nil {
+			n.children[v] = &trieNode{}
+			n.count++
+		}
+		n = n.children[v]
+	}
+	i := 1<<(l-d) | k.bits(d, l-d)
+	if n.stored(i) {
+		return
+	}
+	n.allot(i, n.routes[i], &pfx)
+	n.count++
+}
+
+// delete removes the prefix of length l with the address k from the trie rooted
+// at n, removing any nodes that are no longer used.
+func (n *trieNode) delete(k trieKey, l int) {
+	var (
+		path []*trieNode
+		vals []int
+	)
+	d := 0
+	for ; l > d+trieStride; d += trieStride {
+		v := k.bits(d, trieStride)
+		path, vals = append(path, n), append(vals, v)
+		if n = n.children[v]; n == nil {
+			return
+		}
+	}
+	i := 1<<(l-d) | k.bits(d, l-d)
+	if !n.stored(i) {
+		return
+	}
+	n.allot(i, n.routes[i], n.routes[i>>1])
+	n.count--
+
+	for j := len(path) - 1; j >= 0 && n.count == 0; j-- {
+		n = path[j]
+		n.children[vals[j]] = nil
+		n.count--
+	}
+}
+
+// stored returns true if a prefix is stored at the index i of the routes of n,
+// rather than the index being covered by a shorter prefix.
+func (n *trieNode) stored(i int) bool {
+	return n.routes[i] != nil && n.routes[i] != n.routes[i>>1]
+}
+
+// allot replaces the route old with new at the index i of the routes of n, and
+// at each index that i covers, other than those that are covered by a longer
+// prefix.
+func (n *trieNode) allot(i int, old, new *string) {
+	if n.routes[i] != old {
+		return
+	}
+	n.routes[i] = new
+	if i < trieFringe {
+		n.allot(2*i, old, new)
+		n.allot(2*i+1, old, new)
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/afthelper"
+	"github.com/openconfig/ygot/ygot"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+// ipv6Op returns an operation of type op for the IPv6 prefix, pointing to the
+// next-hop-group nhg.
+func ipv6Op(op spb.AFTOperation_Operation, prefix string, nhg uint64) *spb.AFTOperation {
+	return &spb.AFTOperation{
+		Op: op,
+		Entry: &spb.AFTOperation_Ipv6{
+			Ipv6: &aftpb.Afts_Ipv6EntryKey{
+				Prefix:    prefix,
+				Ipv6Entry: &aftpb.Afts_Ipv6Entry{NextHopGroup: &wpb.UintValue{Value: nhg}},
+			},
+		},
+	}
+}
+
+// newLookupRIB returns a RIB containing a default route, along with a set of
+// covering and covered prefixes, and a prefix that is recursively resolved.
+func newLookupRIB(t *testing.T) *RIB {
+	t.Helper()
+	r := New(defName)
+	applyOps(t, r, defName,
+		nhOp(1, "192.0.2.1", "eth0"),
+		nhOp(2, "192.0.2.2", "eth1"),
+		nhOp(3, "10.1.1.1", ""),
+		nhgOp(1, 1),
+		nhgOp(2, 2),
+		ipv4Op(spb.AFTOperation_ADD, "0.0.0.0/0", 1),
+		ipv4Op(spb.AFTOperation_ADD, "10.0.0.0/8", 2),
+		ipv4Op(spb.AFTOperation_ADD, "10.1.0.0/16", 1),
+		ipv4Op(spb.AFTOperation_ADD, "10.1.1.1/32", 2),
+		nhgOp(3, 3),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 3),
+		ipv6Op(spb.AFTOperation_ADD, "2001:db8::/32", 1),
+		ipv6Op(spb.AFTOperation_ADD, "2001:db8:1::/48", 2),
+	)
+	return r
+}
+
+// lookupSummary returns the prefix matched by res, and the index of each
+// next-hop that it is resolved to.
+func lookupSummary(res *LookupResult) (string, []uint64) {
+	idx := []uint64{}
+	for _, nh := range res.NextHops {
+		idx = append(idx, nh.NextHop.Index)
+	}
+	return res.Prefix, idx
+}
+
+func TestLookup(t *testing.T) {
+	r := newLookupRIB(t)
+
+	tests := []struct {
+		desc       string
+		inAddr     string
+		wantPrefix string
+		wantNHs    []uint64
+	}{{
+		desc:       "default route",
+		inAddr:     "192.0.2.42",
+		wantPrefix: "0.0.0.0/0",
+		wantNHs:    []uint64{1},
+	}, {
+		desc:       "covering prefix",
+		inAddr:     "10.2.3.4",
+		wantPrefix: "10.0.0.0/8",
+		wantNHs:    []uint64{2},
+	}, {
+		desc:       "covered prefix",
+		inAddr:     "10.1.2.3",
+		wantPrefix: "10.1.0.0/16",
+		wantNHs:    []uint64{1},
+	}, {
+		desc:       "host route",
+		inAddr:     "10.1.1.1",
+		wantPrefix: "10.1.1.1/32",
+		wantNHs:    []uint64{2},
+	}, {
+		desc:       "recursively resolved prefix",
+		inAddr:     "198.51.100.1",
+		wantPrefix: "198.51.100.0/24",
+		wantNHs:    []uint64{2},
+	}, {
+		desc:       "IPv6 covering prefix",
+		inAddr:     "2001:db8::1",
+		wantPrefix: "2001:db8::/32",
+		wantNHs:    []uint64{1},
+	}, {
+		desc:       "IPv6 covered prefix",
+		inAddr:     "2001:db8:1::1",
+		wantPrefix: "2001:db8:1::/48",
+		wantNHs:    []uint64{2},
+	}, {
+		desc:       "IPv4-mapped IPv6 address",
+		inAddr:     "::ffff:10.1.2.3",
+		wantPrefix: "10.1.0.0/16",
+		wantNHs:    []uint64{1},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := r.Lookup("", netip.MustParseAddr(tt.inAddr))
+			if err != nil {
+				t.Fatalf("Lookup(%s): got unexpected error, %v", tt.inAddr, err)
+			}
+			gotPrefix, gotNHs := lookupSummary(got)
+			if gotPrefix != tt.wantPrefix {
+				t.Errorf("Lookup(%s): did not get expected prefix, got: %s, want: %s", tt.inAddr, gotPrefix, tt.wantPrefix)
+			}
+			if diff := cmp.Diff(gotNHs, tt.wantNHs); diff != "" {
+				t.Errorf("Lookup(%s): did not get expected next-hops, diff(-got,+want):\n%s", tt.inAddr, diff)
+			}
+		})
+	}
+}
+
+func TestLookupRecursive(t *testing.T) {
+	r := newLookupRIB(t)
+	got, err := r.Lookup(defName, netip.MustParseAddr("198.51.100.1"))
+	if err != nil {
+		t.Fatalf("Lookup: got unexpected error, %v", err)
+	}
+	want := &LookupResult{
+		NetworkInstance:             defName,
+		Prefix:                      "198.51.100.0/24",
+		NextHopGroupNetworkInstance: defName,
+		NextHopGroup:                3,
+		NextHops: []*LookupNextHop{{
+			NextHop: &afthelper.ResolvedNextHop{
+				NetworkInstance: defName,
+				Index:           2,
+				Address:         "192.0.2.2",
+				Interface:       "eth1",
+				Chain: []*afthelper.ResolutionStep{{
+					NetworkInstance:       defName,
+					NextHop:               3,
+					Address:               "10.1.1.1",
+					PrefixNetworkInstance: defName,
+					Prefix:                "10.1.1.1/32",
+				}},
+			},
+			Weight: 1,
+		}},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Lookup: did not get expected result, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestLookupDelete(t *testing.T) {
+	r := newLookupRIB(t)
+
+	steps := []struct {
+		del        *spb.AFTOperation
+		wantPrefix string
+	}{{
+		del:        ipv4Op(spb.AFTOperation_DELETE, "10.1.0.0/16", 1),
+		wantPrefix: "10.0.0.0/8",
+	}, {
+		del:        ipv4Op(spb.AFTOperation_DELETE, "10.0.0.0/8", 2),
+		wantPrefix: "0.0.0.0/0",
+	}, {
+		del: ipv4Op(spb.AFTOperation_DELETE, "0.0.0.0/0", 1),
+	}}
+
+	addr := netip.MustParseAddr("10.1.2.3")
+	for _, s := range steps {
+		applyOps(t, r, defName, s.del)
+		got, err := r.Lookup(defName, addr)
+		switch {
+		case s.wantPrefix == "":
+			if !errors.Is(err, ErrNoMatch) {
+				t.Errorf("Lookup(%s) after deleting %s: did not get expected error, got: %v, want: %v", addr, s.del.GetIpv4().GetPrefix(), err, ErrNoMatch)
+			}
+		case err != nil:
+			t.Errorf("Lookup(%s) after deleting %s: got unexpected error, %v", addr, s.del.GetIpv4().GetPrefix(), err)
+		case got.Prefix != s.wantPrefix:
+			t.Errorf("Lookup(%s) after deleting %s: did not get expected prefix, got: %s, want: %s", addr, s.del.GetIpv4().GetPrefix(), got.Prefix, s.wantPrefix)
+		}
+	}
+
+	if err := r.Flush([]string{defName}); err != nil {
+		t.Fatalf("cannot flush RIB, %v", err)
+	}
+	if _, err := r.Lookup(defName, netip.MustParseAddr("2001:db8::1")); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("Lookup after Flush: did not get expected error, got: %v, want: %v", err, ErrNoMatch)
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	r := newLookupRIB(t)
+	if _, err := r.Lookup("VRF-A", netip.MustParseAddr("192.0.2.1")); err == nil {
+		t.Errorf("Lookup: did not get expected error for unknown network instance")
+	}
+	if _, err := r.Lookup(defName, netip.Addr{}); err == nil {
+		t.Errorf("Lookup: did not get expected error for invalid address")
+	}
+}
+
+// randomPrefix returns a random IPv4 prefix, with a length between 8 and 32.
+func randomPrefix(rnd *rand.Rand) netip.Prefix {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], rnd.Uint32())
+	return netip.PrefixFrom(netip.AddrFrom4(b), 8+rnd.Intn(25)).Masked()
+}
+
+func TestPrefixIndex(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	h := NewRIBHolder(defName)
+	prefixes := map[netip.Prefix]bool{}
+
+	// linearMatch returns the longest prefix that contains addr by scanning
+	// all prefixes.
+	linearMatch := func(addr netip.Addr) (string, bool) {
+		var best netip.Prefix
+		found := false
+		for p := range prefixes {
+			if p.Contains(addr) && (!found || p.Bits() > best.Bits()) {
+				best, found = p, true
+			}
+		}
+		if !found {
+			return "", false
+		}
+		return best.String(), true
+	}
+
+	for i := 0; i < 2000; i++ {
+		p := randomPrefix(rnd)
+		switch {
+		case prefixes[p] || rnd.Intn(4) == 0 && len(prefixes) != 0:
+			// Remove an arbitrary prefix.
+			for d := range prefixes {
+				h.unindexPrefix(d.String())
+				delete(prefixes, d)
+				break
+			}
+		default:
+			h.indexPrefix(p.String())
+			prefixes[p] = true
+		}
+
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], rnd.Uint32())
+		for _, addr := range []netip.Addr{netip.AddrFrom4(b), p.Addr()} {
+			got, gotOK := h.prefixes.longestMatch(addr)
+			want, wantOK := linearMatch(addr)
+			if got != want || gotOK != wantOK {
+				t.Fatalf("longestMatch(%s) after %d changes: did not get expected prefix, got: %s (%v), want: %s (%v)", addr, i, got, gotOK, want, wantOK)
+			}
+		}
+	}
+}
+
+// BenchmarkLookup measures the time taken to look up an address within a RIB
+// containing one million prefixes.
+func BenchmarkLookup(b *testing.B) {
+	const n = 1000000
+	rnd := rand.New(rand.NewSource(42))
+
+	r := New(defName, DisableRIBCheckFn())
+	for _, op := range []*spb.AFTOperation{nhOp(1, "192.0.2.1", "eth0"), nhgOp(1, 1)} {
+		if _, _, err := r.AddEntry(defName, op); err != nil {
+			b.Fatalf("cannot add entry, %v", err)
+		}
+	}
+
+	// Adding each prefix using AddEntry is slow for a RIB of this size, so the
+	// prefixes are written to the network instance RIB directly.
+	niR, _ := r.NetworkInstanceRIB(defName)
+	addrs := make([]netip.Addr, 0, n)
+	for i := 0; i < n; i++ {
+		p := randomPrefix(rnd)
+		niR.r.GetAfts().GetOrCreateIpv4Entry(p.String()).NextHopGroup = ygot.Uint64(1)
+		niR.indexPrefix(p.String())
+		addrs = append(addrs, p.Addr())
+	}
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, ok := niR.prefixes.longestMatch(addrs[i%n]); !ok {
+				b.Fatalf("cannot find match for %s", addrs[i%n])
+			}
+		}
+	})
+
+	b.Run("resolved", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := r.Lookup(defName, addrs[i%n]); err != nil {
+				b.Fatalf("cannot look up %s, %v", addrs[i%n], err)
+			}
+		}
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"time"
+
+	"github.com/openconfig/gribigo/constants"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// EntryMetadata describes the operation that programmed an entry within the RIB,
+// such that the client that is responsible for the entry can be determined.
+type EntryMetadata struct {
+	// Session is the ID of the client session that programmed the entry. It is
+	// empty if the entry was not programmed on behalf of a session - for
+	// example, it was added using AddEntry, or derived from another entry.
+	Session string
+	// ElectionID is the election ID that was specified in the operation that
+	// programmed the entry, it is nil if no election ID was specified.
+	ElectionID *spb.Uint128
+	// OperationID is the ID of the operation that programmed the entry.
+	OperationID uint64
+	// Programmed is the time at which the entry was installed in the RIB.
+	Programmed time.Time
+}
+
+// AddEntryForSession adds the entry described in op to the network instance ni as
+// per AddEntry, on behalf of the client session with the ID session. The session is
+// recorded in the metadata of each entry that is installed as a result of op, and
+// in the journal of the RIB. Entries that are pending resolution retain the session
+// of the operation that added them, regardless of the operation that results in
+// them being installed.
+func (r *RIB) AddEntryForSession(ni, session string, op *spb.AFTOperation) ([]*OpResult, []*OpResult, error) {
+	ni, err := r.operationNetworkInstance(ni)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oks, fails := []*OpResult{}, []*OpResult{}
+	if err := validateOperationKey(op); err != nil {
+		fails = append(fails, &OpResult{
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
+			Error:   err.Error(),
+		})
+		return oks, fails, nil
+	}
+	checked := map[pendingID]bool{}
+	if err := r.addEntryInternal(ni, session, op, &oks, &fails, checked, 0); err != nil {
+		return nil, nil, err
+	}
+
+	return oks, fails, nil
+}
+
+// DeleteEntryForSession removes the entry specified by op from the network
+// instance ni as per DeleteEntry, on behalf of the client session with the ID
+// session. The session is recorded as the deleter of the entry in the journal of
+// the RIB.
+func (r *RIB) DeleteEntryForSession(ni, session string, op *spb.AFTOperation) ([]*OpResult, []*OpResult, error) {
+	return r.deleteEntry(ni, session, op, 0)
+}
+
+// GetEntryMetadata returns the metadata describing the operation that programmed
+// the entry with key key, within the AFT a of network instance ni, where an empty
+// name refers to the default network instance. The key is the prefix of an IPv4 or
+// IPv6 entry, or the label, ID or index of other entries. It returns false if the
+// entry is not installed in the RIB.
+func (r *RIB) GetEntryMetadata(ni string, a constants.AFT, key any) (*EntryMetadata, bool) {
+	if ni == "" {
+		ni = r.defaultName
+	}
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	m, ok := r.entryMetadata[newEntryID(ni, a, key)]
+	if !ok {
+		return nil, false
+	}
+	c := *m
+	if m.ElectionID != nil {
+		c.ElectionID = &spb.Uint128{High: m.ElectionID.GetHigh(), Low: m.ElectionID.GetLow()}
+	}
+	return &c, true
+}
+
+// GetOperationEntryMetadata returns the metadata describing the operation that
+// programmed the entry that the operation op refers to, within network instance
+// ni, as per GetEntryMetadata.
+func (r *RIB) GetOperationEntryMetadata(ni string, op *spb.AFTOperation) (*EntryMetadata, bool) {
+	a, key := operationKey(op)
+	if key == nil {
+		return nil, false
+	}
+	return r.GetEntryMetadata(ni, a, key)
+}
+
+// setEntryMetadata records that the entry with key key, within the AFT a of
+// network instance ni, was installed by the operation op on behalf of the client
+// session with the ID session, replacing any existing metadata for the entry.
+func (r *RIB) setEntryMetadata(ni, session string, a constants.AFT, key any, op *spb.AFTOperation) {
+	m := &EntryMetadata{
+		Session:     session,
+		OperationID: op.GetId(),
+		Programmed:  r.now(),
+	}
+	if id := op.GetElectionId(); id != nil {
+		m.ElectionID = &spb.Uint128{High: id.GetHigh(), Low: id.GetLow()}
+	}
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	if r.entryMetadata == nil {
+		r.entryMetadata = map[entryID]*EntryMetadata{}
+	}
+	r.entryMetadata[newEntryID(ni, a, key)] = m
+}
+
+// removeEntryMetadata removes the metadata of the entry with key key, within the
+// AFT a of network instance ni.
+func (r *RIB) removeEntryMetadata(ni string, a constants.AFT, key any) {
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	delete(r.entryMetadata, newEntryID(ni, a, key))
+}
+
+// flushEntryMetadata removes the metadata of all entries within the network
+// instance ni.
+func (r *RIB) flushEntryMetadata(ni string) {
+	r.metaMu.Lock()
+	defer r.metaMu.Unlock()
+	for id := range r.entryMetadata {
+		if id.ni == ni {
+			delete(r.entryMetadata, id)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestEntryMetadata(t *testing.T) {
+	now := time.Unix(42, 0)
+	r := New(defName, WithClock(func() time.Time { return now }), WithJournal(100))
+
+	// sessionOp sets the ID and election ID of op, and applies it to the RIB on
+	// behalf of session.
+	sessionOp := func(session string, id, elecID uint64, op *spb.AFTOperation) {
+		t.Helper()
+		op.Id, op.ElectionId = id, &spb.Uint128{Low: elecID}
+		var (
+			fails []*OpResult
+			err   error
+		)
+		switch op.GetOp() {
+		case spb.AFTOperation_DELETE:
+			_, fails, err = r.DeleteEntryForSession(defName, session, op)
+		default:
+			_, fails, err = r.AddEntryForSession(defName, session, op)
+		}
+		if err != nil || len(fails) != 0 {
+			t.Fatalf("cannot apply operation %s, fails: %v, err: %v", op, fails, err)
+		}
+	}
+
+	checkMetadata := func(a constants.AFT, key any, want *EntryMetadata) {
+		t.Helper()
+		got, ok := r.GetEntryMetadata("", a, key)
+		if !ok {
+			t.Fatalf("GetEntryMetadata(%s, %v): did not find metadata", a, key)
+		}
+		if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+			t.Errorf("GetEntryMetadata(%s, %v): did not get expected metadata, diff(-got,+want):\n%s", a, key, diff)
+		}
+	}
+
+	sessionOp("session-1", 1, 10, nhOp(1, "192.0.2.1", ""))
+	checkMetadata(constants.NextHop, uint64(1), &EntryMetadata{
+		Session:     "session-1",
+		ElectionID:  &spb.Uint128{Low: 10},
+		OperationID: 1,
+		Programmed:  now,
+	})
+
+	// An entry that is pending is attributed to the session that added it,
+	// rather than the session whose operation resolved it.
+	sessionOp("session-1", 2, 10, nhgOp(1, 2))
+	if _, ok := r.GetEntryMetadata(defName, constants.NextHopGroup, uint64(1)); ok {
+		t.Errorf("GetEntryMetadata: got metadata for pending entry")
+	}
+	now = time.Unix(84, 0)
+	sessionOp("session-2", 1, 11, nhOp(2, "192.0.2.2", ""))
+	checkMetadata(constants.NextHopGroup, uint64(1), &EntryMetadata{
+		Session:     "session-1",
+		ElectionID:  &spb.Uint128{Low: 10},
+		OperationID: 2,
+		Programmed:  now,
+	})
+
+	// A replace updates the attribution of the entry.
+	sessionOp("session-2", 2, 11, nhOp(1, "192.0.2.3", ""))
+	checkMetadata(constants.NextHop, uint64(1), &EntryMetadata{
+		Session:     "session-2",
+		ElectionID:  &spb.Uint128{Low: 11},
+		OperationID: 2,
+		Programmed:  now,
+	})
+
+	sessionOp("session-2", 3, 11, ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1))
+	// The metadata of the entry that an operation refers to can be retrieved
+	// using the operation.
+	if md, ok := r.GetOperationEntryMetadata("", ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1)); !ok || md.Session != "session-2" {
+		t.Errorf("GetOperationEntryMetadata: did not get expected metadata, got: %v, %v, want session: session-2", md, ok)
+	}
+	sessionOp("session-3", 1, 12, ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1))
+	if _, ok := r.GetEntryMetadata(defName, constants.IPv4, "198.51.100.0/24"); ok {
+		t.Errorf("GetEntryMetadata: got metadata for deleted entry")
+	}
+
+	var got []string
+	for _, e := range r.Journal(0) {
+		got = append(got, string(e.Op)+" "+e.AFT.String()+" "+e.Key+" "+e.Session)
+	}
+	want := []string{
+		"ADD NextHop 1 session-1",
+		"ADD NextHop 2 session-2",
+		"ADD NextHopGroup 1 session-1",
+		"REPLACE NextHop 1 session-2",
+		"ADD IPv4 198.51.100.0/24 session-2",
+		"DELETE IPv4 198.51.100.0/24 session-3",
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("did not get expected journal, diff(-got,+want):\n%s", diff)
+	}
+
+	if err := r.Flush([]string{defName}); err != nil {
+		t.Fatalf("cannot flush RIB, %v", err)
+	}
+	if _, ok := r.GetEntryMetadata(defName, constants.NextHop, uint64(1)); ok {
+		t.Errorf("GetEntryMetadata: got metadata for flushed entry")
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/openconfig/gribigo/aft"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/types/known/structpb"
+	"lukechampine.com/uint128"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// saveFormatVersion is the version of the format written by Save.
+const saveFormatVersion = 1
+
+// Fields of the metadata that is written by Save.
+const (
+	metaVersion          = "version"
+	metaDefaultName      = "default_network_instance"
+	metaNetworkInstances = "network_instances"
+	metaElectionIDHigh   = "election_id_high"
+	metaElectionIDLow    = "election_id_low"
+)
+
+// SetElectionID records that id is an election ID that was used to program the
+// RIB. The highest election ID that is recorded is stored when the RIB is saved,
+// such that it can be restored along with the RIB's contents.
+func (r *RIB) SetElectionID(id *spb.Uint128) {
+	if id == nil {
+		return
+	}
+	r.elecMu.Lock()
+	defer r.elecMu.Unlock()
+	if r.electionID == nil || uint128.New(id.GetLow(), id.GetHigh()).Cmp(uint128.New(r.electionID.GetLow(), r.electionID.GetHigh())) > 0 {
+		r.electionID = &spb.Uint128{High: id.GetHigh(), Low: id.GetLow()}
+	}
+}
+
+// ElectionID returns the highest election ID that was recorded using SetElectionID,
+// or restored by Load. It returns nil if no election ID has been recorded.
+func (r *RIB) ElectionID() *spb.Uint128 {
+	r.elecMu.Lock()
+	defer r.elecMu.Unlock()
+	if r.electionID == nil {
+		return nil
+	}
+	return &spb.Uint128{High: r.electionID.GetHigh(), Low: r.electionID.GetLow()}
+}
+
+// Save writes the contents of the RIB to w, such that it can be restored using
+// Load. The contents are written as a sequence of length-delimited protobufs, the
+// first of which is a Struct containing the metadata of the RIB - its network
+// instances and the election ID returned by ElectionID. Each subsequent message is
+// an AFTOperation that adds an entry of the RIB, ordered such that the entries that
+// an entry references are written before it. Operations that are pending resolution
+// are not written.
+func (r *RIB) Save(w io.Writer) error {
+	snap := r.Snapshot()
+	defer snap.Release()
+
+	nis := snap.NetworkInstances()
+	niVals := make([]any, 0, len(nis))
+	for _, n := range nis {
+		niVals = append(niVals, n)
+	}
+	meta := map[string]any{
+		metaVersion:          saveFormatVersion,
+		metaDefaultName:      r.defaultName,
+		metaNetworkInstances: niVals,
+	}
+	if id := r.ElectionID(); id != nil {
+		meta[metaElectionIDHigh] = strconv.FormatUint(id.GetHigh(), 10)
+		meta[metaElectionIDLow] = strconv.FormatUint(id.GetLow(), 10)
+	}
+	m, err := structpb.NewStruct(meta)
+	if err != nil {
+		return fmt.Errorf("cannot create metadata, %v", err)
+	}
+	if _, err := protodelim.MarshalTo(w, m); err != nil {
+		return fmt.Errorf("cannot write metadata, %v", err)
+	}
+
+	var id uint64
+	write := func(ni string, op *spb.AFTOperation) error {
+		id++
+		op.Id, op.NetworkInstance, op.Op = id, ni, spb.AFTOperation_ADD
+		if _, err := protodelim.MarshalTo(w, op); err != nil {
+			return fmt.Errorf("cannot write entry %s, %v", prototext.Format(op), err)
+		}
+		return nil
+	}
+
+	// Next-hops are written first, followed by next-hop-groups, since all other
+	// entries reference next-hop-groups, across all network instances.
+	for _, fn := range []func(string, *aft.Afts) error{
+		func(ni string, a *aft.Afts) error {
+			for _, k := range sortedKeys(a.NextHop) {
+				p, err := ConcreteNextHopProto(a.NextHop[k])
+				if err != nil {
+					return err
+				}
+				if err := write(ni, &spb.AFTOperation{Entry: &spb.AFTOperation_NextHop{NextHop: p}}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(ni string, a *aft.Afts) error {
+			for _, k := range sortedKeys(a.NextHopGroup) {
+				p, err := ConcreteNextHopGroupProto(a.NextHopGroup[k])
+				if err != nil {
+					return err
+				}
+				if err := write(ni, &spb.AFTOperation{Entry: &spb.AFTOperation_NextHopGroup{NextHopGroup: p}}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(ni string, a *aft.Afts) error {
+			for _, k := range sortedKeys(a.Ipv4Entry) {
+				p, err := ConcreteIPv4Proto(a.Ipv4Entry[k])
+				if err != nil {
+					return err
+				}
+				if err := write(ni, &spb.AFTOperation{Entry: &spb.AFTOperation_Ipv4{Ipv4: p}}); err != nil {
+					return err
+				}
+			}
+			for _, k := range sortedKeys(a.Ipv6Entry) {
+				p, err := ConcreteIPv6Proto(a.Ipv6Entry[k])
+				if err != nil {
+					return err
+				}
+				if err := write(ni, &spb.AFTOperation{Entry: &spb.AFTOperation_Ipv6{Ipv6: p}}); err != nil {
+					return err
+				}
+			}
+			labels := make([]aft.Afts_LabelEntry_Label_Union, 0, len(a.LabelEntry))
+			for k := range a.LabelEntry {
+				labels = append(labels, k)
+			}
+			sort.Slice(labels, func(i, j int) bool { return fmt.Sprint(labels[i]) < fmt.Sprint(labels[j]) })
+			for _, k := range labels {
+				p, err := ConcreteMPLSProto(a.LabelEntry[k])
+				if err != nil {
+					return err
+				}
+				if err := write(ni, &spb.AFTOperation{Entry: &spb.AFTOperation_Mpls{Mpls: p}}); err != nil {
+					return err
+				}
+			}
+			for _, k := range sortedKeys(a.PolicyForwardingEntry) {
+				p, err := ConcretePolicyForwardingProto(a.PolicyForwardingEntry[k])
+				if err != nil {
+					return err
+				}
+				if err := write(ni, &spb.AFTOperation{Entry: &spb.AFTOperation_PolicyForwardingEntry{PolicyForwardingEntry: p}}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	} {
+		for _, ni := range nis {
+			if err := fn(ni, snap.nis[ni].afts); err != nil {
+				return fmt.Errorf("cannot save network instance %s, %v", ni, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Load creates a new RIB with the options opt, and restores the contents that were
+// written by Save from rd into it. Each entry is added to the RIB as an operation,
+// such that references between entries are validated and reference counts are
+// rebuilt. Entries that cannot be added to the RIB, or whose references cannot be
+// resolved, do not prevent the remaining entries from being restored, rather an
+// error describing each is returned in the slice of errors. A non-nil error is
+// returned if the contents of rd cannot be read.
+func Load(rd io.Reader, opt ...RIBOpt) (*RIB, []error, error) {
+	br := bufio.NewReader(rd)
+	meta := &structpb.Struct{}
+	if err := protodelim.UnmarshalFrom(br, meta); err != nil {
+		return nil, nil, fmt.Errorf("cannot read metadata, %v", err)
+	}
+	fields := meta.GetFields()
+	if v := fields[metaVersion].GetNumberValue(); v != saveFormatVersion {
+		return nil, nil, fmt.Errorf("unsupported format version %v", v)
+	}
+	dn := fields[metaDefaultName].GetStringValue()
+	if dn == "" {
+		return nil, nil, errors.New("metadata does not contain the default network instance")
+	}
+
+	r := New(dn, opt...)
+	for _, v := range fields[metaNetworkInstances].GetListValue().GetValues() {
+		if n := v.GetStringValue(); n != dn {
+			if err := r.AddNetworkInstance(n); err != nil {
+				return nil, nil, fmt.Errorf("cannot create network instance %s, %v", n, err)
+			}
+		}
+	}
+	if h, l := fields[metaElectionIDHigh], fields[metaElectionIDLow]; h != nil && l != nil {
+		high, err := strconv.ParseUint(h.GetStringValue(), 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid election ID, %v", err)
+		}
+		low, err := strconv.ParseUint(l.GetStringValue(), 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid election ID, %v", err)
+		}
+		r.SetElectionID(&spb.Uint128{High: high, Low: low})
+	}
+
+	var errs []error
+	for {
+		op := &spb.AFTOperation{}
+		err := protodelim.UnmarshalFrom(br, op)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot read entry, %v", err)
+		}
+		_, fails, err := r.AddEntry(op.GetNetworkInstance(), op)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot restore entry %s, %v", prototext.Format(op), err))
+			continue
+		}
+		for _, f := range fails {
+			errs = append(errs, fmt.Errorf("cannot restore entry %s, %s", prototext.Format(f.Op), f.Error))
+		}
+	}
+
+	// Entries that are still pending cannot be resolved, and are removed such that
+	// their operation IDs do not remain in the RIB.
+	for _, p := range r.getPending() {
+		errs = append(errs, fmt.Errorf("cannot restore entry %s, unresolved references: %v", prototext.Format(p.op), r.UnresolvedReferences(p.ni, p.op)))
+		r.RemovePendingForSession(p.session, p.op.GetId())
+	}
+	return r, errs, nil
+}
+
+// sortedKeys returns the keys of the map m in ascending order.
+func sortedKeys[K uint64 | string, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestSaveLoad(t *testing.T) {
+	r := New(defName)
+	if err := r.AddNetworkInstance("VRF-A"); err != nil {
+		t.Fatalf("cannot add network instance, %v", err)
+	}
+	if err := r.AddNetworkInstance("VRF-EMPTY"); err != nil {
+		t.Fatalf("cannot add network instance, %v", err)
+	}
+	// The operations are deliberately in an order that requires entries to be
+	// held pending resolution, such that Save must reorder them.
+	ops := []*spb.AFTOperation{
+		ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 2),
+		nhgOp(2, 2),
+		nhOp(2, "192.0.2.2", ""),
+		nhOp(1, "192.0.2.1", ""),
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+	}
+	for i, op := range ops {
+		op.Id = uint64(i + 1)
+	}
+	applyOps(t, r, defName, ops...)
+	applyOps(t, r, "VRF-A",
+		nhOp(1, "192.0.2.1", ""),
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 1),
+	)
+	r.SetElectionID(&spb.Uint128{High: 1, Low: 42})
+	r.SetElectionID(&spb.Uint128{High: 0, Low: 100})
+
+	var buf bytes.Buffer
+	if err := r.Save(&buf); err != nil {
+		t.Fatalf("Save(): got unexpected error, %v", err)
+	}
+
+	got, errs, err := Load(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Load(): got unexpected error, %v", err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("Load(): got unexpected entry errors, %v", errs)
+	}
+
+	if diff := cmp.Diff(got.KnownNetworkInstances(), r.KnownNetworkInstances()); diff != "" {
+		t.Errorf("Load(): did not get expected network instances, diff(-got,+want):\n%s", diff)
+	}
+	if diff := cmp.Diff(got.ElectionID(), &spb.Uint128{High: 1, Low: 42}, protocmp.Transform()); diff != "" {
+		t.Errorf("Load(): did not get expected election ID, diff(-got,+want):\n%s", diff)
+	}
+	for _, ni := range r.KnownNetworkInstances() {
+		want, err := r.ExportAFT(ni)
+		if err != nil {
+			t.Fatalf("cannot export network instance %s, %v", ni, err)
+		}
+		gotAFT, err := got.ExportAFT(ni)
+		if err != nil {
+			t.Fatalf("cannot export restored network instance %s, %v", ni, err)
+		}
+		if diff := cmp.Diff(gotAFT, want); diff != "" {
+			t.Errorf("Load(): did not get expected contents for network instance %s, diff(-got,+want):\n%s", ni, diff)
+		}
+	}
+
+	// Reference counts and resolution state are rebuilt.
+	for _, id := range []uint64{1, 2} {
+		if n, err := got.NHGReferences(defName, id); err != nil || n != 1 {
+			t.Errorf("NHGReferences(%d): did not get expected count, got: %d (err: %v), want: 1", id, n, err)
+		}
+		if n, err := got.NHReferences(defName, id); err != nil || n != 1 {
+			t.Errorf("NHReferences(%d): did not get expected count, got: %d (err: %v), want: 1", id, n, err)
+		}
+	}
+	resolved, err := got.ResolvedEntries(defName)
+	if err != nil {
+		t.Fatalf("ResolvedEntries(): got unexpected error, %v", err)
+	}
+	if diff := cmp.Diff(resolved, []string{"198.51.100.0/24", "203.0.113.0/24"}); diff != "" {
+		t.Errorf("ResolvedEntries(): did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+	// A referenced entry cannot be deleted from the restored RIB.
+	if _, fails, _ := got.DeleteEntry(defName, nhgOp(1, 1)); len(fails) != 1 {
+		t.Errorf("DeleteEntry(): did not get expected failure deleting referenced next-hop-group, got: %v", fails)
+	}
+}
+
+func TestLoadInvalidEntries(t *testing.T) {
+	r := New(defName)
+	applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""), nhgOp(1, 1), ipv4Op(spb.AFTOperation_ADD, "192.0.2.0/24", 1))
+	var buf bytes.Buffer
+	if err := r.Save(&buf); err != nil {
+		t.Fatalf("Save(): got unexpected error, %v", err)
+	}
+
+	// Append entries that cannot be restored, one that references a
+	// next-hop-group that does not exist, and one within a network instance
+	// that does not exist.
+	unresolved := ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 42)
+	unresolved.Id = 100
+	unknownNI := nhOp(2, "192.0.2.2", "")
+	unknownNI.Id, unknownNI.NetworkInstance = 101, "VRF-UNKNOWN"
+	for _, op := range []*spb.AFTOperation{unresolved, unknownNI} {
+		if _, err := protodelim.MarshalTo(&buf, op); err != nil {
+			t.Fatalf("cannot write operation, %v", err)
+		}
+	}
+
+	got, errs, err := Load(&buf)
+	if err != nil {
+		t.Fatalf("Load(): got unexpected error, %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("Load(): did not get expected number of entry errors, got: %v, want: 2", errs)
+	}
+	niR, ok := got.NetworkInstanceRIB(defName)
+	if !ok {
+		t.Fatalf("cannot find default network instance")
+	}
+	if _, ok := niR.GetIPv4Entry("192.0.2.0/24"); !ok {
+		t.Errorf("valid entry was not restored")
+	}
+	if _, ok := niR.GetIPv4Entry("198.51.100.0/24"); ok {
+		t.Errorf("unresolvable entry was restored")
+	}
+	if got.IsPending(unresolved.Id) {
+		t.Errorf("unresolvable entry remains pending after restore")
+	}
+}
+
+func TestLoadInvalidInput(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []byte
+		wantErr string
+	}{{
+		desc:    "empty input",
+		wantErr: "cannot read metadata",
+	}, {
+		desc:    "not length-delimited protobufs",
+		in:      []byte("not a checkpoint"),
+		wantErr: "cannot read metadata",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, _, err := Load(bytes.NewReader(tt.in)); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Load(): did not get expected error, got: %v, want: %s", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -30,7 +30,7 @@ func TestLocalRIB(t *testing.T) {
 
 		if diff := cmp.Diff(got, want,
 			cmpopts.EquateEmpty(), cmp.AllowUnexported(rib.RIB{}),
-			cmpopts.IgnoreFields(rib.RIB{}, "nrMu", "pendMu", "ribCheck"),
+			cmpopts.IgnoreFields(rib.RIB{}, "nrMu", "pendMu", "resMu", "intfMu", "elecMu", "metaMu", "seq", "ribCheck"),
 			cmp.AllowUnexported(rib.RIBHolder{}),
 			cmpopts.IgnoreFields(rib.RIBHolder{}, "mu", "refCounts", "checkFn"),
 		); diff != "" {
@@ -0,0 +1,429 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/afthelper"
+	"github.com/openconfig/gribigo/constants"
+)
+
+// ResolvabilityChange describes an entry within the RIB whose resolvability
+// changed as a result of a mutation of the RIB. An entry is resolvable if each
+// next-hop that it uses can be recursively resolved within the RIB, that is to
+// say, its resolution neither loops nor exceeds the maximum resolution depth,
+// and each egress interface that it is ultimately resolved to can be used, as
+// described for WithInterfaceResolver.
+type ResolvabilityChange struct {
+	// NetworkInstance is the network instance that the entry is within.
+	NetworkInstance string
+	// AFT is the AFT that the entry is within.
+	AFT constants.AFT
+	// Key is the key of the entry - the prefix of an IPv4 or IPv6 entry, or
+	// the label, ID or index of other entries, expressed as a uint64.
+	Key any
+	// Resolvable indicates whether the entry is resolvable following the
+	// mutation.
+	Resolvable bool
+}
+
+// ResolvabilityBatch is the set of entries whose resolvability changed as a
+// result of a single mutation of the RIB.
+type ResolvabilityBatch struct {
+	// Seq is the sequence number of the mutation that caused the changes, as
+	// recorded in the journal of the RIB. For a Flush, it is the sequence
+	// number of the last entry that was removed.
+	Seq uint64
+	// Changes are the entries whose resolvability changed, each entry is
+	// included at most once.
+	Changes []*ResolvabilityChange
+}
+
+// ResolvabilityFn is a function that is called with the entries whose
+// resolvability was changed by a mutation of the RIB.
+type ResolvabilityFn func(*ResolvabilityBatch)
+
+// SetResolvabilityHook registers fn to be called following each mutation of the
+// RIB that changes the resolvability of one or more existing entries, other than
+// the entry that was mutated. Next-hops, next-hop-groups, and IPv4, IPv6 and MPLS
+// entries are considered. Entries that are added or removed by a mutation are not
+// reported. The hook is called without any locks on the RIB being held, and is
+// removed if fn is nil.
+//
+// The dependencies between entries are tracked only whilst a hook is registered,
+// such that the resolvability of each entry is calculated from the contents of
+// the RIB when SetResolvabilityHook is called. It must not be called concurrently
+// with modifications to the RIB.
+func (r *RIB) SetResolvabilityHook(fn ResolvabilityFn) {
+	if fn == nil {
+		r.resolvability = nil
+		return
+	}
+	g := &resolvabilityGraph{
+		fn:         fn,
+		resolvable: map[entryID]bool{},
+		deps:       map[entryID][]entryID{},
+		dependents: map[entryID]map[entryID]bool{},
+		lookups:    map[string]map[entryID]netip.Addr{},
+		lookupNI:   map[entryID]string{},
+	}
+
+	ribs, done := r.ribs()
+	defer done()
+	ids := []entryID{}
+	for ni, rib := range ribs {
+		afts := rib.GetAfts()
+		for p := range afts.Ipv4Entry {
+			ids = append(ids, newEntryID(ni, constants.IPv4, p))
+		}
+		for p := range afts.Ipv6Entry {
+			ids = append(ids, newEntryID(ni, constants.IPv6, p))
+		}
+		for l := range afts.LabelEntry {
+			if u, ok := l.(aft.UnionUint32); ok {
+				ids = append(ids, newEntryID(ni, constants.MPLS, u))
+			}
+		}
+		for id := range afts.NextHopGroup {
+			ids = append(ids, newEntryID(ni, constants.NextHopGroup, id))
+		}
+		for idx := range afts.NextHop {
+			ids = append(ids, newEntryID(ni, constants.NextHop, idx))
+		}
+	}
+	for _, id := range ids {
+		g.setDeps(r, ribs, id)
+	}
+	for _, id := range ids {
+		g.resolvable[id], _ = r.entryResolvable(ribs, id)
+	}
+	r.resolvability = g
+}
+
+// resolvabilityGraph is the graph of dependencies between the entries of the
+// RIB, which is used to determine the entries whose resolvability is affected by
+// a mutation without recalculating the resolvability of all entries.
+type resolvabilityGraph struct {
+	// fn is the function that is called with each batch of changes.
+	fn ResolvabilityFn
+
+	// mu protects the fields below.
+	mu sync.Mutex
+	// resolvable stores whether each entry within the RIB is resolvable.
+	resolvable map[entryID]bool
+	// deps maps each entry to the entries that it directly depends upon - the
+	// next-hop-group of an IPv4, IPv6 or MPLS entry, the next-hops of a
+	// next-hop-group, and the prefix that the address of a next-hop is
+	// resolved via.
+	deps map[entryID][]entryID
+	// dependents is the inverse of deps, mapping each entry to the entries
+	// that directly depend upon it.
+	dependents map[entryID]map[entryID]bool
+	// lookups stores the address of each next-hop that is resolved by looking
+	// up its address, keyed by the network instance in which the address is
+	// looked up, such that the next-hops whose resolution may be changed by a
+	// prefix can be determined.
+	lookups map[string]map[entryID]netip.Addr
+	// lookupNI maps each next-hop within lookups to the network instance in
+	// which its address is looked up.
+	lookupNI map[entryID]string
+}
+
+// tracksResolvability returns true if the resolvability of entries within the
+// AFT a is tracked.
+func tracksResolvability(a constants.AFT) bool {
+	switch a {
+	case constants.IPv4, constants.IPv6, constants.MPLS, constants.NextHopGroup, constants.NextHop:
+		return true
+	}
+	return false
+}
+
+// updateResolvability updates the resolvability of the entries that depend upon
+// the entries ids following the mutation with sequence number seq, which added,
+// replaced or removed them, and calls the registered ResolvabilityFn with the
+// entries whose resolvability changed.
+func (r *RIB) updateResolvability(seq uint64, ids ...entryID) {
+	g := r.resolvability
+	if g == nil {
+		return
+	}
+	ribs, done := r.ribs()
+	changes := g.update(r, ribs, ids)
+	done()
+	if len(changes) != 0 {
+		g.fn(&ResolvabilityBatch{Seq: seq, Changes: changes})
+	}
+}
+
+// flushResolvability updates the resolvability of entries following the removal
+// of all entries within the network instances nis by Flush.
+func (r *RIB) flushResolvability(nis []string) {
+	g := r.resolvability
+	if g == nil {
+		return
+	}
+	flushed := map[string]bool{}
+	for _, ni := range nis {
+		flushed[ni] = true
+	}
+	g.mu.Lock()
+	ids := []entryID{}
+	for id := range g.resolvable {
+		if flushed[id.ni] {
+			ids = append(ids, id)
+		}
+	}
+	g.mu.Unlock()
+	r.updateResolvability(r.seq.Load(), ids...)
+}
+
+// update recalculates the dependencies of the entries ids, and of the next-hops
+// whose resolution may be changed by them, using the specified ribs. The
+// resolvability of these entries, and each entry that transitively depends upon
+// them, is then recalculated. It returns the changes in the resolvability of
+// entries that existed both before and after the mutation, in a consistent order.
+func (g *resolvabilityGraph) update(r *RIB, ribs map[string]*aft.RIB, ids []entryID) []*ResolvabilityChange {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	seeds := map[entryID]bool{}
+	for _, id := range ids {
+		if !tracksResolvability(id.aft) {
+			continue
+		}
+		seeds[id] = true
+		// A prefix changes the resolution of the next-hops whose address it
+		// covers within the network instance that it is within.
+		if p, ok := id.key.(string); ok {
+			pfx, err := netip.ParsePrefix(p)
+			if err != nil {
+				continue
+			}
+			for nh, addr := range g.lookups[id.ni] {
+				if pfx.Contains(addr) {
+					seeds[nh] = true
+				}
+			}
+		}
+	}
+	for id := range seeds {
+		g.setDeps(r, ribs, id)
+	}
+
+	// Each entry that transitively depends upon a seed is visited once, such that
+	// an entry that depends on a seed via multiple paths is only reported once.
+	affected := []entryID{}
+	for id := range seeds {
+		affected = append(affected, id)
+	}
+	visited := map[entryID]bool{}
+	for len(affected) != 0 {
+		id := affected[0]
+		affected = affected[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		for d := range g.dependents[id] {
+			if !visited[d] {
+				affected = append(affected, d)
+			}
+		}
+	}
+
+	changes := []*ResolvabilityChange{}
+	for id := range visited {
+		now, exists := r.entryResolvable(ribs, id)
+		was, known := g.resolvable[id]
+		if !exists {
+			delete(g.resolvable, id)
+			continue
+		}
+		g.resolvable[id] = now
+		if known && was != now {
+			changes = append(changes, &ResolvabilityChange{
+				NetworkInstance: id.ni,
+				AFT:             id.aft,
+				Key:             id.key,
+				Resolvable:      now,
+			})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		switch {
+		case a.NetworkInstance != b.NetworkInstance:
+			return a.NetworkInstance < b.NetworkInstance
+		case a.AFT != b.AFT:
+			return a.AFT < b.AFT
+		}
+		return fmt.Sprintf("%v", a.Key) < fmt.Sprintf("%v", b.Key)
+	})
+	return changes
+}
+
+// setDeps replaces the stored dependencies of the entry id with those that it
+// has within ribs, removing them if the entry does not exist.
+func (g *resolvabilityGraph) setDeps(r *RIB, ribs map[string]*aft.RIB, id entryID) {
+	for _, d := range g.deps[id] {
+		delete(g.dependents[d], id)
+		if len(g.dependents[d]) == 0 {
+			delete(g.dependents, d)
+		}
+	}
+	delete(g.deps, id)
+	if ni, ok := g.lookupNI[id]; ok {
+		delete(g.lookups[ni], id)
+		delete(g.lookupNI, id)
+	}
+
+	afts := ribs[id.ni].GetAfts()
+	nhgDep := func(ni string, nhg uint64) []entryID {
+		if ni == "" {
+			ni = id.ni
+		}
+		return []entryID{newEntryID(ni, constants.NextHopGroup, nhg)}
+	}
+
+	var deps []entryID
+	switch id.aft {
+	case constants.IPv4:
+		if e := afts.GetIpv4Entry(id.key.(string)); e != nil {
+			deps = nhgDep(e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup())
+		}
+	case constants.IPv6:
+		if e := afts.GetIpv6Entry(id.key.(string)); e != nil {
+			deps = nhgDep(e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup())
+		}
+	case constants.MPLS:
+		if e := afts.GetLabelEntry(aft.UnionUint32(id.key.(uint64))); e != nil {
+			deps = nhgDep(e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup())
+		}
+	case constants.NextHopGroup:
+		if e := afts.GetNextHopGroup(id.key.(uint64)); e != nil {
+			for idx := range e.NextHop {
+				deps = append(deps, newEntryID(id.ni, constants.NextHop, idx))
+			}
+		}
+	case constants.NextHop:
+		nh := afts.GetNextHop(id.key.(uint64))
+		if nh == nil || nh.GetInterfaceRef().GetInterface() != "" {
+			break
+		}
+		addr, err := netip.ParseAddr(nh.GetIpAddress())
+		if err != nil {
+			break
+		}
+		lookupNI := id.ni
+		if nhNI := nh.GetNetworkInstance(); nhNI != "" {
+			lookupNI = nhNI
+		}
+		if g.lookups[lookupNI] == nil {
+			g.lookups[lookupNI] = map[entryID]netip.Addr{}
+		}
+		g.lookups[lookupNI][id] = addr
+		g.lookupNI[id] = lookupNI
+
+		if niR, ok := r.niRIB[lookupNI]; ok {
+			if p, ok := niR.prefixes.longestMatch(addr); ok {
+				a := constants.IPv6
+				if addr.Is4() {
+					a = constants.IPv4
+				}
+				deps = []entryID{newEntryID(lookupNI, a, p)}
+			}
+		}
+	}
+
+	if len(deps) == 0 {
+		return
+	}
+	g.deps[id] = deps
+	for _, d := range deps {
+		if g.dependents[d] == nil {
+			g.dependents[d] = map[entryID]bool{}
+		}
+		g.dependents[d][id] = true
+	}
+}
+
+// entryResolvable returns whether the entry id within ribs is resolvable, and
+// false if the entry does not exist.
+func (r *RIB) entryResolvable(ribs map[string]*aft.RIB, id entryID) (resolvable, exists bool) {
+	afts := ribs[id.ni].GetAfts()
+	switch id.aft {
+	case constants.IPv4:
+		if afts.GetIpv4Entry(id.key.(string)) == nil {
+			return false, false
+		}
+		nhs, err := afthelper.ResolvePrefix(ribs, id.ni, id.key.(string), r.maxResolutionDepth)
+		return err == nil && r.checkInterfaces(nhs) == nil, true
+	case constants.IPv6:
+		if afts.GetIpv6Entry(id.key.(string)) == nil {
+			return false, false
+		}
+		nhs, err := afthelper.ResolvePrefix(ribs, id.ni, id.key.(string), r.maxResolutionDepth)
+		return err == nil && r.checkInterfaces(nhs) == nil, true
+	case constants.MPLS:
+		e := afts.GetLabelEntry(aft.UnionUint32(id.key.(uint64)))
+		if e == nil {
+			return false, false
+		}
+		ni := e.GetNextHopGroupNetworkInstance()
+		if ni == "" {
+			ni = id.ni
+		}
+		return r.nhgResolvable(ribs, ni, e.GetNextHopGroup()), true
+	case constants.NextHopGroup:
+		if afts.GetNextHopGroup(id.key.(uint64)) == nil {
+			return false, false
+		}
+		return r.nhgResolvable(ribs, id.ni, id.key.(uint64)), true
+	case constants.NextHop:
+		nh := afts.GetNextHop(id.key.(uint64))
+		if nh == nil {
+			return false, false
+		}
+		nhs, err := afthelper.ResolveNextHopEntry(ribs, id.ni, nh, r.maxResolutionDepth)
+		return err == nil && r.checkInterfaces(nhs) == nil, true
+	}
+	return false, false
+}
+
+// nhgResolvable returns true if each next-hop of the next-hop-group with the
+// specified ID, within network instance ni, is resolvable.
+func (r *RIB) nhgResolvable(ribs map[string]*aft.RIB, ni string, id uint64) bool {
+	nhg := ribs[ni].GetAfts().GetNextHopGroup(id)
+	if nhg == nil {
+		return false
+	}
+	for idx := range nhg.NextHop {
+		nh := ribs[ni].GetAfts().GetNextHop(idx)
+		if nh == nil {
+			return false
+		}
+		nhs, err := afthelper.ResolveNextHopEntry(ribs, ni, nh, r.maxResolutionDepth)
+		if err != nil || r.checkInterfaces(nhs) != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/constants"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+// nhgMembersOp returns an operation adding a next-hop-group with the specified
+// ID that contains each of the next-hops with the indices nhs.
+func nhgMembersOp(id uint64, nhs ...uint64) *spb.AFTOperation {
+	nhg := &aftpb.Afts_NextHopGroup{}
+	for _, nh := range nhs {
+		nhg.NextHop = append(nhg.NextHop, &aftpb.Afts_NextHopGroup_NextHopKey{
+			Index:   nh,
+			NextHop: &aftpb.Afts_NextHopGroup_NextHop{Weight: &wpb.UintValue{Value: 1}},
+		})
+	}
+	return &spb.AFTOperation{
+		Op: spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_NextHopGroup{
+			NextHopGroup: &aftpb.Afts_NextHopGroupKey{Id: id, NextHopGroup: nhg},
+		},
+	}
+}
+
+func TestResolvabilityHook(t *testing.T) {
+	r := New(defName, WithJournal(100))
+
+	// The IPv4 entries 198.51.100.0/24 and 198.51.101.0/24 both depend upon NH 1
+	// via separate next-hop-groups, and 203.0.113.0/24 depends upon both of them,
+	// via NHs 3 and 4, such that it is reachable from NH 1 via two paths.
+	applyOps(t, r, defName,
+		nhOp(1, "192.0.2.1", ""),
+		nhgOp(1, 1),
+		nhgOp(2, 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+		ipv4Op(spb.AFTOperation_ADD, "198.51.101.0/24", 2),
+		nhOp(3, "198.51.100.1", ""),
+		nhOp(4, "198.51.101.1", ""),
+		nhgMembersOp(3, 3, 4),
+		ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 3),
+		// The entries using NH 5, which is resolved via its interface, are
+		// unaffected by NH 1.
+		nhOp(5, "192.0.2.5", "eth0"),
+		nhgOp(5, 5),
+		ipv4Op(spb.AFTOperation_ADD, "198.18.0.0/15", 5),
+	)
+
+	var batches []*ResolvabilityBatch
+	r.SetResolvabilityHook(func(b *ResolvabilityBatch) {
+		batches = append(batches, b)
+	})
+
+	// check validates that a single batch was received for the last mutation of
+	// the RIB, and that the IPv4 entries within it are the prefixes want, each of
+	// which has the resolvability resolvable.
+	check := func(desc string, resolvable bool, want []string) {
+		t.Helper()
+		defer func() { batches = nil }()
+		if len(batches) != 1 {
+			t.Fatalf("%s: did not get expected number of batches, got: %d, want: 1", desc, len(batches))
+		}
+		b := batches[0]
+		js := r.Journal(0)
+		if last := js[len(js)-1].Seq; b.Seq != last {
+			t.Errorf("%s: did not get expected sequence number, got: %d, want: %d", desc, b.Seq, last)
+		}
+		got := []string{}
+		for _, c := range b.Changes {
+			if c.Resolvable != resolvable {
+				t.Errorf("%s: did not get expected resolvability for %s %v, got: %v, want: %v", desc, c.AFT, c.Key, c.Resolvable, resolvable)
+			}
+			if c.AFT == constants.IPv4 {
+				got = append(got, fmt.Sprintf("%v", c.Key))
+			}
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%s: did not get expected prefixes, diff(-got,+want):\n%s", desc, diff)
+		}
+	}
+
+	wantPrefixes := []string{"198.51.100.0/24", "198.51.101.0/24", "203.0.113.0/24"}
+
+	// Adding a prefix that covers NH 1 and uses it causes its resolution to loop,
+	// such that it, and each entry that depends on it, cannot be resolved.
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_ADD, "192.0.2.0/24", 1))
+	check("add looping prefix", false, wantPrefixes)
+
+	// Adding an unrelated entry does not change the resolvability of any entry.
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_ADD, "198.18.0.0/16", 5))
+	if len(batches) != 0 {
+		t.Errorf("add unrelated prefix: got unexpected batches, got: %v, want: none", batches)
+	}
+
+	applyOps(t, r, defName, ipv4Op(spb.AFTOperation_DELETE, "192.0.2.0/24", 1))
+	check("delete looping prefix", true, wantPrefixes)
+}
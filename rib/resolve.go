@@ -0,0 +1,444 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/afthelper"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+)
+
+// WithMaxResolutionDepth specifies the maximum number of prefixes that can be
+// traversed when a next-hop is recursively resolved via other prefixes within
+// the RIB. By default, afthelper.DefaultMaxResolutionDepth is used.
+func WithMaxResolutionDepth(n int) *maxResolutionDepth { return &maxResolutionDepth{n: n} }
+
+// maxResolutionDepth is the internal implementation of WithMaxResolutionDepth.
+type maxResolutionDepth struct {
+	n int
+}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*maxResolutionDepth) isRIBOpt() {}
+
+// hasMaxResolutionDepth returns the depth specified by the maxResolutionDepth
+// option within the supplied RIBOpt slice, or zero if it is not present.
+func hasMaxResolutionDepth(opt []RIBOpt) int {
+	for _, o := range opt {
+		if v, ok := o.(*maxResolutionDepth); ok {
+			return v.n
+		}
+	}
+	return 0
+}
+
+// nhKey uniquely identifies a next-hop within the RIB.
+type nhKey struct {
+	// ni is the network instance that the next-hop is within.
+	ni string
+	// index is the index of the next-hop.
+	index uint64
+}
+
+// nhResolution describes the resolution of a next-hop within the RIB.
+type nhResolution struct {
+	// unresolved indicates that the next-hop cannot be resolved, for example,
+	// because its resolution loops.
+	unresolved bool
+	// summary is a description of how the next-hop is resolved, such that two
+	// resolutions can be compared.
+	summary string
+}
+
+// ribs returns the RIB of each network instance within r, without copying them,
+// along with a function that must be called once the RIBs are no longer being
+// used. The RIBs must not be modified.
+func (r *RIB) ribs() (map[string]*aft.RIB, func()) {
+	r.nrMu.RLock()
+	// Locks are acquired in a consistent order to avoid deadlocking with other
+	// callers.
+	names := []string{}
+	for n := range r.niRIB {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	ribs := map[string]*aft.RIB{}
+	for _, n := range names {
+		r.niRIB[n].mu.RLock()
+		ribs[n] = r.niRIB[n].r
+	}
+	return ribs, func() {
+		for _, n := range names {
+			r.niRIB[n].mu.RUnlock()
+		}
+		r.nrMu.RUnlock()
+	}
+}
+
+// resolveNextHop determines how the next-hop nh within network instance ni is
+// resolved using the specified ribs, along with the dependencies of its
+// resolution.
+func (r *RIB) resolveNextHop(ribs map[string]*aft.RIB, ni string, nh *aft.Afts_NextHop) (nhResolution, *nhDeps, error) {
+	res, err := afthelper.ResolveNextHopEntry(ribs, ni, nh, r.maxResolutionDepth)
+	if err == nil {
+		err = r.checkInterfaces(res)
+	}
+	deps := resolutionDeps(ribs, nhKey{ni: ni, index: nh.GetIndex()}, nh, res)
+	if err != nil {
+		return nhResolution{unresolved: true, summary: err.Error()}, deps, err
+	}
+
+	recursive := false
+	parts := []string{}
+	for _, n := range res {
+		chain := []string{}
+		for _, s := range n.Chain {
+			chain = append(chain, fmt.Sprintf("%s:%s", s.PrefixNetworkInstance, s.Prefix))
+			recursive = true
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d(%s)", n.NetworkInstance, n.Index, strings.Join(chain, ",")))
+	}
+	if !recursive {
+		return nhResolution{}, deps, nil
+	}
+	return nhResolution{summary: strings.Join(parts, ";")}, deps, nil
+}
+
+// resolutionDeps returns the dependencies of the resolution res of the next-hop
+// nh, with key k, within the specified ribs. These are the addresses that were
+// looked up, and the other next-hops that were traversed.
+func resolutionDeps(ribs map[string]*aft.RIB, k nhKey, nh *aft.Afts_NextHop, res []*afthelper.ResolvedNextHop) *nhDeps {
+	deps := &nhDeps{}
+	addrs := map[lookupAddr]bool{}
+	addAddr := func(ni string, n *aft.Afts_NextHop) {
+		if n.GetInterfaceRef().GetInterface() != "" {
+			return
+		}
+		addr, err := netip.ParseAddr(n.GetIpAddress())
+		if err != nil {
+			return
+		}
+		if nhNI := n.GetNetworkInstance(); nhNI != "" {
+			ni = nhNI
+		}
+		if a := (lookupAddr{ni: ni, addr: addr}); !addrs[a] {
+			addrs[a] = true
+			deps.addrs = append(deps.addrs, a)
+		}
+	}
+	nhs := map[nhKey]bool{k: true}
+	addNH := func(ni string, index uint64) {
+		n := ribs[ni].GetAfts().GetNextHop(index)
+		if nhs[nhKey{ni: ni, index: index}] || n == nil {
+			return
+		}
+		nhs[nhKey{ni: ni, index: index}] = true
+		deps.nhs = append(deps.nhs, nhKey{ni: ni, index: index})
+		addAddr(ni, n)
+	}
+
+	addAddr(k.ni, nh)
+	for _, n := range res {
+		for _, s := range n.Chain {
+			addNH(s.NetworkInstance, s.NextHop)
+		}
+		addNH(n.NetworkInstance, n.Index)
+	}
+	return deps
+}
+
+// checkNextHopResolution checks whether the candidate next-hop nh within network
+// instance ni can be recursively resolved within the RIB. An error is returned
+// if its resolution would loop, or exceed the maximum resolution depth. A
+// next-hop whose address is not covered by a prefix within the RIB is resolved
+// outside of gRIBI, and hence is valid.
+func (r *RIB) checkNextHopResolution(ni string, nh *aft.Afts_NextHop) error {
+	ribs, done := r.ribs()
+	defer done()
+	_, _, err := r.resolveNextHop(ribs, ni, nh)
+	switch {
+	case errors.Is(err, afthelper.ErrResolutionLoop), errors.Is(err, afthelper.ErrMaxDepthExceeded):
+		return fmt.Errorf("cannot resolve next-hop %d in NI %s, %v", nh.GetIndex(), ni, err)
+	case err != nil:
+		// Other errors indicate that the RIB does not contain an entry required
+		// to resolve the next-hop, which is validated elsewhere.
+		log.V(2).Infof("cannot recursively resolve next-hop %d in NI %s, %v", nh.GetIndex(), ni, err)
+	}
+	return nil
+}
+
+// dependentEntry is an entry within the RIB that references a next-hop-group.
+type dependentEntry struct {
+	// ni is the network instance that the entry is within.
+	ni string
+	// aft is the AFT that the entry is within.
+	aft constants.AFT
+	// key is the key of the entry, as supplied to the ResolvedEntryFn.
+	key any
+}
+
+// resolutionScope describes the next-hops whose resolution is re-evaluated
+// following a change to the RIB.
+type resolutionScope struct {
+	// prefixes are prefixes that have been changed, the next-hops whose
+	// resolution looks up an address covered by any of them are considered.
+	prefixes []lookupPrefix
+	// nextHops are next-hops that have been changed, they are considered along
+	// with the next-hops whose resolution traverses them.
+	nextHops []nhKey
+	// affected, if set, is called for each next-hop within the RIB, such that
+	// those for which it returns true are considered. All next-hops that are
+	// recursively resolved are also considered, since their resolution may
+	// traverse an affected next-hop.
+	affected func(nhKey, *aft.Afts_NextHop) bool
+	// unresolved indicates that next-hops that cannot currently be resolved are
+	// considered, since their resolution may not be fully described by the
+	// index.
+	unresolved bool
+}
+
+// lookupPrefix is a prefix within a network instance.
+type lookupPrefix struct {
+	// ni is the network instance that the prefix is within.
+	ni string
+	// prefix is the prefix.
+	prefix netip.Prefix
+}
+
+// prefixScope returns a resolutionScope considering the next-hops whose
+// resolution may be changed by a change to the prefix within network instance ni.
+func prefixScope(ni, prefix string) resolutionScope {
+	s := resolutionScope{unresolved: true}
+	if p, err := netip.ParsePrefix(prefix); err == nil {
+		s.prefixes = append(s.prefixes, lookupPrefix{ni: ni, prefix: p})
+	}
+	return s
+}
+
+// resolutionChange describes a next-hop whose resolution has changed.
+type resolutionChange struct {
+	// nh is a copy of the next-hop.
+	nh *aft.Afts_NextHop
+	// key identifies the next-hop.
+	key nhKey
+	// old and new are the previous and current resolution of the next-hop.
+	old, new nhResolution
+	// dependents are the entries that reference a next-hop-group containing the
+	// next-hop.
+	dependents []dependentEntry
+}
+
+// reevaluateResolution recalculates the resolution of next-hops within the RIB
+// following a change to its contents. The next-hops that are considered are those
+// described by scope. For each next-hop whose resolution changes, the post-change
+// hook is called with a Replace operation for the next-hop, and the resolved
+// entry hook is called for each entry that depends upon it.
+func (r *RIB) reevaluateResolution(scope resolutionScope) error {
+	if !r.ribCheck {
+		return nil
+	}
+
+	changes, err := r.resolutionChanges(scope)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		log.V(2).Infof("resolution of next-hop %d in NI %s changed from %+v to %+v", c.key.index, c.key.ni, c.old, c.new)
+		if niR, ok := r.NetworkInstanceRIB(c.key.ni); ok {
+			niR.mu.RLock()
+			fn := niR.postChangeHook
+			niR.mu.RUnlock()
+			if fn != nil {
+				fn(constants.Replace, niR.timestamp(), c.key.ni, c.nh)
+			}
+		}
+
+		op := constants.Replace
+		switch {
+		case c.new.unresolved:
+			op = constants.Delete
+		case c.old.unresolved:
+			op = constants.Add
+		}
+		for _, d := range c.dependents {
+			if err := r.callResolvedEntryHook(op, d.ni, d.aft, d.key); err != nil {
+				return fmt.Errorf("cannot run resolvedEntryHook, %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolutionChanges calculates the next-hops whose resolution has changed, as
+// described for reevaluateResolution, and updates the stored resolution of each
+// next-hop that is considered.
+func (r *RIB) resolutionChanges(scope resolutionScope) ([]*resolutionChange, error) {
+	ribs, done := r.ribs()
+	defer done()
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	if r.nhIndex == nil {
+		r.nhIndex = newNHIndex()
+	}
+	idx := r.nhIndex
+
+	candidates := map[nhKey]bool{}
+	for _, k := range scope.nextHops {
+		candidates[k] = true
+		for d := range idx.via[k] {
+			candidates[d] = true
+		}
+	}
+	for _, p := range scope.prefixes {
+		for _, k := range idx.within(p.ni, p.prefix) {
+			candidates[k] = true
+		}
+	}
+	if scope.unresolved {
+		for k := range idx.unresolved {
+			candidates[k] = true
+		}
+	}
+	if scope.affected != nil {
+		for k := range idx.res {
+			candidates[k] = true
+		}
+		for ni, rib := range ribs {
+			for i, nh := range rib.GetAfts().NextHop {
+				if k := (nhKey{ni: ni, index: i}); scope.affected(k, nh) {
+					candidates[k] = true
+				}
+			}
+		}
+	}
+
+	keys := []nhKey{}
+	for k := range candidates {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].ni != keys[j].ni {
+			return keys[i].ni < keys[j].ni
+		}
+		return keys[i].index < keys[j].index
+	})
+
+	changes := []*resolutionChange{}
+	for _, k := range keys {
+		nh := ribs[k.ni].GetAfts().GetNextHop(k.index)
+		if nh == nil {
+			// The next-hop has been removed, and hence there is no change in
+			// resolution to report.
+			idx.remove(k)
+			continue
+		}
+		old := idx.res[k]
+		res, deps, _ := r.resolveNextHop(ribs, k.ni, nh)
+		idx.set(k, res, deps)
+		if res == old {
+			continue
+		}
+
+		nhCopy, err := ygot.DeepCopy(nh)
+		if err != nil {
+			return nil, fmt.Errorf("cannot copy next-hop %d in NI %s, %v", k.index, k.ni, err)
+		}
+		changes = append(changes, &resolutionChange{
+			nh:         nhCopy.(*aft.Afts_NextHop),
+			key:        k,
+			old:        old,
+			new:        res,
+			dependents: dependentEntries(ribs, k),
+		})
+	}
+	return changes, nil
+}
+
+// dependentEntries returns the IPv4, IPv6 and MPLS entries within ribs that
+// reference a next-hop-group which contains the next-hop k.
+func dependentEntries(ribs map[string]*aft.RIB, k nhKey) []dependentEntry {
+	nhgs := map[uint64]bool{}
+	for id, nhg := range ribs[k.ni].GetAfts().NextHopGroup {
+		if _, ok := nhg.NextHop[k.index]; ok {
+			nhgs[id] = true
+		}
+	}
+	if len(nhgs) == 0 {
+		return nil
+	}
+
+	refs := func(ni, nhgNI string, nhg uint64) bool {
+		if nhgNI == "" {
+			nhgNI = ni
+		}
+		return nhgNI == k.ni && nhgs[nhg]
+	}
+
+	deps := []dependentEntry{}
+	for ni, rib := range ribs {
+		for p, e := range rib.GetAfts().Ipv4Entry {
+			if refs(ni, e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup()) {
+				deps = append(deps, dependentEntry{ni: ni, aft: constants.IPv4, key: p})
+			}
+		}
+		for p, e := range rib.GetAfts().Ipv6Entry {
+			if refs(ni, e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup()) {
+				deps = append(deps, dependentEntry{ni: ni, aft: constants.IPv6, key: p})
+			}
+		}
+		for _, e := range rib.GetAfts().LabelEntry {
+			if refs(ni, e.GetNextHopGroupNetworkInstance(), e.GetNextHopGroup()) {
+				deps = append(deps, dependentEntry{ni: ni, aft: constants.MPLS, key: e.GetLabel()})
+			}
+		}
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		return fmt.Sprintf("%s/%v", deps[i].ni, deps[i].key) < fmt.Sprintf("%s/%v", deps[j].ni, deps[j].key)
+	})
+	return deps
+}
+
+// forgetNextHop removes the stored resolution of the next-hop k, which has been
+// removed from the RIB.
+func (r *RIB) forgetNextHop(k nhKey) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	if r.nhIndex != nil {
+		r.nhIndex.remove(k)
+	}
+}
+
+// forgetResolution removes the stored resolution of all next-hops within the
+// network instance ni.
+func (r *RIB) forgetResolution(ni string) {
+	r.resMu.Lock()
+	defer r.resMu.Unlock()
+	if r.nhIndex == nil {
+		return
+	}
+	for _, k := range r.nhIndex.keys(func(k nhKey) bool { return k.ni == ni }) {
+		r.nhIndex.remove(k)
+	}
+}
@@ -0,0 +1,339 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/afthelper"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+// nhOp returns an operation adding a next-hop with the specified index and
+// address, using the egress interface intf if it is non-empty.
+func nhOp(index uint64, addr, intf string) *spb.AFTOperation {
+	nh := &aftpb.Afts_NextHop{IpAddress: &wpb.StringValue{Value: addr}}
+	if intf != "" {
+		nh.InterfaceRef = &aftpb.Afts_NextHop_InterfaceRef{Interface: &wpb.StringValue{Value: intf}}
+	}
+	return &spb.AFTOperation{
+		Op:    spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: index, NextHop: nh}},
+	}
+}
+
+// nhgOp returns an operation adding a next-hop-group with the specified ID that
+// contains the next-hop with index nh.
+func nhgOp(id, nh uint64) *spb.AFTOperation {
+	return &spb.AFTOperation{
+		Op: spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_NextHopGroup{
+			NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+				Id: id,
+				NextHopGroup: &aftpb.Afts_NextHopGroup{
+					NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+						Index:   nh,
+						NextHop: &aftpb.Afts_NextHopGroup_NextHop{Weight: &wpb.UintValue{Value: 1}},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// ipv4Op returns an operation of type op for the IPv4 prefix, pointing to the
+// next-hop-group nhg.
+func ipv4Op(op spb.AFTOperation_Operation, prefix string, nhg uint64) *spb.AFTOperation {
+	return &spb.AFTOperation{
+		Op: op,
+		Entry: &spb.AFTOperation_Ipv4{
+			Ipv4: &aftpb.Afts_Ipv4EntryKey{
+				Prefix:    prefix,
+				Ipv4Entry: &aftpb.Afts_Ipv4Entry{NextHopGroup: &wpb.UintValue{Value: nhg}},
+			},
+		},
+	}
+}
+
+// resolutionRecorder records the hooks that are called by a RIB.
+type resolutionRecorder struct {
+	mu sync.Mutex
+	// replacedNHs is the set of next-hops for which a Replace was reported.
+	replacedNHs []uint64
+	// entries receives a string describing each call to the resolved entry hook.
+	entries chan string
+}
+
+// postChange implements the RIBHookFn.
+func (r *resolutionRecorder) postChange(op constants.OpType, _ int64, _ string, s ygot.ValidatedGoStruct) {
+	nh, ok := s.(*aft.Afts_NextHop)
+	if !ok || op != constants.Replace {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replacedNHs = append(r.replacedNHs, nh.GetIndex())
+}
+
+// resolvedEntry implements the ResolvedEntryFn.
+func (r *resolutionRecorder) resolvedEntry(_ map[string]*aft.RIB, op constants.OpType, _ string, a constants.AFT, key any, _ ...ResolvedDetails) {
+	r.entries <- fmt.Sprintf("%s %s:%v", op, a, key)
+}
+
+// replaced returns, and resets, the next-hops for which a Replace was reported.
+func (r *resolutionRecorder) replaced() []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	got := r.replacedNHs
+	r.replacedNHs = nil
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	return got
+}
+
+// awaitEntries waits for n calls to the resolved entry hook, returning them
+// in sorted order.
+func (r *resolutionRecorder) awaitEntries(t *testing.T, n int) []string {
+	t.Helper()
+	got := []string{}
+	for i := 0; i < n; i++ {
+		select {
+		case s := <-r.entries:
+			got = append(got, s)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for resolved entry hook, got: %v", got)
+		}
+	}
+	sort.Strings(got)
+	return got
+}
+
+func TestRecursiveResolution(t *testing.T) {
+	const defName = "DEFAULT"
+	r := New(defName)
+
+	rec := &resolutionRecorder{entries: make(chan string, 100)}
+
+	ops := []*spb.AFTOperation{
+		nhOp(3, "192.0.2.1", "eth0"),
+		nhgOp(3, 3),
+		ipv4Op(spb.AFTOperation_ADD, "10.3.0.0/16", 3),
+		nhOp(2, "10.3.0.1", ""),
+		nhgOp(2, 2),
+		ipv4Op(spb.AFTOperation_ADD, "10.2.0.0/16", 2),
+		nhOp(1, "10.2.0.1", ""),
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "203.0.113.0/24", 1),
+	}
+	id := uint64(0)
+	add := func(op *spb.AFTOperation) ([]*OpResult, []*OpResult) {
+		t.Helper()
+		id++
+		op.Id = id
+		oks, fails, err := r.AddEntry(defName, op)
+		if err != nil {
+			t.Fatalf("cannot add entry %v, %v", op, err)
+		}
+		return oks, fails
+	}
+	del := func(op *spb.AFTOperation) {
+		t.Helper()
+		id++
+		op.Id = id
+		if _, fails, err := r.DeleteEntry(defName, op); err != nil || len(fails) != 0 {
+			t.Fatalf("cannot delete entry %v, err: %v, fails: %v", op, err, fails)
+		}
+	}
+	for _, op := range ops {
+		if _, fails := add(op); len(fails) != 0 {
+			t.Fatalf("cannot add entry %v, fails: %v", op, fails)
+		}
+	}
+
+	checkEgress := func(wantChain []string) {
+		t.Helper()
+		ribs, err := r.RIBContents()
+		if err != nil {
+			t.Fatalf("cannot get RIB contents, %v", err)
+		}
+		got, err := afthelper.ResolvePrefix(ribs, defName, "203.0.113.0/24", 0)
+		if err != nil {
+			t.Fatalf("cannot resolve prefix, %v", err)
+		}
+		if len(got) != 1 {
+			t.Fatalf("did not get expected number of next-hops, got: %d, want: 1", len(got))
+		}
+		if got[0].Index != 3 || got[0].Interface != "eth0" {
+			t.Errorf("did not get expected egress next-hop, got: %d via %s, want: 3 via eth0", got[0].Index, got[0].Interface)
+		}
+		gotChain := []string{}
+		for _, s := range got[0].Chain {
+			gotChain = append(gotChain, s.Prefix)
+		}
+		if diff := cmp.Diff(gotChain, wantChain); diff != "" {
+			t.Errorf("did not get expected resolution chain, diff(-got,+want):\n%s", diff)
+		}
+	}
+
+	// Three levels of recursion: 203.0.113.0/24 -> NH1 via 10.2.0.0/16 -> NH2
+	// via 10.3.0.0/16 -> NH3 on eth0.
+	checkEgress([]string{"10.2.0.0/16", "10.3.0.0/16"})
+
+	r.SetPostChangeHook(rec.postChange)
+	r.SetResolvedEntryHook(rec.resolvedEntry)
+
+	// Removing the covering prefix for NH2 means that it, and NH1, are resolved
+	// differently.
+	del(ipv4Op(spb.AFTOperation_DELETE, "10.3.0.0/16", 3))
+	if diff := cmp.Diff(rec.replaced(), []uint64{1, 2}); diff != "" {
+		t.Errorf("did not get expected next-hop status changes after removing prefix, diff(-got,+want):\n%s", diff)
+	}
+	wantEntries := []string{
+		"Delete IPv4:10.3.0.0/16",
+		"Replace IPv4:10.2.0.0/16",
+		"Replace IPv4:203.0.113.0/24",
+	}
+	if diff := cmp.Diff(rec.awaitEntries(t, 3), wantEntries); diff != "" {
+		t.Errorf("did not get expected resolved entries after removing prefix, diff(-got,+want):\n%s", diff)
+	}
+
+	// Adding it back restores the original resolution.
+	if _, fails := add(ipv4Op(spb.AFTOperation_ADD, "10.3.0.0/16", 3)); len(fails) != 0 {
+		t.Fatalf("cannot add covering prefix, fails: %v", fails)
+	}
+	if diff := cmp.Diff(rec.replaced(), []uint64{1, 2}); diff != "" {
+		t.Errorf("did not get expected next-hop status changes after adding prefix, diff(-got,+want):\n%s", diff)
+	}
+	wantEntries = []string{
+		"Add IPv4:10.3.0.0/16",
+		"Replace IPv4:10.2.0.0/16",
+		"Replace IPv4:203.0.113.0/24",
+	}
+	if diff := cmp.Diff(rec.awaitEntries(t, 3), wantEntries); diff != "" {
+		t.Errorf("did not get expected resolved entries after adding prefix, diff(-got,+want):\n%s", diff)
+	}
+	checkEgress([]string{"10.2.0.0/16", "10.3.0.0/16"})
+
+	// Replacing NH3 such that it is resolved via 10.2.0.0/16 would create a loop.
+	_, fails := add(nhOp(3, "10.2.0.2", ""))
+	if len(fails) != 1 || !strings.Contains(fails[0].Error, afthelper.ErrResolutionLoop.Error()) {
+		t.Fatalf("did not get expected failure replacing next-hop, got: %v", fails)
+	}
+	checkEgress([]string{"10.2.0.0/16", "10.3.0.0/16"})
+
+	// A prefix that is added such that it covers the next-hops that it is
+	// resolved via makes them unresolvable.
+	for _, op := range []*spb.AFTOperation{nhOp(4, "10.4.0.1", ""), nhgOp(4, 4)} {
+		if _, fails := add(op); len(fails) != 0 {
+			t.Fatalf("cannot add entry %v, fails: %v", op, fails)
+		}
+	}
+	if _, fails := add(ipv4Op(spb.AFTOperation_ADD, "10.4.0.0/16", 4)); len(fails) != 0 {
+		t.Fatalf("cannot add looping prefix, fails: %v", fails)
+	}
+	if diff := cmp.Diff(rec.replaced(), []uint64{4}); diff != "" {
+		t.Errorf("did not get expected next-hop status changes after adding looping prefix, diff(-got,+want):\n%s", diff)
+	}
+	// The prefix is reported as added, and then removed since it is not
+	// resolvable.
+	wantEntries = []string{
+		"Add IPv4:10.4.0.0/16",
+		"Delete IPv4:10.4.0.0/16",
+	}
+	if diff := cmp.Diff(rec.awaitEntries(t, 2), wantEntries); diff != "" {
+		t.Errorf("did not get expected resolved entries after adding looping prefix, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestMaxResolutionDepth(t *testing.T) {
+	const defName = "DEFAULT"
+	r := New(defName, WithMaxResolutionDepth(1))
+
+	ops := []*spb.AFTOperation{
+		nhOp(2, "192.0.2.1", ""),
+		nhgOp(2, 2),
+		ipv4Op(spb.AFTOperation_ADD, "10.2.0.0/16", 2),
+		nhOp(1, "10.2.0.1", ""),
+		nhgOp(1, 1),
+		ipv4Op(spb.AFTOperation_ADD, "10.1.0.0/16", 1),
+	}
+	for i, op := range ops {
+		op.Id = uint64(i + 1)
+		if _, fails, err := r.AddEntry(defName, op); err != nil || len(fails) != 0 {
+			t.Fatalf("cannot add entry %v, err: %v, fails: %v", op, err, fails)
+		}
+	}
+
+	// A next-hop resolved via 10.1.0.0/16 requires two levels of recursion.
+	op := nhOp(3, "10.1.0.1", "")
+	op.Id = uint64(len(ops) + 1)
+	_, fails, err := r.AddEntry(defName, op)
+	if err != nil {
+		t.Fatalf("cannot add entry, %v", err)
+	}
+	if len(fails) != 1 || !strings.Contains(fails[0].Error, afthelper.ErrMaxDepthExceeded.Error()) {
+		t.Fatalf("did not get expected failure adding next-hop, got: %v", fails)
+	}
+}
+
+// BenchmarkReevaluateResolution measures the time taken to re-evaluate the
+// resolution of next-hops following the addition of a prefix to a RIB that
+// contains ten thousand next-hops, each of which is resolved either via
+// another prefix, or outside of gRIBI.
+func BenchmarkReevaluateResolution(b *testing.B) {
+	const (
+		defName = "DEFAULT"
+		n       = 10000
+	)
+	entries := bulkEntries(defName, nhOp(1, "192.0.2.1", "eth0"), nhgOp(1, 1), ipv4Op(spb.AFTOperation_ADD, "10.0.0.0/8", 1))
+	prefixes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("172.%d.%d.%d", 16+i>>16, (i>>8)&255, i&255)
+		if i%2 == 0 {
+			addr = fmt.Sprintf("10.%d.%d.%d", i>>16, (i>>8)&255, i&255)
+		}
+		entries = append(entries, Entry{NetworkInstance: defName, Op: nhOp(uint64(i+2), addr, "")})
+		prefixes = append(prefixes, fmt.Sprintf("%d.%d.%d.0/24", 100+i>>16, (i>>8)&255, i&255))
+	}
+	r := New(defName)
+	errs, err := r.BulkAdd(context.Background(), entries)
+	if err != nil {
+		b.Fatalf("cannot add entries, %v", err)
+	}
+	for _, err := range errs {
+		if err != nil {
+			b.Fatalf("cannot add entry, %v", err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := r.reevaluateResolution(prefixScope(defName, prefixes[i%n])); err != nil {
+			b.Fatalf("cannot re-evaluate resolution, %v", err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"net/netip"
+)
+
+// lookupAddr is an address that is looked up within a network instance when a
+// next-hop is resolved.
+type lookupAddr struct {
+	// ni is the network instance that the address is looked up within.
+	ni string
+	// addr is the address that is looked up.
+	addr netip.Addr
+}
+
+// nhDeps describes the parts of the RIB that the resolution of a next-hop
+// depends upon.
+type nhDeps struct {
+	// addrs are the addresses that are looked up when resolving the next-hop,
+	// such that a change to a prefix covering any of them may change its
+	// resolution.
+	addrs []lookupAddr
+	// nhs are the other next-hops that are traversed when resolving the
+	// next-hop.
+	nhs []nhKey
+}
+
+// nhIndex stores the resolution of next-hops within the RIB. It is indexed such
+// that the next-hops whose resolution may be changed by a change to a prefix, or
+// another next-hop, can be found without considering every next-hop in the RIB.
+type nhIndex struct {
+	// res stores the resolution of each next-hop that is resolved via another
+	// prefix within the RIB, or that cannot be resolved. Next-hops that are
+	// resolved outside of gRIBI are not stored.
+	res map[nhKey]nhResolution
+	// unresolved is the set of next-hops within res that cannot be resolved.
+	unresolved map[nhKey]bool
+	// deps stores the dependencies of each next-hop within the index.
+	deps map[nhKey]*nhDeps
+	// addrs stores a trie of the addresses that are looked up within each
+	// network instance, and address family.
+	addrs map[addrRoot]*addrNode
+	// via stores the set of next-hops whose resolution traverses each next-hop.
+	via map[nhKey]map[nhKey]bool
+}
+
+// newNHIndex returns a new, empty, nhIndex.
+func newNHIndex() *nhIndex {
+	return &nhIndex{
+		res:        map[nhKey]nhResolution{},
+		unresolved: map[nhKey]bool{},
+		deps:       map[nhKey]*nhDeps{},
+		addrs:      map[addrRoot]*addrNode{},
+		via:        map[nhKey]map[nhKey]bool{},
+	}
+}
+
+// set stores res as the resolution of the next-hop k, whose resolution depends
+// upon deps, replacing any existing entry for k.
+func (x *nhIndex) set(k nhKey, res nhResolution, deps *nhDeps) {
+	x.remove(k)
+	if res != (nhResolution{}) {
+		x.res[k] = res
+	}
+	if res.unresolved {
+		x.unresolved[k] = true
+	}
+	x.deps[k] = deps
+	for _, a := range deps.addrs {
+		x.insertAddr(a, k)
+	}
+	for _, n := range deps.nhs {
+		if x.via[n] == nil {
+			x.via[n] = map[nhKey]bool{}
+		}
+		x.via[n][k] = true
+	}
+}
+
+// remove removes the next-hop k from the index.
+func (x *nhIndex) remove(k nhKey) {
+	delete(x.res, k)
+	delete(x.unresolved, k)
+	d, ok := x.deps[k]
+	if !ok {
+		return
+	}
+	for _, a := range d.addrs {
+		x.removeAddr(a, k)
+	}
+	for _, n := range d.nhs {
+		delete(x.via[n], k)
+		if len(x.via[n]) == 0 {
+			delete(x.via, n)
+		}
+	}
+	delete(x.deps, k)
+}
+
+// keys returns the next-hops within the index for which fn returns true.
+func (x *nhIndex) keys(fn func(nhKey) bool) []nhKey {
+	keys := []nhKey{}
+	for k := range x.deps {
+		if fn(k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// addrRoot identifies a trie of addresses within the nhIndex.
+type addrRoot struct {
+	// ni is the network instance that the addresses are looked up within.
+	ni string
+	// is6 indicates that the trie contains IPv6 addresses.
+	is6 bool
+}
+
+// addrNode is a node within a binary trie of addresses, the depth of a node
+// within the trie is the number of bits of the address that it represents.
+type addrNode struct {
+	// child stores the child nodes for a next bit of zero and one.
+	child [2]*addrNode
+	// nhs is the set of next-hops that look up the address, it is populated only
+	// at nodes whose depth is the length of the address.
+	nhs map[nhKey]bool
+}
+
+// empty returns true if the node has no children, and no next-hops.
+func (n *addrNode) empty() bool {
+	return len(n.nhs) == 0 && n.child[0] == nil && n.child[1] == nil
+}
+
+// addrBit returns the i-th most significant bit of the address bytes b.
+func addrBit(b []byte, i int) int {
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// insertAddr records that the next-hop k looks up the address a.
+func (x *nhIndex) insertAddr(a lookupAddr, k nhKey) {
+	rk := addrRoot{ni: a.ni, is6: a.addr.Is6()}
+	n, ok := x.addrs[rk]
+	if !ok {
+		n = &addrNode{}
+		x.addrs[rk] = n
+	}
+	b := a.addr.AsSlice()
+	for i := 0; i < a.addr.BitLen(); i++ {
+		c := addrBit(b, i)
+		if n.child[c] == nil {
+			n.child[c] = &addrNode{}
+		}
+		n = n.child[c]
+	}
+	if n.nhs == nil {
+		n.nhs = map[nhKey]bool{}
+	}
+	n.nhs[k] = true
+}
+
+// removeAddr removes the record that the next-hop k looks up the address a,
+// removing nodes from the trie that are no longer required.
+func (x *nhIndex) removeAddr(a lookupAddr, k nhKey) {
+	rk := addrRoot{ni: a.ni, is6: a.addr.Is6()}
+	n, ok := x.addrs[rk]
+	if !ok {
+		return
+	}
+	b := a.addr.AsSlice()
+	path := []*addrNode{n}
+	for i := 0; i < a.addr.BitLen(); i++ {
+		if n = n.child[addrBit(b, i)]; n == nil {
+			return
+		}
+		path = append(path, n)
+	}
+	delete(n.nhs, k)
+
+	for i := len(path) - 1; i > 0 && path[i].empty(); i-- {
+		path[i-1].child[addrBit(b, i-1)] = nil
+	}
+	if path[0].empty() {
+		delete(x.addrs, rk)
+	}
+}
+
+// within returns the next-hops that look up an address within the prefix p in
+// the network instance ni.
+func (x *nhIndex) within(ni string, p netip.Prefix) []nhKey {
+	n, ok := x.addrs[addrRoot{ni: ni, is6: p.Addr().Is6()}]
+	if !ok {
+		return nil
+	}
+	b := p.Masked().Addr().AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		if n = n.child[addrBit(b, i)]; n == nil {
+			return nil
+		}
+	}
+
+	keys := []nhKey{}
+	seen := map[nhKey]bool{}
+	for stack := []*addrNode{n}; len(stack) != 0; {
+		n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		for k := range n.nhs {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		for _, c := range n.child {
+			if c != nil {
+				stack = append(stack, c)
+			}
+		}
+	}
+	return keys
+}
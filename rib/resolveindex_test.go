@@ -0,0 +1,112 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"net/netip"
+	"sort"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNHIndex(t *testing.T) {
+	x := newNHIndex()
+	nh := func(i uint64) nhKey { return nhKey{ni: "DEFAULT", index: i} }
+	addr := func(ni, a string) lookupAddr { return lookupAddr{ni: ni, addr: netip.MustParseAddr(a)} }
+
+	x.set(nh(1), nhResolution{}, &nhDeps{addrs: []lookupAddr{addr("DEFAULT", "192.0.2.1")}})
+	x.set(nh(2), nhResolution{summary: "recursive"}, &nhDeps{
+		addrs: []lookupAddr{addr("DEFAULT", "10.0.0.1"), addr("DEFAULT", "192.0.2.1")},
+		nhs:   []nhKey{nh(1)},
+	})
+	x.set(nh(3), nhResolution{}, &nhDeps{addrs: []lookupAddr{addr("VRF-A", "192.0.2.1"), addr("DEFAULT", "2001:db8::1")}})
+
+	within := func(ni, p string) []uint64 {
+		got := []uint64{}
+		for _, k := range x.within(ni, netip.MustParsePrefix(p)) {
+			got = append(got, k.index)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+		return got
+	}
+
+	tests := []struct {
+		desc   string
+		inNI   string
+		inPfx  string
+		wantNH []uint64
+	}{{
+		desc:   "host prefix",
+		inNI:   "DEFAULT",
+		inPfx:  "192.0.2.1/32",
+		wantNH: []uint64{1, 2},
+	}, {
+		desc:   "covering prefix",
+		inNI:   "DEFAULT",
+		inPfx:  "0.0.0.0/0",
+		wantNH: []uint64{1, 2},
+	}, {
+		desc:   "prefix covering one address",
+		inNI:   "DEFAULT",
+		inPfx:  "10.0.0.0/8",
+		wantNH: []uint64{2},
+	}, {
+		desc:   "prefix covering no addresses",
+		inNI:   "DEFAULT",
+		inPfx:  "198.51.100.0/24",
+		wantNH: []uint64{},
+	}, {
+		desc:   "other network instance",
+		inNI:   "VRF-A",
+		inPfx:  "192.0.2.0/24",
+		wantNH: []uint64{3},
+	}, {
+		desc:   "IPv6",
+		inNI:   "DEFAULT",
+		inPfx:  "2001:db8::/32",
+		wantNH: []uint64{3},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if diff := cmp.Diff(within(tt.inNI, tt.inPfx), tt.wantNH); diff != "" {
+				t.Fatalf("within(%s, %s): did not get expected next-hops, diff(-got,+want):\n%s", tt.inNI, tt.inPfx, diff)
+			}
+		})
+	}
+
+	if diff := cmp.Diff(x.via[nh(1)], map[nhKey]bool{nh(2): true}); diff != "" {
+		t.Fatalf("did not get expected next-hops traversing next-hop 1, diff(-got,+want):\n%s", diff)
+	}
+
+	// Replacing the entry for a next-hop removes its previous dependencies.
+	x.set(nh(2), nhResolution{unresolved: true}, &nhDeps{addrs: []lookupAddr{addr("DEFAULT", "10.0.0.1")}})
+	if got := within("DEFAULT", "192.0.2.0/24"); !cmp.Equal(got, []uint64{1}) {
+		t.Fatalf("did not get expected next-hops after replacing next-hop 2, got: %v, want: [1]", got)
+	}
+	if _, ok := x.via[nh(1)]; ok {
+		t.Fatalf("next-hop 2 still traverses next-hop 1 after being replaced")
+	}
+	if !x.unresolved[nh(2)] {
+		t.Fatalf("next-hop 2 is not stored as unresolved")
+	}
+
+	for _, i := range []uint64{1, 2, 3} {
+		x.remove(nh(i))
+	}
+	if len(x.res) != 0 || len(x.unresolved) != 0 || len(x.deps) != 0 || len(x.addrs) != 0 || len(x.via) != 0 {
+		t.Fatalf("index is not empty after removing all next-hops, got: %+v", x)
+	}
+}
@@ -19,9 +19,11 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net/netip"
 	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/golang/glog"
@@ -31,6 +33,7 @@ import (
 	"github.com/openconfig/gribigo/constants"
 	wpb "github.com/openconfig/ygot/proto/ywrapper"
 	"github.com/openconfig/ygot/protomap"
+	"github.com/openconfig/ygot/util"
 	"github.com/openconfig/ygot/ygot"
 	"github.com/openconfig/ygot/ytypes"
 	"google.golang.org/grpc/codes"
@@ -89,6 +92,134 @@ type ResolvedDetails interface {
 	isResolvedDetail()
 }
 
+// RIBEvent describes a change to an entry within the RIB, such that the change can
+// be programmed into a dataplane.
+type RIBEvent struct {
+	// Op is the type of change that was made to the entry.
+	Op constants.OpType
+	// AFT is the AFT that the entry is within.
+	AFT constants.AFT
+	// NetworkInstance is the name of the network instance that the entry is within.
+	NetworkInstance string
+	// Entry is the entry that was changed, as an AFT GoStruct. In the case of a
+	// delete, it contains the entry as it was specified in the operation.
+	Entry ygot.ValidatedGoStruct
+	// Done must be called by the handler of the event once the change has been
+	// processed, with a nil error if it was programmed successfully, or an error
+	// describing why it could not be.
+	Done func(error)
+}
+
+// RIBEventFn is a function that is called for each RIBEvent. An error returned by
+// the function indicates that the change could not be processed, in which case
+// the function need not call the event's Done function.
+type RIBEventFn func(RIBEvent) error
+
+// OperationEntry returns the AFT and the entry that the operation op refers to, as
+// an AFT GoStruct. It returns an error if the entry cannot be converted.
+func OperationEntry(op *spb.AFTOperation) (constants.AFT, ygot.ValidatedGoStruct, error) {
+	var (
+		a     constants.AFT
+		afts  *aftpb.Afts
+		entry func(*aft.Afts) ygot.ValidatedGoStruct
+	)
+	switch e := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		a, afts = constants.IPv4, &aftpb.Afts{Ipv4Entry: []*aftpb.Afts_Ipv4EntryKey{e.Ipv4}}
+		entry = func(r *aft.Afts) ygot.ValidatedGoStruct { return r.GetIpv4Entry(e.Ipv4.GetPrefix()) }
+	case *spb.AFTOperation_Ipv6:
+		a, afts = constants.IPv6, &aftpb.Afts{Ipv6Entry: []*aftpb.Afts_Ipv6EntryKey{e.Ipv6}}
+		entry = func(r *aft.Afts) ygot.ValidatedGoStruct { return r.GetIpv6Entry(e.Ipv6.GetPrefix()) }
+	case *spb.AFTOperation_Mpls:
+		a, afts = constants.MPLS, &aftpb.Afts{LabelEntry: []*aftpb.Afts_LabelEntryKey{e.Mpls}}
+		entry = func(r *aft.Afts) ygot.ValidatedGoStruct {
+			return r.LabelEntry[aft.UnionUint32(e.Mpls.GetLabelUint64())]
+		}
+	case *spb.AFTOperation_NextHopGroup:
+		a, afts = constants.NextHopGroup, &aftpb.Afts{NextHopGroup: []*aftpb.Afts_NextHopGroupKey{e.NextHopGroup}}
+		entry = func(r *aft.Afts) ygot.ValidatedGoStruct { return r.GetNextHopGroup(e.NextHopGroup.GetId()) }
+	case *spb.AFTOperation_NextHop:
+		a, afts = constants.NextHop, &aftpb.Afts{NextHop: []*aftpb.Afts_NextHopKey{e.NextHop}}
+		entry = func(r *aft.Afts) ygot.ValidatedGoStruct { return r.GetNextHop(e.NextHop.GetIndex()) }
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		a, afts = constants.PolicyForwarding, &aftpb.Afts{PolicyForwardingEntry: []*aftpb.Afts_PolicyForwardingEntryKey{e.PolicyForwardingEntry}}
+		entry = func(r *aft.Afts) ygot.ValidatedGoStruct {
+			return r.GetPolicyForwardingEntry(e.PolicyForwardingEntry.GetIndex())
+		}
+	default:
+		return constants.All, nil, fmt.Errorf("unsupported entry type in operation, %T", e)
+	}
+
+	nr, err := candidateRIB(afts)
+	if err != nil {
+		return constants.All, nil, fmt.Errorf("invalid entry in operation, %v", err)
+	}
+	return a, entry(nr.GetAfts()), nil
+}
+
+// operationKey returns the AFT, and the key within the AFT, of the entry that the
+// operation op refers to - the prefix of an IPv4 or IPv6 entry, or the label, ID
+// or index of other entries. It returns a nil key if the operation does not refer
+// to an entry.
+func operationKey(op *spb.AFTOperation) (constants.AFT, any) {
+	switch t := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		return constants.IPv4, t.Ipv4.GetPrefix()
+	case *spb.AFTOperation_Ipv6:
+		return constants.IPv6, t.Ipv6.GetPrefix()
+	case *spb.AFTOperation_Mpls:
+		return constants.MPLS, t.Mpls.GetLabelUint64()
+	case *spb.AFTOperation_NextHopGroup:
+		return constants.NextHopGroup, t.NextHopGroup.GetId()
+	case *spb.AFTOperation_NextHop:
+		return constants.NextHop, t.NextHop.GetIndex()
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		return constants.PolicyForwarding, t.PolicyForwardingEntry.GetIndex()
+	}
+	return constants.All, nil
+}
+
+// maxMPLSLabel is the largest value of an MPLS label, which is a 20-bit value.
+const maxMPLSLabel = 1<<20 - 1
+
+// validateOperationKey returns an error if the key of the entry within the
+// operation op is malformed - an IPv4 or IPv6 prefix that cannot be parsed, a
+// next-hop or next-hop-group with the reserved index or ID of zero, or an MPLS
+// label that is missing or out of range. It is checked before the RIB is mutated,
+// such that a malformed entry is never installed in, or removed from, the RIB.
+func validateOperationKey(op *spb.AFTOperation) error {
+	switch t := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		p, err := netip.ParsePrefix(t.Ipv4.GetPrefix())
+		if err != nil || !p.Addr().Is4() {
+			return fmt.Errorf("invalid IPv4 prefix %q, must be an IPv4 address and prefix length", t.Ipv4.GetPrefix())
+		}
+	case *spb.AFTOperation_Ipv6:
+		p, err := netip.ParsePrefix(t.Ipv6.GetPrefix())
+		if err != nil || !p.Addr().Is6() || p.Addr().Is4In6() {
+			return fmt.Errorf("invalid IPv6 prefix %q, must be an IPv6 address and prefix length", t.Ipv6.GetPrefix())
+		}
+	case *spb.AFTOperation_Mpls:
+		switch l := t.Mpls.GetLabel().(type) {
+		case *aftpb.Afts_LabelEntryKey_LabelUint64:
+			if l.LabelUint64 > maxMPLSLabel {
+				return fmt.Errorf("invalid MPLS label %d, must be no greater than %d", l.LabelUint64, maxMPLSLabel)
+			}
+		case nil:
+			return errors.New("invalid MPLS entry, no label specified")
+		}
+	case *spb.AFTOperation_NextHopGroup:
+		if t.NextHopGroup.GetId() == 0 {
+			return errors.New("invalid next-hop-group ID 0, zero is reserved")
+		}
+	case *spb.AFTOperation_NextHop:
+		if t.NextHop.GetIndex() == 0 {
+			return errors.New("invalid next-hop index 0, zero is reserved")
+		}
+	}
+	return nil
+}
+
 // RIBHolderCheckFunc is a function that is used as a check to determine whether
 // a RIB entry is eligible for a particular operation. It takes arguments of:
 //
@@ -136,13 +267,78 @@ type RIB struct {
 	//
 	// The candidates are stored as the operation that was submitted in order that the
 	// same AddXXX methods can be used along with network instance the operation
-	// referred to. The map is keyed by the operation ID.
-	pendingEntries map[uint64]*pendingEntry
+	// referred to. The map is keyed by the session and ID of the operation, since
+	// operation IDs are only unique within a client session.
+	pendingEntries map[pendingID]*pendingEntry
+
+	// pendingLimit is the maximum number of entries that can be stored in
+	// pendingEntries. If it is zero, the number of pending entries is unbounded.
+	pendingLimit int
 
 	// resolvedEntryHook is a function that is called for all entries that
 	// can be fully resolved in the RIB. In the current implementation it
 	// is called only for IPv4 entries.
 	resolvedEntryHook ResolvedEntryFn
+
+	// clock is the function used to determine the current time for the
+	// network instance RIBs within the RIB. If it is nil, time.Now is used.
+	clock func() time.Time
+
+	// maxResolutionDepth is the maximum number of prefixes that are traversed
+	// when recursively resolving a next-hop. If it is zero, the default depth
+	// is used.
+	maxResolutionDepth int
+	// resMu protects nhIndex.
+	resMu sync.Mutex
+	// nhIndex stores the resolution of the next-hops within the RIB that were
+	// added using AddEntry or BulkAdd. It is used to determine the next-hops
+	// whose resolution changes when a prefix or next-hop is added or removed.
+	nhIndex *nhIndex
+
+	// interfaceResolver determines whether the egress interface of a next-hop
+	// can be used, it is nil if all interfaces are considered usable.
+	interfaceResolver InterfaceResolverFn
+	// intfMu protects intfDown.
+	intfMu sync.RWMutex
+	// intfDown is the set of interfaces that were reported to be down using
+	// SetInterfaceState.
+	intfDown map[string]bool
+
+	// deleted is the history of entries that were recently deleted from the
+	// RIB, it is nil if no history is kept.
+	deleted *deletedHistory
+
+	// journal is the record of the mutations that were made to the RIB, it
+	// is nil if no journal is kept.
+	journal *journal
+	// seq is the sequence number of the last mutation that was made to the
+	// RIB.
+	seq atomic.Uint64
+	// resolvability tracks whether each entry within the RIB can be resolved,
+	// it is nil if no ResolvabilityFn is registered.
+	resolvability *resolvabilityGraph
+
+	// derivations stores the functions that derive entries from changes to
+	// the RIB, and the entries that were derived, it is nil if no functions
+	// are registered.
+	derivations *derivations
+	// maxDerivationDepth is the maximum derivation depth at which changes
+	// are handed to the registered derivation functions. If it is zero, the
+	// default depth is used.
+	maxDerivationDepth int
+	// derivedInGet indicates whether derived entries are returned by Get.
+	derivedInGet bool
+
+	// elecMu protects electionID.
+	elecMu sync.Mutex
+	// electionID is the highest election ID that was recorded by SetElectionID.
+	electionID *spb.Uint128
+
+	// metaMu protects entryMetadata.
+	metaMu sync.Mutex
+	// entryMetadata stores the metadata describing the operation that
+	// programmed each entry within the RIB.
+	entryMetadata map[entryID]*EntryMetadata
 }
 
 // RIBHolder is a container for a set of RIBs.
@@ -184,10 +380,28 @@ type RIBHolder struct {
 	//	 - the changed entry as a ygot.ValidatedGoStruct.
 	postChangeHook RIBHookFn
 
+	// clock is the function used to determine the timestamp that is supplied
+	// to postChangeHook. If it is nil, the current time is used.
+	clock func() time.Time
+
 	// refCounts is used to store counters for the number of references to next-hop
 	// groups and next-hops within the RIB. It is used to ensure that referenced NHs
 	// and NHGs cnanot be removed from the RIB.
 	refCounts *niRefCounter
+
+	// shared stores, for each AFT, the number of snapshots that share the current
+	// map of entries for the AFT. A map that is shared is copied before it is
+	// modified. It is protected by mu.
+	shared map[constants.AFT]int
+	// generation stores, for each AFT, the number of times that the map of entries
+	// has been copied, such that a snapshot that is released only stops sharing
+	// the map that it was taken from. It is protected by mu.
+	generation map[constants.AFT]uint64
+
+	// prefixes is the index of the IPv4 and IPv6 prefixes within the RIB that
+	// is used for longest-prefix-match lookups. It is nil until a prefix is
+	// added, and is protected by mu.
+	prefixes *prefixIndex
 }
 
 // niRefCounter stores reference counters for a particular network instance.
@@ -241,12 +455,70 @@ func hasDisableCheckFn(opt []RIBOpt) bool {
 	return false
 }
 
+// WithPendingLimit specifies that the RIB should store at most n entries that
+// are pending resolution. When the limit is reached, entries that cannot be
+// resolved are returned as failed rather than being stored.
+func WithPendingLimit(n int) *pendingLimit { return &pendingLimit{n: n} }
+
+// pendingLimit is the internal implementation of WithPendingLimit.
+type pendingLimit struct {
+	n int
+}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*pendingLimit) isRIBOpt() {}
+
+// hasPendingLimit returns the limit specified by the pendingLimit option within
+// the supplied RIBOpt slice, or zero if it is not present.
+func hasPendingLimit(opt []RIBOpt) int {
+	for _, o := range opt {
+		if v, ok := o.(*pendingLimit); ok {
+			return v.n
+		}
+	}
+	return 0
+}
+
+// WithClock specifies the function that the RIB uses to determine the current
+// time, which is used as the timestamp that is supplied to post-change hooks.
+// By default, time.Now is used.
+func WithClock(fn func() time.Time) *withClock { return &withClock{fn: fn} }
+
+// withClock is the internal implementation of WithClock.
+type withClock struct {
+	fn func() time.Time
+}
+
+// isRIBOpt implements the RIBOpt interface.
+func (*withClock) isRIBOpt() {}
+
+// hasWithClock returns the clock function specified by the withClock option
+// within the supplied RIBOpt slice, or nil if it is not present.
+func hasWithClock(opt []RIBOpt) func() time.Time {
+	for _, o := range opt {
+		if v, ok := o.(*withClock); ok {
+			return v.fn
+		}
+	}
+	return nil
+}
+
 // New returns a new RIB with the default network instance created with name dn.
 func New(dn string, opt ...RIBOpt) *RIB {
 	r := &RIB{
 		niRIB:          map[string]*RIBHolder{},
 		defaultName:    dn,
-		pendingEntries: map[uint64]*pendingEntry{},
+		pendingEntries: map[pendingID]*pendingEntry{},
+		pendingLimit:   hasPendingLimit(opt),
+		clock:          hasWithClock(opt),
+
+		maxResolutionDepth: hasMaxResolutionDepth(opt),
+		interfaceResolver:  hasInterfaceResolver(opt),
+		deleted:            newDeletedHistory(hasDeletedHistory(opt)),
+		journal:            newJournal(hasJournal(opt)),
+
+		maxDerivationDepth: hasMaxDerivationDepth(opt),
+		derivedInGet:       hasDerivedInGet(opt),
 	}
 
 	rhOpt := []ribHolderOpt{}
@@ -255,6 +527,9 @@ func New(dn string, opt ...RIBOpt) *RIB {
 		rhOpt = append(rhOpt, RIBHolderCheckFn(r.checkFn))
 	}
 	r.ribCheck = checkRIB
+	if r.clock != nil {
+		rhOpt = append(rhOpt, &ribHolderClock{fn: r.clock})
+	}
 
 	r.niRIB[dn] = NewRIBHolder(dn, rhOpt...)
 
@@ -274,11 +549,23 @@ func (r *RIB) checkFn(t constants.OpType, ni string, candidate *aft.RIB) (bool,
 	return false, fmt.Errorf("invalid unknown operation type, %s", t)
 }
 
+// pendingID is the key of an operation that is pending on the gRIBI server.
+type pendingID struct {
+	// session is the ID of the client session that the operation was received
+	// from, it is empty if the session is not known.
+	session string
+	// id is the ID of the operation.
+	id uint64
+}
+
 // pendingEntry describes an operation that is pending on the gRIBI server. Generally,
 // this is due to RIB recursion lookup failures.
 type pendingEntry struct {
 	// ni is the network instance the operation is operating on.
 	ni string
+	// session is the ID of the client session that the operation was
+	// received from, it is empty if the session is not known.
+	session string
 	// op is the AFTOperation that is being performed.
 	op *spb.AFTOperation
 }
@@ -307,6 +594,21 @@ func (r *RIB) NetworkInstanceRIB(s string) (*RIBHolder, bool) {
 	return rh, ok
 }
 
+// operationNetworkInstance returns the name of the network instance that an
+// operation specifying the network instance ni applies to. An empty name refers
+// to the default network instance. It returns an error if the network instance
+// does not exist, since network instances are not created implicitly by gRIBI
+// operations.
+func (r *RIB) operationNetworkInstance(ni string) (string, error) {
+	if ni == "" {
+		return r.defaultName, nil
+	}
+	if _, ok := r.NetworkInstanceRIB(ni); !ok {
+		return "", fmt.Errorf("unknown network instance %s, network instances must be created before entries are added to them", ni)
+	}
+	return ni, nil
+}
+
 // AddNetworkInstance adds a new network instance with the specified name
 // to the RIB.
 func (r *RIB) AddNetworkInstance(name string) error {
@@ -321,6 +623,9 @@ func (r *RIB) AddNetworkInstance(name string) error {
 	if r.ribCheck {
 		rhOpt = append(rhOpt, RIBHolderCheckFn(r.checkFn))
 	}
+	if r.clock != nil {
+		rhOpt = append(rhOpt, &ribHolderClock{fn: r.clock})
+	}
 
 	r.niRIB[name] = NewRIBHolder(name, rhOpt...)
 	return nil
@@ -349,6 +654,24 @@ func (r *RIB) RIBContents() (map[string]*aft.RIB, error) {
 	return r.copyRIBs()
 }
 
+// ExportAFT returns a copy of the AFTs within the network instance named ni as an
+// OpenConfig AFT GoStruct. The entries within the AFTs are keyed by the identifiers
+// used within gRIBI (i.e., prefixes, next-hop indices and next-hop-group IDs). It
+// returns an error if the network instance does not exist.
+func (r *RIB) ExportAFT(ni string) (*aft.Afts, error) {
+	niR, ok := r.NetworkInstanceRIB(ni)
+	if !ok {
+		return nil, fmt.Errorf("cannot find network instance %s", ni)
+	}
+	niR.mu.RLock()
+	defer niR.mu.RUnlock()
+	a, err := ygot.DeepCopy(niR.r.GetOrCreateAfts())
+	if err != nil {
+		return nil, fmt.Errorf("cannot copy AFTs for network instance %s, %v", ni, err)
+	}
+	return a.(*aft.Afts), nil
+}
+
 // String returns a string representation of the RIB.
 func (r *RIB) String() string {
 	r.nrMu.RLock()
@@ -364,6 +687,9 @@ func (r *RIB) String() string {
 type OpResult struct {
 	// ID is the ID of the operation as specified in the input request.
 	ID uint64
+	// Session is the ID of the client session that the operation was received
+	// from, it is empty if the session is not known.
+	Session string
 	// Op is the operation that was performed.
 	Op *spb.AFTOperation
 	// Error is an error string detailing any error that occurred.
@@ -375,8 +701,8 @@ func (o *OpResult) String() string {
 	return fmt.Sprintf("ID: %d, Type: %s, Error: %v", o.ID, prototext.Format(o.Op), o.Error)
 }
 
-// AddEntry adds the entry described in op to the network instance with name ni. It returns
-// two slices of OpResults:
+// AddEntry adds the entry described in op to the network instance with name ni, where an
+// empty name refers to the default network instance. It returns two slices of OpResults:
 //   - the first ("oks") describes the set of entries that were installed successfully based on
 //     this operation.
 //   - the second ("fails") describes the set of entries that were NOT installed, and encountered
@@ -392,27 +718,21 @@ func (o *OpResult) String() string {
 // call the internal implementation in order to install all entries that are now resolvable based
 // on the operation provided.
 func (r *RIB) AddEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpResult, error) {
-	if ni == "" {
-		return nil, nil, fmt.Errorf("invalid network instance, %s", ni)
-	}
-
-	oks, fails := []*OpResult{}, []*OpResult{}
-	checked := map[uint64]bool{}
-	if err := r.addEntryInternal(ni, op, &oks, &fails, checked); err != nil {
-		return nil, nil, err
-	}
-
-	return oks, fails, nil
+	return r.AddEntryForSession(ni, "", op)
 }
 
 // addEntryInternal is the internal implementation of AddEntry. It takes arguments of:
-//   - the name of the network instance being operated on (ni) by the operation op.
+//   - the name of the network instance being operated on (ni) by the operation op,
+//     which was received from the client session with ID session.
 //   - a slice of installed results, which is appended to.
 //   - a slice of failed results, which is appended to.
-//   - a map, keyed by operation ID, describing the stack of calls that we have currently
+//   - a map, keyed by session and operation ID, describing the stack of calls that we have currently
 //     done during this recursion so that we do not repeat an install operation.
-func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*OpResult, installStack map[uint64]bool) error {
-	if installStack[op.GetId()] {
+//   - the derivation depth of the operation, which is zero for operations that are
+//     not derived from another change to the RIB.
+func (r *RIB) addEntryInternal(ni, session string, op *spb.AFTOperation, oks, fails *[]*OpResult, installStack map[pendingID]bool, depth int) error {
+	pid := pendingID{session: session, id: op.GetId()}
+	if installStack[pid] {
 		return nil
 	}
 	niR, ok := r.NetworkInstanceRIB(ni)
@@ -432,6 +752,15 @@ func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*O
 		// completed in case it completes successfully.
 		v4Prefix, v6Prefix string
 		mplsLabel          uint64
+		// scope describes the next-hops whose resolution may be changed by
+		// the operation.
+		scope      resolutionScope
+		reevaluate bool
+		// entryAFT and entryKey identify the entry that was installed, and
+		// before is the entry that it replaced.
+		entryAFT constants.AFT
+		entryKey any
+		before   ygot.GoStruct
 	)
 
 	switch t := op.Entry.(type) {
@@ -445,6 +774,8 @@ func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*O
 			installed = done
 			v4Prefix = t.Ipv4.GetPrefix()
 			handleReferences(r, niR, orig, t.Ipv4.GetIpv4Entry())
+			entryAFT, entryKey, before = constants.IPv4, v4Prefix, orig
+			scope, reevaluate = prefixScope(ni, v4Prefix), true
 		}
 	case *spb.AFTOperation_Ipv6:
 		v6Prefix = t.Ipv6.GetPrefix()
@@ -456,6 +787,8 @@ func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*O
 		case done:
 			installed = done
 			handleReferences(r, niR, orig, t.Ipv6.GetIpv6Entry())
+			entryAFT, entryKey, before = constants.IPv6, v6Prefix, orig
+			scope, reevaluate = prefixScope(ni, v6Prefix), true
 		}
 	case *spb.AFTOperation_Mpls:
 		mplsLabel = t.Mpls.GetLabelUint64()
@@ -467,6 +800,18 @@ func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*O
 		case done:
 			installed = done
 			handleReferences(r, niR, orig, t.Mpls.GetLabelEntry())
+			entryAFT, entryKey, before = constants.MPLS, mplsLabel, orig
+		}
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		log.V(2).Infof("[op %d] attempting to add policy-forwarding entry %d", op.GetId(), t.PolicyForwardingEntry.GetIndex())
+		done, orig, err := niR.AddPolicyForwarding(t.PolicyForwardingEntry, explicitReplace)
+		switch {
+		case err != nil:
+			opErr = err
+		case done:
+			installed = done
+			handleReferences(r, niR, orig, t.PolicyForwardingEntry.GetPolicyForwardingEntry())
+			entryAFT, entryKey, before = constants.PolicyForwarding, t.PolicyForwardingEntry.GetIndex(), orig
 		}
 	case *spb.AFTOperation_NextHopGroup:
 		log.V(2).Infof("[op %d] attempting to add NHG ID %d", op.GetId(), t.NextHopGroup.GetId())
@@ -476,16 +821,31 @@ func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*O
 			opErr = err
 		case done:
 			r.handleNHGReferences(niR, orig, t.NextHopGroup.GetNextHopGroup())
+			entryAFT, entryKey, before = constants.NextHopGroup, t.NextHopGroup.GetId(), orig
 			installed = done
+			// The resolution of next-hops that traverse a member of the
+			// next-hop-group, before or after it was changed, may change.
+			for _, nh := range t.NextHopGroup.GetNextHopGroup().GetNextHop() {
+				scope.nextHops = append(scope.nextHops, nhKey{ni: ni, index: nh.GetIndex()})
+			}
+			if orig != nil {
+				for i := range orig.NextHop {
+					scope.nextHops = append(scope.nextHops, nhKey{ni: ni, index: i})
+				}
+			}
+			scope.unresolved, reevaluate = true, true
 		}
 	case *spb.AFTOperation_NextHop:
 		log.V(2).Infof("[op %d] attempting to add NH Index %d", op.GetId(), t.NextHop.GetIndex())
-		done, _, err := niR.AddNextHop(t.NextHop, explicitReplace)
+		done, orig, err := niR.AddNextHop(t.NextHop, explicitReplace)
 		switch {
 		case err != nil:
 			opErr = err
 		case done:
 			installed = done
+			entryAFT, entryKey, before = constants.NextHop, t.NextHop.GetIndex(), orig
+			scope.nextHops = []nhKey{{ni: ni, index: t.NextHop.GetIndex()}}
+			scope.unresolved, reevaluate = true, true
 		}
 	default:
 		return status.Newf(codes.Unimplemented, "unsupported AFT operation type %T", t).Err()
@@ -494,22 +854,26 @@ func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*O
 	switch {
 	case opErr != nil:
 		*fails = append(*fails, &OpResult{
-			ID:    op.GetId(),
-			Op:    op,
-			Error: opErr.Error(),
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
+			Error:   opErr.Error(),
 		})
 	case installed:
 		// Mark that within this stack we have installed this entry successfully, so
 		// we don't retry if it was somewhere further up the stack.
-		installStack[op.GetId()] = true
+		installStack[pid] = true
 		log.V(2).Infof("operation %d installed in RIB successfully", op.GetId())
 
-		r.rmPending(op.GetId())
+		r.rmPending(pid)
 
 		*oks = append(*oks, &OpResult{
-			ID: op.GetId(),
-			Op: op,
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
 		})
+		r.setEntryMetadata(ni, session, entryAFT, entryKey, op)
+		seq := r.recordAdded(niR, ni, session, entryAFT, entryKey, before, op)
 
 		var (
 			call bool
@@ -536,19 +900,44 @@ func (r *RIB) addEntryInternal(ni string, op *spb.AFTOperation, oks, fails *[]*O
 			}
 		}
 
+		// the operation may have changed how other next-hops are recursively
+		// resolved.
+		if reevaluate {
+			if err := r.reevaluateResolution(scope); err != nil {
+				return err
+			}
+		}
+		r.updateResolvability(seq, newEntryID(ni, entryAFT, entryKey))
+
+		chType := constants.Replace
+		if before == nil || util.IsValueNil(before) {
+			chType = constants.Add
+		}
+		if err := r.deriveAdded(niR, ni, chType, entryAFT, entryKey, depth, oks, fails); err != nil {
+			return err
+		}
+
 		// we may now have made some other pending entry be possible to install,
 		// so try them all out.
 		for _, e := range r.getPending() {
-			err := r.addEntryInternal(e.ni, e.op, oks, fails, installStack)
+			err := r.addEntryInternal(e.ni, e.session, e.op, oks, fails, installStack, 0)
 			if err != nil {
 				return err
 			}
 		}
 	default:
-		r.addPending(op.GetId(), &pendingEntry{
-			ni: ni,
-			op: op,
-		})
+		if !r.addPending(pid, &pendingEntry{
+			ni:      ni,
+			session: session,
+			op:      op,
+		}) {
+			*fails = append(*fails, &OpResult{
+				ID:      op.GetId(),
+				Session: session,
+				Op:      op,
+				Error:   fmt.Sprintf("cannot store unresolved operation, pending queue is full (%d entries)", r.pendingLimit),
+			})
+		}
 	}
 
 	return nil
@@ -603,12 +992,19 @@ func handleReferences[P topLevelEntryProto, S topLevelEntryStruct](r *RIB, niRIB
 			// We are no longer referencing the original NHG, so we need to decrement
 			// the old references.
 			rr, err := r.refdRIB(niRIB, origNHGNI)
-			switch err {
-			case nil:
-				rr.decNHGRefCount(origNHG)
-			default:
+			if err != nil {
 				log.Errorf("cannot find NHG network instance %s", origNHGNI)
+				break
+			}
+			if nr, err := r.refdRIB(niRIB, newNHGNI); err == nil && nr == rr {
+				// Where the old and new NHGs are within the same network instance,
+				// move the reference such that readers of the reference counts
+				// never observe the intermediate state.
+				rr.moveNHGRefCount(origNHG, newNHG)
+				incRefCounts = false
+				break
 			}
+			rr.decNHGRefCount(origNHG)
 		default:
 			// We are referencing new network instances.
 		}
@@ -698,8 +1094,21 @@ func (r *RIB) refdRIB(ni *RIBHolder, ref string) (*RIBHolder, error) {
 	return referencingRIB, nil
 }
 
-// DeleteEntry removes the entry specified by op from the network instance ni.
+// DeleteEntry removes the entry specified by op from the network instance ni, where
+// an empty name refers to the default network instance.
 func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpResult, error) {
+	return r.deleteEntry(ni, "", op, 0)
+}
+
+// deleteEntry is the internal implementation of DeleteEntry, where session is the
+// ID of the client session that the operation op was received from, and depth is
+// the derivation depth of op, which is zero for operations that are not derived
+// from another change to the RIB.
+func (r *RIB) deleteEntry(ni, session string, op *spb.AFTOperation, depth int) ([]*OpResult, []*OpResult, error) {
+	ni, niErr := r.operationNetworkInstance(ni)
+	if niErr != nil {
+		return nil, nil, niErr
+	}
 	niR, ok := r.NetworkInstanceRIB(ni)
 	if !ok || !niR.IsValid() {
 		return nil, nil, fmt.Errorf("invalid network instance, %s", ni)
@@ -711,13 +1120,37 @@ func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpRe
 		err          error
 		originalv4   *aft.Afts_Ipv4Entry
 		originalv6   *aft.Afts_Ipv6Entry
+		originalNH   *aft.Afts_NextHop
 		originalNHG  *aft.Afts_NextHopGroup
 		originalMPLS *aft.Afts_LabelEntry
+		originalPBR  *aft.Afts_PolicyForwardingEntry
+		// delAFT, delKey and delEntry identify the entry that was deleted,
+		// and delSeq is the sequence number of the deletion.
+		delAFT   constants.AFT
+		delKey   any
+		delEntry ygot.GoStruct
+		delSeq   uint64
 	)
 
 	if op == nil || op.Entry == nil {
 		return nil, nil, status.Newf(codes.InvalidArgument, "invalid nil AFT operation, %v", op).Err()
 	}
+	if err := validateOperationKey(op); err != nil {
+		return nil, []*OpResult{{
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
+			Error:   err.Error(),
+		}}, nil
+	}
+	if depth == 0 && r.derivations.isDerivedOp(ni, op) {
+		return nil, []*OpResult{{
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
+			Error:   "cannot delete an entry that is derived from another entry",
+		}}, nil
+	}
 	switch t := op.Entry.(type) {
 	case *spb.AFTOperation_Ipv4:
 		log.V(2).Infof("deleting IPv4 prefix %s", t.Ipv4.GetPrefix())
@@ -727,13 +1160,16 @@ func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpRe
 		removed, originalv6, err = niR.DeleteIPv6(t.Ipv6)
 	case *spb.AFTOperation_NextHop:
 		log.V(2).Infof("deleting NH Index %d", t.NextHop.GetIndex())
-		removed, _, err = niR.DeleteNextHop(t.NextHop)
+		removed, originalNH, err = niR.DeleteNextHop(t.NextHop)
 	case *spb.AFTOperation_NextHopGroup:
 		log.V(2).Infof("deleting NHG ID %d", t.NextHopGroup.GetId())
 		removed, originalNHG, err = niR.DeleteNextHopGroup(t.NextHopGroup)
 	case *spb.AFTOperation_Mpls:
 		log.V(2).Infof("deleting MPLS entry %s", t.Mpls.GetLabel())
 		removed, originalMPLS, err = niR.DeleteMPLS(t.Mpls)
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		log.V(2).Infof("deleting policy-forwarding entry %d", t.PolicyForwardingEntry.GetIndex())
+		removed, originalPBR, err = niR.DeletePolicyForwarding(t.PolicyForwardingEntry)
 	default:
 		return nil, nil, status.Newf(codes.Unimplemented, "unsupported AFT operation type %T", t).Err()
 	}
@@ -747,9 +1183,10 @@ func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpRe
 	switch {
 	case err != nil:
 		fails = append(fails, &OpResult{
-			ID:    op.GetId(),
-			Op:    op,
-			Error: err.Error(),
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
+			Error:   err.Error(),
 		})
 	case removed:
 		// Decrement the reference counts.
@@ -763,6 +1200,7 @@ func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpRe
 			callHook = true
 			aft = constants.IPv4
 			key = originalv4.GetPrefix()
+			delAFT, delKey, delEntry = aft, key, originalv4
 		case originalv6 != nil:
 			referencingRIB, err := r.refdRIB(niR, originalv6.GetNextHopGroupNetworkInstance())
 			if err != nil {
@@ -772,10 +1210,15 @@ func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpRe
 			callHook = true
 			aft = constants.IPv6
 			key = originalv6.GetPrefix()
+			delAFT, delKey, delEntry = aft, key, originalv6
 		case originalNHG != nil:
 			for id := range originalNHG.NextHop {
 				niR.decNHRefCount(id)
 			}
+			delAFT, delKey, delEntry = constants.NextHopGroup, originalNHG.GetId(), originalNHG
+		case originalNH != nil:
+			r.forgetNextHop(nhKey{ni: ni, index: originalNH.GetIndex()})
+			delAFT, delKey, delEntry = constants.NextHop, originalNH.GetIndex(), originalNH
 		case originalMPLS != nil:
 			referencingRIB, err := r.refdRIB(niR, originalMPLS.GetNextHopGroupNetworkInstance())
 			if err != nil {
@@ -785,17 +1228,30 @@ func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpRe
 			callHook = true
 			aft = constants.MPLS
 			key = originalMPLS.GetLabel()
+			delAFT, delKey, delEntry = aft, key, originalMPLS
+		case originalPBR != nil:
+			referencingRIB, err := r.refdRIB(niR, originalPBR.GetNextHopGroupNetworkInstance())
+			if err != nil {
+				return nil, nil, err
+			}
+			referencingRIB.decNHGRefCount(originalPBR.GetNextHopGroup())
+			delAFT, delKey, delEntry = constants.PolicyForwarding, originalPBR.GetIndex(), originalPBR
 		}
 
+		r.removeEntryMetadata(ni, delAFT, delKey)
+		delSeq = r.recordDeleted(ni, session, delAFT, delKey, delEntry, op)
+
 		log.V(2).Infof("operation %d deleted from RIB successfully", op.GetId())
 		oks = append(oks, &OpResult{
-			ID: op.GetId(),
-			Op: op,
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
 		})
 	default:
 		fails = append(fails, &OpResult{
-			ID: op.GetId(),
-			Op: op,
+			ID:      op.GetId(),
+			Session: session,
+			Op:      op,
 		})
 	}
 
@@ -804,11 +1260,26 @@ func (r *RIB) DeleteEntry(ni string, op *spb.AFTOperation) ([]*OpResult, []*OpRe
 			return oks, fails, fmt.Errorf("cannot run resolvedEntryHook, %v", err)
 		}
 	}
+
+	// removing a prefix may change how the next-hops that it covered are resolved.
+	if p, ok := key.(string); ok {
+		if err := r.reevaluateResolution(prefixScope(ni, p)); err != nil {
+			return oks, fails, err
+		}
+	}
+
+	if delEntry != nil {
+		r.updateResolvability(delSeq, newEntryID(ni, delAFT, delKey))
+		if err := r.deriveDeleted(ni, delAFT, delKey, delEntry, depth, &oks, &fails); err != nil {
+			return oks, fails, err
+		}
+	}
 	return oks, fails, nil
 }
 
 // getPending returns the current set of pending entry operations for the
-// RIB receiver.
+// RIB receiver. The entries are sorted by operation ID, and then session, such
+// that they are retried in a deterministic order.
 func (r *RIB) getPending() []*pendingEntry {
 	r.pendMu.RLock()
 	defer r.pendMu.RUnlock()
@@ -816,19 +1287,247 @@ func (r *RIB) getPending() []*pendingEntry {
 	for _, e := range r.pendingEntries {
 		p = append(p, e)
 	}
+	sort.Slice(p, func(i, j int) bool {
+		if p[i].op.GetId() != p[j].op.GetId() {
+			return p[i].op.GetId() < p[j].op.GetId()
+		}
+		return p[i].session < p[j].session
+	})
 	return p
 }
 
-// addPending adds a pendingEntry with operation ID id to the pending entries
-// within the RIB.
-func (r *RIB) addPending(id uint64, e *pendingEntry) {
+// addPending adds a pendingEntry with the key id to the pending entries
+// within the RIB. It returns false if the entry could not be added because the
+// pending limit of the RIB has been reached.
+func (r *RIB) addPending(id pendingID, e *pendingEntry) bool {
 	r.pendMu.Lock()
 	defer r.pendMu.Unlock()
+	if _, ok := r.pendingEntries[id]; !ok && r.pendingLimit > 0 && len(r.pendingEntries) >= r.pendingLimit {
+		return false
+	}
 	r.pendingEntries[id] = e
+	return true
+}
+
+// PendingEntryKeys returns the keys of the entries within the AFT a of network
+// instance ni that are to be added or replaced by operations that are pending
+// resolution. The keys are of the types returned for the entries of each AFT by
+// the RIB, i.e., a string prefix for the IPv4 and IPv6 AFTs, and a uint64 label,
+// ID or index for other AFTs.
+func (r *RIB) PendingEntryKeys(ni string, a constants.AFT) map[any]bool {
+	if ni == "" {
+		ni = r.defaultName
+	}
+	r.pendMu.RLock()
+	defer r.pendMu.RUnlock()
+	keys := map[any]bool{}
+	for _, e := range r.pendingEntries {
+		eni := e.ni
+		if eni == "" {
+			eni = r.defaultName
+		}
+		if eni != ni || e.op.GetOp() == spb.AFTOperation_DELETE {
+			continue
+		}
+		if ea, k := operationKey(e.op); ea == a && k != nil {
+			keys[k] = true
+		}
+	}
+	return keys
+}
+
+// IsPending returns true if the operation with the specified ID, that was not
+// received from a known session, is stored in the RIB awaiting its references
+// being resolved.
+func (r *RIB) IsPending(id uint64) bool {
+	return r.IsPendingForSession("", id)
+}
+
+// IsPendingForSession returns true if the operation with the specified ID that
+// was received from the client session with the ID session is stored in the RIB
+// awaiting its references being resolved.
+func (r *RIB) IsPendingForSession(session string, id uint64) bool {
+	r.pendMu.RLock()
+	defer r.pendMu.RUnlock()
+	_, ok := r.pendingEntries[pendingID{session: session, id: id}]
+	return ok
+}
+
+// RemovePending removes the operation with the specified ID, that was not
+// received from a known session, from the set of operations that are awaiting
+// resolution. It returns true if the operation was pending.
+func (r *RIB) RemovePending(id uint64) bool {
+	return r.RemovePendingForSession("", id)
+}
+
+// RemovePendingForSession removes the operation with the specified ID that was
+// received from the client session with the ID session from the set of
+// operations that are awaiting resolution. It returns true if the operation was
+// pending.
+func (r *RIB) RemovePendingForSession(session string, id uint64) bool {
+	r.pendMu.Lock()
+	defer r.pendMu.Unlock()
+	pid := pendingID{session: session, id: id}
+	e, ok := r.pendingEntries[pid]
+	if ok {
+		r.recordRemovedPending(e)
+	}
+	delete(r.pendingEntries, pid)
+	return ok
+}
+
+// flushPending removes all pending operations within the network instance ni.
+func (r *RIB) flushPending(ni string) {
+	r.pendMu.Lock()
+	defer r.pendMu.Unlock()
+	for id, e := range r.pendingEntries {
+		if e.ni == ni {
+			r.recordRemovedPending(e)
+			delete(r.pendingEntries, id)
+		}
+	}
+}
+
+// UnresolvedReferences returns a description of each reference within the
+// operation op, within network instance ni, that cannot currently be resolved
+// within the RIB. It returns an empty slice if all references can be resolved.
+func (r *RIB) UnresolvedReferences(ni string, op *spb.AFTOperation) []string {
+	if ni == "" {
+		ni = r.defaultName
+	}
+	missing := []string{}
+
+	nhgRef := func(refNI string, id uint64) {
+		if refNI == "" {
+			refNI = ni
+		}
+		niR, ok := r.NetworkInstanceRIB(refNI)
+		if !ok {
+			missing = append(missing, fmt.Sprintf("network-instance %s", refNI))
+			return
+		}
+		if _, ok := niR.GetNextHopGroup(id); !ok {
+			missing = append(missing, fmt.Sprintf("next-hop-group %d in network-instance %s", id, refNI))
+		}
+	}
+
+	switch t := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		e := t.Ipv4.GetIpv4Entry()
+		nhgRef(e.GetNextHopGroupNetworkInstance().GetValue(), e.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_Ipv6:
+		e := t.Ipv6.GetIpv6Entry()
+		nhgRef(e.GetNextHopGroupNetworkInstance().GetValue(), e.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_Mpls:
+		e := t.Mpls.GetLabelEntry()
+		nhgRef(e.GetNextHopGroupNetworkInstance().GetValue(), e.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		e := t.PolicyForwardingEntry.GetPolicyForwardingEntry()
+		nhgRef(e.GetNextHopGroupNetworkInstance().GetValue(), e.GetNextHopGroup().GetValue())
+	case *spb.AFTOperation_NextHopGroup:
+		niR, ok := r.NetworkInstanceRIB(ni)
+		if !ok {
+			return append(missing, fmt.Sprintf("network-instance %s", ni))
+		}
+		for _, nh := range t.NextHopGroup.GetNextHopGroup().GetNextHop() {
+			if _, ok := niR.GetNextHop(nh.GetIndex()); !ok {
+				missing = append(missing, fmt.Sprintf("next-hop %d in network-instance %s", nh.GetIndex(), ni))
+			}
+		}
+	}
+	return missing
+}
+
+// NHGReferences returns the number of entries that reference the next-hop-group
+// with ID id within network instance ni, where an empty name refers to the default
+// network instance. It returns an error if the network instance does not exist.
+func (r *RIB) NHGReferences(ni string, id uint64) (int, error) {
+	niR, err := r.refCountRIB(ni)
+	if err != nil {
+		return 0, err
+	}
+	return niR.nhgRefCount(id), nil
+}
+
+// NHReferences returns the number of next-hop-groups that reference the next-hop
+// with index idx within network instance ni, where an empty name refers to the
+// default network instance. It returns an error if the network instance does not
+// exist.
+func (r *RIB) NHReferences(ni string, idx uint64) (int, error) {
+	niR, err := r.refCountRIB(ni)
+	if err != nil {
+		return 0, err
+	}
+	return niR.nhRefCount(idx), nil
+}
+
+// refCountRIB returns the RIB for the network instance ni whose reference counts
+// are to be read.
+func (r *RIB) refCountRIB(ni string) (*RIBHolder, error) {
+	if ni == "" {
+		ni = r.defaultName
+	}
+	niR, ok := r.NetworkInstanceRIB(ni)
+	if !ok {
+		return nil, fmt.Errorf("invalid network-instance %s", ni)
+	}
+	return niR, nil
+}
+
+// ResolvedEntries returns the sorted prefixes of the IPv4 and IPv6 entries within
+// network instance ni, where an empty name refers to the default network instance,
+// that are currently fully resolvable - such that the next-hop-group that they
+// reference, and each of the next-hops within it, are installed in the RIB. It
+// returns an error if the network instance does not exist.
+func (r *RIB) ResolvedEntries(ni string) ([]string, error) {
+	niR, err := r.refCountRIB(ni)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := func(nhgNI string, id uint64) bool {
+		rr, err := r.refdRIB(niR, nhgNI)
+		if err != nil {
+			return false
+		}
+		nhg, ok := rr.GetNextHopGroup(id)
+		if !ok {
+			return false
+		}
+		for idx := range nhg.NextHop {
+			if _, ok := rr.GetNextHop(idx); !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	niR.mu.RLock()
+	type ref struct {
+		ni string
+		id uint64
+	}
+	refs := map[string]ref{}
+	for p, e := range niR.r.GetAfts().Ipv4Entry {
+		refs[p] = ref{ni: e.GetNextHopGroupNetworkInstance(), id: e.GetNextHopGroup()}
+	}
+	for p, e := range niR.r.GetAfts().Ipv6Entry {
+		refs[p] = ref{ni: e.GetNextHopGroupNetworkInstance(), id: e.GetNextHopGroup()}
+	}
+	niR.mu.RUnlock()
+
+	prefixes := []string{}
+	for p, e := range refs {
+		if resolved(e.ni, e.id) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes, nil
 }
 
-// rmPending removes the operation with ID id from the RIB's pendingEntries.
-func (r *RIB) rmPending(id uint64) {
+// rmPending removes the operation with key id from the RIB's pendingEntries.
+func (r *RIB) rmPending(id pendingID) {
 	r.pendMu.Lock()
 	defer r.pendMu.Unlock()
 	delete(r.pendingEntries, id)
@@ -870,7 +1569,23 @@ func (r *RIB) canResolve(netInst string, candidate *aft.RIB) (bool, error) {
 		if n.GetIndex() == 0 {
 			return false, fmt.Errorf("invalid index zero for next-hop in NI %s", netInst)
 		}
-		// we always resolve next-hop entries because they can be resolved outside of gRIBI.
+		// a next-hop that is resolved in another network-instance can only be
+		// resolved if that network instance exists on the server.
+		if nhNI := n.GetNetworkInstance(); nhNI != "" {
+			if _, ok := r.NetworkInstanceRIB(nhNI); !ok {
+				return false, fmt.Errorf("invalid unknown network-instance %s for next-hop %d in NI %s", nhNI, n.GetIndex(), netInst)
+			}
+		}
+		// a next-hop whose address is covered by another prefix in the RIB is
+		// resolved recursively, which must not loop.
+		ni := netInst
+		if ni == "" {
+			ni = r.defaultName
+		}
+		if err := r.checkNextHopResolution(ni, n); err != nil {
+			return false, err
+		}
+		// otherwise, we always resolve next-hop entries because they can be resolved outside of gRIBI.
 		return true, nil
 	}
 
@@ -940,6 +1655,13 @@ func (r *RIB) canResolve(netInst string, candidate *aft.RIB) (bool, error) {
 		return nhgResolvable(niRIB, i.GetNextHopGroupNetworkInstance(), i.GetNextHopGroup())
 	}
 
+	for _, i := range caft.PolicyForwardingEntry {
+		if i.GetNextHopGroup() == 0 {
+			return false, fmt.Errorf("invalid zero index NHG in PolicyForwardingEntry %d, NI %s", i.GetIndex(), netInst)
+		}
+		return nhgResolvable(niRIB, i.GetNextHopGroupNetworkInstance(), i.GetNextHopGroup())
+	}
+
 	// We should never reach here since we checked that at least one of the things that we are looping over has
 	// length >1, but return here too.
 	return false, errors.New("no entries in specified candidate")
@@ -978,8 +1700,9 @@ func (r *RIB) canDelete(netInst string, deletionCandidate *aft.RIB) (bool, error
 	}
 
 	// IPv4 entries can always be removed, since we allow recursion to happen
-	// inside and outside of gRIBI - this is true for MPLS and IPv6.
-	if len(caft.Ipv4Entry) != 0 || len(caft.LabelEntry) != 0 || len(caft.Ipv6Entry) != 0 {
+	// inside and outside of gRIBI - this is true for MPLS, IPv6 and
+	// policy-forwarding entries, which are never referenced.
+	if len(caft.Ipv4Entry) != 0 || len(caft.LabelEntry) != 0 || len(caft.Ipv6Entry) != 0 || len(caft.PolicyForwardingEntry) != 0 {
 		return true, nil
 	}
 
@@ -994,7 +1717,8 @@ func (r *RIB) canDelete(netInst string, deletionCandidate *aft.RIB) (bool, error
 			return true, nil
 		}
 		// if the NHG is not referenced, then we can delete it.
-		return !niRIB.nhgReferenced(id), nil
+		refs, err := r.NHGReferences(netInst, id)
+		return refs == 0, err
 	}
 
 	for idx := range caft.NextHop {
@@ -1005,7 +1729,8 @@ func (r *RIB) canDelete(netInst string, deletionCandidate *aft.RIB) (bool, error
 			return true, nil
 		}
 		// again if the NH is not referenced, then we can delete it.
-		return !niRIB.nhReferenced(idx), nil
+		refs, err := r.NHReferences(netInst, idx)
+		return refs == 0, err
 	}
 
 	// We checked that there was 1 entry in the RIB, so we should never reach here,
@@ -1020,12 +1745,10 @@ func checkCandidate(caft *aft.Afts) error {
 	switch {
 	case len(caft.MacEntry) != 0:
 		return fmt.Errorf("ethernet MAC entries are unsupported, got: %v", caft.MacEntry)
-	case len(caft.PolicyForwardingEntry) != 0:
-		return fmt.Errorf("PBR entries are unsupported, got: %v", caft.PolicyForwardingEntry)
-	case (len(caft.Ipv6Entry) + len(caft.LabelEntry) + len(caft.Ipv4Entry) + len(caft.NextHopGroup) + len(caft.NextHop)) == 0:
+	case (len(caft.Ipv6Entry) + len(caft.LabelEntry) + len(caft.Ipv4Entry) + len(caft.NextHopGroup) + len(caft.NextHop) + len(caft.PolicyForwardingEntry)) == 0:
 		return errors.New("no entries in specified candidate")
-	case (len(caft.Ipv6Entry) + len(caft.LabelEntry) + len(caft.Ipv4Entry) + len(caft.NextHopGroup) + len(caft.NextHop)) > 1:
-		return fmt.Errorf("multiple entries are unsupported, got mpls: %v, ipv4: %v, next-hop-group: %v, next-hop: %v", caft.LabelEntry, caft.Ipv4Entry, caft.NextHopGroup, caft.NextHop)
+	case (len(caft.Ipv6Entry) + len(caft.LabelEntry) + len(caft.Ipv4Entry) + len(caft.NextHopGroup) + len(caft.NextHop) + len(caft.PolicyForwardingEntry)) > 1:
+		return fmt.Errorf("multiple entries are unsupported, got mpls: %v, ipv4: %v, next-hop-group: %v, next-hop: %v, policy-forwarding: %v", caft.LabelEntry, caft.Ipv4Entry, caft.NextHopGroup, caft.NextHop, caft.PolicyForwardingEntry)
 	}
 	return nil
 }
@@ -1062,6 +1785,26 @@ func hasCheckFn(opts []ribHolderOpt) *ribHolderCheckFn {
 	return nil
 }
 
+// ribHolderClock is a ribHolderOpt that provides the function used to determine
+// the current time within the RIBHolder.
+type ribHolderClock struct {
+	fn func() time.Time
+}
+
+// isRHOpt implements the ribHolderOpt interface.
+func (*ribHolderClock) isRHOpt() {}
+
+// hasRIBHolderClock returns the clock function supplied in a ribHolderClock option
+// within opts, or nil if it is not present.
+func hasRIBHolderClock(opts []ribHolderOpt) func() time.Time {
+	for _, o := range opts {
+		if c, ok := o.(*ribHolderClock); ok {
+			return c.fn
+		}
+	}
+	return nil
+}
+
 // NewRIBHolder returns a new RIB holder for a single network instance.
 func NewRIBHolder(name string, opts ...ribHolderOpt) *RIBHolder {
 	r := &RIBHolder{
@@ -1073,6 +1816,7 @@ func NewRIBHolder(name string, opts ...ribHolderOpt) *RIBHolder {
 			NextHop:      map[uint64]uint64{},
 			NextHopGroup: map[uint64]uint64{},
 		},
+		clock: hasRIBHolderClock(opts),
 	}
 
 	fn := hasCheckFn(opts)
@@ -1087,6 +1831,15 @@ func NewRIBHolder(name string, opts ...ribHolderOpt) *RIBHolder {
 	return r
 }
 
+// timestamp returns the current time in nanoseconds since the unix epoch as
+// determined by the RIBHolder's clock.
+func (r *RIBHolder) timestamp() int64 {
+	if r.clock != nil {
+		return r.clock().UnixNano()
+	}
+	return unixTS()
+}
+
 // IsValid determines whether the specified RIBHolder is valid to be
 // programmed.
 func (r *RIBHolder) IsValid() bool {
@@ -1113,6 +1866,33 @@ func (r *RIBHolder) GetNextHop(index uint64) (*aft.Afts_NextHop, bool) {
 	return n, true
 }
 
+// GetIPv4Entry gets the IPv4 entry with the specified prefix from the RIB and
+// returns it. It returns a bool indicating whether the value was found.
+func (r *RIBHolder) GetIPv4Entry(prefix string) (*aft.Afts_Ipv4Entry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e := r.r.GetAfts().GetIpv4Entry(prefix)
+	if e == nil {
+		return nil, false
+	}
+	return e, true
+}
+
+// EntryCounts returns the number of entries within each AFT of the RIB.
+func (r *RIBHolder) EntryCounts() map[constants.AFT]uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a := r.r.GetAfts()
+	return map[constants.AFT]uint64{
+		constants.IPv4:             uint64(len(a.Ipv4Entry)),
+		constants.IPv6:             uint64(len(a.Ipv6Entry)),
+		constants.MPLS:             uint64(len(a.LabelEntry)),
+		constants.NextHopGroup:     uint64(len(a.NextHopGroup)),
+		constants.NextHop:          uint64(len(a.NextHop)),
+		constants.PolicyForwarding: uint64(len(a.PolicyForwardingEntry)),
+	}
+}
+
 // GetNextHopGroup gets the next-hop-group with the specified ID from the RIB
 // and returns it. It returns a bool indicating whether the value was found.
 func (r *RIBHolder) GetNextHopGroup(id uint64) (*aft.Afts_NextHopGroup, bool) {
@@ -1224,7 +2004,7 @@ func (r *RIBHolder) AddIPv4(e *aftpb.Afts_Ipv4EntryKey, explicitReplace bool) (b
 	// know the key.
 	if r.postChangeHook != nil {
 		for _, ip4 := range nr.Afts.Ipv4Entry {
-			r.postChangeHook(constants.Add, unixTS(), r.name, ip4)
+			r.postChangeHook(constants.Add, r.timestamp(), r.name, ip4)
 		}
 	}
 
@@ -1244,6 +2024,7 @@ func (r *RIBHolder) ipv4Exists(prefix string) bool {
 func (r *RIBHolder) doAddIPv4(pfx string, newRIB *aft.RIB) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.IPv4)
 
 	// Sanity check.
 	if nhg, nh := len(newRIB.Afts.NextHopGroup), len(newRIB.Afts.NextHop); nhg != 0 || nh != 0 {
@@ -1263,6 +2044,7 @@ func (r *RIBHolder) doAddIPv4(pfx string, newRIB *aft.RIB) (bool, error) {
 	if err := ygot.MergeStructInto(r.r, newRIB); err != nil {
 		return false, fmt.Errorf("cannot merge candidate RIB into existing RIB, %v", err)
 	}
+	r.indexPrefix(pfx)
 	return implicit, nil
 }
 
@@ -1298,7 +2080,7 @@ func (r *RIBHolder) DeleteIPv4(e *aftpb.Afts_Ipv4EntryKey) (bool, *aft.Afts_Ipv4
 	r.doDeleteIPv4(e.GetPrefix())
 
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 
 	return true, de, nil
@@ -1316,21 +2098,25 @@ func (r *RIBHolder) retrieveIPv4(prefix string) *aft.Afts_Ipv4Entry {
 func (r *RIBHolder) doDeleteIPv4(pfx string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.IPv4)
 	delete(r.r.Afts.Ipv4Entry, pfx)
+	r.unindexPrefix(pfx)
 }
 
 // locklessDeleteIPv4 removes the next-hop with the specified prefix without
 // holding a lock on the RIB. The caller MUST hold the relevant lock. It returns
 // an error if the entry cannot be found.
 func (r *RIBHolder) locklessDeleteIPv4(prefix string) error {
+	r.unshare(constants.IPv4)
 	de := r.r.Afts.Ipv4Entry[prefix]
 	if de == nil {
 		return fmt.Errorf("cannot find prefix %s", prefix)
 	}
 
 	delete(r.r.Afts.Ipv4Entry, prefix)
+	r.unindexPrefix(prefix)
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 	return nil
 }
@@ -1379,7 +2165,7 @@ func (r *RIBHolder) AddIPv6(e *aftpb.Afts_Ipv6EntryKey, explicitReplace bool) (b
 
 	if r.postChangeHook != nil {
 		for _, ip4 := range nr.Afts.Ipv6Entry {
-			r.postChangeHook(constants.Add, unixTS(), r.name, ip4)
+			r.postChangeHook(constants.Add, r.timestamp(), r.name, ip4)
 		}
 	}
 
@@ -1399,6 +2185,7 @@ func (r *RIBHolder) ipv6Exists(prefix string) bool {
 func (r *RIBHolder) doAddIPv6(pfx string, newRIB *aft.RIB) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.IPv6)
 
 	if nhg, nh := len(newRIB.Afts.NextHopGroup), len(newRIB.Afts.NextHop); nhg != 0 || nh != 0 {
 		return false, fmt.Errorf("candidate RIB specifies entries other than NextHopGroups, got: %d nhg, %d nh", nhg, nh)
@@ -1413,6 +2200,7 @@ func (r *RIBHolder) doAddIPv6(pfx string, newRIB *aft.RIB) (bool, error) {
 	if err := ygot.MergeStructInto(r.r, newRIB); err != nil {
 		return false, fmt.Errorf("cannot merge candidate RIB into existing RIB, %v", err)
 	}
+	r.indexPrefix(pfx)
 	return implicit, nil
 }
 
@@ -1445,7 +2233,7 @@ func (r *RIBHolder) DeleteIPv6(e *aftpb.Afts_Ipv6EntryKey) (bool, *aft.Afts_Ipv6
 	r.doDeleteIPv6(e.GetPrefix())
 
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 
 	return true, de, nil
@@ -1463,20 +2251,24 @@ func (r *RIBHolder) retrieveIPv6(prefix string) *aft.Afts_Ipv6Entry {
 func (r *RIBHolder) doDeleteIPv6(pfx string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.IPv6)
 	delete(r.r.Afts.Ipv6Entry, pfx)
+	r.unindexPrefix(pfx)
 }
 
 // locklessDeleteIPv6 deletes the entry for prefix from the RIB, without holding the lock
 // caution must be exercised and the lock MUST be held to call this function.
 func (r *RIBHolder) locklessDeleteIPv6(prefix string) error {
+	r.unshare(constants.IPv6)
 	de := r.r.Afts.Ipv6Entry[prefix]
 	if de == nil {
 		return fmt.Errorf("cannot find prefix %s", prefix)
 	}
 
 	delete(r.r.Afts.Ipv6Entry, prefix)
+	r.unindexPrefix(prefix)
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 	return nil
 }
@@ -1540,7 +2332,7 @@ func (r *RIBHolder) AddMPLS(e *aftpb.Afts_LabelEntryKey, explicitReplace bool) (
 	// know the key.
 	if r.postChangeHook != nil {
 		for _, mpls := range nr.Afts.LabelEntry {
-			r.postChangeHook(constants.Add, unixTS(), r.name, mpls)
+			r.postChangeHook(constants.Add, r.timestamp(), r.name, mpls)
 		}
 	}
 
@@ -1563,6 +2355,7 @@ func (r *RIBHolder) mplsExists(label uint32) bool {
 func (r *RIBHolder) doAddMPLS(label uint32, newRIB *aft.RIB) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.MPLS)
 
 	// Sanity check.
 	if nhg, nh := len(newRIB.Afts.NextHopGroup), len(newRIB.Afts.NextHop); nhg != 0 || nh != 0 {
@@ -1626,7 +2419,7 @@ func (r *RIBHolder) DeleteMPLS(e *aftpb.Afts_LabelEntryKey) (bool, *aft.Afts_Lab
 	r.doDeleteMPLS(lbl)
 
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 
 	return true, de, nil
@@ -1645,6 +2438,7 @@ func (r *RIBHolder) retrieveMPLS(label uint32) *aft.Afts_LabelEntry {
 func (r *RIBHolder) doDeleteMPLS(label uint32) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.MPLS)
 	delete(r.r.Afts.LabelEntry, aft.UnionUint32(label))
 }
 
@@ -1652,6 +2446,7 @@ func (r *RIBHolder) doDeleteMPLS(label uint32) {
 // from the RIB, without holding the lock on the AFT. The calling routine
 // MUST ensure that it holds the lock to ensure thread-safe operation.
 func (r *RIBHolder) locklessDeleteMPLS(label aft.Afts_LabelEntry_Label_Union) error {
+	r.unshare(constants.MPLS)
 	de := r.r.Afts.LabelEntry[label]
 	if de == nil {
 		return fmt.Errorf("cannot find label %d", label)
@@ -1659,7 +2454,156 @@ func (r *RIBHolder) locklessDeleteMPLS(label aft.Afts_LabelEntry_Label_Union) er
 
 	delete(r.r.Afts.LabelEntry, label)
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
+	}
+	return nil
+}
+
+// AddPolicyForwarding adds the policy-forwarding entry described by e to the
+// RIB. If the explicitReplace argument is set to true, it checks whether the
+// entry exists before it is replaced, otherwise replaces are implicit. It
+// returns a bool which indicates whether the entry was added, a copy of the
+// entry that was replaced, and an error that should be considered fatal by the
+// caller (i.e., there is no possibility that this entry can become valid and be
+// installed in the future).
+func (r *RIBHolder) AddPolicyForwarding(e *aftpb.Afts_PolicyForwardingEntryKey, explicitReplace bool) (bool, *aft.Afts_PolicyForwardingEntry, error) {
+	if r.r == nil {
+		return false, nil, errors.New("invalid RIB structure, nil")
+	}
+
+	if e == nil {
+		return false, nil, errors.New("nil policy-forwarding entry provided")
+	}
+
+	nr, err := candidateRIB(&aftpb.Afts{
+		PolicyForwardingEntry: []*aftpb.Afts_PolicyForwardingEntryKey{e},
+	})
+	if err != nil {
+		return false, nil, fmt.Errorf("invalid PolicyForwardingEntry, %v", err)
+	}
+
+	orig := r.retrievePolicyForwarding(e.GetIndex())
+	if explicitReplace && orig == nil {
+		return false, nil, fmt.Errorf("cannot replace policy-forwarding entry %d, does not exist", e.GetIndex())
+	}
+
+	if r.checkFn != nil {
+		ok, err := r.checkFn(constants.Add, nr)
+		switch {
+		case err != nil:
+			// This entry can never be installed, so return the error
+			// to the caller directly -- signalling to them not to retry.
+			return false, nil, err
+		case !ok:
+			// The entry is valid but cannot yet be installed, the caller
+			// can retry it later.
+			return false, nil, nil
+		}
+	}
+
+	if err := r.doAddPolicyForwarding(e.GetIndex(), nr); err != nil {
+		return false, nil, err
+	}
+
+	if r.postChangeHook != nil {
+		for _, pbr := range nr.Afts.PolicyForwardingEntry {
+			r.postChangeHook(constants.Add, r.timestamp(), r.name, pbr)
+		}
+	}
+
+	return true, orig, nil
+}
+
+// doAddPolicyForwarding implements the addition of the policy-forwarding entry
+// with the specified index with the contents of the newRIB specified. It holds
+// the shortest possible lock on the RIB.
+func (r *RIBHolder) doAddPolicyForwarding(index uint64, newRIB *aft.RIB) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unshare(constants.PolicyForwarding)
+
+	// MergeStructInto doesn't completely replace a list entry if it finds a missing key,
+	// so will append the two entries together.
+	delete(r.r.GetAfts().PolicyForwardingEntry, index)
+
+	if err := ygot.MergeStructInto(r.r, newRIB); err != nil {
+		return fmt.Errorf("cannot merge candidate RIB into existing RIB, %v", err)
+	}
+	return nil
+}
+
+// DeletePolicyForwarding removes the policy-forwarding entry e from the RIB. It
+// returns a boolean indicating whether the entry has been removed, a copy of
+// the entry that was removed, and an error if the message cannot be parsed. Per
+// the gRIBI specification the payload of the entry is not compared to the
+// existing entry before deleting it.
+func (r *RIBHolder) DeletePolicyForwarding(e *aftpb.Afts_PolicyForwardingEntryKey) (bool, *aft.Afts_PolicyForwardingEntry, error) {
+	if e == nil {
+		return false, nil, errors.New("nil policy-forwarding entry provided")
+	}
+
+	if r.r == nil {
+		return false, nil, errors.New("invalid RIB structure, nil")
+	}
+
+	de := r.retrievePolicyForwarding(e.GetIndex())
+
+	rr := &aft.RIB{}
+	rr.GetOrCreateAfts().GetOrCreatePolicyForwardingEntry(e.GetIndex())
+
+	if r.checkFn != nil {
+		ok, err := r.checkFn(constants.Delete, rr)
+		switch {
+		case err != nil:
+			// the check told us this was a fatal error that cannot be
+			// recovered from.
+			return false, nil, err
+		case !ok:
+			// we did not complete this operation, but it can be retried.
+			return false, nil, nil
+		}
+	}
+
+	r.doDeletePolicyForwarding(e.GetIndex())
+
+	if r.postChangeHook != nil {
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
+	}
+
+	return true, de, nil
+}
+
+// retrievePolicyForwarding returns the policy-forwarding entry with the
+// specified index, holding a lock on the RIBHolder as it does so. It returns
+// nil if the entry does not exist.
+func (r *RIBHolder) retrievePolicyForwarding(index uint64) *aft.Afts_PolicyForwardingEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.r.GetAfts().PolicyForwardingEntry[index]
+}
+
+// doDeletePolicyForwarding deletes the policy-forwarding entry with the
+// specified index from the RIB, holding the shortest possible lock.
+func (r *RIBHolder) doDeletePolicyForwarding(index uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unshare(constants.PolicyForwarding)
+	delete(r.r.Afts.PolicyForwardingEntry, index)
+}
+
+// locklessDeletePolicyForwarding removes the policy-forwarding entry with the
+// specified index from the RIB, without holding the lock on the AFT. The calling
+// routine MUST ensure that it holds the lock to ensure thread-safe operation.
+func (r *RIBHolder) locklessDeletePolicyForwarding(index uint64) error {
+	r.unshare(constants.PolicyForwarding)
+	de := r.r.Afts.PolicyForwardingEntry[index]
+	if de == nil {
+		return fmt.Errorf("cannot find policy-forwarding entry %d", index)
+	}
+
+	delete(r.r.Afts.PolicyForwardingEntry, index)
+	if r.postChangeHook != nil {
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 	return nil
 }
@@ -1700,7 +2644,7 @@ func (r *RIBHolder) DeleteNextHopGroup(e *aftpb.Afts_NextHopGroupKey) (bool, *af
 	r.doDeleteNHG(e.GetId())
 
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 
 	return true, de, nil
@@ -1718,6 +2662,7 @@ func (r *RIBHolder) retrieveNHG(id uint64) *aft.Afts_NextHopGroup {
 // holding a lock on the RIB. The caller MUST hold the relevant lock. It returns
 // an error if the entry cannot be found.
 func (r *RIBHolder) locklessDeleteNHG(id uint64) error {
+	r.unshare(constants.NextHopGroup)
 	de := r.r.Afts.NextHopGroup[id]
 	if de == nil {
 		return fmt.Errorf("cannot find NHG %d", id)
@@ -1730,7 +2675,7 @@ func (r *RIBHolder) locklessDeleteNHG(id uint64) error {
 
 	delete(r.r.Afts.NextHopGroup, id)
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 	return nil
 }
@@ -1770,7 +2715,7 @@ func (r *RIBHolder) DeleteNextHop(e *aftpb.Afts_NextHopKey) (bool, *aft.Afts_Nex
 	r.doDeleteNH(e.GetIndex())
 
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 
 	return true, de, nil
@@ -1784,10 +2729,41 @@ func (r *RIBHolder) retrieveNH(index uint64) *aft.Afts_NextHop {
 	return r.r.Afts.NextHop[index]
 }
 
+// retrieveEntry returns the entry with key key within the AFT a, holding a lock
+// on the RIBHolder as it does so. It returns nil if the entry does not exist.
+func (r *RIBHolder) retrieveEntry(a constants.AFT, key any) ygot.GoStruct {
+	var e ygot.GoStruct
+	switch k := key.(type) {
+	case string:
+		switch a {
+		case constants.IPv4:
+			e = r.retrieveIPv4(k)
+		case constants.IPv6:
+			e = r.retrieveIPv6(k)
+		}
+	case uint64:
+		switch a {
+		case constants.MPLS:
+			e = r.retrieveMPLS(uint32(k))
+		case constants.NextHopGroup:
+			e = r.retrieveNHG(k)
+		case constants.NextHop:
+			e = r.retrieveNH(k)
+		case constants.PolicyForwarding:
+			e = r.retrievePolicyForwarding(k)
+		}
+	}
+	if e == nil || util.IsValueNil(e) {
+		return nil
+	}
+	return e
+}
+
 // locklessDeleteNH removes the next-hop with the specified index without
 // holding a lock on the RIB. The caller MUST hold the relevant lock. It returns
 // an error if the entry cannot be found.
 func (r *RIBHolder) locklessDeleteNH(index uint64) error {
+	r.unshare(constants.NextHop)
 	de := r.r.Afts.NextHop[index]
 	if de == nil {
 		return fmt.Errorf("cannot find NH %d", index)
@@ -1795,7 +2771,7 @@ func (r *RIBHolder) locklessDeleteNH(index uint64) error {
 
 	delete(r.r.Afts.NextHop, index)
 	if r.postChangeHook != nil {
-		r.postChangeHook(constants.Delete, unixTS(), r.name, de)
+		r.postChangeHook(constants.Delete, r.timestamp(), r.name, de)
 	}
 	return nil
 }
@@ -1805,6 +2781,7 @@ func (r *RIBHolder) locklessDeleteNH(index uint64) error {
 func (r *RIBHolder) doDeleteNHG(idx uint64) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.NextHopGroup)
 	delete(r.r.Afts.NextHopGroup, idx)
 }
 
@@ -1813,6 +2790,7 @@ func (r *RIBHolder) doDeleteNHG(idx uint64) {
 func (r *RIBHolder) doDeleteNH(id uint64) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.NextHop)
 	delete(r.r.Afts.NextHop, id)
 }
 
@@ -1866,7 +2844,7 @@ func (r *RIBHolder) AddNextHopGroup(e *aftpb.Afts_NextHopGroupKey, explicitRepla
 
 	if r.postChangeHook != nil {
 		for _, nhg := range nr.Afts.NextHopGroup {
-			r.postChangeHook(constants.Add, unixTS(), r.name, nhg)
+			r.postChangeHook(constants.Add, r.timestamp(), r.name, nhg)
 		}
 	}
 
@@ -1886,6 +2864,7 @@ func (r *RIBHolder) nhgExists(id uint64) bool {
 func (r *RIBHolder) doAddNHG(ID uint64, newRIB *aft.RIB) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.NextHopGroup)
 
 	// Sanity check.
 	if ip4, nh := len(newRIB.Afts.Ipv4Entry), len(newRIB.Afts.NextHop); ip4 != 0 || nh != 0 {
@@ -1922,11 +2901,28 @@ func (r *RIBHolder) decNHGRefCount(i uint64) {
 	r.refCounts.NextHopGroup[i]--
 }
 
+// moveNHGRefCount decrements the reference count for the next-hop-group from and
+// increments the reference count for the next-hop-group to whilst holding the
+// lock on the reference counts.
+func (r *RIBHolder) moveNHGRefCount(from, to uint64) {
+	r.refCounts.mu.Lock()
+	defer r.refCounts.mu.Unlock()
+	if r.refCounts.NextHopGroup[from] != 0 {
+		r.refCounts.NextHopGroup[from]--
+	}
+	r.refCounts.NextHopGroup[to]++
+}
+
 // nhgReferenced indicates whether the next-hop-group has a refCount > 0.
 func (r *RIBHolder) nhgReferenced(i uint64) bool {
+	return r.nhgRefCount(i) > 0
+}
+
+// nhgRefCount returns the number of references to the next-hop-group.
+func (r *RIBHolder) nhgRefCount(i uint64) int {
 	r.refCounts.mu.RLock()
 	defer r.refCounts.mu.RUnlock()
-	return r.refCounts.NextHopGroup[i] > 0
+	return int(r.refCounts.NextHopGroup[i])
 }
 
 // AddNextHop adds a new NextHop e to the RIBHolder receiver. If the explicitReplace
@@ -1979,7 +2975,7 @@ func (r *RIBHolder) AddNextHop(e *aftpb.Afts_NextHopKey, explicitReplace bool) (
 
 	if r.postChangeHook != nil {
 		for _, nh := range nr.Afts.NextHop {
-			r.postChangeHook(constants.Add, unixTS(), r.name, nh)
+			r.postChangeHook(constants.Add, r.timestamp(), r.name, nh)
 		}
 	}
 
@@ -2000,6 +2996,7 @@ func (r *RIBHolder) nhExists(index uint64) bool {
 func (r *RIBHolder) doAddNH(index uint64, newRIB *aft.RIB) (bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.unshare(constants.NextHop)
 
 	// Sanity check.
 	if ip4, nhg := len(newRIB.Afts.Ipv4Entry), len(newRIB.Afts.NextHopGroup); ip4 != 0 || nhg != 0 {
@@ -2036,11 +3033,16 @@ func (r *RIBHolder) decNHRefCount(i uint64) {
 	r.refCounts.NextHop[i]--
 }
 
-// nhReferenced indicates whether the next-hop-group has a refCount > 0.
+// nhReferenced indicates whether the next-hop has a refCount > 0.
 func (r *RIBHolder) nhReferenced(i uint64) bool {
+	return r.nhRefCount(i) > 0
+}
+
+// nhRefCount returns the number of references to the next-hop.
+func (r *RIBHolder) nhRefCount(i uint64) int {
 	r.refCounts.mu.RLock()
 	defer r.refCounts.mu.RUnlock()
-	return r.refCounts.NextHop[i] > 0
+	return int(r.refCounts.NextHop[i])
 }
 
 // ConcreteIPv4Proto takes the input Ipv4Entry GoStruct and returns it as a gRIBI
@@ -2114,6 +3116,47 @@ func ConcreteMPLSProto(e *aft.Afts_LabelEntry) (*aftpb.Afts_LabelEntryKey, error
 	}, nil
 }
 
+// ConcretePolicyForwardingProto takes the input PolicyForwardingEntry GoStruct
+// and returns it as a gRIBI PolicyForwardingEntryKey protobuf. It returns an
+// error if the protobuf cannot be marshalled.
+func ConcretePolicyForwardingProto(e *aft.Afts_PolicyForwardingEntry) (*aftpb.Afts_PolicyForwardingEntryKey, error) {
+	pbrProto := &aftpb.Afts_PolicyForwardingEntry{}
+	if err := protoFromGoStruct(e, &gpb.Path{
+		Elem: []*gpb.PathElem{{
+			Name: "afts",
+		}, {
+			Name: "policy-forwarding",
+		}, {
+			Name: "policy-forwarding-entry",
+		}},
+	}, pbrProto); err != nil {
+		return nil, fmt.Errorf("cannot marshal policy-forwarding entry %d, %v", e.GetIndex(), err)
+	}
+
+	// The union fields of the entry are represented as oneofs in the protobuf,
+	// which are not populated from the GoStruct, so are mapped explicitly.
+	switch v := e.GetIpProtocol().(type) {
+	case nil:
+	case aft.UnionUint8:
+		pbrProto.IpProtocol = &aftpb.Afts_PolicyForwardingEntry_IpProtocolUint64{IpProtocolUint64: uint64(v)}
+	default:
+		return nil, fmt.Errorf("cannot marshal policy-forwarding entry %d, unsupported IP protocol type %T", e.GetIndex(), v)
+	}
+
+	switch v := e.GetMplsLabel().(type) {
+	case nil:
+	case aft.UnionUint32:
+		pbrProto.MplsLabel = &aftpb.Afts_PolicyForwardingEntry_MplsLabelUint64{MplsLabelUint64: uint64(v)}
+	default:
+		return nil, fmt.Errorf("cannot marshal policy-forwarding entry %d, unsupported MPLS label type %T", e.GetIndex(), v)
+	}
+
+	return &aftpb.Afts_PolicyForwardingEntryKey{
+		Index:                 e.GetIndex(),
+		PolicyForwardingEntry: pbrProto,
+	}, nil
+}
+
 // ConcreteNextHopProto takes the input NextHop GoStruct and returns it as a gRIBI
 // NextHopEntryKey protobuf. It returns an error if the protobuf cannot be marshalled.
 func ConcreteNextHopProto(e *aft.Afts_NextHop) (*aftpb.Afts_NextHopKey, error) {
@@ -2193,37 +3236,40 @@ func protoFromGoStruct(s ygot.ValidatedGoStruct, prefix *gpb.Path, pb proto.Mess
 //
 // An error is returned if the RIB cannot be returned.
 func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetResponse, stopCh chan struct{}) error {
-	// TODO(robjs): since we are wanting to ensure that we tell the client
-	// exactly what is installed, this leads to a decision to make about locking
-	// of the RIB -- either we can go and lock the entire network instance RIB,
-	// or be more granular than that.
-	//
-	//  * we take the NI-level lock: in the incoming master case, the client can
-	//    ensure that they wait for the Get to complete before writing ==> there
-	//    is no convergence impact. In the multi-master case (or even a consistency)
-	//    check case, we impact convergence.
-	//  * we take a more granular lock, in this case we do not impact convergence
-	//    for any other entity than that individual entry.
-	//
-	// The latter is a better choice for a high-performance implementation, but
-	// its not clear that we need to worry about this for this implementation *yet*.
-	// In the future we should consider a fine-grained per-entry lock.
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	// The entries are read from a snapshot of the RIB such that the RIB is not
+	// locked whilst they are written to msgCh, which may block for a long time
+	// for large RIBs, whilst ensuring that they reflect a single point in time.
+	r.mu.Lock()
+	snap := r.snapshot()
+	r.mu.Unlock()
+	defer snap.release()
+
+	return getRIB(r.name, snap.afts, filter, nil, msgCh, stopCh)
+}
+
+// getRIB writes the entries within afts, which are the AFTs of the network instance
+// name, to msgCh as per GetRIB. Entries for which skip, if it is non-nil, returns
+// true are not written. The maps of entries within afts must not be modified
+// whilst getRIB is running.
+func getRIB(name string, afts *aft.Afts, filter map[spb.AFTType]bool, skip func(constants.AFT, any) bool, msgCh chan *spb.GetResponse, stopCh chan struct{}) error {
 
 	// rewrite ALL to the values that we support.
 	if filter[spb.AFTType_ALL] {
 		filter = map[spb.AFTType]bool{
-			spb.AFTType_IPV4:          true,
-			spb.AFTType_MPLS:          true,
-			spb.AFTType_NEXTHOP:       true,
-			spb.AFTType_NEXTHOP_GROUP: true,
-			spb.AFTType_IPV6:          true,
+			spb.AFTType_IPV4:              true,
+			spb.AFTType_MPLS:              true,
+			spb.AFTType_NEXTHOP:           true,
+			spb.AFTType_NEXTHOP_GROUP:     true,
+			spb.AFTType_IPV6:              true,
+			spb.AFTType_POLICY_FORWARDING: true,
 		}
 	}
 
 	if filter[spb.AFTType_IPV4] {
-		for pfx, e := range r.r.Afts.Ipv4Entry {
+		for pfx, e := range afts.Ipv4Entry {
+			if skip != nil && skip(constants.IPv4, pfx) {
+				continue
+			}
 			select {
 			case <-stopCh:
 				return nil
@@ -2234,7 +3280,7 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 				}
 				msgCh <- &spb.GetResponse{
 					Entry: []*spb.AFTEntry{{
-						NetworkInstance: r.name,
+						NetworkInstance: name,
 						Entry: &spb.AFTEntry_Ipv4{
 							Ipv4: p,
 						},
@@ -2245,7 +3291,10 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 	}
 
 	if filter[spb.AFTType_IPV6] {
-		for pfx, e := range r.r.Afts.Ipv6Entry {
+		for pfx, e := range afts.Ipv6Entry {
+			if skip != nil && skip(constants.IPv6, pfx) {
+				continue
+			}
 			select {
 			case <-stopCh:
 				return nil
@@ -2256,7 +3305,7 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 				}
 				msgCh <- &spb.GetResponse{
 					Entry: []*spb.AFTEntry{{
-						NetworkInstance: r.name,
+						NetworkInstance: name,
 						Entry: &spb.AFTEntry_Ipv6{
 							Ipv6: p,
 						},
@@ -2267,7 +3316,10 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 	}
 
 	if filter[spb.AFTType_MPLS] {
-		for lbl, e := range r.r.Afts.LabelEntry {
+		for lbl, e := range afts.LabelEntry {
+			if skip != nil && skip(constants.MPLS, lbl) {
+				continue
+			}
 			select {
 			case <-stopCh:
 				return nil
@@ -2278,7 +3330,7 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 				}
 				msgCh <- &spb.GetResponse{
 					Entry: []*spb.AFTEntry{{
-						NetworkInstance: r.name,
+						NetworkInstance: name,
 						Entry: &spb.AFTEntry_Mpls{
 							Mpls: p,
 						},
@@ -2288,8 +3340,36 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 		}
 	}
 
+	if filter[spb.AFTType_POLICY_FORWARDING] {
+		for index, e := range afts.PolicyForwardingEntry {
+			if skip != nil && skip(constants.PolicyForwarding, index) {
+				continue
+			}
+			select {
+			case <-stopCh:
+				return nil
+			default:
+				p, err := ConcretePolicyForwardingProto(e)
+				if err != nil {
+					return status.Errorf(codes.Internal, "cannot marshal PolicyForwardingEntry for index %d into GetResponse, %v", index, err)
+				}
+				msgCh <- &spb.GetResponse{
+					Entry: []*spb.AFTEntry{{
+						NetworkInstance: name,
+						Entry: &spb.AFTEntry_PolicyForwardingEntry{
+							PolicyForwardingEntry: p,
+						},
+					}},
+				}
+			}
+		}
+	}
+
 	if filter[spb.AFTType_NEXTHOP_GROUP] {
-		for index, e := range r.r.Afts.NextHopGroup {
+		for index, e := range afts.NextHopGroup {
+			if skip != nil && skip(constants.NextHopGroup, index) {
+				continue
+			}
 			select {
 			case <-stopCh:
 				return nil
@@ -2300,7 +3380,7 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 				}
 				msgCh <- &spb.GetResponse{
 					Entry: []*spb.AFTEntry{{
-						NetworkInstance: r.name,
+						NetworkInstance: name,
 						Entry: &spb.AFTEntry_NextHopGroup{
 							NextHopGroup: p,
 						},
@@ -2311,7 +3391,10 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 	}
 
 	if filter[spb.AFTType_NEXTHOP] {
-		for id, e := range r.r.Afts.NextHop {
+		for id, e := range afts.NextHop {
+			if skip != nil && skip(constants.NextHop, id) {
+				continue
+			}
 			select {
 			case <-stopCh:
 				return nil
@@ -2322,7 +3405,7 @@ func (r *RIBHolder) GetRIB(filter map[spb.AFTType]bool, msgCh chan *spb.GetRespo
 				}
 				msgCh <- &spb.GetResponse{
 					Entry: []*spb.AFTEntry{{
-						NetworkInstance: r.name,
+						NetworkInstance: name,
 						Entry: &spb.AFTEntry_NextHop{
 							NextHop: p,
 						},
@@ -2360,11 +3443,29 @@ func (f *FlushErr) Error() string {
 //   - we remove the remaining NHGs.
 //   - we remove the NHs.
 //
-// Flush handles updating the reference counts within the RIB.
+// Flush handles updating the reference counts within the RIB. Any operations
+// that are pending resolution within the flushed network instances are removed,
+// as are any entries outside of the flushed network instances that were derived
+// from the removed entries.
 func (r *RIB) Flush(networkInstances []string) error {
+	if err := r.flush(networkInstances); err != nil {
+		return err
+	}
+	r.flushResolvability(networkInstances)
+	return r.flushDerived(networkInstances)
+}
+
+// flush removes all entries from the network instances networkInstances. It is
+// the internal implementation of Flush, and holds the lock on each network
+// instance RIB until it returns.
+func (r *RIB) flush(networkInstances []string) error {
 	errs := []error{}
 
 	for _, netInst := range networkInstances {
+		r.flushPending(netInst)
+		r.forgetResolution(netInst)
+		r.flushEntryMetadata(netInst)
+
 		niR, ok := r.NetworkInstanceRIB(netInst)
 		if !ok {
 			log.Errorf("cannot find network instance RIB for %s", netInst)
@@ -2386,7 +3487,9 @@ func (r *RIB) Flush(networkInstances []string) error {
 			}
 			if err := niR.locklessDeleteIPv4(p); err != nil {
 				errs = append(errs, err)
+				continue
 			}
+			r.recordJournal(JournalFlush, netInst, "", constants.IPv4, p, nil, entry, nil)
 		}
 
 		for p, entry := range niR.r.Afts.Ipv6Entry {
@@ -2399,7 +3502,9 @@ func (r *RIB) Flush(networkInstances []string) error {
 			}
 			if err := niR.locklessDeleteIPv6(p); err != nil {
 				errs = append(errs, err)
+				continue
 			}
+			r.recordJournal(JournalFlush, netInst, "", constants.IPv6, p, nil, entry, nil)
 		}
 
 		for label, entry := range niR.r.Afts.LabelEntry {
@@ -2412,7 +3517,24 @@ func (r *RIB) Flush(networkInstances []string) error {
 			}
 			if err := niR.locklessDeleteMPLS(label); err != nil {
 				errs = append(errs, err)
+				continue
+			}
+			r.recordJournal(JournalFlush, netInst, "", constants.MPLS, label, nil, entry, nil)
+		}
+
+		for index, entry := range niR.r.Afts.PolicyForwardingEntry {
+			referencedRIB, err := r.refdRIB(niR, entry.GetNextHopGroupNetworkInstance())
+			switch {
+			case err != nil:
+				log.Errorf("cannot find network instance RIB %s during Flush for policy-forwarding entry %d", entry.GetNextHopGroupNetworkInstance(), index)
+			default:
+				referencedRIB.decNHGRefCount(entry.GetNextHopGroup())
+			}
+			if err := niR.locklessDeletePolicyForwarding(index); err != nil {
+				errs = append(errs, err)
+				continue
 			}
+			r.recordJournal(JournalFlush, netInst, "", constants.PolicyForwarding, index, nil, entry, nil)
 		}
 
 		backupNHGs := []uint64{}
@@ -2423,9 +3545,12 @@ func (r *RIB) Flush(networkInstances []string) error {
 		}
 
 		delNHG := func(id uint64) {
+			entry := niR.r.Afts.NextHopGroup[id]
 			if err := niR.locklessDeleteNHG(id); err != nil {
 				errs = append(errs, err)
+				return
 			}
+			r.recordJournal(JournalFlush, netInst, "", constants.NextHopGroup, id, nil, entry, nil)
 		}
 
 		for _, id := range backupNHGs {
@@ -2436,10 +3561,12 @@ func (r *RIB) Flush(networkInstances []string) error {
 			delNHG(n)
 		}
 
-		for n := range niR.r.Afts.NextHop {
+		for n, entry := range niR.r.Afts.NextHop {
 			if err := niR.locklessDeleteNH(n); err != nil {
 				errs = append(errs, err)
+				continue
 			}
+			r.recordJournal(JournalFlush, netInst, "", constants.NextHop, n, nil, entry, nil)
 		}
 
 	}
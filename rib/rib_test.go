@@ -1801,7 +1801,7 @@ func TestCanResolve(t *testing.T) {
 		wantErrSubstring: "ethernet MAC entries are unsupported",
 	}, {
 
-		desc:  "PBR - invalid",
+		desc:  "PBR - invalid zero NHG",
 		inRIB: New(defName),
 		inNI:  defName,
 		inCand: func() *aft.RIB {
@@ -1809,7 +1809,17 @@ func TestCanResolve(t *testing.T) {
 			r.GetOrCreateAfts().GetOrCreatePolicyForwardingEntry(42)
 			return r
 		}(),
-		wantErrSubstring: "PBR entries are unsupported",
+		wantErrSubstring: "invalid zero index NHG in PolicyForwardingEntry",
+	}, {
+		desc:  "PBR - unresolvable NHG",
+		inRIB: New(defName),
+		inNI:  defName,
+		inCand: func() *aft.RIB {
+			r := &aft.RIB{}
+			r.GetOrCreateAfts().GetOrCreatePolicyForwardingEntry(42).NextHopGroup = ygot.Uint64(1)
+			return r
+		}(),
+		want: false,
 	}, {
 		desc:  "empty candidate - invalid",
 		inRIB: New(defName),
@@ -1829,6 +1839,34 @@ func TestCanResolve(t *testing.T) {
 			return r
 		}(),
 		wantErrSubstring: "multiple entries are unsupported",
+	}, {
+		desc: "next-hop in known network-instance can be resolved",
+		inRIB: func() *RIB {
+			r := New(defName)
+			if err := r.AddNetworkInstance("VRF-A"); err != nil {
+				t.Fatalf("cannot add NI, %v", err)
+			}
+			return r
+		}(),
+		inNI: defName,
+		inCand: func() *aft.RIB {
+			r := &aft.RIB{}
+			n := r.GetOrCreateAfts().GetOrCreateNextHop(1)
+			n.NetworkInstance = ygot.String("VRF-A")
+			return r
+		}(),
+		want: true,
+	}, {
+		desc:  "next-hop in unknown network-instance",
+		inRIB: New(defName),
+		inNI:  defName,
+		inCand: func() *aft.RIB {
+			r := &aft.RIB{}
+			n := r.GetOrCreateAfts().GetOrCreateNextHop(1)
+			n.NetworkInstance = ygot.String("FISH")
+			return r
+		}(),
+		wantErrSubstring: "invalid unknown network-instance FISH",
 	}, {
 		desc:  "next-hop can be successfully resolved",
 		inRIB: New(defName),
@@ -2254,7 +2292,7 @@ func TestRIBAddEntry(t *testing.T) {
 		desc: "nh makes nhg resolvable",
 		inRIB: func() *RIB {
 			r := New(defName)
-			r.pendingEntries[1] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 1}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 1,
@@ -2332,7 +2370,7 @@ func TestRIBAddEntry(t *testing.T) {
 		desc: "nh does not make nhg resolvable",
 		inRIB: func() *RIB {
 			r := New(defName)
-			r.pendingEntries[1] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 1}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 1,
@@ -2381,7 +2419,7 @@ func TestRIBAddEntry(t *testing.T) {
 		inRIB: func() *RIB {
 			r := New(defName)
 			// op#1: NHG ID 1 pending on NH index = 1 showing up
-			r.pendingEntries[1] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 1}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 1,
@@ -2400,7 +2438,7 @@ func TestRIBAddEntry(t *testing.T) {
 			}
 
 			// op#2: IPv4 prefix 42.42.42.42/32 pending on NNG index 1 showing up (q'd above)
-			r.pendingEntries[2] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 2}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 2,
@@ -2860,7 +2898,7 @@ func TestRIBAddEntry(t *testing.T) {
 		inRIB: func() *RIB {
 			r := New(defName)
 			// op#1: NHG ID 1 pending on NH index = 1 showing up
-			r.pendingEntries[1] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 1}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 1,
@@ -2879,7 +2917,7 @@ func TestRIBAddEntry(t *testing.T) {
 			}
 
 			// op#2: MPLS entry pending on NNG index 1 showing up (q'd above)
-			r.pendingEntries[2] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 2}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 2,
@@ -2956,7 +2994,7 @@ func TestRIBAddEntry(t *testing.T) {
 		inRIB: func() *RIB {
 			r := New(defName)
 			// op#1: NHG ID 1 pending on NH index = 1 showing up
-			r.pendingEntries[1] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 1}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 1,
@@ -2975,7 +3013,7 @@ func TestRIBAddEntry(t *testing.T) {
 			}
 
 			// op#2: IPv6 entry pending on NNG index 1 showing up (q'd above)
-			r.pendingEntries[2] = &pendingEntry{
+			r.pendingEntries[pendingID{id: 2}] = &pendingEntry{
 				ni: defName,
 				op: &spb.AFTOperation{
 					Id: 2,
@@ -3425,7 +3463,7 @@ func TestDeleteEntry(t *testing.T) {
 					NextHopGroup: &aftpb.Afts_NextHopGroupKey{},
 				},
 			},
-			Error: "invalid NHG ID 0",
+			Error: "invalid next-hop-group ID 0, zero is reserved",
 		}},
 	}, {
 		desc:              "NHG that doesn't exist",
@@ -5535,3 +5573,945 @@ func TestRIBContents(t *testing.T) {
 	}
 
 }
+
+// getRIBEntries returns the entries that are returned by the GetRIB method of r
+// when called with the specified filter.
+func getRIBEntries(t *testing.T, r *RIBHolder, filter map[spb.AFTType]bool) []*spb.AFTEntry {
+	t.Helper()
+	msgCh := make(chan *spb.GetResponse)
+	errCh := make(chan error)
+	go func() {
+		errCh <- r.GetRIB(filter, msgCh, make(chan struct{}))
+	}()
+
+	got := []*spb.AFTEntry{}
+	for {
+		select {
+		case m := <-msgCh:
+			got = append(got, m.GetEntry()...)
+		case err := <-errCh:
+			if err != nil {
+				t.Fatalf("cannot retrieve RIB, %v", err)
+			}
+			return got
+		}
+	}
+}
+
+func TestMultipleAFTsInNetworkInstance(t *testing.T) {
+	const vrfName = "VRF-A"
+
+	nhgRef := func(ni string) *aftpb.Afts_Ipv4Entry {
+		e := &aftpb.Afts_Ipv4Entry{NextHopGroup: &wpb.UintValue{Value: 1}}
+		if ni != "" {
+			e.NextHopGroupNetworkInstance = &wpb.StringValue{Value: ni}
+		}
+		return e
+	}
+
+	nhEntry := &spb.AFTEntry{
+		NetworkInstance: defName,
+		Entry: &spb.AFTEntry_NextHop{
+			NextHop: &aftpb.Afts_NextHopKey{
+				Index: 1,
+				NextHop: &aftpb.Afts_NextHop{
+					IpAddress: &wpb.StringValue{Value: "192.0.2.1"},
+				},
+			},
+		},
+	}
+	nhgEntry := &spb.AFTEntry{
+		NetworkInstance: defName,
+		Entry: &spb.AFTEntry_NextHopGroup{
+			NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+				Id: 1,
+				NextHopGroup: &aftpb.Afts_NextHopGroup{
+					NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+						Index: 1,
+						NextHop: &aftpb.Afts_NextHopGroup_NextHop{
+							Weight: &wpb.UintValue{Value: 1},
+						},
+					}},
+				},
+			},
+		},
+	}
+	ipv4Entry := &spb.AFTEntry{
+		NetworkInstance: defName,
+		Entry: &spb.AFTEntry_Ipv4{
+			Ipv4: &aftpb.Afts_Ipv4EntryKey{
+				Prefix:    "192.0.2.0/24",
+				Ipv4Entry: nhgRef(""),
+			},
+		},
+	}
+	ipv6Entry := &spb.AFTEntry{
+		NetworkInstance: defName,
+		Entry: &spb.AFTEntry_Ipv6{
+			Ipv6: &aftpb.Afts_Ipv6EntryKey{
+				Prefix: "2001:db8::/32",
+				Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+					NextHopGroup: &wpb.UintValue{Value: 1},
+				},
+			},
+		},
+	}
+	mplsEntry := &spb.AFTEntry{
+		NetworkInstance: defName,
+		Entry: &spb.AFTEntry_Mpls{
+			Mpls: &aftpb.Afts_LabelEntryKey{
+				Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
+					LabelUint64: 42,
+				},
+				LabelEntry: &aftpb.Afts_LabelEntry{
+					NextHopGroup: &wpb.UintValue{Value: 1},
+				},
+			},
+		},
+	}
+	vrfIPv4Entry := &spb.AFTEntry{
+		NetworkInstance: vrfName,
+		Entry: &spb.AFTEntry_Ipv4{
+			Ipv4: &aftpb.Afts_Ipv4EntryKey{
+				Prefix:    "192.0.2.0/24",
+				Ipv4Entry: nhgRef(defName),
+			},
+		},
+	}
+
+	// toOp converts the AFTEntry e to an AFTOperation with the specified ID.
+	toOp := func(id uint64, e *spb.AFTEntry) *spb.AFTOperation {
+		op := &spb.AFTOperation{Id: id, NetworkInstance: e.GetNetworkInstance()}
+		switch v := e.GetEntry().(type) {
+		case *spb.AFTEntry_NextHop:
+			op.Entry = &spb.AFTOperation_NextHop{NextHop: v.NextHop}
+		case *spb.AFTEntry_NextHopGroup:
+			op.Entry = &spb.AFTOperation_NextHopGroup{NextHopGroup: v.NextHopGroup}
+		case *spb.AFTEntry_Ipv4:
+			op.Entry = &spb.AFTOperation_Ipv4{Ipv4: v.Ipv4}
+		case *spb.AFTEntry_Ipv6:
+			op.Entry = &spb.AFTOperation_Ipv6{Ipv6: v.Ipv6}
+		case *spb.AFTEntry_Mpls:
+			op.Entry = &spb.AFTOperation_Mpls{Mpls: v.Mpls}
+		default:
+			t.Fatalf("unhandled entry type %T", v)
+		}
+		return op
+	}
+
+	r := New(defName)
+	if err := r.AddNetworkInstance(vrfName); err != nil {
+		t.Fatalf("cannot add network instance %s, %v", vrfName, err)
+	}
+
+	for i, e := range []*spb.AFTEntry{nhEntry, nhgEntry, ipv4Entry, ipv6Entry, mplsEntry, vrfIPv4Entry} {
+		_, fails, err := r.AddEntry(e.GetNetworkInstance(), toOp(uint64(i+1), e))
+		if err != nil || len(fails) != 0 {
+			t.Fatalf("cannot add entry %s, fails: %v, err: %v", e, fails, err)
+		}
+	}
+
+	sortEntries := cmpopts.SortSlices(func(a, b *spb.AFTEntry) bool { return prototext.Format(a) < prototext.Format(b) })
+
+	defRIB, ok := r.NetworkInstanceRIB(defName)
+	if !ok {
+		t.Fatalf("cannot find network instance %s", defName)
+	}
+	vrfRIB, ok := r.NetworkInstanceRIB(vrfName)
+	if !ok {
+		t.Fatalf("cannot find network instance %s", vrfName)
+	}
+
+	filterTests := []struct {
+		desc     string
+		inRIB    *RIBHolder
+		inFilter map[spb.AFTType]bool
+		want     []*spb.AFTEntry
+	}{{
+		desc:     "all AFTs in default",
+		inRIB:    defRIB,
+		inFilter: map[spb.AFTType]bool{spb.AFTType_ALL: true},
+		want:     []*spb.AFTEntry{nhEntry, nhgEntry, ipv4Entry, ipv6Entry, mplsEntry},
+	}, {
+		desc:     "ipv4 in default",
+		inRIB:    defRIB,
+		inFilter: map[spb.AFTType]bool{spb.AFTType_IPV4: true},
+		want:     []*spb.AFTEntry{ipv4Entry},
+	}, {
+		desc:     "ipv6 in default",
+		inRIB:    defRIB,
+		inFilter: map[spb.AFTType]bool{spb.AFTType_IPV6: true},
+		want:     []*spb.AFTEntry{ipv6Entry},
+	}, {
+		desc:     "mpls in default",
+		inRIB:    defRIB,
+		inFilter: map[spb.AFTType]bool{spb.AFTType_MPLS: true},
+		want:     []*spb.AFTEntry{mplsEntry},
+	}, {
+		desc:     "all AFTs in VRF",
+		inRIB:    vrfRIB,
+		inFilter: map[spb.AFTType]bool{spb.AFTType_ALL: true},
+		want:     []*spb.AFTEntry{vrfIPv4Entry},
+	}, {
+		desc:     "ipv6 and mpls in VRF",
+		inRIB:    vrfRIB,
+		inFilter: map[spb.AFTType]bool{spb.AFTType_IPV6: true, spb.AFTType_MPLS: true},
+		want:     []*spb.AFTEntry{},
+	}}
+
+	for _, tt := range filterTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if diff := cmp.Diff(getRIBEntries(t, tt.inRIB, tt.inFilter), tt.want, protocmp.Transform(), sortEntries); diff != "" {
+				t.Fatalf("did not get expected entries, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+
+	wantCounts := map[*RIBHolder]map[constants.AFT]uint64{
+		defRIB: {constants.IPv4: 1, constants.IPv6: 1, constants.MPLS: 1, constants.NextHopGroup: 1, constants.NextHop: 1, constants.PolicyForwarding: 0},
+		vrfRIB: {constants.IPv4: 1, constants.IPv6: 0, constants.MPLS: 0, constants.NextHopGroup: 0, constants.NextHop: 0, constants.PolicyForwarding: 0},
+	}
+	for h, want := range wantCounts {
+		if diff := cmp.Diff(h.EntryCounts(), want); diff != "" {
+			t.Errorf("NI %s: did not get expected entry counts, diff(-got,+want):\n%s", h.name, diff)
+		}
+	}
+
+	// The NHG is referenced by each of the IPv4, IPv6 and MPLS entries, deleting the
+	// IPv6 entry must not remove the entries in any other AFT.
+	if _, fails, err := r.DeleteEntry(defName, toOp(7, ipv6Entry)); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot delete IPv6 entry, fails: %v, err: %v", fails, err)
+	}
+	if diff := cmp.Diff(getRIBEntries(t, defRIB, map[spb.AFTType]bool{spb.AFTType_ALL: true}), []*spb.AFTEntry{nhEntry, nhgEntry, ipv4Entry, mplsEntry}, protocmp.Transform(), sortEntries); diff != "" {
+		t.Fatalf("did not get expected entries after IPv6 delete, diff(-got,+want):\n%s", diff)
+	}
+	if !defRIB.nhgReferenced(1) {
+		t.Fatalf("NHG 1 is not referenced after IPv6 delete, want referenced by IPv4 and MPLS entries")
+	}
+
+	if err := r.Flush([]string{defName, vrfName}); err != nil {
+		t.Fatalf("cannot flush RIB, %v", err)
+	}
+	for _, h := range []*RIBHolder{defRIB, vrfRIB} {
+		if got := getRIBEntries(t, h, map[spb.AFTType]bool{spb.AFTType_ALL: true}); len(got) != 0 {
+			t.Fatalf("NI %s: did not get empty RIB after flush, got: %v", h.name, got)
+		}
+	}
+}
+
+func TestPendingEntries(t *testing.T) {
+	ipv4Op := func(id uint64, prefix string) *spb.AFTOperation {
+		return &spb.AFTOperation{
+			Id: id,
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: prefix,
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup: &wpb.UintValue{Value: 42},
+					},
+				},
+			},
+		}
+	}
+
+	r := New(defName, WithPendingLimit(2))
+	for _, op := range []*spb.AFTOperation{ipv4Op(1, "192.0.2.0/24"), ipv4Op(2, "198.51.100.0/24")} {
+		oks, fails, err := r.AddEntry(defName, op)
+		if err != nil || len(oks) != 0 || len(fails) != 0 {
+			t.Fatalf("AddEntry(%d): did not get expected pending result, oks: %v, fails: %v, err: %v", op.GetId(), oks, fails, err)
+		}
+	}
+
+	// Re-adding an already pending operation does not count against the limit.
+	if _, fails, err := r.AddEntry(defName, ipv4Op(2, "198.51.100.0/24")); err != nil || len(fails) != 0 {
+		t.Fatalf("AddEntry(2): got unexpected failure re-adding pending operation, fails: %v, err: %v", fails, err)
+	}
+
+	_, fails, err := r.AddEntry(defName, ipv4Op(3, "203.0.113.0/24"))
+	if err != nil {
+		t.Fatalf("AddEntry(3): got unexpected error, %v", err)
+	}
+	if len(fails) != 1 || fails[0].ID != 3 {
+		t.Fatalf("AddEntry(3): did not get expected failure when pending limit reached, got: %v", fails)
+	}
+
+	if got, want := r.UnresolvedReferences(defName, ipv4Op(1, "192.0.2.0/24")), []string{"next-hop-group 42 in network-instance DEFAULT"}; !cmp.Equal(got, want) {
+		t.Fatalf("UnresolvedReferences: did not get expected references, got: %v, want: %v", got, want)
+	}
+
+	nhgOp := &spb.AFTOperation{
+		Id: 4,
+		Entry: &spb.AFTOperation_NextHopGroup{
+			NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+				Id: 42,
+				NextHopGroup: &aftpb.Afts_NextHopGroup{
+					NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{Index: 1}, {Index: 2}},
+				},
+			},
+		},
+	}
+	if got, want := r.UnresolvedReferences("", nhgOp), []string{"next-hop 1 in network-instance DEFAULT", "next-hop 2 in network-instance DEFAULT"}; !cmp.Equal(got, want) {
+		t.Fatalf("UnresolvedReferences: did not get expected references for NHG, got: %v, want: %v", got, want)
+	}
+
+	if !r.RemovePending(1) || r.IsPending(1) {
+		t.Fatalf("RemovePending(1): did not remove pending operation")
+	}
+	if r.RemovePending(1) {
+		t.Fatalf("RemovePending(1): got true removing operation that is not pending")
+	}
+
+	// Operation IDs are only unique within a session, such that the same ID can
+	// be pending for more than one session.
+	if _, _, err := r.AddEntryForSession(defName, "session-a", ipv4Op(2, "198.51.100.0/24")); err != nil {
+		t.Fatalf("AddEntryForSession(2): got unexpected error, %v", err)
+	}
+	if !r.IsPendingForSession("session-a", 2) || !r.IsPending(2) {
+		t.Fatalf("AddEntryForSession(2): operation is not pending for both sessions")
+	}
+	if !r.RemovePendingForSession("session-a", 2) || !r.IsPending(2) {
+		t.Fatalf("RemovePendingForSession(2): did not remove only the operation of session-a")
+	}
+
+	if err := r.Flush([]string{defName}); err != nil {
+		t.Fatalf("Flush: got unexpected error, %v", err)
+	}
+	if r.IsPending(2) {
+		t.Fatalf("Flush: operation 2 is still pending after flush")
+	}
+}
+
+func TestOperationNetworkInstance(t *testing.T) {
+	r := New(defName)
+	if err := r.AddNetworkInstance("VRF-A"); err != nil {
+		t.Fatalf("cannot add network instance, %v", err)
+	}
+
+	// An operation without a network instance applies to the default.
+	if _, fails, err := r.AddEntry("", nhOp(1, "192.0.2.1", "")); err != nil || len(fails) != 0 {
+		t.Fatalf("AddEntry(\"\"): got unexpected failure, fails: %v, err: %v", fails, err)
+	}
+	if _, ok := r.niRIB[defName].GetNextHop(1); !ok {
+		t.Fatalf("AddEntry(\"\"): next-hop was not added to default network instance")
+	}
+	if _, ok := r.niRIB["VRF-A"].GetNextHop(1); ok {
+		t.Fatalf("AddEntry(\"\"): next-hop was added to non-default network instance")
+	}
+
+	del := &spb.AFTOperation{
+		Id:    2,
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: 1}},
+	}
+	if _, fails, err := r.DeleteEntry("", del); err != nil || len(fails) != 0 {
+		t.Fatalf("DeleteEntry(\"\"): got unexpected failure, fails: %v, err: %v", fails, err)
+	}
+	if _, ok := r.niRIB[defName].GetNextHop(1); ok {
+		t.Fatalf("DeleteEntry(\"\"): next-hop was not removed from default network instance")
+	}
+
+	// Network instances are not created implicitly.
+	wantErr := "unknown network instance VRF-B"
+	if _, _, err := r.AddEntry("VRF-B", nhOp(3, "192.0.2.1", "")); errdiff.Substring(err, wantErr) != "" {
+		t.Errorf("AddEntry(VRF-B): did not get expected error, %s", errdiff.Substring(err, wantErr))
+	}
+	if _, _, err := r.DeleteEntry("VRF-B", del); errdiff.Substring(err, wantErr) != "" {
+		t.Errorf("DeleteEntry(VRF-B): did not get expected error, %s", errdiff.Substring(err, wantErr))
+	}
+	if _, ok := r.NetworkInstanceRIB("VRF-B"); ok {
+		t.Errorf("network instance VRF-B was created by an operation")
+	}
+}
+
+func TestReferenceCounts(t *testing.T) {
+	r := New(defName)
+
+	type counts struct {
+		NHG map[uint64]int
+		NH  map[uint64]int
+	}
+	check := func(t *testing.T, want counts, wantResolved []string) {
+		t.Helper()
+		got := counts{NHG: map[uint64]int{}, NH: map[uint64]int{}}
+		for id := range want.NHG {
+			n, err := r.NHGReferences(defName, id)
+			if err != nil {
+				t.Fatalf("NHGReferences(%d): got unexpected error, %v", id, err)
+			}
+			got.NHG[id] = n
+		}
+		for idx := range want.NH {
+			n, err := r.NHReferences("", idx)
+			if err != nil {
+				t.Fatalf("NHReferences(%d): got unexpected error, %v", idx, err)
+			}
+			got.NH[idx] = n
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Fatalf("did not get expected reference counts, diff(-got,+want):\n%s", diff)
+		}
+		resolved, err := r.ResolvedEntries(defName)
+		if err != nil {
+			t.Fatalf("ResolvedEntries(): got unexpected error, %v", err)
+		}
+		if diff := cmp.Diff(resolved, wantResolved); diff != "" {
+			t.Fatalf("ResolvedEntries(): did not get expected entries, diff(-got,+want):\n%s", diff)
+		}
+	}
+	apply := func(t *testing.T, ops ...*spb.AFTOperation) {
+		t.Helper()
+		for _, op := range ops {
+			var (
+				fails []*OpResult
+				err   error
+			)
+			switch op.GetOp() {
+			case spb.AFTOperation_DELETE:
+				_, fails, err = r.DeleteEntry(defName, op)
+			default:
+				_, fails, err = r.AddEntry(defName, op)
+			}
+			if err != nil || len(fails) != 0 {
+				t.Fatalf("cannot apply operation %s, fails: %v, err: %v", op, fails, err)
+			}
+		}
+	}
+
+	apply(t, nhOp(1, "192.0.2.1", ""), nhOp(2, "192.0.2.2", ""), nhgOp(1, 1), nhgOp(2, 2))
+	check(t, counts{
+		NHG: map[uint64]int{1: 0, 2: 0},
+		NH:  map[uint64]int{1: 1, 2: 1},
+	}, []string{})
+
+	apply(t, ipv4Op(spb.AFTOperation_ADD, "192.0.2.0/24", 1), ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1))
+	check(t, counts{
+		NHG: map[uint64]int{1: 2, 2: 0},
+		NH:  map[uint64]int{1: 1, 2: 1},
+	}, []string{"192.0.2.0/24", "198.51.100.0/24"})
+
+	// Replacing a prefix moves its reference from NHG 1 to NHG 2.
+	apply(t, ipv4Op(spb.AFTOperation_REPLACE, "192.0.2.0/24", 2))
+	check(t, counts{
+		NHG: map[uint64]int{1: 1, 2: 1},
+		NH:  map[uint64]int{1: 1, 2: 1},
+	}, []string{"192.0.2.0/24", "198.51.100.0/24"})
+
+	// Replacing the prefix with the same NHG does not change the counts.
+	apply(t, ipv4Op(spb.AFTOperation_ADD, "192.0.2.0/24", 2))
+	check(t, counts{
+		NHG: map[uint64]int{1: 1, 2: 1},
+		NH:  map[uint64]int{1: 1, 2: 1},
+	}, []string{"192.0.2.0/24", "198.51.100.0/24"})
+
+	// Replacing NHG 2 to use NH 1 moves the next-hop reference.
+	apply(t, nhgOp(2, 1))
+	check(t, counts{
+		NHG: map[uint64]int{1: 1, 2: 1},
+		NH:  map[uint64]int{1: 2, 2: 0},
+	}, []string{"192.0.2.0/24", "198.51.100.0/24"})
+
+	// Referenced entries cannot be removed.
+	nhgDel := &spb.AFTOperation{
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_NextHopGroup{NextHopGroup: &aftpb.Afts_NextHopGroupKey{Id: 1}},
+	}
+	if _, fails, _ := r.DeleteEntry(defName, nhgDel); len(fails) != 1 {
+		t.Fatalf("DeleteEntry(NHG 1): did not get expected failure, got: %v", fails)
+	}
+
+	apply(t, ipv4Op(spb.AFTOperation_DELETE, "198.51.100.0/24", 1), nhgDel, &spb.AFTOperation{
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: 2}},
+	})
+	check(t, counts{
+		NHG: map[uint64]int{1: 0, 2: 1},
+		NH:  map[uint64]int{1: 1, 2: 0},
+	}, []string{"192.0.2.0/24"})
+
+	wantErr := "invalid network-instance VRF-A"
+	if _, err := r.NHGReferences("VRF-A", 1); errdiff.Substring(err, wantErr) != "" {
+		t.Errorf("NHGReferences(VRF-A): did not get expected error, %s", errdiff.Substring(err, wantErr))
+	}
+	if _, err := r.NHReferences("VRF-A", 1); errdiff.Substring(err, wantErr) != "" {
+		t.Errorf("NHReferences(VRF-A): did not get expected error, %s", errdiff.Substring(err, wantErr))
+	}
+	if _, err := r.ResolvedEntries("VRF-A"); errdiff.Substring(err, wantErr) != "" {
+		t.Errorf("ResolvedEntries(VRF-A): did not get expected error, %s", errdiff.Substring(err, wantErr))
+	}
+}
+
+// TestOperationSemantics validates the behaviour of ADD, REPLACE and DELETE
+// operations for each AFT, for both entries that exist and are missing from the
+// RIB. An ADD for an existing entry is an implicit replace, a REPLACE requires
+// that the entry exists, and a DELETE of a missing entry succeeds. The reference
+// counts for the entries referenced by the entry being modified are checked
+// after each operation.
+func TestOperationSemantics(t *testing.T) {
+	// setEntry sets the entry within op to an entry for the AFT which references
+	// the next-hop-group (or next-hop in the case of a next-hop-group) ref.
+	type setEntry func(op *spb.AFTOperation, ref uint64)
+
+	nhgRefs := func(r *RIBHolder, i uint64) uint64 {
+		r.refCounts.mu.RLock()
+		defer r.refCounts.mu.RUnlock()
+		return r.refCounts.NextHopGroup[i]
+	}
+	nhRefs := func(r *RIBHolder, i uint64) uint64 {
+		r.refCounts.mu.RLock()
+		defer r.refCounts.mu.RUnlock()
+		return r.refCounts.NextHop[i]
+	}
+
+	afts := []struct {
+		name string
+		set  setEntry
+		// refCount returns the reference count of the entry referenced by the
+		// entry under test, it is nil if the entry does not reference others.
+		refCount func(*RIBHolder, uint64) uint64
+	}{{
+		name: "ipv4",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: "192.0.2.0/24",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup: &wpb.UintValue{Value: ref},
+					},
+				},
+			}
+		},
+		refCount: nhgRefs,
+	}, {
+		name: "ipv6",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_Ipv6{
+				Ipv6: &aftpb.Afts_Ipv6EntryKey{
+					Prefix: "2001:db8::/32",
+					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+						NextHopGroup: &wpb.UintValue{Value: ref},
+					},
+				},
+			}
+		},
+		refCount: nhgRefs,
+	}, {
+		name: "mpls",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_Mpls{
+				Mpls: &aftpb.Afts_LabelEntryKey{
+					Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
+						LabelUint64: 42,
+					},
+					LabelEntry: &aftpb.Afts_LabelEntry{
+						NextHopGroup: &wpb.UintValue{Value: ref},
+					},
+				},
+			}
+		},
+		refCount: nhgRefs,
+	}, {
+		name: "next-hop-group",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id: 10,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{
+						NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+							Index:   ref,
+							NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+						}},
+					},
+				},
+			}
+		},
+		refCount: nhRefs,
+	}, {
+		name: "next-hop",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 10,
+					NextHop: &aftpb.Afts_NextHop{
+						IpAddress: &wpb.StringValue{Value: fmt.Sprintf("192.0.2.%d", ref)},
+					},
+				},
+			}
+		},
+	}}
+
+	// op is an operation to be performed on the entry under test, referencing
+	// the entry with ID ref.
+	type op struct {
+		op  spb.AFTOperation_Operation
+		ref uint64
+	}
+
+	tests := []struct {
+		desc string
+		// inExisting specifies whether the entry under test exists, referencing
+		// entry 1, prior to the operation.
+		inExisting bool
+		inOp       op
+		wantOK     bool
+		// wantRefs is the expected reference count for entries 1 and 2 after the
+		// operation.
+		wantRefs [2]uint64
+	}{{
+		desc:     "ADD missing entry",
+		inOp:     op{spb.AFTOperation_ADD, 1},
+		wantOK:   true,
+		wantRefs: [2]uint64{1, 0},
+	}, {
+		desc:       "ADD existing entry with same contents",
+		inExisting: true,
+		inOp:       op{spb.AFTOperation_ADD, 1},
+		wantOK:     true,
+		wantRefs:   [2]uint64{1, 0},
+	}, {
+		desc:       "ADD existing entry is an implicit replace",
+		inExisting: true,
+		inOp:       op{spb.AFTOperation_ADD, 2},
+		wantOK:     true,
+		wantRefs:   [2]uint64{0, 1},
+	}, {
+		desc:     "REPLACE missing entry",
+		inOp:     op{spb.AFTOperation_REPLACE, 1},
+		wantOK:   false,
+		wantRefs: [2]uint64{0, 0},
+	}, {
+		desc:       "REPLACE existing entry",
+		inExisting: true,
+		inOp:       op{spb.AFTOperation_REPLACE, 2},
+		wantOK:     true,
+		wantRefs:   [2]uint64{0, 1},
+	}, {
+		desc:     "DELETE missing entry",
+		inOp:     op{spb.AFTOperation_DELETE, 1},
+		wantOK:   true,
+		wantRefs: [2]uint64{0, 0},
+	}, {
+		desc:       "DELETE existing entry",
+		inExisting: true,
+		inOp:       op{spb.AFTOperation_DELETE, 1},
+		wantOK:     true,
+		wantRefs:   [2]uint64{0, 0},
+	}}
+
+	for _, a := range afts {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s: %s", a.name, tt.desc), func(t *testing.T) {
+				r := New(defName)
+				var id uint64
+				do := func(o spb.AFTOperation_Operation, set func(*spb.AFTOperation)) ([]*OpResult, []*OpResult, error) {
+					id++
+					op := &spb.AFTOperation{Id: id, NetworkInstance: defName, Op: o}
+					set(op)
+					if o == spb.AFTOperation_DELETE {
+						return r.DeleteEntry(defName, op)
+					}
+					return r.AddEntry(defName, op)
+				}
+				mustAdd := func(set func(*spb.AFTOperation)) {
+					if _, fails, err := do(spb.AFTOperation_ADD, set); err != nil || len(fails) != 0 {
+						t.Fatalf("cannot build base RIB, got fails: %v, err: %v", fails, err)
+					}
+				}
+
+				// Base topology of two next-hops, and two next-hop-groups which
+				// can be referenced by the entry under test. When the entry under
+				// test is a next-hop-group, the base next-hop-groups are not created
+				// such that the next-hops are referenced only by the entry under test.
+				for _, i := range []uint64{1, 2} {
+					i := i
+					mustAdd(func(op *spb.AFTOperation) {
+						op.Entry = &spb.AFTOperation_NextHop{
+							NextHop: &aftpb.Afts_NextHopKey{
+								Index:   i,
+								NextHop: &aftpb.Afts_NextHop{},
+							},
+						}
+					})
+				}
+				if a.name != "next-hop-group" {
+					for _, i := range []uint64{1, 2} {
+						i := i
+						mustAdd(func(op *spb.AFTOperation) {
+							op.Entry = &spb.AFTOperation_NextHopGroup{
+								NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+									Id: i,
+									NextHopGroup: &aftpb.Afts_NextHopGroup{
+										NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+											Index:   i,
+											NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+										}},
+									},
+								},
+							}
+						})
+					}
+				}
+
+				if tt.inExisting {
+					mustAdd(func(op *spb.AFTOperation) { a.set(op, 1) })
+				}
+
+				oks, fails, err := do(tt.inOp.op, func(op *spb.AFTOperation) { a.set(op, tt.inOp.ref) })
+				if err != nil {
+					t.Fatalf("got unexpected error, %v", err)
+				}
+				if gotOK := len(oks) == 1 && len(fails) == 0; gotOK != tt.wantOK {
+					t.Fatalf("did not get expected result, got oks: %v, fails: %v, wantOK? %v", oks, fails, tt.wantOK)
+				}
+
+				if a.refCount == nil {
+					return
+				}
+				niR, ok := r.NetworkInstanceRIB(defName)
+				if !ok {
+					t.Fatalf("cannot find default network instance")
+				}
+				for i, want := range tt.wantRefs {
+					if got := a.refCount(niR, uint64(i+1)); got != want {
+						t.Errorf("did not get expected reference count for entry %d, got: %d, want: %d", i+1, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestOperationEntry(t *testing.T) {
+	tests := []struct {
+		desc      string
+		inOp      *spb.AFTOperation
+		wantAFT   constants.AFT
+		wantEntry ygot.ValidatedGoStruct
+		wantErr   bool
+	}{{
+		desc: "ipv4",
+		inOp: &spb.AFTOperation{
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: "192.0.2.0/24",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup: &wpb.UintValue{Value: 42},
+					},
+				},
+			},
+		},
+		wantAFT: constants.IPv4,
+		wantEntry: &aft.Afts_Ipv4Entry{
+			Prefix:       ygot.String("192.0.2.0/24"),
+			NextHopGroup: ygot.Uint64(42),
+		},
+	}, {
+		desc: "mpls",
+		inOp: &spb.AFTOperation{
+			Entry: &spb.AFTOperation_Mpls{
+				Mpls: &aftpb.Afts_LabelEntryKey{
+					Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
+						LabelUint64: 42,
+					},
+					LabelEntry: &aftpb.Afts_LabelEntry{},
+				},
+			},
+		},
+		wantAFT: constants.MPLS,
+		wantEntry: &aft.Afts_LabelEntry{
+			Label: aft.UnionUint32(42),
+		},
+	}, {
+		desc: "next-hop",
+		inOp: &spb.AFTOperation{
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 1,
+					NextHop: &aftpb.Afts_NextHop{
+						IpAddress: &wpb.StringValue{Value: "192.0.2.1"},
+					},
+				},
+			},
+		},
+		wantAFT: constants.NextHop,
+		wantEntry: &aft.Afts_NextHop{
+			Index:     ygot.Uint64(1),
+			IpAddress: ygot.String("192.0.2.1"),
+		},
+	}, {
+		desc:    "no entry",
+		inOp:    &spb.AFTOperation{},
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			gotAFT, gotEntry, err := OperationEntry(tt.inOp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("did not get expected error, got: %v, wantErr? %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if gotAFT != tt.wantAFT {
+				t.Errorf("did not get expected AFT, got: %s, want: %s", gotAFT, tt.wantAFT)
+			}
+			if diff := cmp.Diff(gotEntry, tt.wantEntry); diff != "" {
+				t.Errorf("did not get expected entry, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPolicyForwardingEntry(t *testing.T) {
+	r := New(defName)
+	for _, op := range []*spb.AFTOperation{nhOp(1, "192.0.2.1", ""), nhgOp(1, 1)} {
+		if _, fails, err := r.AddEntry(defName, op); err != nil || len(fails) != 0 {
+			t.Fatalf("cannot add %s, fails: %v, err: %v", op, fails, err)
+		}
+	}
+
+	pbr := &aftpb.Afts_PolicyForwardingEntryKey{
+		Index: 42,
+		PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntry{
+			IpPrefix:     &wpb.StringValue{Value: "192.0.2.0/24"},
+			IpDscp:       &wpb.UintValue{Value: 10},
+			IpProtocol:   &aftpb.Afts_PolicyForwardingEntry_IpProtocolUint64{IpProtocolUint64: 6},
+			L4SrcPort:    &wpb.UintValue{Value: 1024},
+			L4DstPort:    &wpb.UintValue{Value: 443},
+			NextHopGroup: &wpb.UintValue{Value: 1},
+		},
+	}
+	add := &spb.AFTOperation{
+		Id:    1,
+		Op:    spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_PolicyForwardingEntry{PolicyForwardingEntry: pbr},
+	}
+	if _, fails, err := r.AddEntry(defName, add); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot add policy-forwarding entry, fails: %v, err: %v", fails, err)
+	}
+
+	niR, _ := r.NetworkInstanceRIB(defName)
+	got := getRIBEntries(t, niR, map[spb.AFTType]bool{spb.AFTType_POLICY_FORWARDING: true})
+	want := []*spb.AFTEntry{{
+		NetworkInstance: defName,
+		Entry:           &spb.AFTEntry_PolicyForwardingEntry{PolicyForwardingEntry: pbr},
+	}}
+	if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+		t.Fatalf("did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+
+	if !niR.nhgReferenced(1) {
+		t.Errorf("next-hop-group 1 is not referenced by the policy-forwarding entry")
+	}
+
+	del := &spb.AFTOperation{
+		Id:    2,
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_PolicyForwardingEntry{PolicyForwardingEntry: &aftpb.Afts_PolicyForwardingEntryKey{Index: 42}},
+	}
+	if _, fails, err := r.DeleteEntry(defName, del); err != nil || len(fails) != 0 {
+		t.Fatalf("cannot delete policy-forwarding entry, fails: %v, err: %v", fails, err)
+	}
+	if got := getRIBEntries(t, niR, map[spb.AFTType]bool{spb.AFTType_POLICY_FORWARDING: true}); len(got) != 0 {
+		t.Errorf("did not get expected empty RIB after delete, got: %v", got)
+	}
+	if niR.nhgReferenced(1) {
+		t.Errorf("next-hop-group 1 is referenced after the policy-forwarding entry was deleted")
+	}
+}
+
+func TestMalformedEntries(t *testing.T) {
+	mplsOp := func(label *aftpb.Afts_LabelEntryKey_LabelUint64) *spb.AFTOperation {
+		k := &aftpb.Afts_LabelEntryKey{
+			LabelEntry: &aftpb.Afts_LabelEntry{NextHopGroup: &wpb.UintValue{Value: 1}},
+		}
+		if label != nil {
+			k.Label = label
+		}
+		return &spb.AFTOperation{Op: spb.AFTOperation_ADD, Entry: &spb.AFTOperation_Mpls{Mpls: k}}
+	}
+
+	ipv6Op := &spb.AFTOperation{
+		Op: spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_Ipv6{
+			Ipv6: &aftpb.Afts_Ipv6EntryKey{
+				Prefix:    "::ffff:192.0.2.0/120",
+				Ipv6Entry: &aftpb.Afts_Ipv6Entry{NextHopGroup: &wpb.UintValue{Value: 1}},
+			},
+		},
+	}
+
+	tests := []struct {
+		desc    string
+		inOp    *spb.AFTOperation
+		wantErr string
+	}{{
+		desc:    "unparseable IPv4 prefix",
+		inOp:    ipv4Op(spb.AFTOperation_ADD, "F-I-S-H", 1),
+		wantErr: `invalid IPv4 prefix "F-I-S-H", must be an IPv4 address and prefix length`,
+	}, {
+		desc:    "IPv4 address without prefix length",
+		inOp:    ipv4Op(spb.AFTOperation_ADD, "192.0.2.1", 1),
+		wantErr: `invalid IPv4 prefix "192.0.2.1", must be an IPv4 address and prefix length`,
+	}, {
+		desc:    "IPv6 prefix within IPv4 AFT",
+		inOp:    ipv4Op(spb.AFTOperation_ADD, "2001:db8::/32", 1),
+		wantErr: `invalid IPv4 prefix "2001:db8::/32", must be an IPv4 address and prefix length`,
+	}, {
+		desc:    "IPv4-mapped prefix within IPv6 AFT",
+		inOp:    ipv6Op,
+		wantErr: `invalid IPv6 prefix "::ffff:192.0.2.0/120", must be an IPv6 address and prefix length`,
+	}, {
+		desc:    "next-hop index zero",
+		inOp:    nhOp(0, "192.0.2.1", ""),
+		wantErr: "invalid next-hop index 0, zero is reserved",
+	}, {
+		desc:    "next-hop-group ID zero",
+		inOp:    nhgOp(0, 1),
+		wantErr: "invalid next-hop-group ID 0, zero is reserved",
+	}, {
+		desc:    "MPLS label out of range",
+		inOp:    mplsOp(&aftpb.Afts_LabelEntryKey_LabelUint64{LabelUint64: 1 << 20}),
+		wantErr: "invalid MPLS label 1048576, must be no greater than 1048575",
+	}, {
+		desc:    "MPLS entry without label",
+		inOp:    mplsOp(nil),
+		wantErr: "invalid MPLS entry, no label specified",
+	}}
+
+	for _, tt := range tests {
+		for _, opType := range []spb.AFTOperation_Operation{spb.AFTOperation_ADD, spb.AFTOperation_DELETE} {
+			t.Run(fmt.Sprintf("%s %s", opType, tt.desc), func(t *testing.T) {
+				// The RIB check function is disabled such that malformed entries would
+				// otherwise be installed without their references being checked.
+				r := New(defName, DisableRIBCheckFn())
+				applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""), nhgOp(1, 1))
+				niR, _ := r.NetworkInstanceRIB(defName)
+				before := niR.EntryCounts()
+
+				op := proto.Clone(tt.inOp).(*spb.AFTOperation)
+				op.Id = 42
+				op.Op = opType
+
+				fn := r.AddEntry
+				if opType == spb.AFTOperation_DELETE {
+					fn = r.DeleteEntry
+				}
+				oks, fails, err := fn(defName, op)
+				if err != nil {
+					t.Fatalf("%s: got unexpected error, %v", opType, err)
+				}
+				if len(oks) != 0 {
+					t.Errorf("%s: got unexpected successful operations, %v", opType, oks)
+				}
+				wantFails := []*OpResult{{ID: 42, Op: op, Error: tt.wantErr}}
+				if diff := cmp.Diff(fails, wantFails, protocmp.Transform()); diff != "" {
+					t.Errorf("%s: did not get expected failures, diff(-got,+want):\n%s", opType, diff)
+				}
+				if diff := cmp.Diff(niR.EntryCounts(), before); diff != "" {
+					t.Errorf("%s: RIB was modified by malformed entry, diff(-got,+want):\n%s", opType, diff)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"sort"
+
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// snapshotAFTs is the set of AFTs whose entries are shared with a snapshot.
+var snapshotAFTs = []constants.AFT{
+	constants.IPv4,
+	constants.IPv6,
+	constants.MPLS,
+	constants.NextHopGroup,
+	constants.NextHop,
+	constants.PolicyForwarding,
+}
+
+// Snapshot is an immutable view of the contents of the RIB at a single point in
+// the sequence of operations that are applied to it. Taking a snapshot does not
+// copy the entries of the RIB, rather the maps of entries are shared between the
+// snapshot and the RIB, and the RIB copies the map for an AFT the first time it
+// modifies it after the snapshot is taken. This allows a snapshot to be read
+// without holding any lock on the RIB, such that the RIB can continue to be
+// modified whilst a large snapshot is read.
+type Snapshot struct {
+	// nis is the snapshot of each network instance, keyed by the name of the
+	// network instance.
+	nis map[string]*niSnapshot
+	// derived is the set of entries within the snapshot that were derived
+	// from other entries, and are hence not returned by GetRIB. It is nil if
+	// derived entries are returned.
+	derived map[entryID]bool
+}
+
+// niSnapshot is the snapshot of the RIB of a single network instance.
+type niSnapshot struct {
+	// holder is the network instance RIB that the snapshot was taken from.
+	holder *RIBHolder
+	// afts stores the entries of the network instance. The maps within it
+	// must not be modified.
+	afts *aft.Afts
+	// generation is the generation of the map of entries for each AFT of
+	// holder at the time that the snapshot was taken.
+	generation map[constants.AFT]uint64
+}
+
+// Snapshot returns a snapshot of the contents of all network instances within
+// the RIB. All network instances are locked whilst the snapshot is taken, such
+// that it reflects a single point in the sequence of operations applied to the
+// RIB, but no lock is held whilst the snapshot is read.
+//
+// The snapshot should be released using Release once it is no longer used.
+func (r *RIB) Snapshot() *Snapshot {
+	// The network instances are copied such that nrMu is not held whilst the
+	// network instance RIBs are locked.
+	r.nrMu.RLock()
+	holders := make(map[string]*RIBHolder, len(r.niRIB))
+	names := make([]string, 0, len(r.niRIB))
+	for n, h := range r.niRIB {
+		holders[n] = h
+		names = append(names, n)
+	}
+	r.nrMu.RUnlock()
+
+	// Lock the network instances in a stable order, such that we cannot deadlock
+	// with another snapshot or a Flush, which locks them in the same order.
+	sort.Strings(names)
+	for _, n := range names {
+		holders[n].mu.Lock()
+	}
+	s := &Snapshot{nis: make(map[string]*niSnapshot, len(names))}
+	for _, n := range names {
+		s.nis[n] = holders[n].snapshot()
+	}
+	if !r.derivedInGet {
+		s.derived = r.derivations.derivedEntries()
+	}
+	for _, n := range names {
+		holders[n].mu.Unlock()
+	}
+	return s
+}
+
+// NetworkInstances returns the names of the network instances within the
+// snapshot, in a stable order.
+func (s *Snapshot) NetworkInstances() []string {
+	names := []string{}
+	for n := range s.nis {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetRIB writes the contents of the network instance ni within the snapshot,
+// filtered according to filter, to msgCh, as per RIBHolder.GetRIB. Derived
+// entries are not written unless the RIB was created with WithDerivedEntriesInGet.
+// It returns an error if the network instance does not exist within the snapshot.
+func (s *Snapshot) GetRIB(ni string, filter map[spb.AFTType]bool, msgCh chan *spb.GetResponse, stopCh chan struct{}) error {
+	n, ok := s.nis[ni]
+	if !ok {
+		return status.Errorf(codes.InvalidArgument, "invalid network instance %s specified", ni)
+	}
+	var skip func(constants.AFT, any) bool
+	if len(s.derived) != 0 {
+		skip = func(a constants.AFT, key any) bool {
+			return s.derived[newEntryID(ni, a, key)]
+		}
+	}
+	return getRIB(ni, n.afts, filter, skip, msgCh, stopCh)
+}
+
+// Release indicates that the snapshot is no longer used, such that the RIB does
+// not copy the entries that the snapshot shares with it when it is subsequently
+// modified. The snapshot must not be read after it is released. A snapshot that
+// is never released remains valid, but causes the next modification of each AFT
+// to copy the AFT's map of entries.
+func (s *Snapshot) Release() {
+	for _, n := range s.nis {
+		n.release()
+	}
+	s.nis = nil
+}
+
+// snapshot returns a snapshot of the receiver's entries, marking the maps of
+// entries as being shared with the snapshot. The caller MUST hold the write lock.
+func (r *RIBHolder) snapshot() *niSnapshot {
+	if r.shared == nil {
+		r.shared = map[constants.AFT]int{}
+		r.generation = map[constants.AFT]uint64{}
+	}
+	gen := make(map[constants.AFT]uint64, len(snapshotAFTs))
+	for _, a := range snapshotAFTs {
+		r.shared[a]++
+		gen[a] = r.generation[a]
+	}
+	// The Afts struct is copied such that the snapshot retains the maps that are
+	// currently in use, even when the RIB replaces them.
+	afts := *r.r.GetOrCreateAfts()
+	return &niSnapshot{holder: r, afts: &afts, generation: gen}
+}
+
+// release stops the snapshot n from sharing the maps of entries of the RIB that
+// it was taken from, where the RIB has not already copied them.
+func (n *niSnapshot) release() {
+	r := n.holder
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for a, g := range n.generation {
+		if r.generation[a] == g && r.shared[a] > 0 {
+			r.shared[a]--
+		}
+	}
+}
+
+// unshare ensures that the map of entries for the AFT a is not shared with any
+// snapshot, copying it if it is, such that it can be modified. The entries
+// themselves are not copied, since they are replaced rather than modified. The
+// caller MUST hold the write lock.
+func (r *RIBHolder) unshare(a constants.AFT) {
+	if r.shared[a] == 0 {
+		return
+	}
+	r.shared[a] = 0
+	r.generation[a]++
+
+	afts := r.r.GetOrCreateAfts()
+	switch a {
+	case constants.IPv4:
+		afts.Ipv4Entry = cloneMap(afts.Ipv4Entry)
+	case constants.IPv6:
+		afts.Ipv6Entry = cloneMap(afts.Ipv6Entry)
+	case constants.MPLS:
+		afts.LabelEntry = cloneMap(afts.LabelEntry)
+	case constants.NextHopGroup:
+		afts.NextHopGroup = cloneMap(afts.NextHopGroup)
+	case constants.NextHop:
+		afts.NextHop = cloneMap(afts.NextHop)
+	case constants.PolicyForwarding:
+		afts.PolicyForwardingEntry = cloneMap(afts.PolicyForwardingEntry)
+	}
+}
+
+// cloneMap returns a copy of the map m, it returns nil if m is nil.
+func cloneMap[K comparable, V any](m map[K]V) map[K]V {
+	if m == nil {
+		return nil
+	}
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
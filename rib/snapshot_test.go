@@ -0,0 +1,260 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rib
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/ygot/ygot"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// snapshotKeys returns the keys of the entries within network instance ni of the
+// snapshot s, in the form <network instance>/<aft>/<key>, in a stable order.
+func snapshotKeys(t *testing.T, s *Snapshot, ni string) []string {
+	t.Helper()
+	msgCh := make(chan *spb.GetResponse)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.GetRIB(ni, map[spb.AFTType]bool{spb.AFTType_ALL: true}, msgCh, make(chan struct{}))
+		close(msgCh)
+	}()
+
+	keys := []string{}
+	for m := range msgCh {
+		for _, e := range m.GetEntry() {
+			var k string
+			switch v := e.GetEntry().(type) {
+			case *spb.AFTEntry_Ipv4:
+				k = fmt.Sprintf("%s/%s/%s", e.GetNetworkInstance(), constants.IPv4, v.Ipv4.GetPrefix())
+			case *spb.AFTEntry_NextHopGroup:
+				k = fmt.Sprintf("%s/%s/%d", e.GetNetworkInstance(), constants.NextHopGroup, v.NextHopGroup.GetId())
+			case *spb.AFTEntry_NextHop:
+				k = fmt.Sprintf("%s/%s/%d", e.GetNetworkInstance(), constants.NextHop, v.NextHop.GetIndex())
+			}
+			keys = append(keys, k)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("GetRIB(%s): got unexpected error, %v", ni, err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyOps applies the operations ops to the network instance ni of r, failing
+// the test if any operation fails.
+func applyOps(t *testing.T, r *RIB, ni string, ops ...*spb.AFTOperation) {
+	t.Helper()
+	for _, op := range ops {
+		var (
+			fails []*OpResult
+			err   error
+		)
+		switch op.GetOp() {
+		case spb.AFTOperation_DELETE:
+			_, fails, err = r.DeleteEntry(ni, op)
+		default:
+			_, fails, err = r.AddEntry(ni, op)
+		}
+		if err != nil || len(fails) != 0 {
+			t.Fatalf("cannot apply operation %s, fails: %v, err: %v", op, fails, err)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	r := New(defName)
+	if err := r.AddNetworkInstance("VRF-A"); err != nil {
+		t.Fatalf("cannot add network instance, %v", err)
+	}
+	applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""), nhgOp(1, 1), ipv4Op(spb.AFTOperation_ADD, "192.0.2.0/24", 1))
+	applyOps(t, r, "VRF-A", nhOp(1, "192.0.2.1", ""))
+
+	snap := r.Snapshot()
+	if diff := cmp.Diff(snap.NetworkInstances(), []string{defName, "VRF-A"}); diff != "" {
+		t.Fatalf("NetworkInstances(): did not get expected network instances, diff(-got,+want):\n%s", diff)
+	}
+
+	// Modify the RIB after the snapshot was taken.
+	applyOps(t, r, defName,
+		ipv4Op(spb.AFTOperation_ADD, "198.51.100.0/24", 1),
+		ipv4Op(spb.AFTOperation_DELETE, "192.0.2.0/24", 1),
+		nhOp(2, "192.0.2.2", ""),
+	)
+	applyOps(t, r, "VRF-A", &spb.AFTOperation{
+		Op:    spb.AFTOperation_DELETE,
+		Entry: &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: 1}},
+	})
+	if err := r.Flush([]string{defName}); err != nil {
+		t.Fatalf("cannot flush RIB, %v", err)
+	}
+
+	want := map[string][]string{
+		defName: {
+			"DEFAULT/IPv4/192.0.2.0/24",
+			"DEFAULT/NextHop/1",
+			"DEFAULT/NextHopGroup/1",
+		},
+		"VRF-A": {
+			"VRF-A/NextHop/1",
+		},
+	}
+	for ni, w := range want {
+		if diff := cmp.Diff(snapshotKeys(t, snap, ni), w); diff != "" {
+			t.Errorf("snapshot of %s did not contain expected entries, diff(-got,+want):\n%s", ni, diff)
+		}
+	}
+
+	// A new snapshot reflects the modifications.
+	current := r.Snapshot()
+	defer current.Release()
+	for _, ni := range []string{defName, "VRF-A"} {
+		if got := snapshotKeys(t, current, ni); len(got) != 0 {
+			t.Errorf("snapshot of %s after modifications did not contain expected entries, got: %v, want: none", ni, got)
+		}
+	}
+
+	if err := snap.GetRIB("VRF-B", map[spb.AFTType]bool{spb.AFTType_ALL: true}, nil, nil); err == nil {
+		t.Errorf("GetRIB(VRF-B): did not get expected error for unknown network instance")
+	}
+	snap.Release()
+}
+
+func TestSnapshotRelease(t *testing.T) {
+	r := New(defName)
+	niR := r.niRIB[defName]
+	applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""))
+
+	// A map that is shared with a snapshot is copied when it is modified.
+	snap := r.Snapshot()
+	applyOps(t, r, defName, nhOp(2, "192.0.2.1", ""))
+	if got, want := niR.generation[constants.NextHop], uint64(1); got != want {
+		t.Fatalf("did not get expected generation after modification, got: %d, want: %d", got, want)
+	}
+	snap.Release()
+
+	// A map that is shared with a snapshot that has been released is not copied.
+	snap = r.Snapshot()
+	snap.Release()
+	applyOps(t, r, defName, nhOp(3, "192.0.2.1", ""))
+	if got, want := niR.generation[constants.NextHop], uint64(1); got != want {
+		t.Fatalf("did not get expected generation after modification with released snapshot, got: %d, want: %d", got, want)
+	}
+
+	// Releasing a snapshot does not affect other snapshots.
+	first, second := r.Snapshot(), r.Snapshot()
+	first.Release()
+	applyOps(t, r, defName, nhOp(4, "192.0.2.1", ""))
+	if got, want := niR.generation[constants.NextHop], uint64(2); got != want {
+		t.Fatalf("did not get expected generation after modification with outstanding snapshot, got: %d, want: %d", got, want)
+	}
+	if diff := cmp.Diff(snapshotKeys(t, second, defName), []string{"DEFAULT/NextHop/1", "DEFAULT/NextHop/2", "DEFAULT/NextHop/3"}); diff != "" {
+		t.Errorf("outstanding snapshot did not contain expected entries, diff(-got,+want):\n%s", diff)
+	}
+	second.Release()
+	if got := niR.shared[constants.NextHop]; got != 0 {
+		t.Errorf("did not get expected shared count after all snapshots were released, got: %d, want: 0", got)
+	}
+}
+
+func TestGetRIBDoesNotBlockModify(t *testing.T) {
+	r := New(defName)
+	applyOps(t, r, defName, nhOp(1, "192.0.2.1", ""), nhOp(2, "192.0.2.2", ""))
+	niR := r.niRIB[defName]
+
+	// The reader of msgCh does not read any messages until the modification
+	// below is complete, such that GetRIB is blocked writing to it.
+	msgCh := make(chan *spb.GetResponse)
+	stopCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- niR.GetRIB(map[spb.AFTType]bool{spb.AFTType_NEXTHOP: true}, msgCh, stopCh)
+		close(msgCh)
+	}()
+	first := <-msgCh
+
+	done := make(chan struct{})
+	go func() {
+		applyOps(t, r, defName, nhOp(3, "192.0.2.3", ""))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("modification was blocked by GetRIB")
+	}
+
+	got := []uint64{first.GetEntry()[0].GetNextHop().GetIndex()}
+	for m := range msgCh {
+		got = append(got, m.GetEntry()[0].GetNextHop().GetIndex())
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("GetRIB(): got unexpected error, %v", err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if diff := cmp.Diff(got, []uint64{1, 2}); diff != "" {
+		t.Fatalf("GetRIB(): did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+}
+
+// snapshotBenchmarkEntries is the number of entries in the RIB that is read
+// whilst it is modified in BenchmarkModifyDuringGet.
+const snapshotBenchmarkEntries = 500000
+
+// BenchmarkModifyDuringGet measures the time taken to add an entry to the RIB
+// whilst a GetRIB of a large RIB is in progress.
+func BenchmarkModifyDuringGet(b *testing.B) {
+	r := New(defName)
+	niR := r.niRIB[defName]
+	// The entries are written directly to the RIB, since adding them individually
+	// is slow for large RIBs.
+	nhs := map[uint64]*aft.Afts_NextHop{}
+	for i := uint64(1); i <= snapshotBenchmarkEntries; i++ {
+		nhs[i] = &aft.Afts_NextHop{Index: ygot.Uint64(i), IpAddress: ygot.String("192.0.2.1")}
+	}
+	niR.r.GetOrCreateAfts().NextHop = nhs
+
+	msgCh := make(chan *spb.GetResponse)
+	stopCh := make(chan struct{})
+	go func() {
+		niR.GetRIB(map[spb.AFTType]bool{spb.AFTType_NEXTHOP: true}, msgCh, stopCh)
+		close(msgCh)
+	}()
+	// The Get is read slowly, such that it is in progress throughout the
+	// benchmark.
+	go func() {
+		for range msgCh {
+			time.Sleep(time.Microsecond)
+		}
+	}()
+	defer close(stopCh)
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		idx := uint64(snapshotBenchmarkEntries + 1 + n)
+		if _, fails, err := r.AddEntry(defName, nhOp(idx, "192.0.2.1", "")); err != nil || len(fails) != 0 {
+			b.Fatalf("cannot add next-hop %d, fails: %v, err: %v", idx, fails, err)
+		}
+	}
+}
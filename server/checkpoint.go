@@ -0,0 +1,151 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/rib"
+)
+
+// WithCheckpointFile specifies that the contents of the server's RIB should be
+// written to the file at path every interval, such that they persist across a
+// restart of the process - as per the PRESERVE persistence mode across a reboot
+// of a device. If the file exists when the server is created, the RIB is restored
+// from it before the server is returned, and hence before it accepts any
+// connections. The highest election ID that was used is restored along with the
+// RIB, such that clients must use an election ID at least as high to become the
+// master. Entries that cannot be restored are logged, and do not prevent the
+// remaining entries from being restored.
+//
+// If interval is zero, checkpoints are not written periodically. In all cases, a
+// final checkpoint is written when the server is stopped using GracefulStop, and
+// a checkpoint can be written at any time using Checkpoint.
+func WithCheckpointFile(path string, interval time.Duration) *checkpointFile {
+	return &checkpointFile{path: path, interval: interval}
+}
+
+// checkpointFile is the internal implementation of the WithCheckpointFile option.
+type checkpointFile struct {
+	// path is the path to the checkpoint file.
+	path string
+	// interval is the interval at which checkpoints are written.
+	interval time.Duration
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*checkpointFile) isServerOpt() {}
+
+// hasCheckpointFile returns the checkpointFile option from the ServerOpt slice
+// supplied, or nil if it is not present.
+func hasCheckpointFile(opt []ServerOpt) *checkpointFile {
+	for _, o := range opt {
+		if v, ok := o.(*checkpointFile); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// restoreCheckpoint restores the server's RIB from its checkpoint file, creating
+// the RIB with the options opt. It does nothing if the file does not exist.
+func (s *Server) restoreCheckpoint(opt []rib.RIBOpt) error {
+	f, err := os.Open(s.checkpoint.path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return fmt.Errorf("cannot open checkpoint file, %v", err)
+	}
+	defer f.Close()
+
+	r, errs, err := rib.Load(f, opt...)
+	if err != nil {
+		return fmt.Errorf("cannot restore checkpoint %s, %v", s.checkpoint.path, err)
+	}
+	if _, ok := r.NetworkInstanceRIB(s.defaultNI); !ok {
+		return fmt.Errorf("cannot restore checkpoint %s, default network instance %s is not present", s.checkpoint.path, s.defaultNI)
+	}
+	for _, err := range errs {
+		log.Warningf("entry not restored from checkpoint %s, %v", s.checkpoint.path, err)
+	}
+
+	s.masterRIB = r
+	s.curElecID = r.ElectionID()
+	for _, n := range r.KnownNetworkInstances() {
+		if _, ok := s.niTypes[n]; !ok {
+			s.niTypes[n] = L3VRF
+		}
+	}
+	log.Infof("restored RIB from checkpoint %s", s.checkpoint.path)
+	return nil
+}
+
+// Checkpoint writes the contents of the server's RIB to the file specified by
+// WithCheckpointFile. The file is replaced atomically, such that a checkpoint
+// that is interrupted does not corrupt the previous checkpoint. It returns an
+// error if the server was not created with WithCheckpointFile.
+func (s *Server) Checkpoint() error {
+	if s.checkpoint == nil {
+		return errors.New("server does not have a checkpoint file")
+	}
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	tmp := s.checkpoint.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("cannot create checkpoint file, %v", err)
+	}
+	w := bufio.NewWriter(f)
+	if err := s.masterRIB.Save(w); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write checkpoint, %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write checkpoint, %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write checkpoint, %v", err)
+	}
+	if err := os.Rename(tmp, s.checkpoint.path); err != nil {
+		return fmt.Errorf("cannot replace checkpoint file, %v", err)
+	}
+	return nil
+}
+
+// runCheckpoints writes a checkpoint at the interval specified by
+// WithCheckpointFile until the server begins a graceful stop.
+func (s *Server) runCheckpoints() {
+	s.shutdown.init()
+	ticker := time.NewTicker(s.checkpoint.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown.stopCh:
+			return
+		case <-ticker.C:
+			if err := s.Checkpoint(); err != nil {
+				log.Errorf("cannot write checkpoint, %v", err)
+			}
+		}
+	}
+}
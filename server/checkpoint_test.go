@@ -0,0 +1,109 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// getAll returns the entries that are returned by a Get for all network
+// instances and AFTs of the in-process server s.
+func getAll(ctx context.Context, t *testing.T, s *InProcessServer) []*spb.AFTEntry {
+	t.Helper()
+	gc, err := spb.NewGRIBIClient(s.Conn()).Get(ctx, &spb.GetRequest{
+		NetworkInstance: &spb.GetRequest_All{All: &spb.Empty{}},
+		Aft:             spb.AFTType_ALL,
+	})
+	if err != nil {
+		t.Fatalf("cannot open Get RPC, %v", err)
+	}
+	var entries []*spb.AFTEntry
+	for {
+		res, err := gc.Recv()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("cannot receive Get response, %v", err)
+		}
+		entries = append(entries, res.GetEntry()...)
+	}
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rib")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := NewInProcess(WithCheckpointFile(path, 0))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	mc := startModify(ctx, t, s)
+	for i := uint64(1); i <= 3; i++ {
+		if err := mc.Send(nhAddRequest(i)); err != nil {
+			t.Fatalf("cannot send operation %d, %v", i, err)
+		}
+		res, err := mc.Recv()
+		if err != nil {
+			t.Fatalf("did not get response to operation %d, %v", i, err)
+		}
+		checkProgrammed(t, res)
+	}
+	want := getAll(ctx, t, s)
+	if len(want) != 3 {
+		t.Fatalf("did not get expected number of entries before restart, got: %d, want: 3", len(want))
+	}
+	if err := s.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint(): got unexpected error, %v", err)
+	}
+	s.Stop()
+
+	restored, err := NewInProcess(WithCheckpointFile(path, 0))
+	if err != nil {
+		t.Fatalf("cannot start restored in-process server, %v", err)
+	}
+	defer restored.Stop()
+
+	if diff := cmp.Diff(getAll(ctx, t, restored), want,
+		protocmp.Transform(),
+		cmpopts.SortSlices(func(a, b *spb.AFTEntry) bool { return prototext.Format(a) < prototext.Format(b) }),
+	); diff != "" {
+		t.Errorf("restored server did not return expected entries, diff(-got,+want):\n%s", diff)
+	}
+	if diff := cmp.Diff(restored.curElecID, &spb.Uint128{Low: 1}, protocmp.Transform()); diff != "" {
+		t.Errorf("restored server did not have expected election ID, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestCheckpointNotConfigured(t *testing.T) {
+	s, err := New()
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	if err := s.Checkpoint(); err == nil {
+		t.Errorf("Checkpoint(): did not get expected error for server without a checkpoint file")
+	}
+}
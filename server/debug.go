@@ -0,0 +1,251 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"go.uber.org/atomic"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// TraceStage is a stage of the processing of an operation that is traced when the
+// server is in debug mode.
+type TraceStage string
+
+const (
+	// TraceReceived indicates that the operation was received from the client.
+	TraceReceived TraceStage = "received"
+	// TraceValidated indicates that the operation passed the server's checks and
+	// is to be applied to the RIB.
+	TraceValidated TraceStage = "validated"
+	// TraceRIBApplied indicates that the operation was applied to the RIB. The
+	// detail is "pending" if the operation is pending resolution.
+	TraceRIBApplied TraceStage = "rib-applied"
+	// TraceHookQueued indicates that a RIB event for the operation was queued to
+	// be handed to the function specified by WithRIBEventHook.
+	TraceHookQueued TraceStage = "hook-queued"
+	// TraceHookDone indicates that the RIB event for the operation was completed.
+	// The detail is the error that the event was completed with, if any.
+	TraceHookDone TraceStage = "hook-done"
+	// TraceAck indicates that a result for the operation was sent to the client.
+	// The detail is the status of the result.
+	TraceAck TraceStage = "ack"
+)
+
+// TraceEvent describes a single transition in the processing of an operation.
+type TraceEvent struct {
+	// TraceID identifies the processing of a single operation, it is the same for
+	// each event that relates to the operation.
+	TraceID uint64
+	// Time is the time at which the transition occurred.
+	Time time.Time
+	// Client is the ID of the client that sent the operation.
+	Client string
+	// OperationID is the ID of the operation.
+	OperationID uint64
+	// NetworkInstance is the network instance that the operation applies to.
+	NetworkInstance string
+	// Stage is the stage of processing that the operation reached.
+	Stage TraceStage
+	// Detail is additional information about the transition, its contents
+	// depend on the stage.
+	Detail string
+}
+
+// TraceFn is a function that is called for each TraceEvent generated by the
+// server when it is in debug mode.
+type TraceFn func(TraceEvent)
+
+// WithDebugMode specifies that the server should start in debug mode. In debug
+// mode, operations are processed strictly sequentially - across all clients, and
+// with the server waiting for the RIB event of an operation to be completed before
+// processing the next operation - and each transition in the processing of an
+// operation is traced. Debug mode can be enabled or disabled at runtime using
+// Server.SetDebugMode.
+func WithDebugMode() *debugMode { return &debugMode{} }
+
+// debugMode is the internal implementation of the WithDebugMode option.
+type debugMode struct{}
+
+// isServerOpt implements the ServerOpt interface.
+func (*debugMode) isServerOpt() {}
+
+// hasDebugMode checks whether the ServerOpt slice supplied contains the debugMode
+// option.
+func hasDebugMode(opt []ServerOpt) bool {
+	for _, o := range opt {
+		if _, ok := o.(*debugMode); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithDebugTrace specifies the function that trace events are written to when the
+// server is in debug mode. By default, trace events are logged.
+func WithDebugTrace(fn TraceFn) *debugTrace { return &debugTrace{fn: fn} }
+
+// debugTrace is the internal implementation of the WithDebugTrace option.
+type debugTrace struct {
+	fn TraceFn
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*debugTrace) isServerOpt() {}
+
+// hasDebugTrace returns the function specified by the WithDebugTrace option in
+// the ServerOpt slice supplied, or a function that logs each event if it is not
+// present.
+func hasDebugTrace(opt []ServerOpt) TraceFn {
+	for _, o := range opt {
+		if v, ok := o.(*debugTrace); ok && v.fn != nil {
+			return v.fn
+		}
+	}
+	return logTrace
+}
+
+// logTrace logs the trace event e.
+func logTrace(e TraceEvent) {
+	log.Infof("trace_id=%d client=%s op_id=%d network_instance=%s stage=%s detail=%q", e.TraceID, e.Client, e.OperationID, e.NetworkInstance, e.Stage, e.Detail)
+}
+
+// debugState stores the state used when the server is in debug mode.
+type debugState struct {
+	// enabled indicates that the server is in debug mode.
+	enabled atomic.Bool
+	// fn is the function that trace events are written to.
+	fn TraceFn
+
+	// seqMu is held whilst operations are processed in debug mode, such that
+	// operations from different clients are not processed concurrently.
+	seqMu sync.Mutex
+
+	// mu protects lastID and ops.
+	mu sync.Mutex
+	// lastID is the last trace ID that was allocated.
+	lastID uint64
+	// ops stores each operation that has been received in debug mode and has
+	// not yet received its final result, keyed by client and operation ID.
+	ops map[pendingKey]*tracedOp
+}
+
+// tracedOp is an operation that is being traced.
+type tracedOp struct {
+	// id is the trace ID of the operation.
+	id uint64
+	// ni is the network instance that the operation applies to.
+	ni string
+}
+
+// SetDebugMode enables or disables debug mode on the server, as described by
+// WithDebugMode. Operations that are being processed when debug mode is changed
+// are not affected, and operations that were received before debug mode was
+// enabled are not traced.
+func (s *Server) SetDebugMode(enabled bool) {
+	s.debug.mu.Lock()
+	defer s.debug.mu.Unlock()
+	s.debug.enabled.Store(enabled)
+	if !enabled {
+		s.debug.ops = map[pendingKey]*tracedOp{}
+	}
+}
+
+// DebugMode returns true if the server is in debug mode.
+func (s *Server) DebugMode() bool {
+	return s.debug.enabled.Load()
+}
+
+// traceReceived allocates a trace ID for the operation op received from the client
+// with ID cid, and traces that it was received.
+func (s *Server) traceReceived(cid string, op *spb.AFTOperation) {
+	ni := op.GetNetworkInstance()
+	if ni == "" {
+		ni = s.defaultNI
+	}
+	s.debug.mu.Lock()
+	s.debug.lastID++
+	id := s.debug.lastID
+	s.debug.ops[pendingKey{client: cid, id: op.GetId()}] = &tracedOp{id: id, ni: ni}
+	s.debug.mu.Unlock()
+	s.emitTrace(id, cid, op.GetId(), ni, TraceReceived, op.GetOp().String())
+}
+
+// trace traces that the operation with ID opID from the client with ID cid reached
+// stage. It does nothing if the operation is not being traced.
+func (s *Server) trace(cid string, opID uint64, stage TraceStage, detail string) {
+	s.debug.mu.Lock()
+	t, ok := s.debug.ops[pendingKey{client: cid, id: opID}]
+	s.debug.mu.Unlock()
+	if ok {
+		s.emitTrace(t.id, cid, opID, t.ni, stage, detail)
+	}
+}
+
+// traceResults traces each result within res, which is sent to the client with ID
+// cid. An operation is no longer traced once its final result is traced.
+func (s *Server) traceResults(cid string, res *spb.ModifyResponse) {
+	if !s.DebugMode() {
+		return
+	}
+	var fibACK bool
+	if cs, ok := s.getClientState(cid); ok && cs.params != nil {
+		fibACK = cs.params.FIBAck
+	}
+	for _, r := range res.GetResult() {
+		k := pendingKey{client: cid, id: r.GetId()}
+		s.debug.mu.Lock()
+		t, ok := s.debug.ops[k]
+		switch {
+		case !ok:
+		case r.GetStatus() == spb.AFTResult_FAILED, r.GetStatus() == spb.AFTResult_FIB_PROGRAMMED,
+			r.GetStatus() == spb.AFTResult_RIB_PROGRAMMED && !fibACK:
+			delete(s.debug.ops, k)
+		}
+		s.debug.mu.Unlock()
+		if ok {
+			s.emitTrace(t.id, cid, r.GetId(), t.ni, TraceAck, r.GetStatus().String())
+		}
+	}
+}
+
+// clearTraces stops tracing the operations sent by the client with ID cid.
+func (s *Server) clearTraces(cid string) {
+	s.debug.mu.Lock()
+	defer s.debug.mu.Unlock()
+	for k := range s.debug.ops {
+		if k.client == cid {
+			delete(s.debug.ops, k)
+		}
+	}
+}
+
+// emitTrace writes a trace event with the specified contents to the server's
+// trace function.
+func (s *Server) emitTrace(id uint64, cid string, opID uint64, ni string, stage TraceStage, detail string) {
+	s.debug.fn(TraceEvent{
+		TraceID:         id,
+		Time:            s.clock(),
+		Client:          cid,
+		OperationID:     opID,
+		NetworkInstance: ni,
+		Stage:           stage,
+		Detail:          detail,
+	})
+}
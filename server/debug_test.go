@@ -0,0 +1,145 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/fluent"
+	"github.com/openconfig/gribigo/rib"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestDebugMode(t *testing.T) {
+	elecID := &spb.Uint128{High: 0, Low: 1}
+	def := DefaultNetworkInstanceName
+
+	var (
+		mu     sync.Mutex
+		traces []TraceEvent
+	)
+	traceFn := func(e TraceEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		traces = append(traces, e)
+	}
+	// Complete each event asynchronously, as a dataplane would.
+	hook := func(e rib.RIBEvent) error {
+		go e.Done(nil)
+		return nil
+	}
+
+	s, err := New(WithRIBEventHook(hook), WithDebugMode(), WithDebugTrace(traceFn))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	if !s.DebugMode() {
+		t.Fatalf("DebugMode(): server created with WithDebugMode is not in debug mode")
+	}
+	s.cs["testclient"] = &clientState{
+		params: &clientParams{
+			Persist:      true,
+			ExpectElecID: true,
+			FIBAck:       true,
+		},
+		lastElecID: elecID,
+	}
+	s.curElecID = elecID
+	s.curMaster = "testclient"
+
+	resCh := make(chan *spb.ModifyResponse, 100)
+	errCh := make(chan error, 1)
+	modify := func(id uint64, e fluent.GRIBIEntry) {
+		op, err := e.OpProto()
+		if err != nil {
+			t.Fatalf("cannot build operation, %v", err)
+		}
+		op.Id = id
+		op.Op = spb.AFTOperation_ADD
+		op.ElectionId = elecID
+		s.doModify("testclient", []*spb.AFTOperation{op}, resCh, errCh)
+	}
+
+	// In debug mode, doModify returns only once the operation's event has been
+	// completed, and hence the trace is complete once the operations return.
+	modify(1, fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("192.0.2.1"))
+	modify(2, fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(1, 1))
+	modify(3, fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("198.51.100.0/24").WithNextHopGroup(1))
+
+	opTrace := func(id uint64) []TraceEvent {
+		e := TraceEvent{TraceID: id, OperationID: id, NetworkInstance: def}
+		stages := []struct {
+			stage  TraceStage
+			detail string
+		}{
+			{TraceReceived, "ADD"},
+			{TraceValidated, ""},
+			{TraceRIBApplied, ""},
+			{TraceAck, "RIB_PROGRAMMED"},
+			{TraceHookQueued, ""},
+			{TraceHookDone, ""},
+			{TraceAck, "FIB_PROGRAMMED"},
+		}
+		events := []TraceEvent{}
+		for _, st := range stages {
+			e.Stage, e.Detail = st.stage, st.detail
+			events = append(events, e)
+		}
+		return events
+	}
+	want := append(append(opTrace(1), opTrace(2)...), opTrace(3)...)
+
+	mu.Lock()
+	got := traces
+	traces = nil
+	mu.Unlock()
+	if diff := cmp.Diff(got, want, cmpopts.IgnoreFields(TraceEvent{}, "Time", "Client")); diff != "" {
+		t.Errorf("did not get expected trace, diff(-got,+want):\n%s", diff)
+	}
+	if len(s.debug.ops) != 0 {
+		t.Errorf("operations are still traced after their final results, got: %v", s.debug.ops)
+	}
+
+	s.SetDebugMode(false)
+	if s.DebugMode() {
+		t.Fatalf("DebugMode(): server is in debug mode after it was disabled")
+	}
+	modify(4, fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("203.0.113.0/24").WithNextHopGroup(1))
+	timeout := time.After(10 * time.Second)
+	for acks := 0; acks < 2; {
+		select {
+		case err := <-errCh:
+			t.Fatalf("got unexpected error, %v", err)
+		case <-timeout:
+			t.Fatalf("did not receive results for operation 4 within timeout")
+		case res := <-resCh:
+			for _, r := range res.GetResult() {
+				if r.GetId() == 4 {
+					acks++
+				}
+			}
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(traces) != 0 {
+		t.Errorf("got traces when debug mode was disabled, got: %v", traces)
+	}
+}
@@ -0,0 +1,533 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/rib"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// eventQueue is a queue of RIB events that are handed to a RIBEventFn in the
+// order in which they were queued. Events are handed over serially by a single
+// goroutine, such that the function observes the entries in dependency order;
+// the number of events that it may have outstanding is bounded by the number of
+// slots.
+type eventQueue struct {
+	// fn is the function that events are handed to.
+	fn rib.RIBEventFn
+	// slots has a capacity of the number of events that can be outstanding at
+	// any one time, an event holds a slot until it is completed.
+	slots chan struct{}
+
+	// mu protects the queue, the sequence number of the next event to be queued,
+	// and the state of each queued event.
+	mu sync.Mutex
+	// cond is signalled when an event is added to the queue.
+	cond *sync.Cond
+	// queue is the set of events that have not yet been handed to fn.
+	queue []*queuedEvent
+	// nextSeq is the sequence number of the next event to be queued.
+	nextSeq uint64
+	// stopped indicates that the queue has been stopped, and no further events
+	// should be handed to fn.
+	stopped bool
+	// stopCh is closed when the queue is stopped.
+	stopCh chan struct{}
+
+	// doneMu protects completed, nextDone and finalising.
+	doneMu sync.Mutex
+	// completed stores the completion functions of events that have been
+	// completed but not yet finalised since an event that was queued before
+	// them is still outstanding, keyed by the sequence number of the event.
+	completed map[uint64]func()
+	// nextDone is the sequence number of the next event to be finalised.
+	nextDone uint64
+	// finalising indicates that a call to complete is finalising events.
+	finalising bool
+}
+
+// queuedEvent is an event within an eventQueue.
+type queuedEvent struct {
+	// e is the event that was queued.
+	e rib.RIBEvent
+	// seq is the sequence number of the event, which determines the order in
+	// which it is finalised.
+	seq uint64
+	// once ensures that the event is completed only once.
+	once sync.Once
+
+	// handed indicates that the event has been handed to the queue's function,
+	// such that it holds a slot. It is protected by the queue's mu.
+	handed bool
+	// completed indicates that the event has been completed, either by the
+	// queue's function or since it was abandoned. It is protected by the queue's
+	// mu.
+	completed bool
+}
+
+// newEventQueue returns a queue that hands events to fn, with at most n events
+// outstanding at any one time.
+func newEventQueue(fn rib.RIBEventFn, n int) *eventQueue {
+	q := &eventQueue{
+		fn:        fn,
+		slots:     make(chan struct{}, n),
+		completed: map[uint64]func(){},
+		stopCh:    make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// enqueue adds the event e to the queue. It does not block, such that the caller
+// cannot be blocked by the function that handles events.
+//
+// It returns a function that abandons the event, completing it with the error
+// supplied if it has not already been completed. An abandoned event that has not
+// yet been handed to the queue's function is discarded, and one that has releases
+// its slot, such that an event that has stalled does not prevent the events
+// queued after it from being handed over and finalised. Any subsequent
+// completion of an abandoned event is ignored.
+func (q *eventQueue) enqueue(e rib.RIBEvent) func(error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	qe := &queuedEvent{e: e, seq: q.nextSeq}
+	q.nextSeq++
+	q.queue = append(q.queue, qe)
+	q.cond.Signal()
+	return func(err error) { q.finish(qe, err) }
+}
+
+// next blocks until there is an event within the queue that has not been
+// abandoned, and returns it. It returns false if the queue has been stopped.
+func (q *eventQueue) next() (*queuedEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for len(q.queue) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			return nil, false
+		}
+		qe := q.queue[0]
+		q.queue = q.queue[1:]
+		if !qe.completed {
+			return qe, true
+		}
+	}
+}
+
+// stop stops the queue, such that run returns and the events that remain within
+// the queue are discarded.
+func (q *eventQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return
+	}
+	q.stopped = true
+	close(q.stopCh)
+	q.cond.Broadcast()
+}
+
+// run hands each event within the queue to the queue's function in order, waiting
+// for a slot to be available before each is handed over. It returns once the queue
+// is stopped.
+//
+// Events may be completed by the function in any order, but the Done function of
+// each queued event is called in the order in which the events were queued, such
+// that the FIB_PROGRAMMED results for a set of dependent entries are sent in the
+// order in which they were installed in the RIB. The slot that is held by an event
+// is released as soon as it is completed.
+func (q *eventQueue) run() {
+	for {
+		qe, ok := q.next()
+		if !ok {
+			return
+		}
+		select {
+		case q.slots <- struct{}{}:
+		case <-q.stopCh:
+			return
+		}
+
+		// The event may have been abandoned whilst waiting for a slot, in which
+		// case it is not handed over.
+		q.mu.Lock()
+		if qe.completed {
+			q.mu.Unlock()
+			<-q.slots
+			continue
+		}
+		qe.handed = true
+		q.mu.Unlock()
+
+		e := qe.e
+		e.Done = func(err error) { q.finish(qe, err) }
+		if err := q.fn(e); err != nil {
+			e.Done(err)
+		}
+	}
+}
+
+// finish completes the queued event qe with the error err, releasing the slot
+// that it holds and finalising it once the events queued before it have been
+// finalised. Only the first call for an event has any effect.
+func (q *eventQueue) finish(qe *queuedEvent, err error) {
+	qe.once.Do(func() {
+		q.mu.Lock()
+		handed := qe.handed
+		qe.completed = true
+		q.mu.Unlock()
+		if handed {
+			<-q.slots
+		}
+		done := qe.e.Done
+		q.complete(qe.seq, func() { done(err) })
+	})
+}
+
+// complete records that the event with sequence number seq has been completed, and
+// calls fn once each event that was queued before it has been finalised. Any
+// subsequent events that were waiting for this event are finalised in order.
+//
+// The completion functions are called without doneMu held, since they may block
+// writing results to a client. Only one caller finalises events at any one time,
+// such that they are finalised in order; a caller that completes an event whilst
+// another is finalising leaves its event to be finalised by that caller.
+func (q *eventQueue) complete(seq uint64, fn func()) {
+	q.doneMu.Lock()
+	defer q.doneMu.Unlock()
+	q.completed[seq] = fn
+	if q.finalising {
+		return
+	}
+	q.finalising = true
+	for {
+		f, ok := q.completed[q.nextDone]
+		if !ok {
+			q.finalising = false
+			return
+		}
+		delete(q.completed, q.nextDone)
+		q.nextDone++
+		q.doneMu.Unlock()
+		f()
+		q.doneMu.Lock()
+	}
+}
+
+// queueEvents queues a RIB event for each operation that was installed in the RIB
+// according to the response res, which was sent to the client with ID cid for the
+// operation op within network instance ni. Since op may be pending resolution, it
+// is stored such that an event can be generated when it is installed. If fibACK is
+// set, the result of each event is written to resCh - unless done is closed, or the
+// operation has already been returned as failed since the operation timeout expired.
+//
+// Events are also queued for the operations of other clients that were installed
+// since op resolved them, according to the responses in others, which are keyed by
+// the ID of the client that sent the operation. The results of these events are
+// written to the client that sent each operation, according to its ACK mode. They
+// are queued after the events for the client's own operations, such that the
+// entries that resolve them are programmed first.
+//
+// When the server is in debug mode, it returns a channel for each event that was
+// queued, which is closed when the event has been completed.
+func (s *Server) queueEvents(cid, ni string, op *spb.AFTOperation, res *spb.ModifyResponse, others map[string]*spb.ModifyResponse, fibACK bool, resCh chan *spb.ModifyResponse, done chan struct{}) []chan struct{} {
+	if s.events == nil {
+		return nil
+	}
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+
+	s.pendingEvents[pendingKey{client: cid, id: op.GetId()}] = &pendingOp{ni: ni, op: op}
+	completed := s.queueResultEvents(cid, res, fibACK, resCh, done)
+	for _, ocid := range sortedClients(others) {
+		ocs, ok := s.getClientState(ocid)
+		if !ok || ocs.results == nil {
+			continue
+		}
+		completed = append(completed, s.queueResultEvents(ocid, others[ocid], ocs.params.FIBAck, ocs.results, ocs.done)...)
+	}
+
+	// Remove operations that are no longer pending since they were removed from
+	// the RIB without being installed.
+	for k := range s.pendingEvents {
+		if !s.masterRIB.IsPendingForSession(k.client, k.id) {
+			delete(s.pendingEvents, k)
+		}
+	}
+	return completed
+}
+
+// queueResultEvents queues the events for the results in res of operations sent by
+// the client with ID cid, as per queueEvents. It must be called with eventMu held.
+func (s *Server) queueResultEvents(cid string, res *spb.ModifyResponse, fibACK bool, resCh chan *spb.ModifyResponse, done chan struct{}) []chan struct{} {
+	emit := func(res *spb.ModifyResponse) {
+		s.traceResults(cid, res)
+		select {
+		case resCh <- res:
+		case <-done:
+		}
+	}
+
+	var completed []chan struct{}
+	for _, r := range res.GetResult() {
+		pk := pendingKey{client: cid, id: r.GetId()}
+		p, ok := s.pendingEvents[pk]
+		if !ok {
+			continue
+		}
+		switch r.GetStatus() {
+		case spb.AFTResult_RIB_PROGRAMMED:
+			evEmit := emit
+			tracked := fibACK && s.opTimeout != 0
+			if tracked {
+				evEmit = func(res *spb.ModifyResponse) {
+					if s.completeOperation(pk) {
+						emit(res)
+					}
+				}
+			}
+			if fibACK {
+				// The result is outstanding until it has been sent, such that
+				// the client's stream is not closed before it is delivered.
+				s.startAck(cid)
+				ackEmit := evEmit
+				evEmit = func(res *spb.ModifyResponse) {
+					defer s.endAck(cid)
+					ackEmit(res)
+				}
+			}
+			e := s.trackFIB(p, ribEvent(p, fibACK, evEmit))
+			if s.DebugMode() {
+				var c chan struct{}
+				e, c = s.traceEvent(cid, r.GetId(), e)
+				completed = append(completed, c)
+			}
+			if tracked {
+				s.trackOperation(pk, func() func(error) { return s.events.enqueue(e) })
+			} else {
+				s.events.enqueue(e)
+			}
+			delete(s.pendingEvents, pk)
+		case spb.AFTResult_FAILED:
+			delete(s.pendingEvents, pk)
+		}
+	}
+	return completed
+}
+
+// traceEvent traces that the RIB event e for the operation with ID opID, sent by
+// the client with ID cid, is queued. It returns e with its Done function wrapped
+// such that its completion is traced, and a channel that is closed once it has
+// completed.
+func (s *Server) traceEvent(cid string, opID uint64, e rib.RIBEvent) (rib.RIBEvent, chan struct{}) {
+	s.trace(cid, opID, TraceHookQueued, "")
+	c := make(chan struct{})
+	done := e.Done
+	e.Done = func(err error) {
+		var detail string
+		if err != nil {
+			detail = err.Error()
+		}
+		s.trace(cid, opID, TraceHookDone, detail)
+		done(err)
+		close(c)
+	}
+	return e, c
+}
+
+// ribEvent returns the RIB event for the installed operation p. When the event is
+// completed, the result is written using emit if fibACK is set.
+func ribEvent(p *pendingOp, fibACK bool, emit func(*spb.ModifyResponse)) rib.RIBEvent {
+	id := p.op.GetId()
+	e := rib.RIBEvent{
+		Op:              constants.OpFromAFTOp(p.op.GetOp()),
+		NetworkInstance: p.ni,
+	}
+	a, entry, err := rib.OperationEntry(p.op)
+	if err != nil {
+		log.Errorf("cannot determine entry for operation %d, %v", id, err)
+	}
+	e.AFT, e.Entry = a, entry
+
+	e.Done = func(err error) {
+		res := &spb.AFTResult{
+			Id:     id,
+			Status: spb.AFTResult_FIB_PROGRAMMED,
+		}
+		if err != nil {
+			log.Errorf("RIB event hook failed operation %d, %v", id, err)
+			res.Status = spb.AFTResult_FAILED
+			res.ErrorDetails = &spb.AFTErrorDetails{
+				ErrorMessage: fmt.Sprintf("cannot program entry into FIB, %v", err),
+			}
+		}
+		if !fibACK {
+			return
+		}
+		emit(&spb.ModifyResponse{Result: []*spb.AFTResult{res}})
+	}
+	return e
+}
+
+// fibState is the FIB programming state of an entry.
+type fibState struct {
+	// gen is the generation of the event that most recently changed the
+	// entry, such that the completion of an earlier event for the same entry
+	// does not change its state.
+	gen uint64
+	// programmed indicates that the event completed successfully, such that
+	// the entry is programmed into the FIB.
+	programmed bool
+}
+
+// trackFIB records that the entry changed by the installed operation p is not
+// yet programmed into the FIB, and returns the event e for the operation with
+// its Done function wrapped such that the entry is recorded as programmed once
+// the event is completed without error. The state is updated before the result
+// of the event is sent, such that a client that has received a FIB_PROGRAMMED
+// result observes the entry as programmed in a subsequent Get.
+func (s *Server) trackFIB(p *pendingOp, e rib.RIBEvent) rib.RIBEvent {
+	k, ok := opEntryKey(p.ni, p.op)
+	if !ok {
+		return e
+	}
+	s.fibMu.Lock()
+	defer s.fibMu.Unlock()
+	if p.op.GetOp() == spb.AFTOperation_DELETE {
+		delete(s.fibStatus, k)
+		return e
+	}
+
+	s.fibGen++
+	gen := s.fibGen
+	s.fibStatus[k] = &fibState{gen: gen}
+	done := e.Done
+	e.Done = func(err error) {
+		s.fibMu.Lock()
+		if st, ok := s.fibStatus[k]; ok && st.gen == gen {
+			st.programmed = err == nil
+		}
+		s.fibMu.Unlock()
+		done(err)
+	}
+	return e
+}
+
+// annotateFIBStatus sets the FIB status of the entry e, which is to be returned by
+// the Get RPC, when the FIB is modelled by a function specified by
+// WithRIBEventHook. The status is PROGRAMMED once the event for the operation that
+// most recently changed the entry has completed successfully, and NOT_PROGRAMMED
+// until then, or if it failed - unless it has since been set by SetFIBStatus.
+// Entries that were not installed by an operation for which an event was
+// generated, and whose status has not been set, are left UNAVAILABLE.
+func (s *Server) annotateFIBStatus(e *spb.AFTEntry) {
+	if s.fibStatus == nil {
+		return
+	}
+	k, ok := getEntryKey(e)
+	if !ok {
+		return
+	}
+	s.fibMu.Lock()
+	defer s.fibMu.Unlock()
+	st, ok := s.fibStatus[k]
+	switch {
+	case !ok:
+		return
+	case st.programmed:
+		e.FibStatus = spb.AFTEntry_PROGRAMMED
+	default:
+		e.FibStatus = spb.AFTEntry_NOT_PROGRAMMED
+	}
+}
+
+// SetFIBStatus records whether the entry with the specified key, within the AFT a
+// of network instance ni, is programmed into the FIB. It allows the function
+// specified by WithRIBEventHook to report changes to the FIB that occur after the
+// event for an entry has been completed - for example, an entry that is withdrawn
+// from the FIB since an entry that it is resolved via was removed - such that
+// they are reflected by the Get RPC. The key is a prefix for the IPv4 and IPv6
+// AFTs, and the decimal label, ID or index for other AFTs.
+//
+// The status is replaced when the next event for the entry is generated. It
+// returns an error if the server does not model the FIB, since no function is
+// specified by WithRIBEventHook.
+func (s *Server) SetFIBStatus(ni string, a constants.AFT, key string, programmed bool) error {
+	if s.fibStatus == nil {
+		return errors.New("cannot set FIB status, server does not have a RIB event hook")
+	}
+	k := entryKey{ni: ni, aft: a, key: key}
+	s.fibMu.Lock()
+	defer s.fibMu.Unlock()
+	st, ok := s.fibStatus[k]
+	if !ok {
+		st = &fibState{}
+		s.fibStatus[k] = st
+	}
+	st.programmed = programmed
+	return nil
+}
+
+// flushFIBStatus removes the FIB programming state of all entries within the
+// network instances specified, which have been flushed.
+func (s *Server) flushFIBStatus(nis []string) {
+	if s.fibStatus == nil {
+		return
+	}
+	s.fibMu.Lock()
+	defer s.fibMu.Unlock()
+	flushed := map[string]bool{}
+	for _, ni := range nis {
+		flushed[ni] = true
+	}
+	for k := range s.fibStatus {
+		if flushed[k.ni] {
+			delete(s.fibStatus, k)
+		}
+	}
+}
+
+// getEntryKey returns the key of the entry e returned by the Get RPC. It returns
+// false if the entry type is not known.
+func getEntryKey(e *spb.AFTEntry) (entryKey, bool) {
+	k := entryKey{ni: e.GetNetworkInstance()}
+	switch v := e.GetEntry().(type) {
+	case *spb.AFTEntry_Ipv4:
+		k.aft, k.key = constants.IPv4, v.Ipv4.GetPrefix()
+	case *spb.AFTEntry_Ipv6:
+		k.aft, k.key = constants.IPv6, v.Ipv6.GetPrefix()
+	case *spb.AFTEntry_Mpls:
+		k.aft, k.key = constants.MPLS, fmt.Sprintf("%d", v.Mpls.GetLabelUint64())
+	case *spb.AFTEntry_NextHopGroup:
+		k.aft, k.key = constants.NextHopGroup, fmt.Sprintf("%d", v.NextHopGroup.GetId())
+	case *spb.AFTEntry_NextHop:
+		k.aft, k.key = constants.NextHop, fmt.Sprintf("%d", v.NextHop.GetIndex())
+	case *spb.AFTEntry_PolicyForwardingEntry:
+		k.aft, k.key = constants.PolicyForwarding, fmt.Sprintf("%d", v.PolicyForwardingEntry.GetIndex())
+	default:
+		return entryKey{}, false
+	}
+	return k, true
+}
@@ -0,0 +1,435 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+	"github.com/openconfig/gribigo/rib"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// eventSummary is a summary of a RIB event used for comparison in tests.
+type eventSummary struct {
+	Op  constants.OpType
+	AFT constants.AFT
+	NI  string
+}
+
+func TestRIBEventHook(t *testing.T) {
+	elecID := &spb.Uint128{High: 0, Low: 1}
+	def := DefaultNetworkInstanceName
+
+	nh := fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("192.0.2.1")
+	nhg := fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(1, 1)
+	ipv4 := fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("198.51.100.0/24").WithNextHopGroup(1)
+
+	tests := []struct {
+		desc string
+		// inEntries are the entries that are added, each in its own operation,
+		// with IDs assigned sequentially from 1.
+		inEntries []fluent.GRIBIEntry
+		// inHookErr is returned by the hook for IPv4 entries if non-nil.
+		inHookErr error
+		// inDoneErr is used to complete events for IPv4 entries if non-nil.
+		inDoneErr error
+		// wantEvents is the set of events that are expected, in order.
+		wantEvents []eventSummary
+		// wantFIB is the set of statuses for the FIB results that are expected by
+		// operation ID.
+		wantFIB map[uint64]spb.AFTResult_Status
+	}{{
+		desc:      "entries in dependency order",
+		inEntries: []fluent.GRIBIEntry{nh, nhg, ipv4},
+		wantEvents: []eventSummary{
+			{Op: constants.Add, AFT: constants.NextHop, NI: def},
+			{Op: constants.Add, AFT: constants.NextHopGroup, NI: def},
+			{Op: constants.Add, AFT: constants.IPv4, NI: def},
+		},
+		wantFIB: map[uint64]spb.AFTResult_Status{
+			1: spb.AFTResult_FIB_PROGRAMMED,
+			2: spb.AFTResult_FIB_PROGRAMMED,
+			3: spb.AFTResult_FIB_PROGRAMMED,
+		},
+	}, {
+		desc:      "entries resolved out of order generate events in dependency order",
+		inEntries: []fluent.GRIBIEntry{ipv4, nhg, nh},
+		wantEvents: []eventSummary{
+			{Op: constants.Add, AFT: constants.NextHop, NI: def},
+			{Op: constants.Add, AFT: constants.NextHopGroup, NI: def},
+			{Op: constants.Add, AFT: constants.IPv4, NI: def},
+		},
+		wantFIB: map[uint64]spb.AFTResult_Status{
+			1: spb.AFTResult_FIB_PROGRAMMED,
+			2: spb.AFTResult_FIB_PROGRAMMED,
+			3: spb.AFTResult_FIB_PROGRAMMED,
+		},
+	}, {
+		desc:      "hook rejects entry",
+		inEntries: []fluent.GRIBIEntry{nh, nhg, ipv4},
+		inHookErr: errors.New("no space in FIB"),
+		wantEvents: []eventSummary{
+			{Op: constants.Add, AFT: constants.NextHop, NI: def},
+			{Op: constants.Add, AFT: constants.NextHopGroup, NI: def},
+			{Op: constants.Add, AFT: constants.IPv4, NI: def},
+		},
+		wantFIB: map[uint64]spb.AFTResult_Status{
+			1: spb.AFTResult_FIB_PROGRAMMED,
+			2: spb.AFTResult_FIB_PROGRAMMED,
+			3: spb.AFTResult_FAILED,
+		},
+	}, {
+		desc:      "event completed with error",
+		inEntries: []fluent.GRIBIEntry{nh, nhg, ipv4},
+		inDoneErr: errors.New("hardware error"),
+		wantEvents: []eventSummary{
+			{Op: constants.Add, AFT: constants.NextHop, NI: def},
+			{Op: constants.Add, AFT: constants.NextHopGroup, NI: def},
+			{Op: constants.Add, AFT: constants.IPv4, NI: def},
+		},
+		wantFIB: map[uint64]spb.AFTResult_Status{
+			1: spb.AFTResult_FIB_PROGRAMMED,
+			2: spb.AFTResult_FIB_PROGRAMMED,
+			3: spb.AFTResult_FAILED,
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				events []eventSummary
+			)
+			hook := func(e rib.RIBEvent) error {
+				mu.Lock()
+				events = append(events, eventSummary{Op: e.Op, AFT: e.AFT, NI: e.NetworkInstance})
+				mu.Unlock()
+
+				if e.AFT == constants.IPv4 {
+					if got, ok := e.Entry.(*aft.Afts_Ipv4Entry); !ok || got.GetPrefix() != "198.51.100.0/24" || got.GetNextHopGroup() != 1 {
+						t.Errorf("did not get expected entry in event, got: %v", e.Entry)
+					}
+					if tt.inHookErr != nil {
+						return tt.inHookErr
+					}
+					// Complete the event asynchronously, as a dataplane would.
+					go e.Done(tt.inDoneErr)
+					return nil
+				}
+				go e.Done(nil)
+				return nil
+			}
+
+			s, err := New(WithRIBEventHook(hook))
+			if err != nil {
+				t.Fatalf("cannot create server, %v", err)
+			}
+			s.cs["testclient"] = &clientState{
+				params: &clientParams{
+					Persist:      true,
+					ExpectElecID: true,
+					FIBAck:       true,
+				},
+				lastElecID: elecID,
+			}
+			s.curElecID = elecID
+			s.curMaster = "testclient"
+
+			resCh := make(chan *spb.ModifyResponse, 100)
+			errCh := make(chan error, 1)
+			for i, e := range tt.inEntries {
+				op, err := e.OpProto()
+				if err != nil {
+					t.Fatalf("cannot build operation, %v", err)
+				}
+				op.Id = uint64(i + 1)
+				op.Op = spb.AFTOperation_ADD
+				op.ElectionId = elecID
+				s.doModify("testclient", []*spb.AFTOperation{op}, resCh, errCh)
+			}
+
+			// Each operation must be RIB ACKed before its FIB result is received.
+			ribACKed := map[uint64]bool{}
+			gotFIB := map[uint64]spb.AFTResult_Status{}
+			timeout := time.After(10 * time.Second)
+			for len(gotFIB) != len(tt.wantFIB) {
+				select {
+				case err := <-errCh:
+					t.Fatalf("got unexpected error, %v", err)
+				case <-timeout:
+					t.Fatalf("did not receive expected results within timeout, got FIB results: %v", gotFIB)
+				case res := <-resCh:
+					for _, r := range res.GetResult() {
+						switch r.GetStatus() {
+						case spb.AFTResult_RIB_PROGRAMMED:
+							ribACKed[r.GetId()] = true
+						case spb.AFTResult_FIB_PROGRAMMED, spb.AFTResult_FAILED:
+							if !ribACKed[r.GetId()] {
+								t.Errorf("received FIB result for operation %d before RIB ACK, got: %s", r.GetId(), r)
+							}
+							if r.GetStatus() == spb.AFTResult_FAILED && r.GetErrorDetails().GetErrorMessage() == "" {
+								t.Errorf("did not get error details for failed operation, got: %s", r)
+							}
+							gotFIB[r.GetId()] = r.GetStatus()
+						}
+					}
+				}
+			}
+
+			if diff := cmp.Diff(gotFIB, tt.wantFIB); diff != "" {
+				t.Errorf("did not get expected FIB results, diff(-got,+want):\n%s", diff)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if diff := cmp.Diff(events, tt.wantEvents); diff != "" {
+				t.Errorf("did not get expected events, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestMaxOutstandingRIBEvents(t *testing.T) {
+	// release is closed to complete all outstanding events.
+	release := make(chan struct{})
+	var (
+		mu          sync.Mutex
+		outstanding int
+		maxOut      int
+	)
+	hook := func(e rib.RIBEvent) error {
+		mu.Lock()
+		outstanding++
+		if outstanding > maxOut {
+			maxOut = outstanding
+		}
+		mu.Unlock()
+		go func() {
+			<-release
+			mu.Lock()
+			outstanding--
+			mu.Unlock()
+			e.Done(nil)
+		}()
+		return nil
+	}
+
+	q := newEventQueue(hook, 2)
+	go q.run()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		q.enqueue(rib.RIBEvent{Done: func(error) { wg.Done() }})
+	}
+
+	// Allow the queue to hand over as many events as it will.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxOut != 2 {
+		t.Errorf("did not get expected maximum number of outstanding events, got: %d, want: 2", maxOut)
+	}
+}
+
+func TestRIBEventCompletionOrder(t *testing.T) {
+	const n = 5
+	var (
+		mu     sync.Mutex
+		events []rib.RIBEvent
+	)
+	handed := make(chan struct{}, n)
+	q := newEventQueue(func(e rib.RIBEvent) error {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		handed <- struct{}{}
+		return nil
+	}, n)
+	go q.run()
+
+	var (
+		wg  sync.WaitGroup
+		got []int
+	)
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		q.enqueue(rib.RIBEvent{Done: func(error) {
+			mu.Lock()
+			got = append(got, i)
+			mu.Unlock()
+			wg.Done()
+		}})
+	}
+	for i := 0; i < n; i++ {
+		<-handed
+	}
+
+	// Complete the events in reverse order, the Done functions must still be
+	// called in the order in which the events were queued.
+	mu.Lock()
+	es := append([]rib.RIBEvent{}, events...)
+	mu.Unlock()
+	for i := len(es) - 1; i >= 0; i-- {
+		es[i].Done(nil)
+	}
+	wg.Wait()
+
+	if diff := cmp.Diff(got, []int{0, 1, 2, 3, 4}); diff != "" {
+		t.Errorf("did not get expected completion order, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestGetFIBStatus(t *testing.T) {
+	events := make(chan rib.RIBEvent, 10)
+	hook := func(e rib.RIBEvent) error {
+		events <- e
+		return nil
+	}
+	s, err := NewInProcess(WithRIBEventHook(hook), WithMaxOutstandingRIBEvents(2))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc := startModify(ctx, t, s)
+
+	// send sends req, and waits for its RIB_PROGRAMMED result.
+	send := func(req *spb.ModifyRequest) {
+		t.Helper()
+		if err := mc.Send(req); err != nil {
+			t.Fatalf("cannot send %s, %v", req, err)
+		}
+		res, err := mc.Recv()
+		if err != nil {
+			t.Fatalf("did not get response to %s, %v", req, err)
+		}
+		checkProgrammed(t, res)
+	}
+	// nextEvent returns the next event handed to the hook.
+	nextEvent := func() rib.RIBEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatalf("did not receive RIB event")
+		}
+		return rib.RIBEvent{}
+	}
+	// checkStatus checks that the FIB status of the next-hops returned by Get,
+	// keyed by index, is want.
+	checkStatus := func(desc string, want map[uint64]spb.AFTEntry_Status) {
+		t.Helper()
+		got := map[uint64]spb.AFTEntry_Status{}
+		for _, e := range getAll(ctx, t, s) {
+			got[e.GetNextHop().GetIndex()] = e.GetFibStatus()
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("%s: did not get expected FIB status, diff(-got,+want):\n%s", desc, diff)
+		}
+	}
+
+	// The events are not completed until the entries have been returned by
+	// Get, such that their programming into the FIB is delayed.
+	send(nhAddRequest(1))
+	send(nhAddRequest(2))
+	checkStatus("before programming", map[uint64]spb.AFTEntry_Status{
+		1: spb.AFTEntry_NOT_PROGRAMMED,
+		2: spb.AFTEntry_NOT_PROGRAMMED,
+	})
+
+	nextEvent().Done(nil)
+	nextEvent().Done(errors.New("FIB is full"))
+	checkStatus("after programming", map[uint64]spb.AFTEntry_Status{
+		1: spb.AFTEntry_PROGRAMMED,
+		2: spb.AFTEntry_NOT_PROGRAMMED,
+	})
+
+	// Replacing a programmed entry returns it to NOT_PROGRAMMED until the
+	// event for the replacement is completed.
+	replace := nhAddRequest(1)
+	replace.Operation[0].Id = 3
+	replace.Operation[0].Op = spb.AFTOperation_REPLACE
+	send(replace)
+	checkStatus("before replace programmed", map[uint64]spb.AFTEntry_Status{
+		1: spb.AFTEntry_NOT_PROGRAMMED,
+		2: spb.AFTEntry_NOT_PROGRAMMED,
+	})
+	nextEvent().Done(nil)
+	checkStatus("after replace programmed", map[uint64]spb.AFTEntry_Status{
+		1: spb.AFTEntry_PROGRAMMED,
+		2: spb.AFTEntry_NOT_PROGRAMMED,
+	})
+
+	// Changes to the FIB that are not the result of an event are reported by
+	// the FIB model.
+	if err := s.SetFIBStatus(DefaultNetworkInstanceName, constants.NextHop, "1", false); err != nil {
+		t.Fatalf("cannot set FIB status, %v", err)
+	}
+	if err := s.SetFIBStatus(DefaultNetworkInstanceName, constants.NextHop, "2", true); err != nil {
+		t.Fatalf("cannot set FIB status, %v", err)
+	}
+	checkStatus("after FIB status set", map[uint64]spb.AFTEntry_Status{
+		1: spb.AFTEntry_NOT_PROGRAMMED,
+		2: spb.AFTEntry_PROGRAMMED,
+	})
+}
+
+func TestGetFIBStatusUnavailable(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc := startModify(ctx, t, s)
+	if err := mc.Send(nhAddRequest(1)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	res, err := mc.Recv()
+	if err != nil {
+		t.Fatalf("did not get response, %v", err)
+	}
+	checkProgrammed(t, res)
+
+	// Without a RIB event hook the FIB is not modelled, such that the FIB
+	// status of entries is not reported.
+	for _, e := range getAll(ctx, t, s) {
+		if got := e.GetFibStatus(); got != spb.AFTEntry_UNAVAILABLE {
+			t.Errorf("did not get expected FIB status for %s, got: %s, want: %s", e, got, spb.AFTEntry_UNAVAILABLE)
+		}
+	}
+
+	if err := s.SetFIBStatus(DefaultNetworkInstanceName, constants.NextHop, "1", true); err == nil {
+		t.Errorf("SetFIBStatus(): did not get expected error without a RIB event hook")
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// inProcessBufSize is the size of the buffer used by the in-memory listener for
+// an InProcessServer.
+const inProcessBufSize = 1024 * 1024
+
+// InProcessServer is a gRIBI server that is served over an in-memory listener,
+// such that it can be used without network overhead - for example, in benchmarks.
+type InProcessServer struct {
+	// Server is the gRIBI server that is being served.
+	*Server
+
+	// grpcServer is the gRPC server that Server is registered to.
+	grpcServer *grpc.Server
+	// lis is the in-memory listener that grpcServer is serving on.
+	lis *bufconn.Listener
+	// conn is a client connection to grpcServer.
+	conn *grpc.ClientConn
+}
+
+// NewInProcess creates a new gRIBI server, using the options specified, that is
+// served over an in-memory listener. The returned server has a client connection
+// that is already connected to it, which can be retrieved using Conn.
+func NewInProcess(opt ...ServerOpt) (*InProcessServer, error) {
+	s, err := New(opt...)
+	if err != nil {
+		return nil, err
+	}
+
+	lis := bufconn.Listen(inProcessBufSize)
+	gs := grpc.NewServer()
+	spb.RegisterGRIBIServer(gs, s)
+	go gs.Serve(lis)
+
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		gs.Stop()
+		return nil, fmt.Errorf("cannot connect to in-process server, %v", err)
+	}
+
+	return &InProcessServer{
+		Server:     s,
+		grpcServer: gs,
+		lis:        lis,
+		conn:       conn,
+	}, nil
+}
+
+// Conn returns a client connection to the in-process server.
+func (s *InProcessServer) Conn() *grpc.ClientConn {
+	return s.conn
+}
+
+// Stop closes the client connection to, and stops, the in-process server.
+func (s *InProcessServer) Stop() error {
+	err := s.conn.Close()
+	s.grpcServer.Stop()
+	return err
+}
+
+// GracefulStop gracefully stops the gRIBI server as per Server.GracefulStop, and
+// subsequently closes the client connection and gracefully stops the gRPC server,
+// closing the in-memory listener. If ctx expires before the gRIBI server has
+// stopped, the gRPC server is stopped immediately and the error from ctx is
+// returned.
+func (s *InProcessServer) GracefulStop(ctx context.Context) error {
+	err := s.Server.GracefulStop(ctx)
+	cErr := s.conn.Close()
+	if err != nil {
+		s.grpcServer.Stop()
+		return err
+	}
+	s.grpcServer.GracefulStop()
+	return cErr
+}
@@ -0,0 +1,278 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+	wpb "github.com/openconfig/ygot/proto/ywrapper"
+)
+
+// benchmarkEntries is the number of entries used by each benchmark.
+const benchmarkEntries = 1000
+
+// startModify opens a Modify RPC to the in-process server s, and sends the session
+// parameters and election ID for a SINGLE_PRIMARY client. It returns the stream once
+// the server has responded to both.
+func startModify(ctx context.Context, tb testing.TB, s *InProcessServer) spb.GRIBI_ModifyClient {
+	tb.Helper()
+	mc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+	if err != nil {
+		tb.Fatalf("cannot open Modify RPC, %v", err)
+	}
+	for _, req := range []*spb.ModifyRequest{{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+		},
+	}, {
+		ElectionId: &spb.Uint128{Low: 1},
+	}} {
+		if err := mc.Send(req); err != nil {
+			tb.Fatalf("cannot send %s, %v", req, err)
+		}
+		if _, err := mc.Recv(); err != nil {
+			tb.Fatalf("did not get response to %s, %v", req, err)
+		}
+	}
+	return mc
+}
+
+// nhAddRequest returns a ModifyRequest that adds the next-hop with index i, using
+// the operation ID i.
+func nhAddRequest(i uint64) *spb.ModifyRequest {
+	return &spb.ModifyRequest{
+		Operation: []*spb.AFTOperation{{
+			Id:              i,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{Low: 1},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: i,
+					NextHop: &aftpb.Afts_NextHop{
+						IpAddress: &wpb.StringValue{Value: fmt.Sprintf("10.%d.%d.%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff)},
+					},
+				},
+			},
+		}},
+	}
+}
+
+// checkProgrammed fails the test if res does not contain a programmed result.
+func checkProgrammed(tb testing.TB, res *spb.ModifyResponse) {
+	tb.Helper()
+	if len(res.GetResult()) != 1 || res.GetResult()[0].GetStatus() != spb.AFTResult_RIB_PROGRAMMED {
+		tb.Fatalf("operation was not programmed, got: %s", res)
+	}
+}
+
+func TestInProcess(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc := startModify(ctx, t, s)
+	if err := mc.Send(nhAddRequest(1)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	res, err := mc.Recv()
+	if err != nil {
+		t.Fatalf("did not get response to operation, %v", err)
+	}
+	checkProgrammed(t, res)
+
+	niR, ok := s.masterRIB.NetworkInstanceRIB(DefaultNetworkInstanceName)
+	if !ok {
+		t.Fatalf("cannot find default network instance")
+	}
+	if _, ok := niR.GetNextHop(1); !ok {
+		t.Errorf("next-hop was not installed in the in-process server's RIB")
+	}
+}
+
+func TestGetBatchSize(t *testing.T) {
+	const (
+		entries   = 5000
+		batchSize = 500
+	)
+	s, err := NewInProcess(WithGetBatchSize(batchSize))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := uint64(1); i <= entries; i++ {
+		if _, fails, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, nhAddRequest(i).GetOperation()[0]); err != nil || len(fails) != 0 {
+			t.Fatalf("cannot add next-hop %d, fails: %v, err: %v", i, fails, err)
+		}
+	}
+
+	gc, err := spb.NewGRIBIClient(s.Conn()).Get(ctx, &spb.GetRequest{
+		NetworkInstance: &spb.GetRequest_All{All: &spb.Empty{}},
+		Aft:             spb.AFTType_ALL,
+	})
+	if err != nil {
+		t.Fatalf("cannot open Get RPC, %v", err)
+	}
+	var got, msgs int
+	for {
+		res, err := gc.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("error receiving Get response, %v", err)
+		}
+		if n := len(res.GetEntry()); n == 0 || n > batchSize {
+			t.Errorf("did not get expected number of entries in GetResponse, got: %d, want: between 1 and %d", n, batchSize)
+		}
+		got += len(res.GetEntry())
+		msgs++
+	}
+	if got != entries {
+		t.Errorf("did not get expected number of entries, got: %d, want: %d", got, entries)
+	}
+	if want := entries / batchSize; msgs != want {
+		t.Errorf("did not get expected number of GetResponses, got: %d, want: %d", msgs, want)
+	}
+}
+
+func BenchmarkInProcessSequentialAdd(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		s, err := NewInProcess()
+		if err != nil {
+			b.Fatalf("cannot start in-process server, %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		mc := startModify(ctx, b, s)
+		b.StartTimer()
+
+		for i := uint64(1); i <= benchmarkEntries; i++ {
+			if err := mc.Send(nhAddRequest(i)); err != nil {
+				b.Fatalf("cannot send operation %d, %v", i, err)
+			}
+			res, err := mc.Recv()
+			if err != nil {
+				b.Fatalf("did not get response to operation %d, %v", i, err)
+			}
+			checkProgrammed(b, res)
+		}
+
+		b.StopTimer()
+		cancel()
+		s.Stop()
+	}
+}
+
+func BenchmarkInProcessConcurrentAdd(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		s, err := NewInProcess()
+		if err != nil {
+			b.Fatalf("cannot start in-process server, %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		mc := startModify(ctx, b, s)
+		b.StartTimer()
+
+		// All operations are sent without waiting for the server to respond,
+		// such that they are outstanding concurrently.
+		sendErr := make(chan error, 1)
+		go func() {
+			for i := uint64(1); i <= benchmarkEntries; i++ {
+				if err := mc.Send(nhAddRequest(i)); err != nil {
+					sendErr <- fmt.Errorf("cannot send operation %d, %v", i, err)
+					return
+				}
+			}
+			sendErr <- nil
+		}()
+		for i := 0; i < benchmarkEntries; i++ {
+			res, err := mc.Recv()
+			if err != nil {
+				b.Fatalf("did not get response, %v", err)
+			}
+			checkProgrammed(b, res)
+		}
+		if err := <-sendErr; err != nil {
+			b.Fatalf("%v", err)
+		}
+
+		b.StopTimer()
+		cancel()
+		s.Stop()
+	}
+}
+
+func BenchmarkInProcessGet(b *testing.B) {
+	s, err := NewInProcess()
+	if err != nil {
+		b.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mc := startModify(ctx, b, s)
+	for i := uint64(1); i <= benchmarkEntries; i++ {
+		if err := mc.Send(nhAddRequest(i)); err != nil {
+			b.Fatalf("cannot send operation %d, %v", i, err)
+		}
+		res, err := mc.Recv()
+		if err != nil {
+			b.Fatalf("did not get response to operation %d, %v", i, err)
+		}
+		checkProgrammed(b, res)
+	}
+
+	c := spb.NewGRIBIClient(s.Conn())
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		gc, err := c.Get(ctx, &spb.GetRequest{
+			NetworkInstance: &spb.GetRequest_Name{Name: DefaultNetworkInstanceName},
+			Aft:             spb.AFTType_ALL,
+		})
+		if err != nil {
+			b.Fatalf("cannot open Get RPC, %v", err)
+		}
+		var got int
+		for {
+			res, err := gc.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				b.Fatalf("error receiving Get response, %v", err)
+			}
+			got += len(res.GetEntry())
+		}
+		if got != benchmarkEntries {
+			b.Fatalf("did not get expected number of entries, got: %d, want: %d", got, benchmarkEntries)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/grpc/codes"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// WithMaxIPv4Entries specifies the maximum number of IPv4 entries that can be
+// installed within each network instance of the server. When the limit is
+// reached, an ADD of a new IPv4 entry is returned as FAILED with error details
+// indicating RESOURCE_EXHAUSTED. Replaces and deletes of existing entries are
+// not affected. A limit of zero indicates that the number of entries is not
+// limited.
+func WithMaxIPv4Entries(n uint64) *entryLimit {
+	return &entryLimit{aft: constants.IPv4, n: n}
+}
+
+// WithMaxNHGs specifies the maximum number of next-hop-groups that can be
+// installed within each network instance of the server. The semantics of the
+// limit are as described for WithMaxIPv4Entries.
+func WithMaxNHGs(n uint64) *entryLimit {
+	return &entryLimit{aft: constants.NextHopGroup, n: n}
+}
+
+// WithMaxNHs specifies the maximum number of next-hops that can be installed
+// within each network instance of the server. The semantics of the limit are
+// as described for WithMaxIPv4Entries.
+func WithMaxNHs(n uint64) *entryLimit {
+	return &entryLimit{aft: constants.NextHop, n: n}
+}
+
+// entryLimit is the internal implementation of the options that limit the
+// number of entries within an AFT.
+type entryLimit struct {
+	// aft is the AFT that is limited.
+	aft constants.AFT
+	// n is the maximum number of entries within the AFT.
+	n uint64
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*entryLimit) isServerOpt() {}
+
+// hasEntryLimits returns the limits specified by the entryLimit options within
+// the supplied ServerOpt slice, keyed by AFT.
+func hasEntryLimits(opt []ServerOpt) map[constants.AFT]uint64 {
+	limits := map[constants.AFT]uint64{}
+	for _, o := range opt {
+		if v, ok := o.(*entryLimit); ok && v.n != 0 {
+			limits[v.aft] = v.n
+		}
+	}
+	return limits
+}
+
+// limitedAFTs is the set of AFTs for which the number of entries can be limited.
+var limitedAFTs = map[constants.AFT]bool{
+	constants.IPv4:         true,
+	constants.NextHopGroup: true,
+	constants.NextHop:      true,
+}
+
+// entryLimits stores the maximum number of entries within each AFT of a network
+// instance. Its methods are safe to call on a nil entryLimits, which does not
+// limit any AFT.
+type entryLimits struct {
+	// addMu is held from when an operation is checked against the limits until
+	// it has been applied to the RIB, such that operations that are processed
+	// concurrently cannot together exceed a limit.
+	addMu sync.Mutex
+
+	// mu protects the max map.
+	mu sync.RWMutex
+	// max is the maximum number of entries, keyed by AFT. AFTs that are not
+	// limited are not present.
+	max map[constants.AFT]uint64
+}
+
+// get returns the limit for the AFT a, or zero if it is not limited.
+func (l *entryLimits) get(a constants.AFT) uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.max[a]
+}
+
+// all returns a copy of the current limits, or nil if no AFT is limited.
+func (l *entryLimits) all() map[constants.AFT]uint64 {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.max) == 0 {
+		return nil
+	}
+	ret := map[constants.AFT]uint64{}
+	for a, n := range l.max {
+		ret[a] = n
+	}
+	return ret
+}
+
+// SetEntryLimit sets the maximum number of entries within the AFT a of each
+// network instance to n, such that tests can simulate a change in the size of
+// the device's tables at runtime. A limit of zero removes the limit. Only
+// IPv4, next-hop-group and next-hop AFTs can be limited.
+//
+// Entries that are already installed are not removed if they exceed the new
+// limit, but no further entries can be added until the number of entries is
+// below it.
+func (s *Server) SetEntryLimit(a constants.AFT, n uint64) error {
+	if !limitedAFTs[a] {
+		return fmt.Errorf("cannot limit the number of entries in AFT %s", a)
+	}
+	if s.limits == nil {
+		return fmt.Errorf("server does not support entry limits")
+	}
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+	if n == 0 {
+		delete(s.limits.max, a)
+		return nil
+	}
+	s.limits.max[a] = n
+	return nil
+}
+
+// checkEntryLimit checks whether the operation op within network instance ni
+// would cause the number of entries in the AFT that it refers to to exceed the
+// configured limit. It returns a ModifyResponse containing a failed result for
+// the operation if so, or nil if the operation may proceed. Operations that
+// refer to entries that already exist, or that are to be added by operations
+// that are pending resolution, are always allowed to proceed. Entries that are
+// pending resolution count towards the limit, since they are installed without
+// being checked again once they are resolved.
+//
+// When the AFT is limited and the operation may proceed, the check is not
+// released until the returned function is called, which must be once the
+// operation has been applied to the RIB. The returned function is non-nil.
+func (s *Server) checkEntryLimit(ni string, op *spb.AFTOperation) (*spb.ModifyResponse, func()) {
+	noop := func() {}
+	k, ok := opEntryKey(ni, op)
+	if !ok || s.limits.get(k.aft) == 0 {
+		return nil, noop
+	}
+	niR, ok := s.masterRIB.NetworkInstanceRIB(ni)
+	if !ok {
+		return nil, noop
+	}
+
+	s.limits.addMu.Lock()
+	// The limit is read again, since it may have been changed whilst waiting.
+	limit := s.limits.get(k.aft)
+	if limit == 0 {
+		return nil, s.limits.addMu.Unlock
+	}
+
+	// installed returns true if the entry with key key, of the type returned by
+	// the RIB for the AFT, is installed in the network instance.
+	installed := func(key any) bool {
+		var ok bool
+		switch k.aft {
+		case constants.IPv4:
+			_, ok = niR.GetIPv4Entry(key.(string))
+		case constants.NextHopGroup:
+			_, ok = niR.GetNextHopGroup(key.(uint64))
+		case constants.NextHop:
+			_, ok = niR.GetNextHop(key.(uint64))
+		}
+		return ok
+	}
+
+	var key any
+	switch e := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		key = e.Ipv4.GetPrefix()
+	case *spb.AFTOperation_NextHopGroup:
+		key = e.NextHopGroup.GetId()
+	case *spb.AFTOperation_NextHop:
+		key = e.NextHop.GetIndex()
+	}
+	pending := s.masterRIB.PendingEntryKeys(ni, k.aft)
+	if installed(key) || pending[key] {
+		return nil, s.limits.addMu.Unlock
+	}
+
+	n := niR.EntryCounts()[k.aft]
+	for pk := range pending {
+		if !installed(pk) {
+			n++
+		}
+	}
+	if n < limit {
+		return nil, s.limits.addMu.Unlock
+	}
+	s.limits.addMu.Unlock()
+
+	return &spb.ModifyResponse{
+		Result: []*spb.AFTResult{{
+			Id:     op.GetId(),
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: fmt.Sprintf("%s: cannot install %s %s in network-instance %s, table is full (%d entries)", codes.ResourceExhausted, k.aft, k.key, ni, limit),
+			},
+		}},
+	}, noop
+}
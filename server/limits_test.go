@@ -0,0 +1,222 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/chk"
+	"github.com/openconfig/gribigo/client"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+	"google.golang.org/grpc/codes"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestEntryLimits(t *testing.T) {
+	s, err := NewInProcess(WithMaxNHs(2), WithMaxNHGs(1))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	c.StartSending(context.Background(), t)
+
+	await := func() {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := c.Await(ctx, t); err != nil {
+			t.Fatalf("got unexpected error from client, %v", err)
+		}
+	}
+
+	def := DefaultNetworkInstanceName
+	nh := func(i uint64) fluent.GRIBIEntry {
+		return fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(i).WithIPAddress("192.0.2.1")
+	}
+	c.Modify().AddEntry(t, nh(1), nh(2), nh(3))
+	c.Modify().ReplaceEntry(t, nh(2))
+	await()
+
+	res := c.Results(t)
+	for id, want := range map[uint64]fluent.ProgrammingResult{
+		1: fluent.InstalledInRIB,
+		2: fluent.InstalledInRIB,
+		// The table is full.
+		3: fluent.ProgrammingFailed,
+		// Replacing an existing entry is allowed.
+		4: fluent.InstalledInRIB,
+	} {
+		chk.HasResult(t, res, fluent.OperationResult().WithOperationID(id).WithProgrammingResult(want).AsResult())
+	}
+
+	nh3 := &spb.AFTOperation{
+		Id:    42,
+		Op:    spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: 3}},
+	}
+	got, release := s.checkEntryLimit(def, nh3)
+	release()
+	if got == nil || len(got.GetResult()) != 1 {
+		t.Fatalf("did not get expected result for over-limit operation, got: %v", got)
+	}
+	if r := got.GetResult()[0]; r.GetStatus() != spb.AFTResult_FAILED || !strings.HasPrefix(r.GetErrorDetails().GetErrorMessage(), codes.ResourceExhausted.String()) {
+		t.Errorf("did not get expected failure for over-limit operation, got: %v", r)
+	}
+
+	wantLimits := map[constants.AFT]uint64{
+		constants.NextHop:      2,
+		constants.NextHopGroup: 1,
+	}
+	if diff := cmp.Diff(s.Stats().EntryLimits, wantLimits); diff != "" {
+		t.Errorf("did not get expected limits, diff(-got,+want):\n%s", diff)
+	}
+	if got, want := s.Stats().RIBSize[def][constants.NextHop], uint64(2); got != want {
+		t.Errorf("did not get expected number of next-hops, got: %d, want: %d", got, want)
+	}
+
+	// Increasing the limit at runtime allows further entries to be added.
+	if err := s.SetEntryLimit(constants.NextHop, 3); err != nil {
+		t.Fatalf("cannot set limit, %v", err)
+	}
+	got, release = s.checkEntryLimit(def, nh3)
+	release()
+	if got != nil {
+		t.Errorf("did not get expected result after increasing limit, got: %v, want: nil", got)
+	}
+	if err := s.SetEntryLimit(constants.NextHopGroup, 0); err != nil {
+		t.Fatalf("cannot remove limit, %v", err)
+	}
+	wantLimits = map[constants.AFT]uint64{
+		constants.NextHop: 3,
+	}
+	if diff := cmp.Diff(s.Stats().EntryLimits, wantLimits); diff != "" {
+		t.Errorf("did not get expected limits after update, diff(-got,+want):\n%s", diff)
+	}
+
+	if err := s.SetEntryLimit(constants.MPLS, 1); err == nil {
+		t.Errorf("did not get expected error limiting MPLS entries")
+	}
+}
+
+func TestEntryLimitsPending(t *testing.T) {
+	s, err := NewInProcess(WithMaxIPv4Entries(1), WithPendingResolution(time.Minute))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	c.StartSending(context.Background(), t)
+
+	def := DefaultNetworkInstanceName
+	ipv4 := func(prefix string) fluent.GRIBIEntry {
+		return fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix(prefix).WithNextHopGroup(1)
+	}
+	// The first entry is pending since next-hop-group 1 does not exist, but
+	// counts towards the limit such that the second is rejected.
+	c.Modify().AddEntry(t, ipv4("192.0.2.0/24"), ipv4("198.51.100.0/24"))
+	// The client does not converge whilst the first entry is pending, so the
+	// results are polled until the second entry has been rejected.
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("did not get result for operation 2, got: %v", c.Results(t))
+		}
+		if hasResultFor(c.Results(t), 2) {
+			break
+		}
+	}
+	chk.HasResult(t, c.Results(t), fluent.OperationResult().WithOperationID(2).WithProgrammingResult(fluent.ProgrammingFailed).AsResult())
+	if got := s.masterRIB.PendingEntryKeys(def, constants.IPv4); !got["192.0.2.0/24"] || len(got) != 1 {
+		t.Errorf("did not get expected pending entries, got: %v, want: 192.0.2.0/24", got)
+	}
+}
+
+func TestEntryLimitsConcurrent(t *testing.T) {
+	const (
+		limit      = 5
+		numWorkers = 4
+		numEntries = 10
+	)
+	s, err := New(WithMaxNHs(limit))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	def := DefaultNetworkInstanceName
+	elec := &electionDetails{
+		master:       "testclient",
+		ID:           &spb.Uint128{Low: 1},
+		client:       "testclient",
+		clientLatest: &spb.Uint128{Low: 1},
+	}
+
+	// Each worker checks its operations against the limit and applies them to
+	// the RIB as the Modify RPC does, such that the limit must not be exceeded
+	// however the workers are interleaved.
+	var wg sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < numEntries; j++ {
+				id := uint64(i*numEntries + j + 1)
+				op := &spb.AFTOperation{
+					Id:              id,
+					NetworkInstance: def,
+					Op:              spb.AFTOperation_ADD,
+					ElectionId:      &spb.Uint128{Low: 1},
+					Entry:           &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: id, NextHop: &aftpb.Afts_NextHop{}}},
+				}
+				res, release := s.checkEntryLimit(def, op)
+				if res == nil {
+					if _, _, err := s.modifyAndTrack("testclient", def, op, false, elec); err != nil {
+						t.Errorf("cannot run operation %d, %v", id, err)
+					}
+				}
+				release()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := s.Stats().RIBSize[def][constants.NextHop]; got != limit {
+		t.Errorf("did not get expected number of next-hops, got: %d, want: %d", got, limit)
+	}
+}
+
+// hasResultFor returns true if res contains a result for the operation with ID id.
+func hasResultFor(res []*client.OpResult, id uint64) bool {
+	for _, r := range res {
+		if r.OperationID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// DefaultInstanceMetadataKey is the gRPC metadata key that is used by a Manager
+// to determine the server instance that an RPC is routed to if no other key is
+// specified.
+const DefaultInstanceMetadataKey = "gribigo-instance"
+
+// Manager manages a set of independent gRIBI server instances, each of which has
+// its own RIB, election state and connected clients. The Manager implements the
+// gRIBI service such that all instances can be served on a single gRPC server,
+// with each RPC being routed to an instance based on the value of a gRPC metadata
+// key that is set by the client.
+type Manager struct {
+	*spb.UnimplementedGRIBIServer
+
+	// key is the gRPC metadata key used to select the instance for an RPC.
+	key string
+
+	// mu protects the instances map.
+	mu sync.RWMutex
+	// instances stores the server instances, keyed by name.
+	instances map[string]*Server
+}
+
+// NewManager returns a new Manager that routes RPCs to the instance named by the
+// value of the gRPC metadata key specified. If key is empty,
+// DefaultInstanceMetadataKey is used.
+func NewManager(key string) *Manager {
+	if key == "" {
+		key = DefaultInstanceMetadataKey
+	}
+	return &Manager{
+		key:       key,
+		instances: map[string]*Server{},
+	}
+}
+
+// MetadataKey returns the gRPC metadata key that is used by the manager to route
+// RPCs to instances.
+func (m *Manager) MetadataKey() string {
+	return m.key
+}
+
+// Create creates a new server instance with the specified name, using the options
+// specified. It returns an error if an instance with the name already exists.
+func (m *Manager) Create(name string, opt ...ServerOpt) (*Server, error) {
+	if name == "" {
+		return nil, fmt.Errorf("invalid empty instance name")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.instances[name]; ok {
+		return nil, fmt.Errorf("instance %s already exists", name)
+	}
+	s, err := New(opt...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create instance %s, %v", name, err)
+	}
+	m.instances[name] = s
+	return s, nil
+}
+
+// Delete removes the server instance with the specified name, such that no new
+// RPCs are routed to it, and stops it gracefully as per Server.GracefulStop. It
+// returns an error if the instance does not exist, or if ctx expires before the
+// instance has stopped.
+func (m *Manager) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	s, ok := m.instances[name]
+	delete(m.instances, name)
+	m.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("instance %s does not exist", name)
+	}
+	return s.GracefulStop(ctx)
+}
+
+// Instance returns the server instance with the specified name, and a bool
+// indicating whether it exists.
+func (m *Manager) Instance(name string) (*Server, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.instances[name]
+	return s, ok
+}
+
+// Instances returns the names of the server instances, in sorted order.
+func (m *Manager) Instances() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	names := []string{}
+	for n := range m.instances {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instanceFor returns the server instance that the RPC with the context ctx
+// should be routed to. It returns an error that should be returned to the client
+// if the metadata key is not set, or does not name an existing instance.
+func (m *Manager) instanceFor(ctx context.Context) (*Server, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	v := md.Get(m.key)
+	switch len(v) {
+	case 0:
+		return nil, status.Errorf(codes.InvalidArgument, "metadata key %s must be set to select an instance", m.key)
+	case 1:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "metadata key %s must be set only once, got: %v", m.key, v)
+	}
+	s, ok := m.Instance(v[0])
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "instance %s does not exist", v[0])
+	}
+	return s, nil
+}
+
+// Modify implements the gRIBI Modify RPC, routing it to the instance selected by
+// the metadata of the RPC.
+func (m *Manager) Modify(ms spb.GRIBI_ModifyServer) error {
+	s, err := m.instanceFor(ms.Context())
+	if err != nil {
+		return err
+	}
+	return s.Modify(ms)
+}
+
+// Get implements the gRIBI Get RPC, routing it to the instance selected by the
+// metadata of the RPC.
+func (m *Manager) Get(req *spb.GetRequest, stream spb.GRIBI_GetServer) error {
+	s, err := m.instanceFor(stream.Context())
+	if err != nil {
+		return err
+	}
+	return s.Get(req, stream)
+}
+
+// Flush implements the gRIBI Flush RPC, routing it to the instance selected by
+// the metadata of the RPC.
+func (m *Manager) Flush(ctx context.Context, req *spb.FlushRequest) (*spb.FlushResponse, error) {
+	s, err := m.instanceFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.Flush(ctx, req)
+}
+
+// ManagerStats is a snapshot of the statistics of the instances of a Manager.
+type ManagerStats struct {
+	// Aggregate contains the sum of the statistics of all instances. Client
+	// statistics are keyed by client ID, which is unique across instances,
+	// whilst RIB sizes are summed for network instances of the same name.
+	Aggregate *Stats
+	// Instance contains the statistics of each instance, keyed by instance name.
+	Instance map[string]*Stats
+}
+
+// Stats returns a snapshot of the statistics of each instance managed by m, along
+// with their aggregate.
+func (m *Manager) Stats() *ManagerStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	ms := &ManagerStats{
+		Aggregate: &Stats{
+			AFT:     map[constants.AFT]OperationStats{},
+			Client:  map[string]OperationStats{},
+			RIBSize: map[string]map[constants.AFT]uint64{},
+		},
+		Instance: map[string]*Stats{},
+	}
+	agg := ms.Aggregate
+	for name, s := range m.instances {
+		st := s.Stats()
+		ms.Instance[name] = st
+
+		agg.Operations = addOperationStats(agg.Operations, st.Operations)
+		for a, o := range st.AFT {
+			agg.AFT[a] = addOperationStats(agg.AFT[a], o)
+		}
+		for id, o := range st.Client {
+			agg.Client[id] = addOperationStats(agg.Client[id], o)
+		}
+		agg.GetRequests += st.GetRequests
+		agg.FlushRequests += st.FlushRequests
+		for ni, counts := range st.RIBSize {
+			if agg.RIBSize[ni] == nil {
+				agg.RIBSize[ni] = map[constants.AFT]uint64{}
+			}
+			for a, n := range counts {
+				agg.RIBSize[ni][a] += n
+			}
+		}
+	}
+	return ms
+}
+
+// addOperationStats returns the sum of a and b.
+func addOperationStats(a, b OperationStats) OperationStats {
+	return OperationStats{
+		Received: a.Received + b.Received,
+		Accepted: a.Accepted + b.Accepted,
+		NACKed:   a.NACKed + b.NACKed,
+	}
+}
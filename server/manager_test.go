@@ -0,0 +1,232 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// startManager serves m on an in-memory listener, returning a client connection
+// to it.
+func startManager(t *testing.T, m *Manager) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(inProcessBufSize)
+	gs := grpc.NewServer()
+	spb.RegisterGRIBIServer(gs, m)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		t.Fatalf("cannot connect to manager, %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestManager(t *testing.T) {
+	m := NewManager("")
+	for _, n := range []string{"dut1", "dut2"} {
+		if _, err := m.Create(n); err != nil {
+			t.Fatalf("cannot create instance %s, %v", n, err)
+		}
+	}
+	if _, err := m.Create("dut1"); err == nil {
+		t.Fatalf("did not get expected error creating duplicate instance")
+	}
+	if diff := cmp.Diff(m.Instances(), []string{"dut1", "dut2"}); diff != "" {
+		t.Fatalf("did not get expected instances, diff(-got,+want):\n%s", diff)
+	}
+
+	conn := startManager(t, m)
+
+	def := DefaultNetworkInstanceName
+	entries := map[string][]fluent.GRIBIEntry{
+		"dut1": {
+			fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("192.0.2.1"),
+		},
+		"dut2": {
+			fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(2).WithIPAddress("192.0.2.2"),
+			fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(2).AddNextHop(2, 1),
+		},
+	}
+
+	clients := map[string]*fluent.GRIBIClient{}
+	for _, n := range []string{"dut1", "dut2"} {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), DefaultInstanceMetadataKey, n)
+		c := fluent.NewClient()
+		c.Connection().WithStub(spb.NewGRIBIClient(conn)).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+		c.Start(ctx, t)
+		defer c.Stop(t)
+		c.StartSending(ctx, t)
+		c.Modify().AddEntry(t, entries[n]...)
+
+		actx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := c.Await(actx, t); err != nil {
+			t.Fatalf("got unexpected error from client for %s, %v", n, err)
+		}
+		clients[n] = c
+	}
+
+	wantNH := map[string][]uint64{
+		"dut1": {1},
+		"dut2": {2},
+	}
+	wantNHG := map[string][]uint64{
+		"dut1": nil,
+		"dut2": {2},
+	}
+	for n, c := range clients {
+		res, err := c.Get().WithNetworkInstance(def).WithAFT(fluent.AllAFTs).Send()
+		if err != nil {
+			t.Fatalf("cannot send Get to %s, %v", n, err)
+		}
+		var gotNH, gotNHG []uint64
+		for _, e := range res.GetEntry() {
+			switch v := e.GetEntry().(type) {
+			case *spb.AFTEntry_NextHop:
+				gotNH = append(gotNH, v.NextHop.GetIndex())
+			case *spb.AFTEntry_NextHopGroup:
+				gotNHG = append(gotNHG, v.NextHopGroup.GetId())
+			default:
+				t.Errorf("got unexpected entry from %s, %s", n, e)
+			}
+		}
+		if diff := cmp.Diff(gotNH, wantNH[n]); diff != "" {
+			t.Errorf("did not get expected next-hops from %s, diff(-got,+want):\n%s", n, diff)
+		}
+		if diff := cmp.Diff(gotNHG, wantNHG[n]); diff != "" {
+			t.Errorf("did not get expected next-hop-groups from %s, diff(-got,+want):\n%s", n, diff)
+		}
+	}
+
+	s1, ok := m.Instance("dut1")
+	if !ok {
+		t.Fatalf("cannot find instance dut1")
+	}
+	niR, ok := s1.masterRIB.NetworkInstanceRIB(def)
+	if !ok {
+		t.Fatalf("cannot find default network instance for dut1")
+	}
+	if _, ok := niR.GetNextHop(1); !ok {
+		t.Errorf("next-hop 1 was not installed in dut1")
+	}
+	if _, ok := niR.GetNextHop(2); ok {
+		t.Errorf("next-hop 2 was installed in dut1")
+	}
+
+	st := m.Stats()
+	for n, want := range map[string]OperationStats{
+		"dut1": {Received: 1, Accepted: 1},
+		"dut2": {Received: 2, Accepted: 2},
+	} {
+		if diff := cmp.Diff(st.Instance[n].Operations, want); diff != "" {
+			t.Errorf("did not get expected statistics for %s, diff(-got,+want):\n%s", n, diff)
+		}
+	}
+	if diff := cmp.Diff(st.Aggregate.Operations, OperationStats{Received: 3, Accepted: 3}); diff != "" {
+		t.Errorf("did not get expected aggregate statistics, diff(-got,+want):\n%s", diff)
+	}
+	if got, want := st.Aggregate.RIBSize[def][constants.NextHop], uint64(2); got != want {
+		t.Errorf("did not get expected aggregate next-hop count, got: %d, want: %d", got, want)
+	}
+	if got, want := len(st.Aggregate.Client), 2; got != want {
+		t.Errorf("did not get expected number of aggregate clients, got: %d, want: %d", got, want)
+	}
+	if got, want := st.Aggregate.GetRequests, uint64(2); got != want {
+		t.Errorf("did not get expected aggregate Get requests, got: %d, want: %d", got, want)
+	}
+
+	dctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Close the client to dut1 such that the instance can stop gracefully.
+	clients["dut1"].Stop(t)
+	if err := m.Delete(dctx, "dut1"); err != nil {
+		t.Fatalf("cannot delete instance dut1, %v", err)
+	}
+	if err := m.Delete(dctx, "dut1"); err == nil {
+		t.Fatalf("did not get expected error deleting non-existent instance")
+	}
+	if _, ok := m.Instance("dut1"); ok {
+		t.Fatalf("instance dut1 exists after being deleted")
+	}
+}
+
+func TestManagerRouting(t *testing.T) {
+	m := NewManager("device")
+	if _, err := m.Create("dut1"); err != nil {
+		t.Fatalf("cannot create instance, %v", err)
+	}
+	conn := startManager(t, m)
+
+	tests := []struct {
+		desc     string
+		inMD     []string
+		wantCode codes.Code
+	}{{
+		desc:     "no metadata",
+		wantCode: codes.InvalidArgument,
+	}, {
+		desc:     "unknown instance",
+		inMD:     []string{"device", "dut2"},
+		wantCode: codes.NotFound,
+	}, {
+		desc:     "default key is not used",
+		inMD:     []string{DefaultInstanceMetadataKey, "dut1"},
+		wantCode: codes.InvalidArgument,
+	}, {
+		desc:     "multiple values",
+		inMD:     []string{"device", "dut1", "device", "dut1"},
+		wantCode: codes.InvalidArgument,
+	}, {
+		desc:     "routed to instance",
+		inMD:     []string{"device", "dut1"},
+		wantCode: codes.OK,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(context.Background(), tt.inMD...)
+			_, err := spb.NewGRIBIClient(conn).Flush(ctx, &spb.FlushRequest{
+				NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+			})
+			if got := status.Code(err); got != tt.wantCode {
+				t.Fatalf("did not get expected error code, got: %s (%v), want: %s", got, err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/grpc/codes"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// NetworkInstanceType is the type of a network instance, corresponding to the
+// identities derived from NETWORK_INSTANCE_TYPE in the OpenConfig
+// network-instance model.
+type NetworkInstanceType int64
+
+const (
+	_ NetworkInstanceType = iota
+	// DefaultInstance is the default network instance of the device.
+	DefaultInstance
+	// L3VRF is a layer 3 VRF.
+	L3VRF
+	// L2VSI is a layer 2 virtual switch instance.
+	L2VSI
+	// L2P2P is a layer 2 point-to-point instance.
+	L2P2P
+	// L2L3 is an instance that supports both layer 2 and layer 3 forwarding.
+	L2L3
+)
+
+func (n NetworkInstanceType) String() string {
+	return map[NetworkInstanceType]string{
+		DefaultInstance: "DEFAULT_INSTANCE",
+		L3VRF:           "L3VRF",
+		L2VSI:           "L2VSI",
+		L2P2P:           "L2P2P",
+		L2L3:            "L2L3",
+	}[n]
+}
+
+// NetworkInstanceCompatibility is a matrix describing the AFTs that can be
+// programmed within a network instance of each type. An AFT that is not
+// present for a type, or a type that is not present in the matrix, cannot be
+// programmed.
+type NetworkInstanceCompatibility map[NetworkInstanceType]map[constants.AFT]bool
+
+// l3AFTs is the set of AFTs that can be programmed in a network instance that
+// performs layer 3 forwarding.
+var l3AFTs = []constants.AFT{
+	constants.IPv4,
+	constants.IPv6,
+	constants.MPLS,
+	constants.NextHopGroup,
+	constants.NextHop,
+	constants.PolicyForwarding,
+}
+
+// DefaultNetworkInstanceCompatibility returns the matrix of AFTs that can be
+// programmed in each type of network instance as per the OpenConfig semantics
+// of the network instance types. Layer 3 entries can be programmed in the
+// DEFAULT_INSTANCE, L3VRF and L2L3 types, whereas no gRIBI AFT can be
+// programmed within the L2VSI and L2P2P types. A new matrix is returned on each
+// call, such that callers can modify it before supplying it to
+// WithNetworkInstanceCompatibility.
+func DefaultNetworkInstanceCompatibility() NetworkInstanceCompatibility {
+	m := NetworkInstanceCompatibility{
+		L2VSI: {},
+		L2P2P: {},
+	}
+	for _, t := range []NetworkInstanceType{DefaultInstance, L3VRF, L2L3} {
+		m[t] = map[constants.AFT]bool{}
+		for _, a := range l3AFTs {
+			m[t][a] = true
+		}
+	}
+	return m
+}
+
+// WithNetworkInstanceTypes specifies that the server should be initialised with
+// the network instances in the supplied map, keyed by name, of the type
+// specified by the map's value. It is used to provide the server with the
+// network instances that would be created by the bootstrap configuration of a
+// device. Operations that refer to an AFT that cannot be programmed within the
+// type of the network instance they specify are returned to the client as
+// FAILED.
+//
+// Network instances that are created using WithVRFs are of type L3VRF, and the
+// default network instance is of type DefaultInstance.
+func WithNetworkInstanceTypes(nis map[string]NetworkInstanceType) *withNetworkInstanceTypes {
+	return &withNetworkInstanceTypes{nis: nis}
+}
+
+// withNetworkInstanceTypes is the internal implementation of
+// WithNetworkInstanceTypes that can be read by the server.
+type withNetworkInstanceTypes struct {
+	nis map[string]NetworkInstanceType
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*withNetworkInstanceTypes) isServerOpt() {}
+
+// hasNetworkInstanceTypes checks whether the ServerOpt slice supplied contains
+// the withNetworkInstanceTypes option and returns the network instances it
+// specifies if so.
+func hasNetworkInstanceTypes(opt []ServerOpt) map[string]NetworkInstanceType {
+	for _, o := range opt {
+		if v, ok := o.(*withNetworkInstanceTypes); ok {
+			return v.nis
+		}
+	}
+	return nil
+}
+
+// WithNetworkInstanceCompatibility specifies the matrix that is used to
+// determine whether an AFT can be programmed in a network instance of a
+// particular type, replacing the matrix returned by
+// DefaultNetworkInstanceCompatibility. It can be used to reflect
+// implementation-specific behaviour of a device.
+func WithNetworkInstanceCompatibility(m NetworkInstanceCompatibility) *withNetworkInstanceCompatibility {
+	return &withNetworkInstanceCompatibility{m: m}
+}
+
+// withNetworkInstanceCompatibility is the internal implementation of
+// WithNetworkInstanceCompatibility that can be read by the server.
+type withNetworkInstanceCompatibility struct {
+	m NetworkInstanceCompatibility
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*withNetworkInstanceCompatibility) isServerOpt() {}
+
+// hasNetworkInstanceCompatibility checks whether the ServerOpt slice supplied
+// contains the withNetworkInstanceCompatibility option and returns the matrix
+// it specifies if so. If it is not present, the default matrix is returned.
+func hasNetworkInstanceCompatibility(opt []ServerOpt) NetworkInstanceCompatibility {
+	for _, o := range opt {
+		if v, ok := o.(*withNetworkInstanceCompatibility); ok {
+			return v.m
+		}
+	}
+	return DefaultNetworkInstanceCompatibility()
+}
+
+// checkNetworkInstanceType checks whether the AFT that the operation op refers
+// to can be programmed within network instance ni based on the type of the
+// network instance. It returns a ModifyResponse containing a failed result for
+// the operation if not, or nil if the operation may proceed. Operations within
+// network instances whose type is not known are always allowed to proceed.
+func (s *Server) checkNetworkInstanceType(ni string, op *spb.AFTOperation) *spb.ModifyResponse {
+	niType, ok := s.niTypes[ni]
+	if !ok {
+		return nil
+	}
+	k, ok := opEntryKey(ni, op)
+	if !ok || s.niCompat[niType][k.aft] {
+		return nil
+	}
+
+	return &spb.ModifyResponse{
+		Result: []*spb.AFTResult{{
+			Id:     op.GetId(),
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: fmt.Sprintf("%s: cannot install %s %s in network-instance %s of type %s, %s entries are not supported by the network-instance type", codes.FailedPrecondition, k.aft, k.key, ni, niType, k.aft),
+			},
+		}},
+	}
+}
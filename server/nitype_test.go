@@ -0,0 +1,131 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/openconfig/gribigo/constants"
+	"google.golang.org/grpc/codes"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestCheckNetworkInstanceType(t *testing.T) {
+	ipv4 := &spb.AFTOperation{
+		Id:    1,
+		Op:    spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_Ipv4{Ipv4: &aftpb.Afts_Ipv4EntryKey{Prefix: "192.0.2.0/24"}},
+	}
+	nh := &spb.AFTOperation{
+		Id:    2,
+		Op:    spb.AFTOperation_ADD,
+		Entry: &spb.AFTOperation_NextHop{NextHop: &aftpb.Afts_NextHopKey{Index: 1}},
+	}
+
+	// quirk allows next-hops, but not IPv4 entries, within an L2VSI.
+	quirk := DefaultNetworkInstanceCompatibility()
+	quirk[L2VSI][constants.NextHop] = true
+
+	tests := []struct {
+		desc        string
+		inOpts      []ServerOpt
+		inNI        string
+		inOp        *spb.AFTOperation
+		wantFail    bool
+		wantMessage []string
+	}{{
+		desc: "IPv4 in default network instance",
+		inNI: DefaultNetworkInstanceName,
+		inOp: ipv4,
+	}, {
+		desc:   "IPv4 in L3VRF",
+		inOpts: []ServerOpt{WithVRFs([]string{"VRF-A"})},
+		inNI:   "VRF-A",
+		inOp:   ipv4,
+	}, {
+		desc:   "IPv4 in L2L3 instance",
+		inOpts: []ServerOpt{WithNetworkInstanceTypes(map[string]NetworkInstanceType{"IRB": L2L3})},
+		inNI:   "IRB",
+		inOp:   ipv4,
+	}, {
+		desc:        "IPv4 in L2VSI",
+		inOpts:      []ServerOpt{WithNetworkInstanceTypes(map[string]NetworkInstanceType{"L2": L2VSI})},
+		inNI:        "L2",
+		inOp:        ipv4,
+		wantFail:    true,
+		wantMessage: []string{codes.FailedPrecondition.String(), "network-instance L2", "type L2VSI", "IPv4"},
+	}, {
+		desc:        "next-hop in L2P2P",
+		inOpts:      []ServerOpt{WithNetworkInstanceTypes(map[string]NetworkInstanceType{"PW": L2P2P})},
+		inNI:        "PW",
+		inOp:        nh,
+		wantFail:    true,
+		wantMessage: []string{"type L2P2P", "NextHop"},
+	}, {
+		desc: "next-hop in L2VSI allowed by modified matrix",
+		inOpts: []ServerOpt{
+			WithNetworkInstanceTypes(map[string]NetworkInstanceType{"L2": L2VSI}),
+			WithNetworkInstanceCompatibility(quirk),
+		},
+		inNI: "L2",
+		inOp: nh,
+	}, {
+		desc: "IPv4 in L2VSI with modified matrix",
+		inOpts: []ServerOpt{
+			WithNetworkInstanceTypes(map[string]NetworkInstanceType{"L2": L2VSI}),
+			WithNetworkInstanceCompatibility(quirk),
+		},
+		inNI:     "L2",
+		inOp:     ipv4,
+		wantFail: true,
+	}, {
+		desc:     "type missing from matrix",
+		inOpts:   []ServerOpt{WithNetworkInstanceCompatibility(NetworkInstanceCompatibility{})},
+		inNI:     DefaultNetworkInstanceName,
+		inOp:     ipv4,
+		wantFail: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := New(tt.inOpts...)
+			if err != nil {
+				t.Fatalf("cannot create server, %v", err)
+			}
+			got := s.checkNetworkInstanceType(tt.inNI, tt.inOp)
+			if !tt.wantFail {
+				if got != nil {
+					t.Fatalf("did not get expected result, got: %v, want: nil", got)
+				}
+				return
+			}
+			if got == nil || len(got.GetResult()) != 1 {
+				t.Fatalf("did not get expected failure, got: %v", got)
+			}
+			r := got.GetResult()[0]
+			if r.GetId() != tt.inOp.GetId() || r.GetStatus() != spb.AFTResult_FAILED {
+				t.Errorf("did not get expected result, got: %v", r)
+			}
+			for _, m := range tt.wantMessage {
+				if !strings.Contains(r.GetErrorDetails().GetErrorMessage(), m) {
+					t.Errorf("did not find %q in error message, got: %s", m, r.GetErrorDetails().GetErrorMessage())
+				}
+			}
+		})
+	}
+}
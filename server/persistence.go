@@ -0,0 +1,297 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/golang/glog"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/prototext"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// PersistenceBackend is a store for the entries within the network instances of
+// the server's RIB, such that they persist across a restart of the server.
+type PersistenceBackend interface {
+	// Save replaces the stored entries of the network instance ni with entries.
+	Save(ni string, entries []*spb.AFTEntry) error
+	// Load returns the stored entries of the network instance ni. It returns
+	// no entries, and no error, if nothing is stored for ni.
+	Load(ni string) ([]*spb.AFTEntry, error)
+	// Delete removes the stored entries of the network instance ni. It does
+	// not return an error if nothing is stored for ni.
+	Delete(ni string) error
+}
+
+// WithPersistence specifies that the entries within the server's RIB should be
+// stored using backend. When the server is created, the entries that are stored
+// for each of its network instances are loaded and installed in its RIB before it
+// accepts any connections. Entries that cannot be installed are logged, and do not
+// prevent the remaining entries from being restored.
+//
+// The stored entries of a network instance are replaced once each Modify request
+// that contains operations for it has been processed, and are removed when it is
+// flushed.
+func WithPersistence(backend PersistenceBackend) *persistence {
+	return &persistence{backend: backend}
+}
+
+// persistence is the internal implementation of the WithPersistence option.
+type persistence struct {
+	backend PersistenceBackend
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*persistence) isServerOpt() {}
+
+// hasPersistence returns the PersistenceBackend specified in the ServerOpt slice
+// supplied, or nil if it is not present.
+func hasPersistence(opt []ServerOpt) PersistenceBackend {
+	for _, o := range opt {
+		if v, ok := o.(*persistence); ok {
+			return v.backend
+		}
+	}
+	return nil
+}
+
+// FilePersistenceBackend is a PersistenceBackend that stores the entries of each
+// network instance in a separate file within a directory. Each file contains the
+// entries as a sequence of length-delimited AFTEntry protobufs.
+type FilePersistenceBackend struct {
+	// dir is the directory within which the files are stored.
+	dir string
+	// mu serialises access to the files.
+	mu sync.Mutex
+}
+
+// NewFilePersistenceBackend returns a FilePersistenceBackend that stores entries
+// within the directory dir, which is created if it does not exist.
+func NewFilePersistenceBackend(dir string) (*FilePersistenceBackend, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create persistence directory %s, %v", dir, err)
+	}
+	return &FilePersistenceBackend{dir: dir}, nil
+}
+
+// path returns the path of the file that stores the entries of the network
+// instance ni.
+func (f *FilePersistenceBackend) path(ni string) string {
+	return filepath.Join(f.dir, url.PathEscape(ni)+".pb")
+}
+
+// Save implements the PersistenceBackend interface. The file is replaced
+// atomically, such that a Save that is interrupted does not corrupt the entries
+// that were previously stored.
+func (f *FilePersistenceBackend) Save(ni string, entries []*spb.AFTEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := f.path(ni)
+	tmp := path + ".tmp"
+	fh, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("cannot create file for network instance %s, %v", ni, err)
+	}
+	w := bufio.NewWriter(fh)
+	for _, e := range entries {
+		if _, err := protodelim.MarshalTo(w, e); err != nil {
+			fh.Close()
+			return fmt.Errorf("cannot write entry %s, %v", prototext.Format(e), err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return fmt.Errorf("cannot write entries for network instance %s, %v", ni, err)
+	}
+	if err := fh.Close(); err != nil {
+		return fmt.Errorf("cannot write entries for network instance %s, %v", ni, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("cannot replace file for network instance %s, %v", ni, err)
+	}
+	return nil
+}
+
+// Load implements the PersistenceBackend interface.
+func (f *FilePersistenceBackend) Load(ni string) ([]*spb.AFTEntry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fh, err := os.Open(f.path(ni))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("cannot open file for network instance %s, %v", ni, err)
+	}
+	defer fh.Close()
+
+	r := bufio.NewReader(fh)
+	var entries []*spb.AFTEntry
+	for {
+		e := &spb.AFTEntry{}
+		err := protodelim.UnmarshalFrom(r, e)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read entry for network instance %s, %v", ni, err)
+		}
+		entries = append(entries, e)
+	}
+}
+
+// Delete implements the PersistenceBackend interface.
+func (f *FilePersistenceBackend) Delete(ni string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Remove(f.path(ni)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("cannot remove file for network instance %s, %v", ni, err)
+	}
+	return nil
+}
+
+// restorePersisted installs the entries that are stored by the server's
+// persistence backend for each of its network instances in its RIB.
+func (s *Server) restorePersisted() error {
+	nis := s.masterRIB.KnownNetworkInstances()
+	sort.Strings(nis)
+	stored := map[string][]*spb.AFTEntry{}
+	for _, ni := range nis {
+		entries, err := s.persistence.Load(ni)
+		if err != nil {
+			return fmt.Errorf("cannot load persisted entries, %v", err)
+		}
+		stored[ni] = entries
+	}
+
+	// Next-hops are installed first, followed by next-hop-groups, since all other
+	// entries reference next-hop-groups, across all network instances.
+	var ops []*spb.AFTOperation
+	for _, pass := range []func(*spb.AFTOperation) bool{
+		func(op *spb.AFTOperation) bool { return op.GetNextHop() != nil },
+		func(op *spb.AFTOperation) bool { return op.GetNextHopGroup() != nil },
+		func(op *spb.AFTOperation) bool { return op.GetNextHop() == nil && op.GetNextHopGroup() == nil },
+	} {
+		for _, ni := range nis {
+			for _, e := range stored[ni] {
+				op, err := persistedOp(ni, e)
+				if err != nil {
+					log.Warningf("entry not restored from persistence backend, %v", err)
+					continue
+				}
+				if pass(op) {
+					op.Id = uint64(len(ops) + 1)
+					ops = append(ops, op)
+				}
+			}
+		}
+	}
+
+	for _, op := range ops {
+		_, fails, err := s.masterRIB.AddEntry(op.GetNetworkInstance(), op)
+		if err != nil {
+			log.Warningf("entry not restored from persistence backend, cannot add %s, %v", prototext.Format(op), err)
+			continue
+		}
+		for _, f := range fails {
+			log.Warningf("entry not restored from persistence backend, cannot add %s, %s", prototext.Format(f.Op), f.Error)
+		}
+	}
+	// Entries that are still pending cannot be resolved, and are removed such that
+	// their operation IDs do not remain in the RIB.
+	for _, op := range ops {
+		if s.masterRIB.RemovePending(op.GetId()) {
+			log.Warningf("entry not restored from persistence backend, unresolved references for %s", prototext.Format(op))
+		}
+	}
+	log.Infof("restored %d entries from persistence backend", len(ops))
+	return nil
+}
+
+// persistedOp returns an operation that adds the entry e, which was stored for
+// the network instance ni.
+func persistedOp(ni string, e *spb.AFTEntry) (*spb.AFTOperation, error) {
+	op := &spb.AFTOperation{NetworkInstance: ni, Op: spb.AFTOperation_ADD}
+	switch v := e.GetEntry().(type) {
+	case *spb.AFTEntry_Ipv4:
+		op.Entry = &spb.AFTOperation_Ipv4{Ipv4: v.Ipv4}
+	case *spb.AFTEntry_Ipv6:
+		op.Entry = &spb.AFTOperation_Ipv6{Ipv6: v.Ipv6}
+	case *spb.AFTEntry_Mpls:
+		op.Entry = &spb.AFTOperation_Mpls{Mpls: v.Mpls}
+	case *spb.AFTEntry_NextHopGroup:
+		op.Entry = &spb.AFTOperation_NextHopGroup{NextHopGroup: v.NextHopGroup}
+	case *spb.AFTEntry_NextHop:
+		op.Entry = &spb.AFTOperation_NextHop{NextHop: v.NextHop}
+	case *spb.AFTEntry_PolicyForwardingEntry:
+		op.Entry = &spb.AFTOperation_PolicyForwardingEntry{PolicyForwardingEntry: v.PolicyForwardingEntry}
+	default:
+		return nil, fmt.Errorf("unsupported entry type %T in network instance %s", v, ni)
+	}
+	return op, nil
+}
+
+// persist replaces the entries that are stored by the server's persistence
+// backend for each of the network instances nis with their current contents. The
+// entries of a network instance that is empty are removed from the backend.
+func (s *Server) persist(nis []string) {
+	if s.persistence == nil {
+		return
+	}
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	snap := s.masterRIB.Snapshot()
+	defer snap.Release()
+	for _, ni := range nis {
+		msgCh := make(chan *spb.GetResponse)
+		errCh := make(chan error, 1)
+		go func() {
+			defer close(msgCh)
+			errCh <- snap.GetRIB(ni, map[spb.AFTType]bool{spb.AFTType_ALL: true}, msgCh, nil)
+		}()
+		var entries []*spb.AFTEntry
+		for res := range msgCh {
+			entries = append(entries, res.GetEntry()...)
+		}
+		if err := <-errCh; err != nil {
+			log.Errorf("cannot persist network instance %s, %v", ni, err)
+			continue
+		}
+
+		var err error
+		switch len(entries) {
+		case 0:
+			err = s.persistence.Delete(ni)
+		default:
+			err = s.persistence.Save(ni, entries)
+		}
+		if err != nil {
+			log.Errorf("cannot persist network instance %s, %v", ni, err)
+		}
+	}
+}
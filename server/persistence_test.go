@@ -0,0 +1,131 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestFilePersistenceBackend(t *testing.T) {
+	b, err := NewFilePersistenceBackend(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFilePersistenceBackend(): got unexpected error, %v", err)
+	}
+
+	// Network instance names are not required to be valid file names.
+	ni := "vrf/one"
+	if got, err := b.Load(ni); err != nil || got != nil {
+		t.Fatalf("Load(%s): did not get expected result for unknown network instance, got: %v, err: %v", ni, got, err)
+	}
+
+	want := []*spb.AFTEntry{{
+		NetworkInstance: ni,
+		Entry: &spb.AFTEntry_NextHop{
+			NextHop: &aftpb.Afts_NextHopKey{Index: 1},
+		},
+	}, {
+		NetworkInstance: ni,
+		Entry: &spb.AFTEntry_NextHop{
+			NextHop: &aftpb.Afts_NextHopKey{Index: 2},
+		},
+	}}
+	if err := b.Save(ni, want); err != nil {
+		t.Fatalf("Save(%s): got unexpected error, %v", ni, err)
+	}
+	got, err := b.Load(ni)
+	if err != nil {
+		t.Fatalf("Load(%s): got unexpected error, %v", ni, err)
+	}
+	if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+		t.Errorf("Load(%s): did not get expected entries, diff(-got,+want):\n%s", ni, diff)
+	}
+
+	if err := b.Delete(ni); err != nil {
+		t.Fatalf("Delete(%s): got unexpected error, %v", ni, err)
+	}
+	if got, err := b.Load(ni); err != nil || got != nil {
+		t.Errorf("Load(%s): did not get expected result after Delete, got: %v, err: %v", ni, got, err)
+	}
+	if err := b.Delete(ni); err != nil {
+		t.Errorf("Delete(%s): got unexpected error for network instance that is not stored, %v", ni, err)
+	}
+}
+
+func TestPersistenceRestore(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b, err := NewFilePersistenceBackend(dir)
+	if err != nil {
+		t.Fatalf("cannot create persistence backend, %v", err)
+	}
+	s, err := NewInProcess(WithPersistence(b))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	mc := startModify(ctx, t, s)
+	for i := uint64(1); i <= 3; i++ {
+		if err := mc.Send(nhAddRequest(i)); err != nil {
+			t.Fatalf("cannot send operation %d, %v", i, err)
+		}
+		res, err := mc.Recv()
+		if err != nil {
+			t.Fatalf("did not get response to operation %d, %v", i, err)
+		}
+		checkProgrammed(t, res)
+	}
+	want := getAll(ctx, t, s)
+	if len(want) != 3 {
+		t.Fatalf("did not get expected number of entries before restart, got: %d, want: 3", len(want))
+	}
+	mc.CloseSend()
+	if err := s.GracefulStop(ctx); err != nil {
+		t.Fatalf("GracefulStop(): got unexpected error, %v", err)
+	}
+
+	restored, err := NewInProcess(WithPersistence(b))
+	if err != nil {
+		t.Fatalf("cannot start restored in-process server, %v", err)
+	}
+	defer restored.Stop()
+
+	if diff := cmp.Diff(getAll(ctx, t, restored), want,
+		protocmp.Transform(),
+		cmpopts.SortSlices(func(a, b *spb.AFTEntry) bool { return prototext.Format(a) < prototext.Format(b) }),
+	); diff != "" {
+		t.Errorf("restored server did not return expected entries, diff(-got,+want):\n%s", diff)
+	}
+
+	// Flushing the network instance removes its stored entries.
+	if _, err := restored.Flush(ctx, &spb.FlushRequest{
+		NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+		Election:        &spb.FlushRequest_Override{Override: &spb.Empty{}},
+	}); err != nil {
+		t.Fatalf("cannot flush restored server, %v", err)
+	}
+	if got, err := b.Load(DefaultNetworkInstanceName); err != nil || got != nil {
+		t.Errorf("Load(%s): did not get expected result after Flush, got: %v, err: %v", DefaultNetworkInstanceName, got, err)
+	}
+}
@@ -21,15 +21,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	log "github.com/golang/glog"
 	"github.com/google/uuid"
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/constants"
 	"github.com/openconfig/gribigo/rib"
+	"github.com/openconfig/ygot/ygot"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
 	"lukechampine.com/uint128"
 
 	spb "github.com/openconfig/gribi/v1/proto/service"
@@ -40,10 +46,6 @@ const (
 	DefaultNetworkInstanceName = "DEFAULT"
 )
 
-// unixTS is used to determine the current unix timestamp in nanoseconds since the
-// epoch. It is defined such that it can be overloaded by unit tests.
-var unixTS = time.Now().UnixNano
-
 // Server implements the gRIBI service.
 type Server struct {
 	*spb.UnimplementedGRIBIServer
@@ -74,6 +76,147 @@ type Server struct {
 	// masterRIB is the single gRIBI RIB that is used for a server that runs with
 	// a single elected master, where a single RIB is written to by all clients.
 	masterRIB *rib.RIB
+
+	// pendingTimeout is the duration for which an operation that cannot be
+	// resolved is held by the server before it is returned as failed. If zero,
+	// unresolved operations are held indefinitely.
+	pendingTimeout time.Duration
+	// pendMu protects the pendingOps map.
+	pendMu sync.Mutex
+	// pendingOps stores the operations that are pending resolution within the
+	// RIB when pendingTimeout is set, keyed by the client and operation ID.
+	pendingOps map[pendingKey]*pendingOp
+
+	// opTimeout is the duration for which an operation that is installed in
+	// the RIB may await its FIB_PROGRAMMED result before it is returned as
+	// failed. If zero, operations may await their result indefinitely.
+	opTimeout time.Duration
+	// inflightMu protects the inflight map.
+	inflightMu sync.Mutex
+	// inflight stores each operation that is awaiting its
+	// result when opTimeout is set, keyed by the client and operation ID.
+	inflight map[pendingKey]*inflightOp
+
+	// strictDeleteOwnership indicates that a client may only delete entries
+	// that it owns, i.e., that it created or most recently replaced.
+	strictDeleteOwnership bool
+
+	// referenceIntegrityCheck indicates that operations that reference entries
+	// that are not installed in the RIB are rejected rather than being held
+	// pending resolution.
+	referenceIntegrityCheck bool
+
+	// increasingOpIDs indicates that the IDs of operations received from a
+	// client are required to increase.
+	increasingOpIDs bool
+
+	// limits stores the maximum number of entries within each AFT of a network
+	// instance.
+	limits *entryLimits
+
+	// getBatchSize is the maximum number of entries that are sent within a
+	// single GetResponse.
+	getBatchSize int
+
+	// tls is the TLS configuration of the server, it is nil if the server was
+	// not created with TLS options.
+	tls *tlsConfig
+
+	// defaultNI is the name of the default network instance of the server.
+	defaultNI string
+	// niTypes stores the type of each network instance that is known to the
+	// server, keyed by name.
+	niTypes map[string]NetworkInstanceType
+	// niCompat is the matrix of AFTs that can be programmed in each type of
+	// network instance.
+	niCompat NetworkInstanceCompatibility
+
+	// events is the queue of RIB events that are to be handed to the function
+	// specified by WithRIBEventHook, it is nil if no function is specified.
+	events *eventQueue
+	// eventMu protects the pendingEvents map.
+	eventMu sync.Mutex
+	// pendingEvents stores the operations that are pending resolution within
+	// the RIB, keyed by client and operation ID, such that events can be
+	// generated for them when they are installed.
+	pendingEvents map[pendingKey]*pendingOp
+	// fibMu protects fibGen and fibStatus.
+	fibMu sync.Mutex
+	// fibGen is the generation of the most recent event for which the FIB
+	// programming state of an entry was recorded.
+	fibGen uint64
+	// fibStatus stores the FIB programming state of the entries that were
+	// installed by operations for which an event was generated, keyed by
+	// entry. It is nil if no function is specified by WithRIBEventHook, in
+	// which case the FIB is not modelled by the server.
+	fibStatus map[entryKey]*fibState
+
+	// clock returns the current time, it is used for all timestamps that are
+	// generated by the server.
+	clock func() time.Time
+
+	// opHook is the function that is called for each AFTOperation prior to it
+	// being processed, it is nil if no function is specified.
+	opHook OperationHookFn
+
+	// stats stores the counters for the operations and RPCs handled by the
+	// server.
+	stats *serverStats
+	// metricsHandler indicates that MetricsHandler should return a handler.
+	metricsHandler bool
+
+	// shutdown stores the state used when the server is drained or stopped.
+	shutdown shutdownState
+
+	// debug stores the state used when the server is in debug mode.
+	debug debugState
+
+	// checkpoint is the file that the server's RIB is written to, it is nil
+	// if the RIB is not checkpointed.
+	checkpoint *checkpointFile
+	// checkpointMu serialises writes to the checkpoint file.
+	checkpointMu sync.Mutex
+
+	// persistence is the backend that the entries of the server's RIB are
+	// stored using, it is nil if the entries are not persisted.
+	persistence PersistenceBackend
+	// persistMu serialises writes to the persistence backend, such that the
+	// stored entries reflect the latest contents of the RIB.
+	persistMu sync.Mutex
+
+	// modifyStreams stores the connections that have an active Modify RPC.
+	modifyStreams modifyStreamState
+}
+
+// entryKey uniquely identifies an entry within the server's RIB.
+type entryKey struct {
+	// ni is the name of the network instance that the entry is within.
+	ni string
+	// aft is the AFT that the entry is within.
+	aft constants.AFT
+	// key is the key of the entry within the AFT.
+	key string
+}
+
+// pendingKey is the key used to store pending operations, since each client
+// has its own operation ID space, operations are keyed by both the client ID
+// and operation ID.
+type pendingKey struct {
+	// client is the ID of the client that sent the operation.
+	client string
+	// id is the ID of the operation.
+	id uint64
+}
+
+// pendingOp stores the details of an operation that the server is holding
+// whilst its references are not resolvable.
+type pendingOp struct {
+	// ni is the network instance that the operation was within.
+	ni string
+	// op is the operation that is pending.
+	op *spb.AFTOperation
+	// deadline is the time after which the operation is returned as failed.
+	deadline time.Time
 }
 
 // clientState stores information that relates to a specific client
@@ -92,6 +235,17 @@ type clientState struct {
 	// sent to the server. This is used to validate whether the election
 	// ID in an operation matches the expected election ID.
 	lastElecID *spb.Uint128
+	// lastOpID stores the ID of the last operation that was accepted from
+	// the client. Operation IDs are required to be increasing when the server
+	// is created using WithIncreasingOperationIDs.
+	lastOpID uint64
+	// done is closed when the client's Modify RPC is closed, such that results
+	// that are generated asynchronously are no longer sent to it.
+	done chan struct{}
+	// results is the channel on which results are written to the client's Modify
+	// RPC. It is used to send results for the client's operations that are
+	// installed by operations received from other clients.
+	results chan *spb.ModifyResponse
 }
 
 // DeepCopy returns a copy of the clientState struct.
@@ -190,6 +344,91 @@ func hasResolvedEntryHook(opt []ServerOpt) *resolvedEntryHook {
 	return nil
 }
 
+// WithRIBEventHook specifies a function that is called for each change to an entry
+// within the RIB that results from a Modify operation, such that the change can be
+// programmed into a dataplane. The function is called after the RIB_PROGRAMMED
+// result for the operation is sent, in the order in which the entries were
+// installed in the RIB - and hence in dependency order.
+//
+// The function must call the Done function of the event once the change has been
+// programmed. For clients that requested RIB_AND_FIB_ACK, the FIB_PROGRAMMED result
+// for the operation is sent only once Done is called, or a FAILED result if Done is
+// called with a non-nil error, or the function returns an error.
+// Events may be completed in any order, but the results are sent in the order in
+// which the events were generated, such that a client observes FIB_PROGRAMMED
+// results for dependent entries in the same order as their RIB_PROGRAMMED results.
+//
+// The function is called on a goroutine that is separate to the Modify RPC, such
+// that a function that blocks cannot block the Modify RPC, however, it delays the
+// events that follow it. The number of events that can be outstanding - i.e., that
+// have not had Done called - is specified by WithMaxOutstandingRIBEvents. Entries
+// that are removed by a Flush do not generate events.
+//
+// When a function is specified, the Get RPC reports the FIB status of each entry
+// that was installed by a Modify operation - NOT_PROGRAMMED until Done is called
+// for the event of the operation that most recently changed the entry, and
+// PROGRAMMED once it is called without error. Subsequent changes to the FIB that
+// are not the result of an event can be reported using Server.SetFIBStatus.
+func WithRIBEventHook(fn rib.RIBEventFn) *ribEventHook {
+	return &ribEventHook{fn: fn}
+}
+
+// ribEventHook is the internal implementation of the WithRIBEventHook option.
+type ribEventHook struct {
+	fn rib.RIBEventFn
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*ribEventHook) isServerOpt() {}
+
+// hasRIBEventHook returns the function specified by the WithRIBEventHook option
+// in the ServerOpt slice supplied, or nil if it is not present.
+func hasRIBEventHook(opt []ServerOpt) rib.RIBEventFn {
+	for _, o := range opt {
+		if v, ok := o.(*ribEventHook); ok {
+			return v.fn
+		}
+	}
+	return nil
+}
+
+// WithMaxOutstandingRIBEvents specifies the number of events generated for the
+// function specified by WithRIBEventHook that can be outstanding - i.e., that have
+// been handed to the function but not had Done called - at any one time. When n
+// is greater than one, the events may be completed in any order. By default, a
+// single event may be outstanding, such that each event is completed before the
+// function is called for the next.
+//
+// The function is always called serially, on a single goroutine, in the order in
+// which the entries were installed in the RIB - such that it observes an entry
+// only after the entries that it references. A function that programs entries
+// concurrently should therefore return promptly, and call Done asynchronously;
+// n bounds the number of entries that are being programmed at any one time.
+func WithMaxOutstandingRIBEvents(n int) *maxOutstandingRIBEvents {
+	return &maxOutstandingRIBEvents{n: n}
+}
+
+// maxOutstandingRIBEvents is the internal implementation of the
+// WithMaxOutstandingRIBEvents option.
+type maxOutstandingRIBEvents struct {
+	n int
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*maxOutstandingRIBEvents) isServerOpt() {}
+
+// hasMaxOutstandingRIBEvents returns the number of events specified by the
+// WithMaxOutstandingRIBEvents option in the ServerOpt slice supplied, or 1 if it
+// is not present or invalid.
+func hasMaxOutstandingRIBEvents(opt []ServerOpt) int {
+	for _, o := range opt {
+		if v, ok := o.(*maxOutstandingRIBEvents); ok && v.n > 0 {
+			return v.n
+		}
+	}
+	return 1
+}
+
 // DisableRIBCheckFn specifies that the consistency checking functions should
 // be disabled for the RIB. It is useful for a testing RIB that does not need
 // to have working references.
@@ -212,9 +451,39 @@ func hasDisableCheckFn(opt []ServerOpt) bool {
 	return false
 }
 
+// WithDefaultNetworkInstanceName specifies the name of the default network
+// instance of the server, which is created when the server is started. Operations
+// that do not specify a network instance are applied to the default network
+// instance. If the option is not specified, DefaultNetworkInstanceName is used.
+func WithDefaultNetworkInstanceName(name string) *defaultNetworkInstanceName {
+	return &defaultNetworkInstanceName{name: name}
+}
+
+// defaultNetworkInstanceName is the internal implementation of
+// WithDefaultNetworkInstanceName.
+type defaultNetworkInstanceName struct {
+	name string
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*defaultNetworkInstanceName) isServerOpt() {}
+
+// hasDefaultNetworkInstanceName returns the name of the default network instance
+// specified in the ServerOpt slice supplied, or DefaultNetworkInstanceName if it
+// is not specified.
+func hasDefaultNetworkInstanceName(opt []ServerOpt) string {
+	for _, o := range opt {
+		if v, ok := o.(*defaultNetworkInstanceName); ok && v.name != "" {
+			return v.name
+		}
+	}
+	return DefaultNetworkInstanceName
+}
+
 // WithVRFs specifies that the server should be initialised with the L3VRF
 // network instances specified in the names list. Each is created in the
-// server's RIB such that it can be referenced.
+// server's RIB such that it can be referenced. Operations that specify a
+// network instance that was not created are returned as FAILED to the client.
 func WithVRFs(names []string) *withVRFs { return &withVRFs{names: names} }
 
 // withVRFs is the internal implementation of WithVRFs that can be read by the
@@ -237,41 +506,476 @@ func hasWithVRFs(opt []ServerOpt) []string {
 	return nil
 }
 
+// WithPendingResolution specifies that operations whose references cannot be
+// resolved should be held by the server for up to the specified timeout. If the
+// references are resolved within the timeout, the operation is installed and
+// acknowledged, otherwise it is returned to the client as failed with details of
+// the unresolved references. Operations that are pending when the network instance
+// they refer to is flushed are also returned as failed. The number of operations
+// that are held is bounded, as per WithMaxPendingOperations.
+func WithPendingResolution(timeout time.Duration) *pendingResolution {
+	return &pendingResolution{timeout: timeout}
+}
+
+// pendingResolution is the internal implementation of WithPendingResolution.
+type pendingResolution struct {
+	timeout time.Duration
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*pendingResolution) isServerOpt() {}
+
+// hasPendingResolution returns the timeout specified by the WithPendingResolution
+// option in the ServerOpt slice supplied, or zero if it is not present.
+func hasPendingResolution(opt []ServerOpt) time.Duration {
+	for _, o := range opt {
+		if v, ok := o.(*pendingResolution); ok {
+			return v.timeout
+		}
+	}
+	return 0
+}
+
+// WithClock specifies the function that the server uses to determine the current
+// time when generating timestamps - for example, in the results of Modify and Flush
+// RPCs, and the timestamps supplied to post-change RIB hooks. It allows tests to
+// use a deterministic clock. By default, time.Now is used.
+//
+// The clock is also used to determine when operations that are pending resolution
+// expire (see WithPendingResolution) - such that a clock that returns a fixed time
+// results in pending operations never expiring.
+func WithClock(fn func() time.Time) *withClock { return &withClock{fn: fn} }
+
+// withClock is the internal implementation of WithClock.
+type withClock struct {
+	fn func() time.Time
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*withClock) isServerOpt() {}
+
+// hasWithClock returns the clock function specified by the WithClock option in the
+// ServerOpt slice supplied, or nil if it is not present.
+func hasWithClock(opt []ServerOpt) func() time.Time {
+	for _, o := range opt {
+		if v, ok := o.(*withClock); ok {
+			return v.fn
+		}
+	}
+	return nil
+}
+
+// WithStrictDeleteOwnership specifies that the server should only allow a client to
+// delete entries that it owns - that is, entries that the client added, or most
+// recently replaced. The owner of an entry is the client session that is recorded
+// in the metadata of the entry within the RIB, such that a client retains ownership
+// of its entries when it changes its election ID, whereas a new master - including
+// a client that reconnects - must replace an entry to take ownership of it before
+// deleting it.
+//
+// A DELETE of an entry owned by another client is returned as FAILED, with error
+// details indicating the FAILED_PRECONDITION and the owner of the entry, unless
+// the entry within the operation has its entry_metadata set to
+// OwnershipOverrideMetadata. Since next-hop and next-hop-group entries have no
+// entry_metadata, they must be replaced to take ownership of them. By default,
+// the current master may delete any entry.
+func WithStrictDeleteOwnership() *strictDeleteOwnership { return &strictDeleteOwnership{} }
+
+// strictDeleteOwnership is the internal implementation of WithStrictDeleteOwnership.
+type strictDeleteOwnership struct{}
+
+// isServerOpt implements the ServerOpt interface.
+func (*strictDeleteOwnership) isServerOpt() {}
+
+// hasStrictDeleteOwnership checks whether the ServerOpt slice supplied contains
+// the strictDeleteOwnership option.
+func hasStrictDeleteOwnership(opt []ServerOpt) bool {
+	for _, o := range opt {
+		if _, ok := o.(*strictDeleteOwnership); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithIncreasingOperationIDs specifies that the server should require the IDs of
+// the operations received from a client to increase, such that the client can
+// unambiguously correlate results with operations. An operation whose ID is not
+// greater than the ID of the last operation that was accepted from the client
+// is returned as FAILED. Operations that are not accepted - for example, because
+// the client is not the primary, or the operation specifies an unknown network
+// instance - do not update the last operation ID of the client.
+func WithIncreasingOperationIDs() *increasingOperationIDs { return &increasingOperationIDs{} }
+
+// increasingOperationIDs is the internal implementation of WithIncreasingOperationIDs.
+type increasingOperationIDs struct{}
+
+// isServerOpt implements the ServerOpt interface.
+func (*increasingOperationIDs) isServerOpt() {}
+
+// hasIncreasingOperationIDs checks whether the ServerOpt slice supplied contains
+// the increasingOperationIDs option.
+func hasIncreasingOperationIDs(opt []ServerOpt) bool {
+	for _, o := range opt {
+		if _, ok := o.(*increasingOperationIDs); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// OwnershipOverrideMetadata is the value of the entry_metadata of the entry within
+// a DELETE operation that indicates that the entry may be deleted even if it is
+// owned by another client when the server is using WithStrictDeleteOwnership.
+const OwnershipOverrideMetadata = "gribigo-ownership-override"
+
+// EntryOwnedByOtherClient is included in the error details of a failed result
+// when a DELETE operation is rejected because the entry is owned by another client
+// when the server is using WithStrictDeleteOwnership.
+const EntryOwnedByOtherClient = "ENTRY_OWNED_BY_OTHER_CLIENT"
+
+// NotPrimary is included in the error details of a failed result when an
+// operation is not processed because it was not received from the primary client,
+// or its election ID does not match the election ID last advertised by the client.
+const NotPrimary = "NOT_PRIMARY"
+
+// hasOwnershipOverride returns true if the entry within the operation op has its
+// entry_metadata set to OwnershipOverrideMetadata.
+func hasOwnershipOverride(op *spb.AFTOperation) bool {
+	var md []byte
+	switch e := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		md = e.Ipv4.GetIpv4Entry().GetEntryMetadata().GetValue()
+	case *spb.AFTOperation_Ipv6:
+		md = e.Ipv6.GetIpv6Entry().GetEntryMetadata().GetValue()
+	case *spb.AFTOperation_Mpls:
+		md = e.Mpls.GetLabelEntry().GetEntryMetadata().GetValue()
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		md = e.PolicyForwardingEntry.GetPolicyForwardingEntry().GetEntryMetadata().GetValue()
+	}
+	return string(md) == OwnershipOverrideMetadata
+}
+
+// defaultMaxPendingOperations is the maximum number of operations that are held
+// pending resolution when WithPendingResolution is specified without the
+// WithMaxPendingOperations option.
+const defaultMaxPendingOperations = 10000
+
+// WithMaxPendingOperations specifies the maximum number of operations that can be
+// held pending resolution by the server. Operations that cannot be resolved once
+// the limit is reached are returned to the client as failed. When
+// WithPendingResolution is specified, the limit defaults to 10000 operations.
+func WithMaxPendingOperations(n int) *maxPendingOps { return &maxPendingOps{n: n} }
+
+// maxPendingOps is the internal implementation of WithMaxPendingOperations.
+type maxPendingOps struct {
+	n int
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*maxPendingOps) isServerOpt() {}
+
+// hasMaxPendingOperations returns the limit specified by the WithMaxPendingOperations
+// option in the ServerOpt slice supplied. If it is not present, it returns
+// defaultMaxPendingOperations when the WithPendingResolution option is present, such
+// that the operations held by the server are bounded, or zero otherwise.
+func hasMaxPendingOperations(opt []ServerOpt) int {
+	for _, o := range opt {
+		if v, ok := o.(*maxPendingOps); ok {
+			return v.n
+		}
+	}
+	if hasPendingResolution(opt) != 0 {
+		return defaultMaxPendingOperations
+	}
+	return 0
+}
+
+// defaultGetBatchSize is the maximum number of entries that are sent within a
+// single GetResponse when the WithGetBatchSize option is not specified.
+const defaultGetBatchSize = 1000
+
+// WithGetBatchSize specifies the maximum number of entries that the server sends
+// within a single GetResponse. Entries are batched such that a Get of a large RIB
+// does not send a message per entry, whilst the size of each message remains
+// bounded. A batch only contains entries from a single network instance.
+func WithGetBatchSize(n int) *getBatchSize { return &getBatchSize{n: n} }
+
+// getBatchSize is the internal implementation of WithGetBatchSize.
+type getBatchSize struct {
+	n int
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*getBatchSize) isServerOpt() {}
+
+// hasGetBatchSize returns the size specified by the WithGetBatchSize option in the
+// ServerOpt slice supplied, or defaultGetBatchSize if it is not present or is not
+// positive.
+func hasGetBatchSize(opt []ServerOpt) int {
+	for _, o := range opt {
+		if v, ok := o.(*getBatchSize); ok && v.n > 0 {
+			return v.n
+		}
+	}
+	return defaultGetBatchSize
+}
+
+// WithDeletedHistory specifies that the server should keep a record of the entries
+// that were recently deleted from its RIB, such that they can be queried using
+// RecentlyDeleted. At most count entries are kept for each AFT within each network
+// instance, and entries are discarded once they are older than age. An age of zero
+// indicates that entries are only discarded when the count is exceeded.
+func WithDeletedHistory(count int, age time.Duration) *deletedHistory {
+	return &deletedHistory{count: count, age: age}
+}
+
+// deletedHistory is the internal implementation of WithDeletedHistory.
+type deletedHistory struct {
+	count int
+	age   time.Duration
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*deletedHistory) isServerOpt() {}
+
+// hasDeletedHistory returns the deletedHistory option in the ServerOpt slice
+// supplied, or nil if it is not present.
+func hasDeletedHistory(opt []ServerOpt) *deletedHistory {
+	for _, o := range opt {
+		if v, ok := o.(*deletedHistory); ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// WithJournal specifies that the server should keep a journal of the mutations that
+// are made to its RIB, including those made by Flush and by the removal of the
+// pending operations of a client that disconnects, such that they can be retrieved
+// using Journal. At most size entries are kept.
+func WithJournal(size int) *journalSize {
+	return &journalSize{size: size}
+}
+
+// journalSize is the internal implementation of WithJournal.
+type journalSize struct {
+	size int
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*journalSize) isServerOpt() {}
+
+// hasJournal returns the size of the journal specified in the ServerOpt slice
+// supplied, or zero if it is not present.
+func hasJournal(opt []ServerOpt) int {
+	for _, o := range opt {
+		if v, ok := o.(*journalSize); ok {
+			return v.size
+		}
+	}
+	return 0
+}
+
+// WithReferenceIntegrityCheck specifies whether the server should reject operations
+// that reference entries that are not installed in the RIB. When enabled, an ADD
+// or REPLACE of an IPv4, IPv6, MPLS or policy-forwarding entry that references a
+// next-hop-group that does not exist, or of a next-hop-group that references a
+// next-hop that does not exist, is returned as FAILED with error details
+// indicating INVALID_ARGUMENT, rather than being held pending resolution.
+func WithReferenceIntegrityCheck(enabled bool) *referenceIntegrityCheck {
+	return &referenceIntegrityCheck{enabled: enabled}
+}
+
+// referenceIntegrityCheck is the internal implementation of WithReferenceIntegrityCheck.
+type referenceIntegrityCheck struct {
+	enabled bool
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*referenceIntegrityCheck) isServerOpt() {}
+
+// hasReferenceIntegrityCheck checks whether the ServerOpt slice supplied contains
+// the referenceIntegrityCheck option, and returns whether it is enabled.
+func hasReferenceIntegrityCheck(opt []ServerOpt) bool {
+	for _, o := range opt {
+		if v, ok := o.(*referenceIntegrityCheck); ok {
+			return v.enabled
+		}
+	}
+	return false
+}
+
+// OperationHookFn is a function that is called for each AFTOperation that is
+// received by the server. If it returns a non-nil AFTResult, the result is sent
+// to the client rather than the operation being processed.
+type OperationHookFn func(op *spb.AFTOperation) *spb.AFTResult
+
+// WithOperationHook specifies a function that is called for each AFTOperation
+// received by the server, prior to it being processed. If the function returns a
+// non-nil result, processing of the operation is skipped and the result is
+// returned to the client - if the ID of the result is unset, it is set to the ID
+// of the operation. This allows specific operations to be failed deterministically,
+// for example, to simulate a FIB being full when testing a client.
+func WithOperationHook(fn OperationHookFn) *operationHook {
+	return &operationHook{fn: fn}
+}
+
+// operationHook is the internal implementation of the WithOperationHook option.
+type operationHook struct {
+	fn OperationHookFn
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*operationHook) isServerOpt() {}
+
+// hasOperationHook returns the function specified by the WithOperationHook
+// option in the ServerOpt slice supplied, or nil if it is not present.
+func hasOperationHook(opt []ServerOpt) OperationHookFn {
+	for _, o := range opt {
+		if v, ok := o.(*operationHook); ok {
+			return v.fn
+		}
+	}
+	return nil
+}
+
 // New creates a new gRIBI server.
 func New(opt ...ServerOpt) (*Server, error) {
 	ribOpt := []rib.RIBOpt{}
 	if hasDisableCheckFn(opt) {
 		ribOpt = append(ribOpt, rib.DisableRIBCheckFn())
 	}
+	if n := hasMaxPendingOperations(opt); n != 0 {
+		ribOpt = append(ribOpt, rib.WithPendingLimit(n))
+	}
+	if fn := hasWithClock(opt); fn != nil {
+		ribOpt = append(ribOpt, rib.WithClock(fn))
+	}
+	if v := hasDeletedHistory(opt); v != nil {
+		ribOpt = append(ribOpt, rib.WithDeletedHistory(v.count, v.age))
+	}
+	if n := hasJournal(opt); n != 0 {
+		ribOpt = append(ribOpt, rib.WithJournal(n))
+	}
 
+	defNI := hasDefaultNetworkInstanceName(opt)
 	s := &Server{
 		cs: map[string]*clientState{},
 		// TODO(robjs): when we implement support for ALL_PRIMARY then we might not
 		// want to create a new RIB by default.
-		masterRIB: rib.New(DefaultNetworkInstanceName, ribOpt...),
+		masterRIB:      rib.New(defNI, ribOpt...),
+		defaultNI:      defNI,
+		pendingTimeout: hasPendingResolution(opt),
+		pendingOps:     map[pendingKey]*pendingOp{},
+		opTimeout:      hasOperationTimeout(opt),
+		inflight:       map[pendingKey]*inflightOp{},
+
+		strictDeleteOwnership: hasStrictDeleteOwnership(opt),
+
+		referenceIntegrityCheck: hasReferenceIntegrityCheck(opt),
+		increasingOpIDs:         hasIncreasingOperationIDs(opt),
+		limits:                  &entryLimits{max: hasEntryLimits(opt)},
+		getBatchSize:            hasGetBatchSize(opt),
+
+		niTypes:  map[string]NetworkInstanceType{defNI: DefaultInstance},
+		niCompat: hasNetworkInstanceCompatibility(opt),
+
+		opHook: hasOperationHook(opt),
+
+		stats:          newServerStats(),
+		metricsHandler: hasMetricsHandler(opt),
+
+		clock: time.Now,
+	}
+	s.modifyStreams.single = !hasMultipleModifyPerConnection(opt)
+
+	if fn := hasWithClock(opt); fn != nil {
+		s.clock = fn
+	}
+
+	s.debug.fn = hasDebugTrace(opt)
+	s.debug.ops = map[pendingKey]*tracedOp{}
+	s.debug.enabled.Store(hasDebugMode(opt))
+
+	if cp := hasCheckpointFile(opt); cp != nil {
+		s.checkpoint = cp
+		if err := s.restoreCheckpoint(ribOpt); err != nil {
+			return nil, err
+		}
 	}
 
+	tlsCfg, err := newTLSConfig(opt)
+	if err != nil {
+		return nil, err
+	}
+	s.tls = tlsCfg
+
 	if v := hasPostChangeRIBHook(opt); v != nil {
 		s.masterRIB.SetPostChangeHook(v.fn)
 	}
 
+	if fn := hasRIBEventHook(opt); fn != nil {
+		s.events = newEventQueue(fn, hasMaxOutstandingRIBEvents(opt))
+		s.pendingEvents = map[pendingKey]*pendingOp{}
+		s.fibStatus = map[entryKey]*fibState{}
+		go s.events.run()
+	}
+
 	if v := hasResolvedEntryHook(opt); v != nil {
 		s.masterRIB.SetResolvedEntryHook(v.fn)
 	}
 
 	if vrfs := hasWithVRFs(opt); vrfs != nil {
 		for _, n := range vrfs {
+			// The network instance may already exist if the RIB was restored
+			// from a checkpoint.
+			if _, ok := s.masterRIB.NetworkInstanceRIB(n); !ok {
+				if err := s.masterRIB.AddNetworkInstance(n); err != nil {
+					return nil, fmt.Errorf("cannot create network instance %s, %v", n, err)
+				}
+			}
+			s.niTypes[n] = L3VRF
+		}
+	}
+
+	for n, t := range hasNetworkInstanceTypes(opt) {
+		if _, ok := s.masterRIB.NetworkInstanceRIB(n); !ok {
 			if err := s.masterRIB.AddNetworkInstance(n); err != nil {
 				return nil, fmt.Errorf("cannot create network instance %s, %v", n, err)
 			}
 		}
+		s.niTypes[n] = t
+	}
+
+	if b := hasPersistence(opt); b != nil {
+		s.persistence = b
+		if err := s.restorePersisted(); err != nil {
+			return nil, err
+		}
 	}
 
+	if s.checkpoint != nil && s.checkpoint.interval > 0 {
+		go s.runCheckpoints()
+	}
+
+	s.shutdown.ready.Store(true)
 	return s, nil
 }
 
 // Modify implements the gRIBI Modify RPC.
 func (s *Server) Modify(ms spb.GRIBI_ModifyServer) error {
+	if err := s.startRPC(); err != nil {
+		return err
+	}
+	defer s.endRPC()
+
+	endStream, err := s.startModifyStream(ms.Context())
+	if err != nil {
+		return err
+	}
+	defer endStream()
+
 	// Initiate the per client state for this client.
 	cid := uuid.New().String()
 	log.V(2).Infof("creating client with ID %s", cid)
@@ -280,7 +984,9 @@ func (s *Server) Modify(ms spb.GRIBI_ModifyServer) error {
 	}
 
 	resultChan := make(chan *spb.ModifyResponse)
+	s.storeClientResults(cid, resultChan)
 	errCh := make(chan error)
+	act := &streamActivity{}
 	go func() {
 		// Store whether this is the first message on the Modify RPC, some options - like the session
 		// parameters can only be set as the first message.
@@ -295,6 +1001,10 @@ func (s *Server) Modify(ms spb.GRIBI_ModifyServer) error {
 				errCh <- status.Errorf(codes.Unknown, "error reading message from client, %v", err)
 				return
 			}
+			if !act.begin() {
+				// The stream has been closed since the server is stopping.
+				return
+			}
 			log.V(2).Infof("received message %s on Modify channel", in)
 
 			var (
@@ -329,7 +1039,11 @@ func (s *Server) Modify(ms spb.GRIBI_ModifyServer) error {
 					errCh <- err
 					return
 				}
+			case in.Operation != nil && s.isDraining():
+				s.stats.received(cid, in.Operation)
+				res = drainedResults(in.Operation)
 			case in.Operation != nil:
+				s.stats.received(cid, in.Operation)
 				s.doModify(cid, in.Operation, resultChan, errCh)
 				skipWrite = true
 			default:
@@ -342,14 +1056,19 @@ func (s *Server) Modify(ms spb.GRIBI_ModifyServer) error {
 			if !skipWrite {
 				resultChan <- res
 			}
+			act.end()
 		}
 	}()
 
 	resultDone := make(chan struct{})
+	sendDone := make(chan struct{})
 	go func() {
+		defer close(sendDone)
 		for {
 			select {
 			case res := <-resultChan:
+				s.stampResults(res)
+				s.stats.results(cid, res)
 				// update that we have received at least one message.
 				if err := ms.Send(res); err != nil {
 					errCh <- status.Errorf(codes.Internal, "cannot write message to client channel, %s", res)
@@ -361,8 +1080,14 @@ func (s *Server) Modify(ms spb.GRIBI_ModifyServer) error {
 		}
 	}()
 
-	err := <-errCh
-	close(resultDone)
+	if s.pendingTimeout != 0 {
+		go s.expirePending(cid, resultChan, resultDone)
+	}
+	if s.opTimeout != 0 {
+		go s.expireOperations(cid, resultChan, resultDone)
+	}
+
+	err = s.awaitModify(cid, act, errCh, resultDone, sendDone)
 
 	// when this client goes away, we need to clean up its state.
 	s.deleteClient(cid)
@@ -370,8 +1095,25 @@ func (s *Server) Modify(ms spb.GRIBI_ModifyServer) error {
 	return err
 }
 
+// stampResults sets the timestamp of each AFTResult within res that does not
+// already have a timestamp to the current time.
+func (s *Server) stampResults(res *spb.ModifyResponse) {
+	ts := s.clock().UnixNano()
+	for _, r := range res.GetResult() {
+		if r.Timestamp == 0 {
+			r.Timestamp = ts
+		}
+	}
+}
+
 // Get implements the gRIBI Get RPC.
 func (s *Server) Get(req *spb.GetRequest, stream spb.GRIBI_GetServer) error {
+	if err := s.startRPC(); err != nil {
+		return err
+	}
+	defer s.endRPC()
+	s.stats.countGet()
+
 	msgCh := make(chan *spb.GetResponse)
 	errCh := make(chan error)
 	doneCh := make(chan struct{})
@@ -391,25 +1133,128 @@ func (s *Server) Get(req *spb.GetRequest, stream spb.GRIBI_GetServer) error {
 
 	go s.doGet(req, msgCh, doneCh, stopCh, errCh)
 
+	// Entries are batched into GetResponses of at most getBatchSize entries, a
+	// batch is sent when it is full, or when an entry from a different network
+	// instance is received.
+	var batch *spb.GetResponse
+	flush := func() error {
+		if batch == nil {
+			return nil
+		}
+		defer func() { batch = nil }()
+		if err := stream.Send(batch); err != nil {
+			return status.Errorf(codes.Internal, "cannot write message to client channel, %v", err)
+		}
+		return nil
+	}
+
 	var done bool
 
 	for !done {
 		select {
 		case <-doneCh:
+			if err := flush(); err != nil {
+				return err
+			}
 			done = true
 		case err := <-errCh:
 			return status.Errorf(codes.Internal, "cannot generate GetResponse, %v", err)
+		case <-s.shutdown.killCh:
+			return status.Errorf(codes.Unavailable, "server stopped")
 		case r := <-msgCh:
-			if err := stream.Send(r); err != nil {
-				return status.Errorf(codes.Internal, "cannot write message to client channel, %v", err)
+			for _, e := range r.GetEntry() {
+				s.annotateFIBStatus(e)
+				if batch != nil && batch.Entry[0].GetNetworkInstance() != e.GetNetworkInstance() {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+				if batch == nil {
+					batch = &spb.GetResponse{}
+				}
+				batch.Entry = append(batch.Entry, e)
+				if len(batch.Entry) >= s.getBatchSize {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
 			}
 		}
 	}
 	return nil
 }
 
+// ExportAFT returns the contents of the AFTs within the network instance ni as an
+// OpenConfig AFT GoStruct, such that the state of the server can be compared to
+// telemetry from a device.
+func (s *Server) ExportAFT(ni string) (*aft.Afts, error) {
+	return s.masterRIB.ExportAFT(ni)
+}
+
+// RecentlyDeleted returns the records of the entries that were recently deleted from
+// the AFT a within the network instance ni, such that a test can determine whether,
+// and when, an entry was programmed after it has been removed. If filter is not nil,
+// only entries whose key it returns true for are returned. No entries are returned
+// unless the server was created with the WithDeletedHistory option.
+func (s *Server) RecentlyDeleted(ni string, a constants.AFT, filter func(key string) bool) []*rib.DeletedEntry {
+	return s.masterRIB.RecentlyDeleted(ni, a, filter)
+}
+
+// Journal returns the mutations that were made to the server's RIB with a sequence
+// number greater than sinceSeq, such that a test can reconstruct the order in
+// which entries were added and removed. No entries are returned unless the server
+// was created with the WithJournal option.
+func (s *Server) Journal(sinceSeq uint64) []*rib.JournalEntry {
+	return s.masterRIB.Journal(sinceSeq)
+}
+
+// EntryMetadata returns the metadata describing the operation that programmed the
+// entry with key key, within the AFT a of network instance ni, such that a test can
+// determine which client session programmed the entry. The session of each entry is
+// the ID of the Modify RPC that it was received on. It returns false if the entry is
+// not installed.
+func (s *Server) EntryMetadata(ni string, a constants.AFT, key any) (*rib.EntryMetadata, bool) {
+	return s.masterRIB.GetEntryMetadata(ni, a, key)
+}
+
+// CheckConsistency checks that the server's RIB is internally consistent, such
+// that a test can assert that a sequence of operations did not corrupt it. See
+// rib.RIB.CheckConsistency for details of the checks that are performed.
+func (s *Server) CheckConsistency() *rib.ConsistencyReport {
+	return s.masterRIB.CheckConsistency()
+}
+
+// ExportJSON returns the contents of the AFTs within the network instance ni as
+// indented RFC7951 JSON.
+func (s *Server) ExportJSON(ni string) (string, error) {
+	a, err := s.ExportAFT(ni)
+	if err != nil {
+		return "", err
+	}
+	js, err := ygot.EmitJSON(a, &ygot.EmitJSONConfig{
+		Format: ygot.RFC7951,
+		Indent: "  ",
+		RFC7951Config: &ygot.RFC7951JSONConfig{
+			AppendModuleName: true,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot render AFTs for network instance %s as JSON, %v", ni, err)
+	}
+	return js, nil
+}
+
 // Flush implements the gRIBI Flush RPC - used for removing entries from the server.
 func (s *Server) Flush(ctx context.Context, req *spb.FlushRequest) (*spb.FlushResponse, error) {
+	if err := s.startRPC(); err != nil {
+		return nil, err
+	}
+	defer s.endRPC()
+	s.stats.countFlush()
+	if s.isDraining() {
+		return nil, status.Errorf(codes.Unavailable, "server is draining")
+	}
+
 	if err := s.checkFlushRequest(req); err != nil {
 		return nil, err
 	}
@@ -443,9 +1288,11 @@ func (s *Server) Flush(ctx context.Context, req *spb.FlushRequest) (*spb.FlushRe
 		// error).
 		return nil, status.Errorf(codes.Internal, det.String())
 	}
+	s.flushFIBStatus(nis)
+	s.persist(nis)
 
 	return &spb.FlushResponse{
-		Timestamp: unixTS(),
+		Timestamp: s.clock().UnixNano(),
 		Result:    spb.FlushResponse_OK,
 	}, nil
 }
@@ -461,7 +1308,9 @@ func (s *Server) newClient(id string) error {
 	s.cs[id] = &clientState{
 		// Set to the default set of parameters.
 		params: &clientParams{},
+		done:   make(chan struct{}),
 	}
+	s.stats.addClient(id)
 
 	return nil
 }
@@ -472,7 +1321,24 @@ func (s *Server) newClient(id string) error {
 func (s *Server) deleteClient(id string) {
 	s.csMu.Lock()
 	defer s.csMu.Unlock()
+	if cs, ok := s.cs[id]; ok && cs.done != nil {
+		close(cs.done)
+	}
 	delete(s.cs, id)
+	s.stats.deleteClient(id)
+	s.clearTraces(id)
+	s.clearOperations(id)
+
+	// Operations that are pending on behalf of the client can no longer be
+	// acknowledged, so they are removed from the RIB.
+	s.pendMu.Lock()
+	defer s.pendMu.Unlock()
+	for k := range s.pendingOps {
+		if k.client == id {
+			s.masterRIB.RemovePendingForSession(k.client, k.id)
+			delete(s.pendingOps, k)
+		}
+	}
 }
 
 // updateParams writes the parameters for the client specified by id to the server state
@@ -628,16 +1494,12 @@ func isNewMaster(cand, exist *spb.Uint128) (bool, bool, error) {
 	if exist == nil {
 		return true, false, nil
 	}
-	if cand.High > exist.High {
+	switch uint128.New(cand.Low, cand.High).Cmp(uint128.New(exist.Low, exist.High)) {
+	case 1:
 		return true, false, nil
-	}
-	if cand.Low > exist.Low {
-		return true, false, nil
-	}
-
-	// Per comments in gribi.proto - if the two values are equal, then we accept the new
-	// candidate as the master, this allows for reconnections.
-	if cand.High == exist.High && cand.Low == exist.Low {
+	case 0:
+		// Per comments in gribi.proto - if the two values are equal, then we accept the new
+		// candidate as the master, this allows for reconnections.
 		return true, true, nil
 	}
 	// TODO(robjs): currently this is not specified in the spec, since this is the
@@ -670,6 +1532,39 @@ func (s *Server) storeClientElectionID(id string, elecID *spb.Uint128) bool {
 	return true
 }
 
+// storeClientResults stores the channel on which results are written to the
+// Modify RPC of the client with ID cid.
+func (s *Server) storeClientResults(cid string, ch chan *spb.ModifyResponse) {
+	s.csMu.Lock()
+	defer s.csMu.Unlock()
+	if cs, ok := s.cs[cid]; ok {
+		cs.results = ch
+	}
+}
+
+// checkClientOpID checks whether id is greater than the ID of the last operation
+// that was accepted from the client with the specified ID. It returns the ID of
+// the last operation, and whether id is greater than it.
+func (s *Server) checkClientOpID(cid string, id uint64) (uint64, bool) {
+	s.csMu.RLock()
+	defer s.csMu.RUnlock()
+	cs, ok := s.cs[cid]
+	if !ok {
+		return 0, false
+	}
+	return cs.lastOpID, id > cs.lastOpID
+}
+
+// storeClientOpID stores id as the ID of the last operation that was accepted
+// from the client with the specified ID.
+func (s *Server) storeClientOpID(cid string, id uint64) {
+	s.csMu.Lock()
+	defer s.csMu.Unlock()
+	if cs, ok := s.cs[cid]; ok {
+		cs.lastOpID = id
+	}
+}
+
 // getClientStateCopy returns a copy of the state for the client with the specified ID, since
 // the state of a client is immutable after the initial creation, we never allow a client to
 // get a copy of the pointer so that they could change this. It returns a copy of the clientState
@@ -710,16 +1605,25 @@ func (s *Server) runElection(id string, elecID *spb.Uint128) (*spb.ModifyRespons
 		return nil, status.Newf(codes.Internal, "cannot store election ID %s for client %s", elecID, id).Err()
 	}
 
-	s.elecMu.RLock()
-	defer s.elecMu.RUnlock()
-	nm, _, err := isNewMaster(elecID, s.curElecID)
+	s.elecMu.Lock()
+	defer s.elecMu.Unlock()
+	nm, eq, err := isNewMaster(elecID, s.curElecID)
 	if err != nil {
 		return nil, err
 	}
 
-	if nm {
+	switch {
+	case nm && eq && s.curMaster == id:
+		// The master has re-advertised its election ID - for example, as a
+		// liveness signal. This does not change mastership, and hence the
+		// state that the master has programmed is unaffected.
+		log.V(2).Infof("client %s re-advertised election ID %s", id, elecID)
+	case nm:
 		s.curElecID = elecID
 		s.curMaster = id
+		if s.masterRIB != nil {
+			s.masterRIB.SetElectionID(elecID)
+		}
 	}
 
 	return &spb.ModifyResponse{
@@ -740,6 +1644,12 @@ func (s *Server) getElection() *electionDetails {
 // doModify implements a modify operation for a specific input set of AFTOperation
 // messages for the client with the specified cid. It writes the result to the supplied
 // ModifyResponse channel when successful, or writes the error to the supplied errCh.
+//
+// The operations are processed serially in the order in which they are specified,
+// such that an operation may reference an entry that is added by an earlier operation
+// within the same request. The results for each operation are written to resCh before
+// the next operation is processed, and hence the RIB_PROGRAMMED results are returned
+// to the client in the order in which the entries were installed.
 func (s *Server) doModify(cid string, ops []*spb.AFTOperation, resCh chan *spb.ModifyResponse, errCh chan error) {
 	cs, ok := s.getClientState(cid)
 	switch {
@@ -756,29 +1666,84 @@ func (s *Server) doModify(cid string, ops []*spb.AFTOperation, resCh chan *spb.M
 		return
 	}
 
+	// In debug mode, operations are processed sequentially across all clients.
+	debug := s.DebugMode()
+	if debug {
+		s.debug.seqMu.Lock()
+		defer s.debug.seqMu.Unlock()
+	}
+	// emit writes the response res to the client, tracing its results.
+	emit := func(res *spb.ModifyResponse) {
+		s.traceResults(cid, res)
+		resCh <- res
+	}
+
 	elec := s.getElection()
 	elec.clientLatest = cs.lastElecID
 	elec.client = cid
 
+	// The network instances that operations were applied to are persisted once
+	// all operations have been processed.
+	touched := map[string]bool{}
+	defer func() {
+		if len(touched) == 0 {
+			return
+		}
+		nis := []string{}
+		for ni := range touched {
+			nis = append(nis, ni)
+		}
+		sort.Strings(nis)
+		s.persist(nis)
+	}()
+
 	for _, o := range ops {
+		if debug {
+			s.traceReceived(cid, o)
+		}
+		if s.increasingOpIDs {
+			if last, ok := s.checkClientOpID(cid, o.GetId()); !ok {
+				// Operation IDs are required to increase such that the client can
+				// unambiguously correlate results with operations.
+				emit(&spb.ModifyResponse{
+					Result: []*spb.AFTResult{{
+						Id:     o.Id,
+						Status: spb.AFTResult_FAILED,
+						ErrorDetails: &spb.AFTErrorDetails{
+							ErrorMessage: fmt.Sprintf("operation ID %d is not greater than the previous operation ID %d", o.GetId(), last),
+						},
+					}},
+				})
+				continue
+			}
+		}
+
+		if s.opHook != nil {
+			if r := s.opHook(o); r != nil {
+				r = proto.Clone(r).(*spb.AFTResult)
+				if r.Id == 0 {
+					r.Id = o.GetId()
+				}
+				emit(&spb.ModifyResponse{Result: []*spb.AFTResult{r}})
+				continue
+			}
+		}
+
+		// The network instance of an entry is specified only by the operation
+		// that carries it - the entries themselves do not have a network
+		// instance - such that an operation that does not specify a network
+		// instance applies to the default network instance. Entries are
+		// attributed to the same network instance by Get and Flush.
 		ni := o.GetNetworkInstance()
 		if ni == "" {
-			resCh <- &spb.ModifyResponse{
-				Result: []*spb.AFTResult{{
-					Id:     o.Id,
-					Status: spb.AFTResult_FAILED,
-					ErrorDetails: &spb.AFTErrorDetails{
-						ErrorMessage: `invalid network instance name "" specified`,
-					},
-				}},
-			}
+			ni = s.defaultNI
 		}
 		if _, ok := s.masterRIB.NetworkInstanceRIB(ni); !ok {
 			// this is an unknown network instance, we should not return
 			// an error to the client since we do not want the connection
 			// to be torn down.
 			log.Errorf("rejected operation %s since it is an unknown network-instance, %s", o, ni)
-			resCh <- &spb.ModifyResponse{
+			emit(&spb.ModifyResponse{
 				Result: []*spb.AFTResult{{
 					Id:     o.Id,
 					Status: spb.AFTResult_FAILED,
@@ -786,8 +1751,8 @@ func (s *Server) doModify(cid string, ops []*spb.AFTOperation, resCh chan *spb.M
 						ErrorMessage: fmt.Sprintf(`unknown network instance "%s" specified`, ni),
 					},
 				}},
-			}
-			return
+			})
+			continue
 		}
 
 		// We do not try and modify entries within the operation in parallel
@@ -801,16 +1766,404 @@ func (s *Server) doModify(cid string, ops []*spb.AFTOperation, resCh chan *spb.M
 		// for ALL_PRIMARY this situation will need to handled likely by creating
 		// some form of lock on each transaction as it is attempted, or building
 		// a more intelligent RIB structure to track missing dependencies.
-		res, err := modifyEntry(s.masterRIB, ni, o, cs.params.FIBAck, elec)
+		if s.strictDeleteOwnership && o.GetOp() == spb.AFTOperation_DELETE && !hasOwnershipOverride(o) {
+			// Ownership is only checked for operations that would otherwise be
+			// processed, such that a client that is not primary receives a
+			// NOT_PRIMARY result rather than an ownership failure.
+			if _, ok, _ := checkElectionForModify(o.GetId(), o.GetElectionId(), elec); ok {
+				if res := s.checkDeleteOwnership(cid, ni, o); res != nil {
+					emit(res)
+					continue
+				}
+			}
+		}
+
+		if s.referenceIntegrityCheck && o.GetOp() != spb.AFTOperation_DELETE {
+			// Only check references for operations that would otherwise be
+			// processed such that election failures are reported as normal.
+			if _, ok, _ := checkElectionForModify(o.GetId(), o.GetElectionId(), elec); ok {
+				if res := s.checkReferences(ni, o); res != nil {
+					emit(res)
+					continue
+				}
+			}
+		}
+
+		// releaseLimit is called once the operation has been applied to the
+		// RIB, such that it is counted towards the limits before any other
+		// operation is checked against them.
+		releaseLimit := func() {}
+		if o.GetOp() != spb.AFTOperation_DELETE {
+			// As for reference checks, only operations that would otherwise be
+			// processed are checked against the network instance type and the
+			// limits.
+			if _, ok, _ := checkElectionForModify(o.GetId(), o.GetElectionId(), elec); ok {
+				if res := s.checkNetworkInstanceType(ni, o); res != nil {
+					emit(res)
+					continue
+				}
+				var res *spb.ModifyResponse
+				if res, releaseLimit = s.checkEntryLimit(ni, o); res != nil {
+					emit(res)
+					continue
+				}
+			}
+		}
+
+		if debug {
+			s.trace(cid, o.GetId(), TraceValidated, "")
+		}
+
+		if s.persistence != nil {
+			touched[ni] = true
+		}
+
+		// Only the IDs of accepted operations are recorded, such that an operation
+		// that is rejected since the client is not primary does not advance it.
+		if _, ok, _ := checkElectionForModify(o.GetId(), o.GetElectionId(), elec); s.increasingOpIDs && ok {
+			s.storeClientOpID(cid, o.GetId())
+		}
+
+		// When a RIB event hook is specified, FIB_PROGRAMMED results are sent
+		// once the hook has completed the event for the operation.
+		res, others, err := s.modifyAndTrack(cid, ni, o, cs.params.FIBAck && s.events == nil, elec)
+		releaseLimit()
 		switch {
 		case err != nil:
 			errCh <- err
 		default:
-			resCh <- res
+			if debug {
+				var detail string
+				if s.masterRIB.IsPendingForSession(cid, o.GetId()) {
+					detail = "pending"
+				}
+				s.trace(cid, o.GetId(), TraceRIBApplied, detail)
+			}
+			// The FIB_PROGRAMMED results are sent in a separate response to the
+			// RIB_PROGRAMMED results, such that the client observes the two
+			// phases of programming the entry in order.
+			ribRes, fibRes := splitFIBResults(res)
+			if ribRes != nil {
+				emit(ribRes)
+			}
+			if fibRes != nil {
+				emit(fibRes)
+			}
+			s.sendResolved(others)
+			events := s.queueEvents(cid, ni, o, res, others, cs.params.FIBAck, resCh, cs.done)
+			if debug {
+				// Wait for the events to be completed before processing the next
+				// operation, such that the processing of each operation is not
+				// interleaved with that of any other.
+				for _, e := range events {
+					select {
+					case <-e:
+					case <-cs.done:
+					}
+				}
+			}
+		}
+	}
+}
+
+// sendResolved sends the results in others, which are for operations that were
+// pending on behalf of other clients, to the client that sent each operation.
+// The results are keyed by the ID of the client, and are sent according to the
+// client's ACK mode. Results for clients that are no longer connected are
+// discarded.
+func (s *Server) sendResolved(others map[string]*spb.ModifyResponse) {
+	for _, cid := range sortedClients(others) {
+		cs, ok := s.getClientState(cid)
+		if !ok || cs.results == nil {
+			log.Warningf("discarding results for disconnected client %s, %s", cid, others[cid])
+			continue
+		}
+		res, resCh := others[cid], cs.results
+		emit := func(res *spb.ModifyResponse) {
+			s.traceResults(cid, res)
+			select {
+			case resCh <- res:
+			case <-cs.done:
+			}
+		}
+		emit(res)
+		if cs.params.FIBAck && s.events == nil {
+			fib := &spb.ModifyResponse{}
+			for _, r := range res.GetResult() {
+				if r.GetStatus() == spb.AFTResult_RIB_PROGRAMMED {
+					fib.Result = append(fib.Result, &spb.AFTResult{Id: r.GetId(), Status: spb.AFTResult_FIB_PROGRAMMED})
+				}
+			}
+			if len(fib.Result) != 0 {
+				emit(fib)
+			}
 		}
 	}
 }
 
+// sortedClients returns the IDs of the clients that results are stored for in
+// res in ascending order.
+func sortedClients(res map[string]*spb.ModifyResponse) []string {
+	clients := make([]string, 0, len(res))
+	for cid := range res {
+		clients = append(clients, cid)
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// splitFIBResults splits the results within res into a response that contains
+// the FIB_PROGRAMMED results, and a response containing all other results. Each
+// response is nil if it would contain no results, such that it is not sent to the
+// client.
+func splitFIBResults(res *spb.ModifyResponse) (*spb.ModifyResponse, *spb.ModifyResponse) {
+	var other, fib []*spb.AFTResult
+	for _, r := range res.GetResult() {
+		if r.GetStatus() == spb.AFTResult_FIB_PROGRAMMED {
+			fib = append(fib, r)
+			continue
+		}
+		other = append(other, r)
+	}
+	var ribRes, fibRes *spb.ModifyResponse
+	if other != nil {
+		ribRes = &spb.ModifyResponse{Result: other}
+	}
+	if fib != nil {
+		fibRes = &spb.ModifyResponse{Result: fib}
+	}
+	return ribRes, fibRes
+}
+
+// opEntryKey returns the key of the entry that op within network instance ni
+// operates on. It returns false if the entry type is not known.
+func opEntryKey(ni string, op *spb.AFTOperation) (entryKey, bool) {
+	k := entryKey{ni: ni}
+	switch e := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		k.aft, k.key = constants.IPv4, e.Ipv4.GetPrefix()
+	case *spb.AFTOperation_Ipv6:
+		k.aft, k.key = constants.IPv6, e.Ipv6.GetPrefix()
+	case *spb.AFTOperation_Mpls:
+		k.aft, k.key = constants.MPLS, fmt.Sprintf("%d", e.Mpls.GetLabelUint64())
+	case *spb.AFTOperation_NextHopGroup:
+		k.aft, k.key = constants.NextHopGroup, fmt.Sprintf("%d", e.NextHopGroup.GetId())
+	case *spb.AFTOperation_NextHop:
+		k.aft, k.key = constants.NextHop, fmt.Sprintf("%d", e.NextHop.GetIndex())
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		k.aft, k.key = constants.PolicyForwarding, fmt.Sprintf("%d", e.PolicyForwardingEntry.GetIndex())
+	default:
+		return entryKey{}, false
+	}
+	return k, true
+}
+
+// checkDeleteOwnership checks whether the client with ID cid may delete the entry
+// within network instance ni that op refers to. It returns a ModifyResponse
+// containing a failed result for the operation if the entry is owned by another
+// client session, or nil if the operation may proceed.
+func (s *Server) checkDeleteOwnership(cid, ni string, op *spb.AFTOperation) *spb.ModifyResponse {
+	md, ok := s.masterRIB.GetOperationEntryMetadata(ni, op)
+	if !ok || md.Session == "" || md.Session == cid {
+		return nil
+	}
+
+	k, _ := opEntryKey(ni, op)
+	return &spb.ModifyResponse{
+		Result: []*spb.AFTResult{{
+			Id:     op.GetId(),
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: fmt.Sprintf("%s: %s, cannot delete %s %s in network-instance %s, entry is owned by client %s", codes.FailedPrecondition, EntryOwnedByOtherClient, k.aft, k.key, ni, md.Session),
+			},
+		}},
+	}
+}
+
+// checkReferences checks whether the entries referenced by op within network instance
+// ni are installed in the RIB. It returns a ModifyResponse containing a failed result
+// for the operation if a referenced entry does not exist, or nil if the operation may
+// proceed.
+func (s *Server) checkReferences(ni string, op *spb.AFTOperation) *spb.ModifyResponse {
+	niR, ok := s.masterRIB.NetworkInstanceRIB(ni)
+	if !ok {
+		return nil
+	}
+
+	// nhgMissing returns an error message if the next-hop-group with ID id does not
+	// exist within the network instance refNI, or the operation's network instance
+	// if refNI is not specified.
+	nhgMissing := func(id uint64, refNI string) string {
+		if id == 0 {
+			return ""
+		}
+		refR := niR
+		if refNI != "" {
+			if refR, ok = s.masterRIB.NetworkInstanceRIB(refNI); !ok {
+				return fmt.Sprintf("next-hop-group %d references unknown network-instance %s", id, refNI)
+			}
+		} else {
+			refNI = ni
+		}
+		if _, ok := refR.GetNextHopGroup(id); !ok {
+			return fmt.Sprintf("next-hop-group %d does not exist in network-instance %s", id, refNI)
+		}
+		return ""
+	}
+
+	var msg string
+	switch e := op.GetEntry().(type) {
+	case *spb.AFTOperation_Ipv4:
+		msg = nhgMissing(e.Ipv4.GetIpv4Entry().GetNextHopGroup().GetValue(), e.Ipv4.GetIpv4Entry().GetNextHopGroupNetworkInstance().GetValue())
+	case *spb.AFTOperation_Ipv6:
+		msg = nhgMissing(e.Ipv6.GetIpv6Entry().GetNextHopGroup().GetValue(), e.Ipv6.GetIpv6Entry().GetNextHopGroupNetworkInstance().GetValue())
+	case *spb.AFTOperation_Mpls:
+		msg = nhgMissing(e.Mpls.GetLabelEntry().GetNextHopGroup().GetValue(), e.Mpls.GetLabelEntry().GetNextHopGroupNetworkInstance().GetValue())
+	case *spb.AFTOperation_PolicyForwardingEntry:
+		msg = nhgMissing(e.PolicyForwardingEntry.GetPolicyForwardingEntry().GetNextHopGroup().GetValue(), e.PolicyForwardingEntry.GetPolicyForwardingEntry().GetNextHopGroupNetworkInstance().GetValue())
+	case *spb.AFTOperation_NextHopGroup:
+		for _, nh := range e.NextHopGroup.GetNextHopGroup().GetNextHop() {
+			if _, ok := niR.GetNextHop(nh.GetIndex()); !ok {
+				msg = fmt.Sprintf("next-hop %d does not exist in network-instance %s", nh.GetIndex(), ni)
+				break
+			}
+		}
+	}
+	if msg == "" {
+		return nil
+	}
+
+	k, _ := opEntryKey(ni, op)
+	return &spb.ModifyResponse{
+		Result: []*spb.AFTResult{{
+			Id:     op.GetId(),
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: fmt.Sprintf("%s: cannot install %s %s in network-instance %s, %s", codes.InvalidArgument, k.aft, k.key, ni, msg),
+			},
+		}},
+	}
+}
+
+// modifyAndTrack performs the operation op within the network instance ni on
+// behalf of the client with ID cid using modifyEntry. If the server is configured to
+// time out pending operations, it records whether op is pending resolution such that
+// it can later be returned as failed. The results are returned as per modifyEntry.
+func (s *Server) modifyAndTrack(cid, ni string, op *spb.AFTOperation, fibACK bool, elec *electionDetails) (*spb.ModifyResponse, map[string]*spb.ModifyResponse, error) {
+	if s.pendingTimeout == 0 {
+		return modifyEntry(s.masterRIB, cid, ni, op, fibACK, elec)
+	}
+
+	// Hold the pending lock such that the expiry of pending entries cannot race
+	// with this operation resolving them.
+	s.pendMu.Lock()
+	defer s.pendMu.Unlock()
+	res, others, err := modifyEntry(s.masterRIB, cid, ni, op, fibACK, elec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Results may be returned for operations that were pending on behalf of any
+	// client, since this operation may have resolved them.
+	resolved := func(client string, res *spb.ModifyResponse) {
+		for _, r := range res.GetResult() {
+			k := pendingKey{client: client, id: r.GetId()}
+			if _, ok := s.pendingOps[k]; ok && !s.masterRIB.IsPendingForSession(k.client, k.id) {
+				delete(s.pendingOps, k)
+			}
+		}
+	}
+	resolved(cid, res)
+	for client, ores := range others {
+		resolved(client, ores)
+	}
+	if s.masterRIB.IsPendingForSession(cid, op.GetId()) {
+		s.pendingOps[pendingKey{client: cid, id: op.GetId()}] = &pendingOp{
+			ni:       ni,
+			op:       op,
+			deadline: s.clock().Add(s.pendingTimeout),
+		}
+	}
+	return res, others, nil
+}
+
+// pendingCheckInterval returns the interval at which pending operations are checked
+// for expiry given the pending timeout t.
+func pendingCheckInterval(t time.Duration) time.Duration {
+	if i := t / 4; i > time.Millisecond {
+		return i
+	}
+	return time.Millisecond
+}
+
+// expirePending periodically checks the operations that are pending resolution on
+// behalf of the client with ID cid, writing failed results to resCh for those that
+// have expired. It returns when doneCh is closed.
+func (s *Server) expirePending(cid string, resCh chan *spb.ModifyResponse, doneCh chan struct{}) {
+	ticker := time.NewTicker(pendingCheckInterval(s.pendingTimeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneCh:
+			return
+		case <-ticker.C:
+			res := s.expiredResults(cid, s.clock())
+			if res == nil {
+				continue
+			}
+			s.traceResults(cid, res)
+			select {
+			case resCh <- res:
+			case <-doneCh:
+				return
+			}
+		}
+	}
+}
+
+// expiredResults returns a ModifyResponse containing failed results for each
+// operation sent by the client with ID cid that is no longer pending at time now.
+// An operation is no longer pending if its deadline has passed, in which case it is
+// removed from the RIB, or if it has been removed from the RIB by a Flush. The
+// results are ordered by operation ID. It returns nil if there are no such
+// operations.
+func (s *Server) expiredResults(cid string, now time.Time) *spb.ModifyResponse {
+	s.pendMu.Lock()
+	defer s.pendMu.Unlock()
+
+	results := []*spb.AFTResult{}
+	for k, p := range s.pendingOps {
+		if k.client != cid {
+			continue
+		}
+		id := k.id
+		var msg string
+		switch {
+		case !s.masterRIB.IsPendingForSession(cid, id):
+			msg = fmt.Sprintf("operation %d was removed whilst pending resolution", id)
+		case now.After(p.deadline):
+			msg = fmt.Sprintf("operation %d could not be resolved within %s, unresolved references: %s", id, s.pendingTimeout, strings.Join(s.masterRIB.UnresolvedReferences(p.ni, p.op), ", "))
+			s.masterRIB.RemovePendingForSession(cid, id)
+		default:
+			continue
+		}
+		delete(s.pendingOps, k)
+		results = append(results, &spb.AFTResult{
+			Id:     id,
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: msg,
+			},
+		})
+	}
+
+	if len(results) == 0 {
+		return nil
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].GetId() < results[j].GetId() })
+	return &spb.ModifyResponse{Result: results}
+}
+
 // electionDetails provides a summary of a single election from the perspective of one client.
 type electionDetails struct {
 	// master is the clientID of the client that is master after the election.
@@ -824,32 +2177,52 @@ type electionDetails struct {
 }
 
 // modifyEntry performs the specified modify operation, op, on the RIB, r, within the network
-// instance ni. The client's request ACK mode is specified by fibACK. The details of the
-// current election on the server is described in election.
-// The results are returned as a ModifyResponse and an error which must be a status.Status.
-func modifyEntry(r *rib.RIB, ni string, op *spb.AFTOperation, fibACK bool, election *electionDetails) (*spb.ModifyResponse, error) {
+// instance ni on behalf of the client with ID cid, which is recorded as the session that
+// programmed the affected entries. The client's request ACK mode is specified by fibACK.
+// The details of the current election on the server is described in election.
+//
+// The results for operations sent by the client are returned as a ModifyResponse.
+// Since op may result in operations that were pending on behalf of other clients
+// being installed, the results for these operations are returned separately,
+// keyed by the ID of the client that sent them. FIB_PROGRAMMED results are not
+// included for other clients, since they depend on the ACK mode of each client.
+// The returned error must be a status.Status.
+func modifyEntry(r *rib.RIB, cid, ni string, op *spb.AFTOperation, fibACK bool, election *electionDetails) (*spb.ModifyResponse, map[string]*spb.ModifyResponse, error) {
 	if op == nil {
-		return nil, status.Newf(codes.Internal, "invalid nil operation received").Err()
+		return nil, nil, status.Newf(codes.Internal, "invalid nil operation received").Err()
 	}
 
 	res, ok, err := checkElectionForModify(op.Id, op.ElectionId, election)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if !ok {
-		return res, err
+		return res, nil, err
 	}
 
 	if r == nil {
-		return nil, status.New(codes.Internal, "invalid RIB state").Err()
+		return nil, nil, status.New(codes.Internal, "invalid RIB state").Err()
 	}
 
 	niR, ok := r.NetworkInstanceRIB(ni)
 	if !ok || !niR.IsValid() {
-		return nil, status.Newf(codes.Internal, "invalid RIB state for network instance name: '%s'", ni).Err()
+		return nil, nil, status.Newf(codes.Internal, "invalid RIB state for network instance name: '%s'", ni).Err()
 	}
 
 	results := []*spb.AFTResult{}
+	others := map[string]*spb.ModifyResponse{}
+	// add appends the result res for an operation sent by the client with ID
+	// session to the results for that client.
+	add := func(session string, res *spb.AFTResult) {
+		if session == cid {
+			results = append(results, res)
+			return
+		}
+		if others[session] == nil {
+			others[session] = &spb.ModifyResponse{}
+		}
+		others[session].Result = append(others[session].Result, res)
+	}
 
 	var (
 		oks, faileds []*rib.OpResult
@@ -862,9 +2235,9 @@ func modifyEntry(r *rib.RIB, ni string, op *spb.AFTOperation, fibACK bool, elect
 		// whether the entry was an explicit replace from the op, and if so errors if the
 		// entry does not already exist.
 		log.V(2).Infof("calling AddEntry for operation ID %d", op.GetId())
-		oks, faileds, ribFatalErr = r.AddEntry(ni, op)
+		oks, faileds, ribFatalErr = r.AddEntryForSession(ni, cid, op)
 	case spb.AFTOperation_DELETE:
-		oks, faileds, ribFatalErr = r.DeleteEntry(ni, op)
+		oks, faileds, ribFatalErr = r.DeleteEntryForSession(ni, cid, op)
 	default:
 		return &spb.ModifyResponse{
 			Result: []*spb.AFTResult{
@@ -876,12 +2249,12 @@ func modifyEntry(r *rib.RIB, ni string, op *spb.AFTOperation, fibACK bool, elect
 					},
 				},
 			},
-		}, nil
+		}, nil, nil
 	}
 
 	if ribFatalErr != nil {
 		// RIB action returned fatal error for the connection.
-		return nil, addModifyErrDetailsOrReturn(
+		return nil, nil, addModifyErrDetailsOrReturn(
 			status.Newf(codes.Unimplemented, "fatal error processing operation %s, error: %v", op.Op, ribFatalErr),
 			&spb.ModifyRPCErrorDetails{
 				Reason: spb.ModifyRPCErrorDetails_UNKNOWN,
@@ -891,16 +2264,17 @@ func modifyEntry(r *rib.RIB, ni string, op *spb.AFTOperation, fibACK bool, elect
 
 	for _, ok := range oks {
 		log.V(2).Infof("received OK for %d in operation %s", ok.ID, prototext.Format(op))
-		results = append(results, &spb.AFTResult{
+		add(ok.Session, &spb.AFTResult{
 			Id:     ok.ID,
 			Status: spb.AFTResult_RIB_PROGRAMMED,
 		})
 		// For RIB_AND_FIB_ACK we sent both the RIB programmed and FIB programmed
-		// signals back.
+		// signals back, the Modify RPC sends these to the client in separate
+		// responses.
 		//
 		// TODO(robjs): Currently, we just say everything that was RIB programmed was
 		// FIB programmed. Add a feedback loop for this.
-		if fibACK {
+		if fibACK && ok.Session == cid {
 			results = append(results, &spb.AFTResult{
 				Id:     ok.ID,
 				Status: spb.AFTResult_FIB_PROGRAMMED,
@@ -910,17 +2284,21 @@ func modifyEntry(r *rib.RIB, ni string, op *spb.AFTOperation, fibACK bool, elect
 
 	for _, fail := range faileds {
 		log.Errorf("returning failed to client because the RIB declared it failed, %v", fail)
-		results = append(results, &spb.AFTResult{
+		res := &spb.AFTResult{
 			Id:     fail.ID,
 			Status: spb.AFTResult_FAILED,
-			// TODO(robjs): add somewhere for the error that we provide to be
-			// returned.
-		})
+		}
+		if fail.Error != "" {
+			res.ErrorDetails = &spb.AFTErrorDetails{
+				ErrorMessage: fail.Error,
+			}
+		}
+		add(fail.Session, res)
 	}
 
 	return &spb.ModifyResponse{
 		Result: results,
-	}, nil
+	}, others, nil
 }
 
 // checkElectionForModify checks whether the operation with ID opID, and election ID opElecID
@@ -934,35 +2312,24 @@ func modifyEntry(r *rib.RIB, ni string, op *spb.AFTOperation, fibACK bool, elect
 // Any returned error is considered fatal to the Modify RPC and can be sent directly back
 // to the client.
 func checkElectionForModify(opID uint64, opElecID *spb.Uint128, election *electionDetails) (*spb.ModifyResponse, bool, error) {
-	// check whether the election ID is the current one.
-	if opElecID == nil {
-		// this is an error since we only support election IDs.
-		return nil, false, addModifyErrDetailsOrReturn(
-			status.Newf(codes.FailedPrecondition, "no specified election ID when it was required"),
-			&spb.ModifyRPCErrorDetails{
-				// TODO(robjs): we probably need to define what happens here, no specified error code.
-			})
-	}
-
 	switch {
-	case election == nil, election.master == "", election.ID == nil:
+	case election == nil:
 		return nil, false, status.Newf(codes.Internal, "invalid election state in server, details of election: %+v", election).Err()
+	case opElecID == nil:
+		// The operation cannot be from the primary client if it does not specify
+		// an election ID.
+		return notPrimaryResult(opID, "no election ID specified in operation"), false, nil
 	case election.clientLatest == nil:
-		// This client might not have sent us an election ID yet, which means that they are in
-		// the wrong.
-		return nil, false, addModifyErrDetailsOrReturn(
-			status.Newf(codes.FailedPrecondition, "client has not yet specified an election ID"),
-			&spb.ModifyRPCErrorDetails{},
-		)
+		// This client has not yet sent us an election ID, and hence cannot be the
+		// primary client.
+		return notPrimaryResult(opID, "client has not yet specified an election ID"), false, nil
+	case election.master == "", election.ID == nil:
+		// No client has won an election on the server.
+		return notPrimaryResult(opID, "no client has been elected as primary"), false, nil
 	case election.client != election.master:
 		// this client is not the elected master.
 		log.Errorf("returning failed to client %s (id: %s), because they are not the elected master (%s is, id: %s)", election.client, election.clientLatest, election.master, election.ID)
-		return &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     opID,
-				Status: spb.AFTResult_FAILED,
-			}},
-		}, false, nil
+		return notPrimaryResult(opID, "client is not primary, primary election ID is %s", election.ID), false, nil
 	}
 
 	thisID := uint128.New(opElecID.Low, opElecID.High)
@@ -970,12 +2337,7 @@ func checkElectionForModify(opID uint64, opElecID *spb.Uint128, election *electi
 	currentClientID := uint128.New(election.clientLatest.Low, election.clientLatest.High)
 	if thisID.Cmp(currentClientID) != 0 {
 		log.Errorf("returning failed to client because operation election ID %s != their latest election ID %s (master is: %s with ID %s)", opElecID, election.clientLatest, election.master, election.ID)
-		return &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     opID,
-				Status: spb.AFTResult_FAILED,
-			}},
-		}, false, nil
+		return notPrimaryResult(opID, "operation election ID %s does not match the election ID advertised by the client %s", thisID, currentClientID), false, nil
 	}
 
 	// This is a belt and braces check -- it's not clear that we need to do it. Since we
@@ -988,22 +2350,30 @@ func checkElectionForModify(opID uint64, opElecID *spb.Uint128, election *electi
 		// this value is greater than the known master ID. Return an error
 		return nil, false, status.Newf(codes.FailedPrecondition, "specified election ID was greater than existing election, %s > %s", thisID, currentID).Err()
 	case thisID.Cmp(currentID) < 0:
-		// this value is less as the current master ID, ignore this transaction.
-		// note that since we don't respond here, the client at the other side
-		// is just going to have a pending transaction forever.
-		//
-		// TODO(robjs): should we add an error code here?
+		// this value is less than the current master ID, such that the client has
+		// advertised a lower election ID since it became primary.
 		log.Errorf("returning failed to client because operation election ID %s < the master election ID %s (master: %s)", opElecID, election.ID, election.master)
-		return &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     opID,
-				Status: spb.AFTResult_FAILED,
-			}},
-		}, false, nil
+		return notPrimaryResult(opID, "operation election ID %s is lower than the primary election ID %s", thisID, currentID), false, nil
 	}
 	return nil, true, nil
 }
 
+// notPrimaryResult returns a ModifyResponse containing a FAILED result for the
+// operation with ID opID, indicating that it was not processed because it was not
+// received from the primary client. The error message of the result is prefixed
+// with NotPrimary, and followed by the reason specified by format and args.
+func notPrimaryResult(opID uint64, format string, args ...interface{}) *spb.ModifyResponse {
+	return &spb.ModifyResponse{
+		Result: []*spb.AFTResult{{
+			Id:     opID,
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: fmt.Sprintf("%s: %s", NotPrimary, fmt.Sprintf(format, args...)),
+			},
+		}},
+	}
+}
+
 // doGet implements the Get RPC for the gRIBI server. It handles the input GetRequest, writing
 // the set of GetResponses to the specified msgCh. When the Get is done, the function writes to
 // doneCh such that the caller knows that the work that is being done is complete. If a message
@@ -1020,6 +2390,12 @@ func (s *Server) doGet(req *spb.GetRequest, msgCh chan *spb.GetResponse, doneCh,
 		return
 	}
 
+	// The entries are read from a snapshot of the RIB, such that they reflect a
+	// single point in time across all network instances, without the RIB being
+	// locked whilst they are sent to the client.
+	snap := s.masterRIB.Snapshot()
+	defer snap.Release()
+
 	netInstances := []string{}
 	switch nireq := req.NetworkInstance.(type) {
 	case *spb.GetRequest_Name:
@@ -1029,25 +2405,19 @@ func (s *Server) doGet(req *spb.GetRequest, msgCh chan *spb.GetResponse, doneCh,
 		}
 		netInstances = append(netInstances, nireq.Name)
 	case *spb.GetRequest_All:
-		netInstances = s.masterRIB.KnownNetworkInstances()
+		netInstances = snap.NetworkInstances()
 	}
 
 	filter := map[spb.AFTType]bool{}
 	switch v := req.Aft; v {
-	case spb.AFTType_ALL, spb.AFTType_IPV4, spb.AFTType_NEXTHOP, spb.AFTType_NEXTHOP_GROUP, spb.AFTType_MPLS, spb.AFTType_IPV6:
+	case spb.AFTType_ALL, spb.AFTType_IPV4, spb.AFTType_NEXTHOP, spb.AFTType_NEXTHOP_GROUP, spb.AFTType_MPLS, spb.AFTType_IPV6, spb.AFTType_POLICY_FORWARDING:
 		filter[v] = true
 	default:
-		errCh <- status.Errorf(codes.Unimplemented, "AFTs other than IPv4, MPLS, IPv6, NHG and NH are unimplemented, requested: %s", v)
+		errCh <- status.Errorf(codes.Unimplemented, "AFTs other than IPv4, MPLS, IPv6, NHG, NH and policy-forwarding are unimplemented, requested: %s", v)
 	}
 
 	for _, ni := range netInstances {
-		netInst, ok := s.masterRIB.NetworkInstanceRIB(ni)
-		if !ok {
-			errCh <- status.Errorf(codes.InvalidArgument, "invalid network instance %s specified", ni)
-			return
-		}
-
-		if err := netInst.GetRIB(filter, msgCh, stopCh); err != nil {
+		if err := snap.GetRIB(ni, filter, msgCh, stopCh); err != nil {
 			errCh <- err
 			return
 		}
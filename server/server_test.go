@@ -17,11 +17,19 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/openconfig/gribigo/chk"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/prototext"
@@ -30,8 +38,11 @@ import (
 
 	aftpb "github.com/openconfig/gribi/v1/proto/gribi_aft"
 	spb "github.com/openconfig/gribi/v1/proto/service"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
 	"github.com/openconfig/gribigo/rib"
 	wpb "github.com/openconfig/ygot/proto/ywrapper"
+	"github.com/openconfig/ygot/ygot"
 )
 
 func TestNewClient(t *testing.T) {
@@ -84,7 +95,7 @@ func TestNewClient(t *testing.T) {
 				}
 			}
 			if diff := cmp.Diff(tt.wantClients, s.cs,
-				cmp.AllowUnexported(clientState{})); diff != "" {
+				cmp.AllowUnexported(clientState{}), cmpopts.IgnoreFields(clientState{}, "done")); diff != "" {
 				t.Fatalf("did not get expected clients, diff(-want,+got):\n%s", diff)
 			}
 		})
@@ -506,6 +517,10 @@ func TestIsNewMaster(t *testing.T) {
 		desc:    "not master",
 		inCand:  &spb.Uint128{High: 1, Low: 1},
 		inExist: &spb.Uint128{High: 44, Low: 42},
+	}, {
+		desc:    "not master - higher low, lower high",
+		inCand:  &spb.Uint128{High: 1, Low: 100},
+		inExist: &spb.Uint128{High: 2, Low: 1},
 	}}
 
 	for _, tt := range tests {
@@ -614,6 +629,67 @@ func TestRunElection(t *testing.T) {
 		},
 		wantServerElecID: &spb.Uint128{High: 0, Low: 4000},
 		wantServerMaster: "existing",
+	}, {
+		desc: "equal election ID from another client becomes master",
+		inServer: &Server{
+			cs: map[string]*clientState{
+				"c2": {
+					params: &clientParams{
+						ExpectElecID: true,
+					},
+				},
+			},
+			curElecID: &spb.Uint128{High: 1, Low: 42},
+			curMaster: "c1",
+		},
+		inID:     "c2",
+		inElecID: &spb.Uint128{High: 1, Low: 42},
+		wantResponse: &spb.ModifyResponse{
+			ElectionId: &spb.Uint128{High: 1, Low: 42},
+		},
+		wantServerElecID: &spb.Uint128{High: 1, Low: 42},
+		wantServerMaster: "c2",
+	}, {
+		desc: "master re-advertises its election ID",
+		inServer: &Server{
+			cs: map[string]*clientState{
+				"c1": {
+					params: &clientParams{
+						ExpectElecID: true,
+					},
+					lastElecID: &spb.Uint128{High: 0, Low: 42},
+				},
+			},
+			curElecID: &spb.Uint128{High: 0, Low: 42},
+			curMaster: "c1",
+		},
+		inID:     "c1",
+		inElecID: &spb.Uint128{High: 0, Low: 42},
+		wantResponse: &spb.ModifyResponse{
+			ElectionId: &spb.Uint128{High: 0, Low: 42},
+		},
+		wantServerElecID: &spb.Uint128{High: 0, Low: 42},
+		wantServerMaster: "c1",
+	}, {
+		desc: "does not become master - higher low, lower high",
+		inServer: &Server{
+			cs: map[string]*clientState{
+				"c2": {
+					params: &clientParams{
+						ExpectElecID: true,
+					},
+				},
+			},
+			curElecID: &spb.Uint128{High: 2, Low: 1},
+			curMaster: "c1",
+		},
+		inID:     "c2",
+		inElecID: &spb.Uint128{High: 1, Low: 100},
+		wantResponse: &spb.ModifyResponse{
+			ElectionId: &spb.Uint128{High: 2, Low: 1},
+		},
+		wantServerElecID: &spb.Uint128{High: 2, Low: 1},
+		wantServerMaster: "c1",
 	}, {
 		desc: "not expecting election",
 		inServer: &Server{
@@ -820,7 +896,11 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     1,
 					Status: spb.AFTResult_RIB_PROGRAMMED,
-				}, {
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
 					Id:     1,
 					Status: spb.AFTResult_FIB_PROGRAMMED,
 				}},
@@ -907,6 +987,9 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     84,
 					Status: spb.AFTResult_FAILED,
+					ErrorDetails: &spb.AFTErrorDetails{
+						ErrorMessage: `invalid IPv4 prefix "F-I-S-H", must be an IPv4 address and prefix length`,
+					},
 				}},
 			},
 		}},
@@ -958,7 +1041,11 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     1,
 					Status: spb.AFTResult_RIB_PROGRAMMED,
-				}, {
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
 					Id:     1,
 					Status: spb.AFTResult_FIB_PROGRAMMED,
 				}},
@@ -968,7 +1055,11 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     2,
 					Status: spb.AFTResult_RIB_PROGRAMMED,
-				}, {
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
 					Id:     2,
 					Status: spb.AFTResult_FIB_PROGRAMMED,
 				}},
@@ -1054,7 +1145,11 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     1,
 					Status: spb.AFTResult_RIB_PROGRAMMED,
-				}, {
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
 					Id:     1,
 					Status: spb.AFTResult_FIB_PROGRAMMED,
 				}},
@@ -1064,7 +1159,11 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     2,
 					Status: spb.AFTResult_RIB_PROGRAMMED,
-				}, {
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
 					Id:     2,
 					Status: spb.AFTResult_FIB_PROGRAMMED,
 				}},
@@ -1074,7 +1173,11 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     3,
 					Status: spb.AFTResult_RIB_PROGRAMMED,
-				}, {
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
 					Id:     3,
 					Status: spb.AFTResult_FIB_PROGRAMMED,
 				}},
@@ -1084,1432 +1187,3801 @@ func TestDoModify(t *testing.T) {
 				Result: []*spb.AFTResult{{
 					Id:     4,
 					Status: spb.AFTResult_RIB_PROGRAMMED,
-				}, {
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
 					Id:     4,
 					Status: spb.AFTResult_FIB_PROGRAMMED,
 				}},
 			},
 		}},
-	}}
-
-	type recvMsg struct {
-		result *spb.ModifyResponse
-		err    error
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.desc, func(t *testing.T) {
-			errCh := make(chan error)
-			resCh := make(chan *spb.ModifyResponse)
-
-			go tt.inServer.doModify(tt.inCID, tt.inOps, resCh, errCh)
-			got := []*recvMsg{}
-			for i := 0; i < len(tt.wantMsg); i++ {
-				gotMsg := &recvMsg{}
-				select {
-				case err := <-errCh:
-					gotMsg.err = err
-				case got := <-resCh:
-					gotMsg.result = got
-				}
-				got = append(got, gotMsg)
+	}, {
+		desc: "decreasing operation ID",
+		inServer: func() *Server {
+			s, err := New(WithIncreasingOperationIDs())
+			if err != nil {
+				t.Fatalf("cannot create server, error: %v", err)
 			}
-
-			lessFn := func(i, j int) bool {
-				switch {
-				case got[i].err != nil && got[j].err != nil:
-					return fmt.Sprintf("%v", got[i].err) < fmt.Sprintf("%v", got[j].err)
-				case got[i].err != nil:
-					return true
-				case got[j].err != nil:
-					return false
-				default:
-					iid := got[i].result.GetResult()[0].GetId()
-					jid := got[j].result.GetResult()[0].GetId()
-					return iid < jid
-				}
+			s.cs["testclient"] = &clientState{
+				params: &clientParams{
+					Persist:      true,
+					ExpectElecID: true,
+				},
+				lastElecID: &spb.Uint128{High: 42, Low: 42},
 			}
-			sort.Slice(got, lessFn)
-			sort.Slice(tt.wantMsg, lessFn)
-
-			if len(got) != len(tt.wantMsg) {
-				t.Fatalf("did not get expected number of messages, got: %d, want: %d", len(got), len(tt.wantMsg))
+			s.curElecID = &spb.Uint128{High: 42, Low: 42}
+			s.curMaster = "testclient"
+			return s
+		}(),
+		inCID: "testclient",
+		inOps: []*spb.AFTOperation{{
+			Id:              2,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   1,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}, {
+			Id:              1,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   2,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}, {
+			Id:              3,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   3,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}},
+		wantMsg: []*expectedMsg{{
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     1,
+					Status: spb.AFTResult_FAILED,
+					ErrorDetails: &spb.AFTErrorDetails{
+						ErrorMessage: "operation ID 1 is not greater than the previous operation ID 2",
+					},
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     2,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     3,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			},
+		}},
+	}, {
+		desc: "reused operation ID from earlier request",
+		inServer: func() *Server {
+			s, err := New(WithIncreasingOperationIDs())
+			if err != nil {
+				t.Fatalf("cannot create server, error: %v", err)
 			}
-
-			for i := 0; i < len(tt.wantMsg); i++ {
-				wantMsg := tt.wantMsg[i]
-				gotMsg := got[i]
-				if err := gotMsg.err; err != nil {
-					checkStatusErr(t, err, wantMsg.errCode, wantMsg.errReason)
-				}
-				if wantMsg.result != nil {
-					if diff := cmp.Diff(gotMsg.result, wantMsg.result, protocmp.Transform()); diff != "" {
-						t.Fatalf("did not get expected response, diff(-got,+want):\n%s", diff)
-					}
-				}
+			s.cs["testclient"] = &clientState{
+				params: &clientParams{
+					Persist:      true,
+					ExpectElecID: true,
+				},
+				lastElecID: &spb.Uint128{High: 42, Low: 42},
+				lastOpID:   5,
 			}
-		})
-	}
-}
-
-func TestModifyEntry(t *testing.T) {
-	defName := DefaultNetworkInstanceName
-	tests := []struct {
-		desc           string
-		inRIB          *rib.RIB
-		inNI           string
-		inOp           *spb.AFTOperation
-		inFIBACK       bool
-		inElection     *electionDetails
-		wantResponse   *spb.ModifyResponse
-		wantErrCode    codes.Code
-		wantErrDetails spb.ModifyRPCErrorDetails_Reason
-	}{{
-		desc:        "nil election ID",
-		inRIB:       rib.New(defName),
-		inOp:        &spb.AFTOperation{},
-		wantErrCode: codes.FailedPrecondition,
-	}, {
-		desc:  "invalid election",
-		inRIB: rib.New(defName),
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 0, Low: 1},
-		},
-		wantErrCode: codes.Internal,
-	}, {
-		desc:  "client hasn't sent election ID",
-		inRIB: rib.New(defName),
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 0, Low: 1},
-		},
-		inElection: &electionDetails{
-			master: "some-client",
-			ID:     &spb.Uint128{High: 1, Low: 1},
-		},
-		wantErrCode: codes.FailedPrecondition,
-	}, {
-		desc:  "client gives higher ID than known master",
+			s.curElecID = &spb.Uint128{High: 42, Low: 42}
+			s.curMaster = "testclient"
+			return s
+		}(),
+		inCID: "testclient",
+		inOps: []*spb.AFTOperation{{
+			Id:              5,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   1,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}},
+		wantMsg: []*expectedMsg{{
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     5,
+					Status: spb.AFTResult_FAILED,
+					ErrorDetails: &spb.AFTErrorDetails{
+						ErrorMessage: "operation ID 5 is not greater than the previous operation ID 5",
+					},
+				}},
+			},
+		}},
+	}, {
+		desc: "unknown network instance does not stop subsequent operations",
+		inServer: func() *Server {
+			s, err := New()
+			if err != nil {
+				t.Fatalf("cannot create server, error: %v", err)
+			}
+			s.cs["testclient"] = &clientState{
+				params: &clientParams{
+					Persist:      true,
+					ExpectElecID: true,
+				},
+				lastElecID: &spb.Uint128{High: 42, Low: 42},
+			}
+			s.curElecID = &spb.Uint128{High: 42, Low: 42}
+			s.curMaster = "testclient"
+			return s
+		}(),
+		inCID: "testclient",
+		inOps: []*spb.AFTOperation{{
+			Id:              1,
+			NetworkInstance: "FISH",
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   1,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}, {
+			Id:              2,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   1,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}},
+		wantMsg: []*expectedMsg{{
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     1,
+					Status: spb.AFTResult_FAILED,
+					ErrorDetails: &spb.AFTErrorDetails{
+						ErrorMessage: `unknown network instance "FISH" specified`,
+					},
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     2,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			},
+		}},
+	}, {
+		desc: "entries referencing other network instances",
+		inServer: func() *Server {
+			s, err := New(WithVRFs([]string{"VRF-A"}))
+			if err != nil {
+				t.Fatalf("cannot create server, error: %v", err)
+			}
+			s.cs["testclient"] = &clientState{
+				params: &clientParams{
+					Persist:      true,
+					ExpectElecID: true,
+				},
+				lastElecID: &spb.Uint128{High: 42, Low: 42},
+			}
+			s.curElecID = &spb.Uint128{High: 42, Low: 42}
+			s.curMaster = "testclient"
+			return s
+		}(),
+		inCID: "testclient",
+		inOps: []*spb.AFTOperation{{
+			Id:              1,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   1,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}, {
+			Id:              2,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id: 1,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{
+						NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+							Index:   1,
+							NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+						}},
+					},
+				},
+			},
+		}, {
+			Id:              3,
+			NetworkInstance: "VRF-A",
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: "192.0.2.1/32",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup:                &wpb.UintValue{Value: 1},
+						NextHopGroupNetworkInstance: &wpb.StringValue{Value: DefaultNetworkInstanceName},
+					},
+				},
+			},
+		}, {
+			Id:              4,
+			NetworkInstance: "VRF-A",
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 2,
+					NextHop: &aftpb.Afts_NextHop{
+						NetworkInstance: &wpb.StringValue{Value: "VRF-A"},
+					},
+				},
+			},
+		}, {
+			Id:              5,
+			NetworkInstance: "VRF-A",
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 42, Low: 42},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 3,
+					NextHop: &aftpb.Afts_NextHop{
+						NetworkInstance: &wpb.StringValue{Value: "VRF-B"},
+					},
+				},
+			},
+		}},
+		wantMsg: []*expectedMsg{{
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     1,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     2,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     3,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     4,
+					Status: spb.AFTResult_RIB_PROGRAMMED,
+				}},
+			},
+		}, {
+			result: &spb.ModifyResponse{
+				Result: []*spb.AFTResult{{
+					Id:     5,
+					Status: spb.AFTResult_FAILED,
+					ErrorDetails: &spb.AFTErrorDetails{
+						ErrorMessage: "invalid unknown network-instance VRF-B for next-hop 3 in NI VRF-A",
+					},
+				}},
+			},
+		}},
+	}}
+
+	type recvMsg struct {
+		result *spb.ModifyResponse
+		err    error
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			errCh := make(chan error)
+			resCh := make(chan *spb.ModifyResponse)
+
+			go tt.inServer.doModify(tt.inCID, tt.inOps, resCh, errCh)
+			got := []*recvMsg{}
+			for i := 0; i < len(tt.wantMsg); i++ {
+				gotMsg := &recvMsg{}
+				select {
+				case err := <-errCh:
+					gotMsg.err = err
+				case got := <-resCh:
+					gotMsg.result = got
+				}
+				got = append(got, gotMsg)
+			}
+
+			lessFn := func(i, j int) bool {
+				switch {
+				case got[i].err != nil && got[j].err != nil:
+					return fmt.Sprintf("%v", got[i].err) < fmt.Sprintf("%v", got[j].err)
+				case got[i].err != nil:
+					return true
+				case got[j].err != nil:
+					return false
+				default:
+					ir, jr := got[i].result.GetResult()[0], got[j].result.GetResult()[0]
+					if ir.GetId() == jr.GetId() {
+						return ir.GetStatus() < jr.GetStatus()
+					}
+					return ir.GetId() < jr.GetId()
+				}
+			}
+			sort.Slice(got, lessFn)
+			sort.Slice(tt.wantMsg, lessFn)
+
+			if len(got) != len(tt.wantMsg) {
+				t.Fatalf("did not get expected number of messages, got: %d, want: %d", len(got), len(tt.wantMsg))
+			}
+
+			for i := 0; i < len(tt.wantMsg); i++ {
+				wantMsg := tt.wantMsg[i]
+				gotMsg := got[i]
+				if err := gotMsg.err; err != nil {
+					checkStatusErr(t, err, wantMsg.errCode, wantMsg.errReason)
+				}
+				if wantMsg.result != nil {
+					if diff := cmp.Diff(gotMsg.result, wantMsg.result, protocmp.Transform()); diff != "" {
+						t.Fatalf("did not get expected response, diff(-got,+want):\n%s", diff)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestDoModifySemantics checks the results that are returned to a client for ADD,
+// REPLACE and DELETE operations for each AFT, for both existing and missing
+// entries. Whether the entries that can be referenced by the entry under test are
+// referenced after the operation is checked by attempting to delete them.
+func TestDoModifySemantics(t *testing.T) {
+	elecID := &spb.Uint128{High: 0, Low: 1}
+
+	afts := []struct {
+		name string
+		// set sets the entry within op to an entry for the AFT which references
+		// the next-hop-group (or next-hop in the case of a next-hop-group) ref.
+		set func(op *spb.AFTOperation, ref uint64)
+		// refEntry sets the entry within op to the entry with ID i that can be
+		// referenced by the entry under test, it is nil if the entry does not
+		// reference others.
+		refEntry func(op *spb.AFTOperation, i uint64)
+	}{{
+		name: "ipv4",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: "192.0.2.0/24",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup: &wpb.UintValue{Value: ref},
+					},
+				},
+			}
+		},
+		refEntry: nhgEntry,
+	}, {
+		name: "ipv6",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_Ipv6{
+				Ipv6: &aftpb.Afts_Ipv6EntryKey{
+					Prefix: "2001:db8::/32",
+					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+						NextHopGroup: &wpb.UintValue{Value: ref},
+					},
+				},
+			}
+		},
+		refEntry: nhgEntry,
+	}, {
+		name: "mpls",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_Mpls{
+				Mpls: &aftpb.Afts_LabelEntryKey{
+					Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
+						LabelUint64: 42,
+					},
+					LabelEntry: &aftpb.Afts_LabelEntry{
+						NextHopGroup: &wpb.UintValue{Value: ref},
+					},
+				},
+			}
+		},
+		refEntry: nhgEntry,
+	}, {
+		name: "next-hop-group",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id: 10,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{
+						NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+							Index:   ref,
+							NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+						}},
+					},
+				},
+			}
+		},
+		refEntry: nhEntry,
+	}, {
+		name: "next-hop",
+		set: func(op *spb.AFTOperation, ref uint64) {
+			op.Entry = &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 10,
+					NextHop: &aftpb.Afts_NextHop{
+						IpAddress: &wpb.StringValue{Value: fmt.Sprintf("192.0.2.%d", ref)},
+					},
+				},
+			}
+		},
+	}}
+
+	tests := []struct {
+		desc string
+		// inExisting specifies whether the entry under test exists, referencing
+		// entry 1, prior to the operation.
+		inExisting bool
+		inOp       spb.AFTOperation_Operation
+		inRef      uint64
+		wantStatus spb.AFTResult_Status
+		// wantReferenced indicates whether entries 1 and 2 are expected to be
+		// referenced after the operation.
+		wantReferenced [2]bool
+	}{{
+		desc:           "ADD missing entry",
+		inOp:           spb.AFTOperation_ADD,
+		inRef:          1,
+		wantStatus:     spb.AFTResult_RIB_PROGRAMMED,
+		wantReferenced: [2]bool{true, false},
+	}, {
+		desc:           "ADD existing entry with same contents",
+		inExisting:     true,
+		inOp:           spb.AFTOperation_ADD,
+		inRef:          1,
+		wantStatus:     spb.AFTResult_RIB_PROGRAMMED,
+		wantReferenced: [2]bool{true, false},
+	}, {
+		desc:           "ADD existing entry is an implicit replace",
+		inExisting:     true,
+		inOp:           spb.AFTOperation_ADD,
+		inRef:          2,
+		wantStatus:     spb.AFTResult_RIB_PROGRAMMED,
+		wantReferenced: [2]bool{false, true},
+	}, {
+		desc:       "REPLACE missing entry",
+		inOp:       spb.AFTOperation_REPLACE,
+		inRef:      1,
+		wantStatus: spb.AFTResult_FAILED,
+	}, {
+		desc:           "REPLACE existing entry",
+		inExisting:     true,
+		inOp:           spb.AFTOperation_REPLACE,
+		inRef:          2,
+		wantStatus:     spb.AFTResult_RIB_PROGRAMMED,
+		wantReferenced: [2]bool{false, true},
+	}, {
+		desc:       "DELETE missing entry",
+		inOp:       spb.AFTOperation_DELETE,
+		inRef:      1,
+		wantStatus: spb.AFTResult_RIB_PROGRAMMED,
+	}, {
+		desc:       "DELETE existing entry",
+		inExisting: true,
+		inOp:       spb.AFTOperation_DELETE,
+		inRef:      1,
+		wantStatus: spb.AFTResult_RIB_PROGRAMMED,
+	}}
+
+	for _, a := range afts {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s: %s", a.name, tt.desc), func(t *testing.T) {
+				s, err := New()
+				if err != nil {
+					t.Fatalf("cannot create server, %v", err)
+				}
+				s.cs["testclient"] = &clientState{
+					params: &clientParams{
+						Persist:      true,
+						ExpectElecID: true,
+					},
+					lastElecID: elecID,
+				}
+				s.curElecID = elecID
+				s.curMaster = "testclient"
+
+				var id uint64
+				// do runs an operation of type o, with its entry set by set, via the
+				// server's Modify handling and returns the result.
+				do := func(o spb.AFTOperation_Operation, set func(*spb.AFTOperation)) *spb.AFTResult {
+					t.Helper()
+					id++
+					op := &spb.AFTOperation{
+						Id:              id,
+						NetworkInstance: DefaultNetworkInstanceName,
+						Op:              o,
+						ElectionId:      elecID,
+					}
+					set(op)
+
+					resCh := make(chan *spb.ModifyResponse, 1)
+					errCh := make(chan error, 1)
+					s.doModify("testclient", []*spb.AFTOperation{op}, resCh, errCh)
+					select {
+					case err := <-errCh:
+						t.Fatalf("got unexpected error for operation %s, %v", op, err)
+					case res := <-resCh:
+						if len(res.GetResult()) != 1 {
+							t.Fatalf("did not get expected number of results for operation %s, got: %s", op, res)
+						}
+						return res.GetResult()[0]
+					default:
+						t.Fatalf("did not get result for operation %s", op)
+					}
+					return nil
+				}
+				mustAdd := func(set func(*spb.AFTOperation)) {
+					t.Helper()
+					if got := do(spb.AFTOperation_ADD, set); got.GetStatus() != spb.AFTResult_RIB_PROGRAMMED {
+						t.Fatalf("cannot build base RIB, got: %s", got)
+					}
+				}
+
+				// Base topology of two next-hops, and two next-hop-groups which
+				// can be referenced by the entry under test. When the entry under
+				// test is a next-hop-group, the base next-hop-groups are not created
+				// such that the next-hops are referenced only by the entry under test.
+				for _, i := range []uint64{1, 2} {
+					i := i
+					mustAdd(func(op *spb.AFTOperation) { nhEntry(op, i) })
+				}
+				if a.name != "next-hop-group" {
+					for _, i := range []uint64{1, 2} {
+						i := i
+						mustAdd(func(op *spb.AFTOperation) { nhgEntry(op, i) })
+					}
+				}
+
+				if tt.inExisting {
+					mustAdd(func(op *spb.AFTOperation) { a.set(op, 1) })
+				}
+
+				if got := do(tt.inOp, func(op *spb.AFTOperation) { a.set(op, tt.inRef) }); got.GetStatus() != tt.wantStatus {
+					t.Fatalf("did not get expected result, got: %s, want status: %s", got, tt.wantStatus)
+				}
+
+				if a.refEntry == nil {
+					return
+				}
+				// An entry that is referenced cannot be deleted.
+				for i, wantRef := range tt.wantReferenced {
+					ref := uint64(i + 1)
+					got := do(spb.AFTOperation_DELETE, func(op *spb.AFTOperation) { a.refEntry(op, ref) })
+					if gotRef := got.GetStatus() == spb.AFTResult_FAILED; gotRef != wantRef {
+						t.Errorf("did not get expected referenced status for entry %d, got: %v (result: %s), want: %v", ref, gotRef, got, wantRef)
+					}
+				}
+			})
+		}
+	}
+}
+
+// nhEntry sets the entry within op to a next-hop with index i.
+func nhEntry(op *spb.AFTOperation, i uint64) {
+	op.Entry = &spb.AFTOperation_NextHop{
+		NextHop: &aftpb.Afts_NextHopKey{
+			Index:   i,
+			NextHop: &aftpb.Afts_NextHop{},
+		},
+	}
+}
+
+// nhgEntry sets the entry within op to a next-hop-group with ID i which references
+// the next-hop with index i.
+func nhgEntry(op *spb.AFTOperation, i uint64) {
+	op.Entry = &spb.AFTOperation_NextHopGroup{
+		NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+			Id: i,
+			NextHopGroup: &aftpb.Afts_NextHopGroup{
+				NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+					Index:   i,
+					NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+				}},
+			},
+		},
+	}
+}
+
+func TestModifyEntry(t *testing.T) {
+	defName := DefaultNetworkInstanceName
+	tests := []struct {
+		desc           string
+		inRIB          *rib.RIB
+		inNI           string
+		inOp           *spb.AFTOperation
+		inFIBACK       bool
+		inElection     *electionDetails
+		wantResponse   *spb.ModifyResponse
+		wantErrCode    codes.Code
+		wantErrDetails spb.ModifyRPCErrorDetails_Reason
+		// wantResultErrSubstring is a substring that is expected within the
+		// error message of the first result, when it is set, the error message
+		// is otherwise ignored when comparing the response.
+		wantResultErrSubstring string
+	}{{
+		desc:  "nil election ID",
+		inRIB: rib.New(defName),
+		inOp:  &spb.AFTOperation{Id: 1},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 1, Low: 1},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 1, Low: 1},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     1,
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+		wantResultErrSubstring: NotPrimary,
+	}, {
+		desc:  "invalid election",
+		inRIB: rib.New(defName),
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 0, Low: 1},
+		},
+		wantErrCode: codes.Internal,
+	}, {
+		desc:  "client hasn't sent election ID",
+		inRIB: rib.New(defName),
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 0, Low: 1},
+		},
+		inElection: &electionDetails{
+			master: "some-client",
+			ID:     &spb.Uint128{High: 1, Low: 1},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+		wantResultErrSubstring: NotPrimary,
+	}, {
+		desc:  "no client has been elected",
+		inRIB: rib.New(defName),
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 0, Low: 1},
+			Id:         3,
+		},
+		inElection: &electionDetails{
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 0, Low: 1},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     3,
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+		wantResultErrSubstring: NotPrimary,
+	}, {
+		desc:  "client gives higher ID than known master",
+		inRIB: rib.New(defName),
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 2, Low: 0},
+			Id:         1,
+		},
+		inElection: &electionDetails{
+			master: "this-client",
+			// note: this is an internal error that should never happen :-)
+			// so of course we test what happens when it does. In this case
+			// we have got to the stage whereby we decided that our client sent
+			// us a later ID than the one that we think is the master, even though
+			// this client is the master. In this case, we've missed updating
+			// the master ID somehow as new elections happen.
+			ID:           &spb.Uint128{High: 1, Low: 1},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 2, Low: 0},
+		},
+		wantErrCode: codes.FailedPrecondition,
+	}, {
+		desc:  "client gives lower ID than known master",
+		inRIB: rib.New(defName),
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 1, Low: 0},
+			Id:         1,
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 1, Low: 1},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 1, Low: 0},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     1,
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+		wantResultErrSubstring: NotPrimary,
+	}, {
+		desc:  "client is not master - by name",
+		inRIB: rib.New(defName),
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 0, Low: 1},
+			Id:         2,
+		},
+		inElection: &electionDetails{
+			master:       "not-this-client",
+			ID:           &spb.Uint128{High: 1, Low: 1},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 2, Low: 0},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+		wantResultErrSubstring: NotPrimary,
+	}, {
+		desc:  "client is not master - by mismatched latest",
+		inRIB: rib.New(defName),
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 0, Low: 2},
+			Id:         2,
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 0, Low: 1},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 0, Low: 1},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+		wantResultErrSubstring: NotPrimary,
+	}, {
+		desc:        "nil operation",
+		inRIB:       rib.New(defName),
+		wantErrCode: codes.Internal,
+	}, {
+		desc:  "unsupported operation type",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 0, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_INVALID,
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 0, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 0, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_FAILED,
+				ErrorDetails: &spb.AFTErrorDetails{
+					ErrorMessage: "unsupported operation type supplied, INVALID",
+				},
+			}},
+		},
+	}, {
+		desc:        "nil RIB",
+		wantErrCode: codes.Internal,
+	}, {
+		desc:  "ADD v4: rib ACK",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: "2.2.2.2/32",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup: &wpb.UintValue{Value: 1},
+					},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:  "ADD v4: fib ACK",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: "2.2.2.2/32",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup: &wpb.UintValue{Value: 1},
+					},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		inFIBACK: true,
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}, {
+				Id:     2,
+				Status: spb.AFTResult_FIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:  "ADD v6: rib ACK",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Ipv6{
+				Ipv6: &aftpb.Afts_Ipv6EntryKey{
+					Prefix: "2001:db8::/32",
+					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+						NextHopGroup: &wpb.UintValue{Value: 1},
+					},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:  "ADD v6: fib ACK",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Ipv6{
+				Ipv6: &aftpb.Afts_Ipv6EntryKey{
+					Prefix: "2001:db8:cafe::/48",
+					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+						NextHopGroup: &wpb.UintValue{Value: 1},
+					},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		inFIBACK: true,
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}, {
+				Id:     2,
+				Status: spb.AFTResult_FIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:  "ADD MPLS: rib ACK",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Mpls{
+				Mpls: &aftpb.Afts_LabelEntryKey{
+					Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
+						LabelUint64: 42,
+					},
+					LabelEntry: &aftpb.Afts_LabelEntry{
+						NextHopGroup: &wpb.UintValue{Value: 1},
+					},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:  "ADD NHG",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id:           2,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:  "ADD NH",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   2,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:        "nil RIB",
+		inRIB:       nil,
+		wantErrCode: codes.Internal,
+	}, {
+		desc:        "invalid RIB",
+		inRIB:       &rib.RIB{},
+		inNI:        "fish",
+		wantErrCode: codes.Internal,
+	}, {
+		desc:  "ADD NHG",
+		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
+		inNI:  defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id:           2,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc: "DELETE NH",
+		inRIB: func() *rib.RIB {
+			r := rib.New(defName)
+			if _, _, err := r.AddEntry(defName, &spb.AFTOperation{
+				Id: 3,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   2,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}); err != nil {
+				panic(fmt.Sprintf("cannot build test case, got err: %v", err))
+			}
+			return r
+		}(),
+		inNI: defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_DELETE,
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 2,
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc:  "DELETE Missing NHG",
 		inRIB: rib.New(defName),
+		inNI:  defName,
 		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 2, Low: 0},
-			Id:         1,
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_DELETE,
+			Entry: &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id: 2,
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_RIB_PROGRAMMED,
+			}},
+		},
+	}, {
+		desc: "DELETE NH failed due to refcount",
+		inRIB: func() *rib.RIB {
+			r := rib.New(defName)
+			if _, fails, err := r.AddEntry(defName, &spb.AFTOperation{
+				Id: 3,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   2,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}); err != nil || len(fails) != 0 {
+				panic(fmt.Sprintf("cannot build test case, can't add NH, got err: %v, fails: %v", err, fails[0]))
+			}
+
+			if _, fails, err := r.AddEntry(defName, &spb.AFTOperation{
+				Id: 3,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHopGroup{
+					NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+						Id: 2,
+						NextHopGroup: &aftpb.Afts_NextHopGroup{
+							NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+								Index:   2,
+								NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+							}},
+						},
+					},
+				},
+			}); err != nil || len(fails) != 0 {
+				panic(fmt.Sprintf("cannot build test case, can't add NHG, got err: %v, fails: %v", err, fails[0]))
+
+			}
+
+			return r
+		}(),
+		inNI: defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_DELETE,
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 2,
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+	}, {
+		desc: "REPLACE NH",
+		inRIB: func() *rib.RIB {
+			r := rib.New(defName)
+			if _, _, err := r.AddEntry(defName, &spb.AFTOperation{
+				Id: 3,
+				Op: spb.AFTOperation_ADD,
+				Entry: &spb.AFTOperation_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index:   2,
+						NextHop: &aftpb.Afts_NextHop{},
+					},
+				},
+			}); err != nil {
+				panic(fmt.Sprintf("cannot build test case, got err: %v", err))
+			}
+			return r
+		}(),
+		inNI: defName,
+		inOp: &spb.AFTOperation{
+			ElectionId: &spb.Uint128{High: 4, Low: 2},
+			Id:         2,
+			Op:         spb.AFTOperation_REPLACE,
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 2,
+					NextHop: &aftpb.Afts_NextHop{
+						IpAddress: &wpb.StringValue{Value: "NOT VALID"},
+					},
+				},
+			},
+		},
+		inElection: &electionDetails{
+			master:       "this-client",
+			ID:           &spb.Uint128{High: 4, Low: 2},
+			client:       "this-client",
+			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		},
+		wantResponse: &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     2,
+				Status: spb.AFTResult_FAILED,
+			}},
+		},
+		wantResultErrSubstring: `"NOT VALID" does not match regular expression pattern`,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, _, err := modifyEntry(tt.inRIB, "", tt.inNI, tt.inOp, tt.inFIBACK, tt.inElection)
+			if err != nil {
+				checkStatusErr(t, err, tt.wantErrCode, tt.wantErrDetails)
+			}
+			opts := []cmp.Option{protocmp.Transform()}
+			if tt.wantResultErrSubstring != "" {
+				if msg := got.GetResult()[0].GetErrorDetails().GetErrorMessage(); !strings.Contains(msg, tt.wantResultErrSubstring) {
+					t.Fatalf("did not get expected error message, got: %s, want substring: %s", msg, tt.wantResultErrSubstring)
+				}
+				opts = append(opts, protocmp.IgnoreFields(&spb.AFTResult{}, "error_details"))
+			}
+			if diff := cmp.Diff(got, tt.wantResponse, opts...); diff != "" {
+				t.Fatalf("did not get expected response, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDoGet(t *testing.T) {
+	// serverAllRIBs is a function that returns a server with one entry in each RIB
+	// populated.
+	serverAllRIBs := func() *Server {
+		// use a nil function to check the RIB so that addEntry always succeeds
+		s, err := New(DisableRIBCheckFn())
+		if err != nil {
+			t.Fatalf("cannot create server, %v", err)
+		}
+
+		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
+			Id:              1,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index: 1,
+					NextHop: &aftpb.Afts_NextHop{
+						PushedMplsLabelStack: []*aftpb.Afts_NextHop_PushedMplsLabelStackUnion{{
+							PushedMplsLabelStackUint64: 42,
+						}},
+					},
+				},
+			},
+		}); err != nil {
+			t.Fatalf("cannot build test case, NH, err: %v", err)
+		}
+
+		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
+			Id:              1,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id:           1,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{},
+				},
+			},
+		}); err != nil {
+			t.Fatalf("cannot build test case, NHG, err: %v", err)
+		}
+
+		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
+			Id:              1,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix:    "1.1.1.1/32",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+				},
+			},
+		}); err != nil {
+			t.Fatalf("cannot build test case, IPv4, err: %v", err)
+		}
+
+		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
+			Id:              2,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Ipv6{
+				Ipv6: &aftpb.Afts_Ipv6EntryKey{
+					Prefix: "2001:db8::/32",
+					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+						NextHopGroup: &wpb.UintValue{Value: 1},
+					},
+				},
+			},
+		}); err != nil {
+			t.Fatalf("cannot build test case, IPv6, err: %v", err)
+		}
+
+		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
+			Id:              2,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Mpls{
+				Mpls: &aftpb.Afts_LabelEntryKey{
+					Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
+						LabelUint64: 42,
+					},
+					LabelEntry: &aftpb.Afts_LabelEntry{},
+				},
+			},
+		}); err != nil {
+			t.Fatalf("cannot build test case, MPLS, err: %v", err)
+		}
+
+		return s
+	}()
+
+	tests := []struct {
+		desc          string
+		inReq         *spb.GetRequest
+		inServer      *Server
+		wantResponses []*spb.GetResponse
+		wantErr       bool
+	}{{
+		desc: "single network-instance get, with empty RIB",
+		inReq: &spb.GetRequest{
+			NetworkInstance: &spb.GetRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
+			Aft: spb.AFTType_ALL,
 		},
-		inElection: &electionDetails{
-			master: "this-client",
-			// note: this is an internal error that should never happen :-)
-			// so of course we test what happens when it does. In this case
-			// we have got to the stage whereby we decided that our client sent
-			// us a later ID than the one that we think is the master, even though
-			// this client is the master. In this case, we've missed updating
-			// the master ID somehow as new elections happen.
-			ID:           &spb.Uint128{High: 1, Low: 1},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 2, Low: 0},
+	}, {
+		desc: "empty network instance name",
+		inReq: &spb.GetRequest{
+			NetworkInstance: &spb.GetRequest_Name{
+				Name: "",
+			},
+			Aft: spb.AFTType_ALL,
 		},
-		wantErrCode: codes.FailedPrecondition,
+		wantErr: true,
 	}, {
-		desc:  "client gives lower ID than known master",
-		inRIB: rib.New(defName),
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 1, Low: 0},
-			Id:         1,
+		desc: "all network instances",
+		inReq: &spb.GetRequest{
+			Aft: spb.AFTType_ALL,
+			NetworkInstance: &spb.GetRequest_All{
+				All: &spb.Empty{},
+			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 1, Low: 1},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 1, Low: 0},
+		inServer: func() *Server {
+			vrfNames := []string{"ONE", "EIGHT", "FOUR"}
+			s, err := New(
+				DisableRIBCheckFn(),
+				WithVRFs(vrfNames),
+			)
+			if err != nil {
+				t.Fatalf("cannot create server, err: %v", err)
+			}
+
+			prefixes := []string{"1.1.1.1/32", "8.8.8.8/32", "8.8.4.4/32"}
+
+			for i, pfx := range prefixes {
+				if _, _, err := s.masterRIB.AddEntry(vrfNames[i], &spb.AFTOperation{
+					Id:              uint64(i),
+					NetworkInstance: vrfNames[i],
+					Op:              spb.AFTOperation_ADD,
+					Entry: &spb.AFTOperation_Ipv4{
+						Ipv4: &aftpb.Afts_Ipv4EntryKey{
+							Prefix:    pfx,
+							Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+						},
+					},
+				}); err != nil {
+					panic(fmt.Sprintf("cannot build testcase, %v", err))
+				}
+			}
+			return s
+		}(),
+		wantResponses: []*spb.GetResponse{{
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: "ONE",
+				Entry: &spb.AFTEntry_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix:    "1.1.1.1/32",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+					},
+				},
+			}},
+		}, {
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: "EIGHT",
+				Entry: &spb.AFTEntry_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix:    "8.8.8.8/32",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+					},
+				},
+			}},
+		}, {
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: "FOUR",
+				Entry: &spb.AFTEntry_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix:    "8.8.4.4/32",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+					},
+				},
+			}},
+		}},
+	}, {
+		desc: "single non-default network instance",
+		inReq: &spb.GetRequest{
+			Aft: spb.AFTType_ALL,
+			NetworkInstance: &spb.GetRequest_Name{
+				Name: "EIGHT",
+			},
 		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     1,
-				Status: spb.AFTResult_FAILED,
+		inServer: func() *Server {
+			vrfNames := []string{"ONE", "EIGHT"}
+			s, err := New(
+				DisableRIBCheckFn(),
+				WithVRFs(vrfNames),
+			)
+			if err != nil {
+				t.Fatalf("cannot create server, err: %v", err)
+			}
+
+			prefixes := []string{"1.1.1.1/32", "8.8.8.8/32"}
+
+			for i, pfx := range prefixes {
+				if _, _, err := s.masterRIB.AddEntry(vrfNames[i], &spb.AFTOperation{
+					Id:              uint64(i),
+					NetworkInstance: vrfNames[i],
+					Op:              spb.AFTOperation_ADD,
+					Entry: &spb.AFTOperation_Ipv4{
+						Ipv4: &aftpb.Afts_Ipv4EntryKey{
+							Prefix:    pfx,
+							Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+						},
+					},
+				}); err != nil {
+					panic(fmt.Sprintf("cannot build testcase, %v", err))
+				}
+			}
+			return s
+		}(),
+		wantResponses: []*spb.GetResponse{{
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: "EIGHT",
+				Entry: &spb.AFTEntry_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix:    "8.8.8.8/32",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+					},
+				},
+			}},
+		}},
+	}, {
+		desc: "unknown network instance",
+		inReq: &spb.GetRequest{
+			NetworkInstance: &spb.GetRequest_Name{
+				Name: "FISH",
+			},
+			Aft: spb.AFTType_ALL,
+		},
+		wantErr: true,
+	}, {
+		desc: "single network-instance get with one entry in each table",
+		inReq: &spb.GetRequest{
+			NetworkInstance: &spb.GetRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
+			Aft: spb.AFTType_ALL,
+		},
+		inServer: serverAllRIBs,
+		wantResponses: []*spb.GetResponse{{
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: DefaultNetworkInstanceName,
+				Entry: &spb.AFTEntry_NextHopGroup{
+					NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+						Id:           1,
+						NextHopGroup: &aftpb.Afts_NextHopGroup{},
+					},
+				},
+			}},
+		}, {
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: DefaultNetworkInstanceName,
+				Entry: &spb.AFTEntry_NextHop{
+					NextHop: &aftpb.Afts_NextHopKey{
+						Index: 1,
+						NextHop: &aftpb.Afts_NextHop{
+							PushedMplsLabelStack: []*aftpb.Afts_NextHop_PushedMplsLabelStackUnion{{
+								PushedMplsLabelStackUint64: 42,
+							}},
+						},
+					},
+				},
+			}},
+		}, {
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: DefaultNetworkInstanceName,
+				Entry: &spb.AFTEntry_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix:    "1.1.1.1/32",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+					},
+				},
 			}},
-		},
+		}, {
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: DefaultNetworkInstanceName,
+				Entry: &spb.AFTEntry_Ipv6{
+					Ipv6: &aftpb.Afts_Ipv6EntryKey{
+						Prefix: "2001:db8::/32",
+						Ipv6Entry: &aftpb.Afts_Ipv6Entry{
+							NextHopGroup: &wpb.UintValue{Value: 1},
+						},
+					},
+				},
+			}},
+		}, {
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: DefaultNetworkInstanceName,
+				Entry: &spb.AFTEntry_Mpls{
+					Mpls: &aftpb.Afts_LabelEntryKey{
+						Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
+							LabelUint64: 42,
+						},
+						LabelEntry: &aftpb.Afts_LabelEntry{},
+					},
+				},
+			}},
+		}},
 	}, {
-		desc:  "client is not master - by name",
-		inRIB: rib.New(defName),
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 0, Low: 1},
-			Id:         2,
+		desc: "unsupported AFT",
+		inReq: &spb.GetRequest{
+			NetworkInstance: &spb.GetRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
+			Aft: spb.AFTType_MAC,
 		},
-		inElection: &electionDetails{
-			master:       "not-this-client",
-			ID:           &spb.Uint128{High: 1, Low: 1},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 2, Low: 0},
+		wantErr: true,
+	}, {
+		desc: "filter to ipv4",
+		inReq: &spb.GetRequest{
+			NetworkInstance: &spb.GetRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
+			Aft: spb.AFTType_IPV4,
 		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_FAILED,
+		inServer: serverAllRIBs,
+		wantResponses: []*spb.GetResponse{{
+			Entry: []*spb.AFTEntry{{
+				NetworkInstance: DefaultNetworkInstanceName,
+				Entry: &spb.AFTEntry_Ipv4{
+					Ipv4: &aftpb.Afts_Ipv4EntryKey{
+						Prefix:    "1.1.1.1/32",
+						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+					},
+				},
 			}},
+		}},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			errCh := make(chan error)
+			doneCh := make(chan struct{})
+			stopCh := make(chan struct{})
+			msgCh := make(chan *spb.GetResponse)
+
+			s := tt.inServer
+			if tt.inServer == nil {
+				var err error
+				s, err = New()
+				if err != nil {
+					t.Fatalf("cannot create server, %v", err)
+				}
+			}
+			go s.doGet(tt.inReq, msgCh, doneCh, stopCh, errCh)
+
+			var gotErr error
+			var done bool
+			got := []*spb.GetResponse{}
+			for !done {
+				select {
+				case r := <-msgCh:
+					got = append(got, r)
+				case err := <-errCh:
+					gotErr = err
+					done = true
+				case <-doneCh:
+					done = true
+				}
+			}
+
+			if (gotErr != nil) != tt.wantErr {
+				t.Fatalf("did not get expected error, got: %v, wantErr? %v", gotErr, tt.wantErr)
+			}
+
+			if diff := cmp.Diff(got, tt.wantResponses,
+				cmpopts.EquateEmpty(),
+				protocmp.Transform(),
+				cmpopts.SortSlices(func(a, b *spb.GetResponse) bool {
+					return prototext.Format(a) < prototext.Format(b)
+				}),
+				protocmp.SortRepeated(func(a, b *spb.AFTEntry) bool {
+					return prototext.Format(a) < prototext.Format(b)
+				})); diff != "" {
+				t.Fatalf("did not get expected responses, diff(-got,+want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckFlushRequest(t *testing.T) {
+	tests := []struct {
+		desc           string
+		inServer       *Server
+		inRequest      *spb.FlushRequest
+		wantErrCode    codes.Code
+		wantErrDetails *spb.FlushResponseError
+	}{{
+		desc: "network instance is not specified",
+		inServer: &Server{
+			curElecID: &spb.Uint128{High: 0, Low: 3},
 		},
-	}, {
-		desc:  "client is not master - by mismatched latest",
-		inRIB: rib.New(defName),
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 0, Low: 2},
-			Id:         2,
-		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 0, Low: 1},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 0, Low: 1},
+		inRequest: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 3},
+			},
 		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_FAILED,
-			}},
+		wantErrCode: codes.InvalidArgument,
+		wantErrDetails: &spb.FlushResponseError{
+			Status: spb.FlushResponseError_UNSPECIFIED_NETWORK_INSTANCE,
 		},
 	}, {
-		desc:        "nil operation",
-		inRIB:       rib.New(defName),
-		wantErrCode: codes.Internal,
-	}, {
-		desc:  "unsupported operation type",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 0, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_INVALID,
+		desc: "election unspecified, but server is in SINGLE_PRIMARY",
+		inServer: &Server{
+			curElecID: &spb.Uint128{High: 1, Low: 1},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 0, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 0, Low: 2},
+		inRequest: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
 		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_FAILED,
-				ErrorDetails: &spb.AFTErrorDetails{
-					ErrorMessage: "unsupported operation type supplied, INVALID",
-				},
-			}},
+		wantErrCode: codes.FailedPrecondition,
+		wantErrDetails: &spb.FlushResponseError{
+			Status: spb.FlushResponseError_UNSPECIFIED_ELECTION_BEHAVIOR,
 		},
 	}, {
-		desc:        "nil RIB",
-		wantErrCode: codes.Internal,
-	}, {
-		desc:  "ADD v4: rib ACK",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Ipv4{
-				Ipv4: &aftpb.Afts_Ipv4EntryKey{
-					Prefix: "2.2.2.2/32",
-					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
-						NextHopGroup: &wpb.UintValue{Value: 1},
-					},
-				},
+		desc:     "server is ALL_PRIMARY, but election ID is specified",
+		inServer: &Server{},
+		inRequest: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 42, Low: 42},
+			},
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		wantErrCode: codes.FailedPrecondition,
+		wantErrDetails: &spb.FlushResponseError{
+			Status: spb.FlushResponseError_ELECTION_ID_IN_ALL_PRIMARY,
 		},
 	}, {
-		desc:  "ADD v4: fib ACK",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Ipv4{
-				Ipv4: &aftpb.Afts_Ipv4EntryKey{
-					Prefix: "2.2.2.2/32",
-					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
-						NextHopGroup: &wpb.UintValue{Value: 1},
-					},
-				},
+		desc: "zero election ID specified",
+		inServer: &Server{
+			curElecID: &spb.Uint128{High: 1, Low: 1},
+		},
+		inRequest: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 0},
+			},
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		inFIBACK: true,
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}, {
-				Id:     2,
-				Status: spb.AFTResult_FIB_PROGRAMMED,
-			}},
+		wantErrCode: codes.InvalidArgument,
+		wantErrDetails: &spb.FlushResponseError{
+			Status: spb.FlushResponseError_INVALID_ELECTION_ID,
 		},
 	}, {
-		desc:  "ADD v6: rib ACK",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Ipv6{
-				Ipv6: &aftpb.Afts_Ipv6EntryKey{
-					Prefix: "2001:db8::/32",
-					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
-						NextHopGroup: &wpb.UintValue{Value: 1},
-					},
-				},
-			},
+		desc: "specified ID is not master",
+		inServer: &Server{
+			curElecID: &spb.Uint128{High: 0, Low: 2},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		inRequest: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 1},
+			},
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
 		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		wantErrCode: codes.FailedPrecondition,
+		wantErrDetails: &spb.FlushResponseError{
+			Status: spb.FlushResponseError_NOT_PRIMARY,
 		},
 	}, {
-		desc:  "ADD v6: fib ACK",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Ipv6{
-				Ipv6: &aftpb.Afts_Ipv6EntryKey{
-					Prefix: "2001:db8:cafe::/48",
-					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
-						NextHopGroup: &wpb.UintValue{Value: 1},
-					},
-				},
+		desc: "specified ID is OK - equal",
+		inServer: &Server{
+			curElecID: &spb.Uint128{High: 0, Low: 3},
+		},
+		inRequest: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 3},
+			},
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
+	}, {
+		desc: "specified ID is OK - greater than",
+		inServer: &Server{
+			curElecID: &spb.Uint128{High: 0, Low: 3},
 		},
-		inFIBACK: true,
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}, {
-				Id:     2,
-				Status: spb.AFTResult_FIB_PROGRAMMED,
-			}},
+		inRequest: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 4},
+			},
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
 		},
 	}, {
-		desc:  "ADD MPLS: rib ACK",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Mpls{
-				Mpls: &aftpb.Afts_LabelEntryKey{
-					Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
-						LabelUint64: 42,
+		desc: "override specified",
+		inServer: &Server{
+			curElecID: &spb.Uint128{High: 0, Low: 3},
+		},
+		inRequest: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Override{
+				Override: &spb.Empty{},
+			},
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
+			},
+		},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := tt.inServer.checkFlushRequest(tt.inRequest)
+			if err == nil && tt.wantErrCode != codes.OK {
+				t.Fatalf("got unexpected nil error, want: (code: %s, details: %v)", tt.wantErrCode, tt.wantErrDetails)
+			}
+
+			gotErr, ok := status.FromError(err)
+			if !ok {
+				t.Fatalf("got unexpected non-status.Status error, got: %T, want: status.Status", err)
+			}
+
+			if got, want := gotErr.Code(), tt.wantErrCode; got != want {
+				t.Fatalf("did not get expected error code, got: %s, want: %s", gotErr.Proto(), want)
+			}
+
+			if tt.wantErrDetails != nil {
+				gotDets := gotErr.Details()
+				if len(gotDets) != 1 {
+					t.Fatalf("did not get error details, got: %v, want: 1 FlushErrorDetails", gotDets)
+				}
+				gotD, ok := gotDets[0].(*spb.FlushResponseError)
+				if !ok {
+					t.Fatalf("did not get expected details type, got: %T, want: *spb.FlushResponseError", gotDets[0])
+				}
+				if got, want := gotD, tt.wantErrDetails; !proto.Equal(got, want) {
+					t.Fatalf("did not get expected error details, got: %s, want: %s", prototext.Format(got), prototext.Format(want))
+				}
+			}
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	addEntry := func(r *rib.RIB, ni string) {
+		if oks, _, err := r.AddEntry(ni, &spb.AFTOperation{
+			Op: spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   1,
+					NextHop: &aftpb.Afts_NextHop{},
+				},
+			},
+		}); err != nil || len(oks) != 1 {
+			t.Fatalf("cannot add NextHop to server, %v", err)
+		}
+
+		if oks, _, err := r.AddEntry(ni, &spb.AFTOperation{
+			Op: spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id: 1,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{
+						NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+							Index:   1,
+							NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+						}},
 					},
-					LabelEntry: &aftpb.Afts_LabelEntry{
+				},
+			},
+		}); err != nil || len(oks) != 1 {
+			t.Fatalf("cannot add NextHopGroup to server, %v", err)
+		}
+
+		if oks, _, err := r.AddEntry(ni, &spb.AFTOperation{
+			Op: spb.AFTOperation_ADD,
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: "1.1.1.1/32",
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
 						NextHopGroup: &wpb.UintValue{Value: 1},
 					},
 				},
 			},
-		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		}); err != nil || len(oks) != 1 {
+			t.Fatalf("cannot add IPv4Entry to server, %v", err)
+		}
+	}
+
+	// singleNI creates a server with the default network instance with one entry.
+	singleNI := func() *Server {
+		s, err := NewFake()
+		if err != nil {
+			t.Fatalf("cannot create server, error: %v", err)
+		}
+		r := rib.New(DefaultNetworkInstanceName)
+		addEntry(r, DefaultNetworkInstanceName)
+		s.InjectRIB(r)
+		return s.Server
+	}
+
+	// singleNIWithElection creates a server with a default network instance with
+	// one entry, and sets the specified election ID.
+	singleNIWithElection := func(id *spb.Uint128) *Server {
+		s := singleNI()
+		s.curElecID = id
+		return s
+	}
+
+	// multiNI creates a server with a default network instance along with the
+	// other network instances specified, it contains one entry per network
+	// instance.
+	multiNI := func(names []string) *Server {
+		s, err := NewFake(WithVRFs(names))
+		if err != nil {
+			t.Fatalf("cannot create server, error: %v", err)
+		}
+		addEntry(s.masterRIB, DefaultNetworkInstanceName)
+		for _, n := range names {
+			addEntry(s.masterRIB, n)
+		}
+
+		return s.Server
+	}
+
+	// multiNI creates a server with a default network instance along with the
+	// other network instances specified. It also set the election ID.
+	// Each network instance contains one entry.
+	multiNIWithElection := func(names []string, id *spb.Uint128) *Server {
+		s := multiNI(names)
+		s.curElecID = id
+		return s
+	}
+
+	tests := []struct {
+		desc            string
+		inServer        *Server
+		inReq           *spb.FlushRequest
+		wantErrCode     codes.Code
+		wantResult      spb.FlushResponse_Result
+		wantEntriesInNI map[string]int
+	}{{
+		desc:        "error, nil request received",
+		inServer:    multiNI([]string{"two"}),
+		wantErrCode: codes.Internal,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 3,
+			"two":                      3,
 		},
 	}, {
-		desc:  "ADD NHG",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_NextHopGroup{
-				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
-					Id:           2,
-					NextHopGroup: &aftpb.Afts_NextHopGroup{},
-				},
-			},
-		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		desc:        "error, empty request received",
+		inServer:    multiNI([]string{"two"}),
+		inReq:       &spb.FlushRequest{},
+		wantErrCode: codes.InvalidArgument,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 3,
+			"two":                      3,
 		},
 	}, {
-		desc:  "ADD NH",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_NextHop{
-				NextHop: &aftpb.Afts_NextHopKey{
-					Index:   2,
-					NextHop: &aftpb.Afts_NextHop{},
-				},
+		desc:     "error, network instance is not specified",
+		inServer: singleNIWithElection(&spb.Uint128{High: 0, Low: 1}),
+		inReq: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 1},
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		wantErrCode: codes.InvalidArgument,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 3,
 		},
 	}, {
-		desc:        "nil RIB",
-		inRIB:       nil,
-		wantErrCode: codes.Internal,
-	}, {
-		desc:        "invalid RIB",
-		inRIB:       &rib.RIB{},
-		inNI:        "fish",
-		wantErrCode: codes.Internal,
-	}, {
-		desc:  "ADD NHG",
-		inRIB: rib.New(defName, rib.DisableRIBCheckFn()),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_NextHopGroup{
-				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
-					Id:           2,
-					NextHopGroup: &aftpb.Afts_NextHopGroup{},
-				},
+		desc:     "error, network instance does not exist",
+		inServer: singleNI(),
+		inReq: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: "does-not-exist",
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		wantErrCode: codes.InvalidArgument,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 3,
 		},
 	}, {
-		desc: "DELETE NH",
-		inRIB: func() *rib.RIB {
-			r := rib.New(defName)
-			if _, _, err := r.AddEntry(defName, &spb.AFTOperation{
-				Id: 3,
-				Op: spb.AFTOperation_ADD,
-				Entry: &spb.AFTOperation_NextHop{
-					NextHop: &aftpb.Afts_NextHopKey{
-						Index:   2,
-						NextHop: &aftpb.Afts_NextHop{},
-					},
-				},
-			}); err != nil {
-				panic(fmt.Sprintf("cannot build test case, got err: %v", err))
-			}
-			return r
-		}(),
-		inNI: defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_DELETE,
-			Entry: &spb.AFTOperation_NextHop{
-				NextHop: &aftpb.Afts_NextHopKey{
-					Index: 2,
-				},
+		desc:     "error, election ID specified but not master",
+		inServer: singleNIWithElection(&spb.Uint128{High: 0, Low: 2}),
+		inReq: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_All{
+				All: &spb.Empty{},
+			},
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 1},
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 3,
 		},
+		wantErrCode: codes.FailedPrecondition,
 	}, {
-		desc:  "DELETE Missing NHG",
-		inRIB: rib.New(defName),
-		inNI:  defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_DELETE,
-			Entry: &spb.AFTOperation_NextHopGroup{
-				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
-					Id: 2,
-				},
+		desc:     "error, election ID is specified in ALL_PRIMARY mode",
+		inServer: singleNI(),
+		inReq: &spb.FlushRequest{
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 1, Low: 1},
+			},
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: "does-not-exist",
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
-		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_RIB_PROGRAMMED,
-			}},
+		wantErrCode: codes.FailedPrecondition,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 3,
 		},
 	}, {
-		desc: "DELETE NH failed due to refcount",
-		inRIB: func() *rib.RIB {
-			r := rib.New(defName)
-			if _, fails, err := r.AddEntry(defName, &spb.AFTOperation{
-				Id: 3,
-				Op: spb.AFTOperation_ADD,
-				Entry: &spb.AFTOperation_NextHop{
-					NextHop: &aftpb.Afts_NextHopKey{
-						Index:   2,
-						NextHop: &aftpb.Afts_NextHop{},
-					},
-				},
-			}); err != nil || len(fails) != 0 {
-				panic(fmt.Sprintf("cannot build test case, can't add NH, got err: %v, fails: %v", err, fails[0]))
-			}
-
-			if _, fails, err := r.AddEntry(defName, &spb.AFTOperation{
-				Id: 3,
-				Op: spb.AFTOperation_ADD,
-				Entry: &spb.AFTOperation_NextHopGroup{
-					NextHopGroup: &aftpb.Afts_NextHopGroupKey{
-						Id: 2,
-						NextHopGroup: &aftpb.Afts_NextHopGroup{
-							NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
-								Index:   2,
-								NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
-							}},
-						},
-					},
-				},
-			}); err != nil || len(fails) != 0 {
-				panic(fmt.Sprintf("cannot build test case, can't add NHG, got err: %v, fails: %v", err, fails[0]))
-
-			}
-
-			return r
-		}(),
-		inNI: defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_DELETE,
-			Entry: &spb.AFTOperation_NextHop{
-				NextHop: &aftpb.Afts_NextHopKey{
-					Index: 2,
-				},
+		desc:     "success, flush the default NI",
+		inServer: singleNI(),
+		inReq: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: DefaultNetworkInstanceName,
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		wantResult: spb.FlushResponse_OK,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 0,
 		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_FAILED,
-			}},
+	}, {
+		desc:     "success, flush a non default NI",
+		inServer: multiNI([]string{"two"}),
+		inReq: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_Name{
+				Name: "two",
+			},
+		},
+		wantResult: spb.FlushResponse_OK,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 3,
+			"two":                      0,
 		},
 	}, {
-		desc: "REPLACE NH",
-		inRIB: func() *rib.RIB {
-			r := rib.New(defName)
-			if _, _, err := r.AddEntry(defName, &spb.AFTOperation{
-				Id: 3,
-				Op: spb.AFTOperation_ADD,
-				Entry: &spb.AFTOperation_NextHop{
-					NextHop: &aftpb.Afts_NextHopKey{
-						Index:   2,
-						NextHop: &aftpb.Afts_NextHop{},
-					},
-				},
-			}); err != nil {
-				panic(fmt.Sprintf("cannot build test case, got err: %v", err))
-			}
-			return r
-		}(),
-		inNI: defName,
-		inOp: &spb.AFTOperation{
-			ElectionId: &spb.Uint128{High: 4, Low: 2},
-			Id:         2,
-			Op:         spb.AFTOperation_REPLACE,
-			Entry: &spb.AFTOperation_NextHop{
-				NextHop: &aftpb.Afts_NextHopKey{
-					Index: 2,
-					NextHop: &aftpb.Afts_NextHop{
-						IpAddress: &wpb.StringValue{Value: "NOT VALID"},
-					},
-				},
+		desc:     "success, flush all NIs",
+		inServer: multiNI([]string{"two"}),
+		inReq: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_All{
+				All: &spb.Empty{},
 			},
 		},
-		inElection: &electionDetails{
-			master:       "this-client",
-			ID:           &spb.Uint128{High: 4, Low: 2},
-			client:       "this-client",
-			clientLatest: &spb.Uint128{High: 4, Low: 2},
+		wantResult: spb.FlushResponse_OK,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 0,
+			"two":                      0,
 		},
-		wantResponse: &spb.ModifyResponse{
-			Result: []*spb.AFTResult{{
-				Id:     2,
-				Status: spb.AFTResult_FAILED,
-			}},
+	}, {
+		desc:     "success, flush all NIs with a valid election ID",
+		inServer: multiNIWithElection([]string{"two"}, &spb.Uint128{High: 0, Low: 1}),
+		inReq: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_All{
+				All: &spb.Empty{},
+			},
+			Election: &spb.FlushRequest_Id{
+				Id: &spb.Uint128{High: 0, Low: 1},
+			},
+		},
+		wantResult: spb.FlushResponse_OK,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 0,
+			"two":                      0,
+		},
+	}, {
+		desc:     "success, election ID specified with override",
+		inServer: singleNIWithElection(&spb.Uint128{High: 0, Low: 42}),
+		inReq: &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_All{
+				All: &spb.Empty{},
+			},
+			Election: &spb.FlushRequest_Override{
+				Override: &spb.Empty{},
+			},
+		},
+		wantResult: spb.FlushResponse_OK,
+		wantEntriesInNI: map[string]int{
+			DefaultNetworkInstanceName: 0,
 		},
 	}}
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
-			got, err := modifyEntry(tt.inRIB, tt.inNI, tt.inOp, tt.inFIBACK, tt.inElection)
+			resp, err := tt.inServer.Flush(context.Background(), tt.inReq)
 			if err != nil {
-				checkStatusErr(t, err, tt.wantErrCode, tt.wantErrDetails)
+				s, ok := status.FromError(err)
+				if !ok {
+					t.Fatalf("did not get status.Status as error, got: %T %v", err, err)
+				}
+				if got, want := s.Code(), tt.wantErrCode; got != want {
+					t.Fatalf("did not get expected error code, got: %s, want: %s", got, want)
+				}
+				return
 			}
-			if diff := cmp.Diff(got, tt.wantResponse, protocmp.Transform()); diff != "" {
-				t.Fatalf("did not get expected response, diff(-got,+want):\n%s", diff)
+			if tt.wantResult != resp.GetResult() {
+				t.Fatalf("got unexpected result, got: %v, want: %v", resp.Result.String(), tt.wantResult.String())
+				return
+			}
+
+			for ni, wantEntries := range tt.wantEntriesInNI {
+				r, ok := tt.inServer.masterRIB.NetworkInstanceRIB(ni)
+				if !ok {
+					t.Fatalf("cannot find RIB %s on server", ni)
+				}
+
+				msgCh := make(chan *spb.GetResponse)
+				stopCh := make(chan struct{})
+
+				doneCh := make(chan struct{})
+				defer close(doneCh)
+
+				got := []*spb.GetResponse{}
+				go func() {
+					for {
+						select {
+						case r := <-msgCh:
+							got = append(got, r)
+						case <-doneCh:
+							return
+						}
+					}
+				}()
+
+				if err := r.GetRIB(map[spb.AFTType]bool{
+					spb.AFTType_ALL: true,
+				}, msgCh, stopCh); err != nil {
+					t.Fatalf("could not perform Get on RIB, %v", err)
+				}
+				doneCh <- struct{}{}
+
+				if len(got) != wantEntries {
+					t.Fatalf("got unexpected entries in NI %s, got: %d entries, want: %d, contents:\n%+v", ni, len(got), wantEntries, got)
+				}
 			}
 		})
 	}
 }
 
-func TestDoGet(t *testing.T) {
-	// serverAllRIBs is a function that returns a server with one entry in each RIB
-	// populated.
-	serverAllRIBs := func() *Server {
-		// use a nil function to check the RIB so that addEntry always succeeds
-		s, err := New(DisableRIBCheckFn())
-		if err != nil {
-			t.Fatalf("cannot create server, %v", err)
-		}
+func TestPendingResolution(t *testing.T) {
+	defName := DefaultNetworkInstanceName
+	elec := &electionDetails{
+		master:       "testclient",
+		ID:           &spb.Uint128{High: 0, Low: 1},
+		client:       "testclient",
+		clientLatest: &spb.Uint128{High: 0, Low: 1},
+	}
 
-		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
-			Id:              1,
-			NetworkInstance: DefaultNetworkInstanceName,
-			Op:              spb.AFTOperation_ADD,
+	nhOp := func(id, index uint64, op spb.AFTOperation_Operation) *spb.AFTOperation {
+		return &spb.AFTOperation{
+			Id:              id,
+			NetworkInstance: defName,
+			Op:              op,
+			ElectionId:      &spb.Uint128{High: 0, Low: 1},
 			Entry: &spb.AFTOperation_NextHop{
 				NextHop: &aftpb.Afts_NextHopKey{
-					Index: 1,
-					NextHop: &aftpb.Afts_NextHop{
-						PushedMplsLabelStack: []*aftpb.Afts_NextHop_PushedMplsLabelStackUnion{{
-							PushedMplsLabelStackUint64: 42,
-						}},
-					},
+					Index:   index,
+					NextHop: &aftpb.Afts_NextHop{},
 				},
 			},
-		}); err != nil {
-			t.Fatalf("cannot build test case, NH, err: %v", err)
 		}
+	}
 
-		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
-			Id:              1,
-			NetworkInstance: DefaultNetworkInstanceName,
+	nhgOp := func(id, nhgID uint64, nhs ...uint64) *spb.AFTOperation {
+		g := &aftpb.Afts_NextHopGroup{}
+		for _, nh := range nhs {
+			g.NextHop = append(g.NextHop, &aftpb.Afts_NextHopGroup_NextHopKey{
+				Index: nh,
+				NextHop: &aftpb.Afts_NextHopGroup_NextHop{
+					Weight: &wpb.UintValue{Value: 1},
+				},
+			})
+		}
+		return &spb.AFTOperation{
+			Id:              id,
+			NetworkInstance: defName,
 			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 0, Low: 1},
 			Entry: &spb.AFTOperation_NextHopGroup{
 				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
-					Id:           1,
-					NextHopGroup: &aftpb.Afts_NextHopGroup{},
+					Id:           nhgID,
+					NextHopGroup: g,
+				},
+			},
+		}
+	}
+
+	ipv4Op := func(id uint64, prefix string, nhg uint64) *spb.AFTOperation {
+		return &spb.AFTOperation{
+			Id:              id,
+			NetworkInstance: defName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{High: 0, Low: 1},
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix: prefix,
+					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
+						NextHopGroup: &wpb.UintValue{Value: nhg},
+					},
 				},
 			},
+		}
+	}
+
+	// doOps runs the operations ops against the server s, returning the
+	// concatenated set of results.
+	doOps := func(t *testing.T, s *Server, ops ...*spb.AFTOperation) []*spb.AFTResult {
+		t.Helper()
+		got := []*spb.AFTResult{}
+		for _, op := range ops {
+			res, _, err := s.modifyAndTrack("testclient", defName, op, false, elec)
+			if err != nil {
+				t.Fatalf("cannot run operation %s, %v", op, err)
+			}
+			got = append(got, res.GetResult()...)
+		}
+		return got
+	}
+
+	newServer := func(t *testing.T, opt ...ServerOpt) *Server {
+		t.Helper()
+		s, err := New(opt...)
+		if err != nil {
+			t.Fatalf("cannot create server, %v", err)
+		}
+		return s
+	}
+
+	t.Run("forward reference resolved", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute))
+		got := doOps(t, s, ipv4Op(1, "192.0.2.0/24", 42), nhOp(2, 1, spb.AFTOperation_ADD), nhgOp(3, 42, 1))
+		want := []*spb.AFTResult{
+			{Id: 2, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 3, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+		}
+		if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+			t.Fatalf("did not get expected results, diff(-got,+want):\n%s", diff)
+		}
+		if res := s.expiredResults("testclient", time.Now().Add(time.Hour)); res != nil {
+			t.Fatalf("got unexpected expired results, got: %s, want: nil", res)
+		}
+	})
+
+	t.Run("timeout with unresolved reference", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute))
+		if got := doOps(t, s, ipv4Op(1, "192.0.2.0/24", 42)); len(got) != 0 {
+			t.Fatalf("got unexpected results for pending operation, got: %v", got)
+		}
+		if res := s.expiredResults("another-client", time.Now().Add(time.Hour)); res != nil {
+			t.Fatalf("got unexpected expired results for another client, got: %s", res)
+		}
+		if res := s.expiredResults("testclient", time.Now()); res != nil {
+			t.Fatalf("got unexpected expired results before deadline, got: %s", res)
+		}
+
+		res := s.expiredResults("testclient", time.Now().Add(2*time.Minute))
+		if len(res.GetResult()) != 1 || res.GetResult()[0].GetStatus() != spb.AFTResult_FAILED || res.GetResult()[0].GetId() != 1 {
+			t.Fatalf("did not get expected failed result, got: %s", res)
+		}
+		if msg, want := res.GetResult()[0].GetErrorDetails().GetErrorMessage(), "next-hop-group 42 in network-instance DEFAULT"; !strings.Contains(msg, want) {
+			t.Fatalf("did not get expected error message, got: %s, want substring: %s", msg, want)
+		}
+		if s.masterRIB.IsPendingForSession("testclient", 1) {
+			t.Fatalf("operation 1 is still pending in the RIB after expiry")
+		}
+	})
+
+	t.Run("interleaved delete of dependency", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute))
+		got := doOps(t, s,
+			ipv4Op(1, "192.0.2.0/24", 42),
+			nhgOp(2, 42, 10, 11),
+			nhOp(3, 10, spb.AFTOperation_ADD),
+			nhOp(4, 10, spb.AFTOperation_DELETE),
+			nhOp(5, 11, spb.AFTOperation_ADD),
+		)
+		want := []*spb.AFTResult{
+			{Id: 3, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 4, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 5, Status: spb.AFTResult_RIB_PROGRAMMED},
+		}
+		if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+			t.Fatalf("did not get expected results, diff(-got,+want):\n%s", diff)
+		}
+
+		got = doOps(t, s, nhOp(6, 10, spb.AFTOperation_ADD))
+		want = []*spb.AFTResult{
+			{Id: 6, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 2, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+		}
+		if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+			t.Fatalf("did not get expected results after dependency re-added, diff(-got,+want):\n%s", diff)
+		}
+	})
+
+	t.Run("bounded queue", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute), WithMaxPendingOperations(1))
+		got := doOps(t, s, ipv4Op(1, "192.0.2.0/24", 42), ipv4Op(2, "198.51.100.0/24", 42))
+		if len(got) != 1 || got[0].GetId() != 2 || got[0].GetStatus() != spb.AFTResult_FAILED {
+			t.Fatalf("did not get expected failure for operation beyond queue size, got: %v", got)
+		}
+		if msg := got[0].GetErrorDetails().GetErrorMessage(); !strings.Contains(msg, "pending queue is full") {
+			t.Fatalf("did not get expected error message for operation beyond queue size, got: %s", msg)
+		}
+		if !s.masterRIB.IsPendingForSession("testclient", 1) {
+			t.Fatalf("operation 1 is not pending, want pending")
+		}
+	})
+
+	t.Run("bounded queue by default", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute))
+		ops := []*spb.AFTOperation{}
+		for i := 0; i <= defaultMaxPendingOperations; i++ {
+			ops = append(ops, ipv4Op(uint64(i+1), fmt.Sprintf("10.%d.%d.0/24", i/256, i%256), 42))
+		}
+		got := doOps(t, s, ops...)
+		if len(got) != 1 || got[0].GetId() != defaultMaxPendingOperations+1 || got[0].GetStatus() != spb.AFTResult_FAILED {
+			t.Fatalf("did not get expected failure for operation beyond default queue size, got: %v", got)
+		}
+		if msg := got[0].GetErrorDetails().GetErrorMessage(); !strings.Contains(msg, "pending queue is full") {
+			t.Fatalf("did not get expected error message for operation beyond default queue size, got: %s", msg)
+		}
+	})
+
+	t.Run("operation IDs are per-client", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute))
+		doOps(t, s, ipv4Op(1, "192.0.2.0/24", 42))
+
+		// Another client re-using operation ID 1 must not overwrite the pending
+		// operation of the first client.
+		if _, _, err := s.modifyAndTrack("otherclient", defName, ipv4Op(1, "198.51.100.0/24", 42), false, elec); err != nil {
+			t.Fatalf("cannot run operation, %v", err)
+		}
+
+		got := s.expiredResults("testclient", time.Now().Add(2*time.Minute))
+		if len(got.GetResult()) != 1 || got.GetResult()[0].GetId() != 1 || got.GetResult()[0].GetStatus() != spb.AFTResult_FAILED {
+			t.Fatalf("did not get expected expired result for testclient, got: %v", got)
+		}
+		if _, ok := s.pendingOps[pendingKey{client: "otherclient", id: 1}]; !ok {
+			t.Fatalf("pending operation for otherclient was removed, got: %v", s.pendingOps)
+		}
+	})
+
+	t.Run("disconnect of client with overlapping operation IDs", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute))
+		doOps(t, s, ipv4Op(1, "192.0.2.0/24", 42))
+		if _, _, err := s.modifyAndTrack("otherclient", defName, ipv4Op(1, "198.51.100.0/24", 42), false, elec); err != nil {
+			t.Fatalf("cannot run operation, %v", err)
+		}
+
+		// The disconnection of testclient must only remove its own pending
+		// operation, not that of otherclient with the same ID.
+		s.deleteClient("testclient")
+		if s.masterRIB.IsPendingForSession("testclient", 1) {
+			t.Fatalf("operation 1 for testclient is still pending after disconnect")
+		}
+		if !s.masterRIB.IsPendingForSession("otherclient", 1) {
+			t.Fatalf("operation 1 for otherclient is not pending after disconnect of testclient")
+		}
+
+		var got []*spb.AFTResult
+		for _, op := range []*spb.AFTOperation{nhOp(2, 1, spb.AFTOperation_ADD), nhgOp(3, 42, 1)} {
+			res, others, err := s.modifyAndTrack("otherclient", defName, op, false, elec)
+			if err != nil {
+				t.Fatalf("cannot run operation %s, %v", op, err)
+			}
+			if len(others) != 0 {
+				t.Fatalf("got unexpected results for other clients, got: %v", others)
+			}
+			got = append(got, res.GetResult()...)
+		}
+		want := []*spb.AFTResult{
+			{Id: 2, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 3, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+		}
+		if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+			t.Fatalf("did not get expected results for otherclient, diff(-got,+want):\n%s", diff)
+		}
+		if _, ok := s.pendingOps[pendingKey{client: "otherclient", id: 1}]; ok {
+			t.Fatalf("resolved operation for otherclient is still tracked as pending")
+		}
+	})
+
+	t.Run("drained on flush", func(t *testing.T) {
+		s := newServer(t, WithPendingResolution(time.Minute))
+		doOps(t, s, ipv4Op(2, "192.0.2.0/24", 42), ipv4Op(1, "198.51.100.0/24", 42))
+		if _, err := s.Flush(context.Background(), &spb.FlushRequest{
+			NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+			Election:        &spb.FlushRequest_Override{Override: &spb.Empty{}},
 		}); err != nil {
-			t.Fatalf("cannot build test case, NHG, err: %v", err)
+			t.Fatalf("cannot flush server, %v", err)
 		}
 
-		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
-			Id:              1,
-			NetworkInstance: DefaultNetworkInstanceName,
-			Op:              spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Ipv4{
-				Ipv4: &aftpb.Afts_Ipv4EntryKey{
-					Prefix:    "1.1.1.1/32",
-					Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+		res := s.expiredResults("testclient", time.Now())
+		want := &spb.ModifyResponse{
+			Result: []*spb.AFTResult{{
+				Id:     1,
+				Status: spb.AFTResult_FAILED,
+				ErrorDetails: &spb.AFTErrorDetails{
+					ErrorMessage: "operation 1 was removed whilst pending resolution",
 				},
-			},
-		}); err != nil {
-			t.Fatalf("cannot build test case, IPv4, err: %v", err)
+			}, {
+				Id:     2,
+				Status: spb.AFTResult_FAILED,
+				ErrorDetails: &spb.AFTErrorDetails{
+					ErrorMessage: "operation 2 was removed whilst pending resolution",
+				},
+			}},
 		}
+		if diff := cmp.Diff(res, want, protocmp.Transform()); diff != "" {
+			t.Fatalf("did not get expected results after flush, diff(-got,+want):\n%s", diff)
+		}
+	})
+}
 
-		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
-			Id:              2,
+func TestStrictDeleteOwnership(t *testing.T) {
+	const prefix = "192.0.2.0/24"
+	ipv4Op := func(id uint64, op spb.AFTOperation_Operation, elecID uint64, override bool) *spb.AFTOperation {
+		e := &aftpb.Afts_Ipv4Entry{
+			NextHopGroup: &wpb.UintValue{Value: 1},
+		}
+		if override {
+			e.EntryMetadata = &wpb.BytesValue{Value: []byte(OwnershipOverrideMetadata)}
+		}
+		return &spb.AFTOperation{
+			Id:              id,
 			NetworkInstance: DefaultNetworkInstanceName,
-			Op:              spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Ipv6{
-				Ipv6: &aftpb.Afts_Ipv6EntryKey{
-					Prefix: "2001:db8::/32",
-					Ipv6Entry: &aftpb.Afts_Ipv6Entry{
-						NextHopGroup: &wpb.UintValue{Value: 1},
-					},
+			Op:              op,
+			ElectionId:      &spb.Uint128{Low: elecID},
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{
+					Prefix:    prefix,
+					Ipv4Entry: e,
 				},
 			},
-		}); err != nil {
-			t.Fatalf("cannot build test case, IPv6, err: %v", err)
 		}
+	}
 
-		if _, _, err := s.masterRIB.AddEntry(DefaultNetworkInstanceName, &spb.AFTOperation{
-			Id:              2,
+	// addOp returns an ADD operation with ID id and election ID elecID, whose
+	// entry is set using set.
+	addOp := func(id, elecID uint64, set func(*spb.AFTOperation, uint64)) *spb.AFTOperation {
+		op := &spb.AFTOperation{
+			Id:              id,
 			NetworkInstance: DefaultNetworkInstanceName,
 			Op:              spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Mpls{
-				Mpls: &aftpb.Afts_LabelEntryKey{
-					Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
-						LabelUint64: 42,
-					},
-					LabelEntry: &aftpb.Afts_LabelEntry{},
-				},
-			},
-		}); err != nil {
-			t.Fatalf("cannot build test case, MPLS, err: %v", err)
+			ElectionId:      &spb.Uint128{Low: elecID},
 		}
-
-		return s
-	}()
+		set(op, 1)
+		return op
+	}
 
 	tests := []struct {
-		desc          string
-		inReq         *spb.GetRequest
-		inServer      *Server
-		wantResponses []*spb.GetResponse
-		wantErr       bool
+		desc            string
+		inOpts          []ServerOpt
+		inFlush         bool
+		inTakeOwnership bool
+		inOverride      bool
+		// inDeleteClient is the ID of the client session that deletes the
+		// entry, if unset it is "two".
+		inDeleteClient string
+		// inDeleteElecID is the election ID of the client that deletes the
+		// entry, if unset it is 2.
+		inDeleteElecID uint64
+		// inNotPrimary indicates that the client that deletes the entry is not
+		// the primary client.
+		inNotPrimary bool
+		wantFailed   bool
+		// wantNotPrimary indicates that the delete is expected to be rejected
+		// since the client is not primary, rather than due to ownership.
+		wantNotPrimary bool
 	}{{
-		desc: "single network-instance get, with empty RIB",
-		inReq: &spb.GetRequest{
-			NetworkInstance: &spb.GetRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-			Aft: spb.AFTType_ALL,
-		},
+		desc: "default policy allows delete of another client's entry",
 	}, {
-		desc: "empty network instance name",
-		inReq: &spb.GetRequest{
-			NetworkInstance: &spb.GetRequest_Name{
-				Name: "",
-			},
-			Aft: spb.AFTType_ALL,
-		},
-		wantErr: true,
+		desc:       "strict policy rejects delete of another client's entry",
+		inOpts:     []ServerOpt{WithStrictDeleteOwnership()},
+		wantFailed: true,
 	}, {
-		desc: "all network instances",
-		inReq: &spb.GetRequest{
-			Aft: spb.AFTType_ALL,
-			NetworkInstance: &spb.GetRequest_All{
-				All: &spb.Empty{},
-			},
-		},
-		inServer: func() *Server {
-			vrfNames := []string{"ONE", "EIGHT", "FOUR"}
-			s, err := New(
-				DisableRIBCheckFn(),
-				WithVRFs(vrfNames),
-			)
+		desc:           "strict policy returns not primary for delete of another client's entry by non-primary",
+		inOpts:         []ServerOpt{WithStrictDeleteOwnership()},
+		inDeleteElecID: 1,
+		inNotPrimary:   true,
+		wantFailed:     true,
+		wantNotPrimary: true,
+	}, {
+		desc:           "strict policy allows delete by owner after raising its election ID",
+		inOpts:         []ServerOpt{WithStrictDeleteOwnership()},
+		inDeleteClient: "one",
+	}, {
+		desc:           "strict policy rejects delete by reconnected client with same election ID",
+		inOpts:         []ServerOpt{WithStrictDeleteOwnership()},
+		inDeleteElecID: 1,
+		wantFailed:     true,
+	}, {
+		desc:            "strict policy allows delete after taking ownership with replace",
+		inOpts:          []ServerOpt{WithStrictDeleteOwnership()},
+		inTakeOwnership: true,
+	}, {
+		desc:       "strict policy allows delete with override on the operation",
+		inOpts:     []ServerOpt{WithStrictDeleteOwnership()},
+		inOverride: true,
+	}, {
+		desc:    "strict policy allows delete after flush",
+		inOpts:  []ServerOpt{WithStrictDeleteOwnership()},
+		inFlush: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := New(tt.inOpts...)
 			if err != nil {
-				t.Fatalf("cannot create server, err: %v", err)
+				t.Fatalf("cannot create server, %v", err)
+			}
+			for _, cid := range []string{"one", "two"} {
+				s.cs[cid] = &clientState{
+					params: &clientParams{
+						Persist:      true,
+						ExpectElecID: true,
+					},
+				}
+			}
+			setMaster := func(cid string, elecID uint64) {
+				s.cs[cid].lastElecID = &spb.Uint128{Low: elecID}
+				s.curElecID = &spb.Uint128{Low: elecID}
+				s.curMaster = cid
+			}
+			modify := func(cid string, op *spb.AFTOperation) *spb.AFTResult {
+				t.Helper()
+				resCh := make(chan *spb.ModifyResponse, 1)
+				errCh := make(chan error, 1)
+				s.doModify(cid, []*spb.AFTOperation{op}, resCh, errCh)
+				select {
+				case err := <-errCh:
+					t.Fatalf("got unexpected error, %v", err)
+				case res := <-resCh:
+					return res.GetResult()[0]
+				}
+				return nil
+			}
+			wantOK := func(res *spb.AFTResult) {
+				t.Helper()
+				if got := res.GetStatus(); got != spb.AFTResult_RIB_PROGRAMMED {
+					t.Fatalf("did not get expected result, got: %s, want: RIB_PROGRAMMED", res)
+				}
 			}
 
-			prefixes := []string{"1.1.1.1/32", "8.8.8.8/32", "8.8.4.4/32"}
+			setMaster("one", 1)
+			wantOK(modify("one", addOp(1, 1, nhEntry)))
+			wantOK(modify("one", addOp(2, 1, nhgEntry)))
+			wantOK(modify("one", ipv4Op(3, spb.AFTOperation_ADD, 1, false)))
 
-			for i, pfx := range prefixes {
-				if _, _, err := s.masterRIB.AddEntry(vrfNames[i], &spb.AFTOperation{
-					Id:              uint64(i),
-					NetworkInstance: vrfNames[i],
-					Op:              spb.AFTOperation_ADD,
-					Entry: &spb.AFTOperation_Ipv4{
-						Ipv4: &aftpb.Afts_Ipv4EntryKey{
-							Prefix:    pfx,
-							Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
-						},
-					},
-				}); err != nil {
-					panic(fmt.Sprintf("cannot build testcase, %v", err))
+			cid := tt.inDeleteClient
+			if cid == "" {
+				cid = "two"
+			}
+			elecID := tt.inDeleteElecID
+			if elecID == 0 {
+				elecID = 2
+			}
+			if tt.inNotPrimary {
+				s.cs[cid].lastElecID = &spb.Uint128{Low: elecID}
+			} else {
+				setMaster(cid, elecID)
+			}
+			if tt.inFlush {
+				if err := s.masterRIB.Flush([]string{DefaultNetworkInstanceName}); err != nil {
+					t.Fatalf("cannot flush RIB, %v", err)
 				}
+				// The entries are re-added by the new master, such that it owns
+				// them.
+				wantOK(modify(cid, addOp(4, elecID, nhEntry)))
+				wantOK(modify(cid, addOp(5, elecID, nhgEntry)))
+				wantOK(modify(cid, ipv4Op(6, spb.AFTOperation_ADD, elecID, false)))
 			}
-			return s
-		}(),
-		wantResponses: []*spb.GetResponse{{
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: "ONE",
-				Entry: &spb.AFTEntry_Ipv4{
-					Ipv4: &aftpb.Afts_Ipv4EntryKey{
-						Prefix:    "1.1.1.1/32",
-						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
-					},
-				},
-			}},
-		}, {
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: "EIGHT",
-				Entry: &spb.AFTEntry_Ipv4{
-					Ipv4: &aftpb.Afts_Ipv4EntryKey{
-						Prefix:    "8.8.8.8/32",
-						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
-					},
-				},
-			}},
-		}, {
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: "FOUR",
-				Entry: &spb.AFTEntry_Ipv4{
-					Ipv4: &aftpb.Afts_Ipv4EntryKey{
-						Prefix:    "8.8.4.4/32",
-						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
-					},
-				},
-			}},
-		}},
-	}, {
-		desc: "single network-instance get with one entry in each table",
-		inReq: &spb.GetRequest{
-			NetworkInstance: &spb.GetRequest_Name{
-				Name: DefaultNetworkInstanceName,
+			if tt.inTakeOwnership {
+				wantOK(modify(cid, ipv4Op(7, spb.AFTOperation_REPLACE, elecID, false)))
+			}
+
+			res := modify(cid, ipv4Op(8, spb.AFTOperation_DELETE, elecID, tt.inOverride))
+			if !tt.wantFailed {
+				wantOK(res)
+				return
+			}
+			if res.GetStatus() != spb.AFTResult_FAILED {
+				t.Fatalf("did not get expected result, got: %s, want: FAILED", res)
+			}
+			msg := res.GetErrorDetails().GetErrorMessage()
+			if tt.wantNotPrimary {
+				if !strings.Contains(msg, NotPrimary) || strings.Contains(msg, EntryOwnedByOtherClient) {
+					t.Fatalf("did not get expected not primary error detail, got: %s, want substring: %s", msg, NotPrimary)
+				}
+				return
+			}
+			for _, want := range []string{codes.FailedPrecondition.String(), EntryOwnedByOtherClient, "client one"} {
+				if !strings.Contains(msg, want) {
+					t.Fatalf("did not get expected ownership error detail, got: %s, want substring: %s", msg, want)
+				}
+			}
+
+			// The Modify RPC is not torn down, such that the client can take
+			// ownership of the entry and delete it.
+			wantOK(modify(cid, ipv4Op(9, spb.AFTOperation_REPLACE, elecID, false)))
+			wantOK(modify(cid, ipv4Op(10, spb.AFTOperation_DELETE, elecID, false)))
+		})
+	}
+}
+
+func TestStrictDeleteOwnershipPending(t *testing.T) {
+	s, err := New(WithStrictDeleteOwnership())
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	for _, cid := range []string{"one", "two"} {
+		s.cs[cid] = &clientState{
+			params: &clientParams{
+				Persist:      true,
+				ExpectElecID: true,
 			},
-			Aft: spb.AFTType_ALL,
-		},
-		inServer: serverAllRIBs,
-		wantResponses: []*spb.GetResponse{{
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: DefaultNetworkInstanceName,
-				Entry: &spb.AFTEntry_NextHopGroup{
-					NextHopGroup: &aftpb.Afts_NextHopGroupKey{
-						Id:           1,
-						NextHopGroup: &aftpb.Afts_NextHopGroup{},
-					},
-				},
-			}},
-		}, {
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: DefaultNetworkInstanceName,
-				Entry: &spb.AFTEntry_NextHop{
-					NextHop: &aftpb.Afts_NextHopKey{
-						Index: 1,
-						NextHop: &aftpb.Afts_NextHop{
-							PushedMplsLabelStack: []*aftpb.Afts_NextHop_PushedMplsLabelStackUnion{{
-								PushedMplsLabelStackUint64: 42,
-							}},
-						},
-					},
-				},
-			}},
-		}, {
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: DefaultNetworkInstanceName,
-				Entry: &spb.AFTEntry_Ipv4{
-					Ipv4: &aftpb.Afts_Ipv4EntryKey{
-						Prefix:    "1.1.1.1/32",
-						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
-					},
-				},
-			}},
-		}, {
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: DefaultNetworkInstanceName,
-				Entry: &spb.AFTEntry_Ipv6{
-					Ipv6: &aftpb.Afts_Ipv6EntryKey{
-						Prefix: "2001:db8::/32",
-						Ipv6Entry: &aftpb.Afts_Ipv6Entry{
-							NextHopGroup: &wpb.UintValue{Value: 1},
-						},
-					},
-				},
-			}},
-		}, {
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: DefaultNetworkInstanceName,
-				Entry: &spb.AFTEntry_Mpls{
-					Mpls: &aftpb.Afts_LabelEntryKey{
-						Label: &aftpb.Afts_LabelEntryKey_LabelUint64{
-							LabelUint64: 42,
-						},
-						LabelEntry: &aftpb.Afts_LabelEntry{},
-					},
+			lastElecID: &spb.Uint128{Low: 1},
+		}
+	}
+	s.curElecID = &spb.Uint128{Low: 1}
+	s.curMaster = "one"
+
+	op := func(id uint64, o spb.AFTOperation_Operation, set func(*spb.AFTOperation, uint64)) *spb.AFTOperation {
+		a := &spb.AFTOperation{
+			Id:              id,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              o,
+			ElectionId:      &spb.Uint128{Low: 1},
+		}
+		set(a, 1)
+		return a
+	}
+
+	// The next-hop-group cannot be resolved, hence is pending and not yet owned.
+	s.doModify("one", []*spb.AFTOperation{op(1, spb.AFTOperation_ADD, nhgEntry)}, make(chan *spb.ModifyResponse, 1), make(chan error, 1))
+	if md, ok := s.masterRIB.GetEntryMetadata(DefaultNetworkInstanceName, constants.NextHopGroup, uint64(1)); ok {
+		t.Fatalf("pending entry has an owner, got: %s", md.Session)
+	}
+
+	// The next-hop is added by another session, which installs the next-hop-group
+	// on behalf of the session that added it.
+	s.curMaster = "two"
+	resCh := make(chan *spb.ModifyResponse, 2)
+	s.doModify("two", []*spb.AFTOperation{op(2, spb.AFTOperation_ADD, nhEntry)}, resCh, make(chan error, 1))
+	md, ok := s.masterRIB.GetEntryMetadata(DefaultNetworkInstanceName, constants.NextHopGroup, uint64(1))
+	if !ok {
+		t.Fatalf("resolved entry has no owner")
+	}
+	if got, want := md.Session, "one"; got != want {
+		t.Fatalf("did not get expected owner for resolved entry, got: %q, want: %q", got, want)
+	}
+}
+
+func TestIncreasingOperationIDs(t *testing.T) {
+	nhOp := func(id uint64, ni string, elecID uint64) *spb.AFTOperation {
+		return &spb.AFTOperation{
+			Id:              id,
+			NetworkInstance: ni,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{Low: elecID},
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{
+					Index:   id,
+					NextHop: &aftpb.Afts_NextHop{},
 				},
-			}},
-		}},
-	}, {
-		desc: "unsupported AFT",
-		inReq: &spb.GetRequest{
-			NetworkInstance: &spb.GetRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-			Aft: spb.AFTType_MAC,
-		},
-		wantErr: true,
-	}, {
-		desc: "filter to ipv4",
-		inReq: &spb.GetRequest{
-			NetworkInstance: &spb.GetRequest_Name{
-				Name: DefaultNetworkInstanceName,
 			},
-			Aft: spb.AFTType_IPV4,
-		},
-		inServer: serverAllRIBs,
-		wantResponses: []*spb.GetResponse{{
-			Entry: []*spb.AFTEntry{{
-				NetworkInstance: DefaultNetworkInstanceName,
-				Entry: &spb.AFTEntry_Ipv4{
-					Ipv4: &aftpb.Afts_Ipv4EntryKey{
-						Prefix:    "1.1.1.1/32",
-						Ipv4Entry: &aftpb.Afts_Ipv4Entry{},
+		}
+	}
+	nhgOp := func(id, nh uint64) *spb.AFTOperation {
+		return &spb.AFTOperation{
+			Id:              id,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      &spb.Uint128{Low: 2},
+			Entry: &spb.AFTOperation_NextHopGroup{
+				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+					Id: 1,
+					NextHopGroup: &aftpb.Afts_NextHopGroup{
+						NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{Index: nh}},
 					},
 				},
-			}},
-		}},
+			},
+		}
+	}
+
+	tests := []struct {
+		desc   string
+		inOpts []ServerOpt
+		// inRejected is an operation with ID 10 that is not accepted by the
+		// server, it is sent before an accepted operation with the same ID.
+		inRejected *spb.AFTOperation
+		// inLowerID indicates that an operation with a lower ID is sent once
+		// the operation with ID 10 has been accepted.
+		inLowerID  bool
+		wantStatus []spb.AFTResult_Status
+	}{{
+		desc:       "default server accepts lower operation IDs",
+		inLowerID:  true,
+		wantStatus: []spb.AFTResult_Status{spb.AFTResult_RIB_PROGRAMMED, spb.AFTResult_RIB_PROGRAMMED},
+	}, {
+		desc:       "lower operation ID is rejected",
+		inOpts:     []ServerOpt{WithIncreasingOperationIDs()},
+		inLowerID:  true,
+		wantStatus: []spb.AFTResult_Status{spb.AFTResult_RIB_PROGRAMMED, spb.AFTResult_FAILED},
+	}, {
+		desc:       "operation from client that is not primary is not recorded",
+		inOpts:     []ServerOpt{WithIncreasingOperationIDs()},
+		inRejected: nhOp(10, DefaultNetworkInstanceName, 1),
+		wantStatus: []spb.AFTResult_Status{spb.AFTResult_FAILED, spb.AFTResult_RIB_PROGRAMMED},
+	}, {
+		desc:       "operation for unknown network instance is not recorded",
+		inOpts:     []ServerOpt{WithIncreasingOperationIDs()},
+		inRejected: nhOp(10, "FISH", 2),
+		wantStatus: []spb.AFTResult_Status{spb.AFTResult_FAILED, spb.AFTResult_RIB_PROGRAMMED},
+	}, {
+		desc:       "operation with unresolved reference is not recorded",
+		inOpts:     []ServerOpt{WithIncreasingOperationIDs(), WithReferenceIntegrityCheck(true)},
+		inRejected: nhgOp(10, 42),
+		wantStatus: []spb.AFTResult_Status{spb.AFTResult_FAILED, spb.AFTResult_RIB_PROGRAMMED},
 	}}
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
-			errCh := make(chan error)
-			doneCh := make(chan struct{})
-			stopCh := make(chan struct{})
-			msgCh := make(chan *spb.GetResponse)
+			s, err := New(tt.inOpts...)
+			if err != nil {
+				t.Fatalf("cannot create server, %v", err)
+			}
+			s.cs["testclient"] = &clientState{
+				params: &clientParams{
+					Persist:      true,
+					ExpectElecID: true,
+				},
+				lastElecID: &spb.Uint128{Low: 2},
+			}
+			s.curElecID = &spb.Uint128{Low: 2}
+			s.curMaster = "testclient"
 
-			s := tt.inServer
-			if tt.inServer == nil {
-				var err error
-				s, err = New()
-				if err != nil {
-					t.Fatalf("cannot create server, %v", err)
-				}
+			ops := []*spb.AFTOperation{}
+			if tt.inRejected != nil {
+				ops = append(ops, tt.inRejected)
+			}
+			ops = append(ops, nhOp(10, DefaultNetworkInstanceName, 2))
+			if tt.inLowerID {
+				ops = append(ops, nhOp(5, DefaultNetworkInstanceName, 2))
 			}
-			go s.doGet(tt.inReq, msgCh, doneCh, stopCh, errCh)
 
-			var gotErr error
-			var done bool
-			got := []*spb.GetResponse{}
-			for !done {
+			resCh := make(chan *spb.ModifyResponse, len(ops))
+			errCh := make(chan error, 1)
+			s.doModify("testclient", ops, resCh, errCh)
+
+			got := []spb.AFTResult_Status{}
+			for range ops {
 				select {
-				case r := <-msgCh:
-					got = append(got, r)
 				case err := <-errCh:
-					gotErr = err
-					done = true
-				case <-doneCh:
-					done = true
+					t.Fatalf("got unexpected error, %v", err)
+				case res := <-resCh:
+					got = append(got, res.GetResult()[0].GetStatus())
 				}
 			}
-
-			if (gotErr != nil) != tt.wantErr {
-				t.Fatalf("did not get expected error, got: %v, wantErr? %v", gotErr, tt.wantErr)
-			}
-
-			if diff := cmp.Diff(got, tt.wantResponses,
-				cmpopts.EquateEmpty(),
-				protocmp.Transform(),
-				cmpopts.SortSlices(func(a, b *spb.GetResponse) bool {
-					return prototext.Format(a) < prototext.Format(b)
-				}),
-				protocmp.SortRepeated(func(a, b *spb.AFTEntry) bool {
-					return prototext.Format(a) < prototext.Format(b)
-				})); diff != "" {
-				t.Fatalf("did not get expected responses, diff(-got,+want):\n%s", diff)
+			if diff := cmp.Diff(got, tt.wantStatus); diff != "" {
+				t.Fatalf("did not get expected results, diff(-got,+want):\n%s", diff)
 			}
 		})
 	}
 }
 
-func TestCheckFlushRequest(t *testing.T) {
+func TestHasOwnershipOverride(t *testing.T) {
+	ipv4Op := func(md []byte) *spb.AFTOperation {
+		e := &aftpb.Afts_Ipv4Entry{}
+		if md != nil {
+			e.EntryMetadata = &wpb.BytesValue{Value: md}
+		}
+		return &spb.AFTOperation{
+			Entry: &spb.AFTOperation_Ipv4{
+				Ipv4: &aftpb.Afts_Ipv4EntryKey{Prefix: "192.0.2.0/24", Ipv4Entry: e},
+			},
+		}
+	}
+
 	tests := []struct {
-		desc           string
-		inServer       *Server
-		inRequest      *spb.FlushRequest
-		wantErrCode    codes.Code
-		wantErrDetails *spb.FlushResponseError
+		desc string
+		inOp *spb.AFTOperation
+		want bool
 	}{{
-		desc: "network instance is not specified",
-		inServer: &Server{
-			curElecID: &spb.Uint128{High: 0, Low: 3},
-		},
-		inRequest: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 3},
-			},
-		},
-		wantErrCode: codes.InvalidArgument,
-		wantErrDetails: &spb.FlushResponseError{
-			Status: spb.FlushResponseError_UNSPECIFIED_NETWORK_INSTANCE,
-		},
-	}, {
-		desc: "election unspecified, but server is in SINGLE_PRIMARY",
-		inServer: &Server{
-			curElecID: &spb.Uint128{High: 1, Low: 1},
-		},
-		inRequest: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-		},
-		wantErrCode: codes.FailedPrecondition,
-		wantErrDetails: &spb.FlushResponseError{
-			Status: spb.FlushResponseError_UNSPECIFIED_ELECTION_BEHAVIOR,
-		},
-	}, {
-		desc:     "server is ALL_PRIMARY, but election ID is specified",
-		inServer: &Server{},
-		inRequest: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 42, Low: 42},
-			},
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-		},
-		wantErrCode: codes.FailedPrecondition,
-		wantErrDetails: &spb.FlushResponseError{
-			Status: spb.FlushResponseError_ELECTION_ID_IN_ALL_PRIMARY,
-		},
-	}, {
-		desc: "zero election ID specified",
-		inServer: &Server{
-			curElecID: &spb.Uint128{High: 1, Low: 1},
-		},
-		inRequest: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 0},
-			},
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-		},
-		wantErrCode: codes.InvalidArgument,
-		wantErrDetails: &spb.FlushResponseError{
-			Status: spb.FlushResponseError_INVALID_ELECTION_ID,
-		},
-	}, {
-		desc: "specified ID is not master",
-		inServer: &Server{
-			curElecID: &spb.Uint128{High: 0, Low: 2},
-		},
-		inRequest: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 1},
-			},
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-		},
-		wantErrCode: codes.FailedPrecondition,
-		wantErrDetails: &spb.FlushResponseError{
-			Status: spb.FlushResponseError_NOT_PRIMARY,
-		},
+		desc: "no metadata",
+		inOp: ipv4Op(nil),
 	}, {
-		desc: "specified ID is OK - equal",
-		inServer: &Server{
-			curElecID: &spb.Uint128{High: 0, Low: 3},
-		},
-		inRequest: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 3},
-			},
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-		},
+		desc: "override set",
+		inOp: ipv4Op([]byte(OwnershipOverrideMetadata)),
+		want: true,
 	}, {
-		desc: "specified ID is OK - greater than",
-		inServer: &Server{
-			curElecID: &spb.Uint128{High: 0, Low: 3},
-		},
-		inRequest: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 4},
-			},
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-		},
+		desc: "metadata set to another value",
+		inOp: ipv4Op([]byte("other")),
 	}, {
-		desc: "override specified",
-		inServer: &Server{
-			curElecID: &spb.Uint128{High: 0, Low: 3},
-		},
-		inRequest: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Override{
-				Override: &spb.Empty{},
-			},
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
+		desc: "entry without metadata",
+		inOp: &spb.AFTOperation{
+			Entry: &spb.AFTOperation_NextHop{
+				NextHop: &aftpb.Afts_NextHopKey{Index: 1},
 			},
 		},
 	}}
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
-			err := tt.inServer.checkFlushRequest(tt.inRequest)
-			if err == nil && tt.wantErrCode != codes.OK {
-				t.Fatalf("got unexpected nil error, want: (code: %s, details: %v)", tt.wantErrCode, tt.wantErrDetails)
+			if got := hasOwnershipOverride(tt.inOp); got != tt.want {
+				t.Fatalf("hasOwnershipOverride(%s): did not get expected result, got: %v, want: %v", tt.inOp, got, tt.want)
 			}
+		})
+	}
+}
 
-			gotErr, ok := status.FromError(err)
-			if !ok {
-				t.Fatalf("got unexpected non-status.Status error, got: %T, want: status.Status", err)
-			}
+// fakeModifyServer is a fake implementation of the GRIBI_ModifyServer interface
+// that reads requests from, and writes responses to, channels.
+type fakeModifyServer struct {
+	grpc.ServerStream
+	ctx context.Context
+	in  chan *spb.ModifyRequest
+	out chan *spb.ModifyResponse
+}
 
-			if got, want := gotErr.Code(), tt.wantErrCode; got != want {
-				t.Fatalf("did not get expected error code, got: %s, want: %s", gotErr.Proto(), want)
-			}
+func (f *fakeModifyServer) Context() context.Context { return f.ctx }
 
-			if tt.wantErrDetails != nil {
-				gotDets := gotErr.Details()
-				if len(gotDets) != 1 {
-					t.Fatalf("did not get error details, got: %v, want: 1 FlushErrorDetails", gotDets)
-				}
-				gotD, ok := gotDets[0].(*spb.FlushResponseError)
-				if !ok {
-					t.Fatalf("did not get expected details type, got: %T, want: *spb.FlushResponseError", gotDets[0])
-				}
-				if got, want := gotD, tt.wantErrDetails; !proto.Equal(got, want) {
-					t.Fatalf("did not get expected error details, got: %s, want: %s", prototext.Format(got), prototext.Format(want))
-				}
-			}
-		})
+func (f *fakeModifyServer) Send(r *spb.ModifyResponse) error {
+	f.out <- r
+	return nil
+}
+
+func (f *fakeModifyServer) Recv() (*spb.ModifyRequest, error) {
+	r, ok := <-f.in
+	if !ok {
+		return nil, io.EOF
 	}
+	return r, nil
 }
 
-func TestFlush(t *testing.T) {
-	addEntry := func(r *rib.RIB, ni string) {
-		if oks, _, err := r.AddEntry(ni, &spb.AFTOperation{
-			Op: spb.AFTOperation_ADD,
+// recvModifyResponse returns the next response written to ms by the Modify RPC,
+// failing the test if the RPC returns or no response is received within a timeout.
+func recvModifyResponse(t *testing.T, ms *fakeModifyServer, errCh chan error) *spb.ModifyResponse {
+	t.Helper()
+	select {
+	case r := <-ms.out:
+		return r
+	case err := <-errCh:
+		t.Fatalf("Modify returned before sending response, %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatalf("did not receive response from Modify within timeout")
+	}
+	return nil
+}
+
+func TestWithClock(t *testing.T) {
+	fixed := time.Unix(1234, 5678)
+	s, err := New(WithClock(func() time.Time { return fixed }))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+
+	var hookTS []int64
+	s.masterRIB.SetPostChangeHook(func(_ constants.OpType, ts int64, _ string, _ ygot.ValidatedGoStruct) {
+		hookTS = append(hookTS, ts)
+	})
+
+	ms := &fakeModifyServer{
+		ctx: context.Background(),
+		in:  make(chan *spb.ModifyRequest),
+		out: make(chan *spb.ModifyResponse),
+	}
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Modify(ms) }()
+
+	elecID := &spb.Uint128{High: 0, Low: 1}
+	for _, req := range []*spb.ModifyRequest{{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+		},
+	}, {
+		ElectionId: elecID,
+	}} {
+		ms.in <- req
+		recvModifyResponse(t, ms, errCh)
+	}
+
+	ms.in <- &spb.ModifyRequest{
+		Operation: []*spb.AFTOperation{{
+			Id:              1,
+			NetworkInstance: DefaultNetworkInstanceName,
+			Op:              spb.AFTOperation_ADD,
+			ElectionId:      elecID,
 			Entry: &spb.AFTOperation_NextHop{
 				NextHop: &aftpb.Afts_NextHopKey{
 					Index:   1,
 					NextHop: &aftpb.Afts_NextHop{},
 				},
 			},
-		}); err != nil || len(oks) != 1 {
-			t.Fatalf("cannot add NextHop to server, %v", err)
+		}},
+	}
+	got := recvModifyResponse(t, ms, errCh)
+
+	close(ms.in)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Modify returned unexpected error, %v", err)
 		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Modify did not return within timeout")
+	}
 
-		if oks, _, err := r.AddEntry(ni, &spb.AFTOperation{
-			Op: spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_NextHopGroup{
-				NextHopGroup: &aftpb.Afts_NextHopGroupKey{
-					Id: 1,
-					NextHopGroup: &aftpb.Afts_NextHopGroup{
-						NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
-							Index:   1,
-							NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
-						}},
-					},
+	want := &spb.ModifyResponse{
+		Result: []*spb.AFTResult{{
+			Id:        1,
+			Status:    spb.AFTResult_RIB_PROGRAMMED,
+			Timestamp: fixed.UnixNano(),
+		}},
+	}
+	if diff := cmp.Diff(got, want, protocmp.Transform()); diff != "" {
+		t.Fatalf("did not get expected response, diff(-got,+want):\n%s", diff)
+	}
+
+	if diff := cmp.Diff(hookTS, []int64{fixed.UnixNano()}); diff != "" {
+		t.Fatalf("did not get expected post-change hook timestamps, diff(-got,+want):\n%s", diff)
+	}
+
+	resp, err := s.Flush(context.Background(), &spb.FlushRequest{
+		NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+		Election:        &spb.FlushRequest_Id{Id: elecID},
+	})
+	if err != nil {
+		t.Fatalf("cannot flush server, %v", err)
+	}
+	if got, want := resp.GetTimestamp(), fixed.UnixNano(); got != want {
+		t.Fatalf("did not get expected Flush timestamp, got: %d, want: %d", got, want)
+	}
+}
+
+func TestWithClockPendingExpiry(t *testing.T) {
+	now := time.Unix(1234, 0)
+	s, err := New(WithClock(func() time.Time { return now }), WithPendingResolution(time.Minute))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	if err := s.newClient("testclient"); err != nil {
+		t.Fatalf("cannot create client, %v", err)
+	}
+
+	op := &spb.AFTOperation{
+		Id:              1,
+		NetworkInstance: DefaultNetworkInstanceName,
+		Op:              spb.AFTOperation_ADD,
+		ElectionId:      &spb.Uint128{High: 0, Low: 1},
+		Entry: &spb.AFTOperation_NextHopGroup{
+			NextHopGroup: &aftpb.Afts_NextHopGroupKey{
+				Id: 1,
+				NextHopGroup: &aftpb.Afts_NextHopGroup{
+					NextHop: []*aftpb.Afts_NextHopGroup_NextHopKey{{
+						Index:   1,
+						NextHop: &aftpb.Afts_NextHopGroup_NextHop{},
+					}},
 				},
 			},
-		}); err != nil || len(oks) != 1 {
-			t.Fatalf("cannot add NextHopGroup to server, %v", err)
+		},
+	}
+	elec := &electionDetails{
+		master:       "testclient",
+		ID:           &spb.Uint128{High: 0, Low: 1},
+		client:       "testclient",
+		clientLatest: &spb.Uint128{High: 0, Low: 1},
+	}
+	if _, _, err := s.modifyAndTrack("testclient", DefaultNetworkInstanceName, op, false, elec); err != nil {
+		t.Fatalf("cannot run operation, %v", err)
+	}
+
+	// The deadline is determined by the clock, such that the operation does not
+	// expire until the clock has advanced beyond the timeout.
+	if got := s.expiredResults("testclient", s.clock()); got != nil {
+		t.Fatalf("operation expired before clock advanced, got: %s", got)
+	}
+	now = now.Add(2 * time.Minute)
+	got := s.expiredResults("testclient", s.clock())
+	if len(got.GetResult()) != 1 || got.GetResult()[0].GetStatus() != spb.AFTResult_FAILED {
+		t.Fatalf("did not get expected expired result, got: %s", got)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	elecID := &spb.Uint128{High: 0, Low: 1}
+	s, err := New()
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	s.cs["testclient"] = &clientState{
+		params: &clientParams{
+			Persist:      true,
+			ExpectElecID: true,
+		},
+		lastElecID: elecID,
+	}
+	s.curElecID = elecID
+	s.curMaster = "testclient"
+
+	entries := []fluent.GRIBIEntry{
+		fluent.NextHopEntry().WithNetworkInstance(DefaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1"),
+		fluent.NextHopEntry().WithNetworkInstance(DefaultNetworkInstanceName).WithIndex(2).WithIPAddress("192.0.2.2"),
+		fluent.NextHopGroupEntry().WithNetworkInstance(DefaultNetworkInstanceName).WithID(42).AddNextHop(1, 1).AddNextHop(2, 3),
+		fluent.IPv4Entry().WithNetworkInstance(DefaultNetworkInstanceName).WithPrefix("198.51.100.0/24").WithNextHopGroup(42),
+	}
+	for i, e := range entries {
+		op, err := e.OpProto()
+		if err != nil {
+			t.Fatalf("cannot build operation for entry %d, %v", i, err)
 		}
+		op.Id = uint64(i + 1)
+		op.Op = spb.AFTOperation_ADD
+		op.ElectionId = elecID
 
-		if oks, _, err := r.AddEntry(ni, &spb.AFTOperation{
-			Op: spb.AFTOperation_ADD,
-			Entry: &spb.AFTOperation_Ipv4{
-				Ipv4: &aftpb.Afts_Ipv4EntryKey{
-					Prefix: "1.1.1.1/32",
-					Ipv4Entry: &aftpb.Afts_Ipv4Entry{
-						NextHopGroup: &wpb.UintValue{Value: 1},
-					},
-				},
-			},
-		}); err != nil || len(oks) != 1 {
-			t.Fatalf("cannot add IPv4Entry to server, %v", err)
+		resCh := make(chan *spb.ModifyResponse, 1)
+		errCh := make(chan error, 1)
+		s.doModify("testclient", []*spb.AFTOperation{op}, resCh, errCh)
+		select {
+		case err := <-errCh:
+			t.Fatalf("got unexpected error for operation %s, %v", op, err)
+		case res := <-resCh:
+			if got := res.GetResult()[0].GetStatus(); got != spb.AFTResult_RIB_PROGRAMMED {
+				t.Fatalf("operation %s was not programmed, got: %s", op, res)
+			}
+		default:
+			t.Fatalf("did not get result for operation %s", op)
 		}
 	}
 
-	// singleNI creates a server with the default network instance with one entry.
-	singleNI := func() *Server {
-		s, err := NewFake()
+	got, err := s.ExportJSON(DefaultNetworkInstanceName)
+	if err != nil {
+		t.Fatalf("cannot export JSON, %v", err)
+	}
+	want, err := os.ReadFile(filepath.Join("testdata", "export_aft.json"))
+	if err != nil {
+		t.Fatalf("cannot read golden file, %v", err)
+	}
+	if diff := cmp.Diff(strings.TrimSpace(string(want)), strings.TrimSpace(got)); diff != "" {
+		t.Fatalf("did not get expected JSON, diff(-want,+got):\n%s", diff)
+	}
+
+	if _, err := s.ExportJSON("does-not-exist"); err == nil {
+		t.Fatalf("did not get expected error for unknown network instance")
+	}
+}
+
+func TestReferenceIntegrityCheck(t *testing.T) {
+	elecID := &spb.Uint128{High: 0, Low: 1}
+	s, err := New(WithReferenceIntegrityCheck(true))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	s.cs["testclient"] = &clientState{
+		params: &clientParams{
+			Persist:      true,
+			ExpectElecID: true,
+		},
+		lastElecID: elecID,
+	}
+	s.curElecID = elecID
+	s.curMaster = "testclient"
+
+	var id uint64
+	// do runs the operation built from the fluent entry e via the server's Modify
+	// handling and returns the result.
+	do := func(e fluent.GRIBIEntry) *spb.AFTResult {
+		t.Helper()
+		op, err := e.OpProto()
 		if err != nil {
-			t.Fatalf("cannot create server, error: %v", err)
+			t.Fatalf("cannot build operation, %v", err)
+		}
+		id++
+		op.Id = id
+		op.Op = spb.AFTOperation_ADD
+		op.ElectionId = elecID
+
+		resCh := make(chan *spb.ModifyResponse, 1)
+		errCh := make(chan error, 1)
+		s.doModify("testclient", []*spb.AFTOperation{op}, resCh, errCh)
+		select {
+		case err := <-errCh:
+			t.Fatalf("got unexpected error for operation %s, %v", op, err)
+		case res := <-resCh:
+			return res.GetResult()[0]
+		default:
+			t.Fatalf("did not get result for operation %s", op)
+		}
+		return nil
+	}
+	// wantFailed checks that res is a failed result for an invalid argument.
+	wantFailed := func(res *spb.AFTResult) {
+		t.Helper()
+		if res.GetStatus() != spb.AFTResult_FAILED || !strings.Contains(res.GetErrorDetails().GetErrorMessage(), codes.InvalidArgument.String()) {
+			t.Errorf("did not get expected failed result, got: %s", res)
+		}
+	}
+	// wantProgrammed checks that res is a programmed result.
+	wantProgrammed := func(res *spb.AFTResult) {
+		t.Helper()
+		if res.GetStatus() != spb.AFTResult_RIB_PROGRAMMED {
+			t.Errorf("did not get expected programmed result, got: %s", res)
 		}
-		r := rib.New(DefaultNetworkInstanceName)
-		addEntry(r, DefaultNetworkInstanceName)
-		s.InjectRIB(r)
-		return s.Server
 	}
 
-	// singleNIWithElection creates a server with a default network instance with
-	// one entry, and sets the specified election ID.
-	singleNIWithElection := func(id *spb.Uint128) *Server {
-		s := singleNI()
-		s.curElecID = id
-		return s
+	def := DefaultNetworkInstanceName
+	wantFailed(do(fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("192.0.2.0/24").WithNextHopGroup(1)))
+	wantFailed(do(fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(1, 1)))
+	wantProgrammed(do(fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(1)))
+	wantProgrammed(do(fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(1, 1)))
+	wantFailed(do(fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("192.0.2.0/24").WithNextHopGroup(1).WithNextHopGroupNetworkInstance("does-not-exist")))
+	wantProgrammed(do(fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("192.0.2.0/24").WithNextHopGroup(1)))
+
+	if s.masterRIB.IsPendingForSession("testclient", 1) || s.masterRIB.IsPendingForSession("testclient", 2) {
+		t.Errorf("rejected operations were held pending resolution")
 	}
+}
 
-	// multiNI creates a server with a default network instance along with the
-	// other network instances specified, it contains one entry per network
-	// instance.
-	multiNI := func(names []string) *Server {
-		s, err := NewFake(WithVRFs(names))
-		if err != nil {
-			t.Fatalf("cannot create server, error: %v", err)
+func TestOperationHook(t *testing.T) {
+	const numOps = 30
+
+	// Fail every third operation, as though the FIB was full.
+	hook := func(op *spb.AFTOperation) *spb.AFTResult {
+		if op.GetId()%3 != 0 {
+			return nil
 		}
-		addEntry(s.masterRIB, DefaultNetworkInstanceName)
-		for _, n := range names {
-			addEntry(s.masterRIB, n)
+		return &spb.AFTResult{
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: "FIB full",
+			},
 		}
+	}
 
-		return s.Server
+	s, err := NewInProcess(WithOperationHook(hook))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
 	}
+	defer s.Stop()
 
-	// multiNI creates a server with a default network instance along with the
-	// other network instances specified. It also set the election ID.
-	// Each network instance contains one entry.
-	multiNIWithElection := func(names []string, id *spb.Uint128) *Server {
-		s := multiNI(names)
-		s.curElecID = id
-		return s
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	c.StartSending(context.Background(), t)
+	for i := uint64(1); i <= numOps; i++ {
+		c.Modify().AddEntry(t, fluent.NextHopEntry().WithNetworkInstance(DefaultNetworkInstanceName).WithIndex(i).WithIPAddress("192.0.2.1"))
 	}
 
-	tests := []struct {
-		desc            string
-		inServer        *Server
-		inReq           *spb.FlushRequest
-		wantErrCode     codes.Code
-		wantResult      spb.FlushResponse_Result
-		wantEntriesInNI map[string]int
-	}{{
-		desc:        "error, nil request received",
-		inServer:    multiNI([]string{"two"}),
-		wantErrCode: codes.Internal,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 3,
-			"two":                      3,
-		},
-	}, {
-		desc:        "error, empty request received",
-		inServer:    multiNI([]string{"two"}),
-		inReq:       &spb.FlushRequest{},
-		wantErrCode: codes.InvalidArgument,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 3,
-			"two":                      3,
-		},
-	}, {
-		desc:     "error, network instance is not specified",
-		inServer: singleNIWithElection(&spb.Uint128{High: 0, Low: 1}),
-		inReq: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 1},
-			},
-		},
-		wantErrCode: codes.InvalidArgument,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 3,
-		},
-	}, {
-		desc:     "error, network instance does not exist",
-		inServer: singleNI(),
-		inReq: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: "does-not-exist",
-			},
-		},
-		wantErrCode: codes.InvalidArgument,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 3,
-		},
-	}, {
-		desc:     "error, election ID specified but not master",
-		inServer: singleNIWithElection(&spb.Uint128{High: 0, Low: 2}),
-		inReq: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_All{
-				All: &spb.Empty{},
-			},
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 1},
-			},
-		},
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 3,
-		},
-		wantErrCode: codes.FailedPrecondition,
-	}, {
-		desc:     "error, election ID is specified in ALL_PRIMARY mode",
-		inServer: singleNI(),
-		inReq: &spb.FlushRequest{
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 1, Low: 1},
-			},
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: "does-not-exist",
-			},
-		},
-		wantErrCode: codes.FailedPrecondition,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 3,
-		},
-	}, {
-		desc:     "success, flush the default NI",
-		inServer: singleNI(),
-		inReq: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: DefaultNetworkInstanceName,
-			},
-		},
-		wantResult: spb.FlushResponse_OK,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 0,
-		},
-	}, {
-		desc:     "success, flush a non default NI",
-		inServer: multiNI([]string{"two"}),
-		inReq: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_Name{
-				Name: "two",
-			},
-		},
-		wantResult: spb.FlushResponse_OK,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 3,
-			"two":                      0,
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("got unexpected error from client, %v", err)
+	}
+
+	var gotFailed, wantFailed []uint64
+	for i := uint64(3); i <= numOps; i += 3 {
+		wantFailed = append(wantFailed, i)
+	}
+	for _, r := range c.Results(t) {
+		if r.ProgrammingResult == spb.AFTResult_FAILED {
+			gotFailed = append(gotFailed, r.OperationID)
+		}
+	}
+	sort.Slice(gotFailed, func(i, j int) bool { return gotFailed[i] < gotFailed[j] })
+	if diff := cmp.Diff(gotFailed, wantFailed); diff != "" {
+		t.Fatalf("did not get expected failed operations, diff(-got,+want):\n%s", diff)
+	}
+
+	niR, ok := s.masterRIB.NetworkInstanceRIB(DefaultNetworkInstanceName)
+	if !ok {
+		t.Fatalf("cannot find default network instance")
+	}
+	for i := uint64(1); i <= numOps; i++ {
+		if _, got := niR.GetNextHop(i); got != (i%3 != 0) {
+			t.Errorf("did not get expected installed state for next-hop %d, got: %v, want: %v", i, got, i%3 != 0)
+		}
+	}
+}
+
+func TestTwoPhaseFIBACK(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+	if err != nil {
+		t.Fatalf("cannot open Modify RPC, %v", err)
+	}
+	for _, req := range []*spb.ModifyRequest{{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+			AckType:     spb.SessionParameters_RIB_AND_FIB_ACK,
 		},
 	}, {
-		desc:     "success, flush all NIs",
-		inServer: multiNI([]string{"two"}),
-		inReq: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_All{
-				All: &spb.Empty{},
-			},
-		},
-		wantResult: spb.FlushResponse_OK,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 0,
-			"two":                      0,
+		ElectionId: &spb.Uint128{Low: 1},
+	}} {
+		if err := mc.Send(req); err != nil {
+			t.Fatalf("cannot send %s, %v", req, err)
+		}
+		if _, err := mc.Recv(); err != nil {
+			t.Fatalf("did not get response to %s, %v", req, err)
+		}
+	}
+
+	for i := uint64(1); i <= 2; i++ {
+		if err := mc.Send(nhAddRequest(i)); err != nil {
+			t.Fatalf("cannot send operation %d, %v", i, err)
+		}
+		var got []*spb.AFTResult
+		for _, want := range []spb.AFTResult_Status{spb.AFTResult_RIB_PROGRAMMED, spb.AFTResult_FIB_PROGRAMMED} {
+			res, err := mc.Recv()
+			if err != nil {
+				t.Fatalf("did not get %s response to operation %d, %v", want, i, err)
+			}
+			if len(res.GetResult()) != 1 {
+				t.Fatalf("did not get exactly one result in response to operation %d, got: %s", i, res)
+			}
+			r := res.GetResult()[0]
+			if r.GetId() != i || r.GetStatus() != want {
+				t.Fatalf("did not get expected result for operation %d, got: %s, want: id %d, status %s", i, r, i, want)
+			}
+			got = append(got, r)
+		}
+		if rib, fib := got[0].GetTimestamp(), got[1].GetTimestamp(); rib == 0 || rib > fib {
+			t.Errorf("did not get RIB_PROGRAMMED before FIB_PROGRAMMED for operation %d, RIB timestamp: %d, FIB timestamp: %d", i, rib, fib)
+		}
+	}
+}
+
+// TestModifyResultOrdering sends a single ModifyRequest containing many dependent
+// operations, and checks that the RIB_PROGRAMMED and FIB_PROGRAMMED results are
+// each returned in the order in which the operations were specified, even where
+// the RIB event hook completes events out of order.
+func TestModifyResultOrdering(t *testing.T) {
+	const entries = 3334 // Each entry has a next-hop, next-hop-group and IPv4 prefix.
+
+	hook := func(e rib.RIBEvent) error {
+		go func() {
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Microsecond)
+			e.Done(nil)
+		}()
+		return nil
+	}
+	s, err := NewInProcess(WithRIBEventHook(hook), WithMaxOutstandingRIBEvents(16))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	// Programming the entries takes a number of seconds, and considerably longer
+	// with the race detector enabled.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	mc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+	if err != nil {
+		t.Fatalf("cannot open Modify RPC, %v", err)
+	}
+	for _, req := range []*spb.ModifyRequest{{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+			AckType:     spb.SessionParameters_RIB_AND_FIB_ACK,
 		},
 	}, {
-		desc:     "success, flush all NIs with a valid election ID",
-		inServer: multiNIWithElection([]string{"two"}, &spb.Uint128{High: 0, Low: 1}),
-		inReq: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_All{
-				All: &spb.Empty{},
-			},
-			Election: &spb.FlushRequest_Id{
-				Id: &spb.Uint128{High: 0, Low: 1},
-			},
-		},
-		wantResult: spb.FlushResponse_OK,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 0,
-			"two":                      0,
-		},
+		ElectionId: &spb.Uint128{Low: 1},
+	}} {
+		if err := mc.Send(req); err != nil {
+			t.Fatalf("cannot send %s, %v", req, err)
+		}
+		if _, err := mc.Recv(); err != nil {
+			t.Fatalf("did not get response to %s, %v", req, err)
+		}
+	}
+
+	def := DefaultNetworkInstanceName
+	req := &spb.ModifyRequest{}
+	for i := uint64(1); i <= entries; i++ {
+		for _, e := range []fluent.GRIBIEntry{
+			fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(i).WithIPAddress("192.0.2.1"),
+			fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(i).AddNextHop(i, 1),
+			fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)).WithNextHopGroup(i),
+		} {
+			op, err := e.OpProto()
+			if err != nil {
+				t.Fatalf("cannot build operation, %v", err)
+			}
+			op.Id = uint64(len(req.Operation) + 1)
+			op.Op = spb.AFTOperation_ADD
+			op.ElectionId = &spb.Uint128{Low: 1}
+			req.Operation = append(req.Operation, op)
+		}
+	}
+	if err := mc.Send(req); err != nil {
+		t.Fatalf("cannot send operations, %v", err)
+	}
+
+	want := uint64(len(req.Operation))
+	var lastRIB, lastFIB uint64
+	for lastFIB != want {
+		res, err := mc.Recv()
+		if err != nil {
+			t.Fatalf("did not receive all results, last RIB result: %d, last FIB result: %d, %v", lastRIB, lastFIB, err)
+		}
+		for _, r := range res.GetResult() {
+			switch r.GetStatus() {
+			case spb.AFTResult_RIB_PROGRAMMED:
+				if r.GetId() != lastRIB+1 {
+					t.Fatalf("did not get RIB_PROGRAMMED results in order, got: %d, want: %d", r.GetId(), lastRIB+1)
+				}
+				lastRIB = r.GetId()
+			case spb.AFTResult_FIB_PROGRAMMED:
+				if r.GetId() != lastFIB+1 {
+					t.Fatalf("did not get FIB_PROGRAMMED results in order, got: %d, want: %d", r.GetId(), lastFIB+1)
+				}
+				if r.GetId() > lastRIB {
+					t.Fatalf("got FIB_PROGRAMMED result for operation %d before RIB_PROGRAMMED", r.GetId())
+				}
+				lastFIB = r.GetId()
+			default:
+				t.Fatalf("got unexpected result, %s", r)
+			}
+		}
+	}
+}
+
+func TestResolvedResultsSentToOwner(t *testing.T) {
+	tests := []struct {
+		desc   string
+		inOpts []ServerOpt
+	}{{
+		desc: "results sent when operation is processed",
 	}, {
-		desc:     "success, election ID specified with override",
-		inServer: singleNIWithElection(&spb.Uint128{High: 0, Low: 42}),
-		inReq: &spb.FlushRequest{
-			NetworkInstance: &spb.FlushRequest_All{
-				All: &spb.Empty{},
-			},
-			Election: &spb.FlushRequest_Override{
-				Override: &spb.Empty{},
-			},
-		},
-		wantResult: spb.FlushResponse_OK,
-		wantEntriesInNI: map[string]int{
-			DefaultNetworkInstanceName: 0,
+		desc: "results sent by RIB event hook",
+		inOpts: []ServerOpt{
+			WithRIBEventHook(func(e rib.RIBEvent) error {
+				go e.Done(nil)
+				return nil
+			}),
 		},
 	}}
 
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
-			resp, err := tt.inServer.Flush(context.Background(), tt.inReq)
+			// Both clients share the connection of the in-process server.
+			s, err := NewInProcess(append(tt.inOpts, WithMultipleModifyPerConnection())...)
 			if err != nil {
-				s, ok := status.FromError(err)
-				if !ok {
-					t.Fatalf("did not get status.Status as error, got: %T %v", err, err)
+				t.Fatalf("cannot start in-process server, %v", err)
+			}
+			defer s.Stop()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// open opens a Modify RPC for a client that requests FIB
+			// acknowledgements, which is elected primary using the election ID
+			// elecID.
+			open := func(elecID uint64) spb.GRIBI_ModifyClient {
+				t.Helper()
+				mc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+				if err != nil {
+					t.Fatalf("cannot open Modify RPC, %v", err)
 				}
-				if got, want := s.Code(), tt.wantErrCode; got != want {
-					t.Fatalf("did not get expected error code, got: %s, want: %s", got, want)
+				for _, req := range []*spb.ModifyRequest{{
+					Params: &spb.SessionParameters{
+						Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+						Persistence: spb.SessionParameters_PRESERVE,
+						AckType:     spb.SessionParameters_RIB_AND_FIB_ACK,
+					},
+				}, {
+					ElectionId: &spb.Uint128{Low: elecID},
+				}} {
+					if err := mc.Send(req); err != nil {
+						t.Fatalf("cannot send %s, %v", req, err)
+					}
+					if _, err := mc.Recv(); err != nil {
+						t.Fatalf("did not get response to %s, %v", req, err)
+					}
 				}
-				return
+				return mc
 			}
-			if tt.wantResult != resp.GetResult() {
-				t.Fatalf("got unexpected result, got: %v, want: %v", resp.Result.String(), tt.wantResult.String())
-				return
+			// send sends the operations for entries, starting at operation ID
+			// id, using the election ID elecID.
+			send := func(mc spb.GRIBI_ModifyClient, id, elecID uint64, entries ...fluent.GRIBIEntry) {
+				t.Helper()
+				req := &spb.ModifyRequest{}
+				for i, e := range entries {
+					op, err := e.OpProto()
+					if err != nil {
+						t.Fatalf("cannot build operation, %v", err)
+					}
+					op.Id = id + uint64(i)
+					op.Op = spb.AFTOperation_ADD
+					op.ElectionId = &spb.Uint128{Low: elecID}
+					req.Operation = append(req.Operation, op)
+				}
+				if err := mc.Send(req); err != nil {
+					t.Fatalf("cannot send operations, %v", err)
+				}
 			}
-
-			for ni, wantEntries := range tt.wantEntriesInNI {
-				r, ok := tt.inServer.masterRIB.NetworkInstanceRIB(ni)
-				if !ok {
-					t.Fatalf("cannot find RIB %s on server", ni)
+			// recv checks that the next results received by mc are want, in
+			// any order, since FIB_PROGRAMMED results may be interleaved with
+			// RIB_PROGRAMMED results.
+			recv := func(desc string, mc spb.GRIBI_ModifyClient, want ...*spb.AFTResult) {
+				t.Helper()
+				var got []*spb.AFTResult
+				for len(got) < len(want) {
+					res, err := mc.Recv()
+					if err != nil {
+						t.Fatalf("%s: did not get response, %v", desc, err)
+					}
+					got = append(got, res.GetResult()...)
+				}
+				if diff := cmp.Diff(got, want,
+					protocmp.Transform(),
+					protocmp.IgnoreFields(&spb.AFTResult{}, "timestamp"),
+					cmpopts.SortSlices(func(a, b *spb.AFTResult) bool {
+						if a.GetId() != b.GetId() {
+							return a.GetId() < b.GetId()
+						}
+						return a.GetStatus() < b.GetStatus()
+					}),
+				); diff != "" {
+					t.Fatalf("%s: did not get expected results, diff(-got,+want):\n%s", desc, diff)
 				}
+			}
 
-				msgCh := make(chan *spb.GetResponse)
-				stopCh := make(chan struct{})
+			def := DefaultNetworkInstanceName
+			a := open(1)
+			send(a, 1, 1, fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("192.0.2.0/24").WithNextHopGroup(1))
 
-				doneCh := make(chan struct{})
-				defer close(doneCh)
+			// The second client becomes primary, and installs the entries that
+			// resolve the operation that is pending on behalf of the first
+			// client.
+			b := open(2)
+			send(b, 10, 2,
+				fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("198.51.100.1"),
+				fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(1, 1),
+			)
+			recv("second client", b,
+				&spb.AFTResult{Id: 10, Status: spb.AFTResult_RIB_PROGRAMMED},
+				&spb.AFTResult{Id: 10, Status: spb.AFTResult_FIB_PROGRAMMED},
+				&spb.AFTResult{Id: 11, Status: spb.AFTResult_RIB_PROGRAMMED},
+				&spb.AFTResult{Id: 11, Status: spb.AFTResult_FIB_PROGRAMMED},
+			)
 
-				got := []*spb.GetResponse{}
-				go func() {
-					for {
-						select {
-						case r := <-msgCh:
-							got = append(got, r)
-						case <-doneCh:
-							return
-						}
-					}
-				}()
+			// The results for the resolved operation are sent to the client
+			// that sent it.
+			recv("first client", a,
+				&spb.AFTResult{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+				&spb.AFTResult{Id: 1, Status: spb.AFTResult_FIB_PROGRAMMED},
+			)
 
-				if err := r.GetRIB(map[spb.AFTType]bool{
-					spb.AFTType_ALL: true,
-				}, msgCh, stopCh); err != nil {
-					t.Fatalf("could not perform Get on RIB, %v", err)
-				}
-				doneCh <- struct{}{}
+			// The next results received by the second client are for its
+			// subsequent operation, such that it did not receive a result for
+			// the resolved operation.
+			send(b, 12, 2, fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(2).WithIPAddress("198.51.100.2"))
+			recv("subsequent operation", b,
+				&spb.AFTResult{Id: 12, Status: spb.AFTResult_RIB_PROGRAMMED},
+				&spb.AFTResult{Id: 12, Status: spb.AFTResult_FIB_PROGRAMMED},
+			)
+		})
+	}
+}
 
-				if len(got) != wantEntries {
-					t.Fatalf("got unexpected entries in NI %s, got: %d entries, want: %d, contents:\n%+v", ni, len(got), wantEntries, got)
-				}
+func TestSplitFIBResults(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      *spb.ModifyResponse
+		wantRIB *spb.ModifyResponse
+		wantFIB *spb.ModifyResponse
+	}{{
+		desc: "RIB only",
+		in: &spb.ModifyResponse{Result: []*spb.AFTResult{
+			{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+		}},
+		wantRIB: &spb.ModifyResponse{Result: []*spb.AFTResult{
+			{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+		}},
+	}, {
+		desc: "RIB and FIB",
+		in: &spb.ModifyResponse{Result: []*spb.AFTResult{
+			{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 1, Status: spb.AFTResult_FIB_PROGRAMMED},
+			{Id: 2, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 2, Status: spb.AFTResult_FIB_PROGRAMMED},
+			{Id: 3, Status: spb.AFTResult_FAILED},
+		}},
+		wantRIB: &spb.ModifyResponse{Result: []*spb.AFTResult{
+			{Id: 1, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 2, Status: spb.AFTResult_RIB_PROGRAMMED},
+			{Id: 3, Status: spb.AFTResult_FAILED},
+		}},
+		wantFIB: &spb.ModifyResponse{Result: []*spb.AFTResult{
+			{Id: 1, Status: spb.AFTResult_FIB_PROGRAMMED},
+			{Id: 2, Status: spb.AFTResult_FIB_PROGRAMMED},
+		}},
+	}, {
+		desc: "FIB only",
+		in: &spb.ModifyResponse{Result: []*spb.AFTResult{
+			{Id: 1, Status: spb.AFTResult_FIB_PROGRAMMED},
+		}},
+		wantFIB: &spb.ModifyResponse{Result: []*spb.AFTResult{
+			{Id: 1, Status: spb.AFTResult_FIB_PROGRAMMED},
+		}},
+	}, {
+		desc: "no results",
+		in:   &spb.ModifyResponse{},
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			gotRIB, gotFIB := splitFIBResults(tt.in)
+			if diff := cmp.Diff(gotRIB, tt.wantRIB, protocmp.Transform()); diff != "" {
+				t.Errorf("did not get expected RIB response, diff(-got,+want):\n%s", diff)
+			}
+			if diff := cmp.Diff(gotFIB, tt.wantFIB, protocmp.Transform()); diff != "" {
+				t.Errorf("did not get expected FIB response, diff(-got,+want):\n%s", diff)
 			}
 		})
 	}
 }
+
+func TestServerRecentlyDeleted(t *testing.T) {
+	s, err := NewInProcess(WithDeletedHistory(10, time.Hour))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(12, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	c.StartSending(context.Background(), t)
+
+	nh := fluent.NextHopEntry().WithNetworkInstance(DefaultNetworkInstanceName).WithIndex(1).WithIPAddress("192.0.2.1")
+	c.Modify().AddEntry(t, nh)
+	c.Modify().DeleteEntry(t, nh)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("got unexpected error from client, %v", err)
+	}
+
+	got := s.RecentlyDeleted(DefaultNetworkInstanceName, constants.NextHop, nil)
+	if len(got) != 1 {
+		t.Fatalf("did not get expected number of deleted entries, got: %d, want: 1", len(got))
+	}
+	if got[0].Key != "1" || got[0].Client != "12" {
+		t.Errorf("did not get expected deleted entry, got key: %s, client: %s, want key: 1, client: 12", got[0].Key, got[0].Client)
+	}
+}
+
+func TestServerJournal(t *testing.T) {
+	s, err := New(WithJournal(10), WithPendingResolution(time.Minute))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	defName := DefaultNetworkInstanceName
+	elec := &electionDetails{
+		master:       "testclient",
+		ID:           &spb.Uint128{Low: 1},
+		client:       "testclient",
+		clientLatest: &spb.Uint128{Low: 1},
+	}
+
+	ops := []*spb.AFTOperation{{
+		Id:              1,
+		NetworkInstance: defName,
+		Op:              spb.AFTOperation_ADD,
+		ElectionId:      &spb.Uint128{Low: 1},
+		Entry: &spb.AFTOperation_NextHop{
+			NextHop: &aftpb.Afts_NextHopKey{
+				Index:   1,
+				NextHop: &aftpb.Afts_NextHop{IpAddress: &wpb.StringValue{Value: "192.0.2.1"}},
+			},
+		},
+	}, {
+		// References a next-hop-group that does not exist, and hence is held
+		// pending resolution.
+		Id:              2,
+		NetworkInstance: defName,
+		Op:              spb.AFTOperation_ADD,
+		ElectionId:      &spb.Uint128{Low: 1},
+		Entry: &spb.AFTOperation_Ipv4{
+			Ipv4: &aftpb.Afts_Ipv4EntryKey{
+				Prefix:    "198.51.100.0/24",
+				Ipv4Entry: &aftpb.Afts_Ipv4Entry{NextHopGroup: &wpb.UintValue{Value: 42}},
+			},
+		},
+	}}
+	for _, op := range ops {
+		if _, _, err := s.modifyAndTrack("testclient", defName, op, false, elec); err != nil {
+			t.Fatalf("cannot run operation %d, %v", op.GetId(), err)
+		}
+	}
+
+	// Disconnecting the client removes its pending operation, and flushing
+	// removes the installed next-hop.
+	s.deleteClient("testclient")
+	if _, err := s.Flush(context.Background(), &spb.FlushRequest{
+		NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+		Election:        &spb.FlushRequest_Override{Override: &spb.Empty{}},
+	}); err != nil {
+		t.Fatalf("cannot flush server, %v", err)
+	}
+
+	type summary struct {
+		Op  rib.JournalOp
+		ID  uint64
+		AFT constants.AFT
+		Key string
+	}
+	got := []summary{}
+	for _, e := range s.Journal(0) {
+		got = append(got, summary{Op: e.Op, ID: e.OperationID, AFT: e.AFT, Key: e.Key})
+	}
+	want := []summary{
+		{Op: rib.JournalAdd, ID: 1, AFT: constants.NextHop, Key: "1"},
+		{Op: rib.JournalRemovePending, ID: 2, AFT: constants.IPv4, Key: "198.51.100.0/24"},
+		{Op: rib.JournalFlush, AFT: constants.NextHop, Key: "1"},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Journal(0): did not get expected entries, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestUnspecifiedNetworkInstance(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	c.StartSending(context.Background(), t)
+
+	// None of the entries specify a network instance.
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithIndex(1).WithIPAddress("192.0.2.1"),
+		fluent.NextHopGroupEntry().WithID(1).AddNextHop(1, 1),
+		fluent.IPv4Entry().WithPrefix("198.51.100.0/24").WithNextHopGroup(1),
+		fluent.IPv6Entry().WithPrefix("2001:db8::/32").WithNextHopGroup(1),
+		fluent.LabelEntry().WithLabel(42).WithNextHopGroup(1),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("got unexpected error from client, %v", err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		chk.HasResult(t, c.Results(t),
+			fluent.OperationResult().
+				WithOperationID(i).
+				WithProgrammingResult(fluent.InstalledInRIB).
+				AsResult(),
+		)
+	}
+
+	// getNIs returns the number of entries in each network instance.
+	getNIs := func() map[string]int {
+		t.Helper()
+		gr, err := c.Get().AllNetworkInstances().WithAFT(fluent.AllAFTs).Send()
+		if err != nil {
+			t.Fatalf("got unexpected error from Get, %v", err)
+		}
+		nis := map[string]int{}
+		for _, e := range gr.GetEntry() {
+			nis[e.GetNetworkInstance()]++
+		}
+		return nis
+	}
+
+	if diff := cmp.Diff(getNIs(), map[string]int{DefaultNetworkInstanceName: 5}); diff != "" {
+		t.Fatalf("did not get entries in the default network instance, diff(-got,+want):\n%s", diff)
+	}
+
+	if _, err := c.Flush().WithElectionOverride().WithNetworkInstance(DefaultNetworkInstanceName).Send(); err != nil {
+		t.Fatalf("got unexpected error from Flush, %v", err)
+	}
+	if diff := cmp.Diff(getNIs(), map[string]int{}); diff != "" {
+		t.Fatalf("did not get expected entries after Flush, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestDefaultNetworkInstanceName(t *testing.T) {
+	s, err := NewInProcess(WithDefaultNetworkInstanceName("default"))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	if _, ok := s.Server.masterRIB.NetworkInstanceRIB("default"); !ok {
+		t.Fatalf("default network instance was not created")
+	}
+
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	c.StartSending(context.Background(), t)
+
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithIndex(1).WithIPAddress("192.0.2.1"),
+		fluent.NextHopEntry().WithNetworkInstance("VRF-A").WithIndex(2).WithIPAddress("192.0.2.2"),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("got unexpected error from client, %v", err)
+	}
+
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithOperationID(1).
+			WithProgrammingResult(fluent.InstalledInRIB).
+			AsResult(),
+	)
+	chk.HasResult(t, c.Results(t),
+		fluent.OperationResult().
+			WithOperationID(2).
+			WithProgrammingResult(fluent.ProgrammingFailed).
+			AsResult(),
+	)
+	for _, r := range c.Results(t) {
+		if r.OperationID == 2 && !strings.Contains(r.ErrorDetails.GetErrorMessage(), `unknown network instance "VRF-A"`) {
+			t.Errorf("did not get expected error for unknown network instance, got: %s", r)
+		}
+	}
+
+	gr, err := c.Get().WithNetworkInstance("default").WithAFT(fluent.NextHop).Send()
+	if err != nil {
+		t.Fatalf("got unexpected error from Get, %v", err)
+	}
+	if got := len(gr.GetEntry()); got != 1 {
+		t.Fatalf("did not get expected number of entries in default network instance, got: %d, want: 1", got)
+	}
+}
+
+func TestEntryAttribution(t *testing.T) {
+	s, err := NewInProcess(WithJournal(100))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+	stub := spb.NewGRIBIClient(s.Conn())
+
+	// program opens a Modify RPC with the election ID elecID, adds next-hop 1 on
+	// it and closes the RPC once the next-hop is programmed.
+	program := func(elecID uint64) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		mc, err := stub.Modify(ctx)
+		if err != nil {
+			t.Fatalf("cannot open Modify RPC, %v", err)
+		}
+		req := nhAddRequest(1)
+		req.GetOperation()[0].ElectionId = &spb.Uint128{Low: elecID}
+		for _, m := range []*spb.ModifyRequest{{
+			Params: &spb.SessionParameters{
+				Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+				Persistence: spb.SessionParameters_PRESERVE,
+			},
+		}, {
+			ElectionId: &spb.Uint128{Low: elecID},
+		}, req} {
+			if err := mc.Send(m); err != nil {
+				t.Fatalf("cannot send %s, %v", m, err)
+			}
+			res, err := mc.Recv()
+			if err != nil {
+				t.Fatalf("did not get response to %s, %v", m, err)
+			}
+			if m == req {
+				checkProgrammed(t, res)
+			}
+		}
+	}
+
+	program(1)
+	first, ok := s.EntryMetadata(DefaultNetworkInstanceName, constants.NextHop, uint64(1))
+	if !ok {
+		t.Fatalf("EntryMetadata: did not find metadata for next-hop")
+	}
+	if first.Session == "" || first.ElectionID.GetLow() != 1 || first.OperationID != 1 {
+		t.Fatalf("EntryMetadata: did not get expected metadata, got: %+v", first)
+	}
+
+	// The client reconnects, with a new session, and re-adds the entry, taking
+	// over its attribution.
+	program(2)
+	second, ok := s.EntryMetadata(DefaultNetworkInstanceName, constants.NextHop, uint64(1))
+	if !ok {
+		t.Fatalf("EntryMetadata: did not find metadata for next-hop after reconnection")
+	}
+	if second.Session == "" || second.Session == first.Session {
+		t.Errorf("EntryMetadata: session was not updated after reconnection, got: %q, first session: %q", second.Session, first.Session)
+	}
+	if second.ElectionID.GetLow() != 2 {
+		t.Errorf("EntryMetadata: election ID was not updated after reconnection, got: %s, want: 2", second.ElectionID)
+	}
+
+	var sessions []string
+	for _, e := range s.Journal(0) {
+		sessions = append(sessions, e.Session)
+	}
+	if diff := cmp.Diff(sessions, []string{first.Session, second.Session}); diff != "" {
+		t.Errorf("did not get expected sessions in journal, diff(-got,+want):\n%s", diff)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+const (
+	// DrainingErrorMessage is the error message that is returned within the
+	// AFTResult for operations that are received by a server that is draining
+	// or stopping, and hence are not processed.
+	DrainingErrorMessage = "server is draining, operation was not processed"
+
+	// shutdownIdleInterval is the interval for which a Modify stream must not
+	// have received any message before it is closed during a graceful stop.
+	shutdownIdleInterval = 250 * time.Millisecond
+)
+
+// shutdownState stores the state of the server that is used when it is being
+// drained or stopped.
+type shutdownState struct {
+	// mu protects draining and stopping.
+	mu sync.RWMutex
+	// draining indicates that the server should not process any AFT operations
+	// that it receives.
+	draining bool
+	// stopping indicates that the server has begun a graceful stop, and should
+	// not accept new RPCs.
+	stopping bool
+
+	// initOnce ensures that the channels within the shutdownState are created
+	// only once.
+	initOnce sync.Once
+	// stopCh is closed when the server begins a graceful stop.
+	stopCh chan struct{}
+	// killCh is closed when a graceful stop did not complete in time and the
+	// remaining RPCs must be terminated.
+	killCh chan struct{}
+	// killOnce ensures that killCh is closed only once.
+	killOnce sync.Once
+
+	// rpcs tracks the RPCs that are being handled by the server.
+	rpcs sync.WaitGroup
+
+	// ackMu protects acks.
+	ackMu sync.Mutex
+	// acks stores the number of FIB_PROGRAMMED results that are outstanding
+	// for each client, keyed by client ID, such that a Modify stream is not
+	// closed during a graceful stop before they have been sent.
+	acks map[string]int
+
+	// ready indicates that the server has finished initialising its network
+	// instances, and has not begun stopping.
+	ready atomic.Bool
+}
+
+// init creates the channels within the shutdownState if they have not
+// already been created. It must be called before the channels are used.
+func (st *shutdownState) init() {
+	st.initOnce.Do(func() {
+		st.stopCh = make(chan struct{})
+		st.killCh = make(chan struct{})
+	})
+}
+
+// Drain causes the server to stop processing AFT operations. Streams that are
+// open are not closed, but each operation that is subsequently received is
+// responded to with a FAILED result whose error message is DrainingErrorMessage,
+// such that clients can fail over to another server. Flush requests are rejected
+// whilst the server is draining, Get requests continue to be served.
+func (s *Server) Drain() {
+	s.shutdown.mu.Lock()
+	defer s.shutdown.mu.Unlock()
+	s.shutdown.draining = true
+}
+
+// GracefulStop stops the server gracefully. New Modify, Get and Flush RPCs are
+// rejected, and operations that are subsequently received on existing Modify
+// streams are not processed, as per Drain. Operations that have already been
+// received are completed and their results are sent to the client - including
+// FIB_PROGRAMMED results that are awaiting the completion of an event handed to
+// the function specified by WithRIBEventHook - after which each Modify stream is
+// closed with an Unavailable status once it has been idle for a short interval.
+// If ctx expires before all RPCs have completed, the remaining RPCs are
+// terminated and the error from ctx is returned.
+//
+// If the server was created with WithCheckpointFile, a final checkpoint is written
+// once all RPCs have completed, and any error writing it is returned. Similarly,
+// if it was created with WithPersistence, the entries of each network instance
+// are stored using the persistence backend.
+//
+// The server does not own the listener that it is served on, callers should
+// stop the gRPC server once GracefulStop has returned.
+func (s *Server) GracefulStop(ctx context.Context) error {
+	s.shutdown.init()
+	s.shutdown.mu.Lock()
+	if !s.shutdown.stopping {
+		s.shutdown.stopping = true
+		close(s.shutdown.stopCh)
+	}
+	s.shutdown.mu.Unlock()
+	s.shutdown.ready.Store(false)
+
+	done := make(chan struct{})
+	go func() {
+		s.shutdown.rpcs.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.persist(s.masterRIB.KnownNetworkInstances())
+		if s.checkpoint != nil {
+			return s.Checkpoint()
+		}
+		return nil
+	case <-ctx.Done():
+		s.shutdown.killOnce.Do(func() { close(s.shutdown.killCh) })
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Stop stops the server as per GracefulStop, and subsequently releases the
+// goroutines that the server runs in the background, such as that which hands
+// events to the function specified by WithRIBEventHook. Events that have not
+// been handed to the function when Stop returns are discarded. The server
+// cannot be used once it has been stopped.
+//
+// As per GracefulStop, the server does not own the listener that it is served
+// on, callers should stop the gRPC server once Stop has returned.
+func (s *Server) Stop(ctx context.Context) error {
+	err := s.GracefulStop(ctx)
+	if s.events != nil {
+		s.events.stop()
+	}
+	return err
+}
+
+// Ready returns true if the server has finished initialising its network
+// instances - including restoring them from a checkpoint - such that it can
+// serve RPCs. It returns false once the server has begun stopping.
+func (s *Server) Ready() bool {
+	return s.shutdown.ready.Load()
+}
+
+// startRPC records that the server is handling a new RPC. It returns an error
+// that should be returned to the client if the server is stopping. If no error
+// is returned, endRPC must be called when the RPC completes.
+func (s *Server) startRPC() error {
+	s.shutdown.init()
+	s.shutdown.mu.RLock()
+	defer s.shutdown.mu.RUnlock()
+	if s.shutdown.stopping {
+		return status.Errorf(codes.Unavailable, "server is shutting down")
+	}
+	s.shutdown.rpcs.Add(1)
+	return nil
+}
+
+// endRPC records that an RPC started with startRPC has completed.
+func (s *Server) endRPC() {
+	s.shutdown.rpcs.Done()
+}
+
+// isDraining returns true if the server should not process AFT operations.
+func (s *Server) isDraining() bool {
+	s.shutdown.mu.RLock()
+	defer s.shutdown.mu.RUnlock()
+	return s.shutdown.draining || s.shutdown.stopping
+}
+
+// startAck records that a FIB_PROGRAMMED result is outstanding for the client
+// with ID cid. endAck must be called once the result has been sent.
+func (s *Server) startAck(cid string) {
+	s.shutdown.ackMu.Lock()
+	defer s.shutdown.ackMu.Unlock()
+	if s.shutdown.acks == nil {
+		s.shutdown.acks = map[string]int{}
+	}
+	s.shutdown.acks[cid]++
+}
+
+// endAck records that an outstanding FIB_PROGRAMMED result for the client with
+// ID cid has been sent.
+func (s *Server) endAck(cid string) {
+	s.shutdown.ackMu.Lock()
+	defer s.shutdown.ackMu.Unlock()
+	if s.shutdown.acks[cid]--; s.shutdown.acks[cid] <= 0 {
+		delete(s.shutdown.acks, cid)
+	}
+}
+
+// hasPendingAcks returns true if there are FIB_PROGRAMMED results outstanding
+// for the client with ID cid.
+func (s *Server) hasPendingAcks(cid string) bool {
+	s.shutdown.ackMu.Lock()
+	defer s.shutdown.ackMu.Unlock()
+	return s.shutdown.acks[cid] > 0
+}
+
+// drainedResults returns a ModifyResponse that responds to each operation in
+// ops with a FAILED result, indicating that it was not processed because the
+// server is draining.
+func drainedResults(ops []*spb.AFTOperation) *spb.ModifyResponse {
+	res := &spb.ModifyResponse{}
+	for _, o := range ops {
+		res.Result = append(res.Result, &spb.AFTResult{
+			Id:     o.GetId(),
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: DrainingErrorMessage,
+			},
+		})
+	}
+	return res
+}
+
+// streamActivity tracks whether a Modify stream is processing a message such
+// that it can be closed when idle during a graceful stop.
+type streamActivity struct {
+	// mu protects the fields of streamActivity.
+	mu sync.Mutex
+	// busy indicates that a message has been received and is being processed.
+	busy bool
+	// last is the time at which the last message was received.
+	last time.Time
+	// closed indicates that the stream has been closed, and no further messages
+	// should be processed.
+	closed bool
+}
+
+// begin records that a message has been received on the stream. It returns
+// false if the stream has been closed and the message should not be processed.
+func (a *streamActivity) begin() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return false
+	}
+	a.busy = true
+	a.last = time.Now()
+	return true
+}
+
+// end records that the message received on the stream has been processed.
+func (a *streamActivity) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.busy = false
+}
+
+// closeIfIdle closes the stream if it is not processing a message and has not
+// received a message for at least d. It returns true if the stream was closed.
+func (a *streamActivity) closeIfIdle(d time.Duration) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.busy || time.Since(a.last) < d {
+		return false
+	}
+	a.closed = true
+	return true
+}
+
+// awaitModify waits for the Modify stream of the client with ID cid, whose
+// activity is tracked by act, to complete. It returns the error written to
+// errCh, or an Unavailable error if the stream is closed because the server is
+// stopping. sendDone is closed when the goroutine sending results to the client
+// has exited after resultDone has been closed.
+func (s *Server) awaitModify(cid string, act *streamActivity, errCh chan error, resultDone, sendDone chan struct{}) error {
+	select {
+	case err := <-errCh:
+		close(resultDone)
+		return err
+	case <-s.shutdown.stopCh:
+	}
+
+	t := time.NewTicker(shutdownIdleInterval / 5)
+	defer t.Stop()
+	for {
+		select {
+		case err := <-errCh:
+			close(resultDone)
+			return err
+		case <-s.shutdown.killCh:
+			close(resultDone)
+			return status.Errorf(codes.Unavailable, "server stopped")
+		case <-t.C:
+			// The stream is not closed whilst results are outstanding for
+			// operations that were installed in the RIB, since these are sent
+			// once the RIB event hook completes.
+			if s.hasPendingAcks(cid) || !act.closeIfIdle(shutdownIdleInterval) {
+				continue
+			}
+			// Ensure that all results that were handed to the sending goroutine
+			// have been written to the client before the stream is closed.
+			close(resultDone)
+			select {
+			case <-sendDone:
+			case err := <-errCh:
+				return err
+			}
+			return status.Errorf(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/rib"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestDrain(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc := startModify(ctx, t, s)
+	if err := mc.Send(nhAddRequest(1)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	res, err := mc.Recv()
+	if err != nil {
+		t.Fatalf("did not get response to operation, %v", err)
+	}
+	checkProgrammed(t, res)
+
+	s.Drain()
+
+	// The stream remains open, but operations are not processed.
+	for _, id := range []uint64{2, 3} {
+		if err := mc.Send(nhAddRequest(id)); err != nil {
+			t.Fatalf("cannot send operation %d, %v", id, err)
+		}
+		res, err := mc.Recv()
+		if err != nil {
+			t.Fatalf("did not get response to operation %d, %v", id, err)
+		}
+		if len(res.GetResult()) != 1 {
+			t.Fatalf("did not get expected number of results, got: %s", res)
+		}
+		r := res.GetResult()[0]
+		if r.GetId() != id || r.GetStatus() != spb.AFTResult_FAILED || r.GetErrorDetails().GetErrorMessage() != DrainingErrorMessage {
+			t.Fatalf("did not get expected result for operation %d while draining, got: %s", id, r)
+		}
+	}
+
+	niR, ok := s.masterRIB.NetworkInstanceRIB(DefaultNetworkInstanceName)
+	if !ok {
+		t.Fatalf("cannot find default network instance")
+	}
+	if _, ok := niR.GetNextHop(2); ok {
+		t.Errorf("next-hop was installed in the RIB while the server was draining")
+	}
+
+	gc, err := spb.NewGRIBIClient(s.Conn()).Get(ctx, &spb.GetRequest{
+		NetworkInstance: &spb.GetRequest_All{All: &spb.Empty{}},
+		Aft:             spb.AFTType_ALL,
+	})
+	if err != nil {
+		t.Fatalf("cannot start Get RPC, %v", err)
+	}
+	if _, err := gc.Recv(); err != nil {
+		t.Errorf("did not get response to Get while draining, %v", err)
+	}
+
+	if _, err := spb.NewGRIBIClient(s.Conn()).Flush(ctx, &spb.FlushRequest{
+		NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+	}); status.Code(err) != codes.Unavailable {
+		t.Errorf("did not get expected error from Flush while draining, got: %v, want code: %s", err, codes.Unavailable)
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc := startModify(ctx, t, s)
+	if err := mc.Send(nhAddRequest(1)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	res, err := mc.Recv()
+	if err != nil {
+		t.Fatalf("did not get response to operation, %v", err)
+	}
+	checkProgrammed(t, res)
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stopCancel()
+	stopErr := make(chan error)
+	go func() { stopErr <- s.Server.GracefulStop(stopCtx) }()
+
+	for !s.isDraining() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// New RPCs are rejected.
+	nc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+	if err != nil {
+		t.Fatalf("cannot open Modify RPC, %v", err)
+	}
+	if _, err := nc.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("did not get expected error for new Modify RPC, got: %v, want code: %s", err, codes.Unavailable)
+	}
+
+	// The existing stream is closed once it is idle.
+	if _, err := mc.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("did not get expected error on existing Modify RPC, got: %v, want code: %s", err, codes.Unavailable)
+	}
+
+	if err := <-stopErr; err != nil {
+		t.Fatalf("did not get expected error from GracefulStop, got: %v, want: nil", err)
+	}
+}
+
+func TestGracefulStopTimeout(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc := startModify(ctx, t, s)
+
+	stopCtx, stopCancel := context.WithCancel(context.Background())
+	stopCancel()
+	if err := s.Server.GracefulStop(stopCtx); err != context.Canceled {
+		t.Fatalf("did not get expected error from GracefulStop, got: %v, want: %v", err, context.Canceled)
+	}
+
+	if _, err := mc.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("did not get expected error on Modify RPC after hard stop, got: %v, want code: %s", err, codes.Unavailable)
+	}
+}
+
+func TestStop(t *testing.T) {
+	// The hook completes each event after the interval for which a stream must be
+	// idle before it is closed, such that the FIB_PROGRAMMED result is in-flight
+	// when the server is stopped.
+	hook := func(e rib.RIBEvent) error {
+		go func() {
+			time.Sleep(2 * shutdownIdleInterval)
+			e.Done(nil)
+		}()
+		return nil
+	}
+	s, err := NewInProcess(WithRIBEventHook(hook))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	if !s.Ready() {
+		t.Fatalf("server is not ready after it was created")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+	if err != nil {
+		t.Fatalf("cannot open Modify RPC, %v", err)
+	}
+	for _, req := range []*spb.ModifyRequest{{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+			AckType:     spb.SessionParameters_RIB_AND_FIB_ACK,
+		},
+	}, {
+		ElectionId: &spb.Uint128{Low: 1},
+	}} {
+		if err := mc.Send(req); err != nil {
+			t.Fatalf("cannot send %s, %v", req, err)
+		}
+		if _, err := mc.Recv(); err != nil {
+			t.Fatalf("did not get response to %s, %v", req, err)
+		}
+	}
+
+	if err := mc.Send(nhAddRequest(1)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	res, err := mc.Recv()
+	if err != nil {
+		t.Fatalf("did not get response to operation, %v", err)
+	}
+	checkProgrammed(t, res)
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stopCancel()
+	stopErr := make(chan error)
+	go func() { stopErr <- s.Server.Stop(stopCtx) }()
+
+	// The in-flight FIB_PROGRAMMED result is delivered before the stream is
+	// closed.
+	res, err = mc.Recv()
+	if err != nil {
+		t.Fatalf("did not get FIB_PROGRAMMED result before the stream was closed, %v", err)
+	}
+	if len(res.GetResult()) != 1 || res.GetResult()[0].GetStatus() != spb.AFTResult_FIB_PROGRAMMED {
+		t.Fatalf("did not get expected FIB_PROGRAMMED result, got: %s", res)
+	}
+	if _, err := mc.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("did not get expected error on Modify RPC, got: %v, want code: %s", err, codes.Unavailable)
+	}
+
+	if err := <-stopErr; err != nil {
+		t.Fatalf("did not get expected error from Stop, got: %v, want: nil", err)
+	}
+	if s.Ready() {
+		t.Errorf("server is ready after it was stopped")
+	}
+
+	// New RPCs are rejected, and once the gRPC server is stopped, subsequent
+	// dials fail.
+	if _, err := spb.NewGRIBIClient(s.Conn()).Flush(ctx, &spb.FlushRequest{
+		NetworkInstance: &spb.FlushRequest_All{All: &spb.Empty{}},
+	}); status.Code(err) != codes.Unavailable {
+		t.Errorf("did not get expected error from Flush after stop, got: %v, want code: %s", err, codes.Unavailable)
+	}
+	if err := s.Stop(); err != nil {
+		t.Fatalf("cannot stop in-process server, %v", err)
+	}
+	if _, err := s.lis.DialContext(ctx); err == nil {
+		t.Errorf("dial to stopped server succeeded, want error")
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/openconfig/gribigo/constants"
+	"go.uber.org/atomic"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// statsAFTs is the set of AFTs for which statistics are maintained, in the order
+// in which they are reported.
+var statsAFTs = []constants.AFT{
+	constants.IPv4,
+	constants.IPv6,
+	constants.MPLS,
+	constants.NextHopGroup,
+	constants.NextHop,
+	constants.PolicyForwarding,
+}
+
+// OperationStats is a snapshot of the counters for AFT operations that have been
+// handled by the server.
+type OperationStats struct {
+	// Received is the number of AFT operations that have been received.
+	Received uint64
+	// Accepted is the number of AFT operations for which a RIB_PROGRAMMED result
+	// has been sent.
+	Accepted uint64
+	// NACKed is the number of AFT operations for which a FAILED result has been
+	// sent.
+	NACKed uint64
+}
+
+// Stats is a snapshot of the statistics of the server.
+type Stats struct {
+	// Operations contains the counters for AFT operations received from all
+	// clients.
+	Operations OperationStats
+	// AFT contains the counters for AFT operations, keyed by the AFT that the
+	// operation refers to.
+	AFT map[constants.AFT]OperationStats
+	// Client contains the counters for AFT operations, keyed by the ID of each
+	// client that is currently connected to the server.
+	Client map[string]OperationStats
+	// GetRequests is the number of Get RPCs that have been received.
+	GetRequests uint64
+	// FlushRequests is the number of Flush RPCs that have been received.
+	FlushRequests uint64
+	// RIBSize is the number of entries that are installed in the RIB, keyed by
+	// network instance name, and subsequently by AFT.
+	RIBSize map[string]map[constants.AFT]uint64
+	// EntryLimits is the maximum number of entries that can be installed within
+	// each network instance, keyed by AFT. AFTs that are not limited are not
+	// present, and it is nil if no AFT is limited.
+	EntryLimits map[constants.AFT]uint64
+}
+
+// opCounters stores the counters for a set of AFT operations.
+type opCounters struct {
+	received, accepted, nacked atomic.Uint64
+}
+
+// snapshot returns the current values of the counters in o.
+func (o *opCounters) snapshot() OperationStats {
+	return OperationStats{
+		Received: o.received.Load(),
+		Accepted: o.accepted.Load(),
+		NACKed:   o.nacked.Load(),
+	}
+}
+
+// reset sets all counters in o to zero.
+func (o *opCounters) reset() {
+	o.received.Store(0)
+	o.accepted.Store(0)
+	o.nacked.Store(0)
+}
+
+// serverStats stores the counters that are maintained by the server. The methods
+// that update the counters are no-ops for a nil serverStats.
+type serverStats struct {
+	// total counts operations from all clients and for all AFTs.
+	total opCounters
+	// aft counts operations for each AFT.
+	aft map[constants.AFT]*opCounters
+
+	// gets and flushes count the Get and Flush RPCs received.
+	gets, flushes atomic.Uint64
+
+	// mu protects the client and opAFT maps.
+	mu sync.RWMutex
+	// client counts operations for each connected client, keyed by client ID.
+	client map[string]*opCounters
+	// opAFT stores the AFT of each operation for which no RIB_PROGRAMMED or
+	// FAILED result has been sent, such that the result can be counted against
+	// the AFT.
+	opAFT map[pendingKey]constants.AFT
+}
+
+// newServerStats returns a serverStats with all counters initialised to zero.
+func newServerStats() *serverStats {
+	st := &serverStats{
+		aft:    map[constants.AFT]*opCounters{},
+		client: map[string]*opCounters{},
+		opAFT:  map[pendingKey]constants.AFT{},
+	}
+	for _, a := range statsAFTs {
+		st.aft[a] = &opCounters{}
+	}
+	return st
+}
+
+// addClient creates counters for the client with ID cid.
+func (st *serverStats) addClient(cid string) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.client[cid] = &opCounters{}
+}
+
+// deleteClient removes the counters for the client with ID cid.
+func (st *serverStats) deleteClient(cid string) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.client, cid)
+	for k := range st.opAFT {
+		if k.client == cid {
+			delete(st.opAFT, k)
+		}
+	}
+}
+
+// received counts the operations in ops as having been received from the
+// client with ID cid.
+func (st *serverStats) received(cid string, ops []*spb.AFTOperation) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, o := range ops {
+		st.total.received.Inc()
+		if c := st.client[cid]; c != nil {
+			c.received.Inc()
+		}
+		k, ok := opEntryKey("", o)
+		if !ok {
+			continue
+		}
+		st.aft[k.aft].received.Inc()
+		st.opAFT[pendingKey{client: cid, id: o.GetId()}] = k.aft
+	}
+}
+
+// results counts the AFT results within res that were sent to the client with
+// ID cid.
+func (st *serverStats) results(cid string, res *spb.ModifyResponse) {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, r := range res.GetResult() {
+		var inc func(*opCounters)
+		switch r.GetStatus() {
+		case spb.AFTResult_RIB_PROGRAMMED:
+			inc = func(o *opCounters) { o.accepted.Inc() }
+		case spb.AFTResult_FAILED:
+			inc = func(o *opCounters) { o.nacked.Inc() }
+		default:
+			continue
+		}
+		inc(&st.total)
+		if c := st.client[cid]; c != nil {
+			inc(c)
+		}
+		k := pendingKey{client: cid, id: r.GetId()}
+		if a, ok := st.opAFT[k]; ok {
+			inc(st.aft[a])
+			delete(st.opAFT, k)
+		}
+	}
+}
+
+// countGet counts a Get RPC as having been received.
+func (st *serverStats) countGet() {
+	if st == nil {
+		return
+	}
+	st.gets.Inc()
+}
+
+// countFlush counts a Flush RPC as having been received.
+func (st *serverStats) countFlush() {
+	if st == nil {
+		return
+	}
+	st.flushes.Inc()
+}
+
+// reset sets all counters to zero.
+func (st *serverStats) reset() {
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.total.reset()
+	for _, c := range st.aft {
+		c.reset()
+	}
+	for _, c := range st.client {
+		c.reset()
+	}
+	st.gets.Store(0)
+	st.flushes.Store(0)
+}
+
+// Stats returns a snapshot of the statistics of the server.
+func (s *Server) Stats() *Stats {
+	st := &Stats{
+		AFT:     map[constants.AFT]OperationStats{},
+		Client:  map[string]OperationStats{},
+		RIBSize: map[string]map[constants.AFT]uint64{},
+
+		EntryLimits: s.limits.all(),
+	}
+
+	if s.stats != nil {
+		st.GetRequests = s.stats.gets.Load()
+		st.FlushRequests = s.stats.flushes.Load()
+		s.stats.mu.RLock()
+		st.Operations = s.stats.total.snapshot()
+		for a, c := range s.stats.aft {
+			st.AFT[a] = c.snapshot()
+		}
+		for id, c := range s.stats.client {
+			st.Client[id] = c.snapshot()
+		}
+		s.stats.mu.RUnlock()
+	}
+
+	for _, ni := range s.masterRIB.KnownNetworkInstances() {
+		if r, ok := s.masterRIB.NetworkInstanceRIB(ni); ok {
+			st.RIBSize[ni] = r.EntryCounts()
+		}
+	}
+	return st
+}
+
+// ResetStats sets all the operation and RPC counters of the server to zero. The
+// RIB size is not affected, since it reflects the current contents of the RIB.
+func (s *Server) ResetStats() {
+	s.stats.reset()
+}
+
+// WithMetricsHandler specifies that the server should provide an http.Handler,
+// retrieved using MetricsHandler, that exposes the statistics of the server in
+// the Prometheus text exposition format, such that it can be mounted by the
+// binary embedding the server.
+func WithMetricsHandler() *metricsHandler { return &metricsHandler{} }
+
+// metricsHandler is the internal implementation of the WithMetricsHandler option.
+type metricsHandler struct{}
+
+// isServerOpt implements the ServerOpt interface.
+func (*metricsHandler) isServerOpt() {}
+
+// hasMetricsHandler checks whether the ServerOpt slice supplied contains the
+// WithMetricsHandler option.
+func hasMetricsHandler(opt []ServerOpt) bool {
+	for _, o := range opt {
+		if _, ok := o.(*metricsHandler); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MetricsHandler returns an http.Handler that exposes the statistics of the
+// server in the Prometheus text exposition format. It returns nil if the server
+// was not created with the WithMetricsHandler option.
+func (s *Server) MetricsHandler() http.Handler {
+	if !s.metricsHandler {
+		return nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(formatMetrics(s.Stats()))
+	})
+}
+
+// formatMetrics renders st in the Prometheus text exposition format.
+func formatMetrics(st *Stats) []byte {
+	buf := &bytes.Buffer{}
+	header := func(name, typ, help string) {
+		buf.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ))
+	}
+
+	clients := []string{}
+	for id := range st.Client {
+		clients = append(clients, id)
+	}
+	sort.Strings(clients)
+
+	for _, m := range []struct {
+		name string
+		help string
+		fn   func(OperationStats) uint64
+	}{
+		{"gribi_operations_received_total", "Number of AFT operations received.", func(o OperationStats) uint64 { return o.Received }},
+		{"gribi_operations_accepted_total", "Number of AFT operations programmed in the RIB.", func(o OperationStats) uint64 { return o.Accepted }},
+		{"gribi_operations_nacked_total", "Number of AFT operations that failed.", func(o OperationStats) uint64 { return o.NACKed }},
+	} {
+		header(m.name, "counter", m.help)
+		buf.WriteString(fmt.Sprintf("%s %d\n", m.name, m.fn(st.Operations)))
+		for _, a := range statsAFTs {
+			buf.WriteString(fmt.Sprintf("%s{aft=%q} %d\n", m.name, a, m.fn(st.AFT[a])))
+		}
+		for _, id := range clients {
+			buf.WriteString(fmt.Sprintf("%s{client=%q} %d\n", m.name, id, m.fn(st.Client[id])))
+		}
+	}
+
+	header("gribi_get_requests_total", "counter", "Number of Get RPCs received.")
+	buf.WriteString(fmt.Sprintf("gribi_get_requests_total %d\n", st.GetRequests))
+	header("gribi_flush_requests_total", "counter", "Number of Flush RPCs received.")
+	buf.WriteString(fmt.Sprintf("gribi_flush_requests_total %d\n", st.FlushRequests))
+
+	nis := []string{}
+	for ni := range st.RIBSize {
+		nis = append(nis, ni)
+	}
+	sort.Strings(nis)
+	header("gribi_rib_entries", "gauge", "Number of entries installed in the RIB.")
+	for _, ni := range nis {
+		for _, a := range statsAFTs {
+			buf.WriteString(fmt.Sprintf("gribi_rib_entries{network_instance=%q,aft=%q} %d\n", ni, a, st.RIBSize[ni][a]))
+		}
+	}
+	return buf.Bytes()
+}
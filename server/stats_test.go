@@ -0,0 +1,135 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/openconfig/gribigo/constants"
+	"github.com/openconfig/gribigo/fluent"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestStats(t *testing.T) {
+	s, err := NewInProcess(WithMetricsHandler())
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	c := fluent.NewClient()
+	c.Connection().WithStub(spb.NewGRIBIClient(s.Conn())).WithRedundancyMode(fluent.ElectedPrimaryClient).WithInitialElectionID(1, 0).WithPersistence()
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	c.StartSending(context.Background(), t)
+
+	def := DefaultNetworkInstanceName
+	c.Modify().AddEntry(t,
+		fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(1).WithIPAddress("192.0.2.1"),
+		fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(2).WithIPAddress("192.0.2.2"),
+		fluent.NextHopGroupEntry().WithNetworkInstance(def).WithID(1).AddNextHop(1, 1),
+		fluent.IPv4Entry().WithNetworkInstance(def).WithPrefix("1.1.1.1/32").WithNextHopGroup(1),
+		// A next-hop referencing an unknown network instance cannot be installed.
+		fluent.NextHopEntry().WithNetworkInstance(def).WithIndex(3).WithNextHopNetworkInstance("FISH"),
+		// An entry within an unknown network instance is rejected.
+		fluent.IPv4Entry().WithNetworkInstance("FISH").WithPrefix("2.2.2.2/32").WithNextHopGroup(1),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Await(ctx, t); err != nil {
+		t.Fatalf("got unexpected error from client, %v", err)
+	}
+	if _, err := c.Get().WithNetworkInstance(def).WithAFT(fluent.AllAFTs).Send(); err != nil {
+		t.Fatalf("cannot send Get, %v", err)
+	}
+
+	got := s.Stats()
+	if len(got.Client) != 1 {
+		t.Fatalf("did not get expected number of clients, got: %d (%v), want: 1", len(got.Client), got.Client)
+	}
+	wantOps := OperationStats{Received: 6, Accepted: 4, NACKed: 2}
+	for id, st := range got.Client {
+		if diff := cmp.Diff(st, wantOps); diff != "" {
+			t.Errorf("did not get expected statistics for client %s, diff(-got,+want):\n%s", id, diff)
+		}
+	}
+	got.Client = nil
+
+	want := &Stats{
+		Operations: wantOps,
+		AFT: map[constants.AFT]OperationStats{
+			constants.IPv4:             {Received: 2, Accepted: 1, NACKed: 1},
+			constants.IPv6:             {},
+			constants.MPLS:             {},
+			constants.NextHopGroup:     {Received: 1, Accepted: 1},
+			constants.NextHop:          {Received: 3, Accepted: 2, NACKed: 1},
+			constants.PolicyForwarding: {},
+		},
+		GetRequests: 1,
+		RIBSize: map[string]map[constants.AFT]uint64{
+			def: {constants.IPv4: 1, constants.IPv6: 0, constants.MPLS: 0, constants.NextHopGroup: 1, constants.NextHop: 2, constants.PolicyForwarding: 0},
+		},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Fatalf("did not get expected statistics, diff(-got,+want):\n%s", diff)
+	}
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatalf("cannot read metrics, %v", err)
+	}
+	for _, l := range []string{
+		"# TYPE gribi_operations_received_total counter",
+		"gribi_operations_received_total 6",
+		`gribi_operations_accepted_total{aft="NextHop"} 2`,
+		`gribi_operations_nacked_total{aft="IPv4"} 1`,
+		"gribi_get_requests_total 1",
+		"gribi_flush_requests_total 0",
+		`gribi_rib_entries{network_instance="DEFAULT",aft="NextHopGroup"} 1`,
+	} {
+		if !strings.Contains(string(body), l+"\n") {
+			t.Errorf("metrics did not contain %q, got:\n%s", l, body)
+		}
+	}
+
+	s.ResetStats()
+	got = s.Stats()
+	if got.Operations != (OperationStats{}) || got.GetRequests != 0 || got.AFT[constants.NextHop] != (OperationStats{}) {
+		t.Errorf("did not get zero counters after reset, got: %+v", got)
+	}
+	if diff := cmp.Diff(got.RIBSize, want.RIBSize); diff != "" {
+		t.Errorf("did not get expected RIB size after reset, diff(-got,+want):\n%s", diff)
+	}
+}
+
+func TestMetricsHandlerNotEnabled(t *testing.T) {
+	s, err := New()
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	if h := s.MetricsHandler(); h != nil {
+		t.Fatalf("did not get nil handler when metrics are not enabled, got: %v", h)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	log "github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// WithMultipleModifyPerConnection specifies that the server accepts multiple
+// Modify RPCs at the same time from a single client connection, treating each
+// as an independent session. By default, the server accepts only a single Modify
+// RPC at a time from each connection, and a Modify RPC that is opened whilst
+// another Modify RPC from the same connection is active is rejected with the
+// FAILED_PRECONDITION code, such that a client cannot create a second session on
+// the same channel.
+//
+// This option is required by clients that run multiple sessions over a single
+// connection, such as the fluent ConnectionPool.
+func WithMultipleModifyPerConnection() *multipleModifyPerConnection {
+	return &multipleModifyPerConnection{}
+}
+
+// multipleModifyPerConnection is the internal implementation of
+// WithMultipleModifyPerConnection.
+type multipleModifyPerConnection struct{}
+
+// isServerOpt implements the ServerOpt interface.
+func (*multipleModifyPerConnection) isServerOpt() {}
+
+// hasMultipleModifyPerConnection checks whether the ServerOpt slice supplied
+// contains the multipleModifyPerConnection option.
+func hasMultipleModifyPerConnection(opt []ServerOpt) bool {
+	for _, o := range opt {
+		if _, ok := o.(*multipleModifyPerConnection); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// modifyStreamState stores the connections that have an active Modify RPC when
+// the server accepts a single Modify RPC per connection.
+type modifyStreamState struct {
+	// single indicates that only a single Modify RPC is accepted from each
+	// connection.
+	single bool
+	// mu protects conns.
+	mu sync.Mutex
+	// conns is the set of connections that have an active Modify RPC. Since
+	// gRPC stores the same peer for all RPCs on a transport connection, the
+	// peer identifies the connection - the address of the peer is insufficient
+	// since it is not unique for in-memory connections.
+	conns map[*peer.Peer]bool
+}
+
+// startModifyStream records that a Modify RPC has been opened with the context
+// ctx. It returns an error with the FAILED_PRECONDITION code if the server accepts
+// a single Modify RPC per connection and the connection of ctx already has an
+// active Modify RPC. The returned function must be called when the RPC ends.
+func (s *Server) startModifyStream(ctx context.Context) (func(), error) {
+	m := &s.modifyStreams
+	if !m.single {
+		return func() {}, nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		log.Warningf("cannot determine the connection of a Modify RPC, allowing it")
+		return func() {}, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns[p] {
+		return nil, status.Errorf(codes.FailedPrecondition, "a Modify RPC is already active on the connection from %s", p.Addr)
+	}
+	if m.conns == nil {
+		m.conns = map[*peer.Peer]bool{}
+	}
+	m.conns[p] = true
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.conns, p)
+	}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestSingleModifyPerConnection(t *testing.T) {
+	params := &spb.ModifyRequest{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+		},
+	}
+
+	tests := []struct {
+		desc     string
+		opt      []ServerOpt
+		wantCode codes.Code
+	}{{
+		desc:     "second stream is rejected by default",
+		wantCode: codes.FailedPrecondition,
+	}, {
+		desc:     "second stream is an independent session",
+		opt:      []ServerOpt{WithMultipleModifyPerConnection()},
+		wantCode: codes.OK,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := NewInProcess(tt.opt...)
+			if err != nil {
+				t.Fatalf("cannot start in-process server, %v", err)
+			}
+			defer s.Stop()
+			stub := spb.NewGRIBIClient(s.Conn())
+
+			// open opens a Modify RPC and sends the session parameters on it,
+			// returning the status of the response.
+			open := func(ctx context.Context) codes.Code {
+				t.Helper()
+				mc, err := stub.Modify(ctx)
+				if err != nil {
+					t.Fatalf("cannot open Modify RPC, %v", err)
+				}
+				if err := mc.Send(params); err != nil {
+					return status.Code(err)
+				}
+				_, err = mc.Recv()
+				return status.Code(err)
+			}
+
+			firstCtx, cancelFirst := context.WithCancel(context.Background())
+			defer cancelFirst()
+			if got := open(firstCtx); got != codes.OK {
+				t.Fatalf("first Modify RPC: did not get expected code, got: %s, want: %s", got, codes.OK)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if got := open(ctx); got != tt.wantCode {
+				t.Fatalf("second Modify RPC: did not get expected code, got: %s, want: %s", got, tt.wantCode)
+			}
+			cancel()
+
+			// Once the first Modify RPC has ended, a new one is accepted.
+			cancelFirst()
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				ctx, cancel := context.WithCancel(context.Background())
+				got := open(ctx)
+				cancel()
+				if got == codes.OK {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Modify RPC was not accepted after the first RPC ended, got: %s", got)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestSingleModifyPerConnectionSeparateConnections(t *testing.T) {
+	s, err := NewInProcess()
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	// All connections to the in-process server have the same peer address, but
+	// are separate connections, such that each may have an active Modify RPC.
+	conn, err := grpc.DialContext(context.Background(), "bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return s.lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("cannot dial in-process server, %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i, c := range []*grpc.ClientConn{s.Conn(), conn} {
+		mc, err := spb.NewGRIBIClient(c).Modify(ctx)
+		if err != nil {
+			t.Fatalf("connection %d: cannot open Modify RPC, %v", i, err)
+		}
+		if err := mc.Send(&spb.ModifyRequest{
+			Params: &spb.SessionParameters{
+				Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+				Persistence: spb.SessionParameters_PRESERVE,
+			},
+		}); err != nil {
+			t.Fatalf("connection %d: cannot send session parameters, %v", i, err)
+		}
+		if _, err := mc.Recv(); err != nil {
+			t.Fatalf("connection %d: did not get expected response, got err: %v", i, err)
+		}
+	}
+}
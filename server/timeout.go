@@ -0,0 +1,171 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/golang/glog"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// WithOperationTimeout specifies the maximum time for which an operation that has
+// been installed in the RIB may wait for its FIB_PROGRAMMED result - for example,
+// because the function specified by WithRIBEventHook has stalled. If the result is
+// not sent within the timeout, the operation is returned to the client as failed
+// with an error message beginning with TIMEOUT, and any result that is
+// subsequently generated for it is discarded. Operations are only tracked when the
+// client requested FIB acknowledgements and a RIB event hook is specified, since
+// all other results are sent as the operation is processed.
+func WithOperationTimeout(d time.Duration) *operationTimeout {
+	return &operationTimeout{d: d}
+}
+
+// operationTimeout is the internal implementation of WithOperationTimeout.
+type operationTimeout struct {
+	d time.Duration
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*operationTimeout) isServerOpt() {}
+
+// hasOperationTimeout returns the timeout specified by the WithOperationTimeout
+// option in the ServerOpt slice supplied, or zero if it is not present.
+func hasOperationTimeout(opt []ServerOpt) time.Duration {
+	for _, o := range opt {
+		if v, ok := o.(*operationTimeout); ok {
+			return v.d
+		}
+	}
+	return 0
+}
+
+// inflightOp is an operation that is awaiting its result.
+type inflightOp struct {
+	// deadline is the time by which the result must be sent.
+	deadline time.Time
+	// abandon abandons the RIB event for the operation, completing it with
+	// the error supplied.
+	abandon func(error)
+}
+
+// trackOperation records that the operation identified by k is awaiting its
+// result, such that it is returned as failed if the result is not sent before
+// the operation timeout. The RIB event for the operation is queued by calling
+// enqueue, which returns the function that abandons the event. It is called
+// whilst the operation is being tracked, such that the result of the event is
+// not discarded if it completes immediately, and the operation cannot time out
+// before the event can be abandoned.
+func (s *Server) trackOperation(k pendingKey, enqueue func() func(error)) {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	op := &inflightOp{deadline: s.clock().Add(s.opTimeout)}
+	s.inflight[k] = op
+	op.abandon = enqueue()
+}
+
+// completeOperation records that the result for the operation identified by k is
+// to be sent. It returns false if the operation has already timed out, in which
+// case the result must not be sent.
+func (s *Server) completeOperation(k pendingKey) bool {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	if _, ok := s.inflight[k]; !ok {
+		log.Warningf("discarding result for operation %d from client %s since it timed out", k.id, k.client)
+		return false
+	}
+	delete(s.inflight, k)
+	return true
+}
+
+// expireOperations periodically checks the operations that are awaiting their
+// result on behalf of the client with ID cid, writing failed results to resCh for
+// those whose deadline has passed. The RIB events for such operations are then
+// abandoned, such that they release the resources that they hold - and the
+// client's stream is not held open awaiting their results. It returns when doneCh
+// is closed.
+func (s *Server) expireOperations(cid string, resCh chan *spb.ModifyResponse, doneCh chan struct{}) {
+	ticker := time.NewTicker(pendingCheckInterval(s.opTimeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-doneCh:
+			return
+		case <-ticker.C:
+			res, expired := s.timedOutResults(cid, s.clock())
+			if res == nil {
+				continue
+			}
+			s.traceResults(cid, res)
+			select {
+			case resCh <- res:
+			case <-doneCh:
+			}
+			// The events are abandoned once the failed results have been handed
+			// to the sending goroutine, such that the stream is not closed before
+			// they are sent.
+			for _, op := range expired {
+				op.abandon(errors.New("operation timed out"))
+			}
+		}
+	}
+}
+
+// timedOutResults returns a ModifyResponse containing failed results for each
+// operation sent by the client with ID cid whose deadline is before now, along
+// with the operations themselves, which are no longer tracked. The results are
+// ordered by operation ID. It returns nil if there are no such operations.
+func (s *Server) timedOutResults(cid string, now time.Time) (*spb.ModifyResponse, []*inflightOp) {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+
+	results := []*spb.AFTResult{}
+	var expired []*inflightOp
+	for k, op := range s.inflight {
+		if k.client != cid || !now.After(op.deadline) {
+			continue
+		}
+		delete(s.inflight, k)
+		expired = append(expired, op)
+		results = append(results, &spb.AFTResult{
+			Id:     k.id,
+			Status: spb.AFTResult_FAILED,
+			ErrorDetails: &spb.AFTErrorDetails{
+				ErrorMessage: fmt.Sprintf("TIMEOUT: operation %d was not acknowledged within %s", k.id, s.opTimeout),
+			},
+		})
+	}
+
+	if len(results) == 0 {
+		return nil, nil
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].GetId() < results[j].GetId() })
+	return &spb.ModifyResponse{Result: results}, expired
+}
+
+// clearOperations stops tracking the operations sent by the client with ID cid.
+func (s *Server) clearOperations(cid string) {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	for k := range s.inflight {
+		if k.client == cid {
+			delete(s.inflight, k)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/aft"
+	"github.com/openconfig/gribigo/rib"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+func TestOperationTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	// The mock FIB stalls programming next-hop 1 until release is closed, and
+	// programs all other entries immediately.
+	release := make(chan struct{})
+	hook := func(e rib.RIBEvent) error {
+		if nh, ok := e.Entry.(*aft.Afts_NextHop); ok && nh.GetIndex() == 1 {
+			go func() {
+				<-release
+				e.Done(nil)
+			}()
+			return nil
+		}
+		go e.Done(nil)
+		return nil
+	}
+
+	s, err := NewInProcess(WithRIBEventHook(hook), WithOperationTimeout(timeout))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+	if err != nil {
+		t.Fatalf("cannot open Modify RPC, %v", err)
+	}
+	for _, req := range []*spb.ModifyRequest{{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+			AckType:     spb.SessionParameters_RIB_AND_FIB_ACK,
+		},
+	}, {
+		ElectionId: &spb.Uint128{Low: 1},
+	}} {
+		if err := mc.Send(req); err != nil {
+			t.Fatalf("cannot send %s, %v", req, err)
+		}
+		if _, err := mc.Recv(); err != nil {
+			t.Fatalf("did not get response to %s, %v", req, err)
+		}
+	}
+
+	// recv returns the result within the next response received on the stream.
+	recv := func() *spb.AFTResult {
+		t.Helper()
+		res, err := mc.Recv()
+		if err != nil {
+			t.Fatalf("did not get response, %v", err)
+		}
+		if len(res.GetResult()) != 1 {
+			t.Fatalf("did not get expected number of results, got: %s", res)
+		}
+		return res.GetResult()[0]
+	}
+
+	start := time.Now()
+	if err := mc.Send(nhAddRequest(1)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	if r := recv(); r.GetId() != 1 || r.GetStatus() != spb.AFTResult_RIB_PROGRAMMED {
+		t.Fatalf("did not get RIB_PROGRAMMED result for operation 1, got: %s", r)
+	}
+	r := recv()
+	elapsed := time.Since(start)
+	if r.GetId() != 1 || r.GetStatus() != spb.AFTResult_FAILED || !strings.HasPrefix(r.GetErrorDetails().GetErrorMessage(), "TIMEOUT") {
+		t.Fatalf("did not get TIMEOUT result for stalled operation 1, got: %s", r)
+	}
+	// The NACK is expected once the timeout expires, with an allowance for the
+	// interval at which operations are checked and for scheduling delays.
+	if maxDelay := timeout + time.Second; elapsed < timeout || elapsed > maxDelay {
+		t.Errorf("did not get TIMEOUT result within expected time, got: %s, want: between %s and %s", elapsed, timeout, maxDelay)
+	}
+
+	// Once the stalled operation completes, its result is discarded, such that
+	// the next result received is for operation 2.
+	close(release)
+	if err := mc.Send(nhAddRequest(2)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	for _, want := range []spb.AFTResult_Status{spb.AFTResult_RIB_PROGRAMMED, spb.AFTResult_FIB_PROGRAMMED} {
+		if r := recv(); r.GetId() != 2 || r.GetStatus() != want {
+			t.Fatalf("did not get expected result for operation 2, got: %s, want status: %s", r, want)
+		}
+	}
+}
+
+func TestOperationTimeoutAbandonsEvent(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+
+	// The mock FIB never programs next-hop 1, and programs all other entries
+	// immediately. Only one event may be outstanding, such that the stalled
+	// event must be abandoned for any other event to be handed to the hook.
+	hook := func(e rib.RIBEvent) error {
+		if nh, ok := e.Entry.(*aft.Afts_NextHop); ok && nh.GetIndex() == 1 {
+			return nil
+		}
+		go e.Done(nil)
+		return nil
+	}
+
+	s, err := NewInProcess(WithRIBEventHook(hook), WithMaxOutstandingRIBEvents(1), WithOperationTimeout(timeout))
+	if err != nil {
+		t.Fatalf("cannot start in-process server, %v", err)
+	}
+	defer s.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mc, err := spb.NewGRIBIClient(s.Conn()).Modify(ctx)
+	if err != nil {
+		t.Fatalf("cannot open Modify RPC, %v", err)
+	}
+	for _, req := range []*spb.ModifyRequest{{
+		Params: &spb.SessionParameters{
+			Redundancy:  spb.SessionParameters_SINGLE_PRIMARY,
+			Persistence: spb.SessionParameters_PRESERVE,
+			AckType:     spb.SessionParameters_RIB_AND_FIB_ACK,
+		},
+	}, {
+		ElectionId: &spb.Uint128{Low: 1},
+	}} {
+		if err := mc.Send(req); err != nil {
+			t.Fatalf("cannot send %s, %v", req, err)
+		}
+		if _, err := mc.Recv(); err != nil {
+			t.Fatalf("did not get response to %s, %v", req, err)
+		}
+	}
+
+	// want receives the next response on the stream, and checks that it contains
+	// a single result for the operation with ID id, with the status st.
+	want := func(id uint64, st spb.AFTResult_Status) {
+		t.Helper()
+		res, err := mc.Recv()
+		if err != nil {
+			t.Fatalf("did not get response, %v", err)
+		}
+		if r := res.GetResult(); len(r) != 1 || r[0].GetId() != id || r[0].GetStatus() != st {
+			t.Fatalf("did not get expected result, got: %s, want: operation %d with status %s", res, id, st)
+		}
+	}
+
+	if err := mc.Send(nhAddRequest(1)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	want(1, spb.AFTResult_RIB_PROGRAMMED)
+	want(1, spb.AFTResult_FAILED)
+
+	// The slot held by the stalled event is released, such that the event for
+	// operation 2 is handed to the hook and its result is sent.
+	if err := mc.Send(nhAddRequest(2)); err != nil {
+		t.Fatalf("cannot send operation, %v", err)
+	}
+	want(2, spb.AFTResult_RIB_PROGRAMMED)
+	want(2, spb.AFTResult_FIB_PROGRAMMED)
+
+	// The stalled operation no longer holds the stream open, such that the
+	// server stops once the stream is idle.
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer stopCancel()
+	start := time.Now()
+	if err := s.Server.GracefulStop(stopCtx); err != nil {
+		t.Fatalf("did not get expected error from GracefulStop, got: %v, want: nil", err)
+	}
+	if elapsed, maxDelay := time.Since(start), 2*time.Second; elapsed > maxDelay {
+		t.Errorf("GracefulStop did not return promptly, got: %s, want: <= %s", elapsed, maxDelay)
+	}
+}
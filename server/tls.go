@@ -0,0 +1,174 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// WithTLS specifies the certificate that is presented by the server to clients
+// when TLS credentials are created for it using TransportCredentials.
+func WithTLS(cert tls.Certificate) *withTLS {
+	return &withTLS{cert: cert}
+}
+
+// withTLS is the internal implementation of WithTLS.
+type withTLS struct {
+	cert tls.Certificate
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*withTLS) isServerOpt() {}
+
+// WithTLSFromFiles specifies that the certificate presented by the server to
+// clients should be loaded from the PEM encoded certificate and key files
+// specified. The files are read again when Reload is called, such that a
+// long-running server can have its certificate rotated.
+func WithTLSFromFiles(certFile, keyFile string) *withTLSFiles {
+	return &withTLSFiles{certFile: certFile, keyFile: keyFile}
+}
+
+// withTLSFiles is the internal implementation of WithTLSFromFiles.
+type withTLSFiles struct {
+	certFile, keyFile string
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*withTLSFiles) isServerOpt() {}
+
+// WithClientCAs specifies the pool of certificate authorities that are used to
+// verify the certificates presented by clients. If require is true, clients
+// must present a certificate that is signed by one of the authorities, otherwise
+// a certificate is verified only if the client presents one. It must be used
+// alongside WithTLS or WithTLSFromFiles.
+func WithClientCAs(pool *x509.CertPool, require bool) *withClientCAs {
+	return &withClientCAs{pool: pool, require: require}
+}
+
+// withClientCAs is the internal implementation of WithClientCAs.
+type withClientCAs struct {
+	pool    *x509.CertPool
+	require bool
+}
+
+// isServerOpt implements the ServerOpt interface.
+func (*withClientCAs) isServerOpt() {}
+
+// tlsConfig stores the TLS configuration of the server.
+type tlsConfig struct {
+	// mu protects cert.
+	mu sync.RWMutex
+	// cert is the certificate that is presented to clients.
+	cert *tls.Certificate
+
+	// certFile and keyFile are the files that cert is loaded from, they are
+	// empty if the certificate was specified directly.
+	certFile, keyFile string
+
+	// clientCAs is the pool of authorities used to verify client certificates.
+	clientCAs *x509.CertPool
+	// requireClientCert indicates whether clients must present a certificate.
+	requireClientCert bool
+}
+
+// newTLSConfig returns the TLS configuration specified by the supplied options,
+// or nil if TLS is not configured.
+func newTLSConfig(opt []ServerOpt) (*tlsConfig, error) {
+	var (
+		c   *tlsConfig
+		cas *withClientCAs
+	)
+	for _, o := range opt {
+		switch v := o.(type) {
+		case *withTLS:
+			cert := v.cert
+			c = &tlsConfig{cert: &cert}
+		case *withTLSFiles:
+			c = &tlsConfig{certFile: v.certFile, keyFile: v.keyFile}
+			if err := c.load(); err != nil {
+				return nil, err
+			}
+		case *withClientCAs:
+			cas = v
+		}
+	}
+	if cas != nil {
+		if c == nil {
+			return nil, errors.New("client certificate authorities cannot be specified without a server certificate")
+		}
+		c.clientCAs, c.requireClientCert = cas.pool, cas.require
+	}
+	return c, nil
+}
+
+// load reads the certificate and key from the files specified in the
+// configuration.
+func (c *tlsConfig) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate from %s and %s, %v", c.certFile, c.keyFile, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// certificate returns the certificate that is currently presented to clients,
+// it implements the GetCertificate function of a tls.Config.
+func (c *tlsConfig) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// TransportCredentials returns the TLS credentials that should be used by the
+// gRPC server that the gRIBI server is registered to, as specified by the
+// WithTLS, WithTLSFromFiles and WithClientCAs options. It returns nil if the
+// server was not created with TLS options.
+func (s *Server) TransportCredentials() credentials.TransportCredentials {
+	if s.tls == nil {
+		return nil
+	}
+	cfg := &tls.Config{
+		GetCertificate: s.tls.certificate,
+	}
+	if s.tls.clientCAs != nil {
+		cfg.ClientCAs = s.tls.clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.tls.requireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return credentials.NewTLS(cfg)
+}
+
+// Reload reads the server's certificate from the files specified using
+// WithTLSFromFiles, such that connections that are subsequently established
+// use the new certificate. Existing connections are not affected. It returns
+// an error if the certificate was not loaded from files, or the files cannot
+// be read, in which case the existing certificate continues to be used.
+func (s *Server) Reload() error {
+	if s.tls == nil || s.tls.certFile == "" {
+		return errors.New("server TLS certificate was not loaded from files")
+	}
+	return s.tls.load()
+}
@@ -0,0 +1,309 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openconfig/gribigo/fluent"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	spb "github.com/openconfig/gribi/v1/proto/service"
+)
+
+// testCA is a certificate authority used to issue certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// newTestCA returns a new self-signed certificate authority.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key, %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create CA certificate, %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse CA certificate, %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns the PEM encoded certificate and key for a new certificate with
+// the specified serial number issued by the CA. The certificate is valid for
+// localhost.
+func (ca *testCA) issue(t *testing.T, serial int64) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key, %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("cannot create certificate, %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key, %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// keyPair returns a new tls.Certificate issued by the CA.
+func (ca *testCA) keyPair(t *testing.T, serial int64) tls.Certificate {
+	t.Helper()
+	c, k := ca.issue(t, serial)
+	cert, err := tls.X509KeyPair(c, k)
+	if err != nil {
+		t.Fatalf("cannot create key pair, %v", err)
+	}
+	return cert
+}
+
+// serveTLS starts a gRPC server using the transport credentials of s, and
+// returns the address that it is listening on.
+func serveTLS(t *testing.T, s *Server) string {
+	t.Helper()
+	gs := grpc.NewServer(grpc.Creds(s.TransportCredentials()))
+	spb.RegisterGRIBIServer(gs, s)
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("cannot listen, %v", err)
+	}
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+	return l.Addr().String()
+}
+
+// tlsGet dials addr using the supplied TLS configuration and performs a Get,
+// returning any error encountered.
+func tlsGet(addr string, cfg *tls.Config) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(credentials.NewTLS(cfg)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	gc, err := spb.NewGRIBIClient(conn).Get(ctx, &spb.GetRequest{
+		NetworkInstance: &spb.GetRequest_All{All: &spb.Empty{}},
+		Aft:             spb.AFTType_ALL,
+	})
+	if err != nil {
+		return err
+	}
+	// The server closes the stream once all entries, of which there are none,
+	// have been sent.
+	if _, err := gc.Recv(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	s, err := New(WithTLS(ca.keyPair(t, 2)))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	addr := serveTLS(t, s)
+
+	c := fluent.NewClient()
+	c.Connection().WithTarget(addr).WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: ca.pool}))
+	c.Start(context.Background(), t)
+	defer c.Stop(t)
+	if _, err := c.Get().WithNetworkInstance(DefaultNetworkInstanceName).WithAFT(fluent.AllAFTs).Send(); err != nil {
+		t.Fatalf("cannot perform Get using verified TLS, %v", err)
+	}
+
+	// A client that does not trust the CA cannot connect.
+	if err := tlsGet(addr, &tls.Config{}); err == nil {
+		t.Errorf("did not get expected error for client that does not trust the server certificate")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	clientCert := ca.keyPair(t, 3)
+	otherCert := newTestCA(t).keyPair(t, 4)
+
+	tests := []struct {
+		desc      string
+		inRequire bool
+		inCerts   []tls.Certificate
+		wantErr   bool
+	}{{
+		desc:      "required, certificate presented",
+		inRequire: true,
+		inCerts:   []tls.Certificate{clientCert},
+	}, {
+		desc:      "required, no certificate presented",
+		inRequire: true,
+		wantErr:   true,
+	}, {
+		desc:      "required, certificate from another CA",
+		inRequire: true,
+		inCerts:   []tls.Certificate{otherCert},
+		wantErr:   true,
+	}, {
+		desc: "optional, no certificate presented",
+	}, {
+		desc:    "optional, certificate from another CA",
+		inCerts: []tls.Certificate{otherCert},
+		wantErr: true,
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			s, err := New(WithTLS(ca.keyPair(t, 2)), WithClientCAs(ca.pool, tt.inRequire))
+			if err != nil {
+				t.Fatalf("cannot create server, %v", err)
+			}
+			addr := serveTLS(t, s)
+			err = tlsGet(addr, &tls.Config{RootCAs: ca.pool, Certificates: tt.inCerts})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("did not get expected error, got: %v, wantErr? %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(serial int64) {
+		t.Helper()
+		c, k := ca.issue(t, serial)
+		if err := os.WriteFile(certFile, c, 0600); err != nil {
+			t.Fatalf("cannot write certificate, %v", err)
+		}
+		if err := os.WriteFile(keyFile, k, 0600); err != nil {
+			t.Fatalf("cannot write key, %v", err)
+		}
+	}
+	serial := func(s *Server) int64 {
+		t.Helper()
+		c, err := s.tls.certificate(nil)
+		if err != nil {
+			t.Fatalf("cannot get certificate, %v", err)
+		}
+		x, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatalf("cannot parse certificate, %v", err)
+		}
+		return x.SerialNumber.Int64()
+	}
+
+	write(10)
+	s, err := New(WithTLSFromFiles(certFile, keyFile))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	addr := serveTLS(t, s)
+	if got, want := serial(s), int64(10); got != want {
+		t.Fatalf("did not get expected certificate, got serial: %d, want: %d", got, want)
+	}
+
+	write(11)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("cannot reload certificate, %v", err)
+	}
+	if got, want := serial(s), int64(11); got != want {
+		t.Fatalf("did not get expected certificate after reload, got serial: %d, want: %d", got, want)
+	}
+	if err := tlsGet(addr, &tls.Config{RootCAs: ca.pool}); err != nil {
+		t.Fatalf("cannot perform Get after reload, %v", err)
+	}
+
+	// A failed reload leaves the existing certificate in place.
+	if err := os.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("cannot write certificate, %v", err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Fatalf("did not get expected error reloading invalid certificate")
+	}
+	if got, want := serial(s), int64(11); got != want {
+		t.Fatalf("did not get expected certificate after failed reload, got serial: %d, want: %d", got, want)
+	}
+}
+
+func TestTLSOptionErrors(t *testing.T) {
+	if _, err := New(WithClientCAs(x509.NewCertPool(), true)); err == nil {
+		t.Errorf("did not get expected error for client CAs without a certificate")
+	}
+	if _, err := New(WithTLSFromFiles("does-not-exist.pem", "does-not-exist.key")); err == nil {
+		t.Errorf("did not get expected error for missing certificate files")
+	}
+
+	s, err := New(WithTLS(newTestCA(t).keyPair(t, 2)))
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Errorf("did not get expected error reloading certificate that was not loaded from files")
+	}
+
+	s, err = New()
+	if err != nil {
+		t.Fatalf("cannot create server, %v", err)
+	}
+	if c := s.TransportCredentials(); c != nil {
+		t.Errorf("did not get expected nil credentials for server without TLS, got: %v", c)
+	}
+}